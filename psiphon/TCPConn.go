@@ -62,6 +62,13 @@ func DialTCP(
 	var conn net.Conn
 	var err error
 
+	if config.HostResolver != nil && config.UpstreamProxyURL == "" {
+		addr, err = resolveDialAddr(ctx, addr, config)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
 	if config.UpstreamProxyURL != "" {
 		conn, err = proxiedTcpDial(ctx, addr, config)
 	} else {
@@ -91,6 +98,35 @@ func DialTCP(
 	return conn, nil
 }
 
+// resolveDialAddr resolves the domain name in addr using
+// config.HostResolver, and returns addr with the domain name replaced by
+// the first resolved IP address.
+func resolveDialAddr(
+	ctx context.Context, addr string, config *DialConfig) (string, error) {
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+
+	resolverDialConfig := *config
+	resolverDialConfig.HostResolver = nil
+
+	IPs, err := config.HostResolver.LookupIP(ctx, host, &resolverDialConfig)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+	if len(IPs) < 1 {
+		return "", common.ContextError(errors.New("no IP address"))
+	}
+
+	return net.JoinHostPort(IPs[0].String(), port), nil
+}
+
 // proxiedTcpDial wraps a tcpDial call in an upstreamproxy dial.
 func proxiedTcpDial(
 	ctx context.Context, addr string, config *DialConfig) (net.Conn, error) {
@@ -22,31 +22,83 @@ package common
 import (
 	"bufio"
 	"bytes"
-	"compress/zlib"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strconv"
+	"strings"
 	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ed25519"
+	"github.com/andybalholm/brotli"
 )
 
 // AuthenticatedDataPackage is a JSON record containing some Psiphon data
 // payload, such as list of Psiphon server entries. As it may be downloaded
 // from various sources, it is digitally signed so that the data may be
 // authenticated.
+//
+// A package may optionally carry a config overrides section, an opaque
+// payload. When present, the package signature covers both the data and the
+// config overrides, so config overrides can neither be moved to another
+// package nor removed from a package; see makeConfigOverridesPackageDigest.
+// Readers which predate config overrides reject packages with unknown
+// fields, so config overrides are carried only in versioned packages, which
+// those readers reject in any case. The config overrides section is omitted
+// from packages that don't include it.
+//
+// Two signature algorithms are supported: the legacy RSA PKCS #1 v1.5 with
+// SHA-256, and Ed25519 over the SHA-256 digest. The algorithm is determined
+// by the signing key. To allow for rolling signing key and algorithm
+// upgrades, readers may be configured with a comma-separated list of
+// acceptable signing public keys. The package is accepted when it's signed by
+// any one of the listed keys.
 type AuthenticatedDataPackage struct {
 	Data                   string `json:"data"`
 	SigningPublicKeyDigest []byte `json:"signingPublicKeyDigest"`
 	Signature              []byte `json:"signature"`
+	ConfigOverrides        []byte `json:"configOverrides,omitempty"`
 }
 
+// Authenticated data package format versions. Legacy packages have no format
+// header. Versioned packages begin with a format header, which consists of
+// authenticatedDataPackageFormatMagic followed by a single format version
+// byte; the format version selects the parser for the remainder of the
+// package. In format version 1, the remainder is a legacy package. In format
+// version 2, the remainder is a chunked package; see
+// WriteChunkedAuthenticatedDataPackage.
+//
+// Legacy packages are JSON, compressed with zlib or gzip, or not compressed.
+// The magic value begins with a zero byte, which can't begin a JSON, zlib, or
+// gzip encoding. Brotli has no identifying header, so it's never detected;
+// instead, format versions V1_BROTLI and V2_BROTLI are format versions 1 and
+// 2 with the remainder compressed with Brotli.
+const (
+	AUTHENTICATED_DATA_PACKAGE_FORMAT_LEGACY    = 0
+	AUTHENTICATED_DATA_PACKAGE_FORMAT_V1        = 1
+	AUTHENTICATED_DATA_PACKAGE_FORMAT_V2        = 2
+	AUTHENTICATED_DATA_PACKAGE_FORMAT_V1_BROTLI = 3
+	AUTHENTICATED_DATA_PACKAGE_FORMAT_V2_BROTLI = 4
+
+	AUTHENTICATED_DATA_PACKAGE_DEFAULT_CHUNK_SIZE = 65536
+)
+
+var authenticatedDataPackageFormatMagic = []byte("\x00PADP")
+
+// authenticatedDataPackageConfigOverridesLabel prefixes the signed digest of
+// packages with config overrides, distinguishing the digest from the signed
+// digests of packages without config overrides.
+var authenticatedDataPackageConfigOverridesLabel = []byte("\x00PADP config overrides")
+
 // GenerateAuthenticatedDataPackageKeys generates a key pair
 // be used to sign and verify AuthenticatedDataPackages.
 func GenerateAuthenticatedDataPackageKeys() (string, string, error) {
@@ -68,11 +120,157 @@ func GenerateAuthenticatedDataPackageKeys() (string, string, error) {
 		nil
 }
 
+// GenerateAuthenticatedDataPackageEd25519Keys generates an Ed25519 key pair
+// to be used to sign and verify AuthenticatedDataPackages.
+//
+// Unlike the RSA keys, which are base64 encoded DER structures, Ed25519 keys
+// are encoded as base64 raw key bytes. The encodings are distinguished by
+// length.
+func GenerateAuthenticatedDataPackageEd25519Keys() (string, string, error) {
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", ContextError(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(publicKey),
+		base64.StdEncoding.EncodeToString(privateKey),
+		nil
+}
+
+// authenticatedDataPackageKey is a parsed signing public key.
+type authenticatedDataPackageKey struct {
+	digest           []byte
+	rsaPublicKey     *rsa.PublicKey
+	ed25519PublicKey ed25519.PublicKey
+}
+
+// parseSigningPublicKeys parses a comma-separated list of signing public
+// keys.
+func parseSigningPublicKeys(signingPublicKeys string) ([]*authenticatedDataPackageKey, error) {
+
+	var keys []*authenticatedDataPackageKey
+
+	for _, signingPublicKey := range strings.Split(signingPublicKeys, ",") {
+
+		signingPublicKey = strings.TrimSpace(signingPublicKey)
+
+		decodedPublicKey, err := base64.StdEncoding.DecodeString(signingPublicKey)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+
+		key := &authenticatedDataPackageKey{
+			digest: sha256sum(signingPublicKey),
+		}
+
+		if len(decodedPublicKey) == ed25519.PublicKeySize {
+
+			key.ed25519PublicKey = ed25519.PublicKey(decodedPublicKey)
+
+		} else {
+
+			publicKey, err := x509.ParsePKIXPublicKey(decodedPublicKey)
+			if err != nil {
+				return nil, ContextError(err)
+			}
+			rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+			if !ok {
+				return nil, ContextError(errors.New("unexpected signing public key type"))
+			}
+			key.rsaPublicKey = rsaPublicKey
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// selectSigningPublicKey returns the key, from keys, with the specified
+// digest.
+func selectSigningPublicKey(
+	keys []*authenticatedDataPackageKey, digest []byte) (*authenticatedDataPackageKey, error) {
+
+	for _, key := range keys {
+		if 0 == bytes.Compare(key.digest, digest) {
+			return key, nil
+		}
+	}
+
+	return nil, ContextError(errors.New("unexpected signing public key digest"))
+}
+
+// verify checks that signature is a valid signature, made with the key, of
+// the specified SHA-256 digest.
+func (key *authenticatedDataPackageKey) verify(digest, signature []byte) error {
+
+	if key.ed25519PublicKey != nil {
+		if !ed25519.Verify(key.ed25519PublicKey, digest, signature) {
+			return ContextError(errors.New("invalid signature"))
+		}
+		return nil
+	}
+
+	err := rsa.VerifyPKCS1v15(key.rsaPublicKey, crypto.SHA256, digest, signature)
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// signAuthenticatedDataPackageDigest signs the specified SHA-256 digest with
+// the given RSA or Ed25519 private key.
+func signAuthenticatedDataPackageDigest(signingPrivateKey string, digest []byte) ([]byte, error) {
+
+	decodedPrivateKey, err := base64.StdEncoding.DecodeString(signingPrivateKey)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	if len(decodedPrivateKey) == ed25519.PrivateKeySize {
+		return ed25519.Sign(ed25519.PrivateKey(decodedPrivateKey), digest), nil
+	}
+
+	rsaPrivateKey, err := x509.ParsePKCS1PrivateKey(decodedPrivateKey)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	signature, err := rsa.SignPKCS1v15(
+		rand.Reader,
+		rsaPrivateKey,
+		crypto.SHA256,
+		digest)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	return signature, nil
+}
+
 func sha256sum(data string) []byte {
 	digest := sha256.Sum256([]byte(data))
 	return digest[:]
 }
 
+// makeConfigOverridesPackageDigest returns the SHA-256 digest, to be signed,
+// of a package with the specified data digest and config overrides. The
+// data digest is the digest which is signed when the package has no config
+// overrides: the SHA-256 digest of the data for legacy packages, or the
+// chunked package digest for chunked packages. When configOverrides is nil,
+// the data digest is returned.
+func makeConfigOverridesPackageDigest(dataDigest, configOverrides []byte) []byte {
+	if configOverrides == nil {
+		return dataDigest
+	}
+	hash := sha256.New()
+	hash.Write(authenticatedDataPackageConfigOverridesLabel)
+	hash.Write(dataDigest)
+	hash.Write(sha256sum(string(configOverrides)))
+	return hash.Sum(nil)
+}
+
 // WriteAuthenticatedDataPackage creates an AuthenticatedDataPackage
 // containing the specified data and signed by the given key. The output
 // conforms with the legacy format here:
@@ -80,50 +278,323 @@ func sha256sum(data string) []byte {
 func WriteAuthenticatedDataPackage(
 	data string, signingPublicKey, signingPrivateKey string) ([]byte, error) {
 
-	derEncodedPrivateKey, err := base64.StdEncoding.DecodeString(signingPrivateKey)
+	return WriteAuthenticatedDataPackageWithConfigOverrides(
+		data, nil, signingPublicKey, signingPrivateKey)
+}
+
+// WriteAuthenticatedDataPackageWithConfigOverrides is
+// WriteAuthenticatedDataPackage with an additional config overrides section,
+// which is signed, along with the data, by the given key. When
+// configOverrides is nil, the output is identical to
+// WriteAuthenticatedDataPackage. Otherwise, as config overrides are carried
+// only in versioned packages, the output is a format version 1 package.
+func WriteAuthenticatedDataPackageWithConfigOverrides(
+	data string,
+	configOverrides []byte,
+	signingPublicKey, signingPrivateKey string) ([]byte, error) {
+
+	formatVersion := AUTHENTICATED_DATA_PACKAGE_FORMAT_LEGACY
+	if configOverrides != nil {
+		formatVersion = AUTHENTICATED_DATA_PACKAGE_FORMAT_V1
+	}
+
+	return WriteAuthenticatedDataPackageWithFormat(
+		data, configOverrides, formatVersion, signingPublicKey, signingPrivateKey)
+}
+
+// writeLegacyAuthenticatedDataPackage creates a legacy package, which is
+// also the remainder of a format version 1 package, compressed with
+// compress.
+func writeLegacyAuthenticatedDataPackage(
+	data string,
+	configOverrides []byte,
+	compress func([]byte) []byte,
+	signingPublicKey, signingPrivateKey string) ([]byte, error) {
+
+	signature, err := signAuthenticatedDataPackageDigest(
+		signingPrivateKey,
+		makeConfigOverridesPackageDigest(sha256sum(data), configOverrides))
 	if err != nil {
 		return nil, ContextError(err)
 	}
-	rsaPrivateKey, err := x509.ParsePKCS1PrivateKey(derEncodedPrivateKey)
+
+	packageJSON, err := json.Marshal(
+		&AuthenticatedDataPackage{
+			Data:                   data,
+			SigningPublicKeyDigest: sha256sum(signingPublicKey),
+			Signature:              signature,
+			ConfigOverrides:        configOverrides,
+		})
 	if err != nil {
 		return nil, ContextError(err)
 	}
 
-	signature, err := rsa.SignPKCS1v15(
-		rand.Reader,
-		rsaPrivateKey,
-		crypto.SHA256,
-		sha256sum(data))
+	return compress(packageJSON), nil
+}
+
+// WriteAuthenticatedDataPackageWithFormat is
+// WriteAuthenticatedDataPackageWithConfigOverrides with the specified format
+// version. For AUTHENTICATED_DATA_PACKAGE_FORMAT_LEGACY, the output is
+// identical to WriteAuthenticatedDataPackage, and config overrides are
+// rejected; otherwise, the output begins with a format header. Versioned
+// packages are rejected by readers which predate format versions, so the
+// legacy format should be used while such readers remain in use.
+func WriteAuthenticatedDataPackageWithFormat(
+	data string,
+	configOverrides []byte,
+	formatVersion int,
+	signingPublicKey, signingPrivateKey string) ([]byte, error) {
+
+	switch formatVersion {
+	case AUTHENTICATED_DATA_PACKAGE_FORMAT_LEGACY:
+		if configOverrides != nil {
+			return nil, ContextError(errLegacyPackageConfigOverrides)
+		}
+		legacyPackage, err := writeLegacyAuthenticatedDataPackage(
+			data, nil, Compress, signingPublicKey, signingPrivateKey)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		return legacyPackage, nil
+	case AUTHENTICATED_DATA_PACKAGE_FORMAT_V1, AUTHENTICATED_DATA_PACKAGE_FORMAT_V1_BROTLI:
+		legacyPackage, err := writeLegacyAuthenticatedDataPackage(
+			data,
+			configOverrides,
+			getAuthenticatedDataPackageCompressor(formatVersion),
+			signingPublicKey,
+			signingPrivateKey)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		return append(makeAuthenticatedDataPackageFormatHeader(formatVersion), legacyPackage...), nil
+	case AUTHENTICATED_DATA_PACKAGE_FORMAT_V2, AUTHENTICATED_DATA_PACKAGE_FORMAT_V2_BROTLI:
+		return writeChunkedAuthenticatedDataPackage(
+			data,
+			configOverrides,
+			AUTHENTICATED_DATA_PACKAGE_DEFAULT_CHUNK_SIZE,
+			formatVersion,
+			signingPublicKey,
+			signingPrivateKey)
+	}
+
+	return nil, ContextError(
+		fmt.Errorf("unsupported package format version: %d", formatVersion))
+}
+
+// errLegacyPackageConfigOverrides is the error for a legacy package with
+// config overrides, which readers which predate config overrides can't read.
+var errLegacyPackageConfigOverrides = errors.New(
+	"config overrides require a versioned package format")
+
+func makeAuthenticatedDataPackageFormatHeader(formatVersion int) []byte {
+	return append(
+		append([]byte(nil), authenticatedDataPackageFormatMagic...),
+		byte(formatVersion))
+}
+
+// isChunkedAuthenticatedDataPackageFormat checks if the format version is a
+// chunked package format.
+func isChunkedAuthenticatedDataPackageFormat(formatVersion int) bool {
+	return formatVersion == AUTHENTICATED_DATA_PACKAGE_FORMAT_V2 ||
+		formatVersion == AUTHENTICATED_DATA_PACKAGE_FORMAT_V2_BROTLI
+}
+
+// isBrotliAuthenticatedDataPackageFormat checks if the format version
+// specifies Brotli compression.
+func isBrotliAuthenticatedDataPackageFormat(formatVersion int) bool {
+	return formatVersion == AUTHENTICATED_DATA_PACKAGE_FORMAT_V1_BROTLI ||
+		formatVersion == AUTHENTICATED_DATA_PACKAGE_FORMAT_V2_BROTLI
+}
+
+// getAuthenticatedDataPackageCompressor returns the compressor for the
+// remainder of a package in the specified format version.
+func getAuthenticatedDataPackageCompressor(formatVersion int) func([]byte) []byte {
+	if isBrotliAuthenticatedDataPackageFormat(formatVersion) {
+		return compressBrotli
+	}
+	return Compress
+}
+
+// compressBrotli returns Brotli compressed data.
+func compressBrotli(data []byte) []byte {
+	var compressedData bytes.Buffer
+	writer := brotli.NewWriter(&compressedData)
+	writer.Write(data)
+	writer.Close()
+	return compressedData.Bytes()
+}
+
+// chunkedAuthenticatedDataPackage is the format version 2 package record.
+//
+// The data is divided into consecutive ChunkSize byte chunks, the last of
+// which may be shorter, and ChunkDigests is the concatenation of the SHA-256
+// digest of each chunk. Signature signs the chunked package digest, which
+// covers the chunk size and the chunk digests, along with any config
+// overrides, so only the signature and the chunk digests need to be verified
+// before any data is read. Each chunk is
+// then verified as it's read, and the data in a verified chunk may be
+// processed before the following chunks are read.
+//
+// Since the package is streamed in a single pass, the data field is encoded
+// last, after all of the fields required to verify it.
+type chunkedAuthenticatedDataPackage struct {
+	SigningPublicKeyDigest []byte `json:"signingPublicKeyDigest"`
+	Signature              []byte `json:"signature"`
+	ChunkSize              int    `json:"chunkSize,string"`
+	ChunkDigests           []byte `json:"chunkDigests"`
+	ConfigOverrides        []byte `json:"configOverrides,omitempty"`
+	Data                   string `json:"data"`
+}
+
+// makeChunkedAuthenticatedDataPackageDigest returns the SHA-256 digest, to
+// be signed, of the chunk size and chunk digests.
+func makeChunkedAuthenticatedDataPackageDigest(chunkSize int, chunkDigests []byte) []byte {
+	hash := sha256.New()
+	var encodedChunkSize [8]byte
+	binary.BigEndian.PutUint64(encodedChunkSize[:], uint64(chunkSize))
+	hash.Write(encodedChunkSize[:])
+	hash.Write(chunkDigests)
+	return hash.Sum(nil)
+}
+
+// WriteChunkedAuthenticatedDataPackage creates a format version 2, chunked,
+// AuthenticatedDataPackage containing the specified data, divided into
+// chunks of chunkSize bytes, and the optional config overrides, signed by
+// the given key. Readers of a chunked package verify and release the
+// payload one chunk at a time, rather than verifying the entire payload
+// before releasing any of it; so, for large payloads, processing may start
+// as soon as the first chunk is read. As with other versioned packages,
+// chunked packages are rejected by readers which predate the format.
+func WriteChunkedAuthenticatedDataPackage(
+	data string,
+	configOverrides []byte,
+	chunkSize int,
+	signingPublicKey, signingPrivateKey string) ([]byte, error) {
+
+	return writeChunkedAuthenticatedDataPackage(
+		data,
+		configOverrides,
+		chunkSize,
+		AUTHENTICATED_DATA_PACKAGE_FORMAT_V2,
+		signingPublicKey,
+		signingPrivateKey)
+}
+
+// writeChunkedAuthenticatedDataPackage is
+// WriteChunkedAuthenticatedDataPackage with the specified chunked package
+// format version, which selects the compression.
+func writeChunkedAuthenticatedDataPackage(
+	data string,
+	configOverrides []byte,
+	chunkSize int,
+	formatVersion int,
+	signingPublicKey, signingPrivateKey string) ([]byte, error) {
+
+	if chunkSize <= 0 {
+		return nil, ContextError(fmt.Errorf("invalid chunk size: %d", chunkSize))
+	}
+
+	// ChunkDigests is encoded as an empty string, rather than null, for empty
+	// data, as the streaming reader supports only string values.
+	chunkDigests := []byte{}
+	for i := 0; i < len(data); i += chunkSize {
+		end := i + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunkDigests = append(chunkDigests, sha256sum(data[i:end])...)
+	}
+
+	signature, err := signAuthenticatedDataPackageDigest(
+		signingPrivateKey,
+		makeConfigOverridesPackageDigest(
+			makeChunkedAuthenticatedDataPackageDigest(chunkSize, chunkDigests),
+			configOverrides))
 	if err != nil {
 		return nil, ContextError(err)
 	}
 
 	packageJSON, err := json.Marshal(
-		&AuthenticatedDataPackage{
-			Data: data,
+		&chunkedAuthenticatedDataPackage{
 			SigningPublicKeyDigest: sha256sum(signingPublicKey),
 			Signature:              signature,
+			ChunkSize:              chunkSize,
+			ChunkDigests:           chunkDigests,
+			ConfigOverrides:        configOverrides,
+			Data:                   data,
 		})
 	if err != nil {
 		return nil, ContextError(err)
 	}
 
-	return Compress(packageJSON), nil
+	return append(
+		makeAuthenticatedDataPackageFormatHeader(formatVersion),
+		getAuthenticatedDataPackageCompressor(formatVersion)(packageJSON)...), nil
+}
+
+// ParseAuthenticatedDataPackageFormat returns the format version and the
+// format header length of a package which begins with the specified prefix.
+// The prefix need not include any more of the package than the format
+// header. Packages without a format header are legacy packages. Callers which
+// inspect the compressed package directly must skip the format header.
+func ParseAuthenticatedDataPackageFormat(prefix []byte) (int, int, error) {
+
+	if !bytes.HasPrefix(prefix, authenticatedDataPackageFormatMagic) {
+		return AUTHENTICATED_DATA_PACKAGE_FORMAT_LEGACY, 0, nil
+	}
+
+	headerLength := len(authenticatedDataPackageFormatMagic) + 1
+	if len(prefix) < headerLength {
+		return 0, 0, ContextError(errors.New("truncated package format header"))
+	}
+
+	formatVersion := int(prefix[headerLength-1])
+
+	switch formatVersion {
+	case AUTHENTICATED_DATA_PACKAGE_FORMAT_V1,
+		AUTHENTICATED_DATA_PACKAGE_FORMAT_V2,
+		AUTHENTICATED_DATA_PACKAGE_FORMAT_V1_BROTLI,
+		AUTHENTICATED_DATA_PACKAGE_FORMAT_V2_BROTLI:
+		return formatVersion, headerLength, nil
+	}
+
+	return 0, 0, ContextError(
+		fmt.Errorf("unsupported package format version: %d", formatVersion))
 }
 
 // ReadAuthenticatedDataPackage extracts and verifies authenticated
 // data from an AuthenticatedDataPackage. The package must have been
-// signed with the given key.
+// signed with the given key, or with one of the keys in a comma-separated
+// list of keys.
 //
-// Set isCompressed to false to read packages that are not compressed.
+// Set isCompressed to false to read packages that are not compressed. When
+// isCompressed is true, the compression codec is selected as in
+// NewAuthenticatedDataPackageDecompressor, and packages that are not
+// compressed are also accepted.
+//
+// Both legacy and versioned packages are accepted; see
+// WriteAuthenticatedDataPackageWithFormat.
 func ReadAuthenticatedDataPackage(
 	dataPackage []byte, isCompressed bool, signingPublicKey string) (string, error) {
 
+	// Format version 1 wraps a legacy package, which is parsed below. Format
+	// version 2 is parsed separately.
+
+	formatVersion, headerLength, err := ParseAuthenticatedDataPackageFormat(dataPackage)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	dataPackage = dataPackage[headerLength:]
+
 	var packageJSON []byte
-	var err error
 
 	if isCompressed {
-		packageJSON, err = Decompress(dataPackage)
+		decompressor, err := NewAuthenticatedDataPackageDecompressor(
+			bytes.NewReader(dataPackage), formatVersion, nil)
+		if err != nil {
+			return "", ContextError(err)
+		}
+		packageJSON, err = ioutil.ReadAll(decompressor)
 		if err != nil {
 			return "", ContextError(err)
 		}
@@ -131,47 +602,139 @@ func ReadAuthenticatedDataPackage(
 		packageJSON = dataPackage
 	}
 
+	if isChunkedAuthenticatedDataPackageFormat(formatVersion) {
+		data, err := readChunkedAuthenticatedDataPackage(packageJSON, signingPublicKey)
+		if err != nil {
+			return "", ContextError(err)
+		}
+		return data, nil
+	}
+
 	var authenticatedDataPackage *AuthenticatedDataPackage
 	err = json.Unmarshal(packageJSON, &authenticatedDataPackage)
 	if err != nil {
 		return "", ContextError(err)
 	}
 
-	derEncodedPublicKey, err := base64.StdEncoding.DecodeString(signingPublicKey)
+	if formatVersion == AUTHENTICATED_DATA_PACKAGE_FORMAT_LEGACY &&
+		authenticatedDataPackage.ConfigOverrides != nil {
+
+		return "", ContextError(errLegacyPackageConfigOverrides)
+	}
+
+	keys, err := parseSigningPublicKeys(signingPublicKey)
 	if err != nil {
 		return "", ContextError(err)
 	}
-	publicKey, err := x509.ParsePKIXPublicKey(derEncodedPublicKey)
+
+	key, err := selectSigningPublicKey(
+		keys, authenticatedDataPackage.SigningPublicKeyDigest)
 	if err != nil {
 		return "", ContextError(err)
 	}
-	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
-	if !ok {
-		return "", ContextError(errors.New("unexpected signing public key type"))
+
+	err = key.verify(
+		makeConfigOverridesPackageDigest(
+			sha256sum(authenticatedDataPackage.Data),
+			authenticatedDataPackage.ConfigOverrides),
+		authenticatedDataPackage.Signature)
+	if err != nil {
+		return "", ContextError(err)
 	}
 
-	if 0 != bytes.Compare(
-		authenticatedDataPackage.SigningPublicKeyDigest,
-		sha256sum(signingPublicKey)) {
+	return authenticatedDataPackage.Data, nil
+}
 
-		return "", ContextError(errors.New("unexpected signing public key digest"))
+// NewAuthenticatedDataPackageDecompressor returns an io.Reader that streams
+// the package JSON read from dataPackage, which follows the format header of
+// a package in the specified format version. Brotli is selected by the
+// format version. Otherwise, the compression codec is detected as in
+// NewDecompressingReaderWithDictionary, except that a package which is not
+// compressed, as identified by isUncompressedAuthenticatedDataPackage, is
+// streamed as is. ErrUnrecognizedCompression is returned, unwrapped, for a
+// package in none of these codecs.
+func NewAuthenticatedDataPackageDecompressor(
+	dataPackage io.Reader, formatVersion int, dictionary []byte) (io.Reader, error) {
+
+	if isBrotliAuthenticatedDataPackageFormat(formatVersion) {
+		return brotli.NewReader(dataPackage), nil
 	}
 
-	err = rsa.VerifyPKCS1v15(
-		rsaPublicKey,
-		crypto.SHA256,
-		sha256sum(authenticatedDataPackage.Data),
-		authenticatedDataPackage.Signature)
+	bufferedReader := bufio.NewReader(dataPackage)
+
+	// Any Peek error is left for the JSON streamer or decompressor to report.
+	header, _ := bufferedReader.Peek(1)
+
+	if isUncompressedAuthenticatedDataPackage(header) {
+		return bufferedReader, nil
+	}
+
+	decompressor, err := NewDecompressingReaderWithDictionary(bufferedReader, dictionary)
+	if err == ErrUnrecognizedCompression {
+		return nil, err
+	}
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return decompressor, nil
+}
+
+// isUncompressedAuthenticatedDataPackage checks if the package JSON, which
+// follows any format header, is not compressed: the package begins with '{',
+// which opens the JSON object. Neither zlib nor gzip data can begin with
+// '{', so no compressed package is misidentified.
+func isUncompressedAuthenticatedDataPackage(header []byte) bool {
+	return len(header) > 0 && header[0] == '{'
+}
+
+// readChunkedAuthenticatedDataPackage extracts and verifies the data from a
+// decompressed format version 2 package.
+func readChunkedAuthenticatedDataPackage(
+	packageJSON []byte, signingPublicKey string) (string, error) {
+
+	var chunkedPackage *chunkedAuthenticatedDataPackage
+	err := json.Unmarshal(packageJSON, &chunkedPackage)
 	if err != nil {
 		return "", ContextError(err)
 	}
 
-	return authenticatedDataPackage.Data, nil
+	if chunkedPackage == nil {
+		return "", ContextError(errors.New("missing expected field"))
+	}
+
+	keys, err := parseSigningPublicKeys(signingPublicKey)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	key, err := selectSigningPublicKey(keys, chunkedPackage.SigningPublicKeyDigest)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	reader, err := newChunkVerifyingReader(
+		strings.NewReader(chunkedPackage.Data),
+		key,
+		chunkedPackage.Signature,
+		chunkedPackage.ChunkSize,
+		chunkedPackage.ChunkDigests,
+		chunkedPackage.ConfigOverrides)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	return string(data), nil
 }
 
 // NewAuthenticatedDataPackageReader extracts and verifies authenticated
 // data from an AuthenticatedDataPackage stored in the specified file. The
-// package must have been signed with the given key.
+// package must have been signed with the given key, or with one of the keys
+// in a comma-separated list of keys.
 // NewAuthenticatedDataPackageReader does not load the entire package nor
 // the entire data into memory. It streams the package while verifying, and
 // returns an io.Reader that the caller may use to stream the authenticated
@@ -179,6 +742,37 @@ func ReadAuthenticatedDataPackage(
 func NewAuthenticatedDataPackageReader(
 	dataPackage io.ReadSeeker, signingPublicKey string) (io.Reader, error) {
 
+	payload, _, err := NewAuthenticatedDataPackageReaderWithConfigOverrides(
+		dataPackage, signingPublicKey)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	return payload, nil
+}
+
+// NewAuthenticatedDataPackageReaderWithConfigOverrides is
+// NewAuthenticatedDataPackageReader and additionally returns the verified
+// config overrides section, if present. The returned config overrides is nil
+// when the package has no config overrides section. When the section is
+// present, its signature must be valid or the entire package is rejected.
+func NewAuthenticatedDataPackageReaderWithConfigOverrides(
+	dataPackage io.ReadSeeker, signingPublicKey string) (io.Reader, []byte, error) {
+
+	return NewAuthenticatedDataPackageReaderWithDictionary(
+		dataPackage, signingPublicKey, nil)
+}
+
+// NewAuthenticatedDataPackageReaderWithDictionary is
+// NewAuthenticatedDataPackageReaderWithConfigOverrides with a zlib preset
+// dictionary used to decompress the package. A package compressed with a
+// dictionary is rejected when dictionary is nil or is not the dictionary
+// used for compression. See NewDecompressingReaderWithDictionary.
+func NewAuthenticatedDataPackageReaderWithDictionary(
+	dataPackage io.ReadSeeker,
+	signingPublicKey string,
+	dictionary []byte) (io.Reader, []byte, error) {
+
 	// The file is streamed in 2 passes. The first pass verifies the package
 	// signature. No payload data should be accepted/processed until the signature
 	// check is complete. The second pass repositions to the data payload and returns
@@ -190,18 +784,51 @@ func NewAuthenticatedDataPackageReader(
 	// will not change while the returned io.Reader is used -- unless the client host
 	// is compromised; a compromised client host is outside of our threat model.
 
+	// Read the format header, if any. As in ReadAuthenticatedDataPackage,
+	// all supported format versions wrap a legacy package, which is streamed
+	// starting after the format header.
+
+	_, err := dataPackage.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, nil, ContextError(err)
+	}
+
+	prefix := make([]byte, len(authenticatedDataPackageFormatMagic)+1)
+	n, err := io.ReadFull(dataPackage, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, ContextError(err)
+	}
+
+	formatVersion, headerLength, err := ParseAuthenticatedDataPackageFormat(prefix[:n])
+	if err != nil {
+		return nil, nil, ContextError(err)
+	}
+
+	if isChunkedAuthenticatedDataPackageFormat(formatVersion) {
+		payload, configOverrides, err := newChunkedAuthenticatedDataPackageReader(
+			dataPackage, int64(headerLength), formatVersion, signingPublicKey, dictionary)
+		if err != nil {
+			return nil, nil, ContextError(err)
+		}
+		return payload, configOverrides, nil
+	}
+
 	var payload io.Reader
+	var jsonConfigOverrides []byte
 
 	for pass := 0; pass < 2; pass++ {
 
-		_, err := dataPackage.Seek(0, io.SeekStart)
+		_, err := dataPackage.Seek(int64(headerLength), io.SeekStart)
 		if err != nil {
-			return nil, ContextError(err)
+			return nil, nil, ContextError(err)
 		}
 
-		decompressor, err := zlib.NewReader(dataPackage)
+		// The package may be compressed with zlib, gzip, or, as specified by
+		// the format version, Brotli, or not compressed.
+		decompressor, err := NewAuthenticatedDataPackageDecompressor(
+			dataPackage, formatVersion, dictionary)
 		if err != nil {
-			return nil, ContextError(err)
+			return nil, nil, ContextError(err)
 		}
 		// TODO: need to Close decompressor to ensure zlib checksum is verified?
 
@@ -258,12 +885,19 @@ func NewAuthenticatedDataPackageReader(
 					return false, ContextError(err)
 				}
 				return true, nil
+
+			case "configOverrides":
+				jsonConfigOverrides, err = jsonReadBase64Value(value)
+				if err != nil {
+					return false, ContextError(err)
+				}
+				return true, nil
 			}
 
 			return false, ContextError(fmt.Errorf("unexpected key '%s'", key))
 		}
 
-		// Using a buffered reader to consume zlib output in batches
+		// Using a buffered reader to consume decompressed output in batches
 		// yields a significant speed up in the BenchmarkAuthenticatedPackage.
 		jsonStreamer := &limitedJSONStreamer{
 			reader:  bufio.NewReader(decompressor),
@@ -272,52 +906,303 @@ func NewAuthenticatedDataPackageReader(
 
 		err = jsonStreamer.Stream()
 		if err != nil {
-			return nil, ContextError(err)
+			return nil, nil, ContextError(err)
 		}
 
 		if pass == 0 {
 
 			if jsonSigningPublicKey == nil || jsonSignature == nil {
-				return nil, ContextError(errors.New("missing expected field"))
+				return nil, nil, ContextError(errors.New("missing expected field"))
 			}
 
-			derEncodedPublicKey, err := base64.StdEncoding.DecodeString(signingPublicKey)
-			if err != nil {
-				return nil, ContextError(err)
+			if formatVersion == AUTHENTICATED_DATA_PACKAGE_FORMAT_LEGACY &&
+				jsonConfigOverrides != nil {
+
+				return nil, nil, ContextError(errLegacyPackageConfigOverrides)
 			}
-			publicKey, err := x509.ParsePKIXPublicKey(derEncodedPublicKey)
+
+			keys, err := parseSigningPublicKeys(signingPublicKey)
 			if err != nil {
-				return nil, ContextError(err)
-			}
-			rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
-			if !ok {
-				return nil, ContextError(errors.New("unexpected signing public key type"))
+				return nil, nil, ContextError(err)
 			}
 
-			if 0 != bytes.Compare(jsonSigningPublicKey, sha256sum(signingPublicKey)) {
-				return nil, ContextError(errors.New("unexpected signing public key digest"))
+			key, err := selectSigningPublicKey(keys, jsonSigningPublicKey)
+			if err != nil {
+				return nil, nil, ContextError(err)
 			}
 
-			err = rsa.VerifyPKCS1v15(
-				rsaPublicKey,
-				crypto.SHA256,
-				hash.Sum(nil),
+			err = key.verify(
+				makeConfigOverridesPackageDigest(hash.Sum(nil), jsonConfigOverrides),
 				jsonSignature)
 			if err != nil {
-				return nil, ContextError(err)
+				return nil, nil, ContextError(err)
 			}
 
 		} else { // pass == 1
 
 			if jsonData == nil {
-				return nil, ContextError(errors.New("missing expected field"))
+				return nil, nil, ContextError(errors.New("missing expected field"))
 			}
 
 			payload = jsonData
 		}
 	}
 
-	return payload, nil
+	return payload, jsonConfigOverrides, nil
+}
+
+// newChunkedAuthenticatedDataPackageReader streams a chunked package in the
+// specified format version, starting at offset, in a single pass. The
+// signature and the chunk digests, which precede the data, are verified
+// first; then the returned
+// reader verifies each chunk of the data payload before returning any of the
+// chunk. When a chunk fails verification, the reader returns a
+// ChunkVerificationError, and none of that chunk, or of the following
+// chunks, is returned.
+func newChunkedAuthenticatedDataPackageReader(
+	dataPackage io.ReadSeeker,
+	offset int64,
+	formatVersion int,
+	signingPublicKey string,
+	dictionary []byte) (io.Reader, []byte, error) {
+
+	_, err := dataPackage.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, nil, ContextError(err)
+	}
+
+	decompressor, err := NewAuthenticatedDataPackageDecompressor(
+		dataPackage, formatVersion, dictionary)
+	if err != nil {
+		return nil, nil, ContextError(err)
+	}
+
+	var jsonData io.Reader
+	var jsonSigningPublicKey []byte
+	var jsonSignature []byte
+	var jsonChunkSize []byte
+	var jsonChunkDigests []byte
+	var jsonConfigOverrides []byte
+
+	jsonReadBase64Value := func(value io.Reader) ([]byte, error) {
+		base64Value, err := ioutil.ReadAll(value)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		decodedValue, err := base64.StdEncoding.DecodeString(string(base64Value))
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		return decodedValue, nil
+	}
+
+	jsonHandler := func(key string, value io.Reader) (bool, error) {
+		switch key {
+
+		case "data":
+			jsonData = value
+
+			// As in the second pass of the legacy package reader, the JSON
+			// stream parser must halt at this position.
+			return false, nil
+
+		case "signingPublicKeyDigest":
+			jsonSigningPublicKey, err = jsonReadBase64Value(value)
+
+		case "signature":
+			jsonSignature, err = jsonReadBase64Value(value)
+
+		case "chunkSize":
+			jsonChunkSize, err = ioutil.ReadAll(value)
+
+		case "chunkDigests":
+			jsonChunkDigests, err = jsonReadBase64Value(value)
+
+		case "configOverrides":
+			jsonConfigOverrides, err = jsonReadBase64Value(value)
+
+		default:
+			return false, ContextError(fmt.Errorf("unexpected key '%s'", key))
+		}
+
+		if err != nil {
+			return false, ContextError(err)
+		}
+		return true, nil
+	}
+
+	jsonStreamer := &limitedJSONStreamer{
+		reader:  bufio.NewReader(decompressor),
+		handler: jsonHandler,
+	}
+
+	err = jsonStreamer.Stream()
+	if err != nil {
+		return nil, nil, ContextError(err)
+	}
+
+	if jsonData == nil ||
+		jsonSigningPublicKey == nil ||
+		jsonSignature == nil ||
+		jsonChunkSize == nil {
+
+		return nil, nil, ContextError(errors.New("missing expected field"))
+	}
+
+	chunkSize, err := strconv.Atoi(string(jsonChunkSize))
+	if err != nil {
+		return nil, nil, ContextError(err)
+	}
+
+	keys, err := parseSigningPublicKeys(signingPublicKey)
+	if err != nil {
+		return nil, nil, ContextError(err)
+	}
+
+	key, err := selectSigningPublicKey(keys, jsonSigningPublicKey)
+	if err != nil {
+		return nil, nil, ContextError(err)
+	}
+
+	payload, err := newChunkVerifyingReader(
+		jsonData, key, jsonSignature, chunkSize, jsonChunkDigests, jsonConfigOverrides)
+	if err != nil {
+		return nil, nil, ContextError(err)
+	}
+
+	return payload, jsonConfigOverrides, nil
+}
+
+// ChunkVerificationError is returned, unwrapped, by the payload reader of a
+// chunked package when a chunk fails verification, or when the payload is
+// truncated or extended. All payload data read before the error is from
+// verified chunks, so, unlike other package errors, callers may keep what
+// they've processed. Chunk is the index of the offending chunk.
+type ChunkVerificationError struct {
+	Chunk int
+	Err   error
+}
+
+// Error implements the error interface.
+func (err ChunkVerificationError) Error() string {
+	return fmt.Sprintf("chunk verification error: chunk %d: %s", err.Chunk, err.Err)
+}
+
+// chunkVerifyingReader streams the data payload of a chunked package,
+// verifying each chunk against its signed digest before returning it.
+// Errors are permanent: once a chunk fails verification, or the payload is
+// truncated or extended, all further reads fail.
+type chunkVerifyingReader struct {
+	reader       io.Reader
+	chunkSize    int
+	chunkDigests []byte
+	chunkIndex   int
+	chunk        []byte
+	verified     []byte
+	err          error
+}
+
+// newChunkVerifyingReader verifies that signature, made with key, signs the
+// chunk size and chunk digests, along with any config overrides, and returns
+// a reader which verifies the data read from reader, chunk by chunk.
+func newChunkVerifyingReader(
+	reader io.Reader,
+	key *authenticatedDataPackageKey,
+	signature []byte,
+	chunkSize int,
+	chunkDigests []byte,
+	configOverrides []byte) (*chunkVerifyingReader, error) {
+
+	if chunkSize <= 0 || len(chunkDigests)%sha256.Size != 0 {
+		return nil, ContextError(errors.New("invalid chunks"))
+	}
+
+	err := key.verify(
+		makeConfigOverridesPackageDigest(
+			makeChunkedAuthenticatedDataPackageDigest(chunkSize, chunkDigests),
+			configOverrides),
+		signature)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	return &chunkVerifyingReader{
+		reader:       reader,
+		chunkSize:    chunkSize,
+		chunkDigests: chunkDigests,
+	}, nil
+}
+
+// Read implements the io.Reader interface.
+func (reader *chunkVerifyingReader) Read(p []byte) (int, error) {
+
+	if len(reader.verified) == 0 && reader.err == nil {
+		reader.err = reader.verifyNextChunk()
+	}
+
+	if len(reader.verified) == 0 {
+		return 0, reader.err
+	}
+
+	n := copy(p, reader.verified)
+	reader.verified = reader.verified[n:]
+	return n, nil
+}
+
+// verifyNextChunk reads and verifies the next chunk. It returns io.EOF once
+// every chunk has been read and verified, and otherwise fails with a
+// ChunkVerificationError.
+func (reader *chunkVerifyingReader) verifyNextChunk() error {
+
+	err := reader.readNextChunk()
+	if err != nil && err != io.EOF {
+		return ChunkVerificationError{
+			Chunk: reader.chunkIndex,
+			Err:   err,
+		}
+	}
+
+	return err
+}
+
+// readNextChunk performs verifyNextChunk, returning a wrapped error.
+func (reader *chunkVerifyingReader) readNextChunk() error {
+
+	chunkCount := len(reader.chunkDigests) / sha256.Size
+
+	if reader.chunk == nil {
+		reader.chunk = make([]byte, reader.chunkSize)
+	}
+
+	n, err := io.ReadFull(reader.reader, reader.chunk)
+	if err == io.EOF {
+		if reader.chunkIndex != chunkCount {
+			return ContextError(
+				fmt.Errorf("truncated data: %d of %d chunks", reader.chunkIndex, chunkCount))
+		}
+		return io.EOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return ContextError(err)
+	}
+
+	// Only the last chunk may be shorter than the chunk size.
+	if reader.chunkIndex >= chunkCount ||
+		(n < reader.chunkSize && reader.chunkIndex != chunkCount-1) {
+
+		return ContextError(errors.New("unexpected data"))
+	}
+
+	digest := sha256.Sum256(reader.chunk[:n])
+	offset := reader.chunkIndex * sha256.Size
+	if !bytes.Equal(digest[:], reader.chunkDigests[offset:offset+sha256.Size]) {
+		return ContextError(errors.New("invalid digest"))
+	}
+
+	reader.chunkIndex += 1
+	reader.verified = reader.chunk[:n]
+
+	return nil
 }
 
 // limitedJSONStreamer is a streaming JSON parser that supports just the
@@ -488,6 +1373,10 @@ func (streamer *limitedJSONValueStreamer) Read(p []byte) (int, error) {
 		return 0, io.EOF
 	}
 
+	if bufferedReader, ok := streamer.reader.(*bufio.Reader); ok {
+		return streamer.readBuffered(bufferedReader, p)
+	}
+
 	var i int
 	var err error
 
@@ -522,3 +1411,64 @@ func (streamer *limitedJSONValueStreamer) Read(p []byte) (int, error) {
 
 	return i, err
 }
+
+// readBuffered performs Read when the limitedJSONStreamer reader is a
+// bufio.Reader, copying each run of buffered value bytes up to the next
+// quote or escape with a single copy rather than reading the value one byte
+// at a time, which dominates the cost of streaming large packages. As in
+// Read, no bytes following the end of the value are consumed.
+func (streamer *limitedJSONValueStreamer) readBuffered(
+	reader *bufio.Reader, p []byte) (int, error) {
+
+	n := 0
+	for n < len(p) {
+
+		// Don't block for more input once some of the value has been read.
+		if reader.Buffered() == 0 {
+			if n > 0 {
+				break
+			}
+			_, err := reader.Peek(1)
+			if err != nil {
+				return n, err
+			}
+		}
+
+		buffered, _ := reader.Peek(reader.Buffered())
+		if len(buffered) > len(p)-n {
+			buffered = buffered[:len(p)-n]
+		}
+
+		end := bytes.IndexAny(buffered, "\"\\")
+		if end == -1 {
+			end = len(buffered)
+		}
+		copy(p[n:], buffered[:end])
+		reader.Discard(end)
+		n += end
+
+		if end == len(buffered) {
+			continue
+		}
+
+		b, _ := reader.ReadByte()
+		if b == '"' {
+			streamer.eof = true
+			return n, io.EOF
+		}
+
+		// Psiphon server list string values contain '\n', so support that
+		// required case.
+		b, err := reader.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		if b != 'n' {
+			return n, ContextError(errors.New("unsupported escaped character"))
+		}
+		p[n] = '\n'
+		n += 1
+	}
+
+	return n, nil
+}
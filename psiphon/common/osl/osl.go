@@ -30,6 +30,7 @@
 package osl
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
@@ -42,10 +43,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/url"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -57,11 +60,42 @@ import (
 )
 
 const (
-	KEY_LENGTH_BYTES    = 32
-	REGISTRY_FILENAME   = "osl-registry"
-	OSL_FILENAME_FORMAT = "osl-%s"
+	KEY_LENGTH_BYTES            = 32
+	REGISTRY_FILENAME           = "osl-registry"
+	OSL_FILENAME_FORMAT         = "osl-%s"
+	REGISTRY_DELTA_CONTENT_TYPE = "application/vnd.psiphon.osl-registry-delta"
+
+	// SLOK_SCHEME_VERSION is the newest version of the SLOK key split
+	// scheme that this package supports. Registries and registry deltas
+	// with a newer SLOKSchemeVersion are rejected with a
+	// SLOKSchemeVersionError.
+	SLOK_SCHEME_VERSION = 0
 )
 
+// SLOKSchemeVersionError is returned when a registry or registry delta
+// requires a SLOK scheme version newer than SLOK_SCHEME_VERSION. The key
+// shares of such a registry can't be interpreted, and the client must be
+// upgraded to use it.
+type SLOKSchemeVersionError struct {
+	Version int
+}
+
+// Error implements the error interface.
+func (err SLOKSchemeVersionError) Error() string {
+	return fmt.Sprintf(
+		"unsupported SLOK scheme version %d, newer than version %d",
+		err.Version, SLOK_SCHEME_VERSION)
+}
+
+// checkSLOKSchemeVersion returns a SLOKSchemeVersionError when version is
+// not supported.
+func checkSLOKSchemeVersion(version int) error {
+	if version > SLOK_SCHEME_VERSION {
+		return SLOKSchemeVersionError{Version: version}
+	}
+	return nil
+}
+
 // Config is an OSL configuration, which consists of a list of schemes.
 // The Reload function supports hot reloading of rules data while the
 // process is running.
@@ -143,6 +177,44 @@ type Scheme struct {
 	//
 	SeedPeriodKeySplits []KeySplit
 
+	// OSLPriority is the download priority of all OSLs paved for this
+	// scheme. Clients configured to prioritize downloads fetch OSLs with a
+	// higher priority first. The default, 0, is the lowest priority.
+	OSLPriority int
+
+	// OSLRegions is an optional hint listing the regions of the server
+	// entries paved for this scheme. Clients that lack server entries in
+	// their preferred egress region fetch OSLs hinted with that region
+	// first.
+	OSLRegions []string
+
+	// OSLCapabilities is an optional hint listing the server entry
+	// capabilities, such as tunnel protocols, predominantly offered by the
+	// server entries paved for this scheme. Clients that support none of
+	// these capabilities skip downloading the OSLs.
+	OSLCapabilities []string
+
+	// OSLSelectionWeight is an optional import-time selection weight for
+	// the server entries paved for this scheme; for example, to favor
+	// server entries for newer infrastructure. Clients record the weight
+	// with each imported server entry. The default, 0, indicates no
+	// preference.
+	OSLSelectionWeight int
+
+	// OSLSeedTimestamps specifies that the registry file spec for each OSL
+	// paved for this scheme includes its seed timestamp, the start of the
+	// OSL time period in which its SLOKs are seeded. Clients may download
+	// the most recently seeded OSLs first.
+	OSLSeedTimestamps bool
+
+	// EmbedOSLIDs specifies that OSL files paved for this scheme embed their
+	// OSL ID. Clients reject an OSL file with an embedded OSL ID that
+	// doesn't match the OSL ID of the registry file spec, such as an OSL
+	// file served at another OSL's URL. OSL files with embedded OSL IDs are
+	// rejected by clients which predate OSL ID embedding, so this should not
+	// be set while such clients remain in use.
+	EmbedOSLIDs bool
+
 	// The following fields are ephemeral state.
 
 	epoch                 time.Time
@@ -727,8 +799,118 @@ type PaveFile struct {
 }
 
 // Registry describes a set of OSL files.
+//
+// Generation is a counter which automation increases with each newly paved
+// registry. Clients reject a registry with a lower generation than the
+// highest generation they've seen, so that a mirror can't roll clients back
+// to an older, validly signed registry. Generation must be the first field,
+// as RegistryStreamer expects it before FileSpecs. A 0 Generation is
+// omitted.
+//
+// SLOKSchemeVersion is the version of the SLOK key split scheme used by the
+// KeyShares of the FileSpecs. Clients reject a registry with a
+// SLOKSchemeVersion newer than SLOK_SCHEME_VERSION, which they would
+// otherwise misinterpret. SLOKSchemeVersion must follow Generation and
+// precede FileSpecs. A 0 SLOKSchemeVersion, the original scheme, is
+// omitted.
 type Registry struct {
-	FileSpecs []*OSLFileSpec
+	Generation        int64 `json:",omitempty"`
+	SLOKSchemeVersion int   `json:",omitempty"`
+	FileSpecs         []*OSLFileSpec
+}
+
+// RegistryDelta is a set of changes to a base registry, which allows
+// clients to update a cached registry without downloading the full
+// registry. BaseETag identifies the base registry to which the delta
+// applies. FileSpecs are added to the registry, replacing any existing
+// file specs with the same IDs, and file specs with IDs in RemovedIDs are
+// removed.
+//
+// A delta is distributed as an authenticated package, as is the registry,
+// and is always relative to a full registry; a client applies at most one
+// delta to its cached full registry.
+//
+// Generation, when greater than the base registry Generation, is the
+// generation of the registry with the delta applied. SLOKSchemeVersion is
+// the SLOK scheme version of the delta FileSpecs, as in Registry.
+type RegistryDelta struct {
+	BaseETag          string
+	Generation        int64 `json:",omitempty"`
+	SLOKSchemeVersion int   `json:",omitempty"`
+	FileSpecs         []*OSLFileSpec
+	RemovedIDs        [][]byte
+}
+
+// ApplyDelta applies the registry delta to the registry. File specs which
+// are removed or replaced are deleted, preserving the order of the remaining
+// file specs, and the delta file specs are then appended.
+func (registry *Registry) ApplyDelta(delta *RegistryDelta) {
+
+	deltaIDs := delta.getIDs()
+
+	fileSpecs := make([]*OSLFileSpec, 0, len(registry.FileSpecs)+len(delta.FileSpecs))
+	for _, fileSpec := range registry.FileSpecs {
+		if !deltaIDs[string(fileSpec.ID)] {
+			fileSpecs = append(fileSpecs, fileSpec)
+		}
+	}
+	fileSpecs = append(fileSpecs, delta.FileSpecs...)
+
+	registry.FileSpecs = fileSpecs
+
+	if delta.Generation > registry.Generation {
+		registry.Generation = delta.Generation
+	}
+}
+
+// getIDs returns the set of IDs of file specs removed or replaced by the
+// delta.
+func (delta *RegistryDelta) getIDs() map[string]bool {
+	IDs := make(map[string]bool)
+	for _, fileSpec := range delta.FileSpecs {
+		IDs[string(fileSpec.ID)] = true
+	}
+	for _, ID := range delta.RemovedIDs {
+		IDs[string(ID)] = true
+	}
+	return IDs
+}
+
+// ReadRegistryDelta authenticates and parses a registry delta authenticated
+// package. A delta with an unsupported SLOKSchemeVersion is rejected with a
+// SLOKSchemeVersionError, which is not wrapped.
+func ReadRegistryDelta(
+	registryDeltaContent []byte, signingPublicKey string) (*RegistryDelta, error) {
+
+	encodedDelta, err := common.ReadAuthenticatedDataPackage(
+		registryDeltaContent, true, signingPublicKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	deltaJSON, err := base64.StdEncoding.DecodeString(encodedDelta)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var delta RegistryDelta
+	err = json.Unmarshal(deltaJSON, &delta)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	err = checkSLOKSchemeVersion(delta.SLOKSchemeVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fileSpec := range delta.FileSpecs {
+		if fileSpec.KeyShares == nil {
+			return nil, common.ContextError(errors.New("missing KeyShares"))
+		}
+	}
+
+	return &delta, nil
 }
 
 // An OSLFileSpec includes an ID which is used to reference the
@@ -740,10 +922,28 @@ type Registry struct {
 // MD5 is not cryptographically secure and this checksum is not
 // relied upon for OSL verification. MD5 is used for compatibility
 // with out-of-band distribution hosts.
+//
+// The Priority field is the scheme OSLPriority. It is omitted when 0,
+// leaving the registry unchanged for schemes that don't set a priority.
+// Similarly, the Regions and Capabilities fields are the scheme OSLRegions
+// and OSLCapabilities hints, and the SelectionWeight field is the scheme
+// OSLSelectionWeight; these are omitted when not set.
+//
+// The Size field is the size, in bytes, of the OSL file. It's advisory,
+// for estimating download sizes, and is omitted by older registries.
+//
+// The SeedTimestamp field is the RFC3339 start of the OSL time period, set
+// when the scheme OSLSeedTimestamps is set.
 type OSLFileSpec struct {
-	ID        []byte
-	KeyShares *KeyShares
-	MD5Sum    []byte
+	ID              []byte
+	KeyShares       *KeyShares
+	MD5Sum          []byte
+	Priority        int      `json:",omitempty"`
+	Regions         []string `json:",omitempty"`
+	Capabilities    []string `json:",omitempty"`
+	SelectionWeight int      `json:",omitempty"`
+	Size            int64    `json:",omitempty"`
+	SeedTimestamp   string   `json:",omitempty"`
 }
 
 // KeyShares is a tree data structure which describes the
@@ -789,7 +989,9 @@ type PaveLogInfo struct {
 // of OSLs for a distribution site; i.e., not incrementally.
 //
 // Automation is responsible for consistently distributing server entries
-// to OSLs in the case where OSLs are repaved in subsequent calls.
+// to OSLs in the case where OSLs are repaved in subsequent calls, and for
+// specifying a registryGeneration, the Registry.Generation, which increases
+// with each call.
 func (config *Config) Pave(
 	endTime time.Time,
 	propagationChannelID string,
@@ -798,6 +1000,7 @@ func (config *Config) Pave(
 	paveServerEntries map[string][]string,
 	omitMD5SumsSchemes []int,
 	omitEmptyOSLsSchemes []int,
+	registryGeneration int64,
 	logCallback func(*PaveLogInfo)) ([]*PaveFile, error) {
 
 	config.ReloadableFile.RLock()
@@ -805,7 +1008,9 @@ func (config *Config) Pave(
 
 	var paveFiles []*PaveFile
 
-	registry := &Registry{}
+	registry := &Registry{
+		Generation: registryGeneration,
+	}
 
 	for schemeIndex, scheme := range config.Schemes {
 		if common.Contains(scheme.PropagationChannelIDs, propagationChannelID) {
@@ -846,6 +1051,11 @@ func (config *Config) Pave(
 						return nil, common.ContextError(err)
 					}
 
+					if scheme.EmbedOSLIDs {
+						serverEntriesPackage = append(
+							makeOSLIDHeader(fileSpec.ID), serverEntriesPackage...)
+					}
+
 					boxedServerEntries, err := box(fileKey, serverEntriesPackage)
 					if err != nil {
 						return nil, common.ContextError(err)
@@ -856,6 +1066,8 @@ func (config *Config) Pave(
 						fileSpec.MD5Sum = md5sum[:]
 					}
 
+					fileSpec.Size = int64(len(boxedServerEntries))
+
 					fileName := fmt.Sprintf(
 						OSL_FILENAME_FORMAT, hexEncodedOSLID)
 
@@ -1005,8 +1217,16 @@ func makeOSLFileSpec(
 	}
 
 	fileSpec := &OSLFileSpec{
-		ID:        oslID,
-		KeyShares: keyShares,
+		ID:              oslID,
+		KeyShares:       keyShares,
+		Priority:        scheme.OSLPriority,
+		Regions:         scheme.OSLRegions,
+		Capabilities:    scheme.OSLCapabilities,
+		SelectionWeight: scheme.OSLSelectionWeight,
+	}
+
+	if scheme.OSLSeedTimestamps {
+		fileSpec.SeedTimestamp = firstSLOKTime.UTC().Format(time.RFC3339)
 	}
 
 	return fileKey, fileSpec, nil
@@ -1200,17 +1420,235 @@ func (keyShares *KeyShares) reassembleKey(lookup SLOKLookup, unboxKey bool) (boo
 	return true, joinedKey, nil
 }
 
+// MissingSLOKs returns the minimum number of additional SLOKs, beyond those
+// available via lookup, required to reassemble the file key of the OSL, and
+// the minimum number of SLOKs required to reassemble the key when no SLOKs
+// are available. The OSL is unlockable when no SLOKs are missing.
+func (fileSpec *OSLFileSpec) MissingSLOKs(lookup SLOKLookup) (int, int, error) {
+
+	if fileSpec.KeyShares == nil {
+		return 0, 0, common.ContextError(errors.New("missing KeyShares"))
+	}
+
+	missing, err := fileSpec.KeyShares.missingSLOKs(lookup)
+	if err != nil {
+		return 0, 0, common.ContextError(err)
+	}
+
+	required, err := fileSpec.KeyShares.missingSLOKs(
+		func([]byte) []byte { return nil })
+	if err != nil {
+		return 0, 0, common.ContextError(err)
+	}
+
+	return missing, required, nil
+}
+
+// missingSLOKs recursively traverses a KeyShares tree, as in reassembleKey,
+// and returns the minimum number of additional SLOKs required to reassemble
+// the root key: for SLOK shares, the number of SLOKs short of the threshold;
+// for split shares, the sum of the smallest threshold count of child
+// shortfalls.
+func (keyShares *KeyShares) missingSLOKs(lookup SLOKLookup) (int, error) {
+
+	if (len(keyShares.SLOKIDs) > 0 && len(keyShares.KeyShares) > 0) ||
+		(len(keyShares.SLOKIDs) > 0 && len(keyShares.SLOKIDs) != len(keyShares.BoxedShares)) ||
+		(len(keyShares.KeyShares) > 0 && len(keyShares.KeyShares) != len(keyShares.BoxedShares)) ||
+		(len(keyShares.SLOKIDs) == 0 && keyShares.Threshold > len(keyShares.KeyShares)) {
+		return 0, common.ContextError(errors.New("unexpected KeyShares format"))
+	}
+
+	if len(keyShares.SLOKIDs) > 0 {
+		available := 0
+		for _, slokID := range keyShares.SLOKIDs {
+			if lookup(slokID) != nil {
+				available += 1
+			}
+		}
+		if available >= keyShares.Threshold {
+			return 0, nil
+		}
+		return keyShares.Threshold - available, nil
+	}
+
+	shortfalls := make([]int, len(keyShares.KeyShares))
+	for i, childKeyShares := range keyShares.KeyShares {
+		shortfall, err := childKeyShares.missingSLOKs(lookup)
+		if err != nil {
+			return 0, common.ContextError(err)
+		}
+		shortfalls[i] = shortfall
+	}
+	sort.Ints(shortfalls)
+
+	missing := 0
+	for i := 0; i < keyShares.Threshold; i++ {
+		missing += shortfalls[i]
+	}
+
+	return missing, nil
+}
+
+// MissingSLOKIDs returns the IDs of the SLOKs, not available via lookup, in
+// the key shares of the OSL which can't yet be reassembled. Obtaining any of
+// these SLOKs may reduce the number of SLOKs missing, as reported by
+// MissingSLOKs; SLOKs in key shares which are already reassemblable are
+// omitted. No IDs are returned when the OSL is unlockable.
+func (fileSpec *OSLFileSpec) MissingSLOKIDs(lookup SLOKLookup) ([][]byte, error) {
+
+	if fileSpec.KeyShares == nil {
+		return nil, common.ContextError(errors.New("missing KeyShares"))
+	}
+
+	var slokIDs [][]byte
+	err := fileSpec.KeyShares.missingSLOKIDs(lookup, &slokIDs)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return slokIDs, nil
+}
+
+// missingSLOKIDs recursively traverses a KeyShares tree and appends, to
+// slokIDs, the unavailable SLOK IDs in each share with a shortfall, as
+// determined by missingSLOKs.
+func (keyShares *KeyShares) missingSLOKIDs(lookup SLOKLookup, slokIDs *[][]byte) error {
+
+	missing, err := keyShares.missingSLOKs(lookup)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	if missing == 0 {
+		return nil
+	}
+
+	for _, slokID := range keyShares.SLOKIDs {
+		if lookup(slokID) == nil {
+			*slokIDs = append(*slokIDs, slokID)
+		}
+	}
+
+	for _, childKeyShares := range keyShares.KeyShares {
+		err := childKeyShares.missingSLOKIDs(lookup, slokIDs)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	return nil
+}
+
+// GetOSLCoverage reports the SLOK coverage of the OSLs in registry: the
+// number of OSLs which are seeded, with sufficient SLOKs available via lookup
+// to reassemble the file key; the total number of OSLs; and the number of
+// distinct SLOKs, not available via lookup, in the key shares of the OSLs
+// which aren't seeded, as reported by MissingSLOKIDs. A nil registry has no
+// OSLs. This distinguishes a client which has seeded no OSLs from one which
+// fails to download seeded OSLs.
+func GetOSLCoverage(registry *Registry, lookup SLOKLookup) (int, int, int, error) {
+
+	coverage := newOSLCoverage(lookup)
+
+	if registry != nil {
+		for _, fileSpec := range registry.FileSpecs {
+			_, err := coverage.add(fileSpec)
+			if err != nil {
+				return 0, 0, 0, common.ContextError(err)
+			}
+		}
+	}
+
+	seededCount, totalCount, missingSLOKCount := coverage.get()
+
+	return seededCount, totalCount, missingSLOKCount, nil
+}
+
+// oslCoverage accumulates the SLOK coverage of OSLs; see GetOSLCoverage.
+// SLOK lookups are cached, as the same SLOK may be in the key shares of
+// many OSLs.
+type oslCoverage struct {
+	lookup         SLOKLookup
+	sloks          map[string][]byte
+	seededCount    int
+	totalCount     int
+	missingSLOKIDs map[string]bool
+}
+
+func newOSLCoverage(lookup SLOKLookup) *oslCoverage {
+
+	coverage := &oslCoverage{
+		sloks:          make(map[string][]byte),
+		missingSLOKIDs: make(map[string]bool),
+	}
+
+	coverage.lookup = func(slokID []byte) []byte {
+		slok, ok := coverage.sloks[string(slokID)]
+		if !ok {
+			slok = lookup(slokID)
+			coverage.sloks[string(slokID)] = slok
+		}
+		return slok
+	}
+
+	return coverage
+}
+
+// add records the coverage of the OSL and returns whether it's seeded.
+func (coverage *oslCoverage) add(fileSpec *OSLFileSpec) (bool, error) {
+
+	if fileSpec.KeyShares == nil {
+		return false, common.ContextError(errors.New("missing KeyShares"))
+	}
+
+	coverage.totalCount += 1
+
+	ok, _, err := fileSpec.KeyShares.reassembleKey(coverage.lookup, false)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	if ok {
+		coverage.seededCount += 1
+		return true, nil
+	}
+
+	slokIDs, err := fileSpec.MissingSLOKIDs(coverage.lookup)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+	for _, slokID := range slokIDs {
+		coverage.missingSLOKIDs[string(slokID)] = true
+	}
+
+	return false, nil
+}
+
+func (coverage *oslCoverage) get() (int, int, int) {
+	return coverage.seededCount, coverage.totalCount, len(coverage.missingSLOKIDs)
+}
+
 // GetOSLRegistryURL returns the URL for an OSL registry. Clients
 // call this when fetching the registry from out-of-band
 // distribution sites.
 // Clients are responsible for tracking whether the remote file has
 // changed or not before downloading.
 func GetOSLRegistryURL(baseURL string) string {
+	return GetOSLRegistryURLWithPath(baseURL, "")
+}
+
+// GetOSLRegistryURLWithPath returns the URL for an OSL registry located at
+// registryPath, a slash-separated path relative to baseURL, for deployments
+// which don't place the registry at the conventional REGISTRY_FILENAME. When
+// registryPath is blank, the conventional location is used.
+func GetOSLRegistryURLWithPath(baseURL, registryPath string) string {
+	if registryPath == "" {
+		registryPath = REGISTRY_FILENAME
+	}
 	u, err := url.Parse(baseURL)
 	if err != nil {
 		return ""
 	}
-	u.Path = path.Join(u.Path, REGISTRY_FILENAME)
+	u.Path = path.Join(u.Path, registryPath)
 	return u.String()
 }
 
@@ -1262,11 +1700,19 @@ type SLOKLookup func([]byte) []byte
 // with its present base URL, they will not appear in the registry and not
 // be used.
 type RegistryStreamer struct {
-	jsonDecoder *json.Decoder
-	lookup      SLOKLookup
+	jsonDecoder   *json.Decoder
+	generation    int64
+	baseDone      bool
+	delta         *RegistryDelta
+	deltaIDs      map[string]bool
+	deltaIndex    int
+	fileSpecCount int
+	coverage      *oslCoverage
 }
 
-// NewRegistryStreamer creates a new RegistryStreamer.
+// NewRegistryStreamer creates a new RegistryStreamer. A registry with an
+// unsupported SLOKSchemeVersion is rejected with a SLOKSchemeVersionError,
+// which is not wrapped, before any file specs are read.
 func NewRegistryStreamer(
 	registryFileContent io.ReadSeeker,
 	signingPublicKey string,
@@ -1284,7 +1730,9 @@ func NewRegistryStreamer(
 	// is expected to be of the following form, corresponding
 	// to the Registry struct type:
 	//
-	// {"FileSpecs" : [{...}, {...}, ..., {...}]}
+	// {"Generation" : N, "SLOKSchemeVersion" : V, "FileSpecs" : [{...}, {...}, ..., {...}]}
+	//
+	// where the Generation and SLOKSchemeVersion fields are optional.
 
 	jsonDecoder := json.NewDecoder(base64Decoder)
 
@@ -1293,16 +1741,42 @@ func NewRegistryStreamer(
 		return nil, common.ContextError(err)
 	}
 
-	token, err := jsonDecoder.Token()
+	name, err := readJSONFieldName(jsonDecoder)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
 
-	name, ok := token.(string)
+	var generation int64
+	if name == "Generation" {
 
-	if !ok {
-		return nil, common.ContextError(
-			fmt.Errorf("unexpected token type: %T", token))
+		err = jsonDecoder.Decode(&generation)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		name, err = readJSONFieldName(jsonDecoder)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	if name == "SLOKSchemeVersion" {
+
+		var slokSchemeVersion int
+		err = jsonDecoder.Decode(&slokSchemeVersion)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		err = checkSLOKSchemeVersion(slokSchemeVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		name, err = readJSONFieldName(jsonDecoder)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
 	}
 
 	if name != "FileSpecs" {
@@ -1317,10 +1791,43 @@ func NewRegistryStreamer(
 
 	return &RegistryStreamer{
 		jsonDecoder: jsonDecoder,
-		lookup:      lookup,
+		generation:  generation,
+		coverage:    newOSLCoverage(lookup),
 	}, nil
 }
 
+// Generation returns the Registry.Generation of the streamed registry, or
+// the RegistryDelta.Generation of an applied delta, when greater.
+func (s *RegistryStreamer) Generation() int64 {
+	if s.delta != nil && s.delta.Generation > s.generation {
+		return s.delta.Generation
+	}
+	return s.generation
+}
+
+// ApplyDelta applies a registry delta to the streamed registry, as in
+// Registry.ApplyDelta: Next skips registry file specs which are removed or
+// replaced by the delta, and returns the delta file specs after the
+// registry file specs. ApplyDelta must be called before the first Next.
+func (s *RegistryStreamer) ApplyDelta(delta *RegistryDelta) {
+	s.delta = delta
+	s.deltaIDs = delta.getIDs()
+}
+
+// FileSpecCount returns the number of file specs, seeded or not, that Next
+// has read from the registry, and from any applied delta, so far. Once Next
+// returns nil, this is the total number of OSLs in the registry.
+func (s *RegistryStreamer) FileSpecCount() int {
+	return s.fileSpecCount
+}
+
+// Coverage returns the SLOK coverage, as reported by GetOSLCoverage, of the
+// file specs that Next has read so far. Once Next returns nil, this is the
+// coverage of the registry.
+func (s *RegistryStreamer) Coverage() (int, int, int) {
+	return s.coverage.get()
+}
+
 // Next returns the next OSL file spec that the client
 // has sufficient SLOKs to decrypt. The client calls
 // NewOSLReader with the file spec to process that OSL.
@@ -1328,7 +1835,26 @@ func NewRegistryStreamer(
 func (s *RegistryStreamer) Next() (*OSLFileSpec, error) {
 
 	for {
-		if s.jsonDecoder.More() {
+		if s.baseDone {
+
+			if s.delta == nil || s.deltaIndex >= len(s.delta.FileSpecs) {
+				return nil, nil
+			}
+
+			fileSpec := s.delta.FileSpecs[s.deltaIndex]
+			s.deltaIndex += 1
+			s.fileSpecCount += 1
+
+			ok, err := s.coverage.add(fileSpec)
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+
+			if ok {
+				return fileSpec, nil
+			}
+
+		} else if s.jsonDecoder.More() {
 
 			var fileSpec OSLFileSpec
 			err := s.jsonDecoder.Decode(&fileSpec)
@@ -1336,7 +1862,13 @@ func (s *RegistryStreamer) Next() (*OSLFileSpec, error) {
 				return nil, common.ContextError(err)
 			}
 
-			ok, _, err := fileSpec.KeyShares.reassembleKey(s.lookup, false)
+			if s.deltaIDs[string(fileSpec.ID)] {
+				continue
+			}
+
+			s.fileSpecCount += 1
+
+			ok, err := s.coverage.add(&fileSpec)
 			if err != nil {
 				return nil, common.ContextError(err)
 			}
@@ -1365,7 +1897,7 @@ func (s *RegistryStreamer) Next() (*OSLFileSpec, error) {
 				return nil, common.ContextError(err)
 			}
 
-			return nil, nil
+			s.baseDone = true
 		}
 	}
 }
@@ -1391,6 +1923,22 @@ func expectJSONDelimiter(jsonDecoder *json.Decoder, delimiter string) error {
 	return nil
 }
 
+func readJSONFieldName(jsonDecoder *json.Decoder) (string, error) {
+	token, err := jsonDecoder.Token()
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	name, ok := token.(string)
+
+	if !ok {
+		return "", common.ContextError(
+			fmt.Errorf("unexpected token type: %T", token))
+	}
+
+	return name, nil
+}
+
 // NewOSLReader decrypts, authenticates and streams an OSL payload.
 func NewOSLReader(
 	oslFileContent io.ReadSeeker,
@@ -1398,6 +1946,20 @@ func NewOSLReader(
 	lookup SLOKLookup,
 	signingPublicKey string) (io.Reader, error) {
 
+	return NewOSLReaderWithDictionary(
+		oslFileContent, fileSpec, lookup, signingPublicKey, nil)
+}
+
+// NewOSLReaderWithDictionary is NewOSLReader with a zlib preset dictionary
+// used to decompress the OSL payload. See
+// common.NewAuthenticatedDataPackageReaderWithDictionary.
+func NewOSLReaderWithDictionary(
+	oslFileContent io.ReadSeeker,
+	fileSpec *OSLFileSpec,
+	lookup SLOKLookup,
+	signingPublicKey string,
+	dictionary []byte) (io.Reader, error) {
+
 	ok, fileKey, err := fileSpec.KeyShares.reassembleKey(lookup, true)
 	if err != nil {
 		return nil, common.ContextError(err)
@@ -1419,9 +1981,181 @@ func NewOSLReader(
 		return nil, common.ContextError(err)
 	}
 
-	return common.NewAuthenticatedDataPackageReader(
-		unboxer,
-		signingPublicKey)
+	dataPackage, err := skipOSLIDHeader(unboxer, fileSpec.ID)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	payloadReader, _, err := common.NewAuthenticatedDataPackageReaderWithDictionary(
+		dataPackage,
+		signingPublicKey,
+		dictionary)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return payloadReader, nil
+}
+
+// ServerEntryCapabilitiesKey returns the key used to encrypt the
+// capabilities of server entries distributed in the OSL; see
+// EncryptServerEntryCapabilities. The key is derived from the OSL file key,
+// so only clients holding the SLOKs required to decrypt the OSL can derive
+// it.
+func (fileSpec *OSLFileSpec) ServerEntryCapabilitiesKey(lookup SLOKLookup) ([]byte, error) {
+
+	ok, fileKey, err := fileSpec.KeyShares.reassembleKey(lookup, true)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if !ok {
+		return nil, common.ContextError(errors.New("unseeded OSL"))
+	}
+
+	return deriveKeyHKDF(fileKey, []byte("osl-server-entry-capabilities-key")), nil
+}
+
+// EncryptServerEntryCapabilities encrypts a list of server entry
+// capabilities with a ServerEntryCapabilitiesKey. The result is a base64
+// encoding suitable for a server entry encryptedCapabilities field.
+//
+// Unlike OSL files, many server entries are encrypted with the same key, so
+// each encryption uses a random nonce, which is prepended to the box.
+func EncryptServerEntryCapabilities(key []byte, capabilities []string) (string, error) {
+
+	if len(key) != KEY_LENGTH_BYTES {
+		return "", common.ContextError(errors.New("invalid key length"))
+	}
+
+	plaintext, err := json.Marshal(capabilities)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	nonce, err := common.MakeSecureRandomBytes(24)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	var secretboxNonce [24]byte
+	var secretboxKey [KEY_LENGTH_BYTES]byte
+	copy(secretboxNonce[:], nonce)
+	copy(secretboxKey[:], key)
+	box := secretbox.Seal(nonce, plaintext, &secretboxNonce, &secretboxKey)
+
+	return base64.StdEncoding.EncodeToString(box), nil
+}
+
+// DecryptServerEntryCapabilities decrypts server entry capabilities
+// encrypted with EncryptServerEntryCapabilities.
+func DecryptServerEntryCapabilities(key []byte, encryptedCapabilities string) ([]string, error) {
+
+	if len(key) != KEY_LENGTH_BYTES {
+		return nil, common.ContextError(errors.New("invalid key length"))
+	}
+
+	box, err := base64.StdEncoding.DecodeString(encryptedCapabilities)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if len(box) < 24 {
+		return nil, common.ContextError(errors.New("invalid encrypted capabilities"))
+	}
+
+	var secretboxNonce [24]byte
+	var secretboxKey [KEY_LENGTH_BYTES]byte
+	copy(secretboxNonce[:], box[:24])
+	copy(secretboxKey[:], key)
+	plaintext, ok := secretbox.Open(nil, box[24:], &secretboxNonce, &secretboxKey)
+	if !ok {
+		return nil, common.ContextError(errors.New("unbox failed"))
+	}
+
+	var capabilities []string
+	err = json.Unmarshal(plaintext, &capabilities)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return capabilities, nil
+}
+
+// An OSL file with an embedded OSL ID begins, inside the box, with an OSL ID
+// header, which consists of oslIDHeaderMagic followed by a single OSL ID
+// length byte and the OSL ID. The remainder is the authenticated data
+// package. As with the authenticated data package format header, the magic
+// value begins with a zero byte, which can't begin a legacy package.
+var oslIDHeaderMagic = []byte("\x00POSL")
+
+func makeOSLIDHeader(oslID []byte) []byte {
+	header := append([]byte(nil), oslIDHeaderMagic...)
+	header = append(header, byte(len(oslID)))
+	return append(header, oslID...)
+}
+
+// skipOSLIDHeader reads the OSL ID header, if any, at the start of the
+// unboxed OSL file content, and checks that the embedded OSL ID matches
+// oslID. The returned io.ReadSeeker presents the content following the
+// header. Content without a header is returned as is.
+func skipOSLIDHeader(content io.ReadSeeker, oslID []byte) (io.ReadSeeker, error) {
+
+	prefix := make([]byte, len(oslIDHeaderMagic)+1)
+	n, err := io.ReadFull(content, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, common.ContextError(err)
+	}
+
+	if n < len(prefix) || !bytes.HasPrefix(prefix, oslIDHeaderMagic) {
+		_, err := content.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		return content, nil
+	}
+
+	embeddedID := make([]byte, int(prefix[len(prefix)-1]))
+	_, err = io.ReadFull(content, embeddedID)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if !bytes.Equal(embeddedID, oslID) {
+		return nil, common.ContextError(
+			fmt.Errorf("OSL ID mismatch: embedded %x", embeddedID))
+	}
+
+	return &offsetReadSeeker{
+		ReadSeeker: content,
+		offset:     int64(len(prefix) + len(embeddedID)),
+	}, nil
+}
+
+// offsetReadSeeker presents the content of an io.ReadSeeker following the
+// first offset bytes. As the unboxing io.ReadSeeker supports only seeking to
+// the start, seeks are implemented by seeking to the start and discarding
+// bytes, and only io.SeekStart is supported.
+type offsetReadSeeker struct {
+	io.ReadSeeker
+	offset int64
+}
+
+func (r *offsetReadSeeker) Seek(offset int64, whence int) (int64, error) {
+
+	if offset < 0 || whence != io.SeekStart {
+		return -1, common.ContextError(errors.New("unsupported"))
+	}
+
+	_, err := r.ReadSeeker.Seek(0, io.SeekStart)
+	if err != nil {
+		return -1, common.ContextError(err)
+	}
+
+	_, err = io.CopyN(ioutil.Discard, r.ReadSeeker, r.offset+offset)
+	if err != nil {
+		return -1, common.ContextError(err)
+	}
+
+	return offset, nil
 }
 
 // zeroReader reads an unlimited stream of zeroes.
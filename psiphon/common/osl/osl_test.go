@@ -23,13 +23,16 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/nacl/secretbox"
 )
 
 func TestOSL(t *testing.T) {
@@ -370,6 +373,7 @@ func TestOSL(t *testing.T) {
 				paveServerEntries,
 				omitMD5SumsSchemes,
 				omitEmptyOSLsSchemes,
+				0,
 				nil)
 			if err != nil {
 				t.Fatalf("Pave failed: %s", err)
@@ -383,6 +387,7 @@ func TestOSL(t *testing.T) {
 				paveServerEntries,
 				omitMD5SumsSchemes,
 				omitEmptyOSLsSchemes,
+				0,
 				nil)
 			if err != nil {
 				t.Fatalf("Pave failed: %s", err)
@@ -617,3 +622,601 @@ func TestOSL(t *testing.T) {
 		})
 	}
 }
+
+func TestMissingSLOKs(t *testing.T) {
+
+	share := []byte("share")
+
+	fileSpec := &OSLFileSpec{
+		KeyShares: &KeyShares{
+			Threshold:   2,
+			BoxedShares: [][]byte{share, share, share},
+			KeyShares: []*KeyShares{
+				{
+					Threshold:   2,
+					BoxedShares: [][]byte{share, share},
+					SLOKIDs:     [][]byte{[]byte("a1"), []byte("a2")},
+				},
+				{
+					Threshold:   1,
+					BoxedShares: [][]byte{share},
+					SLOKIDs:     [][]byte{[]byte("b1")},
+				},
+				{
+					Threshold:   2,
+					BoxedShares: [][]byte{share, share, share},
+					SLOKIDs:     [][]byte{[]byte("c1"), []byte("c2"), []byte("c3")},
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		description            string
+		availableSLOKs         []string
+		expectedMissing        int
+		expectedRequired       int
+		expectedMissingSLOKIDs string
+	}{
+		{"no SLOKs", nil, 3, 3, "a1 a2 b1 c1 c2 c3"},
+		{"partial SLOKs", []string{"a1", "c1"}, 2, 3, "a2 b1 c2 c3"},
+		{"reassemblable share", []string{"b1"}, 2, 3, "a1 a2 c1 c2 c3"},
+		{"sufficient SLOKs", []string{"a1", "a2", "b1"}, 0, 3, ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			lookup := func(slokID []byte) []byte {
+				for _, availableSLOK := range testCase.availableSLOKs {
+					if string(slokID) == availableSLOK {
+						return []byte("key")
+					}
+				}
+				return nil
+			}
+
+			missing, required, err := fileSpec.MissingSLOKs(lookup)
+			if err != nil {
+				t.Fatalf("MissingSLOKs failed: %s", err)
+			}
+			if missing != testCase.expectedMissing || required != testCase.expectedRequired {
+				t.Fatalf("unexpected missing SLOKs: %d of %d", missing, required)
+			}
+
+			slokIDs, err := fileSpec.MissingSLOKIDs(lookup)
+			if err != nil {
+				t.Fatalf("MissingSLOKIDs failed: %s", err)
+			}
+			var missingSLOKIDs []string
+			for _, slokID := range slokIDs {
+				missingSLOKIDs = append(missingSLOKIDs, string(slokID))
+			}
+			if strings.Join(missingSLOKIDs, " ") != testCase.expectedMissingSLOKIDs {
+				t.Fatalf("unexpected missing SLOK IDs: %v", missingSLOKIDs)
+			}
+		})
+	}
+
+	invalidFileSpec := &OSLFileSpec{
+		KeyShares: &KeyShares{
+			Threshold:   2,
+			BoxedShares: [][]byte{share},
+			KeyShares: []*KeyShares{
+				{
+					Threshold:   1,
+					BoxedShares: [][]byte{share},
+					SLOKIDs:     [][]byte{[]byte("a1")},
+				},
+			},
+		},
+	}
+
+	_, _, err := invalidFileSpec.MissingSLOKs(func([]byte) []byte { return nil })
+	if err == nil {
+		t.Fatalf("unexpected MissingSLOKs success")
+	}
+
+	_, err = invalidFileSpec.MissingSLOKIDs(func([]byte) []byte { return nil })
+	if err == nil {
+		t.Fatalf("unexpected MissingSLOKIDs success")
+	}
+}
+
+func TestGetOSLCoverage(t *testing.T) {
+
+	share := []byte("share")
+
+	newFileSpec := func(slokIDs ...string) *OSLFileSpec {
+		keyShares := &KeyShares{Threshold: len(slokIDs)}
+		for _, slokID := range slokIDs {
+			keyShares.BoxedShares = append(keyShares.BoxedShares, share)
+			keyShares.SLOKIDs = append(keyShares.SLOKIDs, []byte(slokID))
+		}
+		return &OSLFileSpec{KeyShares: keyShares}
+	}
+
+	registry := &Registry{
+		FileSpecs: []*OSLFileSpec{
+			newFileSpec("a1"),
+			newFileSpec("a1", "b1"),
+			newFileSpec("b1", "c1"),
+		},
+	}
+
+	testCases := []struct {
+		description        string
+		registry           *Registry
+		availableSLOKs     []string
+		expectedSeeded     int
+		expectedTotal      int
+		expectedMissingIDs int
+	}{
+		{"nil registry", nil, []string{"a1"}, 0, 0, 0},
+		{"empty registry", &Registry{}, []string{"a1"}, 0, 0, 0},
+		{"no seeded OSLs", registry, nil, 0, 3, 3},
+		{"partially seeded OSLs", registry, []string{"a1"}, 1, 3, 2},
+		{"failed SLOK lookups", registry, []string{"a1", "b1", "c1", "failed b1"}, 1, 3, 1},
+		{"seeded OSLs", registry, []string{"a1", "b1", "c1"}, 3, 3, 0},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			// A SLOK prefixed with "failed" fails to be looked up; as with
+			// the client datastore lookup, a failed lookup returns no SLOK.
+
+			lookup := func(slokID []byte) []byte {
+				for _, availableSLOK := range testCase.availableSLOKs {
+					if "failed "+string(slokID) == availableSLOK {
+						return nil
+					}
+				}
+				for _, availableSLOK := range testCase.availableSLOKs {
+					if string(slokID) == availableSLOK {
+						return []byte("key")
+					}
+				}
+				return nil
+			}
+
+			seeded, total, missingIDs, err := GetOSLCoverage(testCase.registry, lookup)
+			if err != nil {
+				t.Fatalf("GetOSLCoverage failed: %s", err)
+			}
+			if seeded != testCase.expectedSeeded ||
+				total != testCase.expectedTotal ||
+				missingIDs != testCase.expectedMissingIDs {
+				t.Fatalf("unexpected coverage: %d of %d seeded, %d missing SLOKs",
+					seeded, total, missingIDs)
+			}
+		})
+	}
+
+	invalidRegistry := &Registry{
+		FileSpecs: []*OSLFileSpec{{ID: []byte("invalid")}},
+	}
+
+	_, _, _, err := GetOSLCoverage(invalidRegistry, func([]byte) []byte { return nil })
+	if err == nil {
+		t.Fatalf("unexpected GetOSLCoverage success")
+	}
+}
+
+func TestRegistryDelta(t *testing.T) {
+
+	signingPublicKey, signingPrivateKey, err :=
+		common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	writePackage := func(value interface{}) []byte {
+		valueJSON, err := json.Marshal(value)
+		if err != nil {
+			t.Fatalf("Marshal failed: %s", err)
+		}
+		content, err := common.WriteAuthenticatedDataPackage(
+			base64.StdEncoding.EncodeToString(valueJSON),
+			signingPublicKey,
+			signingPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		return content
+	}
+
+	newFileSpec := func(ID, slokID string) *OSLFileSpec {
+		return &OSLFileSpec{
+			ID: []byte(ID),
+			KeyShares: &KeyShares{
+				Threshold:   1,
+				BoxedShares: [][]byte{[]byte("share")},
+				SLOKIDs:     [][]byte{[]byte(slokID)},
+			},
+			MD5Sum: []byte(ID),
+		}
+	}
+
+	getIDs := func(fileSpecs []*OSLFileSpec) string {
+		var IDs []string
+		for _, fileSpec := range fileSpecs {
+			IDs = append(IDs, fmt.Sprintf("%s:%s", fileSpec.ID, fileSpec.MD5Sum))
+		}
+		return strings.Join(IDs, ",")
+	}
+
+	registry := &Registry{
+		Generation: 2,
+		FileSpecs: []*OSLFileSpec{
+			newFileSpec("a", "available"),
+			newFileSpec("b", "available"),
+			newFileSpec("c", "available"),
+		},
+	}
+
+	replacedFileSpec := newFileSpec("b", "available")
+	replacedFileSpec.MD5Sum = []byte("b2")
+
+	delta := &RegistryDelta{
+		BaseETag:   "\"base\"",
+		Generation: 3,
+		FileSpecs: []*OSLFileSpec{
+			replacedFileSpec,
+			newFileSpec("d", "available"),
+			newFileSpec("e", "missing"),
+		},
+		RemovedIDs: [][]byte{[]byte("a")},
+	}
+
+	deltaContent := writePackage(delta)
+
+	readDelta, err := ReadRegistryDelta(deltaContent, signingPublicKey)
+	if err != nil {
+		t.Fatalf("ReadRegistryDelta failed: %s", err)
+	}
+	if readDelta.BaseETag != delta.BaseETag ||
+		readDelta.Generation != delta.Generation ||
+		getIDs(readDelta.FileSpecs) != getIDs(delta.FileSpecs) ||
+		len(readDelta.RemovedIDs) != 1 {
+		t.Fatalf("unexpected registry delta: %+v", readDelta)
+	}
+
+	otherPublicKey, _, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+	_, err = ReadRegistryDelta(deltaContent, otherPublicKey)
+	if err == nil {
+		t.Fatalf("unexpected ReadRegistryDelta success")
+	}
+
+	lookup := func(slokID []byte) []byte {
+		if string(slokID) == "available" {
+			return []byte("key")
+		}
+		return nil
+	}
+
+	// The streamer skips the locked file spec "e".
+
+	registryStreamer, err := NewRegistryStreamer(
+		bytes.NewReader(writePackage(registry)), signingPublicKey, lookup)
+	if err != nil {
+		t.Fatalf("NewRegistryStreamer failed: %s", err)
+	}
+	if registryStreamer.Generation() != 2 {
+		t.Fatalf("unexpected registry generation: %d", registryStreamer.Generation())
+	}
+	registryStreamer.ApplyDelta(readDelta)
+	if registryStreamer.Generation() != 3 {
+		t.Fatalf("unexpected registry generation: %d", registryStreamer.Generation())
+	}
+
+	var streamedFileSpecs []*OSLFileSpec
+	for {
+		fileSpec, err := registryStreamer.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %s", err)
+		}
+		if fileSpec == nil {
+			break
+		}
+		streamedFileSpecs = append(streamedFileSpecs, fileSpec)
+	}
+
+	expectedIDs := "c:c,b:b2,d:d"
+	if getIDs(streamedFileSpecs) != expectedIDs {
+		t.Fatalf("unexpected streamed file specs: %s", getIDs(streamedFileSpecs))
+	}
+
+	// The file spec count includes the locked file spec "e".
+
+	if registryStreamer.FileSpecCount() != 4 {
+		t.Fatalf("unexpected file spec count: %d", registryStreamer.FileSpecCount())
+	}
+
+	registry.ApplyDelta(readDelta)
+
+	expectedIDs = "c:c,b:b2,d:d,e:e"
+	if getIDs(registry.FileSpecs) != expectedIDs {
+		t.Fatalf("unexpected registry file specs: %s", getIDs(registry.FileSpecs))
+	}
+	if registry.Generation != 3 {
+		t.Fatalf("unexpected registry generation: %d", registry.Generation)
+	}
+}
+
+func TestRegistrySLOKSchemeVersion(t *testing.T) {
+
+	signingPublicKey, signingPrivateKey, err :=
+		common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	writePackage := func(value interface{}) []byte {
+		valueJSON, err := json.Marshal(value)
+		if err != nil {
+			t.Fatalf("Marshal failed: %s", err)
+		}
+		content, err := common.WriteAuthenticatedDataPackage(
+			base64.StdEncoding.EncodeToString(valueJSON),
+			signingPublicKey,
+			signingPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		return content
+	}
+
+	fileSpecs := []*OSLFileSpec{
+		{
+			ID: []byte("a"),
+			KeyShares: &KeyShares{
+				Threshold:   1,
+				BoxedShares: [][]byte{[]byte("share")},
+				SLOKIDs:     [][]byte{[]byte("available")},
+			},
+		},
+	}
+
+	lookup := func(slokID []byte) []byte {
+		return []byte("key")
+	}
+
+	// Registries with the supported SLOK scheme version, including
+	// registries with both the optional Generation and SLOKSchemeVersion
+	// fields, are streamed.
+
+	for _, registry := range []*Registry{
+		{FileSpecs: fileSpecs},
+		{SLOKSchemeVersion: SLOK_SCHEME_VERSION, FileSpecs: fileSpecs},
+		{Generation: 2, SLOKSchemeVersion: SLOK_SCHEME_VERSION, FileSpecs: fileSpecs},
+	} {
+		registryStreamer, err := NewRegistryStreamer(
+			bytes.NewReader(writePackage(registry)), signingPublicKey, lookup)
+		if err != nil {
+			t.Fatalf("NewRegistryStreamer failed: %s", err)
+		}
+		if registryStreamer.Generation() != registry.Generation {
+			t.Fatalf("unexpected registry generation: %d", registryStreamer.Generation())
+		}
+		fileSpec, err := registryStreamer.Next()
+		if err != nil || fileSpec == nil || string(fileSpec.ID) != "a" {
+			t.Fatalf("unexpected Next result: %+v, %v", fileSpec, err)
+		}
+	}
+
+	// A registry requiring a newer SLOK scheme is rejected with a
+	// SLOKSchemeVersionError.
+
+	unsupportedVersion := SLOK_SCHEME_VERSION + 1
+
+	_, err = NewRegistryStreamer(
+		bytes.NewReader(writePackage(&Registry{
+			Generation:        2,
+			SLOKSchemeVersion: unsupportedVersion,
+			FileSpecs:         fileSpecs,
+		})),
+		signingPublicKey,
+		lookup)
+	schemeErr, ok := err.(SLOKSchemeVersionError)
+	if !ok || schemeErr.Version != unsupportedVersion {
+		t.Fatalf("unexpected NewRegistryStreamer error: %v", err)
+	}
+
+	// Likewise for a registry delta.
+
+	_, err = ReadRegistryDelta(
+		writePackage(&RegistryDelta{
+			BaseETag:          "\"base\"",
+			SLOKSchemeVersion: unsupportedVersion,
+			FileSpecs:         fileSpecs,
+		}),
+		signingPublicKey)
+	schemeErr, ok = err.(SLOKSchemeVersionError)
+	if !ok || schemeErr.Version != unsupportedVersion {
+		t.Fatalf("unexpected ReadRegistryDelta error: %v", err)
+	}
+
+	_, err = ReadRegistryDelta(
+		writePackage(&RegistryDelta{
+			BaseETag:          "\"base\"",
+			SLOKSchemeVersion: SLOK_SCHEME_VERSION,
+			FileSpecs:         fileSpecs,
+		}),
+		signingPublicKey)
+	if err != nil {
+		t.Fatalf("ReadRegistryDelta failed: %s", err)
+	}
+}
+
+func TestEmbeddedOSLID(t *testing.T) {
+
+	signingPublicKey, signingPrivateKey, err :=
+		common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	dataPackage, err := common.WriteAuthenticatedDataPackage(
+		"payload", signingPublicKey, signingPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+
+	key, err := common.MakeSecureRandomBytes(KEY_LENGTH_BYTES)
+	if err != nil {
+		t.Fatalf("MakeSecureRandomBytes failed: %s", err)
+	}
+
+	oslID := []byte("osl-a")
+
+	testCases := []struct {
+		description   string
+		content       []byte
+		expectSuccess bool
+	}{
+		{"no embedded OSL ID", dataPackage, true},
+		{"matching OSL ID", append(makeOSLIDHeader(oslID), dataPackage...), true},
+		{"mismatched OSL ID", append(makeOSLIDHeader([]byte("osl-b")), dataPackage...), false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			boxedContent, err := box(key, testCase.content)
+			if err != nil {
+				t.Fatalf("box failed: %s", err)
+			}
+
+			var nonce [24]byte
+			var secretboxKey [KEY_LENGTH_BYTES]byte
+			copy(secretboxKey[:], key)
+			unboxer, err := secretbox.NewOpenReadSeeker(
+				bytes.NewReader(boxedContent), &nonce, &secretboxKey)
+			if err != nil {
+				t.Fatalf("NewOpenReadSeeker failed: %s", err)
+			}
+
+			content, err := skipOSLIDHeader(unboxer, oslID)
+			if !testCase.expectSuccess {
+				if err == nil || !strings.Contains(err.Error(), "OSL ID mismatch") {
+					t.Fatalf("unexpected skipOSLIDHeader result: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("skipOSLIDHeader failed: %s", err)
+			}
+
+			// The authenticated data package reader seeks to the start of
+			// the content following the header on each pass.
+
+			payloadReader, err := common.NewAuthenticatedDataPackageReader(
+				content, signingPublicKey)
+			if err != nil {
+				t.Fatalf("NewAuthenticatedDataPackageReader failed: %s", err)
+			}
+			payload, err := ioutil.ReadAll(payloadReader)
+			if err != nil {
+				t.Fatalf("ReadAll failed: %s", err)
+			}
+			if string(payload) != "payload" {
+				t.Fatalf("unexpected payload: %s", payload)
+			}
+		})
+	}
+}
+
+func TestServerEntryCapabilitiesEncryption(t *testing.T) {
+
+	key, err := common.MakeSecureRandomBytes(KEY_LENGTH_BYTES)
+	if err != nil {
+		t.Fatalf("MakeSecureRandomBytes failed: %s", err)
+	}
+
+	capabilities := []string{"OSSH", "FRONTED-MEEK"}
+
+	encryptedCapabilities, err := EncryptServerEntryCapabilities(key, capabilities)
+	if err != nil {
+		t.Fatalf("EncryptServerEntryCapabilities failed: %s", err)
+	}
+
+	decryptedCapabilities, err := DecryptServerEntryCapabilities(key, encryptedCapabilities)
+	if err != nil {
+		t.Fatalf("DecryptServerEntryCapabilities failed: %s", err)
+	}
+	if strings.Join(decryptedCapabilities, ",") != strings.Join(capabilities, ",") {
+		t.Fatalf("unexpected decrypted capabilities: %v", decryptedCapabilities)
+	}
+
+	// Each encryption uses a new nonce.
+
+	otherEncryptedCapabilities, err := EncryptServerEntryCapabilities(key, capabilities)
+	if err != nil {
+		t.Fatalf("EncryptServerEntryCapabilities failed: %s", err)
+	}
+	if otherEncryptedCapabilities == encryptedCapabilities {
+		t.Fatalf("unexpected repeated encryption")
+	}
+
+	// Decryption fails with another key, or with tampered or malformed
+	// input.
+
+	otherKey, err := common.MakeSecureRandomBytes(KEY_LENGTH_BYTES)
+	if err != nil {
+		t.Fatalf("MakeSecureRandomBytes failed: %s", err)
+	}
+	_, err = DecryptServerEntryCapabilities(otherKey, encryptedCapabilities)
+	if err == nil {
+		t.Fatalf("unexpected decryption with another key")
+	}
+
+	box, _ := base64.StdEncoding.DecodeString(encryptedCapabilities)
+	box[len(box)-1] ^= 1
+	_, err = DecryptServerEntryCapabilities(key, base64.StdEncoding.EncodeToString(box))
+	if err == nil {
+		t.Fatalf("unexpected decryption of tampered input")
+	}
+
+	for _, malformed := range []string{"", "invalid base64", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		_, err = DecryptServerEntryCapabilities(key, malformed)
+		if err == nil {
+			t.Fatalf("unexpected decryption of malformed input: %s", malformed)
+		}
+	}
+}
+
+func TestGetOSLRegistryURLWithPath(t *testing.T) {
+
+	testCases := []struct {
+		description  string
+		baseURL      string
+		registryPath string
+		expectedURL  string
+	}{
+		{"default", "https://example.com/root/", "", "https://example.com/root/osl-registry"},
+		{"default without trailing slash", "https://example.com/root", "", "https://example.com/root/osl-registry"},
+		{"filename override", "https://example.com/root/", "registry.bin", "https://example.com/root/registry.bin"},
+		{"path override", "https://example.com/root/", "meta/v2/osl-registry", "https://example.com/root/meta/v2/osl-registry"},
+		{"query preserved", "https://example.com/root/?key=value", "meta/registry", "https://example.com/root/meta/registry?key=value"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			registryURL := GetOSLRegistryURLWithPath(testCase.baseURL, testCase.registryPath)
+			if registryURL != testCase.expectedURL {
+				t.Fatalf("unexpected registry URL: %s", registryURL)
+			}
+
+			if testCase.registryPath == "" &&
+				registryURL != GetOSLRegistryURL(testCase.baseURL) {
+
+				t.Fatalf("unexpected default registry URL: %s", GetOSLRegistryURL(testCase.baseURL))
+			}
+		})
+	}
+}
@@ -70,6 +70,11 @@ func main() {
 	var omitEmptyOSLsSchemes ints
 	flag.Var(&omitEmptyOSLsSchemes, "omit-empty", "omit empty OSLs for specified scheme(s)")
 
+	var registryGeneration int64
+	flag.Int64Var(
+		&registryGeneration, "generation", 0,
+		"registry generation; must increase with each paving, so clients reject older registries")
+
 	flag.Parse()
 
 	// load config
@@ -220,6 +225,7 @@ func main() {
 			paveServerEntries,
 			omitMD5SumsSchemes,
 			omitEmptyOSLsSchemes,
+			registryGeneration,
 			func(logInfo *osl.PaveLogInfo) {
 				pavedPayloadOSLID[logInfo.OSLID] = true
 				fmt.Printf(
@@ -31,10 +31,10 @@ snapshot so that related parameters, such as two Ints representing a range; or
 a more complex series of related parameters; may be read in an atomic and
 consistent way. For example:
 
-    p := clientParameters.Get()
-    min := p.Int("Min")
-    max := p.Int("Max")
-    p = nil
+	p := clientParameters.Get()
+	min := p.Int("Min")
+	max := p.Int("Max")
+	p = nil
 
 For long-running operations, it is recommended to set any pointer to the
 snapshot to nil to allow garbage collection of old snaphots in cases where the
@@ -78,6 +78,7 @@ const (
 	EstablishTunnelPausePeriod                 = "EstablishTunnelPausePeriod"
 	EstablishTunnelPausePeriodJitter           = "EstablishTunnelPausePeriodJitter"
 	EstablishTunnelServerAffinityGracePeriod   = "EstablishTunnelServerAffinityGracePeriod"
+	EstablishStreamedServerEntries             = "EstablishStreamedServerEntries"
 	StaggerConnectionWorkersPeriod             = "StaggerConnectionWorkersPeriod"
 	StaggerConnectionWorkersJitter             = "StaggerConnectionWorkersJitter"
 	LimitIntensiveConnectionWorkers            = "LimitIntensiveConnectionWorkers"
@@ -131,11 +132,89 @@ const (
 	HTTPProxyOriginServerTimeout               = "HTTPProxyOriginServerTimeout"
 	HTTPProxyMaxIdleConnectionsPerHost         = "HTTPProxyMaxIdleConnectionsPerHost"
 	FetchRemoteServerListTimeout               = "FetchRemoteServerListTimeout"
+	RemoteServerListConnectTimeout             = "RemoteServerListConnectTimeout"
 	FetchRemoteServerListRetryPeriod           = "FetchRemoteServerListRetryPeriod"
+	FetchRemoteServerListDiskFullRetryPeriod   = "FetchRemoteServerListDiskFullRetryPeriod"
 	FetchRemoteServerListStalePeriod           = "FetchRemoteServerListStalePeriod"
+	FetchRemoteServerListMinimumRate           = "FetchRemoteServerListMinimumRate"
+	FetchRemoteServerListRateWindow            = "FetchRemoteServerListRateWindow"
+	FetchRemoteServerListBootstrapTimeout      = "FetchRemoteServerListBootstrapTimeout"
+	FetchRemoteServerListStaggerDelay          = "FetchRemoteServerListStaggerDelay"
 	RemoteServerListSignaturePublicKey         = "RemoteServerListSignaturePublicKey"
+	RemoteServerListLowTrustSignaturePublicKey = "RemoteServerListLowTrustSignaturePublicKey"
+	PrioritizeHighTrustServerEntries           = "PrioritizeHighTrustServerEntries"
+	ServerEntrySourcePriority                  = "ServerEntrySourcePriority"
 	RemoteServerListURLs                       = "RemoteServerListURLs"
+	RemoteServerListRevocationURLs             = "RemoteServerListRevocationURLs"
+	RemoteServerListSecondarySignatureURLs     = "RemoteServerListSecondarySignatureURLs"
+	RemoteServerListSecondaryPublicKey         = "RemoteServerListSecondaryPublicKey"
+	RemoteServerListRevalidateInterval         = "RemoteServerListRevalidateInterval"
+	RemoteServerListFetchMaxTotalBytes         = "RemoteServerListFetchMaxTotalBytes"
+	RemoteServerListFetchMaxConnections        = "RemoteServerListFetchMaxConnections"
+	RemoteServerListHashMissingETags           = "RemoteServerListHashMissingETags"
+	RemoteServerListRetryMaxAttempts           = "RemoteServerListRetryMaxAttempts"
+	RemoteServerListRetryBackoff               = "RemoteServerListRetryBackoff"
+	RemoteServerListRetryBackoffJitter         = "RemoteServerListRetryBackoffJitter"
+	RemoteServerListBootstrapMaxAttempts       = "RemoteServerListBootstrapMaxAttempts"
+	RemoteServerListMaxOSLCount                = "RemoteServerListMaxOSLCount"
+	RemoteServerListMinNewEntriesToReport      = "RemoteServerListMinNewEntriesToReport"
+	RemoteServerListNewEntriesReportWindow     = "RemoteServerListNewEntriesReportWindow"
+	RemoteServerListMaxDecompressionRatio      = "RemoteServerListMaxDecompressionRatio"
+	RemoteServerListMirrorMinimumWeight        = "RemoteServerListMirrorMinimumWeight"
+	RemoteServerListHonorCacheControl          = "RemoteServerListHonorCacheControl"
+	RemoteServerListMaxCacheControlAge         = "RemoteServerListMaxCacheControlAge"
+	RemoteServerListETagWriteMaxAttempts       = "RemoteServerListETagWriteMaxAttempts"
+	RemoteServerListETagWriteRetryBackoff      = "RemoteServerListETagWriteRetryBackoff"
+	RemoteServerListSkipIdenticalContent       = "RemoteServerListSkipIdenticalContent"
+	RemoteServerListRequireTunnel              = "RemoteServerListRequireTunnel"
+	RemoteServerListLegalBlockFailover         = "RemoteServerListLegalBlockFailover"
+	RemoteServerListMirrorFailover             = "RemoteServerListMirrorFailover"
+	RemoteServerListResumeVerifyDigest         = "RemoteServerListResumeVerifyDigest"
+	RemoteServerListNonResumableThreshold      = "RemoteServerListNonResumableThreshold"
+	RemoteServerListDownloadProgressInterval   = "RemoteServerListDownloadProgressInterval"
 	ObfuscatedServerListRootURLs               = "ObfuscatedServerListRootURLs"
+	ObfuscatedServerListShardRootURLs          = "ObfuscatedServerListShardRootURLs"
+	ObfuscatedServerListQuarantineThreshold    = "ObfuscatedServerListQuarantineThreshold"
+	ObfuscatedServerListQuarantinePeriod       = "ObfuscatedServerListQuarantinePeriod"
+	ObfuscatedServerListPrioritizeDownloads    = "ObfuscatedServerListPrioritizeDownloads"
+	ObfuscatedServerListNewServerThreshold     = "ObfuscatedServerListNewServerThreshold"
+	ObfuscatedServerListMinAvailableInodes     = "ObfuscatedServerListMinAvailableInodes"
+	ObfuscatedServerListRegistryDeltas         = "ObfuscatedServerListRegistryDeltas"
+	ObfuscatedServerListRegistryResumeAttempts = "ObfuscatedServerListRegistryResumeAttempts"
+	ObfuscatedServerListResumeRegistryDeltas   = "ObfuscatedServerListResumeRegistryDeltas"
+	ObfuscatedServerListSubdirectoryLength     = "ObfuscatedServerListSubdirectoryLength"
+	ObfuscatedServerListSkipUnchangedFetch     = "ObfuscatedServerListSkipUnchangedFetch"
+	ObfuscatedServerListPersistFetchPlan       = "ObfuscatedServerListPersistFetchPlan"
+	ObfuscatedServerListSkipImportedGeneration = "ObfuscatedServerListSkipImportedGeneration"
+	ObfuscatedServerListRegistryDiff           = "ObfuscatedServerListRegistryDiff"
+	ObfuscatedServerListRecentlySeededFirst    = "ObfuscatedServerListRecentlySeededFirst"
+	ObfuscatedServerListFailOnSLOKLookupError  = "ObfuscatedServerListFailOnSLOKLookupError"
+	ObfuscatedServerListRegistryMinInterval    = "ObfuscatedServerListRegistryMinInterval"
+	ObfuscatedServerListFailureAlertLimit      = "ObfuscatedServerListFailureAlertLimit"
+	ObfuscatedServerListAttemptLogSize         = "ObfuscatedServerListAttemptLogSize"
+	ObfuscatedServerListMaxRetainedFiles       = "ObfuscatedServerListMaxRetainedFiles"
+	ObfuscatedServerListDownloadConcurrency    = "ObfuscatedServerListDownloadConcurrency"
+	ObfuscatedServerListSkipImportedFiles      = "ObfuscatedServerListSkipImportedFiles"
+	VerifyImportedServerEntries                = "VerifyImportedServerEntries"
+	VerifyImportedServerEntriesSampleSize      = "VerifyImportedServerEntriesSampleSize"
+	ProbeImportedServerEntries                 = "ProbeImportedServerEntries"
+	ProbeImportedServerEntriesSampleSize       = "ProbeImportedServerEntriesSampleSize"
+	ProbeImportedServerEntriesTimeout          = "ProbeImportedServerEntriesTimeout"
+	ServerEntryImportMaxWriters                = "ServerEntryImportMaxWriters"
+	ServerEntryMaxTimestampSkew                = "ServerEntryMaxTimestampSkew"
+	ServerEntryImportAtomic                    = "ServerEntryImportAtomic"
+	DataStoreCompaction                        = "DataStoreCompaction"
+	DataStoreCompactionMinimumChurn            = "DataStoreCompactionMinimumChurn"
+	DataStoreLockedRetryAttempts               = "DataStoreLockedRetryAttempts"
+	DataStoreLockedRetryBackoff                = "DataStoreLockedRetryBackoff"
+	DataStoreLockedRetryMaxBackoff             = "DataStoreLockedRetryMaxBackoff"
+	RemoteServerListTelemetryMaxRuns           = "RemoteServerListTelemetryMaxRuns"
+	RemoteServerListTelemetryRedactURLs        = "RemoteServerListTelemetryRedactURLs"
+	RemoteServerListTelemetryUploadBatchSize   = "RemoteServerListTelemetryUploadBatchSize"
+	RemoteServerListTelemetryUploadMaxRuns     = "RemoteServerListTelemetryUploadMaxRuns"
+	RemoteServerListTelemetryUploadTimeout     = "RemoteServerListTelemetryUploadTimeout"
+	RemoteServerListTelemetryUploadBackoff     = "RemoteServerListTelemetryUploadBackoff"
+	RemoteServerListTelemetryUploadMaxBackoff  = "RemoteServerListTelemetryUploadMaxBackoff"
 	PsiphonAPIRequestTimeout                   = "PsiphonAPIRequestTimeout"
 	PsiphonAPIStatusRequestPeriodMin           = "PsiphonAPIStatusRequestPeriodMin"
 	PsiphonAPIStatusRequestPeriodMax           = "PsiphonAPIStatusRequestPeriodMax"
@@ -155,6 +234,7 @@ const (
 	FetchUpgradeStalePeriod                    = "FetchUpgradeStalePeriod"
 	UpgradeDownloadURLs                        = "UpgradeDownloadURLs"
 	UpgradeDownloadClientVersionHeader         = "UpgradeDownloadClientVersionHeader"
+	DownloadDisableKeepAlives                  = "DownloadDisableKeepAlives"
 	TotalBytesTransferredNoticePeriod          = "TotalBytesTransferredNoticePeriod"
 	MeekDialDomainsOnly                        = "MeekDialDomainsOnly"
 	MeekLimitBufferSizes                       = "MeekLimitBufferSizes"
@@ -219,6 +299,7 @@ var defaultClientParameters = map[string]struct {
 	EstablishTunnelPausePeriod:               {value: 5 * time.Second, minimum: 1 * time.Millisecond},
 	EstablishTunnelPausePeriodJitter:         {value: 0.1, minimum: 0.0},
 	EstablishTunnelServerAffinityGracePeriod: {value: 1 * time.Second, minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+	EstablishStreamedServerEntries:           {value: false},
 	StaggerConnectionWorkersPeriod:           {value: time.Duration(0), minimum: time.Duration(0)},
 	StaggerConnectionWorkersJitter:           {value: 0.1, minimum: 0.0},
 	LimitIntensiveConnectionWorkers:          {value: 0, minimum: 0},
@@ -300,12 +381,97 @@ var defaultClientParameters = map[string]struct {
 	HTTPProxyOriginServerTimeout:       {value: 15 * time.Second, minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
 	HTTPProxyMaxIdleConnectionsPerHost: {value: 50, minimum: 0},
 
-	FetchRemoteServerListTimeout:       {value: 30 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
-	FetchRemoteServerListRetryPeriod:   {value: 30 * time.Second, minimum: 1 * time.Millisecond},
-	FetchRemoteServerListStalePeriod:   {value: 6 * time.Hour, minimum: 1 * time.Hour},
-	RemoteServerListSignaturePublicKey: {value: ""},
-	RemoteServerListURLs:               {value: DownloadURLs{}},
-	ObfuscatedServerListRootURLs:       {value: DownloadURLs{}},
+	FetchRemoteServerListTimeout:             {value: 30 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+	RemoteServerListConnectTimeout:           {value: time.Duration(0), minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+	FetchRemoteServerListRetryPeriod:         {value: 30 * time.Second, minimum: 1 * time.Millisecond},
+	FetchRemoteServerListDiskFullRetryPeriod: {value: 1 * time.Hour, minimum: 1 * time.Millisecond},
+	FetchRemoteServerListStalePeriod:         {value: 6 * time.Hour, minimum: 1 * time.Hour},
+	FetchRemoteServerListMinimumRate:         {value: 0, minimum: 0},
+	FetchRemoteServerListRateWindow:          {value: 5 * time.Second, minimum: 1 * time.Millisecond, flags: useNetworkLatencyMultiplier},
+	FetchRemoteServerListBootstrapTimeout:    {value: 60 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+	FetchRemoteServerListStaggerDelay:        {value: time.Duration(0), minimum: time.Duration(0)},
+	RemoteServerListSignaturePublicKey:       {value: ""},
+	RemoteServerListURLs:                     {value: DownloadURLs{}},
+	RemoteServerListRevocationURLs:           {value: DownloadURLs{}},
+	RemoteServerListSecondarySignatureURLs:   {value: DownloadURLs{}},
+	RemoteServerListSecondaryPublicKey:       {value: ""},
+	RemoteServerListRevalidateInterval:       {value: time.Duration(0), minimum: time.Duration(0)},
+	RemoteServerListFetchMaxTotalBytes:       {value: 0, minimum: 0},
+	RemoteServerListFetchMaxConnections:      {value: 2, minimum: 1},
+	RemoteServerListHashMissingETags:         {value: true},
+	RemoteServerListRetryMaxAttempts:         {value: 1, minimum: 1},
+	RemoteServerListRetryBackoff:             {value: 1 * time.Second, minimum: 1 * time.Millisecond},
+	RemoteServerListRetryBackoffJitter:       {value: 0.1, minimum: 0.0},
+	RemoteServerListBootstrapMaxAttempts:     {value: 3, minimum: 1},
+	RemoteServerListMaxOSLCount:              {value: 10000, minimum: 0},
+	RemoteServerListMinNewEntriesToReport:    {value: 1, minimum: 1},
+	RemoteServerListNewEntriesReportWindow:   {value: time.Duration(0), minimum: time.Duration(0)},
+	RemoteServerListMaxDecompressionRatio:    {value: 100.0, minimum: 0.0},
+	RemoteServerListMirrorMinimumWeight:      {value: 0.1, minimum: 0.0},
+	RemoteServerListHonorCacheControl:        {value: false},
+	RemoteServerListMaxCacheControlAge:       {value: 24 * time.Hour, minimum: time.Duration(0)},
+	RemoteServerListETagWriteMaxAttempts:     {value: 3, minimum: 1},
+	RemoteServerListETagWriteRetryBackoff:    {value: 50 * time.Millisecond, minimum: time.Duration(0)},
+	RemoteServerListSkipIdenticalContent:     {value: false},
+	RemoteServerListRequireTunnel:            {value: false},
+	RemoteServerListLegalBlockFailover:       {value: true},
+	RemoteServerListMirrorFailover:           {value: true},
+	RemoteServerListResumeVerifyDigest:       {value: false},
+	RemoteServerListNonResumableThreshold:    {value: 2, minimum: 0},
+	RemoteServerListDownloadProgressInterval: {value: 1 * time.Second, minimum: time.Duration(0)},
+	ObfuscatedServerListRootURLs:             {value: DownloadURLs{}},
+	ObfuscatedServerListShardRootURLs:        {value: DownloadURLsList{}},
+
+	ObfuscatedServerListQuarantineThreshold:    {value: 3, minimum: 1},
+	ObfuscatedServerListQuarantinePeriod:       {value: 24 * time.Hour, minimum: time.Duration(0)},
+	ObfuscatedServerListPrioritizeDownloads:    {value: false},
+	ObfuscatedServerListNewServerThreshold:     {value: 0, minimum: 0},
+	ObfuscatedServerListMinAvailableInodes:     {value: 1, minimum: 0},
+	ObfuscatedServerListRegistryDeltas:         {value: false},
+	ObfuscatedServerListRegistryResumeAttempts: {value: 2, minimum: 0},
+	ObfuscatedServerListResumeRegistryDeltas:   {value: false},
+	ObfuscatedServerListSubdirectoryLength:     {value: 0, minimum: 0},
+	ObfuscatedServerListSkipUnchangedFetch:     {value: false},
+	ObfuscatedServerListPersistFetchPlan:       {value: false},
+	ObfuscatedServerListSkipImportedGeneration: {value: false},
+	ObfuscatedServerListRegistryDiff:           {value: false},
+	ObfuscatedServerListRecentlySeededFirst:    {value: false},
+	ObfuscatedServerListFailOnSLOKLookupError:  {value: false},
+	ObfuscatedServerListRegistryMinInterval:    {value: time.Duration(0), minimum: time.Duration(0)},
+	ObfuscatedServerListFailureAlertLimit:      {value: 3, minimum: 0},
+	ObfuscatedServerListAttemptLogSize:         {value: 0, minimum: 0},
+	ObfuscatedServerListMaxRetainedFiles:       {value: 0, minimum: 0},
+	ObfuscatedServerListDownloadConcurrency:    {value: 2, minimum: 1},
+	ObfuscatedServerListSkipImportedFiles:      {value: false},
+
+	VerifyImportedServerEntries:           {value: false},
+	VerifyImportedServerEntriesSampleSize: {value: 10, minimum: 1},
+
+	ProbeImportedServerEntries:           {value: false},
+	ProbeImportedServerEntriesSampleSize: {value: 10, minimum: 1},
+	ProbeImportedServerEntriesTimeout:    {value: 5 * time.Second, minimum: 1 * time.Millisecond, flags: useNetworkLatencyMultiplier},
+
+	ServerEntryImportMaxWriters: {value: 0, minimum: 0},
+	ServerEntryMaxTimestampSkew: {value: time.Duration(0), minimum: time.Duration(0)},
+	ServerEntryImportAtomic:     {value: false},
+
+	DataStoreCompaction:             {value: false},
+	DataStoreCompactionMinimumChurn: {value: 1000, minimum: 1},
+	DataStoreLockedRetryAttempts:    {value: 3, minimum: 0},
+	DataStoreLockedRetryBackoff:     {value: 50 * time.Millisecond, minimum: time.Duration(0)},
+	DataStoreLockedRetryMaxBackoff:  {value: 1 * time.Second, minimum: time.Duration(0)},
+
+	RemoteServerListTelemetryMaxRuns:          {value: 10, minimum: 1},
+	RemoteServerListTelemetryRedactURLs:       {value: false},
+	RemoteServerListTelemetryUploadBatchSize:  {value: 10, minimum: 1},
+	RemoteServerListTelemetryUploadMaxRuns:    {value: 100, minimum: 1},
+	RemoteServerListTelemetryUploadTimeout:    {value: 30 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+	RemoteServerListTelemetryUploadBackoff:    {value: 5 * time.Second, minimum: 1 * time.Millisecond},
+	RemoteServerListTelemetryUploadMaxBackoff: {value: 5 * time.Minute, minimum: 1 * time.Millisecond},
+
+	RemoteServerListLowTrustSignaturePublicKey: {value: ""},
+	PrioritizeHighTrustServerEntries:           {value: true},
+	ServerEntrySourcePriority:                  {value: []string{}},
 
 	PsiphonAPIRequestTimeout: {value: 20 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 
@@ -330,6 +496,8 @@ var defaultClientParameters = map[string]struct {
 	UpgradeDownloadURLs:                {value: DownloadURLs{}},
 	UpgradeDownloadClientVersionHeader: {value: ""},
 
+	DownloadDisableKeepAlives: {value: false},
+
 	TotalBytesTransferredNoticePeriod: {value: 5 * time.Minute, minimum: 1 * time.Second},
 
 	// The meek server times out inactive sessions after 45 seconds, so this
@@ -525,6 +693,14 @@ func (p *ClientParameters) Set(
 					}
 					return nil, common.ContextError(err)
 				}
+			case DownloadURLsList:
+				err := v.DecodeAndValidate()
+				if err != nil {
+					if skipOnError {
+						continue
+					}
+					return nil, common.ContextError(err)
+				}
 			case protocol.TunnelProtocols:
 				if skipOnError {
 					newValue = v.PruneInvalid()
@@ -823,6 +999,13 @@ func (p *ClientParametersSnapshot) DownloadURLs(name string) DownloadURLs {
 	return value
 }
 
+// DownloadURLsList returns a DownloadURLsList parameter value.
+func (p *ClientParametersSnapshot) DownloadURLsList(name string) DownloadURLsList {
+	value := DownloadURLsList{}
+	p.getValue(name, &value)
+	return value
+}
+
 // RateLimits returns a common.RateLimits parameter value.
 func (p *ClientParametersSnapshot) RateLimits(name string) common.RateLimits {
 	value := common.RateLimits{}
@@ -43,6 +43,11 @@ func TestGetDefaultParameters(t *testing.T) {
 			if v != g {
 				t.Fatalf("String returned %+v expected %+v", v, g)
 			}
+		case []string:
+			g := p.Get().Strings(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("Strings returned %+v expected %+v", v, g)
+			}
 		case int:
 			g := p.Get().Int(name)
 			if v != g {
@@ -83,6 +88,11 @@ func TestGetDefaultParameters(t *testing.T) {
 			if !reflect.DeepEqual(v, g) {
 				t.Fatalf("DownloadURLs returned %+v expected %+v", v, g)
 			}
+		case DownloadURLsList:
+			g := p.Get().DownloadURLsList(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("DownloadURLsList returned %+v expected %+v", v, g)
+			}
 		case common.RateLimits:
 			g := p.Get().RateLimits(name)
 			if !reflect.DeepEqual(v, g) {
@@ -20,8 +20,11 @@
 package parameters
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"math/rand"
+	"net/url"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 )
@@ -44,6 +47,34 @@ type DownloadURL struct {
 	// candidate locations. For a value of N, this URL is only a candidate
 	// after N rounds of attempting the download from other URLs.
 	OnlyAfterAttempts int
+
+	// FallbackEndpoints specifies alternate endpoints for this URL, such as
+	// another port or scheme on the same host, each in the form
+	// scheme://host[:port]. When a connection to the URL fails, the download
+	// is attempted, in order, with the scheme and host of each fallback
+	// endpoint. Each endpoint is base64 encoded, as URL is.
+	FallbackEndpoints []string
+
+	// TLSConfig specifies TLS settings for this URL, for mirrors which
+	// require settings other than the defaults used for all URLs. When nil,
+	// the defaults apply.
+	TLSConfig *DownloadTLSConfig
+}
+
+// DownloadTLSConfig specifies the TLS settings for a DownloadURL.
+type DownloadTLSConfig struct {
+
+	// SNIServerName, when set, is sent in the SNI server_name field in place
+	// of the URL host name, and the server certificate is verified against
+	// this name. SNIServerName is base64 encoded, as URL is.
+	SNIServerName string
+
+	// PinnedPublicKeyHashes, when set, requires the server certificate to
+	// have one of the listed public keys. Each value is the base64 encoded
+	// SHA-256 digest of a DER encoded SubjectPublicKeyInfo. The pins are
+	// checked in addition to certificate verification and also apply when
+	// SkipVerify is set.
+	PinnedPublicKeyHashes []string
 }
 
 // DownloadURLs is a list of download URLs.
@@ -66,6 +97,25 @@ func (d DownloadURLs) DecodeAndValidate() error {
 		}
 
 		downloadURL.URL = string(decodedURL)
+
+		for i, endpoint := range downloadURL.FallbackEndpoints {
+			decodedEndpoint, err := base64.StdEncoding.DecodeString(endpoint)
+			if err != nil {
+				return common.ContextError(fmt.Errorf("failed to decode fallback endpoint: %s", err))
+			}
+			err = validateFallbackEndpoint(string(decodedEndpoint))
+			if err != nil {
+				return common.ContextError(err)
+			}
+			downloadURL.FallbackEndpoints[i] = string(decodedEndpoint)
+		}
+
+		if downloadURL.TLSConfig != nil {
+			err = downloadURL.TLSConfig.decodeAndValidate()
+			if err != nil {
+				return common.ContextError(err)
+			}
+		}
 	}
 
 	if !hasOnlyAfterZero {
@@ -75,6 +125,51 @@ func (d DownloadURLs) DecodeAndValidate() error {
 	return nil
 }
 
+// validateFallbackEndpoint checks that endpoint is an http or https scheme
+// and host, with no path, query, or fragment.
+func validateFallbackEndpoint(endpoint string) error {
+
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return common.ContextError(fmt.Errorf("invalid fallback endpoint: %s", err))
+	}
+
+	if (endpointURL.Scheme != "http" && endpointURL.Scheme != "https") ||
+		endpointURL.Host == "" ||
+		endpointURL.User != nil ||
+		(endpointURL.Path != "" && endpointURL.Path != "/") ||
+		endpointURL.RawQuery != "" ||
+		endpointURL.Fragment != "" {
+
+		return common.ContextError(fmt.Errorf("invalid fallback endpoint: %s", endpoint))
+	}
+
+	return nil
+}
+
+// decodeAndValidate decodes SNIServerName and checks that each pinned public
+// key hash is a base64 encoded SHA-256 digest.
+func (c *DownloadTLSConfig) decodeAndValidate() error {
+
+	decodedSNIServerName, err := base64.StdEncoding.DecodeString(c.SNIServerName)
+	if err != nil {
+		return common.ContextError(fmt.Errorf("failed to decode SNI server name: %s", err))
+	}
+	c.SNIServerName = string(decodedSNIServerName)
+
+	for _, pin := range c.PinnedPublicKeyHashes {
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil {
+			return common.ContextError(fmt.Errorf("failed to decode pinned public key hash: %s", err))
+		}
+		if len(digest) != sha256.Size {
+			return common.ContextError(fmt.Errorf("invalid pinned public key hash: %s", pin))
+		}
+	}
+
+	return nil
+}
+
 // Select chooses a DownloadURL from the list.
 //
 // The first return value is the canonical URL, to be used
@@ -85,6 +180,164 @@ func (d DownloadURLs) DecodeAndValidate() error {
 // selected based at random from the candidates allowed in the
 // specified attempt.
 func (d DownloadURLs) Select(attempt int) (string, string, bool) {
+	return d.selectUniform(attempt, nil)
+}
+
+// selectUniform performs Select using random or, when random is nil, a
+// secure random selection.
+func (d DownloadURLs) selectUniform(
+	attempt int, random *rand.Rand) (string, string, bool) {
+
+	canonicalURL, candidates := d.candidates(attempt)
+
+	if len(candidates) < 1 {
+		// This case is not expected, as decodeAndValidateDownloadURLs
+		// should reject configs that would have no candidates for
+		// 0 attempts.
+		return "", "", true
+	}
+
+	var selection int
+	if random != nil {
+		selection = random.Intn(len(candidates))
+	} else {
+		var err error
+		selection, err = common.MakeSecureRandomInt(len(candidates))
+		if err != nil {
+			selection = 0
+		}
+	}
+	downloadURL := d[candidates[selection]]
+
+	return downloadURL.URL, canonicalURL, downloadURL.SkipVerify
+}
+
+// SelectWeighted is Select with the download URL selected at random from
+// the candidates allowed in the specified attempt in proportion to its
+// weight. weights is indexed in the same order as the DownloadURLs. When
+// weights is not the same length as the DownloadURLs, or when no candidate
+// has a positive weight, the selection is uniform, as in Select.
+//
+// When random is not nil, the selection uses random in place of secure
+// random values, so that a deterministic random source yields a
+// reproducible selection.
+func (d DownloadURLs) SelectWeighted(
+	attempt int, weights []float64, random *rand.Rand) (string, string, bool) {
+
+	if len(weights) != len(d) {
+		return d.selectUniform(attempt, random)
+	}
+
+	canonicalURL, candidates := d.candidates(attempt)
+
+	totalWeight := 0.0
+	for _, index := range candidates {
+		if weights[index] > 0 {
+			totalWeight += weights[index]
+		}
+	}
+
+	if totalWeight <= 0 {
+		return d.selectUniform(attempt, random)
+	}
+
+	// Scale a 53-bit random integer, the precision of a float64 mantissa,
+	// to a point in [0, totalWeight).
+
+	const randomRange = 1 << 53
+	var n int64
+	if random != nil {
+		n = random.Int63n(randomRange)
+	} else {
+		var err error
+		n, err = common.MakeSecureRandomInt64(randomRange)
+		if err != nil {
+			n = 0
+		}
+	}
+	point := float64(n) / randomRange * totalWeight
+
+	selection := -1
+	for _, index := range candidates {
+		if weights[index] <= 0 {
+			continue
+		}
+		selection = index
+		point -= weights[index]
+		if point < 0 {
+			break
+		}
+	}
+	downloadURL := d[selection]
+
+	return downloadURL.URL, canonicalURL, downloadURL.SkipVerify
+}
+
+// SelectWeightedExcluding is SelectWeighted with the candidates whose URL,
+// as returned by Select, is in excluded removed from the selection. The
+// canonical URL is unchanged. The returned ok is false when every candidate
+// is excluded, in which case no URL is selected.
+func (d DownloadURLs) SelectWeightedExcluding(
+	attempt int,
+	weights []float64,
+	excluded map[string]bool,
+	random *rand.Rand) (string, string, bool, bool) {
+
+	canonicalURL, candidates := d.candidates(attempt)
+
+	// The remaining candidates are selected from as a list of URLs which
+	// are all candidates in the first attempt.
+
+	var remaining DownloadURLs
+	var remainingWeights []float64
+	for _, index := range candidates {
+		if excluded[d[index].URL] {
+			continue
+		}
+		downloadURL := *d[index]
+		downloadURL.OnlyAfterAttempts = 0
+		remaining = append(remaining, &downloadURL)
+		if len(weights) == len(d) {
+			remainingWeights = append(remainingWeights, weights[index])
+		}
+	}
+
+	if len(remaining) == 0 {
+		return "", "", false, false
+	}
+
+	downloadURL, _, skipVerify := remaining.SelectWeighted(0, remainingWeights, random)
+
+	return downloadURL, canonicalURL, skipVerify, true
+}
+
+// FallbackEndpoints returns the fallback endpoints of the DownloadURL with
+// the specified URL, as returned by Select, or nil when there is no such
+// DownloadURL.
+func (d DownloadURLs) FallbackEndpoints(URL string) []string {
+	for _, downloadURL := range d {
+		if downloadURL.URL == URL {
+			return downloadURL.FallbackEndpoints
+		}
+	}
+	return nil
+}
+
+// TLSConfig returns the TLS config of the DownloadURL with the specified URL,
+// as returned by Select, or nil when there is no such DownloadURL or when it
+// has no TLS config.
+func (d DownloadURLs) TLSConfig(URL string) *DownloadTLSConfig {
+	for _, downloadURL := range d {
+		if downloadURL.URL == URL {
+			return downloadURL.TLSConfig
+		}
+	}
+	return nil
+}
+
+// candidates returns the canonical URL and the indexes of the DownloadURLs
+// which are candidates in the specified attempt.
+func (d DownloadURLs) candidates(attempt int) (string, []int) {
 
 	// The first OnlyAfterAttempts = 0 URL is the canonical URL. This
 	// is the value used as the key for SetUrlETag when multiple download
@@ -105,18 +358,21 @@ func (d DownloadURLs) Select(attempt int) (string, string, bool) {
 		}
 	}
 
-	if len(candidates) < 1 {
-		// This case is not expected, as decodeAndValidateDownloadURLs
-		// should reject configs that would have no candidates for
-		// 0 attempts.
-		return "", "", true
-	}
+	return canonicalURL, candidates
+}
 
-	selection, err := common.MakeSecureRandomInt(len(candidates))
-	if err != nil {
-		selection = 0
-	}
-	downloadURL := d[candidates[selection]]
+// DownloadURLsList is a list of DownloadURLs. Each DownloadURLs specifies the
+// candidate locations of a distinct resource, such as one shard of a set of
+// resources distributed across multiple locations.
+type DownloadURLsList []DownloadURLs
 
-	return downloadURL.URL, canonicalURL, downloadURL.SkipVerify
+// DecodeAndValidate validates each list of download URLs.
+func (l DownloadURLsList) DecodeAndValidate() error {
+	for _, downloadURLs := range l {
+		err := downloadURLs.DecodeAndValidate()
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+	return nil
 }
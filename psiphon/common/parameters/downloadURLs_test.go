@@ -21,6 +21,7 @@ package parameters
 
 import (
 	"encoding/base64"
+	"math/rand"
 	"testing"
 )
 
@@ -186,3 +187,289 @@ func TestDownloadURLs(t *testing.T) {
 	}
 
 }
+
+func TestDownloadURLsSelectWeighted(t *testing.T) {
+
+	decodedA := "a.example.com"
+	decodedB := "b.example.com"
+	decodedC := "c.example.com"
+
+	downloadURLs := DownloadURLs{
+		{
+			URL:               base64.StdEncoding.EncodeToString([]byte(decodedA)),
+			OnlyAfterAttempts: 0,
+		},
+		{
+			URL:               base64.StdEncoding.EncodeToString([]byte(decodedB)),
+			OnlyAfterAttempts: 0,
+		},
+		{
+			URL:               base64.StdEncoding.EncodeToString([]byte(decodedC)),
+			OnlyAfterAttempts: 1,
+		},
+	}
+
+	err := downloadURLs.DecodeAndValidate()
+	if err != nil {
+		t.Fatalf("unexpected validation error: %s", err)
+	}
+
+	runs := 1000
+
+	// A is weighted 9:1 over B, and C, which has the largest weight, is not
+	// a candidate in the first attempt.
+
+	selections := make(map[string]int)
+	for i := 0; i < runs; i++ {
+		url, canonicalURL, _ := downloadURLs.SelectWeighted(0, []float64{9.0, 1.0, 100.0}, nil)
+		if canonicalURL != decodedA {
+			t.Fatalf("unexpected canonical URL: %s", canonicalURL)
+		}
+		selections[url] += 1
+	}
+
+	if selections[decodedC] != 0 {
+		t.Fatalf("unexpected selection of non-candidate: %v", selections)
+	}
+	if selections[decodedA] <= selections[decodedB]*2 {
+		t.Fatalf("unexpected weighted selections: %v", selections)
+	}
+
+	// A candidate with no weight is not selected while another candidate has
+	// a positive weight.
+
+	selections = make(map[string]int)
+	for i := 0; i < runs; i++ {
+		url, _, _ := downloadURLs.SelectWeighted(1, []float64{0.0, 1.0, 0.0}, nil)
+		selections[url] += 1
+	}
+
+	if selections[decodedB] != runs {
+		t.Fatalf("unexpected weighted selections: %v", selections)
+	}
+
+	// Without positive weights, or with mismatched weights, the selection is
+	// uniform.
+
+	for _, weights := range [][]float64{{0.0, 0.0, 0.0}, {1.0}} {
+		selections = make(map[string]int)
+		for i := 0; i < runs; i++ {
+			url, _, _ := downloadURLs.SelectWeighted(1, weights, nil)
+			selections[url] += 1
+		}
+		if len(selections) != len(downloadURLs) {
+			t.Fatalf("unexpected uniform selections: %v", selections)
+		}
+	}
+
+	// With deterministic random sources with the same seed, weighted and
+	// uniform selections are reproducible.
+
+	for _, weights := range [][]float64{{9.0, 1.0, 100.0}, {1.0}} {
+		randomA := rand.New(rand.NewSource(1))
+		randomB := rand.New(rand.NewSource(1))
+		for i := 0; i < runs; i++ {
+			urlA, _, _ := downloadURLs.SelectWeighted(1, weights, randomA)
+			urlB, _, _ := downloadURLs.SelectWeighted(1, weights, randomB)
+			if urlA != urlB {
+				t.Fatalf("unexpected selections: %s, %s", urlA, urlB)
+			}
+		}
+	}
+}
+
+func TestDownloadURLsSelectWeightedExcluding(t *testing.T) {
+
+	decodedA := "a.example.com"
+	decodedB := "b.example.com"
+	decodedC := "c.example.com"
+
+	downloadURLs := DownloadURLs{
+		{
+			URL:               base64.StdEncoding.EncodeToString([]byte(decodedA)),
+			OnlyAfterAttempts: 0,
+		},
+		{
+			URL:               base64.StdEncoding.EncodeToString([]byte(decodedB)),
+			OnlyAfterAttempts: 0,
+		},
+		{
+			URL:               base64.StdEncoding.EncodeToString([]byte(decodedC)),
+			OnlyAfterAttempts: 1,
+		},
+	}
+
+	err := downloadURLs.DecodeAndValidate()
+	if err != nil {
+		t.Fatalf("unexpected validation error: %s", err)
+	}
+
+	runs := 1000
+
+	// An excluded candidate is never selected, even with the largest
+	// weight, and the canonical URL is unchanged.
+
+	selections := make(map[string]int)
+	for i := 0; i < runs; i++ {
+		url, canonicalURL, _, ok := downloadURLs.SelectWeightedExcluding(
+			1, []float64{100.0, 1.0, 1.0}, map[string]bool{decodedA: true}, nil)
+		if !ok || canonicalURL != decodedA {
+			t.Fatalf("unexpected selection: %s, %s, %v", url, canonicalURL, ok)
+		}
+		selections[url] += 1
+	}
+
+	if selections[decodedA] != 0 || selections[decodedB] == 0 || selections[decodedC] == 0 {
+		t.Fatalf("unexpected selections: %v", selections)
+	}
+
+	// Non-candidates remain excluded.
+
+	for i := 0; i < runs; i++ {
+		url, _, _, ok := downloadURLs.SelectWeightedExcluding(
+			0, nil, map[string]bool{decodedA: true}, nil)
+		if !ok || url != decodedB {
+			t.Fatalf("unexpected selection: %s, %v", url, ok)
+		}
+	}
+
+	// When every candidate is excluded, no URL is selected.
+
+	_, _, _, ok := downloadURLs.SelectWeightedExcluding(
+		0, nil, map[string]bool{decodedA: true, decodedB: true}, nil)
+	if ok {
+		t.Fatalf("unexpected selection")
+	}
+}
+
+func TestDownloadURLsFallbackEndpoints(t *testing.T) {
+
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	downloadURLs := DownloadURLs{
+		{
+			URL:               encode("https://a.example.com/list"),
+			OnlyAfterAttempts: 0,
+			FallbackEndpoints: []string{
+				encode("https://a.example.com:8443"),
+				encode("http://a.example.com:80"),
+			},
+		},
+		{
+			URL:               encode("https://b.example.com/list"),
+			OnlyAfterAttempts: 0,
+		},
+	}
+
+	err := downloadURLs.DecodeAndValidate()
+	if err != nil {
+		t.Fatalf("unexpected validation error: %s", err)
+	}
+
+	endpoints := downloadURLs.FallbackEndpoints("https://a.example.com/list")
+	if len(endpoints) != 2 ||
+		endpoints[0] != "https://a.example.com:8443" ||
+		endpoints[1] != "http://a.example.com:80" {
+
+		t.Fatalf("unexpected fallback endpoints: %+v", endpoints)
+	}
+
+	if downloadURLs.FallbackEndpoints("https://b.example.com/list") != nil ||
+		downloadURLs.FallbackEndpoints("https://c.example.com/list") != nil {
+
+		t.Fatalf("unexpected fallback endpoints")
+	}
+
+	for _, endpoint := range []string{
+		"ftp://a.example.com",
+		"https://",
+		"https://a.example.com:8443/list",
+		"https://a.example.com?q=1",
+		"a.example.com:8443",
+	} {
+		downloadURLs := DownloadURLs{
+			{
+				URL:               encode("https://a.example.com/list"),
+				OnlyAfterAttempts: 0,
+				FallbackEndpoints: []string{encode(endpoint)},
+			},
+		}
+		if downloadURLs.DecodeAndValidate() == nil {
+			t.Fatalf("expected validation error: %s", endpoint)
+		}
+	}
+
+	downloadURLs = DownloadURLs{
+		{
+			URL:               encode("https://a.example.com/list"),
+			OnlyAfterAttempts: 0,
+			FallbackEndpoints: []string{"not base64!"},
+		},
+	}
+	if downloadURLs.DecodeAndValidate() == nil {
+		t.Fatalf("expected decode error")
+	}
+}
+
+func TestDownloadURLsTLSConfig(t *testing.T) {
+
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	pin := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	downloadURLs := DownloadURLs{
+		{
+			URL:               encode("https://a.example.com/list"),
+			OnlyAfterAttempts: 0,
+			TLSConfig: &DownloadTLSConfig{
+				SNIServerName:         encode("front.example.com"),
+				PinnedPublicKeyHashes: []string{pin},
+			},
+		},
+		{
+			URL:               encode("https://b.example.com/list"),
+			OnlyAfterAttempts: 0,
+		},
+	}
+
+	err := downloadURLs.DecodeAndValidate()
+	if err != nil {
+		t.Fatalf("unexpected validation error: %s", err)
+	}
+
+	tlsConfig := downloadURLs.TLSConfig("https://a.example.com/list")
+	if tlsConfig == nil ||
+		tlsConfig.SNIServerName != "front.example.com" ||
+		len(tlsConfig.PinnedPublicKeyHashes) != 1 ||
+		tlsConfig.PinnedPublicKeyHashes[0] != pin {
+
+		t.Fatalf("unexpected TLS config: %+v", tlsConfig)
+	}
+
+	if downloadURLs.TLSConfig("https://b.example.com/list") != nil ||
+		downloadURLs.TLSConfig("https://c.example.com/list") != nil {
+
+		t.Fatalf("unexpected TLS config")
+	}
+
+	for _, tlsConfig := range []*DownloadTLSConfig{
+		{SNIServerName: "not base64!"},
+		{PinnedPublicKeyHashes: []string{"not base64!"}},
+		{PinnedPublicKeyHashes: []string{base64.StdEncoding.EncodeToString(make([]byte, 20))}},
+	} {
+		downloadURLs := DownloadURLs{
+			{
+				URL:               encode("https://a.example.com/list"),
+				OnlyAfterAttempts: 0,
+				TLSConfig:         tlsConfig,
+			},
+		}
+		if downloadURLs.DecodeAndValidate() == nil {
+			t.Fatalf("expected validation error: %+v", tlsConfig)
+		}
+	}
+}
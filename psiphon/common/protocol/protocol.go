@@ -45,6 +45,11 @@ const (
 	SERVER_ENTRY_SOURCE_TARGET     = "TARGET"
 	SERVER_ENTRY_SOURCE_OBFUSCATED = "OBFUSCATED"
 
+	// SERVER_ENTRY_SCHEMA_VERSION is the newest server entry schema version
+	// this client supports. Server entries without a schemaVersion field
+	// are schema version 0.
+	SERVER_ENTRY_SCHEMA_VERSION = 1
+
 	CAPABILITY_SSH_API_REQUESTS            = "ssh-api-requests"
 	CAPABILITY_UNTUNNELED_WEB_API_REQUESTS = "handshake"
 
@@ -28,7 +28,9 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 )
@@ -65,6 +67,17 @@ type ServerEntry struct {
 	TacticsRequestObfuscatedKey   string   `json:"tacticsRequestObfuscatedKey"`
 	MarionetteFormat              string   `json:"marionetteFormat"`
 	ConfigurationVersion          int      `json:"configurationVersion"`
+	SchemaVersion                 int      `json:"schemaVersion"`
+
+	// AvailabilityWindows, when not empty, are the daily time windows in
+	// which the server is live, as when a server is only available during
+	// certain hours for load management. See IsAvailableAt.
+	AvailabilityWindows []AvailabilityWindow `json:"availabilityWindows,omitempty"`
+
+	// MinimumClientVersion, when not 0, is the oldest client version which
+	// supports the server, as when a server requires newer client features.
+	// See GetMinimumClientVersion.
+	MinimumClientVersion int `json:"minimumClientVersion,omitempty"`
 
 	// These local fields are not expected to be present in downloaded server
 	// entries. They are added by the client to record and report stats about
@@ -73,6 +86,42 @@ type ServerEntry struct {
 	LocalTimestamp string `json:"localTimestamp"`
 }
 
+// AvailabilityWindow is a daily time window, from Start until End, which are
+// UTC times of day in "15:04" format. Start is inclusive and End is
+// exclusive. A window with End before Start spans midnight, and a window
+// with End equal to Start spans the entire day.
+type AvailabilityWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// contains indicates whether the UTC time of day of t is within the window.
+// ok is false when the window is malformed.
+func (window AvailabilityWindow) contains(t time.Time) (contains bool, ok bool) {
+
+	start, err := time.Parse("15:04", window.Start)
+	if err != nil {
+		return false, false
+	}
+	end, err := time.Parse("15:04", window.End)
+	if err != nil {
+		return false, false
+	}
+
+	t = t.UTC()
+	minute := t.Hour()*60 + t.Minute()
+	startMinute := start.Hour()*60 + start.Minute()
+	endMinute := end.Hour()*60 + end.Minute()
+
+	if startMinute == endMinute {
+		return true, true
+	}
+	if startMinute < endMinute {
+		return minute >= startMinute && minute < endMinute, true
+	}
+	return minute >= startMinute || minute < endMinute, true
+}
+
 // ServerEntryFields is an alternate representation of ServerEntry which
 // enables future compatibility when unmarshaling and persisting new server
 // entries which may contain new, unrecognized fields not in the ServerEntry
@@ -86,15 +135,19 @@ type ServerEntry struct {
 type ServerEntryFields map[string]interface{}
 
 func (fields ServerEntryFields) GetIPAddress() string {
-	ipAddress, ok := fields["ipAddress"]
+	return fields.getString("ipAddress")
+}
+
+func (fields ServerEntryFields) getString(name string) string {
+	value, ok := fields[name]
 	if !ok {
 		return ""
 	}
-	ipAddressStr, ok := ipAddress.(string)
+	valueStr, ok := value.(string)
 	if !ok {
 		return ""
 	}
-	return ipAddressStr
+	return valueStr
 }
 
 func (fields ServerEntryFields) GetConfigurationVersion() int {
@@ -109,14 +162,105 @@ func (fields ServerEntryFields) GetConfigurationVersion() int {
 	return configurationVersionInt
 }
 
+// GetSchemaVersion returns the server entry schema version, which is 0 when
+// the server entry has no schemaVersion field.
+func (fields ServerEntryFields) GetSchemaVersion() int {
+	// Unmarshaled JSON numbers are float64 values.
+	switch schemaVersion := fields["schemaVersion"].(type) {
+	case float64:
+		return int(schemaVersion)
+	case int:
+		return schemaVersion
+	}
+	return 0
+}
+
+// GetMinimumClientVersion returns the minimum client version required by the
+// server, which is 0, supported by all clients, when the server entry has no
+// minimumClientVersion field.
+func (fields ServerEntryFields) GetMinimumClientVersion() int {
+	// Unmarshaled JSON numbers are float64 values.
+	switch minimumClientVersion := fields["minimumClientVersion"].(type) {
+	case float64:
+		return int(minimumClientVersion)
+	case int:
+		return minimumClientVersion
+	}
+	return 0
+}
+
+// IsSupportedSchemaVersion indicates whether the server entry schema version
+// is no newer than SERVER_ENTRY_SCHEMA_VERSION. A server entry with a newer
+// schema version may depend on fields or semantics this client doesn't
+// support, and should be skipped.
+func (fields ServerEntryFields) IsSupportedSchemaVersion() bool {
+	return fields.GetSchemaVersion() <= SERVER_ENTRY_SCHEMA_VERSION
+}
+
+// GetEncryptedCapabilities returns the encryptedCapabilities field, which
+// holds capabilities encrypted to an OSL key, or "" when the server entry
+// has no encrypted capabilities.
+func (fields ServerEntryFields) GetEncryptedCapabilities() string {
+	return fields.getString("encryptedCapabilities")
+}
+
+// SetDecryptedCapabilities adds the decrypted encryptedCapabilities to the
+// server entry capabilities, omitting duplicates, and removes the
+// encryptedCapabilities field.
+func (fields ServerEntryFields) SetDecryptedCapabilities(capabilities []string) {
+
+	// Unmarshaled JSON arrays are []interface{} values, which is the type
+	// ValidateServerEntryFieldsNonCritical expects.
+	merged, _ := fields["capabilities"].([]interface{})
+	for _, capability := range capabilities {
+		found := false
+		for _, existing := range merged {
+			if existing == capability {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, capability)
+		}
+	}
+
+	fields["capabilities"] = merged
+	delete(fields, "encryptedCapabilities")
+}
+
+func (fields ServerEntryFields) GetLocalSource() string {
+	return fields.getString("localSource")
+}
+
 func (fields ServerEntryFields) SetLocalSource(source string) {
 	fields["localSource"] = source
 }
 
+func (fields ServerEntryFields) GetLocalTimestamp() string {
+	return fields.getString("localTimestamp")
+}
+
 func (fields ServerEntryFields) SetLocalTimestamp(timestamp string) {
 	fields["localTimestamp"] = timestamp
 }
 
+// GetExpiry returns the explicit expiry time of the server entry, from the
+// RFC3339 expiry field. The return value ok is false when the server entry
+// has no expiry, or the expiry is malformed, in which case the server entry
+// doesn't expire.
+func (fields ServerEntryFields) GetExpiry() (expiry time.Time, ok bool) {
+	value := fields.getString("expiry")
+	if value == "" {
+		return time.Time{}, false
+	}
+	expiry, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return expiry, true
+}
+
 // GetCapability returns the server capability corresponding
 // to the tunnel protocol.
 func GetCapability(protocol string) string {
@@ -129,6 +273,27 @@ func GetTacticsCapability(protocol string) string {
 	return GetCapability(protocol) + "-TACTICS"
 }
 
+// IsAvailableAt indicates whether the server is live at time t, per its
+// AvailabilityWindows. A server entry with no availability windows is always
+// available. Malformed windows are ignored, and a server entry with only
+// malformed windows is always available.
+func (serverEntry *ServerEntry) IsAvailableAt(t time.Time) bool {
+
+	available := true
+	for _, window := range serverEntry.AvailabilityWindows {
+		contains, ok := window.contains(t)
+		if !ok {
+			continue
+		}
+		if contains {
+			return true
+		}
+		available = false
+	}
+
+	return available
+}
+
 // SupportsProtocol returns true if and only if the ServerEntry has
 // the necessary capability to support the specified tunnel protocol.
 func (serverEntry *ServerEntry) SupportsProtocol(protocol string) bool {
@@ -199,6 +364,45 @@ func (serverEntry *ServerEntry) GetSupportedTacticsProtocols() []string {
 	return supportedProtocols
 }
 
+// IsFrontedBy returns true when the server supports a fronted tunnel
+// protocol and is addressed by frontingAddress, a domain name. The fronting
+// addresses are MeekFrontingAddresses, which includes matches for
+// MeekFrontingAddressesRegex, and the legacy MeekFrontingDomain. Domain
+// names are compared case insensitively.
+func (serverEntry *ServerEntry) IsFrontedBy(frontingAddress string) bool {
+
+	supportsFronted := false
+	for _, protocol := range SupportedTunnelProtocols {
+		if TunnelProtocolIsFronted(protocol) && serverEntry.SupportsProtocol(protocol) {
+			supportsFronted = true
+			break
+		}
+	}
+	if !supportsFronted || frontingAddress == "" {
+		return false
+	}
+
+	for _, address := range serverEntry.MeekFrontingAddresses {
+		if strings.EqualFold(address, frontingAddress) {
+			return true
+		}
+	}
+
+	if strings.EqualFold(serverEntry.MeekFrontingDomain, frontingAddress) {
+		return true
+	}
+
+	if serverEntry.MeekFrontingAddressesRegex != "" {
+		regex, err := regexp.Compile(
+			"(?i)^(?:" + serverEntry.MeekFrontingAddressesRegex + ")$")
+		if err == nil && regex.MatchString(frontingAddress) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // SupportsSSHAPIRequests returns true when the server supports
 // SSH API requests.
 func (serverEntry *ServerEntry) SupportsSSHAPIRequests() bool {
@@ -236,6 +440,24 @@ func EncodeServerEntry(serverEntry *ServerEntry) (string, error) {
 		serverEntryContents))), nil
 }
 
+// EncodeServerEntryFields returns a string containing the encoding of
+// ServerEntryFields following Psiphon conventions. Unrecognized fields are
+// retained in the encoding.
+func EncodeServerEntryFields(serverEntryFields ServerEntryFields) (string, error) {
+	serverEntryContents, err := json.Marshal(serverEntryFields)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	return hex.EncodeToString([]byte(fmt.Sprintf(
+		"%s %s %s %s %s",
+		serverEntryFields.GetIPAddress(),
+		serverEntryFields.getString("webServerPort"),
+		serverEntryFields.getString("webServerSecret"),
+		serverEntryFields.getString("webServerCertificate"),
+		serverEntryContents))), nil
+}
+
 // DecodeServerEntry extracts a server entry from the encoding
 // used by remote server lists and Psiphon server handshake requests.
 //
@@ -318,15 +540,54 @@ func ValidateServerEntryFields(serverEntryFields ServerEntryFields) error {
 	return nil
 }
 
+// ValidateServerEntryFieldsNonCritical checks for defects in server entries
+// which don't prevent the server entry from being stored, but which indicate
+// a malformed server entry. Currently, it checks that the server entry has
+// capabilities; without capabilities, the server entry supports no tunnel
+// protocols. A server entry with encrypted capabilities which weren't
+// decrypted isn't malformed, and passes this check.
+func ValidateServerEntryFieldsNonCritical(serverEntryFields ServerEntryFields) error {
+	capabilities, _ := serverEntryFields["capabilities"].([]interface{})
+	if len(capabilities) == 0 && serverEntryFields.GetEncryptedCapabilities() == "" {
+		return common.ContextError(
+			fmt.Errorf("server entry has no capabilities: %s", serverEntryFields.GetIPAddress()))
+	}
+	return nil
+}
+
 // DecodeServerEntryList extracts server entries from the list encoding
 // used by remote server lists and Psiphon server handshake requests.
-// Each server entry is validated and invalid entries are skipped.
+// Each server entry is validated and invalid entries are skipped, as are
+// server entries with an unsupported schema version. As with the default
+// StreamingServerEntryDecoder, server entries failing
+// ValidateServerEntryFieldsNonCritical are also skipped. Unrecognized fields
+// don't invalidate a server entry; as with DecodeServerEntryFields, they're
+// retained in the decoded ServerEntryFields.
 // See DecodeServerEntry for note on serverEntrySource/timestamp.
 func DecodeServerEntryList(
 	encodedServerEntryList, timestamp,
 	serverEntrySource string) ([]ServerEntryFields, error) {
 
+	serverEntries, _, err := DecodeServerEntryListWithSkipCount(
+		encodedServerEntryList, timestamp, serverEntrySource, false)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	return serverEntries, nil
+}
+
+// DecodeServerEntryListWithSkipCount is DecodeServerEntryList and also
+// returns the number of server entries skipped due to an unsupported schema
+// version. When lenientValidation is set, server entries which fail only
+// ValidateServerEntryFieldsNonCritical are returned, as with
+// StreamingServerEntryDecoder.SetLenientValidation.
+func DecodeServerEntryListWithSkipCount(
+	encodedServerEntryList, timestamp,
+	serverEntrySource string,
+	lenientValidation bool) ([]ServerEntryFields, int, error) {
+
 	serverEntries := make([]ServerEntryFields, 0)
+	unsupportedSchemaCount := 0
 	for _, encodedServerEntry := range strings.Split(encodedServerEntryList, "\n") {
 		if len(encodedServerEntry) == 0 {
 			continue
@@ -335,7 +596,12 @@ func DecodeServerEntryList(
 		// TODO: skip this entry and continue if can't decode?
 		serverEntryFields, err := DecodeServerEntryFields(encodedServerEntry, timestamp, serverEntrySource)
 		if err != nil {
-			return nil, common.ContextError(err)
+			return nil, 0, common.ContextError(err)
+		}
+
+		if !serverEntryFields.IsSupportedSchemaVersion() {
+			unsupportedSchemaCount += 1
+			continue
 		}
 
 		if ValidateServerEntryFields(serverEntryFields) != nil {
@@ -344,17 +610,30 @@ func DecodeServerEntryList(
 			continue
 		}
 
+		if !lenientValidation &&
+			ValidateServerEntryFieldsNonCritical(serverEntryFields) != nil {
+			continue
+		}
+
 		serverEntries = append(serverEntries, serverEntryFields)
 	}
-	return serverEntries, nil
+	return serverEntries, unsupportedSchemaCount, nil
 }
 
 // StreamingServerEntryDecoder performs the DecodeServerEntryList
 // operation, loading only one server entry into memory at a time.
 type StreamingServerEntryDecoder struct {
-	scanner           *bufio.Scanner
-	timestamp         string
-	serverEntrySource string
+	reader                  *streamingServerEntryReader
+	scanner                 *bufio.Scanner
+	timestamp               string
+	serverEntrySource       string
+	decodedCallback         func(ServerEntryFields)
+	validationErrorCallback func(string, error)
+	lenientValidation       bool
+	unsupportedSchemaCount  int
+	capabilitiesDecrypter   func(string) ([]string, error)
+	undecryptedCount        int
+	decodedCount            int
 }
 
 // NewStreamingServerEntryDecoder creates a new StreamingServerEntryDecoder.
@@ -362,15 +641,108 @@ func NewStreamingServerEntryDecoder(
 	encodedServerEntryListReader io.Reader,
 	timestamp, serverEntrySource string) *StreamingServerEntryDecoder {
 
+	reader := &streamingServerEntryReader{reader: encodedServerEntryListReader}
+
+	scanner := bufio.NewScanner(reader)
+
+	// When reading the input stream fails, any final, incomplete line is
+	// discarded rather than decoded as a truncated server entry, so Next
+	// fails with the read error.
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		return bufio.ScanLines(data, atEOF && reader.err == nil)
+	})
+
 	return &StreamingServerEntryDecoder{
-		scanner:           bufio.NewScanner(encodedServerEntryListReader),
+		reader:            reader,
+		scanner:           scanner,
 		timestamp:         timestamp,
 		serverEntrySource: serverEntrySource,
 	}
 }
 
+// streamingServerEntryReader records any error, other than io.EOF, returned
+// by the StreamingServerEntryDecoder input stream.
+type streamingServerEntryReader struct {
+	reader io.Reader
+	err    error
+}
+
+// Read implements the io.Reader interface.
+func (reader *streamingServerEntryReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	if err != nil && err != io.EOF {
+		reader.err = err
+	}
+	return n, err
+}
+
+// SetDecodedCallback sets a callback which Next invokes with each valid
+// server entry as soon as it is decoded, before Next returns. The callback
+// must not modify the server entry fields.
+func (decoder *StreamingServerEntryDecoder) SetDecodedCallback(
+	callback func(ServerEntryFields)) {
+
+	decoder.decodedCallback = callback
+}
+
+// SetValidationErrorCallback sets a callback which Next invokes with each
+// encoded server entry that fails validation, along with the validation
+// error. The callback is invoked both for skipped server entries and for
+// server entries imported under lenient validation.
+func (decoder *StreamingServerEntryDecoder) SetValidationErrorCallback(
+	callback func(encodedServerEntry string, err error)) {
+
+	decoder.validationErrorCallback = callback
+}
+
+// SetLenientValidation sets whether Next returns server entries which fail
+// only ValidateServerEntryFieldsNonCritical. By default, such server entries
+// are skipped. Server entries failing ValidateServerEntryFields are always
+// skipped.
+func (decoder *StreamingServerEntryDecoder) SetLenientValidation(lenient bool) {
+	decoder.lenientValidation = lenient
+}
+
+// SetCapabilitiesDecrypter sets a function which Next uses to decrypt the
+// encryptedCapabilities field of server entries, before validation. When a
+// server entry's capabilities are decrypted, they're added to its
+// capabilities. A server entry whose capabilities can't be decrypted,
+// including when no decrypter is set, is still returned, with only its
+// unencrypted capabilities and with the encryptedCapabilities field
+// retained.
+func (decoder *StreamingServerEntryDecoder) SetCapabilitiesDecrypter(
+	decrypter func(encryptedCapabilities string) ([]string, error)) {
+
+	decoder.capabilitiesDecrypter = decrypter
+}
+
+// UndecryptedCapabilitiesCount returns the number of server entries Next has
+// returned with encrypted capabilities which couldn't be decrypted by the
+// capabilities decrypter. Server entries with encrypted capabilities aren't
+// counted when no decrypter is set.
+func (decoder *StreamingServerEntryDecoder) UndecryptedCapabilitiesCount() int {
+	return decoder.undecryptedCount
+}
+
+// UnsupportedSchemaCount returns the number of server entries Next has
+// skipped due to an unsupported schema version.
+func (decoder *StreamingServerEntryDecoder) UnsupportedSchemaCount() int {
+	return decoder.unsupportedSchemaCount
+}
+
+// DecodedCount returns the number of valid server entries Next has
+// returned.
+func (decoder *StreamingServerEntryDecoder) DecodedCount() int {
+	return decoder.decodedCount
+}
+
 // Next reads and decodes, and validates the next server entry from the
 // input stream, returning a nil server entry when the stream is complete.
+// Server entries with an unsupported schema version are skipped and counted,
+// and aren't reported to the validation error callback. A
+// common.ChunkVerificationError from the input stream is returned
+// unwrapped, so that callers may check the error type and keep the server
+// entries already returned, which were all read from verified chunks.
 //
 // Limitations:
 // - Each encoded server entry line cannot exceed bufio.MaxScanTokenSize,
@@ -385,24 +757,63 @@ func (decoder *StreamingServerEntryDecoder) Next() (ServerEntryFields, error) {
 
 	for {
 		if !decoder.scanner.Scan() {
-			return nil, common.ContextError(decoder.scanner.Err())
+			err := decoder.scanner.Err()
+			if _, ok := err.(common.ChunkVerificationError); ok {
+				return nil, err
+			}
+			return nil, common.ContextError(err)
 		}
 
 		// TODO: use scanner.Bytes which doesn't allocate, instead of scanner.Text
+		encodedServerEntry := decoder.scanner.Text()
 
 		// TODO: skip this entry and continue if can't decode?
 		serverEntryFields, err := DecodeServerEntryFields(
-			decoder.scanner.Text(), decoder.timestamp, decoder.serverEntrySource)
+			encodedServerEntry, decoder.timestamp, decoder.serverEntrySource)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
 
-		if ValidateServerEntryFields(serverEntryFields) != nil {
+		if !serverEntryFields.IsSupportedSchemaVersion() {
+			decoder.unsupportedSchemaCount += 1
+			continue
+		}
+
+		encryptedCapabilities := serverEntryFields.GetEncryptedCapabilities()
+		if encryptedCapabilities != "" && decoder.capabilitiesDecrypter != nil {
+			capabilities, err := decoder.capabilitiesDecrypter(encryptedCapabilities)
+			if err != nil {
+				decoder.undecryptedCount += 1
+			} else {
+				serverEntryFields.SetDecryptedCapabilities(capabilities)
+			}
+		}
+
+		err = ValidateServerEntryFields(serverEntryFields)
+		if err != nil {
 			// Skip this entry and continue with the next one
-			// TODO: invoke a logging callback
+			if decoder.validationErrorCallback != nil {
+				decoder.validationErrorCallback(encodedServerEntry, err)
+			}
 			continue
 		}
 
+		err = ValidateServerEntryFieldsNonCritical(serverEntryFields)
+		if err != nil {
+			if decoder.validationErrorCallback != nil {
+				decoder.validationErrorCallback(encodedServerEntry, err)
+			}
+			if !decoder.lenientValidation {
+				continue
+			}
+		}
+
+		if decoder.decodedCallback != nil {
+			decoder.decodedCallback(serverEntryFields)
+		}
+
+		decoder.decodedCount += 1
+
 		return serverEntryFields, nil
 	}
 }
@@ -22,7 +22,11 @@ package protocol
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 )
@@ -119,6 +123,377 @@ func TestStreamingServerEntryDecoder(t *testing.T) {
 	}
 }
 
+func TestStreamingServerEntryDecoderValidation(t *testing.T) {
+
+	noCapabilitiesServerEntry := strings.Replace(
+		_VALID_NORMAL_SERVER_ENTRY, `["handshake","SSH","OSSH","VPN"]`, `[]`, 1)
+
+	encodedServerEntryList := hex.EncodeToString([]byte(_VALID_NORMAL_SERVER_ENTRY)) + "\n" +
+		hex.EncodeToString([]byte(_INVALID_MALFORMED_IP_ADDRESS_SERVER_ENTRY)) + "\n" +
+		hex.EncodeToString([]byte(noCapabilitiesServerEntry))
+
+	for _, lenient := range []bool{false, true} {
+
+		decoder := NewStreamingServerEntryDecoder(
+			bytes.NewReader([]byte(encodedServerEntryList)),
+			common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_EMBEDDED)
+
+		var invalidServerEntries []string
+		decoder.SetValidationErrorCallback(
+			func(encodedServerEntry string, err error) {
+				if err == nil {
+					t.Errorf("missing validation error")
+				}
+				invalidServerEntries = append(invalidServerEntries, encodedServerEntry)
+			})
+
+		decoder.SetLenientValidation(lenient)
+
+		count := 0
+		for {
+			serverEntryFields, err := decoder.Next()
+			if err != nil {
+				t.Fatalf("Next failed: %s", err)
+			}
+			if serverEntryFields == nil {
+				break
+			}
+			count += 1
+		}
+
+		// The malformed IP address entry is always skipped; the entry without
+		// capabilities is skipped only under strict validation.
+
+		expectedCount := 1
+		if lenient {
+			expectedCount = 2
+		}
+		if count != expectedCount {
+			t.Errorf("unexpected number of server entries with lenient %v: %d", lenient, count)
+		}
+
+		if len(invalidServerEntries) != 2 ||
+			invalidServerEntries[0] != hex.EncodeToString([]byte(_INVALID_MALFORMED_IP_ADDRESS_SERVER_ENTRY)) ||
+			invalidServerEntries[1] != hex.EncodeToString([]byte(noCapabilitiesServerEntry)) {
+
+			t.Errorf("unexpected invalid server entries with lenient %v", lenient)
+		}
+	}
+}
+
+func TestServerEntryListDecodersNonCriticalValidation(t *testing.T) {
+
+	noCapabilitiesServerEntry := strings.Replace(
+		_VALID_NORMAL_SERVER_ENTRY, `["handshake","SSH","OSSH","VPN"]`, `[]`, 1)
+
+	encodedServerEntryList := hex.EncodeToString([]byte(noCapabilitiesServerEntry))
+
+	// The list and streaming decoders agree on the server entry without
+	// capabilities: by default, it's skipped, and under lenient validation,
+	// it's returned.
+
+	for _, lenient := range []bool{false, true} {
+
+		serverEntries, _, err := DecodeServerEntryListWithSkipCount(
+			encodedServerEntryList, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_EMBEDDED, lenient)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryListWithSkipCount failed: %s", err)
+		}
+		listCount := len(serverEntries)
+
+		decoder := NewStreamingServerEntryDecoder(
+			bytes.NewReader([]byte(encodedServerEntryList)),
+			common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_EMBEDDED)
+		decoder.SetLenientValidation(lenient)
+
+		streamingCount := 0
+		for {
+			serverEntryFields, err := decoder.Next()
+			if err != nil {
+				t.Fatalf("Next failed: %s", err)
+			}
+			if serverEntryFields == nil {
+				break
+			}
+			streamingCount += 1
+		}
+
+		expectedCount := 0
+		if lenient {
+			expectedCount = 1
+		}
+		if listCount != expectedCount || streamingCount != expectedCount {
+			t.Errorf("unexpected number of server entries with lenient %v: %d, %d",
+				lenient, listCount, streamingCount)
+		}
+	}
+
+	serverEntries, err := DecodeServerEntryList(
+		encodedServerEntryList, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_EMBEDDED)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryList failed: %s", err)
+	}
+	if len(serverEntries) != 0 {
+		t.Errorf("unexpected number of server entries: %d", len(serverEntries))
+	}
+}
+
+func TestServerEntrySchemaVersion(t *testing.T) {
+
+	supportedSchemaServerEntry := strings.Replace(
+		_VALID_NORMAL_SERVER_ENTRY, `"ipAddress":"192.168.0.1",`,
+		fmt.Sprintf(`"ipAddress":"192.168.0.1","schemaVersion":%d,`, SERVER_ENTRY_SCHEMA_VERSION), 1)
+
+	unsupportedSchemaServerEntry := strings.Replace(
+		_VALID_NORMAL_SERVER_ENTRY, `"ipAddress":"192.168.0.1",`,
+		fmt.Sprintf(`"ipAddress":"192.168.0.1","schemaVersion":%d,`, SERVER_ENTRY_SCHEMA_VERSION+1), 1)
+
+	// Mixed schema versions: no schemaVersion field, the supported version,
+	// and a newer version twice, including an entry which would also fail
+	// validation.
+
+	encodedServerEntryList := hex.EncodeToString([]byte(_VALID_NORMAL_SERVER_ENTRY)) + "\n" +
+		hex.EncodeToString([]byte(unsupportedSchemaServerEntry)) + "\n" +
+		hex.EncodeToString([]byte(supportedSchemaServerEntry)) + "\n" +
+		hex.EncodeToString([]byte(strings.Replace(
+			unsupportedSchemaServerEntry, `"ipAddress":"192.168.0.1"`, `"ipAddress":"192.168.0."`, 1)))
+
+	checkServerEntries := func(serverEntries []ServerEntryFields) {
+		if len(serverEntries) != 2 {
+			t.Fatalf("unexpected number of server entries: %d", len(serverEntries))
+		}
+		if serverEntries[0].GetSchemaVersion() != 0 ||
+			serverEntries[1].GetSchemaVersion() != SERVER_ENTRY_SCHEMA_VERSION {
+			t.Fatalf("unexpected server entry schema versions")
+		}
+	}
+
+	serverEntries, unsupportedSchemaCount, err := DecodeServerEntryListWithSkipCount(
+		encodedServerEntryList, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_EMBEDDED, false)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryListWithSkipCount failed: %s", err)
+	}
+	checkServerEntries(serverEntries)
+	if unsupportedSchemaCount != 2 {
+		t.Fatalf("unexpected unsupported schema count: %d", unsupportedSchemaCount)
+	}
+
+	serverEntries, err = DecodeServerEntryList(
+		encodedServerEntryList, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_EMBEDDED)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryList failed: %s", err)
+	}
+	checkServerEntries(serverEntries)
+
+	decoder := NewStreamingServerEntryDecoder(
+		bytes.NewReader([]byte(encodedServerEntryList)),
+		common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_EMBEDDED)
+
+	// Skipped schema versions aren't validation errors.
+	decoder.SetValidationErrorCallback(
+		func(encodedServerEntry string, err error) {
+			t.Errorf("unexpected validation error: %s", err)
+		})
+
+	serverEntries = nil
+	for {
+		serverEntryFields, err := decoder.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %s", err)
+		}
+		if serverEntryFields == nil {
+			break
+		}
+		serverEntries = append(serverEntries, serverEntryFields)
+	}
+	checkServerEntries(serverEntries)
+	if decoder.UnsupportedSchemaCount() != 2 {
+		t.Fatalf("unexpected unsupported schema count: %d", decoder.UnsupportedSchemaCount())
+	}
+	if decoder.DecodedCount() != len(serverEntries) {
+		t.Fatalf("unexpected decoded count: %d", decoder.DecodedCount())
+	}
+}
+
+func TestServerEntryUnknownFields(t *testing.T) {
+
+	// Unknown fields of each JSON type, as a newer server entry version may
+	// add. None of these prevent decoding, validation, or conversion to
+	// ServerEntry, and all are retained in ServerEntryFields.
+
+	unknownFields := `"futureString":"value","futureNumber":1.5,"futureBool":true,` +
+		`"futureNull":null,"futureArray":[1,"two",{"three":3}],"futureObject":{"nested":{"value":[]}},`
+
+	unknownFieldsServerEntry := strings.Replace(
+		_VALID_NORMAL_SERVER_ENTRY, `"ipAddress":"192.168.0.1",`,
+		`"ipAddress":"192.168.0.1",`+unknownFields, 1)
+
+	encodedServerEntryList := hex.EncodeToString([]byte(unknownFieldsServerEntry)) + "\n" +
+		hex.EncodeToString([]byte(_VALID_NORMAL_SERVER_ENTRY))
+
+	checkServerEntries := func(serverEntries []ServerEntryFields) {
+		if len(serverEntries) != 2 {
+			t.Fatalf("unexpected number of server entries: %d", len(serverEntries))
+		}
+		serverEntryFields := serverEntries[0]
+		for _, name := range []string{
+			"futureString", "futureNumber", "futureBool",
+			"futureNull", "futureArray", "futureObject"} {
+
+			if _, ok := serverEntryFields[name]; !ok {
+				t.Fatalf("missing unknown field: %s", name)
+			}
+		}
+		if serverEntryFields["futureString"] != "value" ||
+			serverEntryFields["futureNumber"] != 1.5 ||
+			fmt.Sprintf("%v", serverEntryFields["futureArray"]) != "[1 two map[three:3]]" {
+
+			t.Fatalf("unexpected unknown fields: %+v", serverEntryFields)
+		}
+	}
+
+	serverEntries, err := DecodeServerEntryList(
+		encodedServerEntryList, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_OBFUSCATED)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryList failed: %s", err)
+	}
+	checkServerEntries(serverEntries)
+
+	decoder := NewStreamingServerEntryDecoder(
+		bytes.NewReader([]byte(encodedServerEntryList)),
+		common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_OBFUSCATED)
+
+	decoder.SetValidationErrorCallback(
+		func(encodedServerEntry string, err error) {
+			t.Errorf("unexpected validation error: %s", err)
+		})
+
+	serverEntries = nil
+	for {
+		serverEntryFields, err := decoder.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %s", err)
+		}
+		if serverEntryFields == nil {
+			break
+		}
+		serverEntries = append(serverEntries, serverEntryFields)
+	}
+	checkServerEntries(serverEntries)
+
+	// The unknown fields survive reencoding, and the recognized fields are
+	// decoded to ServerEntry.
+
+	encodedServerEntry, err := EncodeServerEntryFields(serverEntries[0])
+	if err != nil {
+		t.Fatalf("EncodeServerEntryFields failed: %s", err)
+	}
+
+	serverEntryFields, err := DecodeServerEntryFields(
+		encodedServerEntry, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_OBFUSCATED)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryFields failed: %s", err)
+	}
+	checkServerEntries([]ServerEntryFields{serverEntryFields, serverEntries[1]})
+
+	serverEntry, err := DecodeServerEntry(
+		encodedServerEntry, common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_OBFUSCATED)
+	if err != nil {
+		t.Fatalf("DecodeServerEntry failed: %s", err)
+	}
+	if serverEntry.IpAddress != _EXPECTED_IP_ADDRESS ||
+		serverEntry.SshObfuscatedPort != 443 ||
+		serverEntry.Region != "CA" {
+
+		t.Fatalf("unexpected decoded server entry: %+v", serverEntry)
+	}
+}
+
+func TestStreamingServerEntryDecoderEncryptedCapabilities(t *testing.T) {
+
+	// The decrypter accepts only "encrypted" and yields one capability.
+
+	decrypter := func(encryptedCapabilities string) ([]string, error) {
+		if encryptedCapabilities != "encrypted" {
+			return nil, errors.New("decryption failed")
+		}
+		return []string{"FRONTED-MEEK", "OSSH"}, nil
+	}
+
+	decryptableServerEntry := strings.Replace(
+		_VALID_NORMAL_SERVER_ENTRY, `"region":"CA"`, `"region":"CA","encryptedCapabilities":"encrypted"`, 1)
+
+	undecryptableServerEntry := strings.Replace(
+		_VALID_NORMAL_SERVER_ENTRY, `["handshake","SSH","OSSH","VPN"]`, `[],"encryptedCapabilities":"other"`, 1)
+
+	encodedServerEntryList := hex.EncodeToString([]byte(decryptableServerEntry)) + "\n" +
+		hex.EncodeToString([]byte(undecryptableServerEntry))
+
+	for _, withDecrypter := range []bool{true, false} {
+
+		decoder := NewStreamingServerEntryDecoder(
+			bytes.NewReader([]byte(encodedServerEntryList)),
+			common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_EMBEDDED)
+
+		if withDecrypter {
+			decoder.SetCapabilitiesDecrypter(decrypter)
+		}
+
+		// Under strict validation, the undecryptable server entry, which has
+		// no unencrypted capabilities, is still returned.
+
+		decoder.SetValidationErrorCallback(
+			func(encodedServerEntry string, err error) {
+				t.Errorf("unexpected validation error: %s", err)
+			})
+
+		var serverEntries []ServerEntryFields
+		for {
+			serverEntryFields, err := decoder.Next()
+			if err != nil {
+				t.Fatalf("Next failed: %s", err)
+			}
+			if serverEntryFields == nil {
+				break
+			}
+			serverEntries = append(serverEntries, serverEntryFields)
+		}
+
+		if len(serverEntries) != 2 {
+			t.Fatalf("unexpected number of server entries: %d", len(serverEntries))
+		}
+
+		expectedCapabilities := "handshake,SSH,OSSH,VPN"
+		expectedEncryptedCapabilities := "encrypted"
+		expectedUndecryptedCount := 0
+		if withDecrypter {
+			expectedCapabilities = "handshake,SSH,OSSH,VPN,FRONTED-MEEK"
+			expectedEncryptedCapabilities = ""
+			expectedUndecryptedCount = 1
+		}
+
+		capabilities, _ := serverEntries[0]["capabilities"].([]interface{})
+		if fmt.Sprintf("%v", capabilities) != fmt.Sprintf("%v", strings.Split(expectedCapabilities, ",")) ||
+			serverEntries[0].GetEncryptedCapabilities() != expectedEncryptedCapabilities {
+
+			t.Fatalf("unexpected decrypted server entry: %+v", serverEntries[0])
+		}
+
+		// The undecryptable server entry retains its encrypted capabilities.
+
+		capabilities, _ = serverEntries[1]["capabilities"].([]interface{})
+		if len(capabilities) != 0 ||
+			serverEntries[1].GetEncryptedCapabilities() != "other" {
+
+			t.Fatalf("unexpected undecrypted server entry: %+v", serverEntries[1])
+		}
+
+		if decoder.UndecryptedCapabilitiesCount() != expectedUndecryptedCount {
+			t.Fatalf("unexpected undecrypted count: %d", decoder.UndecryptedCapabilitiesCount())
+		}
+	}
+}
+
 // Directly call DecodeServerEntryFields and ValidateServerEntry with invalid inputs
 func TestInvalidServerEntries(t *testing.T) {
 
@@ -152,3 +527,122 @@ func TestDecodeServerEntryStruct(t *testing.T) {
 		t.Errorf("unexpected IP address in decoded server entry: %s", serverEntry.IpAddress)
 	}
 }
+
+func TestServerEntryIsFrontedBy(t *testing.T) {
+
+	testCases := []struct {
+		description     string
+		serverEntry     *ServerEntry
+		frontingAddress string
+		expectedFronted bool
+	}{
+		{
+			"fronting addresses",
+			&ServerEntry{
+				Capabilities:          []string{"FRONTED-MEEK"},
+				MeekFrontingAddresses: []string{"a.example.com", "b.example.com"},
+			},
+			"B.EXAMPLE.COM",
+			true,
+		},
+		{
+			"legacy fronting domain",
+			&ServerEntry{
+				Capabilities:       []string{"FRONTED-MEEK"},
+				MeekFrontingDomain: "legacy.example.com",
+			},
+			"legacy.example.com",
+			true,
+		},
+		{
+			"fronting addresses regex",
+			&ServerEntry{
+				Capabilities:               []string{"FRONTED-MEEK"},
+				MeekFrontingAddressesRegex: "[a-z]+\\.example\\.com",
+			},
+			"regex.example.com",
+			true,
+		},
+		{
+			"fronting addresses regex is anchored",
+			&ServerEntry{
+				Capabilities:               []string{"FRONTED-MEEK"},
+				MeekFrontingAddressesRegex: "[a-z]+\\.example\\.com",
+			},
+			"regex.example.com.attacker.com",
+			false,
+		},
+		{
+			"other fronting address",
+			&ServerEntry{
+				Capabilities:          []string{"FRONTED-MEEK"},
+				MeekFrontingAddresses: []string{"a.example.com"},
+			},
+			"c.example.com",
+			false,
+		},
+		{
+			"no fronted capability",
+			&ServerEntry{
+				Capabilities:          []string{"OSSH", "UNFRONTED-MEEK"},
+				MeekFrontingAddresses: []string{"a.example.com"},
+			},
+			"a.example.com",
+			false,
+		},
+		{
+			"empty fronting address",
+			&ServerEntry{
+				Capabilities:       []string{"FRONTED-MEEK"},
+				MeekFrontingDomain: "",
+			},
+			"",
+			false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+			fronted := testCase.serverEntry.IsFrontedBy(testCase.frontingAddress)
+			if fronted != testCase.expectedFronted {
+				t.Errorf("unexpected IsFrontedBy result: %v", fronted)
+			}
+		})
+	}
+}
+
+func TestServerEntryIsAvailableAt(t *testing.T) {
+
+	testCases := []struct {
+		windows   []AvailabilityWindow
+		time      string
+		available bool
+	}{
+		{nil, "12:00", true},
+		{[]AvailabilityWindow{{"09:00", "17:00"}}, "09:00", true},
+		{[]AvailabilityWindow{{"09:00", "17:00"}}, "16:59", true},
+		{[]AvailabilityWindow{{"09:00", "17:00"}}, "17:00", false},
+		{[]AvailabilityWindow{{"09:00", "17:00"}}, "08:59", false},
+		{[]AvailabilityWindow{{"22:00", "02:00"}}, "23:30", true},
+		{[]AvailabilityWindow{{"22:00", "02:00"}}, "01:30", true},
+		{[]AvailabilityWindow{{"22:00", "02:00"}}, "12:00", false},
+		{[]AvailabilityWindow{{"06:00", "06:00"}}, "03:00", true},
+		{[]AvailabilityWindow{{"01:00", "02:00"}, {"09:00", "17:00"}}, "12:00", true},
+		{[]AvailabilityWindow{{"invalid", "17:00"}}, "20:00", true},
+		{[]AvailabilityWindow{{"invalid", "17:00"}, {"09:00", "17:00"}}, "20:00", false},
+	}
+
+	for _, testCase := range testCases {
+		clock, err := time.Parse("15:04", testCase.time)
+		if err != nil {
+			t.Fatalf("time.Parse failed: %s", err)
+		}
+		serverEntry := &ServerEntry{AvailabilityWindows: testCase.windows}
+		available := serverEntry.IsAvailableAt(
+			time.Date(2019, 1, 1, clock.Hour(), clock.Minute(), 0, 0, time.UTC))
+		if available != testCase.available {
+			t.Errorf("unexpected availability for %+v at %s: %v",
+				testCase.windows, testCase.time, available)
+		}
+	}
+}
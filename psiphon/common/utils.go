@@ -20,7 +20,9 @@
 package common
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"compress/zlib"
 	"crypto/rand"
 	"encoding/base64"
@@ -315,9 +317,10 @@ func Compress(data []byte) []byte {
 	return compressedData.Bytes()
 }
 
-// Decompress returns zlib decompressed data
+// Decompress returns decompressed data. The compression codec is
+// detected as in NewDecompressingReader.
 func Decompress(data []byte) ([]byte, error) {
-	reader, err := zlib.NewReader(bytes.NewReader(data))
+	reader, err := NewDecompressingReader(bytes.NewReader(data))
 	if err != nil {
 		return nil, ContextError(err)
 	}
@@ -329,6 +332,124 @@ func Decompress(data []byte) ([]byte, error) {
 	return uncompressedData, nil
 }
 
+// ErrUnrecognizedCompression is returned, unwrapped, by
+// NewDecompressingReader when the data is not in a recognized compression
+// format.
+var ErrUnrecognizedCompression = errors.New("unrecognized compression")
+
+// NewDecompressingReader returns an io.ReadCloser that streams the
+// decompressed data read from reader. The compression codec is detected from
+// the data header: zlib, the default codec used by Compress, and gzip are
+// identified by their headers. Any other data is rejected with
+// ErrUnrecognizedCompression. Brotli, which has no identifying header, isn't
+// detected; callers must select Brotli explicitly, as from a content
+// encoding or a package format version. Closing the reader doesn't close the
+// underlying reader.
+//
+// zlib and gzip data may consist of multiple compressed members, or streams,
+// concatenated together, as is used to split very large payloads into
+// parts. The decompressed output of all members is streamed in order. Each
+// member following the first is detected by its header.
+func NewDecompressingReader(reader io.Reader) (io.ReadCloser, error) {
+	return NewDecompressingReaderWithDictionary(reader, nil)
+}
+
+// NewDecompressingReaderWithDictionary is NewDecompressingReader with a
+// preset dictionary for zlib data, as specified in RFC 1950. The dictionary
+// is required for zlib data compressed with a dictionary, and must be the
+// same dictionary used for compression; otherwise, zlib.ErrDictionary is
+// returned. The dictionary is ignored for zlib data compressed without a
+// dictionary and for gzip data.
+func NewDecompressingReaderWithDictionary(
+	reader io.Reader, dictionary []byte) (io.ReadCloser, error) {
+
+	bufferedReader := bufio.NewReader(reader)
+
+	// Data too short for a header is unrecognized.
+	header, err := bufferedReader.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, ContextError(err)
+	}
+
+	if isZlibHeader(header) {
+		decompressor, err := zlib.NewReaderDict(bufferedReader, dictionary)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		return &multiMemberZlibReader{
+			reader:       bufferedReader,
+			dictionary:   dictionary,
+			decompressor: decompressor,
+		}, nil
+	}
+
+	if len(header) == 2 && header[0] == 0x1f && header[1] == 0x8b {
+		decompressor, err := gzip.NewReader(bufferedReader)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		// Multistream is the gzip.Reader default; it's set explicitly as
+		// multi-member payloads depend on it.
+		decompressor.Multistream(true)
+		return decompressor, nil
+	}
+
+	return nil, ErrUnrecognizedCompression
+}
+
+// multiMemberZlibReader streams the decompressed output of concatenated zlib
+// streams. Unlike gzip, the zlib format has no notion of multiple members,
+// so zlib.Reader stops at the end of the first stream. When a stream ends
+// and the following data begins with a zlib header, decompression continues
+// with the next stream. Any other data following a stream is ignored, as
+// with a single zlib stream.
+//
+// zlib.Reader reads the input through its io.ByteReader interface, which
+// bufio.Reader implements, so reader is positioned exactly at the end of
+// each stream.
+type multiMemberZlibReader struct {
+	reader       *bufio.Reader
+	dictionary   []byte
+	decompressor io.ReadCloser
+}
+
+func (reader *multiMemberZlibReader) Read(p []byte) (int, error) {
+	for {
+		n, err := reader.decompressor.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+
+		header, _ := reader.reader.Peek(2)
+		if !isZlibHeader(header) {
+			return n, io.EOF
+		}
+
+		err = reader.decompressor.(zlib.Resetter).Reset(reader.reader, reader.dictionary)
+		if err != nil {
+			return n, ContextError(err)
+		}
+
+		if n > 0 || len(p) == 0 {
+			return n, nil
+		}
+	}
+}
+
+func (reader *multiMemberZlibReader) Close() error {
+	return reader.decompressor.Close()
+}
+
+// isZlibHeader checks for a zlib header, as specified in RFC 1950: the
+// compression method is deflate and the header checksum is valid.
+func isZlibHeader(header []byte) bool {
+	if len(header) != 2 {
+		return false
+	}
+	return header[0]&0x0f == 8 &&
+		(uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
 // FormatByteCount returns a string representation of the specified
 // byte count in conventional, human-readable format.
 func FormatByteCount(bytes uint64) string {
@@ -21,10 +21,13 @@ package common
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -197,6 +200,98 @@ func TestCompress(t *testing.T) {
 	}
 }
 
+func TestDecompressMultiMember(t *testing.T) {
+
+	originalData := []byte(strings.Repeat("test data\n", 1000))
+
+	// Split the data into parts, each compressed as a separate member.
+
+	parts := [][]byte{originalData[:100], originalData[100:5000], originalData[5000:]}
+
+	var zlibData, gzipData bytes.Buffer
+	for _, part := range parts {
+		zlibData.Write(Compress(part))
+		gzipWriter := gzip.NewWriter(&gzipData)
+		gzipWriter.Write(part)
+		gzipWriter.Close()
+	}
+
+	testCases := []struct {
+		description    string
+		compressedData []byte
+	}{
+		{"zlib", zlibData.Bytes()},
+		{"gzip", gzipData.Bytes()},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			decompressedData, err := Decompress(testCase.compressedData)
+			if err != nil {
+				t.Fatalf("Decompress failed: %s", err)
+			}
+			if !bytes.Equal(originalData, decompressedData) {
+				t.Fatalf("decompressed data doesn't match original data")
+			}
+
+			// Read in small chunks, to cover member boundaries which fall
+			// within a read.
+
+			reader, err := NewDecompressingReader(
+				bytes.NewReader(testCase.compressedData))
+			if err != nil {
+				t.Fatalf("NewDecompressingReader failed: %s", err)
+			}
+			var readData bytes.Buffer
+			buffer := make([]byte, 7)
+			for {
+				n, err := reader.Read(buffer)
+				readData.Write(buffer[:n])
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Read failed: %s", err)
+				}
+			}
+			if !bytes.Equal(originalData, readData.Bytes()) {
+				t.Fatalf("read data doesn't match original data")
+			}
+		})
+	}
+
+	// A corrupt member following the first fails decompression.
+
+	corruptData := append(Compress(parts[0]), Compress(parts[1])...)
+	corruptData[len(corruptData)-1] ^= 0xff
+
+	_, err := Decompress(corruptData)
+	if err == nil {
+		t.Fatalf("Decompress unexpectedly succeeded")
+	}
+}
+
+func TestDecompressUnrecognized(t *testing.T) {
+
+	// Data that is neither zlib nor gzip, including data too short for a
+	// header, is rejected rather than assumed to be some other codec.
+
+	for _, data := range [][]byte{
+		[]byte("test data"), {0x1f}, {}} {
+
+		_, err := NewDecompressingReader(bytes.NewReader(data))
+		if err != ErrUnrecognizedCompression {
+			t.Fatalf("unexpected NewDecompressingReader error: %v", err)
+		}
+
+		_, err = Decompress(data)
+		if err == nil {
+			t.Fatalf("Decompress unexpectedly succeeded")
+		}
+	}
+}
+
 func TestFormatByteCount(t *testing.T) {
 
 	testCases := []struct {
@@ -20,15 +20,22 @@
 package psiphon
 
 import (
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
@@ -255,6 +262,14 @@ type Config struct {
 	// This parameter is only applicable to library deployments.
 	NetworkIDGetter NetworkIDGetter
 
+	// Clock is an interface that provides the current time for remote server
+	// list fetch timestamps and for time-dependent fetch logic, including
+	// revalidation and quarantine periods, and for server entry availability
+	// windows. When not set, the system clock is used. See: Clock doc.
+	//
+	// This parameter is intended for testing.
+	Clock Clock
+
 	// NetworkID, when not blank, is used as the identifier for the host's
 	// current active network.
 	// NetworkID is ignored when NetworkIDGetter is set.
@@ -304,9 +319,38 @@ type Config struct {
 	// be established to known servers. This value is supplied by and depends
 	// on the Psiphon Network, and is typically embedded in the client binary.
 	// All URLs must point to the same entity with the same ETag. At least one
-	// DownloadURL must have OnlyAfterAttempts = 0.
+	// DownloadURL must have OnlyAfterAttempts = 0. When there are multiple
+	// candidate URLs, mirrors with lower recent latency and failure rates
+	// are preferred; see parameters.RemoteServerListMirrorMinimumWeight.
 	RemoteServerListURLs parameters.DownloadURLs
 
+	// RemoteServerListRevocationURLs is an optional list of URLs which
+	// specify locations to fetch a server entry revocation list, with the
+	// same requirements as RemoteServerListURLs. The revocation list is
+	// fetched along with the common remote server list, and the revoked
+	// server entries are deleted; see ServerEntryRevocationList. The list
+	// must be signed with RemoteServerListSignaturePublicKey. This value
+	// requires RemoteServerListURLs.
+	RemoteServerListRevocationURLs parameters.DownloadURLs
+
+	// RemoteServerListSecondarySignatureURLs is an optional list of URLs
+	// which specify locations to fetch a detached secondary signature for
+	// the common remote server list, with the same requirements as
+	// RemoteServerListURLs. The locations should be served from a different
+	// source than RemoteServerListURLs. When set, a downloaded common remote
+	// server list is imported only when the secondary signature, signed
+	// with RemoteServerListSecondaryPublicKey, also validates; see
+	// RemoteServerListSecondarySignature. This defends against a single
+	// compromised signing key. This value requires RemoteServerListURLs and
+	// RemoteServerListSecondaryPublicKey.
+	RemoteServerListSecondarySignatureURLs parameters.DownloadURLs
+
+	// RemoteServerListSecondaryPublicKey specifies the public key, or
+	// comma-separated list of public keys, that's used to authenticate the
+	// secondary signature fetched from RemoteServerListSecondarySignatureURLs.
+	// This key must be distinct from RemoteServerListSignaturePublicKey.
+	RemoteServerListSecondaryPublicKey string
+
 	// RemoteServerListDownloadFilename specifies a target filename for
 	// storing the remote server list download. Data is stored in co-located
 	// files (RemoteServerListDownloadFilename.part*) to allow for resumable
@@ -317,8 +361,22 @@ type Config struct {
 	// to authenticate the remote server list payload. This value is supplied
 	// by and depends on the Psiphon Network, and is typically embedded in the
 	// client binary.
+	//
+	// To support signing key upgrades, the value may be a comma-separated
+	// list of public keys, in which case payloads signed with any one of the
+	// keys are accepted.
 	RemoteServerListSignaturePublicKey string
 
+	// RemoteServerListLowTrustSignaturePublicKey specifies an optional public
+	// key, or comma-separated list of public keys, for lower trust remote
+	// server list and obfuscated server list payloads. Payloads which fail
+	// validation with RemoteServerListSignaturePublicKey but are signed with
+	// one of these keys are accepted, and their server entries are stored
+	// with the SERVER_ENTRY_TRUST_TIER_LOW trust tier. Config overrides in
+	// lower trust payloads are not applied. OSL registries are always
+	// validated with RemoteServerListSignaturePublicKey.
+	RemoteServerListLowTrustSignaturePublicKey string
+
 	// DisableRemoteServerListFetcher disables fetching remote server lists.
 	// This is used for special case temporary tunnels.
 	DisableRemoteServerListFetcher bool
@@ -328,6 +386,220 @@ type Config struct {
 	// default value is used. This value is typical overridden for testing.
 	FetchRemoteServerListRetryPeriodMilliseconds *int
 
+	// FetchRemoteServerListDiskFullRetryPeriodMilliseconds specifies the
+	// delay before retrying a remote server list fetch which failed because
+	// local storage is full, in place of
+	// FetchRemoteServerListRetryPeriodMilliseconds. If omitted, a default
+	// value is used.
+	FetchRemoteServerListDiskFullRetryPeriodMilliseconds *int
+
+	// FetchRemoteServerListStaggerDelayMilliseconds specifies the delay
+	// between starting the common remote server list fetch and starting the
+	// obfuscated server list fetch, when both are triggered together. This
+	// staggers the fetches to avoid a spike in CPU and network usage on
+	// low-end devices. If omitted, the fetches start together.
+	FetchRemoteServerListStaggerDelayMilliseconds *int
+
+	// RemoteServerListConnectTimeoutSeconds specifies a time limit for
+	// establishing each remote server list download connection, including
+	// the TLS handshake. This is shorter than the time limit for the whole
+	// download so that dead mirrors fail fast while slow response bodies
+	// are still allowed to complete. If omitted or 0, only the whole
+	// download time limit applies.
+	RemoteServerListConnectTimeoutSeconds *int
+
+	// RemoteServerListRevalidateIntervalSeconds specifies an interval after
+	// which remote server list resources are fully downloaded and validated
+	// again, even when the ETag indicates the resource is unchanged. This
+	// guards against corruption of cached files. If omitted or 0, resources
+	// are not revalidated.
+	RemoteServerListRevalidateIntervalSeconds *int
+
+	// RemoteServerListHonorCacheControl specifies whether to honor the
+	// Cache-Control max-age of remote server list resource responses. When
+	// set, a resource is not requested again, not even with a conditional
+	// request, until its max-age, limited to
+	// parameters.RemoteServerListMaxCacheControlAge, has elapsed. If omitted,
+	// Cache-Control is ignored.
+	RemoteServerListHonorCacheControl *bool
+
+	// DownloadDisableKeepAlives specifies whether to disable HTTP keep-alive
+	// for remote server list and upgrade downloads. When set, each download
+	// request is sent with "Connection: close" and uses a new connection,
+	// which can improve reliability through proxies and middleboxes that
+	// break keep-alive connections for large transfers. If omitted,
+	// keep-alive is enabled.
+	DownloadDisableKeepAlives *bool
+
+	// RemoteServerListRequireTunnel specifies whether remote server list
+	// downloads must be made through a tunnel. When set, a fetch with no
+	// connected tunnel, including BootstrapFetchCommonRemoteServerList, fails
+	// with a TunnelRequiredError and sends no requests, and the controller
+	// defers the fetch until a tunnel is established. If omitted, downloads
+	// are made untunneled when there's no tunnel.
+	RemoteServerListRequireTunnel *bool
+
+	// RemoteServerListLegalBlockFailover specifies whether a remote server
+	// list download which fails with an HTTP 451 Unavailable For Legal
+	// Reasons response, reported as a LegalBlockError, immediately fails
+	// over to another configured mirror instead of retrying the blocked URL.
+	// If omitted, the default value, which enables failover, is used.
+	RemoteServerListLegalBlockFailover *bool
+
+	// RemoteServerListMirrorFailover specifies whether a remote server list
+	// or obfuscated server list download which fails with a network or HTTP
+	// error immediately fails over to another configured mirror which hasn't
+	// failed in the same fetch, before any retry. The fetch fails only once
+	// every mirror has failed. If omitted, the default value, which enables
+	// failover, is used.
+	RemoteServerListMirrorFailover *bool
+
+	// RemoteServerListResumeVerifyDigest specifies whether an interrupted
+	// remote server list download is resumed only when the server confirms,
+	// with a Content-MD5 digest of the already downloaded byte range, that
+	// the partial download is still valid for the current resource. When the
+	// digest can't be confirmed, the download restarts from the beginning.
+	// If omitted, partial downloads are resumed without a digest check.
+	RemoteServerListResumeVerifyDigest *bool
+
+	// RemoteServerListNonResumableThreshold specifies the number of
+	// consecutive attempts to resume a partial remote server list download
+	// which the origin server ignores, responding with the entire resource,
+	// after which the origin is flagged as non-resumable. An origin which
+	// responds with Accept-Ranges: none is flagged immediately. Downloads
+	// from a non-resumable origin are always made in full, without first
+	// attempting to resume. A value of 0 disables this handling. If omitted,
+	// a default value is used.
+	RemoteServerListNonResumableThreshold *int
+
+	// RemoteServerListDownloadProgressIntervalMilliseconds specifies the
+	// minimum interval between RemoteServerListResourceDownloadProgress
+	// notices emitted while a remote server list resource is downloaded. A
+	// value of 0 disables the progress notices. If omitted, a default value
+	// is used.
+	RemoteServerListDownloadProgressIntervalMilliseconds *int
+
+	// RemoteServerListRetryMaxAttempts specifies the maximum number of
+	// attempts to download the common remote server list, or an obfuscated
+	// server list file, in a single fetch, including the first attempt.
+	// Failed downloads are retried with exponential backoff; a downloaded
+	// list that fails validation is not retried. If omitted, a default value,
+	// which disables retries, is used.
+	RemoteServerListRetryMaxAttempts *int
+
+	// RemoteServerListRetryBackoffMilliseconds specifies the backoff before
+	// the first retry of a failed download; see
+	// RemoteServerListRetryMaxAttempts. The backoff doubles with each
+	// further retry, and is limited to
+	// FetchRemoteServerListRetryPeriodMilliseconds. If omitted, a default
+	// value is used.
+	RemoteServerListRetryBackoffMilliseconds *int
+
+	// MinNewEntriesToReport specifies the minimum number of new server
+	// entries a remote server list fetch must add before the fetch is
+	// reported with OnNewServerEntries and a RemoteServerListNewServerEntries
+	// notice. All fetched server entries are imported regardless. This
+	// avoids reacting to fetches that add few servers. If omitted, a default
+	// value, which reports any fetch that adds a server entry, is used.
+	MinNewEntriesToReport *int
+
+	// OnNewServerEntries, when set, is called with the number of new server
+	// entries added by a remote server list fetch, when that number meets
+	// MinNewEntriesToReport. The callback must not block. When
+	// NewEntriesReportWindowMilliseconds is set, reports are coalesced.
+	//
+	// This parameter is only applicable to library deployments.
+	OnNewServerEntries func(count int)
+
+	// NewEntriesReportWindowMilliseconds specifies a window over which
+	// OnNewServerEntries reports are coalesced. The first report starts the
+	// window, and OnNewServerEntries is called once, when the window ends,
+	// with the total number of new server entries reported within the
+	// window. This avoids a storm of reactions, such as tunnel
+	// reconnections, to a burst of fetches. If omitted or 0, each report is
+	// made immediately.
+	NewEntriesReportWindowMilliseconds *int
+
+	// VerifyImportedServerEntries specifies whether to read back a sample of
+	// the server entries stored by each server list import, to check that the
+	// writes persisted. An import fails with a DataStoreIntegrityError when
+	// a sampled server entry was not persisted. This check is disabled by
+	// default as it adds datastore reads to each import.
+	VerifyImportedServerEntries bool
+
+	// CompactDataStore specifies whether to compact the datastore at the end
+	// of a remote server list fetch, once the number of server entries
+	// written by imports and deleted since the last compaction reaches
+	// DataStoreCompactionMinimumChurn. Compaction reclaims the space left by
+	// the churned server entries, for datastores that support it; the
+	// datastore is locked while it's compacted.
+	CompactDataStore bool
+
+	// DataStoreLockedRetryAttempts is the number of times a server entry or
+	// key/value write is retried when it fails because the datastore is
+	// temporarily locked, as by a conflicting transaction. Each retry
+	// follows a backoff, starting at DataStoreLockedRetryBackoffMilliseconds
+	// and doubling with each retry. Other datastore errors are permanent
+	// and aren't retried. The retry policy is applied when the datastore is
+	// opened.
+	//
+	// Only the Badger datastore, built with the BADGER_DB tag, fails writes
+	// with a temporary lock condition, a transaction conflict. With the
+	// default bolt datastore and the FILES_DB datastore, concurrent writes
+	// wait for each other rather than fail, and bolt's lock timeout applies
+	// only when the datastore is opened, so writes are never retried.
+	DataStoreLockedRetryAttempts *int
+
+	// DataStoreLockedRetryBackoffMilliseconds is the backoff for the first
+	// retry of DataStoreLockedRetryAttempts.
+	DataStoreLockedRetryBackoffMilliseconds *int
+
+	// ProbeImportedServerEntries specifies whether to probe the reachability
+	// of a sample of the new server entries imported by each remote server
+	// list and obfuscated server list fetch. The probe is an untunneled TCP
+	// connect to the advertised server endpoint, and the result is recorded
+	// and may be retrieved with GetServerEntryReachability. This probe is
+	// disabled by default, as it delays imports and as the untunneled
+	// connections to servers may be observed on the network.
+	ProbeImportedServerEntries bool
+
+	// ImportServerEntriesAtomically specifies whether to store all of the
+	// server entries in each server list import in a single datastore
+	// transaction, so that either the entire list is stored or, when the
+	// import fails or is interrupted, none of it is. By default, each server
+	// entry is stored in its own transaction, and an incomplete import is
+	// rolled back using an import journal. The single transaction blocks
+	// other datastore writes for the duration of the import, and the entire
+	// import must fit within the datastore's transaction limits.
+	ImportServerEntriesAtomically bool
+
+	// ServerEntrySourcePriority is an optional list of server entry sources,
+	// such as "EMBEDDED", "REMOTE", and "OBFUSCATED", in the order in which
+	// server entries from those sources are selected. Server entries from
+	// sources not in the list are selected after all listed sources. When
+	// not set, server entries from all sources are selected in random order.
+	// See GetServerEntrySourcePriority and SetServerEntrySourcePriority.
+	ServerEntrySourcePriority []string
+
+	// RedactFetchTelemetryURLs specifies whether the remote server list fetch
+	// telemetry returned by GetFetchTelemetryJSON records only the hostnames
+	// of download URLs, in place of full URLs. Set this when the telemetry
+	// may be shared, such as in a support request, and the download URLs
+	// should not be disclosed.
+	RedactFetchTelemetryURLs bool
+
+	// FetchTelemetryUploadURL is an optional URL to which the remote server
+	// list fetch telemetry, the FetchTelemetryRun of each fetch, is
+	// uploaded. Runs are queued as fetches complete and are uploaded in the
+	// background, in batches of JSON encoded arrays of FetchTelemetryRun,
+	// sent with HTTP POST requests through an active tunnel. A batch that
+	// fails to upload is retried, with backoff, and the upload resumes with
+	// that batch. Fetches are not blocked on uploads. Uploads are tuned with
+	// the RemoteServerListTelemetryUpload parameters.
+	//
+	// This parameter is intended for managed deployments.
+	FetchTelemetryUploadURL string
+
 	// ObfuscatedServerListRootURL is a URL which specifies the root location
 	// from which to fetch obfuscated server list files. This value is
 	// supplied by and depends on the Psiphon Network, and is typically
@@ -345,12 +617,247 @@ type Config struct {
 	// OnlyAfterAttempts = 0.
 	ObfuscatedServerListRootURLs parameters.DownloadURLs
 
+	// ObfuscatedServerListShardRootURLs is a list of additional obfuscated
+	// server list roots, for deployments that shard OSLs across multiple
+	// roots. Each root has its own OSL registry and is specified as a list of
+	// URLs with the same requirements as ObfuscatedServerListRootURLs. OSLs
+	// from all roots are fetched, and an OSL advertised by more than one root
+	// is fetched only once. This parameter is ignored when
+	// ObfuscatedServerListRootURLs is nil.
+	ObfuscatedServerListShardRootURLs parameters.DownloadURLsList
+
+	// ObfuscatedServerListRegistryPath is an optional slash-separated path,
+	// relative to each obfuscated server list root URL, from which to fetch
+	// the OSL registry, for deployments with non-standard layouts. When not
+	// set, the registry is fetched from the conventional "osl-registry"
+	// location. OSL files are always fetched from the root.
+	ObfuscatedServerListRegistryPath string
+
 	// ObfuscatedServerListDownloadDirectory specifies a target directory for
 	// storing the obfuscated remote server list downloads. Data is stored in
 	// co-located files (<OSL filename>.part*) to allow for resumable
 	// downloading.
 	ObfuscatedServerListDownloadDirectory string
 
+	// ObfuscatedServerListSharedCacheDirectory specifies an optional
+	// directory in which validated OSL files are cached by content hash. The
+	// directory may be shared by multiple clients, such as app profiles, or
+	// devices with a synced directory. An OSL file in the shared cache with
+	// the content advertised by the OSL registry is used in place of a
+	// download, and OSL files with identical content under different OSL IDs
+	// share one cached file.
+	ObfuscatedServerListSharedCacheDirectory string
+
+	// ObfuscatedServerListFileEncryptionSecret is an optional secret from
+	// which a key is derived to encrypt the downloaded OSL registry and OSL
+	// files, including partial downloads, in
+	// ObfuscatedServerListDownloadDirectory. On shared devices, the files
+	// otherwise reveal which servers the client may access. The files are
+	// decrypted when read. Files downloaded before the secret was set are
+	// read as is, and files encrypted with a different secret can't be
+	// read. The secret should be stored separately from the download
+	// directory; for example, in the platform key store. The key is derived
+	// with HKDF, which doesn't stretch the secret, so the secret must be a
+	// high-entropy random value, such as 32 hex encoded random bytes, and
+	// not a user chosen password.
+	ObfuscatedServerListFileEncryptionSecret string
+
+	// ObfuscatedServerListDownloadConcurrency specifies the maximum number
+	// of individual OSL files downloaded concurrently in a fetch. Downloaded
+	// OSLs are still imported one at a time, in fetch order. If omitted, a
+	// default value is used.
+	ObfuscatedServerListDownloadConcurrency *int
+
+	// SupportedServerEntryCapabilities is an optional list of the server
+	// entry capabilities, such as "OSSH" or "UNFRONTED-MEEK", which the
+	// client can use. When set, OSLs whose registry capabilities hint lists
+	// only capabilities not in this list are not downloaded. OSLs without a
+	// capabilities hint are always downloaded.
+	SupportedServerEntryCapabilities []string
+
+	// UntunneledDownloadEgressRegionChecker, when set, is called after each
+	// untunneled remote server list download to determine the egress region
+	// of the untunneled network path, for example by querying a lightweight
+	// IP geolocation service. The checker returns the two-letter region code.
+	// The check is only performed when
+	// UntunneledDownloadAllowedEgressRegions is also set.
+	//
+	// This parameter is only applicable to library deployments.
+	UntunneledDownloadEgressRegionChecker func() (string, error)
+
+	// UntunneledDownloadAllowedEgressRegions is the list of regions in which
+	// untunneled remote server list downloads are expected to egress. A
+	// download that egresses in any other region, as reported by
+	// UntunneledDownloadEgressRegionChecker, emits a notice.
+	UntunneledDownloadAllowedEgressRegions []string
+
+	// EnforceUntunneledDownloadEgressRegions specifies that an untunneled
+	// remote server list download that egresses in a region not listed in
+	// UntunneledDownloadAllowedEgressRegions, or for which the egress region
+	// check fails, fails instead of being imported.
+	EnforceUntunneledDownloadEgressRegions bool
+
+	// OnUntunneledDownload, when set, is called with the download URL before
+	// each untunneled download, including remote server list and upgrade
+	// downloads. An untunneled download exposes the client's IP address to
+	// the download host, so privacy conscious apps may use this to warn the
+	// user or block the download. When OnUntunneledDownload returns false,
+	// the download isn't attempted and fails with an
+	// UntunneledDownloadVetoedError. OnUntunneledDownload isn't called for
+	// downloads skipped due to unchanged ETags. OnUntunneledDownload must not
+	// block.
+	//
+	// This parameter is only applicable to library deployments.
+	OnUntunneledDownload func(url string) bool
+
+	// ShouldRetryDownload, when set, is called after each failed common
+	// remote server list download, obfuscated server list file download, and
+	// obfuscated server list registry download, which may be retried within
+	// a fetch, with the download error and the attempt number, starting at
+	// 0, of the failed download. The download is retried only when
+	// ShouldRetryDownload returns true. This overrides the default
+	// classification, which retries all failed common remote server list and
+	// obfuscated server list file downloads, and registry downloads which
+	// made progress. Retries remain limited by
+	// RemoteServerListRetryMaxAttempts and
+	// ObfuscatedServerListRegistryResumeAttempts. A downloaded list which
+	// fails validation, and a download which fails with a
+	// TunnelRequiredError, aren't retried and ShouldRetryDownload isn't
+	// called. ShouldRetryDownload must not block.
+	//
+	// This parameter is only applicable to library deployments.
+	ShouldRetryDownload func(err error, attempt int) bool
+
+	// OnNoEligibleOSLs, when set, is called when an obfuscated server list
+	// fetch finds that none of the OSLs in a registry are eligible, as the
+	// client doesn't have sufficient SLOKs to decrypt any of them, with the
+	// total number of OSLs in the registry. The app may use this to prompt
+	// actions that earn SLOKs. The callback is called once per registry
+	// fetched, and must not block.
+	//
+	// This parameter is only applicable to library deployments.
+	OnNoEligibleOSLs func(registryOSLCount int)
+
+	// RemoteServerListNoticeMinimumSeverity specifies the minimum severity
+	// of the Info, Alert, and download progress notices emitted by remote
+	// server list fetches: "Info", "Alert", or "Error". Notices below this
+	// severity are suppressed, which reduces log noise during large
+	// obfuscated server list fetches. When blank, all notices are emitted.
+	// Error notices, and errors returned by fetches, are never suppressed.
+	RemoteServerListNoticeMinimumSeverity string
+
+	// OnServerEntryValidationError, when set, is called with each encoded
+	// server entry in a fetched remote server list that fails validation,
+	// along with the validation error. This allows integrators to log or
+	// salvage malformed server entries. The callback must not block.
+	//
+	// This parameter is only applicable to library deployments.
+	OnServerEntryValidationError func(encodedServerEntry string, err error)
+
+	// LenientServerEntryValidation specifies that server entries in fetched
+	// remote server lists which fail only non-critical validation, such as
+	// server entries with no capabilities, are imported instead of skipped.
+	// Server entries with an invalid IP address are always skipped.
+	LenientServerEntryValidation bool
+
+	// ServerEntryIPAllowlist is an optional list of CIDRs, such as
+	// "192.0.2.0/24". When set, imported server entries whose IP address is
+	// not in any of the listed networks are dropped instead of stored.
+	ServerEntryIPAllowlist []string
+
+	// ServerEntryIPBlocklist is an optional list of CIDRs. Imported server
+	// entries whose IP address is in any of the listed networks are dropped
+	// instead of stored, even when the IP address is in
+	// ServerEntryIPAllowlist.
+	ServerEntryIPBlocklist []string
+
+	// OnValidatedPayload, when set, is called with the source URL and the
+	// entire payload of each fetched remote server list and obfuscated
+	// server list, after the payload signature is validated and before any
+	// server entries are decoded and stored. This allows integrators to
+	// inspect or archive the exact validated payload. The callback is never
+	// called with a payload that failed validation. The callback must not
+	// modify the payload. When set, each payload is read into memory instead
+	// of being streamed.
+	//
+	// This parameter is only applicable to library deployments.
+	OnValidatedPayload func(sourceURL string, payload []byte)
+
+	// ServerEntrySink, when set, receives each server entry stored by
+	// StoreServerEntries, StreamingStoreServerEntries, and remote server
+	// list fetches, indicating whether the server entry is new or updated.
+	// This allows integrators to mirror the stored server entries in an
+	// external index. Server entries are delivered once each import is
+	// committed; the server entries of a failed import are not delivered.
+	//
+	// This parameter is only applicable to library deployments.
+	ServerEntrySink ServerEntrySink
+
+	// ServerListStore, when set, replaces the local datastore as the store
+	// for the ETags, server entry revocation list, SLOKs, and imported
+	// server entries of remote server list fetches. This allows integrators
+	// to fetch into an external or in-memory store. Fetch bookkeeping
+	// remains in the local datastore. See ServerListStore.
+	//
+	// This parameter is only applicable to library deployments.
+	ServerListStore ServerListStore
+
+	// FetchGate, when set, is called before each OSL file download made by
+	// an obfuscated server list fetch. When FetchGate returns false, the
+	// fetch is paused: no further OSL files are downloaded, the OSLs already
+	// processed are kept, and the fetch returns a FetchGatedError. A later
+	// fetch resumes where the paused fetch left off, as OSLs with stored
+	// ETags aren't downloaded again. This allows apps to defer heavy fetches
+	// based on, for example, battery level, charging state, or network cost.
+	// FetchGate must not block.
+	//
+	// This parameter is only applicable to library deployments.
+	FetchGate func() bool
+
+	// OSLFilenameEncoder, when set, is called to name the download file of
+	// each OSL, overriding the default "osl-<hex ID>" name and any
+	// ObfuscatedServerListSubdirectoryLength subdirectory. The returned name
+	// is relative to ObfuscatedServerListDownloadDirectory and may include
+	// slash-separated subdirectories, which are created as required. This
+	// allows apps to, for example, use hashed names, or shard OSL files into
+	// subdirectories to avoid huge directories. The encoder must return
+	// distinct names for distinct OSL IDs, and each name must be the same
+	// each time it's called for the same OSL ID. Names that would leave the
+	// download directory, or that collide with the OSL registry files or the
+	// quarantine or dry run directories, are rejected and the OSL isn't
+	// downloaded.
+	//
+	// This parameter is only applicable to library deployments.
+	OSLFilenameEncoder func(oslID []byte) string
+
+	// EntropySource, when set, is the source of the non-cryptographic random
+	// values used by remote server list fetch scheduling and sampling: retry
+	// backoff jitter, weighted mirror selection, and the sampling of
+	// imported server entries for verification and probing. Set a
+	// deterministic source, such as rand.NewSource with a fixed seed, to make
+	// these choices reproducible, for example in tests. Access to the source
+	// is serialized, so the source needn't be safe for concurrent use, but it
+	// must not be used elsewhere. When not set, a source seeded with secure
+	// random bytes is used.
+	//
+	// This parameter is only applicable to library deployments.
+	EntropySource rand.Source
+
+	// ServerEntryCompressionDictionary is a base64-encoded zlib preset
+	// dictionary used to decompress remote server list and obfuscated server
+	// list payloads. Payloads compressed with a dictionary, which shrinks
+	// payloads with many similar server entries, cannot be imported without
+	// the same dictionary. Payloads compressed without a dictionary are
+	// imported as usual.
+	ServerEntryCompressionDictionary string
+
+	// ServerEntryCompressionDictionaryFilename specifies a file containing
+	// the raw bytes of a zlib preset dictionary, as an alternative to
+	// ServerEntryCompressionDictionary. The file is read when the config is
+	// committed. This parameter is ignored when
+	// ServerEntryCompressionDictionary is set.
+	ServerEntryCompressionDictionaryFilename string
+
 	// SplitTunnelRoutesURLFormat is a URL which specifies the location of a
 	// routes file to use for split tunnel mode. The URL must include a
 	// placeholder for the client region to be supplied. Split tunnel mode
@@ -411,6 +918,28 @@ type Config struct {
 	// is used. This value is typical overridden for testing.
 	FetchUpgradeRetryPeriodMilliseconds *int
 
+	// DownloadHostAddresses is a static mapping from download host domain
+	// names to IP addresses. When set, the listed download hosts are
+	// resolved using this mapping, in place of the system resolver, for
+	// untunneled remote server list and upgrade downloads.
+	DownloadHostAddresses map[string][]string
+
+	// DownloadHostResolverURL specifies a DNS-over-HTTPS (RFC 8484) endpoint
+	// URL. When set, download host domain names not in DownloadHostAddresses
+	// are resolved using this endpoint, in place of the system resolver, for
+	// untunneled remote server list and upgrade downloads. The endpoint is
+	// itself dialed using the system resolver, so the URL host should
+	// typically be an IP address.
+	DownloadHostResolverURL string
+
+	// MinDownloadTLSVersion specifies the minimum TLS version, such as
+	// "TLS 1.2", accepted for untunneled remote server list and upgrade
+	// downloads. A download connection which negotiates a lower version is
+	// rejected, preventing a downgrade by a network adversary. Valid values
+	// are "TLS 1.0", "TLS 1.1", "TLS 1.2", and "TLS 1.3". When omitted, the
+	// minimum is TLS 1.2.
+	MinDownloadTLSVersion string
+
 	// EmitBytesTransferred indicates whether to emit periodic notices showing
 	// bytes sent and received.
 	EmitBytesTransferred bool
@@ -508,13 +1037,44 @@ type Config struct {
 	// calling clientParameters.Set directly will fail to add config values.
 	clientParameters *parameters.ClientParameters
 
+	// clientParametersMutex guards the inputs to clientParameters. The most
+	// recent SetClientParameters inputs and the most recently applied config
+	// overrides are retained so that applying config overrides does not
+	// discard tactics, and applying tactics does not discard config
+	// overrides.
+	clientParametersMutex       sync.Mutex
+	clientParametersTag         string
+	clientParametersSkipOnError bool
+	clientParametersApply       map[string]interface{}
+	configOverridesVersion      int64
+	configOverridesParameters   map[string]interface{}
+
 	dynamicConfigMutex sync.Mutex
 	sponsorID          string
 	authorizations     []string
 
+	serverEntryStreamHandlerMutex sync.Mutex
+	serverEntryStreamHandler      func(*protocol.ServerEntry)
+
+	newServerEntriesReporter newServerEntriesReporter
+
 	deviceBinder    DeviceBinder
 	networkIDGetter NetworkIDGetter
 
+	remoteServerListNoticeMinimumSeverity noticeSeverity
+
+	serverEntryCompressionDictionary []byte
+
+	oslFileEncryptionKey *downloadFileKey
+
+	serverEntryIPFilter *serverEntryIPFilter
+
+	downloadHostResolver *downloadHostResolver
+
+	minDownloadTLSVersion uint16
+
+	entropy *rand.Rand
+
 	committed bool
 }
 
@@ -625,6 +1185,20 @@ func (config *Config) Commit() error {
 			if config.RemoteServerListDownloadFilename == "" {
 				return common.ContextError(errors.New("missing RemoteServerListDownloadFilename"))
 			}
+			err := checkDownloadDirectory(filepath.Dir(config.RemoteServerListDownloadFilename))
+			if err != nil {
+				return common.ContextError(
+					fmt.Errorf("invalid RemoteServerListDownloadFilename: %s", err))
+			}
+		} else if config.RemoteServerListRevocationURLs != nil {
+			return common.ContextError(errors.New("RemoteServerListRevocationURLs requires RemoteServerListURLs"))
+		} else if config.RemoteServerListSecondarySignatureURLs != nil {
+			return common.ContextError(errors.New("RemoteServerListSecondarySignatureURLs requires RemoteServerListURLs"))
+		}
+
+		if config.RemoteServerListSecondarySignatureURLs != nil &&
+			config.RemoteServerListSecondaryPublicKey == "" {
+			return common.ContextError(errors.New("missing RemoteServerListSecondaryPublicKey"))
 		}
 
 		if config.ObfuscatedServerListRootURLs != nil {
@@ -634,8 +1208,88 @@ func (config *Config) Commit() error {
 			if config.ObfuscatedServerListDownloadDirectory == "" {
 				return common.ContextError(errors.New("missing ObfuscatedServerListDownloadDirectory"))
 			}
+			err := checkDownloadDirectory(config.ObfuscatedServerListDownloadDirectory)
+			if err != nil {
+				return common.ContextError(
+					fmt.Errorf("invalid ObfuscatedServerListDownloadDirectory: %s", err))
+			}
+			if config.ObfuscatedServerListRegistryPath != "" &&
+				path.Clean("/"+config.ObfuscatedServerListRegistryPath) == "/" {
+				return common.ContextError(errors.New("invalid ObfuscatedServerListRegistryPath"))
+			}
+			if config.ObfuscatedServerListSharedCacheDirectory != "" {
+				err := checkDownloadDirectory(config.ObfuscatedServerListSharedCacheDirectory)
+				if err != nil {
+					return common.ContextError(
+						fmt.Errorf("invalid ObfuscatedServerListSharedCacheDirectory: %s", err))
+				}
+			}
+		}
+
+	}
+
+	config.remoteServerListNoticeMinimumSeverity, err = parseNoticeSeverity(
+		config.RemoteServerListNoticeMinimumSeverity)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if config.ServerEntryCompressionDictionary != "" {
+		config.serverEntryCompressionDictionary, err = base64.StdEncoding.DecodeString(
+			config.ServerEntryCompressionDictionary)
+		if err != nil {
+			return common.ContextError(
+				fmt.Errorf("invalid ServerEntryCompressionDictionary: %s", err))
+		}
+	} else if config.ServerEntryCompressionDictionaryFilename != "" {
+		config.serverEntryCompressionDictionary, err = ioutil.ReadFile(
+			config.ServerEntryCompressionDictionaryFilename)
+		if err != nil {
+			return common.ContextError(
+				fmt.Errorf("invalid ServerEntryCompressionDictionaryFilename: %s", err))
+		}
+	}
+
+	err = validateServerEntrySourcePriority(config.ServerEntrySourcePriority)
+	if err != nil {
+		return common.ContextError(
+			fmt.Errorf("invalid ServerEntrySourcePriority: %s", err))
+	}
+
+	if config.ObfuscatedServerListFileEncryptionSecret != "" {
+		config.oslFileEncryptionKey, err = newDownloadFileKey(
+			config.ObfuscatedServerListFileEncryptionSecret)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	entropySource := config.EntropySource
+	if entropySource == nil {
+		seed, err := common.MakeSecureRandomInt64(math.MaxInt64)
+		if err != nil {
+			return common.ContextError(err)
 		}
+		entropySource = rand.NewSource(seed)
+	}
+	config.entropy = rand.New(&lockedRandSource{source: entropySource})
 
+	config.serverEntryIPFilter, err = newServerEntryIPFilter(
+		config.ServerEntryIPAllowlist, config.ServerEntryIPBlocklist)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	config.downloadHostResolver, err = newDownloadHostResolver(
+		config.DownloadHostAddresses, config.DownloadHostResolverURL)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	config.minDownloadTLSVersion, err = parseMinDownloadTLSVersion(
+		config.MinDownloadTLSVersion)
+	if err != nil {
+		return common.ContextError(err)
 	}
 
 	if config.SplitTunnelRoutesURLFormat != "" {
@@ -754,11 +1408,172 @@ func (config *Config) GetClientParameters() *parameters.ClientParametersSnapshot
 // In the case of applying tactics, do not call Config.clientParameters.Set
 // directly as this will not first apply config values.
 //
+// Any config overrides applied with ApplyConfigOverrides are applied after
+// the config file values and before the input parameters.
+//
 // If there is an error, the existing Config.clientParameters are left
 // entirely unmodified.
 func (config *Config) SetClientParameters(tag string, skipOnError bool, applyParameters map[string]interface{}) error {
 
+	config.clientParametersMutex.Lock()
+	defer config.clientParametersMutex.Unlock()
+
+	err := config.setClientParameters(
+		tag, skipOnError, applyParameters, config.configOverridesParameters)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	config.clientParametersTag = tag
+	config.clientParametersSkipOnError = skipOnError
+	config.clientParametersApply = applyParameters
+
+	return nil
+}
+
+// configOverridesSafelist is the list of client parameters which may be set
+// by a config overrides section. Config overrides are distributed alongside
+// server lists, so the safelist is limited to parameters such as fetch
+// timeouts and download mirror lists. In particular, signature public keys
+// are not included.
+var configOverridesSafelist = []string{
+	parameters.FetchRemoteServerListTimeout,
+	parameters.RemoteServerListConnectTimeout,
+	parameters.FetchRemoteServerListRetryPeriod,
+	parameters.FetchRemoteServerListStalePeriod,
+	parameters.RemoteServerListURLs,
+	parameters.ObfuscatedServerListRootURLs,
+	parameters.ObfuscatedServerListShardRootURLs,
+	parameters.FetchUpgradeTimeout,
+	parameters.FetchUpgradeRetryPeriod,
+	parameters.FetchUpgradeStalePeriod,
+	parameters.UpgradeDownloadURLs,
+}
+
+// ConfigOverrides is the payload of a config overrides section of an
+// authenticated data package. Version must increase with each new set of
+// overrides; ApplyConfigOverrides ignores overrides with a version that is
+// not greater than the version of the currently applied overrides.
+type ConfigOverrides struct {
+	Version          int64
+	ClientParameters map[string]interface{}
+}
+
+// ApplyConfigOverrides validates and applies the JSON encoded
+// ConfigOverrides. The caller is responsible for first authenticating the
+// config overrides, as is done by
+// common.NewAuthenticatedDataPackageReaderWithConfigOverrides.
+//
+// Config overrides which set any parameter not in the safelist, or which set
+// any invalid parameter value, are rejected in their entirety.
+//
+// Applied config overrides are stored in the datastore, which must be open,
+// and are reapplied when the datastore is next opened, as the server list
+// which carried the config overrides isn't downloaded again while it's
+// unchanged. The stored version also remains the minimum version for config
+// overrides applied after a restart.
+func (config *Config) ApplyConfigOverrides(configOverridesJSON []byte) error {
+	return config.applyConfigOverrides(configOverridesJSON, true)
+}
+
+// applyStoredConfigOverrides reapplies config overrides stored by
+// ApplyConfigOverrides. When the stored config overrides are no longer valid,
+// for example when a parameter is removed from the safelist, they're not
+// applied, but their version is retained so that older config overrides are
+// still rejected.
+func (config *Config) applyStoredConfigOverrides(configOverridesJSON []byte) error {
+
+	err := config.applyConfigOverrides(configOverridesJSON, false)
+	if err == nil {
+		return nil
+	}
+
+	var configOverrides ConfigOverrides
+	if json.Unmarshal(configOverridesJSON, &configOverrides) == nil {
+		config.clientParametersMutex.Lock()
+		if configOverrides.Version > config.configOverridesVersion {
+			config.configOverridesVersion = configOverrides.Version
+		}
+		config.clientParametersMutex.Unlock()
+	}
+
+	return common.ContextError(err)
+}
+
+func (config *Config) applyConfigOverrides(configOverridesJSON []byte, store bool) error {
+
+	var configOverrides ConfigOverrides
+	err := json.Unmarshal(configOverridesJSON, &configOverrides)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	for name := range configOverrides.ClientParameters {
+		if !common.Contains(configOverridesSafelist, name) {
+			return common.ContextError(
+				fmt.Errorf("config override parameter not permitted: %s", name))
+		}
+	}
+
+	// Validate the parameter values independently of the current tactics,
+	// which may be applied with skipOnError.
+
+	validationParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	_, err = validationParameters.Set("", false, configOverrides.ClientParameters)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	config.clientParametersMutex.Lock()
+	defer config.clientParametersMutex.Unlock()
+
+	if configOverrides.Version <= config.configOverridesVersion {
+		NoticeInfo(
+			"skipping config overrides version %d: current version %d",
+			configOverrides.Version, config.configOverridesVersion)
+		return nil
+	}
+
+	// The config overrides are stored before they're applied, so that
+	// applied config overrides, and their version, are never lost on
+	// restart.
+	if store {
+		err = storeConfigOverrides(configOverridesJSON)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	err = config.setClientParameters(
+		config.clientParametersTag,
+		config.clientParametersSkipOnError,
+		config.clientParametersApply,
+		configOverrides.ClientParameters)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	config.configOverridesVersion = configOverrides.Version
+	config.configOverridesParameters = configOverrides.ClientParameters
+
+	NoticeInfo("applied config overrides version %d", configOverrides.Version)
+
+	return nil
+}
+
+func (config *Config) setClientParameters(
+	tag string,
+	skipOnError bool,
+	applyParameters map[string]interface{},
+	configOverridesParameters map[string]interface{}) error {
+
 	setParameters := []map[string]interface{}{config.makeConfigParameters()}
+	if configOverridesParameters != nil {
+		setParameters = append(setParameters, configOverridesParameters)
+	}
 	if applyParameters != nil {
 		setParameters = append(setParameters, applyParameters)
 	}
@@ -793,6 +1608,46 @@ func (config *Config) SetDynamicConfig(sponsorID string, authorizations []string
 	config.authorizations = authorizations
 }
 
+// SetServerEntryStreamHandler sets a handler which is invoked with each
+// server entry decoded from a newly downloaded common remote server list.
+// The handler is invoked as each server entry is decoded, before it is
+// stored, so that new server entries may be used as establishment candidates
+// before the entire list is stored. All server entries are still stored.
+// The handler must not block. Set a nil handler to stop streaming.
+func (config *Config) SetServerEntryStreamHandler(handler func(*protocol.ServerEntry)) {
+	config.serverEntryStreamHandlerMutex.Lock()
+	defer config.serverEntryStreamHandlerMutex.Unlock()
+	config.serverEntryStreamHandler = handler
+}
+
+func (config *Config) getServerEntryStreamHandler() func(*protocol.ServerEntry) {
+	config.serverEntryStreamHandlerMutex.Lock()
+	defer config.serverEntryStreamHandlerMutex.Unlock()
+	return config.serverEntryStreamHandler
+}
+
+// now returns the current time from the Clock, when set, or else the
+// system clock.
+func (config *Config) now() time.Time {
+	if config.Clock != nil {
+		return config.Clock.Now()
+	}
+	return time.Now()
+}
+
+// getCurrentTimestamp is common.GetCurrentTimestamp using the config clock.
+func (config *Config) getCurrentTimestamp() string {
+	return config.now().UTC().Format(time.RFC3339)
+}
+
+// emitRemoteServerListNotice indicates whether a remote server list fetch
+// notice of the specified severity is to be emitted, given the configured
+// RemoteServerListNoticeMinimumSeverity. Error notices are always emitted.
+func (config *Config) emitRemoteServerListNotice(severity noticeSeverity) bool {
+	return severity == noticeSeverityError ||
+		severity >= config.remoteServerListNoticeMinimumSeverity
+}
+
 // GetSponsorID returns the current client sponsor ID.
 func (config *Config) GetSponsorID() string {
 	config.dynamicConfigMutex.Lock()
@@ -878,6 +1733,106 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 		applyParameters[parameters.FetchRemoteServerListRetryPeriod] = fmt.Sprintf("%dms", *config.FetchRemoteServerListRetryPeriodMilliseconds)
 	}
 
+	if config.FetchRemoteServerListDiskFullRetryPeriodMilliseconds != nil {
+		applyParameters[parameters.FetchRemoteServerListDiskFullRetryPeriod] = fmt.Sprintf("%dms", *config.FetchRemoteServerListDiskFullRetryPeriodMilliseconds)
+	}
+
+	if config.FetchRemoteServerListStaggerDelayMilliseconds != nil {
+		applyParameters[parameters.FetchRemoteServerListStaggerDelay] = fmt.Sprintf("%dms", *config.FetchRemoteServerListStaggerDelayMilliseconds)
+	}
+
+	if config.RemoteServerListConnectTimeoutSeconds != nil {
+		applyParameters[parameters.RemoteServerListConnectTimeout] = fmt.Sprintf("%ds", *config.RemoteServerListConnectTimeoutSeconds)
+	}
+
+	if config.RemoteServerListRevalidateIntervalSeconds != nil {
+		applyParameters[parameters.RemoteServerListRevalidateInterval] = fmt.Sprintf("%ds", *config.RemoteServerListRevalidateIntervalSeconds)
+	}
+
+	if config.RemoteServerListHonorCacheControl != nil {
+		applyParameters[parameters.RemoteServerListHonorCacheControl] = *config.RemoteServerListHonorCacheControl
+	}
+
+	if config.DownloadDisableKeepAlives != nil {
+		applyParameters[parameters.DownloadDisableKeepAlives] = *config.DownloadDisableKeepAlives
+	}
+
+	if config.RemoteServerListRequireTunnel != nil {
+		applyParameters[parameters.RemoteServerListRequireTunnel] = *config.RemoteServerListRequireTunnel
+	}
+
+	if config.RemoteServerListLegalBlockFailover != nil {
+		applyParameters[parameters.RemoteServerListLegalBlockFailover] = *config.RemoteServerListLegalBlockFailover
+	}
+
+	if config.RemoteServerListMirrorFailover != nil {
+		applyParameters[parameters.RemoteServerListMirrorFailover] = *config.RemoteServerListMirrorFailover
+	}
+
+	if config.RemoteServerListResumeVerifyDigest != nil {
+		applyParameters[parameters.RemoteServerListResumeVerifyDigest] = *config.RemoteServerListResumeVerifyDigest
+	}
+
+	if config.RemoteServerListNonResumableThreshold != nil {
+		applyParameters[parameters.RemoteServerListNonResumableThreshold] = *config.RemoteServerListNonResumableThreshold
+	}
+
+	if config.RemoteServerListDownloadProgressIntervalMilliseconds != nil {
+		applyParameters[parameters.RemoteServerListDownloadProgressInterval] = fmt.Sprintf("%dms", *config.RemoteServerListDownloadProgressIntervalMilliseconds)
+	}
+
+	if config.ObfuscatedServerListDownloadConcurrency != nil {
+		applyParameters[parameters.ObfuscatedServerListDownloadConcurrency] = *config.ObfuscatedServerListDownloadConcurrency
+	}
+
+	if config.RemoteServerListRetryMaxAttempts != nil {
+		applyParameters[parameters.RemoteServerListRetryMaxAttempts] = *config.RemoteServerListRetryMaxAttempts
+	}
+
+	if config.RemoteServerListRetryBackoffMilliseconds != nil {
+		applyParameters[parameters.RemoteServerListRetryBackoff] = fmt.Sprintf("%dms", *config.RemoteServerListRetryBackoffMilliseconds)
+	}
+
+	if config.MinNewEntriesToReport != nil {
+		applyParameters[parameters.RemoteServerListMinNewEntriesToReport] = *config.MinNewEntriesToReport
+	}
+
+	if config.NewEntriesReportWindowMilliseconds != nil {
+		applyParameters[parameters.RemoteServerListNewEntriesReportWindow] = fmt.Sprintf("%dms", *config.NewEntriesReportWindowMilliseconds)
+	}
+
+	if config.VerifyImportedServerEntries {
+		applyParameters[parameters.VerifyImportedServerEntries] = true
+	}
+
+	if config.CompactDataStore {
+		applyParameters[parameters.DataStoreCompaction] = true
+	}
+
+	if config.DataStoreLockedRetryAttempts != nil {
+		applyParameters[parameters.DataStoreLockedRetryAttempts] = *config.DataStoreLockedRetryAttempts
+	}
+
+	if config.DataStoreLockedRetryBackoffMilliseconds != nil {
+		applyParameters[parameters.DataStoreLockedRetryBackoff] = fmt.Sprintf("%dms", *config.DataStoreLockedRetryBackoffMilliseconds)
+	}
+
+	if config.ProbeImportedServerEntries {
+		applyParameters[parameters.ProbeImportedServerEntries] = true
+	}
+
+	if config.ImportServerEntriesAtomically {
+		applyParameters[parameters.ServerEntryImportAtomic] = true
+	}
+
+	if len(config.ServerEntrySourcePriority) > 0 {
+		applyParameters[parameters.ServerEntrySourcePriority] = config.ServerEntrySourcePriority
+	}
+
+	if config.RedactFetchTelemetryURLs {
+		applyParameters[parameters.RemoteServerListTelemetryRedactURLs] = true
+	}
+
 	if config.FetchUpgradeRetryPeriodMilliseconds != nil {
 		applyParameters[parameters.FetchUpgradeRetryPeriod] = fmt.Sprintf("%dms", *config.FetchUpgradeRetryPeriodMilliseconds)
 	}
@@ -894,11 +1849,25 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 		if config.RemoteServerListURLs != nil {
 			applyParameters[parameters.RemoteServerListSignaturePublicKey] = config.RemoteServerListSignaturePublicKey
 			applyParameters[parameters.RemoteServerListURLs] = config.RemoteServerListURLs
+			if config.RemoteServerListRevocationURLs != nil {
+				applyParameters[parameters.RemoteServerListRevocationURLs] = config.RemoteServerListRevocationURLs
+			}
+			if config.RemoteServerListSecondarySignatureURLs != nil {
+				applyParameters[parameters.RemoteServerListSecondarySignatureURLs] = config.RemoteServerListSecondarySignatureURLs
+				applyParameters[parameters.RemoteServerListSecondaryPublicKey] = config.RemoteServerListSecondaryPublicKey
+			}
 		}
 
 		if config.ObfuscatedServerListRootURLs != nil {
 			applyParameters[parameters.RemoteServerListSignaturePublicKey] = config.RemoteServerListSignaturePublicKey
 			applyParameters[parameters.ObfuscatedServerListRootURLs] = config.ObfuscatedServerListRootURLs
+			if config.ObfuscatedServerListShardRootURLs != nil {
+				applyParameters[parameters.ObfuscatedServerListShardRootURLs] = config.ObfuscatedServerListShardRootURLs
+			}
+		}
+
+		if config.RemoteServerListLowTrustSignaturePublicKey != "" {
+			applyParameters[parameters.RemoteServerListLowTrustSignaturePublicKey] = config.RemoteServerListLowTrustSignaturePublicKey
 		}
 
 	}
@@ -982,6 +1951,52 @@ func promoteLegacyDownloadURL(URL string) parameters.DownloadURLs {
 	return downloadURLs
 }
 
+// checkDownloadDirectory creates the download directory, when it doesn't
+// exist, and checks that files may be created in it. This surfaces a
+// misconfigured download location when the config is committed rather than
+// on the first download attempt.
+func checkDownloadDirectory(directory string) error {
+
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	file, err := ioutil.TempFile(directory, ".download-check")
+	if err != nil {
+		return common.ContextError(err)
+	}
+	file.Close()
+
+	err = os.Remove(file.Name())
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// parseMinDownloadTLSVersion returns the TLS version value named by
+// MinDownloadTLSVersion. The default, for "", is TLS 1.2.
+func parseMinDownloadTLSVersion(version string) (uint16, error) {
+
+	switch version {
+	case "":
+		return tls.VersionTLS12, nil
+	case "TLS 1.0":
+		return tls.VersionTLS10, nil
+	case "TLS 1.1":
+		return tls.VersionTLS11, nil
+	case "TLS 1.2":
+		return tls.VersionTLS12, nil
+	case "TLS 1.3":
+		return tlsVersionTLS13, nil
+	}
+
+	return 0, common.ContextError(
+		fmt.Errorf("invalid MinDownloadTLSVersion: %s", version))
+}
+
 type loggingDeviceBinder struct {
 	d DeviceBinder
 }
@@ -22,6 +22,8 @@ package psiphon
 import (
 	"encoding/json"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -187,3 +189,90 @@ func (suite *ConfigTestSuite) Test_LoadConfig_GoodJson() {
 	}
 	suite.Nil(err, "JSON with null for optional values should succeed")
 }
+
+func TestConfigDownloadDirectories(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-config-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	commit := func(remoteServerListDownloadFilename, obfuscatedServerListDownloadDirectory string) error {
+		config := &Config{
+			PropagationChannelId:                  "0",
+			SponsorId:                             "0",
+			DataStoreDirectory:                    testDataDirName,
+			RemoteServerListSignaturePublicKey:    "key",
+			RemoteServerListURLs:                  promoteLegacyDownloadURL("http://127.0.0.1/rsl"),
+			RemoteServerListDownloadFilename:      remoteServerListDownloadFilename,
+			ObfuscatedServerListRootURLs:          promoteLegacyDownloadURL("http://127.0.0.1/osl"),
+			ObfuscatedServerListDownloadDirectory: obfuscatedServerListDownloadDirectory,
+		}
+		return config.Commit()
+	}
+
+	// Missing directories are created.
+
+	remoteServerListDirectory := filepath.Join(testDataDirName, "missing", "rsl")
+	obfuscatedServerListDirectory := filepath.Join(testDataDirName, "missing", "osl")
+
+	err = commit(
+		filepath.Join(remoteServerListDirectory, "remote_server_list"),
+		obfuscatedServerListDirectory)
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+	for _, directory := range []string{remoteServerListDirectory, obfuscatedServerListDirectory} {
+		fileInfo, err := os.Stat(directory)
+		if err != nil || !fileInfo.IsDir() {
+			t.Fatalf("directory not created: %s", directory)
+		}
+		fileInfos, err := ioutil.ReadDir(directory)
+		if err != nil || len(fileInfos) != 0 {
+			t.Fatalf("unexpected directory contents: %s", directory)
+		}
+	}
+
+	// A directory which can't be created is a configuration error.
+
+	notADirectory := filepath.Join(testDataDirName, "file")
+	err = ioutil.WriteFile(notADirectory, []byte("file"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	err = commit(
+		filepath.Join(notADirectory, "remote_server_list"),
+		obfuscatedServerListDirectory)
+	if err == nil || !strings.Contains(err.Error(), "invalid RemoteServerListDownloadFilename") {
+		t.Fatalf("unexpected Commit result: %v", err)
+	}
+
+	err = commit(
+		filepath.Join(remoteServerListDirectory, "remote_server_list"),
+		filepath.Join(notADirectory, "osl"))
+	if err == nil || !strings.Contains(err.Error(), "invalid ObfuscatedServerListDownloadDirectory") {
+		t.Fatalf("unexpected Commit result: %v", err)
+	}
+
+	// A directory which isn't writable is a configuration error.
+
+	readOnlyDirectory := filepath.Join(testDataDirName, "read-only")
+	err = os.Mkdir(readOnlyDirectory, 0500)
+	if err != nil {
+		t.Fatalf("Mkdir failed: %s", err)
+	}
+	defer os.Chmod(readOnlyDirectory, 0700)
+
+	if ioutil.WriteFile(filepath.Join(readOnlyDirectory, "file"), nil, 0600) == nil {
+		t.Skipf("read-only directory is writable")
+	}
+
+	err = commit(
+		filepath.Join(remoteServerListDirectory, "remote_server_list"),
+		readOnlyDirectory)
+	if err == nil || !strings.Contains(err.Error(), "invalid ObfuscatedServerListDownloadDirectory") {
+		t.Fatalf("unexpected Commit result: %v", err)
+	}
+}
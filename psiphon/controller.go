@@ -29,6 +29,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 
@@ -55,6 +56,7 @@ type Controller struct {
 	establishedOnce                         bool
 	tunnels                                 []*Tunnel
 	nextTunnel                              int
+	fetchDeferredUntilTunnel                bool
 	startedConnectedReporter                bool
 	isEstablishing                          bool
 	establishLimitTunnelProtocolsState      *limitTunnelProtocolsState
@@ -68,10 +70,12 @@ type Controller struct {
 	stopEstablish                           context.CancelFunc
 	establishWaitGroup                      *sync.WaitGroup
 	candidateServerEntries                  chan *candidateServerEntry
+	streamedServerEntries                   chan *protocol.ServerEntry
 	untunneledDialConfig                    *DialConfig
 	splitTunnelClassifier                   *SplitTunnelClassifier
 	signalFetchCommonRemoteServerList       chan struct{}
 	signalFetchObfuscatedServerLists        chan struct{}
+	signalUploadFetchTelemetry              chan struct{}
 	signalDownloadUpgrade                   chan string
 	signalReportConnected                   chan struct{}
 	serverAffinityDoneBroadcast             chan struct{}
@@ -120,8 +124,17 @@ func NewController(config *Config) (controller *Controller, err error) {
 		// establish will eventually signal another fetch remote.
 		signalFetchCommonRemoteServerList: make(chan struct{}),
 		signalFetchObfuscatedServerLists:  make(chan struct{}),
-		signalDownloadUpgrade:             make(chan string),
-		signalReportConnected:             make(chan struct{}),
+		// signalUploadFetchTelemetry is buffered so that fetchers need not
+		// block while an upload is in progress; the pending upload will
+		// include the telemetry of any fetch that completes meanwhile.
+		signalUploadFetchTelemetry: make(chan struct{}, 1),
+		signalDownloadUpgrade:      make(chan string),
+		signalReportConnected:      make(chan struct{}),
+		// streamedServerEntries is buffered so that the server entry stream
+		// handler, invoked by the remote server list fetcher, need not block.
+		// Server entries that don't fit are dropped; they are still stored
+		// and will be candidates in a later establishment round.
+		streamedServerEntries: make(chan *protocol.ServerEntry, 100),
 	}
 
 	controller.splitTunnelClassifier = NewSplitTunnelClassifier(config, controller)
@@ -209,6 +222,9 @@ func (controller *Controller) Run(ctx context.Context) {
 
 	if !controller.config.DisableRemoteServerListFetcher {
 
+		controller.config.SetServerEntryStreamHandler(controller.handleStreamedServerEntry)
+		defer controller.config.SetServerEntryStreamHandler(nil)
+
 		if controller.config.RemoteServerListURLs != nil {
 			controller.runWaitGroup.Add(1)
 			go controller.remoteServerListFetcher(
@@ -224,6 +240,11 @@ func (controller *Controller) Run(ctx context.Context) {
 				FetchObfuscatedServerLists,
 				controller.signalFetchObfuscatedServerLists)
 		}
+
+		if controller.config.FetchTelemetryUploadURL != "" {
+			controller.runWaitGroup.Add(1)
+			go controller.fetchTelemetryUploader()
+		}
 	}
 
 	if controller.config.UpgradeDownloadURLs != nil {
@@ -323,6 +344,10 @@ fetcherLoop:
 			continue
 		}
 
+		// legalBlockURLs are the URLs which failed, with a LegalBlockError,
+		// in this retry loop.
+		legalBlockURLs := make(map[string]bool)
+
 	retryLoop:
 		for attempt := 0; ; attempt++ {
 			// Don't attempt to fetch while there is no network connectivity,
@@ -337,23 +362,61 @@ fetcherLoop:
 			// no active tunnel, the untunneledDialConfig will be used.
 			tunnel := controller.getNextActiveTunnel()
 
-			err := fetcher(
-				controller.runCtx,
+			err := reportNewServerEntries(
 				controller.config,
-				attempt,
-				tunnel,
-				controller.untunneledDialConfig)
+				func() error {
+					return fetcher(
+						controller.runCtx,
+						controller.config,
+						attempt,
+						tunnel,
+						controller.untunneledDialConfig)
+				})
+
+			controller.signalFetchTelemetryUpload()
 
 			if err == nil {
 				lastFetchTime = monotime.Now()
 				break retryLoop
 			}
 
+			// A fetch requiring a tunnel isn't a failure when there's no
+			// tunnel. Rather than retrying, the fetch is deferred until a
+			// tunnel is registered.
+			if _, ok := err.(TunnelRequiredError); ok &&
+				controller.deferFetchUntilTunnel() {
+
+				NoticeInfo("deferring %s remote server list fetch until a tunnel is established", name)
+				break retryLoop
+			}
+
 			NoticeAlert("failed to fetch %s remote server list: %s", name, err)
 
+			// A URL blocked for legal reasons won't be unblocked by waiting,
+			// so the next attempt, which selects another mirror or transport,
+			// is made immediately. Each blocked URL skips the retry period
+			// only once, so that a fetch with all URLs blocked still waits.
+			if legalBlockErr, ok := err.(LegalBlockError); ok &&
+				!legalBlockURLs[legalBlockErr.URL] &&
+				controller.config.clientParameters.Get().Bool(
+					parameters.RemoteServerListLegalBlockFailover) {
+
+				legalBlockURLs[legalBlockErr.URL] = true
+				NoticeInfo("failing over %s remote server list fetch: %s", name, err)
+				continue
+			}
+
 			retryPeriod := controller.config.clientParameters.Get().Duration(
 				parameters.FetchRemoteServerListRetryPeriod)
 
+			// When local storage is full, retrying after the usual retry
+			// period would fail in the same way, so the retry backs off
+			// until storage may have been freed.
+			if _, ok := err.(DiskFullError); ok {
+				retryPeriod = controller.config.clientParameters.Get().Duration(
+					parameters.FetchRemoteServerListDiskFullRetryPeriod)
+			}
+
 			timer := time.NewTimer(retryPeriod)
 			select {
 			case <-timer.C:
@@ -367,6 +430,72 @@ fetcherLoop:
 	NoticeInfo("exiting %s remote server list fetcher", name)
 }
 
+// fetchTelemetryUploader uploads remote server list fetch telemetry to
+// FetchTelemetryUploadURL when signalled by the remote server list
+// fetchers. Uploads are sent through an active tunnel; when there's no
+// active tunnel, the upload fails and is retried with backoff.
+func (controller *Controller) fetchTelemetryUploader() {
+	defer controller.runWaitGroup.Done()
+
+	runFetchTelemetryUploader(
+		controller.runCtx,
+		controller.config,
+		func(_ context.Context) (*http.Client, error) {
+			tunnel := controller.getNextActiveTunnel()
+			if tunnel == nil {
+				return nil, common.ContextError(errors.New("no active tunnel"))
+			}
+			return MakeTunneledHTTPClient(controller.config, tunnel, false)
+		},
+		controller.signalUploadFetchTelemetry)
+
+	NoticeInfo("exiting fetch telemetry uploader")
+}
+
+// signalFetchTelemetryUpload signals the fetch telemetry uploader, when
+// running, without blocking.
+func (controller *Controller) signalFetchTelemetryUpload() {
+	select {
+	case controller.signalUploadFetchTelemetry <- *new(struct{}):
+	default:
+	}
+}
+
+// handleStreamedServerEntry receives server entries as they are decoded from
+// a newly downloaded remote server list and, when enabled, queues them for
+// establishCandidateGenerator, which will try them ahead of the stored server
+// entries.
+func (controller *Controller) handleStreamedServerEntry(serverEntry *protocol.ServerEntry) {
+
+	if !controller.config.clientParameters.Get().Bool(
+		parameters.EstablishStreamedServerEntries) {
+		return
+	}
+
+	select {
+	case controller.streamedServerEntries <- serverEntry:
+	default:
+	}
+}
+
+// drainStreamedServerEntries appends the server entries queued in
+// controller.streamedServerEntries to pending, without blocking. No more than
+// the channel capacity is held in pending, so the queue remains bounded;
+// server entries left in the channel are drained on a later call.
+func (controller *Controller) drainStreamedServerEntries(
+	pending []*protocol.ServerEntry) []*protocol.ServerEntry {
+
+	for len(pending) < cap(controller.streamedServerEntries) {
+		select {
+		case serverEntry := <-controller.streamedServerEntries:
+			pending = append(pending, serverEntry)
+		default:
+			return pending
+		}
+	}
+	return pending
+}
+
 // establishTunnelWatcher terminates the controller if a tunnel
 // has not been established in the configured time period. This
 // is regardless of how many tunnels are presently active -- meaning
@@ -810,6 +939,11 @@ func (controller *Controller) registerTunnel(tunnel *Tunnel) bool {
 	controller.tunnels = append(controller.tunnels, tunnel)
 	NoticeTunnels(len(controller.tunnels))
 
+	if controller.fetchDeferredUntilTunnel {
+		controller.fetchDeferredUntilTunnel = false
+		controller.signalDeferredFetches()
+	}
+
 	// Promote this successful tunnel to first rank so it's one
 	// of the first candidates next time establish runs.
 	// Connecting to a TargetServerEntry does not change the
@@ -821,6 +955,41 @@ func (controller *Controller) registerTunnel(tunnel *Tunnel) bool {
 	return true
 }
 
+// deferFetchUntilTunnel records that a remote server list fetch failed with
+// a TunnelRequiredError, so that the remote server list fetchers are
+// signalled when the next tunnel is registered. When a tunnel is already
+// active, the fetch isn't deferred and false is returned.
+func (controller *Controller) deferFetchUntilTunnel() bool {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	if len(controller.tunnels) > 0 {
+		return false
+	}
+	controller.fetchDeferredUntilTunnel = true
+	return true
+}
+
+// signalDeferredFetches signals the remote server list fetchers to resume
+// fetches deferred by deferFetchUntilTunnel. Unlike triggerFetches, the
+// signals aren't dropped when a fetcher isn't yet waiting, as the deferring
+// fetcher may not have returned to its wait; the signals are sent
+// asynchronously so that the caller doesn't block. A fetcher which already
+// fetched successfully skips the fetch; see
+// FetchRemoteServerListStalePeriod.
+func (controller *Controller) signalDeferredFetches() {
+	for _, signal := range []chan struct{}{
+		controller.signalFetchCommonRemoteServerList,
+		controller.signalFetchObfuscatedServerLists} {
+
+		go func(signal chan struct{}) {
+			select {
+			case signal <- *new(struct{}):
+			case <-controller.runCtx.Done():
+			}
+		}(signal)
+	}
+}
+
 // hasEstablishedOnce indicates if at least one active tunnel has
 // been established up to this point. This is regardeless of how many
 // tunnels are presently active.
@@ -988,10 +1157,21 @@ func (controller *Controller) triggerFetches() {
 
 	// Trigger an OSL fetch in parallel. Both fetches are run in parallel
 	// so that if one out of the common RLS and OSL set is large, it doesn't
-	// doesn't entirely block fetching the other.
-	select {
-	case controller.signalFetchObfuscatedServerLists <- *new(struct{}):
-	default:
+	// doesn't entirely block fetching the other. When
+	// FetchRemoteServerListStaggerDelay is set, the OSL fetch is triggered
+	// after the delay, so that the fetches don't start at once.
+	signalFetchObfuscatedServerLists := func() {
+		select {
+		case controller.signalFetchObfuscatedServerLists <- *new(struct{}):
+		default:
+		}
+	}
+	staggerDelay := controller.config.clientParameters.Get().Duration(
+		parameters.FetchRemoteServerListStaggerDelay)
+	if staggerDelay > 0 && controller.config.RemoteServerListURLs != nil {
+		time.AfterFunc(staggerDelay, signalFetchObfuscatedServerLists)
+	} else {
+		signalFetchObfuscatedServerLists()
 	}
 
 	// Trigger an out-of-band upgrade availability check and download.
@@ -1553,6 +1733,10 @@ func (controller *Controller) establishCandidateGenerator() {
 		close(controller.serverAffinityDoneBroadcast)
 	}
 
+	// streamedServerEntries holds the server entries drained from
+	// controller.streamedServerEntries which are yet to be tried.
+	var streamedServerEntries []*protocol.ServerEntry
+
 loop:
 	// Repeat until stopped
 	for {
@@ -1585,6 +1769,10 @@ loop:
 		roundStartTime := monotime.Now()
 		var roundNetworkWaitDuration time.Duration
 
+		// triedStreamedServerEntries records the streamed server entries
+		// tried in this round, which the iterator then skips.
+		triedStreamedServerEntries := make(map[string]bool)
+
 		// Send each iterator server entry to the establish workers
 		for {
 
@@ -1598,15 +1786,68 @@ loop:
 			roundNetworkWaitDuration += networkWaitDuration
 			totalNetworkWaitDuration += networkWaitDuration
 
-			serverEntry, err := iterator.Next()
-			if err != nil {
-				NoticeAlert("failed to get next candidate: %s", err)
-				controller.SignalComponentFailure()
-				break loop
+			// Newly fetched server entries streamed from a remote server list
+			// download are tried first, ahead of the iterator. Streamed server
+			// entries are subject to the same filter requirements as the
+			// iterator, and are never the server affinity candidate.
+			//
+			// The channel is drained, up to its capacity, on each step so that
+			// the stream handler doesn't drop server entries while earlier
+			// server entries await their turn.
+
+			streamedServerEntries = controller.drainStreamedServerEntries(
+				streamedServerEntries)
+
+			var serverEntry *protocol.ServerEntry
+			isStreamedServerEntry := false
+
+			if len(streamedServerEntries) > 0 {
+				serverEntry = streamedServerEntries[0]
+				streamedServerEntries[0] = nil
+				streamedServerEntries = streamedServerEntries[1:]
+				isStreamedServerEntry = true
 			}
-			if serverEntry == nil {
-				// Completed this iteration
-				break
+
+			if isStreamedServerEntry {
+
+				serverEntry, err = iterator.Filter(serverEntry)
+				if err != nil {
+					NoticeAlert("failed to filter streamed candidate: %s", err)
+					continue
+				}
+				if serverEntry == nil {
+					continue
+				}
+
+				// As streamed server entries are tried ahead of the iterator,
+				// drop those which support no permitted tunnel protocol rather
+				// than spend a candidate slot on them.
+				if !controller.establishLimitTunnelProtocolsState.isInitialCandidate(false, serverEntry) &&
+					!controller.establishLimitTunnelProtocolsState.isCandidate(false, serverEntry) {
+					continue
+				}
+
+				if triedStreamedServerEntries[serverEntry.IpAddress] {
+					continue
+				}
+				triedStreamedServerEntries[serverEntry.IpAddress] = true
+
+			} else {
+
+				serverEntry, err = iterator.Next()
+				if err != nil {
+					NoticeAlert("failed to get next candidate: %s", err)
+					controller.SignalComponentFailure()
+					break loop
+				}
+				if serverEntry == nil {
+					// Completed this iteration
+					break
+				}
+
+				if triedStreamedServerEntries[serverEntry.IpAddress] {
+					continue
+				}
 			}
 
 			if controller.config.TargetApiProtocol == protocol.PSIPHON_SSH_API_PROTOCOL &&
@@ -1620,15 +1861,17 @@ loop:
 
 			candidate := &candidateServerEntry{
 				serverEntry:                serverEntry,
-				isServerAffinityCandidate:  isServerAffinityCandidate,
+				isServerAffinityCandidate:  isServerAffinityCandidate && !isStreamedServerEntry,
 				adjustedEstablishStartTime: adjustedEstablishStartTime,
 			}
 
-			wasServerAffinityCandidate := isServerAffinityCandidate
+			wasServerAffinityCandidate := candidate.isServerAffinityCandidate
 
 			// Note: there must be only one server affinity candidate, as it
 			// closes the serverAffinityDoneBroadcast channel.
-			isServerAffinityCandidate = false
+			if !isStreamedServerEntry {
+				isServerAffinityCandidate = false
+			}
 
 			// TODO: here we could generate multiple candidates from the
 			// server entry when there are many MeekFrontingAddresses.
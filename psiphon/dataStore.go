@@ -21,13 +21,21 @@ package psiphon
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 )
@@ -42,14 +50,36 @@ var (
 	datastoreSLOKsBucket                        = []byte("SLOKs")
 	datastoreTacticsBucket                      = []byte("tactics")
 	datastoreSpeedTestSamplesBucket             = []byte("speedTestSamples")
+	datastoreOSLQuarantineBucket                = []byte("oslQuarantine")
+	datastoreServerEntryProvenanceBucket        = []byte("serverEntryProvenance")
+	datastoreUrlValidatedTimesBucket            = []byte("urlValidatedTimes")
+	datastoreUrlNextFetchTimesBucket            = []byte("urlNextFetchTimes")
+	datastoreOSLPendingImportBucket             = []byte("oslPendingImport")
+	datastoreServerEntryImportJournalBucket     = []byte("serverEntryImportJournal")
+	datastoreServerEntryReachabilityBucket      = []byte("serverEntryReachability")
+	datastoreOSLFetchFingerprintsBucket         = []byte("oslFetchFingerprints")
+	datastoreOSLFetchPlansBucket                = []byte("oslFetchPlans")
+	datastoreOSLDownloadAttemptsBucket          = []byte("oslDownloadAttempts")
+	datastoreOSLImportTimesBucket               = []byte("oslImportTimes")
+	datastoreOSLRegistryGenerationsBucket       = []byte("oslRegistryGenerations")
+	datastoreOSLRegistryFetchTimesBucket        = []byte("oslRegistryFetchTimes")
+	datastoreOSLRegistryDeltaProgressBucket     = []byte("oslRegistryDeltaProgress")
+	datastoreOSLImportGenerationsBucket         = []byte("oslImportGenerations")
+	datastoreImportedContentDigestsBucket       = []byte("importedContentDigests")
+	datastoreOSLImportedMD5SumsBucket           = []byte("oslImportedMD5Sums")
 	datastoreLastConnectedKey                   = "lastConnected"
+	datastoreServerEntryRevocationListKey       = "serverEntryRevocationList"
+	datastoreConfigOverridesKey                 = "configOverrides"
 	datastoreLastServerEntryFilterKey           = []byte("lastServerEntryFilter")
 	datastoreAffinityServerEntryIDKey           = []byte("affinityServerEntryID")
+	datastoreCompactionChurnKey                 = []byte("compactionChurn")
 	datastorePersistentStatTypeRemoteServerList = string(datastoreRemoteServerListStatsBucket)
 	datastoreServerEntryFetchGCThreshold        = 20
 
-	datastoreMutex    sync.RWMutex
-	activeDatastoreDB *datastoreDB
+	datastoreMutex     sync.RWMutex
+	activeDatastoreDB  *datastoreDB
+	datastoreLockRetry datastoreLockRetryPolicy
+	datastoreConfig    *Config
 )
 
 // OpenDataStore opens and initializes the singleton data store instance.
@@ -71,11 +101,64 @@ func OpenDataStore(config *Config) error {
 	}
 
 	activeDatastoreDB = newDB
+	datastoreLockRetry = newDatastoreLockRetryPolicy(config)
+	datastoreConfig = config
 
 	datastoreMutex.Unlock()
 
 	_ = resetAllPersistentStatsToUnreported()
 
+	// Any import journal records remaining at this point belong to imports
+	// which were interrupted, for example by a crash or process kill, before
+	// completing. Roll back these incomplete imports so that the datastore
+	// doesn't retain a partially written server list.
+	err = rollbackServerEntryImports(nil)
+	if err != nil {
+		NoticeAlert("failed to roll back incomplete imports: %s", common.ContextError(err))
+		// Continue, since this is not fatal
+	}
+
+	err = deleteOrphanedServerEntryRecords()
+	if err != nil {
+		NoticeAlert("failed to delete orphaned server entry records: %s", common.ContextError(err))
+		// Continue, since this is not fatal
+	}
+
+	err = applyStoredConfigOverrides(config)
+	if err != nil {
+		NoticeAlert("failed to apply stored config overrides: %s", common.ContextError(err))
+		// Continue, since this is not fatal
+	}
+
+	return nil
+}
+
+// storeConfigOverrides stores the config overrides most recently applied by
+// Config.ApplyConfigOverrides.
+func storeConfigOverrides(configOverridesJSON []byte) error {
+	err := SetKeyValue(datastoreConfigOverridesKey, string(configOverridesJSON))
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// applyStoredConfigOverrides reapplies any config overrides stored by
+// storeConfigOverrides.
+func applyStoredConfigOverrides(config *Config) error {
+
+	configOverridesJSON, err := GetKeyValue(datastoreConfigOverridesKey)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	if configOverridesJSON == "" {
+		return nil
+	}
+
+	err = config.applyStoredConfigOverrides([]byte(configOverridesJSON))
+	if err != nil {
+		return common.ContextError(err)
+	}
 	return nil
 }
 
@@ -97,6 +180,20 @@ func CloseDataStore() {
 	activeDatastoreDB = nil
 }
 
+// datastoreNow returns the current time from the Clock of the config with
+// which the datastore was opened; see Config.now.
+func datastoreNow() time.Time {
+
+	datastoreMutex.RLock()
+	config := datastoreConfig
+	datastoreMutex.RUnlock()
+
+	if config == nil {
+		return time.Now()
+	}
+	return config.now()
+}
+
 func datastoreView(fn func(tx *datastoreTx) error) error {
 
 	datastoreMutex.RLock()
@@ -113,6 +210,8 @@ func datastoreView(fn func(tx *datastoreTx) error) error {
 	return err
 }
 
+// datastoreUpdate runs fn in an update transaction. A datastoreLockedError
+// is returned unwrapped, so that callers may check the error type.
 func datastoreUpdate(fn func(tx *datastoreTx) error) error {
 
 	datastoreMutex.RLock()
@@ -122,654 +221,3150 @@ func datastoreUpdate(fn func(tx *datastoreTx) error) error {
 		return common.ContextError(errors.New("database not open"))
 	}
 
-	err := activeDatastoreDB.update(fn)
+	err := datastoreUpdateDB(activeDatastoreDB, fn)
+	if _, ok := err.(datastoreLockedError); ok {
+		return err
+	}
 	if err != nil {
 		err = common.ContextError(err)
 	}
 	return err
 }
 
-// StoreServerEntry adds the server entry to the data store.
-//
-// When a server entry already exists for a given server, it will be
-// replaced only if replaceIfExists is set or if the the ConfigurationVersion
-// field of the new entry is strictly higher than the existing entry.
-//
-// If the server entry data is malformed, an alert notice is issued and
-// the entry is skipped; no error is returned.
-func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExists bool) error {
-
-	// Server entries should already be validated before this point,
-	// so instead of skipping we fail with an error.
-	err := protocol.ValidateServerEntryFields(serverEntryFields)
-	if err != nil {
-		return common.ContextError(
-			fmt.Errorf("invalid server entry: %s", err))
-	}
-
-	// BoltDB implementation note:
-	// For simplicity, we don't maintain indexes on server entry
-	// region or supported protocols. Instead, we perform full-bucket
-	// scans with a filter. With a small enough database (thousands or
-	// even tens of thousand of server entries) and common enough
-	// values (e.g., many servers support all protocols), performance
-	// is expected to be acceptable.
-
-	err = datastoreUpdate(func(tx *datastoreTx) error {
-
-		serverEntries := tx.bucket(datastoreServerEntriesBucket)
+// datastoreUpdateDB runs fn in an update transaction of db. It's a variable
+// so that tests may simulate a temporarily locked datastore.
+var datastoreUpdateDB = func(db *datastoreDB, fn func(tx *datastoreTx) error) error {
+	return db.update(fn)
+}
 
-		ipAddress := serverEntryFields.GetIPAddress()
+// datastoreLockedError is returned by an update transaction which failed
+// because the datastore is temporarily locked, for example by a conflicting
+// concurrent transaction. Unlike other datastore errors, the transaction may
+// succeed when retried. Only the Badger datastore returns
+// datastoreLockedError; bolt and FILES_DB update transactions wait for
+// concurrent transactions rather than fail.
+type datastoreLockedError struct {
+	err error
+}
 
-		// Check not only that the entry exists, but is valid. This
-		// will replace in the rare case where the data is corrupt.
-		existingConfigurationVersion := -1
-		existingData := serverEntries.get([]byte(ipAddress))
-		if existingData != nil {
-			var existingServerEntry *protocol.ServerEntry
-			err := json.Unmarshal(existingData, &existingServerEntry)
-			if err == nil {
-				existingConfigurationVersion = existingServerEntry.ConfigurationVersion
-			}
-		}
+func (e datastoreLockedError) Error() string {
+	return fmt.Sprintf("datastore locked: %s", e.err)
+}
 
-		exists := existingConfigurationVersion > -1
-		newer := exists && existingConfigurationVersion < serverEntryFields.GetConfigurationVersion()
-		update := !exists || replaceIfExists || newer
+// datastoreLockRetryPolicy is the retry policy applied by
+// datastoreUpdateWithRetry, from DataStoreLockedRetryAttempts,
+// DataStoreLockedRetryBackoff, and DataStoreLockedRetryMaxBackoff.
+type datastoreLockRetryPolicy struct {
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
 
-		if !update {
-			// Disabling this notice, for now, as it generates too much noise
-			// in diagnostics with clients that always submit embedded servers
-			// to the core on each run.
-			// NoticeInfo("ignored update for server %s", serverEntry.IpAddress)
-			return nil
-		}
+// newDatastoreLockRetryPolicy returns the retry policy specified by the
+// config parameters. A config which isn't committed, and has no parameters,
+// specifies the default policy.
+func newDatastoreLockRetryPolicy(config *Config) datastoreLockRetryPolicy {
 
-		data, err := json.Marshal(serverEntryFields)
+	clientParameters := config.clientParameters
+	if clientParameters == nil {
+		var err error
+		clientParameters, err = parameters.NewClientParameters(nil)
 		if err != nil {
-			return common.ContextError(err)
-		}
-		err = serverEntries.put([]byte(ipAddress), data)
-		if err != nil {
-			return common.ContextError(err)
+			NoticeAlert("failed to get datastore lock retry parameters: %s", common.ContextError(err))
+			return datastoreLockRetryPolicy{}
 		}
+	}
 
-		NoticeInfo("updated server %s", ipAddress)
-
-		return nil
-	})
-	if err != nil {
-		return common.ContextError(err)
+	p := clientParameters.Get()
+	policy := datastoreLockRetryPolicy{
+		attempts:   p.Int(parameters.DataStoreLockedRetryAttempts),
+		backoff:    p.Duration(parameters.DataStoreLockedRetryBackoff),
+		maxBackoff: p.Duration(parameters.DataStoreLockedRetryMaxBackoff),
 	}
+	p = nil
 
-	return nil
+	return policy
 }
 
-// StoreServerEntries stores a list of server entries.
-// There is an independent transaction for each entry insert/update.
-func StoreServerEntries(
-	config *Config,
-	serverEntries []protocol.ServerEntryFields,
-	replaceIfExists bool) error {
+// datastoreUpdateWithRetry is datastoreUpdate, retrying the transaction when
+// it fails with a datastoreLockedError, up to DataStoreLockedRetryAttempts
+// times. The backoff before each retry starts at DataStoreLockedRetryBackoff
+// and doubles, up to DataStoreLockedRetryMaxBackoff. Other errors are
+// permanent and are returned immediately.
+//
+// fn may be invoked more than once. A failed transaction is rolled back,
+// so fn must not retain state from a failed invocation.
+func datastoreUpdateWithRetry(fn func(tx *datastoreTx) error) error {
 
-	for _, serverEntryFields := range serverEntries {
-		err := StoreServerEntry(serverEntryFields, replaceIfExists)
-		if err != nil {
-			return common.ContextError(err)
-		}
-	}
+	datastoreMutex.RLock()
+	policy := datastoreLockRetry
+	datastoreMutex.RUnlock()
 
-	return nil
-}
+	backoff := policy.backoff
 
-// StreamingStoreServerEntries stores a list of server entries.
-// There is an independent transaction for each entry insert/update.
-func StreamingStoreServerEntries(
-	config *Config,
-	serverEntries *protocol.StreamingServerEntryDecoder,
-	replaceIfExists bool) error {
+	for attempt := 0; ; attempt++ {
 
-	// Note: both StreamingServerEntryDecoder.Next and StoreServerEntry
-	// allocate temporary memory buffers for hex/JSON decoding/encoding,
-	// so this isn't true constant-memory streaming (it depends on garbage
-	// collection).
+		err := datastoreUpdate(fn)
 
-	n := 0
-	for {
-		serverEntry, err := serverEntries.Next()
-		if err != nil {
-			return common.ContextError(err)
+		_, locked := err.(datastoreLockedError)
+		if !locked || attempt >= policy.attempts {
+			if err != nil {
+				return common.ContextError(err)
+			}
+			return nil
 		}
 
-		if serverEntry == nil {
-			// No more server entries
-			break
-		}
+		NoticeInfo("datastore locked, retry %d in %s: %s", attempt+1, backoff, err)
 
-		err = StoreServerEntry(serverEntry, replaceIfExists)
-		if err != nil {
-			return common.ContextError(err)
-		}
+		time.Sleep(backoff)
 
-		n += 1
-		if n == datastoreServerEntryFetchGCThreshold {
-			DoGarbageCollection()
-			n = 0
+		backoff *= 2
+		if backoff > policy.maxBackoff {
+			backoff = policy.maxBackoff
 		}
 	}
-
-	return nil
 }
 
-// PromoteServerEntry sets the server affinity server entry ID to the
-// specified server entry IP address.
-func PromoteServerEntry(config *Config, ipAddress string) error {
-	err := datastoreUpdate(func(tx *datastoreTx) error {
-
-		serverEntryID := []byte(ipAddress)
-
-		// Ensure the corresponding server entry exists before
-		// setting server affinity.
-		bucket := tx.bucket(datastoreServerEntriesBucket)
-		data := bucket.get(serverEntryID)
-		if data == nil {
-			NoticeAlert(
-				"PromoteServerEntry: ignoring unknown server entry: %s",
-				ipAddress)
-			return nil
-		}
-
-		bucket = tx.bucket(datastoreKeyValueBucket)
-		err := bucket.put(datastoreAffinityServerEntryIDKey, serverEntryID)
-		if err != nil {
-			return err
-		}
-
-		// Store the current server entry filter (e.g, region, etc.) that
-		// was in use when the entry was promoted. This is used to detect
-		// when the top ranked server entry was promoted under a different
-		// filter.
+// compactDataStore compacts the datastore when DataStoreCompaction is set
+// and the churn, the number of server entries written by imports and
+// deleted since the last compaction, is at least
+// DataStoreCompactionMinimumChurn. Compaction is a no-op for datastores
+// which don't support it, and the churn is then retained.
+//
+// All datastore transactions are blocked while the datastore is compacted.
+// Compaction failures aren't fatal and are reported in notices.
+func compactDataStore(config *Config) {
 
-		currentFilter, err := makeServerEntryFilterValue(config)
-		if err != nil {
-			return err
-		}
+	p := config.clientParameters.Get()
+	enabled := p.Bool(parameters.DataStoreCompaction)
+	minimumChurn := p.Int(parameters.DataStoreCompactionMinimumChurn)
+	p = nil
 
-		return bucket.put(datastoreLastServerEntryFilterKey, currentFilter)
-	})
+	if !enabled {
+		return
+	}
 
+	churn, err := getDataStoreChurn()
 	if err != nil {
-		return common.ContextError(err)
+		NoticeAlert("failed to get datastore churn: %s", common.ContextError(err))
+		return
 	}
-	return nil
-}
 
-func makeServerEntryFilterValue(config *Config) ([]byte, error) {
+	if churn < minimumChurn {
+		return
+	}
 
-	// Currently, only a change of EgressRegion will "break" server affinity.
-	// If the tunnel protocol filter changes, any existing affinity server
-	// either passes the new filter, or it will be skipped anyway.
+	startTime := time.Now()
 
-	return []byte(config.EgressRegion), nil
-}
+	compacted, err := func() (bool, error) {
+		datastoreMutex.Lock()
+		defer datastoreMutex.Unlock()
 
-func hasServerEntryFilterChanged(config *Config) (bool, error) {
+		if activeDatastoreDB == nil {
+			return false, common.ContextError(errors.New("database not open"))
+		}
 
-	currentFilter, err := makeServerEntryFilterValue(config)
+		return activeDatastoreDB.compact()
+	}()
 	if err != nil {
-		return false, common.ContextError(err)
+		NoticeAlert("failed to compact datastore: %s", common.ContextError(err))
+		return
 	}
 
-	changed := false
-	err = datastoreView(func(tx *datastoreTx) error {
+	if !compacted {
+		return
+	}
 
-		// previousFilter will be nil not found (not previously
-		// set) which will never match any current filter.
+	elapsedTime := time.Since(startTime)
 
-		bucket := tx.bucket(datastoreKeyValueBucket)
-		previousFilter := bucket.get(datastoreLastServerEntryFilterKey)
-		if bytes.Compare(previousFilter, currentFilter) != 0 {
-			changed = true
-		}
-		return nil
+	// Churn added while compacting, by a concurrent import, is retained.
+	err = datastoreUpdate(func(tx *datastoreTx) error {
+		return addDataStoreChurn(tx, -churn)
 	})
 	if err != nil {
-		return false, common.ContextError(err)
+		NoticeAlert("failed to reset datastore churn: %s", common.ContextError(err))
 	}
 
-	return changed, nil
-}
-
-// ServerEntryIterator is used to iterate over
-// stored server entries in rank order.
-type ServerEntryIterator struct {
-	config                       *Config
-	applyServerAffinity          bool
-	serverEntryIDs               [][]byte
-	serverEntryIndex             int
-	isTacticsServerEntryIterator bool
-	isTargetServerEntryIterator  bool
-	hasNextTargetServerEntry     bool
-	targetServerEntry            *protocol.ServerEntry
+	NoticeDataStoreCompacted(churn, int64(elapsedTime/time.Millisecond))
 }
 
-// NewServerEntryIterator creates a new ServerEntryIterator.
-//
-// The boolean return value indicates whether to treat the first server(s)
-// as affinity servers or not. When the server entry selection filter changes
-// such as from a specific region to any region, or when there was no previous
-// filter/iterator, the the first server(s) are arbitrary and should not be
-// given affinity treatment.
-//
-// NewServerEntryIterator and any returned ServerEntryIterator are not
-// designed for concurrent use as not all related datastore operations are
-// performed in a single transaction.
-//
-func NewServerEntryIterator(config *Config) (bool, *ServerEntryIterator, error) {
+// addDataStoreChurn adds count to the datastore churn, in the transaction
+// which writes or deletes the churned server entries.
+func addDataStoreChurn(tx *datastoreTx, count int) error {
 
-	// When configured, this target server entry is the only candidate
-	if config.TargetServerEntry != "" {
-		return newTargetServerEntryIterator(config, false)
+	if count == 0 {
+		return nil
 	}
 
-	filterChanged, err := hasServerEntryFilterChanged(config)
-	if err != nil {
-		return false, nil, common.ContextError(err)
-	}
+	bucket := tx.bucket(datastoreKeyValueBucket)
 
-	applyServerAffinity := !filterChanged
+	churn := 0
+	value := bucket.get(datastoreCompactionChurnKey)
+	if value != nil {
+		var err error
+		churn, err = strconv.Atoi(string(value))
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
 
-	iterator := &ServerEntryIterator{
-		config:              config,
-		applyServerAffinity: applyServerAffinity,
+	churn += count
+	if churn < 0 {
+		churn = 0
 	}
 
-	err = iterator.Reset()
+	err := bucket.put(datastoreCompactionChurnKey, []byte(strconv.Itoa(churn)))
 	if err != nil {
-		return false, nil, common.ContextError(err)
+		return common.ContextError(err)
 	}
 
-	return applyServerAffinity, iterator, nil
+	return nil
 }
 
-func NewTacticsServerEntryIterator(config *Config) (*ServerEntryIterator, error) {
-
-	// When configured, this target server entry is the only candidate
-	if config.TargetServerEntry != "" {
-		_, iterator, err := newTargetServerEntryIterator(config, true)
-		return iterator, err
-	}
+// getDataStoreChurn returns the datastore churn since the last compaction.
+func getDataStoreChurn() (int, error) {
 
-	iterator := &ServerEntryIterator{
-		isTacticsServerEntryIterator: true,
-	}
+	churn := 0
 
-	err := iterator.Reset()
+	err := datastoreView(func(tx *datastoreTx) error {
+		value := tx.bucket(datastoreKeyValueBucket).get(datastoreCompactionChurnKey)
+		if value == nil {
+			return nil
+		}
+		var err error
+		churn, err = strconv.Atoi(string(value))
+		return err
+	})
 	if err != nil {
-		return nil, common.ContextError(err)
+		return 0, common.ContextError(err)
 	}
 
-	return iterator, nil
+	return churn, nil
 }
 
-// newTargetServerEntryIterator is a helper for initializing the TargetServerEntry case
-func newTargetServerEntryIterator(config *Config, isTactics bool) (bool, *ServerEntryIterator, error) {
+// StoreServerEntry adds the server entry to the data store.
+//
+// When a server entry already exists for a given server, it will be
+// replaced only if replaceIfExists is set or if the the ConfigurationVersion
+// field of the new entry is strictly higher than the existing entry.
+//
+// If the server entry data is malformed, an alert notice is issued and
+// the entry is skipped; no error is returned.
+func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExists bool) error {
+	_, err := storeServerEntry(serverEntryFields, replaceIfExists, nil, true, nil)
+	return err
+}
 
-	serverEntry, err := protocol.DecodeServerEntry(
-		config.TargetServerEntry, common.GetCurrentTimestamp(), protocol.SERVER_ENTRY_SOURCE_TARGET)
+// ServerEntryProvenance records where a stored server entry was obtained.
+// URL is the URL the server entry was downloaded from and OSLID is the hex
+// encoded ID of the OSL which contained the server entry, when applicable.
+// FetchTimestamp is the RFC3339 time the server entry was fetched.
+// TrustTier is the trust tier of the signing key which validated the server
+// entry; when blank, the trust tier is SERVER_ENTRY_TRUST_TIER_HIGH.
+// SelectionWeight is the import-time selection weight of the server entry,
+// from the OSL file spec SelectionWeight, which a server entry selector may
+// use to prefer the server entry; 0 indicates no preference.
+type ServerEntryProvenance struct {
+	Source          string
+	URL             string `json:",omitempty"`
+	OSLID           string `json:",omitempty"`
+	FetchTimestamp  string
+	TrustTier       string `json:",omitempty"`
+	SelectionWeight int    `json:",omitempty"`
+}
+
+// storeServerEntry is StoreServerEntry with optional provenance. Whenever the
+// stored server entry is updated, its provenance is replaced with the input
+// provenance or, when the input provenance is nil, deleted. The return value
+// indicates whether the stored server entry was updated. noticeUpdated
+// specifies whether to emit an Info notice for the update. When journal is
+// not nil, the prior state of an updated server entry is recorded in the
+// journal, in the same transaction as the update.
+func storeServerEntry(
+	serverEntryFields protocol.ServerEntryFields,
+	replaceIfExists bool,
+	provenance *ServerEntryProvenance,
+	noticeUpdated bool,
+	journal *serverEntryImportJournal) (bool, error) {
+
+	updated := false
+
+	// BoltDB implementation note:
+	// For simplicity, we don't maintain indexes on server entry
+	// region or supported protocols. Instead, we perform full-bucket
+	// scans with a filter. With a small enough database (thousands or
+	// even tens of thousand of server entries) and common enough
+	// values (e.g., many servers support all protocols), performance
+	// is expected to be acceptable.
+
+	// The transaction may be retried when the datastore is locked. Any
+	// journal record stored by a failed transaction is rolled back, so the
+	// journal state is restored before each attempt.
+	var restoreJournal func()
+	if journal != nil {
+		restoreJournal = journal.checkpoint(serverEntryFields.GetIPAddress())
+	}
+
+	err := datastoreUpdateWithRetry(func(tx *datastoreTx) error {
+		if restoreJournal != nil {
+			restoreJournal()
+		}
+		var err error
+		updated, err = storeServerEntryInTx(
+			tx, serverEntryFields, replaceIfExists, provenance, noticeUpdated, journal)
+		return err
+	})
 	if err != nil {
-		return false, nil, common.ContextError(err)
+		return false, common.ContextError(err)
 	}
 
-	if isTactics {
+	return updated, nil
+}
 
-		if len(serverEntry.GetSupportedTacticsProtocols()) == 0 {
-			return false, nil, common.ContextError(errors.New("TargetServerEntry does not support tactics protocols"))
+// storeServerEntryInTx is storeServerEntry within the existing transaction
+// tx.
+func storeServerEntryInTx(
+	tx *datastoreTx,
+	serverEntryFields protocol.ServerEntryFields,
+	replaceIfExists bool,
+	provenance *ServerEntryProvenance,
+	noticeUpdated bool,
+	journal *serverEntryImportJournal) (bool, error) {
+
+	// Server entries should already be validated before this point,
+	// so instead of skipping we fail with an error.
+	err := protocol.ValidateServerEntryFields(serverEntryFields)
+	if err != nil {
+		return false, common.ContextError(
+			fmt.Errorf("invalid server entry: %s", err))
+	}
+
+	serverEntries := tx.bucket(datastoreServerEntriesBucket)
+
+	ipAddress := serverEntryFields.GetIPAddress()
+
+	// Check not only that the entry exists, but is valid. This
+	// will replace in the rare case where the data is corrupt.
+	existingConfigurationVersion := -1
+	existingData := serverEntries.get([]byte(ipAddress))
+	if existingData != nil {
+		var existingServerEntry *protocol.ServerEntry
+		err := json.Unmarshal(existingData, &existingServerEntry)
+		if err == nil {
+			existingConfigurationVersion = existingServerEntry.ConfigurationVersion
 		}
+	}
 
-	} else {
+	exists := existingConfigurationVersion > -1
+	newer := exists && existingConfigurationVersion < serverEntryFields.GetConfigurationVersion()
+	update := !exists || replaceIfExists || newer
 
-		if config.EgressRegion != "" && serverEntry.Region != config.EgressRegion {
-			return false, nil, common.ContextError(errors.New("TargetServerEntry does not support EgressRegion"))
+	if !update {
+		// Disabling this notice, for now, as it generates too much noise
+		// in diagnostics with clients that always submit embedded servers
+		// to the core on each run.
+		// NoticeInfo("ignored update for server %s", serverEntry.IpAddress)
+		return false, nil
+	}
+
+	provenanceBucket := tx.bucket(datastoreServerEntryProvenanceBucket)
+
+	if journal != nil {
+		err := journal.record(
+			tx,
+			ipAddress,
+			existingData,
+			provenanceBucket.get([]byte(ipAddress)))
+		if err != nil {
+			return false, common.ContextError(err)
 		}
+	}
 
-		limitTunnelProtocols := config.clientParameters.Get().TunnelProtocols(parameters.LimitTunnelProtocols)
-		if len(limitTunnelProtocols) > 0 {
-			// At the ServerEntryIterator level, only limitTunnelProtocols is applied;
-			// excludeIntensive is handled higher up.
-			if len(serverEntry.GetSupportedProtocols(
-				config.UseUpstreamProxy(), limitTunnelProtocols, false)) == 0 {
-				return false, nil, common.ContextError(errors.New("TargetServerEntry does not support LimitTunnelProtocols"))
-			}
+	data, err := json.Marshal(serverEntryFields)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+	err = serverEntries.put([]byte(ipAddress), data)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	if provenance != nil {
+		provenanceData, err := json.Marshal(provenance)
+		if err != nil {
+			return false, common.ContextError(err)
+		}
+		err = provenanceBucket.put([]byte(ipAddress), provenanceData)
+		if err != nil {
+			return false, common.ContextError(err)
+		}
+	} else {
+		err = provenanceBucket.delete([]byte(ipAddress))
+		if err != nil {
+			return false, common.ContextError(err)
 		}
 	}
 
-	iterator := &ServerEntryIterator{
-		isTacticsServerEntryIterator: isTactics,
-		isTargetServerEntryIterator:  true,
-		hasNextTargetServerEntry:     true,
-		targetServerEntry:            serverEntry,
+	if noticeUpdated {
+		NoticeInfo("updated server %s", ipAddress)
 	}
 
-	NoticeInfo("using TargetServerEntry: %s", serverEntry.IpAddress)
+	return true, nil
+}
 
-	return false, iterator, nil
+// StoreServerEntries stores a list of server entries.
+// There is an independent transaction for each entry insert/update. The
+// import is journaled: if any entry fails to store, all entries updated by
+// the import are rolled back to their prior state.
+// When VerifyImportedServerEntries is set, a sample of the stored entries
+// is read back and a DataStoreIntegrityError is returned if any write did
+// not persist. Server entries not permitted by the config
+// ServerEntryIPAllowlist and ServerEntryIPBlocklist, or with a timestamp
+// beyond ServerEntryMaxTimestampSkew, are dropped. The stored entries are
+// delivered to any config ServerEntrySink once the import is committed.
+// Concurrent imports are limited by ServerEntryImportMaxWriters. Each entry
+// write is retried when the datastore is temporarily locked; see
+// datastoreUpdateWithRetry. When ServerEntryImportAtomic is set, all entries
+// are instead stored in a single transaction; see serverEntryImportJournal.
+func StoreServerEntries(
+	config *Config,
+	serverEntries []protocol.ServerEntryFields,
+	replaceIfExists bool) error {
+
+	_, err := storeServerEntries(config, serverEntries, replaceIfExists)
+	return err
 }
 
-// Reset a NewServerEntryIterator to the start of its cycle. The next
-// call to Next will return the first server entry.
-func (iterator *ServerEntryIterator) Reset() error {
-	iterator.Close()
+// storeServerEntries performs StoreServerEntries and returns the number of
+// new server entries, which were not already stored, imported. Existence is
+// checked by server entry IP address before each insert, and a server entry
+// listed more than once is counted once. The count is valid only when no
+// error is returned.
+func storeServerEntries(
+	config *Config,
+	serverEntries []protocol.ServerEntryFields,
+	replaceIfExists bool) (int, error) {
+
+	release := serverEntryImportWriters.acquire(config)
+	defer release()
+
+	verifier := newServerEntryImportVerifier(config)
+
+	journal, err := newServerEntryImportJournalForConfig(config)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	sinkQueue := newServerEntrySinkQueue(config)
+
+	timestampFilter := newServerEntryTimestampFilter(config)
+
+	clientVersionFilter := newServerEntryClientVersionFilter(config)
+
+	droppedCount := 0
+
+	err = journal.run(func(store serverEntryImportStoreFunc) error {
+
+		for _, serverEntryFields := range serverEntries {
+
+			if !config.serverEntryIPFilter.permits(serverEntryFields.GetIPAddress()) {
+				droppedCount += 1
+				continue
+			}
+
+			if !timestampFilter.permits(serverEntryFields) {
+				continue
+			}
+
+			if !clientVersionFilter.permits(serverEntryFields) {
+				continue
+			}
+
+			created := journal.created
+
+			updated, err := store(serverEntryFields, replaceIfExists, nil, true)
+			if err != nil {
+				return common.ContextError(err)
+			}
+			if updated {
+				verifier.add(serverEntryFields)
+				sinkQueue.add(serverEntryFields, journal.created > created)
+			}
+		}
 
-	if iterator.isTargetServerEntryIterator {
-		iterator.hasNextTargetServerEntry = true
 		return nil
+	})
+	if err != nil {
+		return 0, common.ContextError(journal.rollback(err))
 	}
 
-	// BoltDB implementation note:
-	// We don't keep a transaction open for the duration of the iterator
-	// because this would expose the following semantics to consumer code:
-	//
-	//     Read-only transactions and read-write transactions ... generally
-	//     shouldn't be opened simultaneously in the same goroutine. This can
-	//     cause a deadlock as the read-write transaction needs to periodically
-	//     re-map the data file but it cannot do so while a read-only
-	//     transaction is open.
-	//     (https://github.com/boltdb/bolt)
-	//
-	// So the underlying serverEntriesBucket could change after the serverEntryIDs
-	// list is built.
+	err = journal.commit()
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
 
-	var serverEntryIDs [][]byte
+	release()
 
-	err := datastoreView(func(tx *datastoreTx) error {
+	sinkQueue.deliver()
 
-		bucket := tx.bucket(datastoreKeyValueBucket)
+	if droppedCount > 0 {
+		NoticeServerEntriesDroppedByIPPolicy(droppedCount)
+	}
 
-		serverEntryIDs = make([][]byte, 0)
-		shuffleHead := 0
+	timestampFilter.notice()
 
-		var affinityServerEntryID []byte
-		if iterator.applyServerAffinity {
-			affinityServerEntryID = bucket.get(datastoreAffinityServerEntryIDKey)
-			if affinityServerEntryID != nil {
-				serverEntryIDs = append(serverEntryIDs, append([]byte(nil), affinityServerEntryID...))
-				shuffleHead = 1
+	clientVersionFilter.notice()
+
+	// A DataStoreIntegrityError is returned unwrapped, so that callers may
+	// check the error type.
+	return journal.created, verifier.verify()
+}
+
+// StreamingStoreServerEntries stores a list of server entries.
+// There is an independent transaction for each entry insert/update.
+// Stored entries are filtered, journaled, verified, and delivered to any
+// ServerEntrySink, and concurrent imports are limited, as in
+// StoreServerEntries. When serverEntries fails with a
+// common.ChunkVerificationError, the server entries read from verified
+// chunks are kept and the error is returned unwrapped.
+func StreamingStoreServerEntries(
+	config *Config,
+	serverEntries *protocol.StreamingServerEntryDecoder,
+	replaceIfExists bool) error {
+
+	return StreamingStoreServerEntriesWithProvenance(
+		config, serverEntries, replaceIfExists, nil)
+}
+
+// StreamingStoreServerEntriesWithProvenance is StreamingStoreServerEntries
+// with provenance, which is recorded for each stored server entry. The
+// provenance may be retrieved with GetServerEntryProvenance.
+func StreamingStoreServerEntriesWithProvenance(
+	config *Config,
+	serverEntries *protocol.StreamingServerEntryDecoder,
+	replaceIfExists bool,
+	provenance *ServerEntryProvenance) error {
+
+	_, err := streamingStoreServerEntries(
+		context.Background(), config, serverEntries, replaceIfExists, provenance, nil)
+	return err
+}
+
+// streamingStoreServerEntries performs
+// StreamingStoreServerEntriesWithProvenance and returns the number of new
+// server entries, which were not already stored, imported, counted as in
+// storeServerEntries. The count is valid only when no error, other than a
+// common.ChunkVerificationError, is returned.
+//
+// When ctx is cancelled, as when a fetch is cancelled part way through its
+// import, no further server entry transactions are started: any transaction
+// in progress completes, the import is rolled back, and the context error is
+// returned. The import is also abandoned when ctx is cancelled while waiting
+// for a ServerEntryImportMaxWriters slot.
+//
+// When serverEntries fails with a common.ChunkVerificationError, as when a
+// chunked package is tampered with part way through, the server entries read
+// from the preceding, verified chunks are committed rather than rolled back,
+// and the error is returned along with the number of new server entries.
+//
+// newServerEntry, when not nil, is called with each new server entry.
+func streamingStoreServerEntries(
+	ctx context.Context,
+	config *Config,
+	serverEntries *protocol.StreamingServerEntryDecoder,
+	replaceIfExists bool,
+	provenance *ServerEntryProvenance,
+	newServerEntry func(protocol.ServerEntryFields)) (int, error) {
+
+	// Note: both StreamingServerEntryDecoder.Next and StoreServerEntry
+	// allocate temporary memory buffers for hex/JSON decoding/encoding,
+	// so this isn't true constant-memory streaming (it depends on garbage
+	// collection).
+
+	release, err := serverEntryImportWriters.acquireContext(ctx, config)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+	defer release()
+
+	verifier := newServerEntryImportVerifier(config)
+
+	// Server entries with provenance are imported by remote server list
+	// fetches, which may store many entries; their per-entry notices are
+	// subject to RemoteServerListNoticeMinimumSeverity.
+	noticeUpdated := provenance == nil ||
+		config.emitRemoteServerListNotice(noticeSeverityInfo)
+
+	journal, err := newServerEntryImportJournalForConfig(config)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	sinkQueue := newServerEntrySinkQueue(config)
+
+	timestampFilter := newServerEntryTimestampFilter(config)
+
+	clientVersionFilter := newServerEntryClientVersionFilter(config)
+
+	droppedCount := 0
+
+	var chunkVerificationErr error
+
+	err = journal.run(func(store serverEntryImportStoreFunc) error {
+
+		n := 0
+		for {
+			serverEntry, err := serverEntries.Next()
+			if err != nil {
+				if _, ok := err.(common.ChunkVerificationError); ok {
+					// The server entries stored so far were read from
+					// verified chunks and are kept.
+					chunkVerificationErr = err
+					break
+				}
+				return common.ContextError(err)
+			}
+
+			if serverEntry == nil {
+				// No more server entries
+				break
+			}
+
+			if !config.serverEntryIPFilter.permits(serverEntry.GetIPAddress()) {
+				droppedCount += 1
+				continue
+			}
+
+			if !timestampFilter.permits(serverEntry) {
+				continue
+			}
+
+			if !clientVersionFilter.permits(serverEntry) {
+				continue
+			}
+
+			// Each server entry is stored in a transaction which commits
+			// atomically, either its own or, in atomic mode, the single
+			// import transaction, so checking for cancellation between
+			// server entries leaves no partially written server entry.
+			err = ctx.Err()
+			if err != nil {
+				return common.ContextError(err)
+			}
+
+			created := journal.created
+
+			updated, err := store(serverEntry, replaceIfExists, provenance, noticeUpdated)
+			if err != nil {
+				return common.ContextError(err)
+			}
+
+			if updated {
+				verifier.add(serverEntry)
+				sinkQueue.add(serverEntry, journal.created > created)
+			}
+
+			if newServerEntry != nil && journal.created > created {
+				newServerEntry(serverEntry)
+			}
+
+			n += 1
+			if n == datastoreServerEntryFetchGCThreshold {
+				DoGarbageCollection()
+				n = 0
 			}
 		}
 
-		bucket = tx.bucket(datastoreServerEntriesBucket)
-		cursor := bucket.cursor()
-		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
-			if affinityServerEntryID != nil {
-				if bytes.Equal(affinityServerEntryID, key) {
-					continue
+		return nil
+	})
+	if err != nil {
+		return 0, common.ContextError(journal.rollback(err))
+	}
+
+	err = journal.commit()
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	release()
+
+	sinkQueue.deliver()
+
+	if droppedCount > 0 {
+		NoticeServerEntriesDroppedByIPPolicy(droppedCount)
+	}
+
+	timestampFilter.notice()
+
+	clientVersionFilter.notice()
+
+	unsupportedSchemaCount := serverEntries.UnsupportedSchemaCount()
+	if unsupportedSchemaCount > 0 {
+		NoticeServerEntriesSkippedBySchemaVersion(
+			unsupportedSchemaCount, protocol.SERVER_ENTRY_SCHEMA_VERSION)
+	}
+
+	undecryptedCount := serverEntries.UndecryptedCapabilitiesCount()
+	if undecryptedCount > 0 {
+		NoticeServerEntriesWithUndecryptedCapabilities(undecryptedCount)
+	}
+
+	// A DataStoreIntegrityError or a common.ChunkVerificationError is
+	// returned unwrapped, so that callers may check the error type.
+	err = verifier.verify()
+	if err != nil {
+		return journal.created, err
+	}
+
+	return journal.created, chunkVerificationErr
+}
+
+// serverEntryTimestampFilter drops server entries with a timestamp
+// implausibly far in the future: later than the current time of the config
+// clock plus ServerEntryMaxTimestampSkew. A far future timestamp would make
+// the server entry appear to be the most recently imported for as long as
+// the timestamp remains in the future. A ServerEntryMaxTimestampSkew of 0
+// disables the filter. A server entry with a missing or malformed timestamp
+// is permitted.
+type serverEntryTimestampFilter struct {
+	maxSkew      time.Duration
+	maxTimestamp time.Time
+	droppedCount int
+}
+
+func newServerEntryTimestampFilter(config *Config) *serverEntryTimestampFilter {
+
+	maxSkew := config.clientParameters.Get().Duration(
+		parameters.ServerEntryMaxTimestampSkew)
+
+	return &serverEntryTimestampFilter{
+		maxSkew:      maxSkew,
+		maxTimestamp: config.now().Add(maxSkew),
+	}
+}
+
+// permits returns false, and counts the dropped server entry, when the
+// server entry timestamp is beyond the maximum skew.
+func (filter *serverEntryTimestampFilter) permits(
+	serverEntryFields protocol.ServerEntryFields) bool {
+
+	if filter.maxSkew == 0 {
+		return true
+	}
+
+	timestamp, err := time.Parse(
+		time.RFC3339, serverEntryFields.GetLocalTimestamp())
+	if err != nil || !timestamp.After(filter.maxTimestamp) {
+		return true
+	}
+
+	filter.droppedCount += 1
+	return false
+}
+
+// notice emits a notice reporting any dropped server entries.
+func (filter *serverEntryTimestampFilter) notice() {
+	if filter.droppedCount > 0 {
+		NoticeServerEntriesDroppedByFutureTimestamp(
+			filter.droppedCount, filter.maxSkew)
+	}
+}
+
+// serverEntryClientVersionFilter skips server entries which require a newer
+// client version, per their minimumClientVersion field, than the running
+// client, config.ClientVersion. Such server entries depend on client
+// features this client doesn't have, and aren't imported; the remaining
+// server entries in the payload are imported as usual.
+type serverEntryClientVersionFilter struct {
+	clientVersion int
+	skippedCount  int
+}
+
+func newServerEntryClientVersionFilter(config *Config) *serverEntryClientVersionFilter {
+
+	// ClientVersion is validated by Config.Commit.
+	clientVersion, _ := strconv.Atoi(config.ClientVersion)
+
+	return &serverEntryClientVersionFilter{
+		clientVersion: clientVersion,
+	}
+}
+
+// permits returns false, and counts the skipped server entry, when the
+// server entry requires a newer client version.
+func (filter *serverEntryClientVersionFilter) permits(
+	serverEntryFields protocol.ServerEntryFields) bool {
+
+	if serverEntryFields.GetMinimumClientVersion() <= filter.clientVersion {
+		return true
+	}
+
+	filter.skippedCount += 1
+	return false
+}
+
+// notice emits a notice reporting any skipped server entries.
+func (filter *serverEntryClientVersionFilter) notice() {
+	if filter.skippedCount > 0 {
+		NoticeServerEntriesSkippedByClientVersion(
+			filter.skippedCount, filter.clientVersion)
+	}
+}
+
+// serverEntryImportWriterLimiter limits the number of concurrent server entry
+// imports, which each write to the datastore, to ServerEntryImportMaxWriters.
+// The limit applies to all imports, including concurrent remote server list
+// fetches and embedded server entry imports, independent of any download
+// concurrency. A ServerEntryImportMaxWriters of 0 is no limit.
+type serverEntryImportWriterLimiter struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	active int
+
+	// peakActive is the maximum number of concurrent imports observed. It's
+	// used only in tests.
+	peakActive int
+}
+
+var serverEntryImportWriters = newServerEntryImportWriterLimiter()
+
+func newServerEntryImportWriterLimiter() *serverEntryImportWriterLimiter {
+	limiter := &serverEntryImportWriterLimiter{}
+	limiter.cond = sync.NewCond(&limiter.mutex)
+	return limiter
+}
+
+// acquire blocks until the import may proceed within the current
+// ServerEntryImportMaxWriters limit. The returned release function must be
+// called when the import no longer writes to the datastore; it may be called
+// more than once.
+func (limiter *serverEntryImportWriterLimiter) acquire(config *Config) func() {
+	release, _ := limiter.acquireContext(context.Background(), config)
+	return release
+}
+
+// acquireContext is acquire with cancellation: when ctx is cancelled before
+// the import may proceed, acquireContext returns the context error and no
+// release function.
+func (limiter *serverEntryImportWriterLimiter) acquireContext(
+	ctx context.Context, config *Config) (func(), error) {
+
+	maxWriters := config.clientParameters.Get().Int(parameters.ServerEntryImportMaxWriters)
+
+	// sync.Cond can't wait on a channel, so waiters are woken to check for
+	// cancellation when ctx is done.
+	if maxWriters > 0 && ctx.Done() != nil {
+		stopWaking := make(chan struct{})
+		defer close(stopWaking)
+		go func() {
+			select {
+			case <-ctx.Done():
+				limiter.mutex.Lock()
+				limiter.cond.Broadcast()
+				limiter.mutex.Unlock()
+			case <-stopWaking:
+			}
+		}()
+	}
+
+	limiter.mutex.Lock()
+	for maxWriters > 0 && limiter.active >= maxWriters {
+		if ctx.Err() != nil {
+			limiter.mutex.Unlock()
+			return nil, ctx.Err()
+		}
+		limiter.cond.Wait()
+	}
+	limiter.active += 1
+	if limiter.active > limiter.peakActive {
+		limiter.peakActive = limiter.active
+	}
+	limiter.mutex.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			limiter.mutex.Lock()
+			limiter.active -= 1
+			limiter.cond.Broadcast()
+			limiter.mutex.Unlock()
+		})
+	}, nil
+}
+
+// serverEntryImportJournal is an undo log for a server entry import. Since
+// each server entry is stored in an independent transaction, an import which
+// fails part way, or which is interrupted by a crash, would otherwise leave
+// only some of its server entries in the datastore.
+//
+// Before a server entry is first updated by an import, its prior state is
+// recorded in the journal bucket, in the same transaction as the update.
+// Journal records are keyed by a random import ID followed by the server
+// entry IP address. When the import completes, commit deletes the journal
+// records; when the import fails, rollback restores the prior state. Records
+// left behind by an interrupted import are rolled back in OpenDataStore.
+//
+// Concurrent imports which update the same server entry are not
+// coordinated; rolling back one such import restores the state prior to
+// that import.
+//
+// In atomic mode, when ServerEntryImportAtomic is set, run stores all of the
+// server entries in a single transaction, so a failed or interrupted import
+// is discarded with the transaction and no journal records are written. The
+// transaction blocks other datastore writes for the duration of the import.
+type serverEntryImportJournal struct {
+	importID []byte
+	atomic   bool
+	recorded map[string]bool
+
+	// created is the number of recorded server entries which did not exist
+	// prior to the import.
+	created int
+}
+
+// serverEntryImportJournalRecord is the prior state of a server entry
+// updated by an import. ServerEntry is nil when the server entry did not
+// exist and Provenance is nil when the server entry had no provenance.
+type serverEntryImportJournalRecord struct {
+	ServerEntry []byte
+	Provenance  []byte
+}
+
+const serverEntryImportIDLength = 8
+
+func newServerEntryImportJournal() (*serverEntryImportJournal, error) {
+
+	importID, err := common.MakeSecureRandomBytes(serverEntryImportIDLength)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return &serverEntryImportJournal{
+		importID: importID,
+		recorded: make(map[string]bool),
+	}, nil
+}
+
+// newServerEntryImportJournalForConfig creates a journal in atomic mode when
+// ServerEntryImportAtomic is set.
+func newServerEntryImportJournalForConfig(config *Config) (*serverEntryImportJournal, error) {
+
+	journal, err := newServerEntryImportJournal()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	journal.atomic = config.clientParameters.Get().Bool(parameters.ServerEntryImportAtomic)
+
+	return journal, nil
+}
+
+// serverEntryImportStoreFunc stores a single server entry in an import; see
+// storeServerEntry.
+type serverEntryImportStoreFunc func(
+	serverEntryFields protocol.ServerEntryFields,
+	replaceIfExists bool,
+	provenance *ServerEntryProvenance,
+	noticeUpdated bool) (bool, error)
+
+// run calls importServerEntries, which stores the import's server entries
+// using the input store function. Each server entry is stored in its own
+// journaled transaction or, in atomic mode, all server entries are stored in
+// a single transaction which is committed only if importServerEntries
+// succeeds. When run fails, the import must be rolled back.
+//
+// In atomic mode, importServerEntries runs within the datastore transaction
+// and so must not make any other datastore calls.
+func (journal *serverEntryImportJournal) run(
+	importServerEntries func(store serverEntryImportStoreFunc) error) error {
+
+	if !journal.atomic {
+		return importServerEntries(func(
+			serverEntryFields protocol.ServerEntryFields,
+			replaceIfExists bool,
+			provenance *ServerEntryProvenance,
+			noticeUpdated bool) (bool, error) {
+
+			return storeServerEntry(
+				serverEntryFields, replaceIfExists, provenance, noticeUpdated, journal)
+		})
+	}
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+
+		err := importServerEntries(func(
+			serverEntryFields protocol.ServerEntryFields,
+			replaceIfExists bool,
+			provenance *ServerEntryProvenance,
+			noticeUpdated bool) (bool, error) {
+
+			return storeServerEntryInTx(
+				tx, serverEntryFields, replaceIfExists, provenance, noticeUpdated, journal)
+		})
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		return addDataStoreChurn(tx, len(journal.recorded))
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// record stores the prior state of the specified server entry, unless a
+// prior state was already recorded by this import, in which case the
+// earlier record is retained. In atomic mode, only the import's counts are
+// updated.
+func (journal *serverEntryImportJournal) record(
+	tx *datastoreTx,
+	ipAddress string,
+	serverEntryData []byte,
+	provenanceData []byte) error {
+
+	if journal.recorded[ipAddress] {
+		return nil
+	}
+
+	if !journal.atomic {
+
+		data, err := json.Marshal(&serverEntryImportJournalRecord{
+			ServerEntry: serverEntryData,
+			Provenance:  provenanceData,
+		})
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		key := append(append([]byte(nil), journal.importID...), []byte(ipAddress)...)
+
+		err = tx.bucket(datastoreServerEntryImportJournalBucket).put(key, data)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	journal.recorded[ipAddress] = true
+	if serverEntryData == nil {
+		journal.created += 1
+	}
+
+	return nil
+}
+
+// checkpoint returns a function which restores the journal state for the
+// specified server entry to its current state, undoing any record made by a
+// transaction which was rolled back.
+func (journal *serverEntryImportJournal) checkpoint(ipAddress string) func() {
+
+	recorded := journal.recorded[ipAddress]
+	created := journal.created
+
+	return func() {
+		if !recorded {
+			delete(journal.recorded, ipAddress)
+		}
+		journal.created = created
+	}
+}
+
+// commit completes the import by deleting its journal records. In atomic
+// mode, the import is already committed by run.
+func (journal *serverEntryImportJournal) commit() error {
+
+	if journal.atomic || len(journal.recorded) == 0 {
+		return nil
+	}
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreServerEntryImportJournalBucket)
+		for ipAddress := range journal.recorded {
+			key := append(append([]byte(nil), journal.importID...), []byte(ipAddress)...)
+			err := bucket.delete(key)
+			if err != nil {
+				return common.ContextError(err)
+			}
+		}
+		return addDataStoreChurn(tx, len(journal.recorded))
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// rollback restores the prior state of all server entries updated by the
+// import. The input importErr, the error which caused the import to fail, is
+// returned; a rollback failure is reported in a notice. In atomic mode, the
+// import transaction was already discarded.
+func (journal *serverEntryImportJournal) rollback(importErr error) error {
+
+	if len(journal.recorded) == 0 {
+		return importErr
+	}
+
+	if journal.atomic {
+		NoticeInfo("rolled back import of %d server entries", len(journal.recorded))
+		return importErr
+	}
+
+	err := rollbackServerEntryImports(journal.importID)
+	if err != nil {
+		NoticeAlert("failed to roll back import: %s", common.ContextError(err))
+	} else {
+		NoticeInfo("rolled back import of %d server entries", len(journal.recorded))
+	}
+
+	return importErr
+}
+
+// rollbackServerEntryImports restores the prior state of the server entries
+// recorded in the import journal and deletes the journal records. When
+// importID is nil, all journaled imports are rolled back. The rollback is
+// performed in a single transaction.
+func rollbackServerEntryImports(importID []byte) error {
+
+	restoredCount := 0
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+
+		journalBucket := tx.bucket(datastoreServerEntryImportJournalBucket)
+		serverEntries := tx.bucket(datastoreServerEntriesBucket)
+		provenanceBucket := tx.bucket(datastoreServerEntryProvenanceBucket)
+
+		// Collect keys before modifying the bucket, as the cursor may not
+		// be used to iterate over a bucket while it is being modified.
+		var keys, values [][]byte
+		cursor := journalBucket.cursor()
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			if len(key) <= serverEntryImportIDLength ||
+				(importID != nil && !bytes.HasPrefix(key, importID)) {
+				continue
+			}
+			keys = append(keys, append([]byte(nil), key...))
+			values = append(values, append([]byte(nil), value...))
+		}
+		cursor.close()
+
+		for i, key := range keys {
+
+			err := journalBucket.delete(key)
+			if err != nil {
+				return common.ContextError(err)
+			}
+
+			var record *serverEntryImportJournalRecord
+			err = json.Unmarshal(values[i], &record)
+			if err != nil {
+				// In case of data corruption or a bug causing this condition,
+				// do not stop restoring.
+				NoticeAlert("rollbackServerEntryImports: %s", common.ContextError(err))
+				continue
+			}
+
+			ipAddress := key[serverEntryImportIDLength:]
+
+			if record.ServerEntry == nil {
+				err = serverEntries.delete(ipAddress)
+			} else {
+				err = serverEntries.put(ipAddress, record.ServerEntry)
+			}
+			if err != nil {
+				return common.ContextError(err)
+			}
+
+			if record.Provenance == nil {
+				err = provenanceBucket.delete(ipAddress)
+			} else {
+				err = provenanceBucket.put(ipAddress, record.Provenance)
+			}
+			if err != nil {
+				return common.ContextError(err)
+			}
+
+			restoredCount += 1
+		}
+
+		return nil
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if importID == nil && restoredCount > 0 {
+		NoticeInfo("rolled back %d server entries from incomplete imports", restoredCount)
+	}
+
+	return nil
+}
+
+// serverEntryImportVerifier selects a sample of the server entries updated
+// by an import and, when VerifyImportedServerEntries is set, reads them back
+// after the import to check that the writes persisted.
+type serverEntryImportVerifier struct {
+	enabled      bool
+	random       *rand.Rand
+	sampleSize   int
+	sample       []protocol.ServerEntryFields
+	indexes      map[string]int
+	updatedCount int
+}
+
+func newServerEntryImportVerifier(config *Config) *serverEntryImportVerifier {
+
+	p := config.clientParameters.Get()
+	enabled := p.Bool(parameters.VerifyImportedServerEntries)
+	sampleSize := p.Int(parameters.VerifyImportedServerEntriesSampleSize)
+	p = nil
+
+	return &serverEntryImportVerifier{
+		enabled:    enabled,
+		random:     config.entropy,
+		sampleSize: sampleSize,
+		indexes:    make(map[string]int),
+	}
+}
+
+// add records an updated server entry. A uniform random sample of the
+// updated server entries is selected using reservoir sampling. When a
+// sampled server entry is updated again, the sample records the latest
+// update.
+func (verifier *serverEntryImportVerifier) add(serverEntryFields protocol.ServerEntryFields) {
+
+	if !verifier.enabled {
+		return
+	}
+
+	ipAddress := serverEntryFields.GetIPAddress()
+
+	if index, ok := verifier.indexes[ipAddress]; ok {
+		verifier.sample[index] = serverEntryFields
+		return
+	}
+
+	verifier.updatedCount += 1
+
+	index := -1
+	if len(verifier.sample) < verifier.sampleSize {
+		verifier.sample = append(verifier.sample, nil)
+		index = len(verifier.sample) - 1
+	} else if j := verifier.random.Intn(verifier.updatedCount); j < verifier.sampleSize {
+		delete(verifier.indexes, verifier.sample[j].GetIPAddress())
+		index = j
+	}
+
+	if index != -1 {
+		verifier.sample[index] = serverEntryFields
+		verifier.indexes[ipAddress] = index
+	}
+}
+
+// verify reads back the sampled server entries and returns a
+// DataStoreIntegrityError if any stored server entry does not match.
+func (verifier *serverEntryImportVerifier) verify() error {
+
+	if !verifier.enabled {
+		return nil
+	}
+
+	var integrityErr error
+
+	err := datastoreView(func(tx *datastoreTx) error {
+
+		bucket := tx.bucket(datastoreServerEntriesBucket)
+
+		for _, serverEntryFields := range verifier.sample {
+
+			ipAddress := serverEntryFields.GetIPAddress()
+
+			data, err := json.Marshal(serverEntryFields)
+			if err != nil {
+				return common.ContextError(err)
+			}
+
+			if !bytes.Equal(bucket.get([]byte(ipAddress)), data) {
+				integrityErr = NewDataStoreIntegrityError(
+					fmt.Sprintf("server %s not persisted", ipAddress))
+				return nil
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return integrityErr
+}
+
+// DataStoreIntegrityError is returned when a server entry read back from the
+// datastore does not match the server entry that was written.
+type DataStoreIntegrityError struct {
+	message string
+}
+
+// NewDataStoreIntegrityError creates a new DataStoreIntegrityError.
+func NewDataStoreIntegrityError(errorMessage string) error {
+	return DataStoreIntegrityError{
+		message: fmt.Sprintf("datastore integrity error: %s", errorMessage)}
+}
+
+// Error implements the error interface.
+func (err DataStoreIntegrityError) Error() string {
+	return err.message
+}
+
+// GetServerEntryProvenance returns the provenance recorded for the stored
+// server entry with the specified IP address. nil is returned when no
+// provenance is recorded.
+func GetServerEntryProvenance(ipAddress string) (*ServerEntryProvenance, error) {
+
+	var provenance *ServerEntryProvenance
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreServerEntryProvenanceBucket)
+		data := bucket.get([]byte(ipAddress))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &provenance)
+	})
+
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return provenance, nil
+}
+
+// GetServerEntrySelectionWeight returns the import-time selection weight of
+// the stored server entry with the specified IP address. 0 is returned when
+// the server entry has no recorded provenance.
+func GetServerEntrySelectionWeight(ipAddress string) (int, error) {
+
+	provenance, err := GetServerEntryProvenance(ipAddress)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	if provenance == nil {
+		return 0, nil
+	}
+
+	return provenance.SelectionWeight, nil
+}
+
+// deleteServerEntryRecords deletes the stored server entry with the specified
+// IP address along with its provenance and reachability records. All server
+// entry deletions should use this helper, so that these records don't outlive
+// the server entry.
+func deleteServerEntryRecords(tx *datastoreTx, ipAddress []byte) error {
+
+	err := tx.bucket(datastoreServerEntriesBucket).delete(ipAddress)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	err = tx.bucket(datastoreServerEntryProvenanceBucket).delete(ipAddress)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	err = tx.bucket(datastoreServerEntryReachabilityBucket).delete(ipAddress)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// deleteOrphanedServerEntryRecords deletes any provenance and reachability
+// records with no corresponding stored server entry. Such records may have
+// been left behind by server entry deletions in earlier versions.
+func deleteOrphanedServerEntryRecords() error {
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+
+		serverEntries := tx.bucket(datastoreServerEntriesBucket)
+
+		count := 0
+		for _, bucketName := range [][]byte{
+			datastoreServerEntryProvenanceBucket,
+			datastoreServerEntryReachabilityBucket} {
+
+			bucket := tx.bucket(bucketName)
+
+			// Collect keys first, as the bucket is not modified while iterating.
+			var deleteKeys [][]byte
+			cursor := bucket.cursor()
+			for key, _ := cursor.first(); key != nil; key, _ = cursor.next() {
+				if serverEntries.get(key) == nil {
+					deleteKeys = append(deleteKeys, append([]byte(nil), key...))
+				}
+			}
+			cursor.close()
+
+			for _, key := range deleteKeys {
+				err := bucket.delete(key)
+				if err != nil {
+					return common.ContextError(err)
+				}
+			}
+			count += len(deleteKeys)
+		}
+
+		return addDataStoreChurn(tx, count)
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// DeleteServerEntriesByProvenance deletes all stored server entries with
+// recorded provenance for which match returns true, along with their
+// provenance and reachability records. Server entries with no recorded
+// provenance are not deleted. The number of deleted server entries is
+// returned.
+func DeleteServerEntriesByProvenance(
+	match func(*ServerEntryProvenance) bool) (int, error) {
+
+	count := 0
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+
+		provenanceBucket := tx.bucket(datastoreServerEntryProvenanceBucket)
+
+		// Collect keys first, as the bucket is not modified while iterating.
+		var deleteKeys [][]byte
+		cursor := provenanceBucket.cursor()
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			var provenance *ServerEntryProvenance
+			err := json.Unmarshal(value, &provenance)
+			if err != nil {
+				NoticeAlert("DeleteServerEntriesByProvenance: %s", common.ContextError(err))
+				continue
+			}
+			if match(provenance) {
+				deleteKeys = append(deleteKeys, append([]byte(nil), key...))
+			}
+		}
+		cursor.close()
+
+		for _, key := range deleteKeys {
+			err := deleteServerEntryRecords(tx, key)
+			if err != nil {
+				return common.ContextError(err)
+			}
+			count += 1
+		}
+
+		return addDataStoreChurn(tx, count)
+	})
+
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	return count, nil
+}
+
+// DeleteServerEntries deletes the stored server entries with the specified
+// IP addresses, along with their provenance and reachability records. IP
+// addresses with no stored server entry are ignored. The number of deleted
+// server entries is returned.
+func DeleteServerEntries(ipAddresses []string) (int, error) {
+
+	count := 0
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+
+		serverEntries := tx.bucket(datastoreServerEntriesBucket)
+
+		for _, ipAddress := range ipAddresses {
+			key := []byte(ipAddress)
+			if serverEntries.get(key) == nil {
+				continue
+			}
+			err := deleteServerEntryRecords(tx, key)
+			if err != nil {
+				return common.ContextError(err)
+			}
+			count += 1
+		}
+
+		return addDataStoreChurn(tx, count)
+	})
+
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	return count, nil
+}
+
+// PurgeExpiredServerEntries deletes the stored server entries with an
+// explicit expiry, as reported by ServerEntryFields.GetExpiry, that isn't
+// after now, along with their provenance and reachability records. Server
+// entries without an expiry are retained. The number of deleted server
+// entries is returned.
+func PurgeExpiredServerEntries(now time.Time) (int, error) {
+
+	count := 0
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+
+		serverEntries := tx.bucket(datastoreServerEntriesBucket)
+
+		// Collect keys first, as the bucket is not modified while iterating.
+		var deleteKeys [][]byte
+		cursor := serverEntries.cursor()
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			var serverEntryFields protocol.ServerEntryFields
+			err := json.Unmarshal(value, &serverEntryFields)
+			if err != nil {
+				NoticeAlert("PurgeExpiredServerEntries: %s", common.ContextError(err))
+				continue
+			}
+			expiry, ok := serverEntryFields.GetExpiry()
+			if ok && !expiry.After(now) {
+				deleteKeys = append(deleteKeys, append([]byte(nil), key...))
+			}
+		}
+		cursor.close()
+
+		for _, key := range deleteKeys {
+			err := deleteServerEntryRecords(tx, key)
+			if err != nil {
+				return common.ContextError(err)
+			}
+			count += 1
+		}
+
+		return addDataStoreChurn(tx, count)
+	})
+
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	return count, nil
+}
+
+// purgeExpiredServerEntries is PurgeExpiredServerEntries using the config
+// clock. Failures aren't fatal and are reported in notices.
+func purgeExpiredServerEntries(config *Config) {
+
+	count, err := PurgeExpiredServerEntries(config.now())
+	if err != nil {
+		NoticeAlert("failed to purge expired server entries: %s", common.ContextError(err))
+		return
+	}
+
+	if count > 0 {
+		NoticeServerEntriesExpired(count)
+	}
+}
+
+// ExportServerEntries writes all stored server entries to w or, when source
+// is not blank, only the stored server entries with that local source. Each
+// server entry is written on its own line in the encoded server entry list
+// format, the format of embedded server entry lists, so the output may be
+// imported with protocol.DecodeServerEntryList and StoreServerEntries. All
+// stored fields are exported, including fields that aren't recognized by
+// this client version.
+func ExportServerEntries(w io.Writer, source string) error {
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreServerEntriesBucket)
+		cursor := bucket.cursor()
+		defer cursor.close()
+
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+
+			var serverEntryFields protocol.ServerEntryFields
+			err := json.Unmarshal(value, &serverEntryFields)
+			if err != nil {
+				// In case of data corruption or a bug causing this condition,
+				// do not stop iterating.
+				NoticeAlert("ExportServerEntries: %s", common.ContextError(err))
+				continue
+			}
+
+			if source != "" {
+				if serverEntryFields.GetLocalSource() != source {
+					continue
+				}
+			}
+
+			encodedServerEntry, err := protocol.EncodeServerEntryFields(serverEntryFields)
+			if err != nil {
+				return common.ContextError(err)
+			}
+
+			_, err = io.WriteString(w, encodedServerEntry+"\n")
+			if err != nil {
+				return common.ContextError(err)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// serverEntryAgeHistogramBounds are the upper bounds of the bounded
+// buckets returned by GetServerEntryAgeHistogram.
+var serverEntryAgeHistogramBounds = []time.Duration{
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+	30 * 24 * time.Hour,
+	90 * 24 * time.Hour,
+	365 * 24 * time.Hour,
+}
+
+// ServerEntryAgeHistogramBucket is a count of stored server entries with an
+// import age less than MaxAge and at least the MaxAge of the preceding
+// bucket. The final bucket has a MaxAge of 0 and counts all older server
+// entries.
+type ServerEntryAgeHistogramBucket struct {
+	MaxAge time.Duration
+	Count  int
+}
+
+// ServerEntryAgeHistogram is the distribution of stored server entries by
+// import age. Unknown is the count of server entries with a missing or
+// malformed import timestamp.
+type ServerEntryAgeHistogram struct {
+	Buckets []ServerEntryAgeHistogramBucket
+	Unknown int
+}
+
+// GetServerEntryAgeHistogram returns bucketed counts of all stored server
+// entries by import age, the time elapsed since each server entry's
+// LocalTimestamp. Ages are relative to the current time of the config
+// clock. Server entries with timestamps in the future are counted in the
+// first bucket.
+func GetServerEntryAgeHistogram(config *Config) (*ServerEntryAgeHistogram, error) {
+
+	histogram := &ServerEntryAgeHistogram{}
+	for _, bound := range serverEntryAgeHistogramBounds {
+		histogram.Buckets = append(
+			histogram.Buckets, ServerEntryAgeHistogramBucket{MaxAge: bound})
+	}
+	histogram.Buckets = append(histogram.Buckets, ServerEntryAgeHistogramBucket{})
+
+	now := config.now()
+
+	err := scanServerEntries(func(serverEntry *protocol.ServerEntry) {
+
+		timestamp, err := time.Parse(time.RFC3339, serverEntry.LocalTimestamp)
+		if err != nil {
+			histogram.Unknown += 1
+			return
+		}
+
+		age := now.Sub(timestamp)
+
+		index := len(serverEntryAgeHistogramBounds)
+		for i, bound := range serverEntryAgeHistogramBounds {
+			if age < bound {
+				index = i
+				break
+			}
+		}
+		histogram.Buckets[index].Count += 1
+	})
+
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return histogram, nil
+}
+
+// PromoteServerEntry sets the server affinity server entry ID to the
+// specified server entry IP address.
+func PromoteServerEntry(config *Config, ipAddress string) error {
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+
+		serverEntryID := []byte(ipAddress)
+
+		// Ensure the corresponding server entry exists before
+		// setting server affinity.
+		bucket := tx.bucket(datastoreServerEntriesBucket)
+		data := bucket.get(serverEntryID)
+		if data == nil {
+			NoticeAlert(
+				"PromoteServerEntry: ignoring unknown server entry: %s",
+				ipAddress)
+			return nil
+		}
+
+		bucket = tx.bucket(datastoreKeyValueBucket)
+		err := bucket.put(datastoreAffinityServerEntryIDKey, serverEntryID)
+		if err != nil {
+			return err
+		}
+
+		// Store the current server entry filter (e.g, region, etc.) that
+		// was in use when the entry was promoted. This is used to detect
+		// when the top ranked server entry was promoted under a different
+		// filter.
+
+		currentFilter, err := makeServerEntryFilterValue(config)
+		if err != nil {
+			return err
+		}
+
+		return bucket.put(datastoreLastServerEntryFilterKey, currentFilter)
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+func makeServerEntryFilterValue(config *Config) ([]byte, error) {
+
+	// Currently, only a change of EgressRegion will "break" server affinity.
+	// If the tunnel protocol filter changes, any existing affinity server
+	// either passes the new filter, or it will be skipped anyway.
+
+	return []byte(config.EgressRegion), nil
+}
+
+func hasServerEntryFilterChanged(config *Config) (bool, error) {
+
+	currentFilter, err := makeServerEntryFilterValue(config)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	changed := false
+	err = datastoreView(func(tx *datastoreTx) error {
+
+		// previousFilter will be nil not found (not previously
+		// set) which will never match any current filter.
+
+		bucket := tx.bucket(datastoreKeyValueBucket)
+		previousFilter := bucket.get(datastoreLastServerEntryFilterKey)
+		if bytes.Compare(previousFilter, currentFilter) != 0 {
+			changed = true
+		}
+		return nil
+	})
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	return changed, nil
+}
+
+// ServerEntryIterator is used to iterate over
+// stored server entries in rank order.
+type ServerEntryIterator struct {
+	config                       *Config
+	applyServerAffinity          bool
+	serverEntryIDs               [][]byte
+	serverEntryIndex             int
+	isTacticsServerEntryIterator bool
+	isTargetServerEntryIterator  bool
+	hasNextTargetServerEntry     bool
+	targetServerEntry            *protocol.ServerEntry
+}
+
+// NewServerEntryIterator creates a new ServerEntryIterator.
+//
+// The boolean return value indicates whether to treat the first server(s)
+// as affinity servers or not. When the server entry selection filter changes
+// such as from a specific region to any region, or when there was no previous
+// filter/iterator, the the first server(s) are arbitrary and should not be
+// given affinity treatment.
+//
+// NewServerEntryIterator and any returned ServerEntryIterator are not
+// designed for concurrent use as not all related datastore operations are
+// performed in a single transaction.
+//
+func NewServerEntryIterator(config *Config) (bool, *ServerEntryIterator, error) {
+
+	// When configured, this target server entry is the only candidate
+	if config.TargetServerEntry != "" {
+		return newTargetServerEntryIterator(config, false)
+	}
+
+	filterChanged, err := hasServerEntryFilterChanged(config)
+	if err != nil {
+		return false, nil, common.ContextError(err)
+	}
+
+	applyServerAffinity := !filterChanged
+
+	iterator := &ServerEntryIterator{
+		config:              config,
+		applyServerAffinity: applyServerAffinity,
+	}
+
+	err = iterator.Reset()
+	if err != nil {
+		return false, nil, common.ContextError(err)
+	}
+
+	return applyServerAffinity, iterator, nil
+}
+
+func NewTacticsServerEntryIterator(config *Config) (*ServerEntryIterator, error) {
+
+	// When configured, this target server entry is the only candidate
+	if config.TargetServerEntry != "" {
+		_, iterator, err := newTargetServerEntryIterator(config, true)
+		return iterator, err
+	}
+
+	iterator := &ServerEntryIterator{
+		config:                       config,
+		isTacticsServerEntryIterator: true,
+	}
+
+	err := iterator.Reset()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return iterator, nil
+}
+
+// newTargetServerEntryIterator is a helper for initializing the TargetServerEntry case
+func newTargetServerEntryIterator(config *Config, isTactics bool) (bool, *ServerEntryIterator, error) {
+
+	serverEntry, err := protocol.DecodeServerEntry(
+		config.TargetServerEntry, config.getCurrentTimestamp(), protocol.SERVER_ENTRY_SOURCE_TARGET)
+	if err != nil {
+		return false, nil, common.ContextError(err)
+	}
+
+	if isTactics {
+
+		if len(serverEntry.GetSupportedTacticsProtocols()) == 0 {
+			return false, nil, common.ContextError(errors.New("TargetServerEntry does not support tactics protocols"))
+		}
+
+	} else {
+
+		if config.EgressRegion != "" && serverEntry.Region != config.EgressRegion {
+			return false, nil, common.ContextError(errors.New("TargetServerEntry does not support EgressRegion"))
+		}
+
+		limitTunnelProtocols := config.clientParameters.Get().TunnelProtocols(parameters.LimitTunnelProtocols)
+		if len(limitTunnelProtocols) > 0 {
+			// At the ServerEntryIterator level, only limitTunnelProtocols is applied;
+			// excludeIntensive is handled higher up.
+			if len(serverEntry.GetSupportedProtocols(
+				config.UseUpstreamProxy(), limitTunnelProtocols, false)) == 0 {
+				return false, nil, common.ContextError(errors.New("TargetServerEntry does not support LimitTunnelProtocols"))
+			}
+		}
+	}
+
+	iterator := &ServerEntryIterator{
+		config:                       config,
+		isTacticsServerEntryIterator: isTactics,
+		isTargetServerEntryIterator:  true,
+		hasNextTargetServerEntry:     true,
+		targetServerEntry:            serverEntry,
+	}
+
+	NoticeInfo("using TargetServerEntry: %s", serverEntry.IpAddress)
+
+	return false, iterator, nil
+}
+
+// Reset a NewServerEntryIterator to the start of its cycle. The next
+// call to Next will return the first server entry.
+func (iterator *ServerEntryIterator) Reset() error {
+	iterator.Close()
+
+	if iterator.isTargetServerEntryIterator {
+		iterator.hasNextTargetServerEntry = true
+		return nil
+	}
+
+	// BoltDB implementation note:
+	// We don't keep a transaction open for the duration of the iterator
+	// because this would expose the following semantics to consumer code:
+	//
+	//     Read-only transactions and read-write transactions ... generally
+	//     shouldn't be opened simultaneously in the same goroutine. This can
+	//     cause a deadlock as the read-write transaction needs to periodically
+	//     re-map the data file but it cannot do so while a read-only
+	//     transaction is open.
+	//     (https://github.com/boltdb/bolt)
+	//
+	// So the underlying serverEntriesBucket could change after the serverEntryIDs
+	// list is built.
+
+	var serverEntryIDs [][]byte
+
+	// The tactics server entry iterator does not apply source or trust tier
+	// prioritization.
+	prioritizeHighTrust := false
+	var sourcePriority []string
+	if !iterator.isTacticsServerEntryIterator {
+		p := iterator.config.clientParameters.Get()
+		prioritizeHighTrust = p.Bool(parameters.PrioritizeHighTrustServerEntries)
+		sourcePriority = p.Strings(parameters.ServerEntrySourcePriority)
+		p = nil
+	}
+
+	err := datastoreView(func(tx *datastoreTx) error {
+
+		bucket := tx.bucket(datastoreKeyValueBucket)
+
+		serverEntryIDs = make([][]byte, 0)
+		shuffleHead := 0
+
+		var affinityServerEntryID []byte
+		if iterator.applyServerAffinity {
+			affinityServerEntryID = bucket.get(datastoreAffinityServerEntryIDKey)
+			if affinityServerEntryID != nil {
+				serverEntryIDs = append(serverEntryIDs, append([]byte(nil), affinityServerEntryID...))
+				shuffleHead = 1
+			}
+		}
+
+		bucket = tx.bucket(datastoreServerEntriesBucket)
+		cursor := bucket.cursor()
+		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+			if affinityServerEntryID != nil {
+				if bytes.Equal(affinityServerEntryID, key) {
+					continue
+				}
+			}
+			serverEntryIDs = append(serverEntryIDs, append([]byte(nil), key...))
+		}
+		cursor.close()
+
+		for i := len(serverEntryIDs) - 1; i > shuffleHead-1; i-- {
+			j := rand.Intn(i+1-shuffleHead) + shuffleHead
+			serverEntryIDs[i], serverEntryIDs[j] = serverEntryIDs[j], serverEntryIDs[i]
+		}
+
+		// When ServerEntrySourcePriority is set, server entries are ordered
+		// by source, retaining the shuffled order within each source. See
+		// Config.GetServerEntrySourcePriority.
+		prioritizeServerEntrySources(
+			bucket, serverEntryIDs[shuffleHead:], sourcePriority)
+
+		// When PrioritizeHighTrustServerEntries is set, low trust server
+		// entries are moved after all high trust server entries, retaining
+		// the shuffled order within each trust tier.
+		if prioritizeHighTrust {
+
+			provenanceBucket := tx.bucket(datastoreServerEntryProvenanceBucket)
+			var lowTrustServerEntryIDs [][]byte
+			n := shuffleHead
+			for _, serverEntryID := range serverEntryIDs[shuffleHead:] {
+				if getStoredServerEntryTrustTier(
+					provenanceBucket.get(serverEntryID)) == SERVER_ENTRY_TRUST_TIER_LOW {
+
+					lowTrustServerEntryIDs = append(lowTrustServerEntryIDs, serverEntryID)
+					continue
+				}
+				serverEntryIDs[n] = serverEntryID
+				n += 1
+			}
+			copy(serverEntryIDs[n:], lowTrustServerEntryIDs)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	iterator.serverEntryIDs = serverEntryIDs
+	iterator.serverEntryIndex = 0
+
+	return nil
+}
+
+// Close cleans up resources associated with a ServerEntryIterator.
+func (iterator *ServerEntryIterator) Close() {
+	iterator.serverEntryIDs = nil
+	iterator.serverEntryIndex = 0
+}
+
+// Next returns the next server entry, by rank, for a ServerEntryIterator.
+// Returns nil with no error when there is no next item.
+func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
+
+	var serverEntry *protocol.ServerEntry
+	var err error
+
+	defer func() {
+		if err != nil {
+			iterator.Close()
+		}
+	}()
+
+	if iterator.isTargetServerEntryIterator {
+		if iterator.hasNextTargetServerEntry {
+			iterator.hasNextTargetServerEntry = false
+			return MakeCompatibleServerEntry(iterator.targetServerEntry), nil
+		}
+		return nil, nil
+	}
+
+	// There are no region/protocol indexes for the server entries bucket.
+	// Loop until we have the next server entry that matches the iterator
+	// filter requirements.
+	for {
+		if iterator.serverEntryIndex >= len(iterator.serverEntryIDs) {
+			// There is no next item
+			return nil, nil
+		}
+
+		serverEntryID := iterator.serverEntryIDs[iterator.serverEntryIndex]
+		iterator.serverEntryIndex += 1
+
+		var data []byte
+
+		err = datastoreView(func(tx *datastoreTx) error {
+			bucket := tx.bucket(datastoreServerEntriesBucket)
+			value := bucket.get(serverEntryID)
+			if value != nil {
+				// Must make a copy as slice is only valid within transaction.
+				data = make([]byte, len(value))
+				copy(data, value)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		if data == nil {
+			// In case of data corruption or a bug causing this condition,
+			// do not stop iterating.
+			NoticeAlert("ServerEntryIterator.Next: unexpected missing server entry: %s", string(serverEntryID))
+			continue
+		}
+
+		err = json.Unmarshal(data, &serverEntry)
+		if err != nil {
+			// In case of data corruption or a bug causing this condition,
+			// do not stop iterating.
+			NoticeAlert("ServerEntryIterator.Next: %s", common.ContextError(err))
+			continue
+		}
+
+		if iterator.serverEntryIndex%datastoreServerEntryFetchGCThreshold == 0 {
+			DoGarbageCollection()
+		}
+
+		if iterator.isCandidate(serverEntry) {
+			break
+		}
+	}
+
+	return MakeCompatibleServerEntry(serverEntry), nil
+}
+
+// isCandidate checks the iterator filter requirements for a stored server
+// entry.
+func (iterator *ServerEntryIterator) isCandidate(serverEntry *protocol.ServerEntry) bool {
+
+	// Server entries outside of their availability windows aren't live.
+	if !serverEntry.IsAvailableAt(iterator.config.now()) {
+		return false
+	}
+
+	if iterator.isTacticsServerEntryIterator {
+
+		// Tactics doesn't filter by egress region.
+		return len(serverEntry.GetSupportedTacticsProtocols()) > 0
+	}
+
+	return iterator.config.EgressRegion == "" ||
+		serverEntry.Region == iterator.config.EgressRegion
+}
+
+// Filter applies the iterator filter requirements to a server entry obtained
+// outside of the iterator, such as a server entry streamed from a remote
+// server list download. Filter returns the stored copy of the server entry
+// when it meets the requirements, and nil when it does not, including when
+// the server entry is no longer stored, having been revoked, expired, or
+// rolled back. A target server entry iterator admits no other candidates.
+func (iterator *ServerEntryIterator) Filter(
+	serverEntry *protocol.ServerEntry) (*protocol.ServerEntry, error) {
+
+	if iterator.isTargetServerEntryIterator {
+		return nil, nil
+	}
+
+	var storedServerEntry *protocol.ServerEntry
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		value := tx.bucket(datastoreServerEntriesBucket).get(
+			[]byte(serverEntry.IpAddress))
+		if value == nil {
+			return nil
+		}
+		return json.Unmarshal(value, &storedServerEntry)
+	})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if storedServerEntry == nil || !iterator.isCandidate(storedServerEntry) {
+		return nil, nil
+	}
+
+	return MakeCompatibleServerEntry(storedServerEntry), nil
+}
+
+// MakeCompatibleServerEntry provides backwards compatibility with old server entries
+// which have a single meekFrontingDomain and not a meekFrontingAddresses array.
+// By copying this one meekFrontingDomain into meekFrontingAddresses, this client effectively
+// uses that single value as legacy clients do.
+func MakeCompatibleServerEntry(serverEntry *protocol.ServerEntry) *protocol.ServerEntry {
+	if len(serverEntry.MeekFrontingAddresses) == 0 && serverEntry.MeekFrontingDomain != "" {
+		serverEntry.MeekFrontingAddresses =
+			append(serverEntry.MeekFrontingAddresses, serverEntry.MeekFrontingDomain)
+	}
+
+	return serverEntry
+}
+
+func scanServerEntries(scanner func(*protocol.ServerEntry)) error {
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreServerEntriesBucket)
+		cursor := bucket.cursor()
+		n := 0
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			var serverEntry *protocol.ServerEntry
+			err := json.Unmarshal(value, &serverEntry)
+			if err != nil {
+				// In case of data corruption or a bug causing this condition,
+				// do not stop iterating.
+				NoticeAlert("scanServerEntries: %s", common.ContextError(err))
+				continue
+			}
+			scanner(serverEntry)
+
+			n += 1
+			if n == datastoreServerEntryFetchGCThreshold {
+				DoGarbageCollection()
+				n = 0
+			}
+		}
+		cursor.close()
+		return nil
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// CountServerEntries returns a count of stored server entries.
+func CountServerEntries() int {
+	count := 0
+	err := scanServerEntries(func(_ *protocol.ServerEntry) {
+		count += 1
+	})
+
+	if err != nil {
+		NoticeAlert("CountServerEntries failed: %s", err)
+		return 0
+	}
+
+	return count
+}
+
+// CountServerEntriesWithLimits returns a count of stored server entries for
+// the specified region and tunnel protocol limits.
+func CountServerEntriesWithLimits(
+	useUpstreamProxy bool, region string, limitState *limitTunnelProtocolsState) (int, int) {
+
+	// When CountServerEntriesWithLimits is called only
+	// limitTunnelProtocolState is fixed; excludeIntensive is transitory.
+	excludeIntensive := false
+
+	initialCount := 0
+	count := 0
+	err := scanServerEntries(func(serverEntry *protocol.ServerEntry) {
+		if region == "" || serverEntry.Region == region {
+
+			if limitState.isInitialCandidate(excludeIntensive, serverEntry) {
+				initialCount += 1
+			}
+
+			if limitState.isCandidate(excludeIntensive, serverEntry) {
+				count += 1
+			}
+
+		}
+	})
+
+	if err != nil {
+		NoticeAlert("CountServerEntriesWithLimits failed: %s", err)
+		return 0, 0
+	}
+
+	return initialCount, count
+}
+
+// ReportAvailableRegions prints a notice with the available egress regions.
+// When limitState has initial protocols, the available regions are limited
+// to those available for the initial protocols; or if limitState has general
+// limited protocols, the available regions are similarly limited.
+func ReportAvailableRegions(config *Config, limitState *limitTunnelProtocolsState) {
+
+	// When ReportAvailableRegions is called only limitTunnelProtocolState is
+	// fixed; excludeIntensive is transitory.
+	excludeIntensive := false
+
+	now := config.now()
+
+	regions := make(map[string]bool)
+	err := scanServerEntries(func(serverEntry *protocol.ServerEntry) {
+
+		if !serverEntry.IsAvailableAt(now) {
+			return
+		}
+
+		isCandidate := false
+		if limitState.hasInitialProtocols() {
+			isCandidate = limitState.isInitialCandidate(excludeIntensive, serverEntry)
+		} else {
+			isCandidate = limitState.isCandidate(excludeIntensive, serverEntry)
+		}
+
+		if isCandidate {
+			regions[serverEntry.Region] = true
+		}
+	})
+
+	if err != nil {
+		NoticeAlert("ReportAvailableRegions failed: %s", err)
+		return
+	}
+
+	regionList := make([]string, 0, len(regions))
+	for region := range regions {
+		// Some server entries do not have a region, but it makes no sense to return
+		// an empty string as an "available region".
+		if region != "" {
+			regionList = append(regionList, region)
+		}
+	}
+
+	NoticeAvailableEgressRegions(regionList)
+}
+
+// GetAvailableServerRegions returns the distinct, sorted list of egress
+// regions across all stored server entries. When limitTunnelProtocols is not
+// empty, only server entries supporting at least one of the specified tunnel
+// protocols are considered. Server entries with no region are ignored, as
+// are server entries outside of their availability windows, per the clock
+// of the config with which the datastore was opened.
+func GetAvailableServerRegions(limitTunnelProtocols protocol.TunnelProtocols) ([]string, error) {
+
+	now := datastoreNow()
+
+	regions := make(map[string]bool)
+	err := scanServerEntries(func(serverEntry *protocol.ServerEntry) {
+
+		if serverEntry.Region == "" || !serverEntry.IsAvailableAt(now) {
+			return
+		}
+
+		if len(limitTunnelProtocols) > 0 {
+			supported := false
+			for _, tunnelProtocol := range limitTunnelProtocols {
+				if serverEntrySupportsProtocol(serverEntry, tunnelProtocol) {
+					supported = true
+					break
+				}
+			}
+			if !supported {
+				return
+			}
+		}
+
+		regions[serverEntry.Region] = true
+	})
+
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	regionList := make([]string, 0, len(regions))
+	for region := range regions {
+		regionList = append(regionList, region)
+	}
+	sort.Strings(regionList)
+
+	return regionList, nil
+}
+
+// GetFrontedServerEntries returns the stored server entries which are
+// addressed by the domain name frontingAddress; that is, server entries
+// which support a fronted tunnel protocol and list frontingAddress as a
+// fronting address. When region is not blank, only server entries in that
+// region are returned. When limitTunnelProtocols is not empty, only server
+// entries supporting one of the fronted tunnel protocols in the limit are
+// returned.
+func GetFrontedServerEntries(
+	frontingAddress string,
+	region string,
+	limitTunnelProtocols protocol.TunnelProtocols) ([]*protocol.ServerEntry, error) {
+
+	serverEntries := make([]*protocol.ServerEntry, 0)
+	err := scanServerEntries(func(serverEntry *protocol.ServerEntry) {
+
+		if region != "" && serverEntry.Region != region {
+			return
+		}
+
+		serverEntry = MakeCompatibleServerEntry(serverEntry)
+
+		if !serverEntry.IsFrontedBy(frontingAddress) {
+			return
+		}
+
+		if len(limitTunnelProtocols) > 0 {
+			supported := false
+			for _, tunnelProtocol := range limitTunnelProtocols {
+				if protocol.TunnelProtocolIsFronted(tunnelProtocol) &&
+					serverEntrySupportsProtocol(serverEntry, tunnelProtocol) {
+					supported = true
+					break
+				}
+			}
+			if !supported {
+				return
+			}
+		}
+
+		serverEntries = append(serverEntries, serverEntry)
+	})
+
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return serverEntries, nil
+}
+
+// serverEntrySupportsProtocol returns true when the server entry supports
+// the tunnel protocol and can be dialed with it. A server entry with the
+// fronted capability but with no fronting address, the domain name used to
+// dial it, cannot be dialed with a fronted tunnel protocol.
+func serverEntrySupportsProtocol(
+	serverEntry *protocol.ServerEntry, tunnelProtocol string) bool {
+
+	if !serverEntry.SupportsProtocol(tunnelProtocol) {
+		return false
+	}
+
+	if protocol.TunnelProtocolIsFronted(tunnelProtocol) {
+		serverEntry = MakeCompatibleServerEntry(serverEntry)
+		if len(serverEntry.MeekFrontingAddresses) == 0 &&
+			serverEntry.MeekFrontingAddressesRegex == "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SetSplitTunnelRoutes updates the cached routes data for
+// the given region. The associated etag is also stored and
+// used to make efficient web requests for updates to the data.
+func SetSplitTunnelRoutes(region, etag string, data []byte) error {
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreSplitTunnelRouteETagsBucket)
+		err := bucket.put([]byte(region), []byte(etag))
+
+		bucket = tx.bucket(datastoreSplitTunnelRouteDataBucket)
+		err = bucket.put([]byte(region), data)
+		return err
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// GetSplitTunnelRoutesETag retrieves the etag for cached routes
+// data for the specified region. If not found, it returns an empty string value.
+func GetSplitTunnelRoutesETag(region string) (string, error) {
+
+	var etag string
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreSplitTunnelRouteETagsBucket)
+		etag = string(bucket.get([]byte(region)))
+		return nil
+	})
+
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+	return etag, nil
+}
+
+// GetSplitTunnelRoutesData retrieves the cached routes data
+// for the specified region. If not found, it returns a nil value.
+func GetSplitTunnelRoutesData(region string) ([]byte, error) {
+
+	var data []byte
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreSplitTunnelRouteDataBucket)
+		value := bucket.get([]byte(region))
+		if value != nil {
+			// Must make a copy as slice is only valid within transaction.
+			data = make([]byte, len(value))
+			copy(data, value)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	return data, nil
+}
+
+// ETagStore is a persistence backend for the ETags of downloaded resources,
+// keyed by URL. By default, ETags are stored in the main datastore; an
+// integrator may use SetETagStore to keep ETags in a separate, lighter-weight
+// store to reduce contention on the main datastore.
+//
+// GetUrlETag must return an empty string, and no error, when no ETag is
+// stored for the URL. Setting a blank ETag clears the stored ETag.
+// Implementations must be safe for concurrent use.
+type ETagStore interface {
+	GetUrlETag(url string) (string, error)
+	SetUrlETag(url, etag string) error
+}
+
+var (
+	etagStoreMutex  sync.Mutex
+	activeETagStore ETagStore = datastoreETagStore{}
+)
+
+// pendingUrlETags are ETags which failed to be stored, keyed by URL, and
+// which are to be stored by flushPendingUrlETags. Until stored, a pending
+// ETag is returned by GetUrlETag, so that the resource isn't downloaded
+// again in this process. Any SetUrlETag for the URL supersedes a pending
+// ETag. pendingUrlETagsMutex also serializes ETag writes, so that a flush
+// can't overwrite a newer ETag.
+var (
+	pendingUrlETagsMutex sync.Mutex
+	pendingUrlETags      = make(map[string]string)
+)
+
+// SetETagStore replaces the ETagStore used by GetUrlETag and SetUrlETag.
+// When store is nil, the default datastore-backed store is restored.
+//
+// ETags are not migrated between stores: after switching stores, resources
+// are downloaded again, and validated, before their ETags are stored in the
+// new store.
+func SetETagStore(store ETagStore) {
+
+	etagStoreMutex.Lock()
+	defer etagStoreMutex.Unlock()
+
+	if store == nil {
+		store = datastoreETagStore{}
+	}
+	activeETagStore = store
+
+	pendingUrlETagsMutex.Lock()
+	pendingUrlETags = make(map[string]string)
+	pendingUrlETagsMutex.Unlock()
+}
+
+func getETagStore() ETagStore {
+
+	etagStoreMutex.Lock()
+	defer etagStoreMutex.Unlock()
+
+	return activeETagStore
+}
+
+// SetUrlETag stores an ETag for the specfied URL, using the ETagStore set by
+// SetETagStore.
+// Note: input URL is treated as a string, and is not
+// encoded or decoded or otherwise canonicalized.
+func SetUrlETag(url, etag string) error {
+
+	pendingUrlETagsMutex.Lock()
+	defer pendingUrlETagsMutex.Unlock()
+
+	delete(pendingUrlETags, url)
+
+	err := getETagStore().SetUrlETag(url, etag)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// GetUrlETag retrieves a previously stored an ETag for the
+// specfied URL, using the ETagStore set by SetETagStore. If
+// not found, it returns an empty string value. An ETag pending
+// a flushPendingUrlETags is returned in place of the stored
+// ETag.
+func GetUrlETag(url string) (string, error) {
+
+	pendingUrlETagsMutex.Lock()
+	etag, ok := pendingUrlETags[url]
+	pendingUrlETagsMutex.Unlock()
+	if ok {
+		return etag, nil
+	}
+
+	etag, err := getETagStore().GetUrlETag(url)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+	return etag, nil
+}
+
+// queueUrlETag records an ETag, which failed to be stored, for a later
+// flushPendingUrlETags.
+func queueUrlETag(url, etag string) {
+
+	pendingUrlETagsMutex.Lock()
+	defer pendingUrlETagsMutex.Unlock()
+
+	pendingUrlETags[url] = etag
+}
+
+// flushPendingUrlETags attempts to store all pending ETags. ETags which
+// again fail to be stored remain pending. flushPendingUrlETags returns the
+// number of ETags stored and the first error, if any.
+func flushPendingUrlETags() (int, error) {
+
+	pendingUrlETagsMutex.Lock()
+	defer pendingUrlETagsMutex.Unlock()
+
+	store := getETagStore()
+
+	flushed := 0
+	var firstErr error
+
+	for url, etag := range pendingUrlETags {
+		err := store.SetUrlETag(url, etag)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = common.ContextError(err)
+			}
+			continue
+		}
+		delete(pendingUrlETags, url)
+		flushed += 1
+	}
+
+	return flushed, firstErr
+}
+
+// datastoreETagStore is the default ETagStore, which stores ETags in the
+// main datastore.
+type datastoreETagStore struct {
+}
+
+func (store datastoreETagStore) SetUrlETag(url, etag string) error {
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreUrlETagsBucket)
+		err := bucket.put([]byte(url), []byte(etag))
+		return err
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+func (store datastoreETagStore) GetUrlETag(url string) (string, error) {
+
+	var etag string
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreUrlETagsBucket)
+		etag = string(bucket.get([]byte(url)))
+		return nil
+	})
+
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+	return etag, nil
+}
+
+// SetUrlValidatedTime stores the time at which the resource at the
+// specified URL was last downloaded and validated.
+// Note: input URL is treated as a string, and is not
+// encoded or decoded or otherwise canonicalized.
+func SetUrlValidatedTime(url string, validatedTime time.Time) error {
+
+	err := setBucketValue(
+		datastoreUrlValidatedTimesBucket,
+		[]byte(url),
+		[]byte(validatedTime.UTC().Format(time.RFC3339Nano)))
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// GetUrlValidatedTime retrieves the time stored by SetUrlValidatedTime
+// for the specified URL. If not found, it returns the zero time.
+func GetUrlValidatedTime(url string) (time.Time, error) {
+
+	var validatedTime time.Time
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreUrlValidatedTimesBucket)
+		value := bucket.get([]byte(url))
+		if value == nil {
+			return nil
+		}
+		var err error
+		validatedTime, err = time.Parse(time.RFC3339Nano, string(value))
+		return err
+	})
+
+	if err != nil {
+		return time.Time{}, common.ContextError(err)
+	}
+	return validatedTime, nil
+}
+
+// urlNextFetchTimeRecord is the earliest time at which the resource with
+// the specified ETag is to be requested again.
+type urlNextFetchTimeRecord struct {
+	ETag          string
+	NextFetchTime time.Time
+}
+
+// SetUrlNextFetchTime stores the earliest time at which the resource at the
+// specified URL, with the specified ETag, is to be requested again. A zero
+// nextFetchTime deletes any stored time.
+// Note: input URL is treated as a string, and is not
+// encoded or decoded or otherwise canonicalized.
+func SetUrlNextFetchTime(url, etag string, nextFetchTime time.Time) error {
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreUrlNextFetchTimesBucket)
+		if nextFetchTime.IsZero() {
+			return bucket.delete([]byte(url))
+		}
+		data, err := json.Marshal(&urlNextFetchTimeRecord{
+			ETag:          etag,
+			NextFetchTime: nextFetchTime.UTC(),
+		})
+		if err != nil {
+			return err
+		}
+		return bucket.put([]byte(url), data)
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// GetUrlNextFetchTime retrieves the ETag and time stored by
+// SetUrlNextFetchTime for the specified URL. If not found, it returns a
+// blank ETag and the zero time.
+func GetUrlNextFetchTime(url string) (string, time.Time, error) {
+
+	var record urlNextFetchTimeRecord
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreUrlNextFetchTimesBucket)
+		value := bucket.get([]byte(url))
+		if value == nil {
+			return nil
+		}
+		return json.Unmarshal(value, &record)
+	})
+
+	if err != nil {
+		return "", time.Time{}, common.ContextError(err)
+	}
+	return record.ETag, record.NextFetchTime, nil
+}
+
+// ServerEntryReachability records the result of a reachability probe of a
+// stored server entry. Endpoint is the probed TCP address and ProbeTimestamp
+// is the RFC3339 time of the probe. Error describes a failed probe.
+type ServerEntryReachability struct {
+	Reachable      bool
+	Endpoint       string `json:",omitempty"`
+	ProbeTimestamp string
+	Error          string `json:",omitempty"`
+}
+
+// setServerEntryReachability stores the reachability probe result for the
+// server entry with the specified IP address, replacing any earlier result.
+func setServerEntryReachability(
+	ipAddress string, reachability *ServerEntryReachability) error {
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		data, err := json.Marshal(reachability)
+		if err != nil {
+			return err
+		}
+		return tx.bucket(datastoreServerEntryReachabilityBucket).put(
+			[]byte(ipAddress), data)
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// GetServerEntryReachability returns the most recent reachability probe
+// result recorded for the stored server entry with the specified IP
+// address. nil is returned when the server entry hasn't been probed. See
+// Config.ProbeImportedServerEntries.
+func GetServerEntryReachability(ipAddress string) (*ServerEntryReachability, error) {
+
+	var reachability *ServerEntryReachability
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		data := tx.bucket(datastoreServerEntryReachabilityBucket).get([]byte(ipAddress))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &reachability)
+	})
+
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	return reachability, nil
+}
+
+// SetKeyValue stores a key/value pair. The write is retried when the
+// datastore is temporarily locked; see datastoreUpdateWithRetry.
+func SetKeyValue(key, value string) error {
+
+	err := datastoreUpdateWithRetry(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreKeyValueBucket)
+		err := bucket.put([]byte(key), []byte(value))
+		return err
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// GetKeyValue retrieves the value for a given key. If not found,
+// it returns an empty string value.
+func GetKeyValue(key string) (string, error) {
+
+	var value string
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreKeyValueBucket)
+		value = string(bucket.get([]byte(key)))
+		return nil
+	})
+
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+	return value, nil
+}
+
+// Persistent stat records in the persistentStatStateUnreported
+// state are available for take out.
+//
+// Records in the persistentStatStateReporting have been taken
+// out and are pending either deletion (for a successful request)
+// or change to StateUnreported (for a failed request).
+//
+// All persistent stat records are reverted to StateUnreported
+// when the datastore is initialized at start up.
+
+var persistentStatStateUnreported = []byte("0")
+var persistentStatStateReporting = []byte("1")
+
+var persistentStatTypes = []string{
+	datastorePersistentStatTypeRemoteServerList,
+}
+
+// StorePersistentStat adds a new persistent stat record, which
+// is set to StateUnreported and is an immediate candidate for
+// reporting.
+//
+// The stat is a JSON byte array containing fields as
+// required by the Psiphon server API. It's assumed that the
+// JSON value contains enough unique information for the value to
+// function as a key in the key/value datastore. This assumption
+// is currently satisfied by the fields sessionId + tunnelNumber
+// for tunnel stats, and URL + ETag for remote server list stats.
+func StorePersistentStat(statType string, stat []byte) error {
+
+	if !common.Contains(persistentStatTypes, statType) {
+		return common.ContextError(fmt.Errorf("invalid persistent stat type: %s", statType))
+	}
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket([]byte(statType))
+		err := bucket.put(stat, persistentStatStateUnreported)
+		return err
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// CountUnreportedPersistentStats returns the number of persistent
+// stat records in StateUnreported.
+func CountUnreportedPersistentStats() int {
+
+	unreported := 0
+
+	err := datastoreView(func(tx *datastoreTx) error {
+
+		for _, statType := range persistentStatTypes {
+
+			bucket := tx.bucket([]byte(statType))
+			cursor := bucket.cursor()
+			for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+				if 0 == bytes.Compare(value, persistentStatStateUnreported) {
+					unreported++
+					break
+				}
+			}
+			cursor.close()
+		}
+		return nil
+	})
+
+	if err != nil {
+		NoticeAlert("CountUnreportedPersistentStats failed: %s", err)
+		return 0
+	}
+
+	return unreported
+}
+
+// TakeOutUnreportedPersistentStats returns up to maxCount persistent
+// stats records that are in StateUnreported. The records are set to
+// StateReporting. If the records are successfully reported, clear them
+// with ClearReportedPersistentStats. If the records are not successfully
+// reported, restore them with PutBackUnreportedPersistentStats.
+func TakeOutUnreportedPersistentStats(maxCount int) (map[string][][]byte, error) {
+
+	stats := make(map[string][][]byte)
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+
+		count := 0
+
+		for _, statType := range persistentStatTypes {
+
+			bucket := tx.bucket([]byte(statType))
+			cursor := bucket.cursor()
+			for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+
+				if count >= maxCount {
+					break
+				}
+
+				// Perform a test JSON unmarshaling. In case of data corruption or a bug,
+				// skip the record.
+				var jsonData interface{}
+				err := json.Unmarshal(key, &jsonData)
+				if err != nil {
+					NoticeAlert(
+						"Invalid key in TakeOutUnreportedPersistentStats: %s: %s",
+						string(key), err)
+					continue
+				}
+
+				if 0 == bytes.Compare(value, persistentStatStateUnreported) {
+					// Must make a copy as slice is only valid within transaction.
+					data := make([]byte, len(key))
+					copy(data, key)
+
+					if stats[statType] == nil {
+						stats[statType] = make([][]byte, 0)
+					}
+
+					stats[statType] = append(stats[statType], data)
+					count += 1
+				}
+			}
+			cursor.close()
+
+			for _, key := range stats[statType] {
+				err := bucket.put(key, persistentStatStateReporting)
+				if err != nil {
+					return err
+				}
+			}
+
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return stats, nil
+}
+
+// PutBackUnreportedPersistentStats restores a list of persistent
+// stat records to StateUnreported.
+func PutBackUnreportedPersistentStats(stats map[string][][]byte) error {
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+
+		for _, statType := range persistentStatTypes {
+
+			bucket := tx.bucket([]byte(statType))
+			for _, key := range stats[statType] {
+				err := bucket.put(key, persistentStatStateUnreported)
+				if err != nil {
+					return err
 				}
 			}
-			serverEntryIDs = append(serverEntryIDs, append([]byte(nil), key...))
-		}
-		cursor.close()
-
-		for i := len(serverEntryIDs) - 1; i > shuffleHead-1; i-- {
-			j := rand.Intn(i+1-shuffleHead) + shuffleHead
-			serverEntryIDs[i], serverEntryIDs[j] = serverEntryIDs[j], serverEntryIDs[i]
 		}
 
 		return nil
 	})
+
 	if err != nil {
 		return common.ContextError(err)
 	}
 
-	iterator.serverEntryIDs = serverEntryIDs
-	iterator.serverEntryIndex = 0
-
 	return nil
 }
 
-// Close cleans up resources associated with a ServerEntryIterator.
-func (iterator *ServerEntryIterator) Close() {
-	iterator.serverEntryIDs = nil
-	iterator.serverEntryIndex = 0
-}
-
-// Next returns the next server entry, by rank, for a ServerEntryIterator.
-// Returns nil with no error when there is no next item.
-func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
-
-	var serverEntry *protocol.ServerEntry
-	var err error
-
-	defer func() {
-		if err != nil {
-			iterator.Close()
-		}
-	}()
-
-	if iterator.isTargetServerEntryIterator {
-		if iterator.hasNextTargetServerEntry {
-			iterator.hasNextTargetServerEntry = false
-			return MakeCompatibleServerEntry(iterator.targetServerEntry), nil
-		}
-		return nil, nil
-	}
-
-	// There are no region/protocol indexes for the server entries bucket.
-	// Loop until we have the next server entry that matches the iterator
-	// filter requirements.
-	for {
-		if iterator.serverEntryIndex >= len(iterator.serverEntryIDs) {
-			// There is no next item
-			return nil, nil
-		}
+// ClearReportedPersistentStats deletes a list of persistent
+// stat records that were successfully reported.
+func ClearReportedPersistentStats(stats map[string][][]byte) error {
 
-		serverEntryID := iterator.serverEntryIDs[iterator.serverEntryIndex]
-		iterator.serverEntryIndex += 1
+	err := datastoreUpdate(func(tx *datastoreTx) error {
 
-		var data []byte
+		for _, statType := range persistentStatTypes {
 
-		err = datastoreView(func(tx *datastoreTx) error {
-			bucket := tx.bucket(datastoreServerEntriesBucket)
-			value := bucket.get(serverEntryID)
-			if value != nil {
-				// Must make a copy as slice is only valid within transaction.
-				data = make([]byte, len(value))
-				copy(data, value)
+			bucket := tx.bucket([]byte(statType))
+			for _, key := range stats[statType] {
+				err := bucket.delete(key)
+				if err != nil {
+					return err
+				}
 			}
-			return nil
-		})
-		if err != nil {
-			return nil, common.ContextError(err)
 		}
 
-		if data == nil {
-			// In case of data corruption or a bug causing this condition,
-			// do not stop iterating.
-			NoticeAlert("ServerEntryIterator.Next: unexpected missing server entry: %s", string(serverEntryID))
-			continue
-		}
-
-		err = json.Unmarshal(data, &serverEntry)
-		if err != nil {
-			// In case of data corruption or a bug causing this condition,
-			// do not stop iterating.
-			NoticeAlert("ServerEntryIterator.Next: %s", common.ContextError(err))
-			continue
-		}
+		return nil
+	})
 
-		if iterator.serverEntryIndex%datastoreServerEntryFetchGCThreshold == 0 {
-			DoGarbageCollection()
-		}
+	if err != nil {
+		return common.ContextError(err)
+	}
 
-		// Check filter requirements
+	return nil
+}
 
-		if iterator.isTacticsServerEntryIterator {
+// resetAllPersistentStatsToUnreported sets all persistent stat
+// records to StateUnreported. This reset is called when the
+// datastore is initialized at start up, as we do not know if
+// persistent records in StateReporting were reported or not.
+func resetAllPersistentStatsToUnreported() error {
 
-			// Tactics doesn't filter by egress region.
-			if len(serverEntry.GetSupportedTacticsProtocols()) > 0 {
-				break
-			}
+	err := datastoreUpdate(func(tx *datastoreTx) error {
 
-		} else {
+		for _, statType := range persistentStatTypes {
 
-			if iterator.config.EgressRegion == "" ||
-				serverEntry.Region == iterator.config.EgressRegion {
-				break
+			bucket := tx.bucket([]byte(statType))
+			resetKeys := make([][]byte, 0)
+			cursor := bucket.cursor()
+			for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+				resetKeys = append(resetKeys, key)
+			}
+			cursor.close()
+			// TODO: data mutation is done outside cursor. Is this
+			// strictly necessary in this case? As is, this means
+			// all stats need to be loaded into memory at once.
+			// https://godoc.org/github.com/boltdb/bolt#Cursor
+			for _, key := range resetKeys {
+				err := bucket.put(key, persistentStatStateUnreported)
+				if err != nil {
+					return err
+				}
 			}
 		}
-	}
 
-	return MakeCompatibleServerEntry(serverEntry), nil
-}
+		return nil
+	})
 
-// MakeCompatibleServerEntry provides backwards compatibility with old server entries
-// which have a single meekFrontingDomain and not a meekFrontingAddresses array.
-// By copying this one meekFrontingDomain into meekFrontingAddresses, this client effectively
-// uses that single value as legacy clients do.
-func MakeCompatibleServerEntry(serverEntry *protocol.ServerEntry) *protocol.ServerEntry {
-	if len(serverEntry.MeekFrontingAddresses) == 0 && serverEntry.MeekFrontingDomain != "" {
-		serverEntry.MeekFrontingAddresses =
-			append(serverEntry.MeekFrontingAddresses, serverEntry.MeekFrontingDomain)
+	if err != nil {
+		return common.ContextError(err)
 	}
 
-	return serverEntry
+	return nil
 }
 
-func scanServerEntries(scanner func(*protocol.ServerEntry)) error {
+// CountSLOKs returns the total number of SLOK records.
+func CountSLOKs() int {
+
+	count := 0
+
 	err := datastoreView(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreServerEntriesBucket)
+		bucket := tx.bucket(datastoreSLOKsBucket)
 		cursor := bucket.cursor()
-		n := 0
-		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
-			var serverEntry *protocol.ServerEntry
-			err := json.Unmarshal(value, &serverEntry)
-			if err != nil {
-				// In case of data corruption or a bug causing this condition,
-				// do not stop iterating.
-				NoticeAlert("scanServerEntries: %s", common.ContextError(err))
-				continue
-			}
-			scanner(serverEntry)
-
-			n += 1
-			if n == datastoreServerEntryFetchGCThreshold {
-				DoGarbageCollection()
-				n = 0
-			}
+		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+			count++
 		}
 		cursor.close()
 		return nil
 	})
 
 	if err != nil {
-		return common.ContextError(err)
+		NoticeAlert("CountSLOKs failed: %s", err)
+		return 0
 	}
 
-	return nil
+	return count
 }
 
-// CountServerEntries returns a count of stored server entries.
-func CountServerEntries() int {
-	count := 0
-	err := scanServerEntries(func(_ *protocol.ServerEntry) {
-		count += 1
+// DeleteSLOKs deletes all SLOK records.
+func DeleteSLOKs() error {
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		return tx.clearBucket(datastoreSLOKsBucket)
 	})
 
 	if err != nil {
-		NoticeAlert("CountServerEntries failed: %s", err)
-		return 0
+		return common.ContextError(err)
 	}
 
-	return count
+	return nil
 }
 
-// CountServerEntriesWithLimits returns a count of stored server entries for
-// the specified region and tunnel protocol limits.
-func CountServerEntriesWithLimits(
-	useUpstreamProxy bool, region string, limitState *limitTunnelProtocolsState) (int, int) {
+// SetSLOK stores a SLOK key, referenced by its ID. The bool
+// return value indicates whether the SLOK was already stored.
+func SetSLOK(id, key []byte) (bool, error) {
 
-	// When CountServerEntriesWithLimits is called only
-	// limitTunnelProtocolState is fixed; excludeIntensive is transitory.
-	excludeIntensive := false
+	var duplicate bool
 
-	initialCount := 0
-	count := 0
-	err := scanServerEntries(func(serverEntry *protocol.ServerEntry) {
-		if region == "" || serverEntry.Region == region {
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreSLOKsBucket)
+		duplicate = bucket.get(id) != nil
+		err := bucket.put([]byte(id), []byte(key))
+		return err
+	})
 
-			if limitState.isInitialCandidate(excludeIntensive, serverEntry) {
-				initialCount += 1
-			}
+	if err != nil {
+		return false, common.ContextError(err)
+	}
 
-			if limitState.isCandidate(excludeIntensive, serverEntry) {
-				count += 1
-			}
+	return duplicate, nil
+}
 
-		}
+// GetSLOK returns a SLOK key for the specified ID. The return
+// value is nil if the SLOK is not found.
+func GetSLOK(id []byte) ([]byte, error) {
+
+	var key []byte
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreSLOKsBucket)
+		key = bucket.get(id)
+		return nil
 	})
 
 	if err != nil {
-		NoticeAlert("CountServerEntriesWithLimits failed: %s", err)
-		return 0, 0
+		return nil, common.ContextError(err)
 	}
 
-	return initialCount, count
+	return key, nil
 }
 
-// ReportAvailableRegions prints a notice with the available egress regions.
-// When limitState has initial protocols, the available regions are limited
-// to those available for the initial protocols; or if limitState has general
-// limited protocols, the available regions are similarly limited.
-func ReportAvailableRegions(config *Config, limitState *limitTunnelProtocolsState) {
-
-	// When ReportAvailableRegions is called only limitTunnelProtocolState is
-	// fixed; excludeIntensive is transitory.
-	excludeIntensive := false
-
-	regions := make(map[string]bool)
-	err := scanServerEntries(func(serverEntry *protocol.ServerEntry) {
+// getSLOKsDigest returns a digest of all stored SLOK records. The digest
+// changes whenever a SLOK is stored or deleted.
+func getSLOKsDigest() ([]byte, error) {
 
-		isCandidate := false
-		if limitState.hasInitialProtocols() {
-			isCandidate = limitState.isInitialCandidate(excludeIntensive, serverEntry)
-		} else {
-			isCandidate = limitState.isCandidate(excludeIntensive, serverEntry)
-		}
+	SLOKs := make(map[string][]byte)
 
-		if isCandidate {
-			regions[serverEntry.Region] = true
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreSLOKsBucket)
+		cursor := bucket.cursor()
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			SLOKs[string(key)] = append([]byte(nil), value...)
 		}
+		cursor.close()
+		return nil
 	})
 
 	if err != nil {
-		NoticeAlert("ReportAvailableRegions failed: %s", err)
-		return
+		return nil, common.ContextError(err)
 	}
 
-	regionList := make([]string, 0, len(regions))
-	for region := range regions {
-		// Some server entries do not have a region, but it makes no sense to return
-		// an empty string as an "available region".
-		if region != "" {
-			regionList = append(regionList, region)
+	// Sort the SLOK IDs so the digest is independent of the datastore
+	// iteration order.
+	IDs := make([]string, 0, len(SLOKs))
+	for ID := range SLOKs {
+		IDs = append(IDs, ID)
+	}
+	sort.Strings(IDs)
+
+	hash := sha256.New()
+	for _, ID := range IDs {
+		for _, value := range [][]byte{[]byte(ID), SLOKs[ID]} {
+			var length [4]byte
+			binary.BigEndian.PutUint32(length[:], uint32(len(value)))
+			hash.Write(length[:])
+			hash.Write(value)
 		}
 	}
 
-	NoticeAvailableEgressRegions(regionList)
+	return hash.Sum(nil), nil
 }
 
-// SetSplitTunnelRoutes updates the cached routes data for
-// the given region. The associated etag is also stored and
-// used to make efficient web requests for updates to the data.
-func SetSplitTunnelRoutes(region, etag string, data []byte) error {
+// setImportedContentDigest stores the content digest of the remote server
+// list resource last imported from the specified canonical URL.
+func setImportedContentDigest(canonicalURL, digest string) error {
 
 	err := datastoreUpdate(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreSplitTunnelRouteETagsBucket)
-		err := bucket.put([]byte(region), []byte(etag))
-
-		bucket = tx.bucket(datastoreSplitTunnelRouteDataBucket)
-		err = bucket.put([]byte(region), data)
-		return err
+		bucket := tx.bucket(datastoreImportedContentDigestsBucket)
+		return bucket.put([]byte(canonicalURL), []byte(digest))
 	})
 
 	if err != nil {
@@ -778,37 +3373,55 @@ func SetSplitTunnelRoutes(region, etag string, data []byte) error {
 	return nil
 }
 
-// GetSplitTunnelRoutesETag retrieves the etag for cached routes
-// data for the specified region. If not found, it returns an empty string value.
-func GetSplitTunnelRoutesETag(region string) (string, error) {
+// getImportedContentDigest retrieves the digest stored by
+// setImportedContentDigest for the specified canonical URL. If not found, it
+// returns a blank digest.
+func getImportedContentDigest(canonicalURL string) (string, error) {
 
-	var etag string
+	var digest string
 
 	err := datastoreView(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreSplitTunnelRouteETagsBucket)
-		etag = string(bucket.get([]byte(region)))
+		bucket := tx.bucket(datastoreImportedContentDigestsBucket)
+		digest = string(bucket.get([]byte(canonicalURL)))
 		return nil
 	})
 
 	if err != nil {
 		return "", common.ContextError(err)
 	}
-	return etag, nil
+	return digest, nil
 }
 
-// GetSplitTunnelRoutesData retrieves the cached routes data
-// for the specified region. If not found, it returns a nil value.
-func GetSplitTunnelRoutesData(region string) ([]byte, error) {
+// setOSLImportedMD5Sum stores the registry advertised MD5 sum of the OSL
+// file last imported from the specified canonical URL. A nil MD5 sum deletes
+// any stored MD5 sum.
+func setOSLImportedMD5Sum(canonicalURL string, md5Sum []byte) error {
 
-	var data []byte
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreOSLImportedMD5SumsBucket)
+		if len(md5Sum) == 0 {
+			return bucket.delete([]byte(canonicalURL))
+		}
+		return bucket.put([]byte(canonicalURL), md5Sum)
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// getOSLImportedMD5Sum retrieves the MD5 sum stored by setOSLImportedMD5Sum
+// for the specified canonical URL. If not found, it returns nil.
+func getOSLImportedMD5Sum(canonicalURL string) ([]byte, error) {
+
+	var md5Sum []byte
 
 	err := datastoreView(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreSplitTunnelRouteDataBucket)
-		value := bucket.get([]byte(region))
+		bucket := tx.bucket(datastoreOSLImportedMD5SumsBucket)
+		value := bucket.get([]byte(canonicalURL))
 		if value != nil {
-			// Must make a copy as slice is only valid within transaction.
-			data = make([]byte, len(value))
-			copy(data, value)
+			md5Sum = append([]byte(nil), value...)
 		}
 		return nil
 	})
@@ -816,18 +3429,20 @@ func GetSplitTunnelRoutesData(region string) ([]byte, error) {
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
-	return data, nil
+	return md5Sum, nil
 }
 
-// SetUrlETag stores an ETag for the specfied URL.
-// Note: input URL is treated as a string, and is not
-// encoded or decoded or otherwise canonicalized.
-func SetUrlETag(url, etag string) error {
+// setOSLFetchFingerprint stores the fingerprint of the last complete
+// obfuscated server list fetch from the specified registry URL. A blank
+// fingerprint deletes any stored fingerprint.
+func setOSLFetchFingerprint(registryURL, fingerprint string) error {
 
 	err := datastoreUpdate(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreUrlETagsBucket)
-		err := bucket.put([]byte(url), []byte(etag))
-		return err
+		bucket := tx.bucket(datastoreOSLFetchFingerprintsBucket)
+		if fingerprint == "" {
+			return bucket.delete([]byte(registryURL))
+		}
+		return bucket.put([]byte(registryURL), []byte(fingerprint))
 	})
 
 	if err != nil {
@@ -836,215 +3451,518 @@ func SetUrlETag(url, etag string) error {
 	return nil
 }
 
-// GetUrlETag retrieves a previously stored an ETag for the
-// specfied URL. If not found, it returns an empty string value.
-func GetUrlETag(url string) (string, error) {
+// getOSLFetchFingerprint retrieves the fingerprint stored by
+// setOSLFetchFingerprint for the specified registry URL. If not found, it
+// returns a blank fingerprint.
+func getOSLFetchFingerprint(registryURL string) (string, error) {
 
-	var etag string
+	var fingerprint string
 
 	err := datastoreView(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreUrlETagsBucket)
-		etag = string(bucket.get([]byte(url)))
+		bucket := tx.bucket(datastoreOSLFetchFingerprintsBucket)
+		fingerprint = string(bucket.get([]byte(registryURL)))
 		return nil
 	})
 
 	if err != nil {
 		return "", common.ContextError(err)
 	}
-	return etag, nil
+	return fingerprint, nil
 }
 
-// SetKeyValue stores a key/value pair.
-func SetKeyValue(key, value string) error {
+// setOSLRegistryGeneration stores the highest OSL registry generation
+// accepted from the specified registry URL.
+func setOSLRegistryGeneration(registryURL string, generation int64) error {
 
 	err := datastoreUpdate(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreKeyValueBucket)
-		err := bucket.put([]byte(key), []byte(value))
+		bucket := tx.bucket(datastoreOSLRegistryGenerationsBucket)
+		return bucket.put(
+			[]byte(registryURL), []byte(strconv.FormatInt(generation, 10)))
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// getOSLRegistryGeneration retrieves the generation stored by
+// setOSLRegistryGeneration for the specified registry URL. If not found, it
+// returns 0.
+func getOSLRegistryGeneration(registryURL string) (int64, error) {
+
+	var generation int64
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreOSLRegistryGenerationsBucket)
+		value := bucket.get([]byte(registryURL))
+		if value == nil {
+			return nil
+		}
+		var err error
+		generation, err = strconv.ParseInt(string(value), 10, 64)
 		return err
 	})
 
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+	return generation, nil
+}
+
+// setOSLRegistryFetchTime stores the time of the last successful download,
+// changed or unchanged, of the OSL registry at the specified registry URL.
+func setOSLRegistryFetchTime(registryURL string, fetchTime time.Time) error {
+
+	err := setBucketValue(
+		datastoreOSLRegistryFetchTimesBucket,
+		[]byte(registryURL),
+		[]byte(fetchTime.UTC().Format(time.RFC3339Nano)))
 	if err != nil {
 		return common.ContextError(err)
 	}
 	return nil
 }
 
-// GetKeyValue retrieves the value for a given key. If not found,
-// it returns an empty string value.
-func GetKeyValue(key string) (string, error) {
+// getOSLRegistryFetchTime retrieves the time stored by
+// setOSLRegistryFetchTime for the specified registry URL. If not found, it
+// returns the zero time.
+func getOSLRegistryFetchTime(registryURL string) (time.Time, error) {
 
-	var value string
+	var fetchTime time.Time
 
 	err := datastoreView(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreKeyValueBucket)
-		value = string(bucket.get([]byte(key)))
-		return nil
+		bucket := tx.bucket(datastoreOSLRegistryFetchTimesBucket)
+		value := bucket.get([]byte(registryURL))
+		if value == nil {
+			return nil
+		}
+		var err error
+		fetchTime, err = time.Parse(time.RFC3339Nano, string(value))
+		return err
 	})
 
 	if err != nil {
-		return "", common.ContextError(err)
+		return time.Time{}, common.ContextError(err)
 	}
-	return value, nil
+	return fetchTime, nil
 }
 
-// Persistent stat records in the persistentStatStateUnreported
-// state are available for take out.
-//
-// Records in the persistentStatStateReporting have been taken
-// out and are pending either deletion (for a successful request)
-// or change to StateUnreported (for a failed request).
-//
-// All persistent stat records are reverted to StateUnreported
-// when the datastore is initialized at start up.
+// oslRegistryDeltaProgress is the progress of applying the registry delta
+// with the response ETag ETag. RemainingIDs are the IDs of the delta file
+// specs which remain to be applied, and AppliedIDs are the IDs of the delta
+// file specs which are applied.
+type oslRegistryDeltaProgress struct {
+	ETag         string
+	RemainingIDs [][]byte
+	AppliedIDs   [][]byte
+}
 
-var persistentStatStateUnreported = []byte("0")
-var persistentStatStateReporting = []byte("1")
+// isApplied indicates whether the delta file spec with the specified OSL ID
+// is applied.
+func (progress *oslRegistryDeltaProgress) isApplied(oslID []byte) bool {
+	for _, ID := range progress.AppliedIDs {
+		if bytes.Equal(ID, oslID) {
+			return true
+		}
+	}
+	return false
+}
 
-var persistentStatTypes = []string{
-	datastorePersistentStatTypeRemoteServerList,
+// setOSLRegistryDeltaProgress stores the progress of applying a new registry
+// delta, with no delta file specs yet applied, for the specified registry
+// URL, replacing any existing progress.
+func setOSLRegistryDeltaProgress(
+	registryURL, ETag string, remainingIDs [][]byte) error {
+
+	data, err := json.Marshal(&oslRegistryDeltaProgress{
+		ETag:         ETag,
+		RemainingIDs: remainingIDs,
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = setBucketValue(
+		datastoreOSLRegistryDeltaProgressBucket, []byte(registryURL), data)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
 }
 
-// StorePersistentStat adds a new persistent stat record, which
-// is set to StateUnreported and is an immediate candidate for
-// reporting.
-//
-// The stat is a JSON byte array containing fields as
-// required by the Psiphon server API. It's assumed that the
-// JSON value contains enough unique information for the value to
-// function as a key in the key/value datastore. This assumption
-// is currently satisfied by the fields sessionId + tunnelNumber
-// for tunnel stats, and URL + ETag for remote server list stats.
-func StorePersistentStat(statType string, stat []byte) error {
+// getOSLRegistryDeltaProgress retrieves the progress stored by
+// setOSLRegistryDeltaProgress for the specified registry URL. If not found,
+// it returns nil.
+func getOSLRegistryDeltaProgress(registryURL string) (*oslRegistryDeltaProgress, error) {
 
-	if !common.Contains(persistentStatTypes, statType) {
-		return common.ContextError(fmt.Errorf("invalid persistent stat type: %s", statType))
+	data, err := getBucketValue(
+		datastoreOSLRegistryDeltaProgressBucket, []byte(registryURL))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if data == nil {
+		return nil, nil
 	}
 
+	var progress *oslRegistryDeltaProgress
+	err = json.Unmarshal(data, &progress)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return progress, nil
+}
+
+// completeOSLRegistryDeltaOperation records that the delta file spec with
+// the specified OSL ID is applied, and returns the number of delta file
+// specs which remain to be applied. Once all delta file specs are applied,
+// the progress is deleted.
+func completeOSLRegistryDeltaOperation(registryURL string, oslID []byte) (int, error) {
+
+	remaining := 0
+
 	err := datastoreUpdate(func(tx *datastoreTx) error {
-		bucket := tx.bucket([]byte(statType))
-		err := bucket.put(stat, persistentStatStateUnreported)
-		return err
+
+		bucket := tx.bucket(datastoreOSLRegistryDeltaProgressBucket)
+
+		data := bucket.get([]byte(registryURL))
+		if data == nil {
+			return nil
+		}
+
+		var progress *oslRegistryDeltaProgress
+		err := json.Unmarshal(data, &progress)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		remainingIDs := make([][]byte, 0, len(progress.RemainingIDs))
+		for _, ID := range progress.RemainingIDs {
+			if bytes.Equal(ID, oslID) {
+				progress.AppliedIDs = append(progress.AppliedIDs, ID)
+			} else {
+				remainingIDs = append(remainingIDs, ID)
+			}
+		}
+
+		remaining = len(remainingIDs)
+		if remaining == len(progress.RemainingIDs) {
+			// The OSL ID isn't a remaining delta file spec.
+			return nil
+		}
+		progress.RemainingIDs = remainingIDs
+
+		if remaining == 0 {
+			return bucket.delete([]byte(registryURL))
+		}
+
+		data, err = json.Marshal(progress)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		return bucket.put([]byte(registryURL), data)
+	})
+
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+	return remaining, nil
+}
+
+// deleteOSLRegistryDeltaProgress deletes any progress stored for the
+// specified registry URL.
+func deleteOSLRegistryDeltaProgress(registryURL string) error {
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		return tx.bucket(datastoreOSLRegistryDeltaProgressBucket).delete(
+			[]byte(registryURL))
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// oslImportGeneration marks the OSL file for an OSL ID as imported while
+// processing the registry at RegistryURL with the specified registry
+// generation. MD5Sum is the OSL file checksum advertised by that registry.
+type oslImportGeneration struct {
+	RegistryURL string
+	Generation  int64
+	MD5Sum      []byte
+}
+
+// setOSLImportGeneration stores the import generation for the specified OSL
+// ID, replacing any existing import generation.
+func setOSLImportGeneration(oslID []byte, importGeneration *oslImportGeneration) error {
+
+	value, err := json.Marshal(importGeneration)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = setBucketValue(datastoreOSLImportGenerationsBucket, oslID, value)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// getOSLImportGeneration retrieves the import generation stored by
+// setOSLImportGeneration for the specified OSL ID. If not found, it returns
+// nil.
+func getOSLImportGeneration(oslID []byte) (*oslImportGeneration, error) {
+
+	value, err := getBucketValue(datastoreOSLImportGenerationsBucket, oslID)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if value == nil {
+		return nil, nil
+	}
+
+	var importGeneration *oslImportGeneration
+	err = json.Unmarshal(value, &importGeneration)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return importGeneration, nil
+}
+
+// An OSL fetch plan, for a registry URL, is stored as a header record and a
+// record for each remaining OSL. Plan records are keyed by a plan ID, derived
+// from the registry URL; the header record key is the plan ID and each OSL
+// record key is the plan ID followed by the OSL ID. The header record value
+// is the fetch fingerprint the plan was made for.
+const oslFetchPlanIDLength = 8
+
+// oslFetchPlanRecord is a remaining OSL in a fetch plan. Order is the
+// position of the OSL in the plan.
+type oslFetchPlanRecord struct {
+	Order    int
+	FileSpec *osl.OSLFileSpec
+}
+
+func makeOSLFetchPlanID(registryURL string) []byte {
+	digest := sha256.Sum256([]byte(registryURL))
+	return digest[:oslFetchPlanIDLength]
+}
+
+// deleteOSLFetchPlanRecords deletes the header and all OSL records of the
+// specified plan.
+func deleteOSLFetchPlanRecords(tx *datastoreTx, planID []byte) error {
+
+	bucket := tx.bucket(datastoreOSLFetchPlansBucket)
+
+	// Collect keys before modifying the bucket, as the cursor may not be
+	// used to iterate over a bucket while it is being modified.
+	var keys [][]byte
+	cursor := bucket.cursor()
+	for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+		if bytes.HasPrefix(key, planID) {
+			keys = append(keys, append([]byte(nil), key...))
+		}
+	}
+	cursor.close()
+
+	for _, key := range keys {
+		err := bucket.delete(key)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	return nil
+}
+
+// setOSLFetchPlan stores a fetch plan, consisting of the specified OSL file
+// specs in order, for the specified registry URL, replacing any existing
+// plan.
+func setOSLFetchPlan(
+	registryURL, fingerprint string, fileSpecs []*osl.OSLFileSpec) error {
+
+	planID := makeOSLFetchPlanID(registryURL)
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+
+		err := deleteOSLFetchPlanRecords(tx, planID)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		bucket := tx.bucket(datastoreOSLFetchPlansBucket)
+
+		err = bucket.put(planID, []byte(fingerprint))
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		for i, fileSpec := range fileSpecs {
+			data, err := json.Marshal(
+				&oslFetchPlanRecord{Order: i, FileSpec: fileSpec})
+			if err != nil {
+				return common.ContextError(err)
+			}
+			key := append(append([]byte(nil), planID...), fileSpec.ID...)
+			err = bucket.put(key, data)
+			if err != nil {
+				return common.ContextError(err)
+			}
+		}
+
+		return nil
 	})
 
 	if err != nil {
 		return common.ContextError(err)
 	}
-
 	return nil
 }
 
-// CountUnreportedPersistentStats returns the number of persistent
-// stat records in StateUnreported.
-func CountUnreportedPersistentStats() int {
+// getOSLFetchPlan retrieves the fetch plan stored by setOSLFetchPlan for the
+// specified registry URL, returning the plan fingerprint and the OSL file
+// specs remaining in the plan, in order. If not found, it returns a blank
+// fingerprint.
+func getOSLFetchPlan(registryURL string) (string, []*osl.OSLFileSpec, error) {
 
-	unreported := 0
+	planID := makeOSLFetchPlanID(registryURL)
+
+	var fingerprint string
+	var records []*oslFetchPlanRecord
 
 	err := datastoreView(func(tx *datastoreTx) error {
 
-		for _, statType := range persistentStatTypes {
+		bucket := tx.bucket(datastoreOSLFetchPlansBucket)
 
-			bucket := tx.bucket([]byte(statType))
-			cursor := bucket.cursor()
-			for key, value := cursor.first(); key != nil; key, value = cursor.next() {
-				if 0 == bytes.Compare(value, persistentStatStateUnreported) {
-					unreported++
-					break
-				}
+		fingerprint = string(bucket.get(planID))
+		if fingerprint == "" {
+			return nil
+		}
+
+		cursor := bucket.cursor()
+		defer cursor.close()
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			if len(key) <= len(planID) || !bytes.HasPrefix(key, planID) {
+				continue
 			}
-			cursor.close()
+			var record *oslFetchPlanRecord
+			err := json.Unmarshal(value, &record)
+			if err != nil || record.FileSpec == nil {
+				// In case of data corruption or a bug causing this condition,
+				// do not stop iterating.
+				NoticeAlert("getOSLFetchPlan: invalid record")
+				continue
+			}
+			records = append(records, record)
 		}
 		return nil
 	})
 
 	if err != nil {
-		NoticeAlert("CountUnreportedPersistentStats failed: %s", err)
-		return 0
+		return "", nil, common.ContextError(err)
 	}
 
-	return unreported
-}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Order < records[j].Order
+	})
 
-// TakeOutUnreportedPersistentStats returns up to maxCount persistent
-// stats records that are in StateUnreported. The records are set to
-// StateReporting. If the records are successfully reported, clear them
-// with ClearReportedPersistentStats. If the records are not successfully
-// reported, restore them with PutBackUnreportedPersistentStats.
-func TakeOutUnreportedPersistentStats(maxCount int) (map[string][][]byte, error) {
+	fileSpecs := make([]*osl.OSLFileSpec, len(records))
+	for i, record := range records {
+		fileSpecs[i] = record.FileSpec
+	}
 
-	stats := make(map[string][][]byte)
+	return fingerprint, fileSpecs, nil
+}
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+// deleteOSLFetchPlanEntry removes the specified OSL from the fetch plan for
+// the specified registry URL.
+func deleteOSLFetchPlanEntry(registryURL string, oslID []byte) error {
 
-		count := 0
+	key := append(makeOSLFetchPlanID(registryURL), oslID...)
 
-		for _, statType := range persistentStatTypes {
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		return tx.bucket(datastoreOSLFetchPlansBucket).delete(key)
+	})
 
-			bucket := tx.bucket([]byte(statType))
-			cursor := bucket.cursor()
-			for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
 
-				if count >= maxCount {
-					break
-				}
+// deleteOSLFetchPlan deletes any fetch plan for the specified registry URL.
+func deleteOSLFetchPlan(registryURL string) error {
 
-				// Perform a test JSON unmarshaling. In case of data corruption or a bug,
-				// skip the record.
-				var jsonData interface{}
-				err := json.Unmarshal(key, &jsonData)
-				if err != nil {
-					NoticeAlert(
-						"Invalid key in TakeOutUnreportedPersistentStats: %s: %s",
-						string(key), err)
-					continue
-				}
+	planID := makeOSLFetchPlanID(registryURL)
 
-				if 0 == bytes.Compare(value, persistentStatStateUnreported) {
-					// Must make a copy as slice is only valid within transaction.
-					data := make([]byte, len(key))
-					copy(data, key)
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		return deleteOSLFetchPlanRecords(tx, planID)
+	})
 
-					if stats[statType] == nil {
-						stats[statType] = make([][]byte, 0)
-					}
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
 
-					stats[statType] = append(stats[statType], data)
-					count += 1
-				}
-			}
-			cursor.close()
+// OSL download attempt records form a ring buffer, keyed by a big-endian
+// sequence number, so that the oldest record has the lowest key.
+const oslDownloadAttemptKeyLength = 8
 
-			for _, key := range stats[statType] {
-				err := bucket.put(key, persistentStatStateReporting)
-				if err != nil {
-					return err
-				}
-			}
+// getSortedOSLDownloadAttemptKeys returns the keys of all OSL download
+// attempt records, oldest first. The keys are sorted, rather than relying
+// on the cursor order, which may differ between datastore implementations.
+func getSortedOSLDownloadAttemptKeys(tx *datastoreTx) [][]byte {
 
+	var keys [][]byte
+	cursor := tx.bucket(datastoreOSLDownloadAttemptsBucket).cursor()
+	for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+		if len(key) == oslDownloadAttemptKeyLength {
+			keys = append(keys, append([]byte(nil), key...))
 		}
-		return nil
-	})
-
-	if err != nil {
-		return nil, common.ContextError(err)
 	}
+	cursor.close()
 
-	return stats, nil
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+
+	return keys
 }
 
-// PutBackUnreportedPersistentStats restores a list of persistent
-// stat records to StateUnreported.
-func PutBackUnreportedPersistentStats(stats map[string][][]byte) error {
+// appendOSLDownloadAttempt stores an OSL download attempt record, deleting
+// the oldest records so that no more than maxCount records are retained.
+func appendOSLDownloadAttempt(record []byte, maxCount int) error {
 
 	err := datastoreUpdate(func(tx *datastoreTx) error {
 
-		for _, statType := range persistentStatTypes {
+		bucket := tx.bucket(datastoreOSLDownloadAttemptsBucket)
 
-			bucket := tx.bucket([]byte(statType))
-			for _, key := range stats[statType] {
-				err := bucket.put(key, persistentStatStateUnreported)
-				if err != nil {
-					return err
-				}
+		keys := getSortedOSLDownloadAttemptKeys(tx)
+
+		var sequence uint64
+		if len(keys) > 0 {
+			sequence = binary.BigEndian.Uint64(keys[len(keys)-1]) + 1
+		}
+
+		key := make([]byte, oslDownloadAttemptKeyLength)
+		binary.BigEndian.PutUint64(key, sequence)
+
+		err := bucket.put(key, record)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		// The new record is in addition to the collected keys.
+		for i := 0; i < len(keys)+1-maxCount; i++ {
+			err := bucket.delete(keys[i])
+			if err != nil {
+				return common.ContextError(err)
 			}
 		}
 
@@ -1054,67 +3972,79 @@ func PutBackUnreportedPersistentStats(stats map[string][][]byte) error {
 	if err != nil {
 		return common.ContextError(err)
 	}
-
 	return nil
 }
 
-// ClearReportedPersistentStats deletes a list of persistent
-// stat records that were successfully reported.
-func ClearReportedPersistentStats(stats map[string][][]byte) error {
-
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+// getOSLDownloadAttempts returns all stored OSL download attempt records,
+// oldest first.
+func getOSLDownloadAttempts() ([][]byte, error) {
 
-		for _, statType := range persistentStatTypes {
+	var records [][]byte
 
-			bucket := tx.bucket([]byte(statType))
-			for _, key := range stats[statType] {
-				err := bucket.delete(key)
-				if err != nil {
-					return err
-				}
-			}
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreOSLDownloadAttemptsBucket)
+		for _, key := range getSortedOSLDownloadAttemptKeys(tx) {
+			records = append(records, append([]byte(nil), bucket.get(key)...))
 		}
-
 		return nil
 	})
 
 	if err != nil {
-		return common.ContextError(err)
+		return nil, common.ContextError(err)
 	}
-
-	return nil
+	return records, nil
 }
 
-// resetAllPersistentStatsToUnreported sets all persistent stat
-// records to StateUnreported. This reset is called when the
-// datastore is initialized at start up, as we do not know if
-// persistent records in StateReporting were reported or not.
-func resetAllPersistentStatsToUnreported() error {
+// oslQuarantineRecord tracks validation failures for an individual OSL.
+// Failures is the number of consecutive failures. When the OSL has been
+// quarantined, QuarantinedUntil is the time after which the OSL may be
+// downloaded again.
+type oslQuarantineRecord struct {
+	Failures         int
+	QuarantinedUntil time.Time
+}
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+// getOSLQuarantineRecord returns the quarantine record for the specified OSL
+// ID. The return value is nil if no record is found.
+func getOSLQuarantineRecord(oslID []byte) (*oslQuarantineRecord, error) {
 
-		for _, statType := range persistentStatTypes {
+	var record *oslQuarantineRecord
 
-			bucket := tx.bucket([]byte(statType))
-			resetKeys := make([][]byte, 0)
-			cursor := bucket.cursor()
-			for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
-				resetKeys = append(resetKeys, key)
-			}
-			cursor.close()
-			// TODO: data mutation is done outside cursor. Is this
-			// strictly necessary in this case? As is, this means
-			// all stats need to be loaded into memory at once.
-			// https://godoc.org/github.com/boltdb/bolt#Cursor
-			for _, key := range resetKeys {
-				err := bucket.put(key, persistentStatStateUnreported)
-				if err != nil {
-					return err
-				}
-			}
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreOSLQuarantineBucket)
+		value := bucket.get(oslID)
+		if value == nil {
+			return nil
 		}
+		return json.Unmarshal(value, &record)
+	})
 
-		return nil
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return record, nil
+}
+
+// setOSLQuarantineRecord stores the quarantine record for the specified OSL
+// ID, replacing any existing record.
+func setOSLQuarantineRecord(oslID []byte, record *oslQuarantineRecord) error {
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return setBucketValue(datastoreOSLQuarantineBucket, oslID, data)
+}
+
+// deleteOSLQuarantineRecord deletes any quarantine record for the specified
+// OSL ID.
+func deleteOSLQuarantineRecord(oslID []byte) error {
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreOSLQuarantineBucket)
+		return bucket.delete(oslID)
 	})
 
 	if err != nil {
@@ -1124,34 +4054,66 @@ func resetAllPersistentStatsToUnreported() error {
 	return nil
 }
 
-// CountSLOKs returns the total number of SLOK records.
-func CountSLOKs() int {
+// oslPendingImportRecord records an OSL file downloaded and validated by
+// DownloadObfuscatedServerLists, which is pending import. FileSpec is the
+// registry file spec used to read the file, URL is the download URL, which is
+// recorded as the server entry provenance, and CanonicalURL is the URL
+// associated with the stored ETag.
+type oslPendingImportRecord struct {
+	FileSpec     *osl.OSLFileSpec
+	URL          string
+	CanonicalURL string
+}
 
-	count := 0
+// getOSLPendingImportRecords returns all OSL pending import records.
+func getOSLPendingImportRecords() ([]*oslPendingImportRecord, error) {
+
+	var records []*oslPendingImportRecord
 
 	err := datastoreView(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreSLOKsBucket)
+		bucket := tx.bucket(datastoreOSLPendingImportBucket)
 		cursor := bucket.cursor()
-		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
-			count++
+		defer cursor.close()
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			var record *oslPendingImportRecord
+			err := json.Unmarshal(value, &record)
+			if err != nil {
+				// In case of data corruption or a bug causing this condition,
+				// do not stop iterating.
+				NoticeAlert("getOSLPendingImportRecords: %s", common.ContextError(err))
+				continue
+			}
+			records = append(records, record)
 		}
-		cursor.close()
 		return nil
 	})
 
 	if err != nil {
-		NoticeAlert("CountSLOKs failed: %s", err)
-		return 0
+		return nil, common.ContextError(err)
 	}
 
-	return count
+	return records, nil
 }
 
-// DeleteSLOKs deletes all SLOK records.
-func DeleteSLOKs() error {
+// setOSLPendingImportRecord stores the pending import record for the
+// specified OSL ID, replacing any existing record.
+func setOSLPendingImportRecord(oslID []byte, record *oslPendingImportRecord) error {
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return setBucketValue(datastoreOSLPendingImportBucket, oslID, data)
+}
+
+// deleteOSLPendingImportRecord deletes any pending import record for the
+// specified OSL ID.
+func deleteOSLPendingImportRecord(oslID []byte) error {
 
 	err := datastoreUpdate(func(tx *datastoreTx) error {
-		return tx.clearBucket(datastoreSLOKsBucket)
+		bucket := tx.bucket(datastoreOSLPendingImportBucket)
+		return bucket.delete(oslID)
 	})
 
 	if err != nil {
@@ -1161,43 +4123,77 @@ func DeleteSLOKs() error {
 	return nil
 }
 
-// SetSLOK stores a SLOK key, referenced by its ID. The bool
-// return value indicates whether the SLOK was already stored.
-func SetSLOK(id, key []byte) (bool, error) {
+// oslImportTime is the time at which the OSL file for OSLID, retained in the
+// download directory, was last imported.
+type oslImportTime struct {
+	OSLID      []byte
+	ImportTime time.Time
+}
 
-	var duplicate bool
+// getOSLImportTimes returns all OSL import times, least recently imported
+// first.
+func getOSLImportTimes() ([]*oslImportTime, error) {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreSLOKsBucket)
-		duplicate = bucket.get(id) != nil
-		err := bucket.put([]byte(id), []byte(key))
-		return err
+	var importTimes []*oslImportTime
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreOSLImportTimesBucket)
+		cursor := bucket.cursor()
+		defer cursor.close()
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			importTime, err := time.Parse(time.RFC3339Nano, string(value))
+			if err != nil {
+				// In case of data corruption or a bug causing this condition,
+				// do not stop iterating.
+				NoticeAlert("getOSLImportTimes: %s", common.ContextError(err))
+				continue
+			}
+			importTimes = append(importTimes, &oslImportTime{
+				OSLID:      append([]byte(nil), key...),
+				ImportTime: importTime,
+			})
+		}
+		return nil
 	})
 
 	if err != nil {
-		return false, common.ContextError(err)
+		return nil, common.ContextError(err)
 	}
 
-	return duplicate, nil
+	sort.SliceStable(importTimes, func(i, j int) bool {
+		return importTimes[i].ImportTime.Before(importTimes[j].ImportTime)
+	})
+
+	return importTimes, nil
 }
 
-// GetSLOK returns a SLOK key for the specified ID. The return
-// value is nil if the SLOK is not found.
-func GetSLOK(id []byte) ([]byte, error) {
+// setOSLImportTime stores the time at which the OSL file for the specified
+// OSL ID was imported, replacing any existing time.
+func setOSLImportTime(oslID []byte, importTime time.Time) error {
 
-	var key []byte
+	err := setBucketValue(
+		datastoreOSLImportTimesBucket,
+		oslID,
+		[]byte(importTime.UTC().Format(time.RFC3339Nano)))
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
 
-	err := datastoreView(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreSLOKsBucket)
-		key = bucket.get(id)
-		return nil
+// deleteOSLImportTime deletes any import time for the specified OSL ID.
+func deleteOSLImportTime(oslID []byte) error {
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreOSLImportTimesBucket)
+		return bucket.delete(oslID)
 	})
 
 	if err != nil {
-		return nil, common.ContextError(err)
+		return common.ContextError(err)
 	}
 
-	return key, nil
+	return nil
 }
 
 // TacticsStorer implements tactics.Storer.
@@ -93,6 +93,21 @@ func (db *datastoreDB) close() error {
 	return db.badgerDB.Close()
 }
 
+// compact runs value log garbage collection, rewriting value log files which
+// are at least half stale, until no file qualifies. The LSM tree is already
+// compacted continuously, by badger's compactors.
+func (db *datastoreDB) compact() (bool, error) {
+	for {
+		err := db.badgerDB.RunValueLogGC(0.5)
+		if err == badger.ErrNoRewrite {
+			return true, nil
+		}
+		if err != nil {
+			return false, common.ContextError(err)
+		}
+	}
+}
+
 func (db *datastoreDB) view(fn func(tx *datastoreTx) error) error {
 	return db.badgerDB.View(
 		func(tx *badger.Txn) error {
@@ -105,7 +120,7 @@ func (db *datastoreDB) view(fn func(tx *datastoreTx) error) error {
 }
 
 func (db *datastoreDB) update(fn func(tx *datastoreTx) error) error {
-	return db.badgerDB.Update(
+	err := db.badgerDB.Update(
 		func(tx *badger.Txn) error {
 			err := fn(&datastoreTx{badgerTx: tx})
 			if err != nil {
@@ -113,6 +128,12 @@ func (db *datastoreDB) update(fn func(tx *datastoreTx) error) error {
 			}
 			return nil
 		})
+	// The transaction conflicted with a concurrent transaction, and may
+	// succeed when retried.
+	if err == badger.ErrConflict {
+		return datastoreLockedError{err: err}
+	}
+	return err
 }
 
 func (tx *datastoreTx) bucket(name []byte) *datastoreBucket {
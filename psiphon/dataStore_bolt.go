@@ -22,6 +22,7 @@
 package psiphon
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"time"
@@ -100,6 +101,23 @@ func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
 			datastoreSLOKsBucket,
 			datastoreTacticsBucket,
 			datastoreSpeedTestSamplesBucket,
+			datastoreOSLQuarantineBucket,
+			datastoreServerEntryProvenanceBucket,
+			datastoreUrlValidatedTimesBucket,
+			datastoreUrlNextFetchTimesBucket,
+			datastoreOSLPendingImportBucket,
+			datastoreServerEntryImportJournalBucket,
+			datastoreServerEntryReachabilityBucket,
+			datastoreOSLFetchFingerprintsBucket,
+			datastoreOSLFetchPlansBucket,
+			datastoreOSLDownloadAttemptsBucket,
+			datastoreOSLImportTimesBucket,
+			datastoreOSLRegistryGenerationsBucket,
+			datastoreOSLRegistryFetchTimesBucket,
+			datastoreOSLRegistryDeltaProgressBucket,
+			datastoreOSLImportGenerationsBucket,
+			datastoreImportedContentDigestsBucket,
+			datastoreOSLImportedMD5SumsBucket,
 		}
 		for _, bucket := range requiredBuckets {
 			_, err := tx.CreateBucketIfNotExists(bucket)
@@ -142,6 +160,87 @@ func (db *datastoreDB) close() error {
 	return db.boltDB.Close()
 }
 
+// compact copies all buckets to a new datastore file, which replaces the
+// existing file. bolt doesn't shrink its file, so the pages freed by deleted
+// and updated records are only reclaimed by rewriting the file. The caller
+// must ensure there are no concurrent transactions.
+func (db *datastoreDB) compact() (bool, error) {
+
+	filename := db.boltDB.Path()
+	compactFilename := filename + ".compact"
+
+	os.Remove(compactFilename)
+
+	err := db.copyTo(compactFilename)
+	if err != nil {
+		os.Remove(compactFilename)
+		return false, common.ContextError(err)
+	}
+
+	err = db.boltDB.Close()
+	if err != nil {
+		os.Remove(compactFilename)
+		return false, common.ContextError(err)
+	}
+
+	// When the compacted file can't replace the existing file, the existing
+	// file is reopened.
+	renameErr := os.Rename(compactFilename, filename)
+	if renameErr != nil {
+		os.Remove(compactFilename)
+	}
+
+	newDB, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+	db.boltDB = newDB
+
+	if renameErr != nil {
+		return false, common.ContextError(renameErr)
+	}
+
+	return true, nil
+}
+
+func (db *datastoreDB) copyTo(filename string) error {
+
+	compactDB, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = db.boltDB.View(func(tx *bolt.Tx) error {
+		return compactDB.Update(func(compactTx *bolt.Tx) error {
+			return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+				compactBucket, err := compactTx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				// Keys are copied in order, so pages may be filled.
+				compactBucket.FillPercent = 1.0
+				return bucket.ForEach(func(key, value []byte) error {
+					if value == nil {
+						return errors.New("unexpected nested bucket")
+					}
+					return compactBucket.Put(key, value)
+				})
+			})
+		})
+	})
+	if err != nil {
+		compactDB.Close()
+		return common.ContextError(err)
+	}
+
+	err = compactDB.Close()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
 func (db *datastoreDB) view(fn func(tx *datastoreTx) error) error {
 	return db.boltDB.View(
 		func(tx *bolt.Tx) error {
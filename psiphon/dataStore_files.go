@@ -132,6 +132,12 @@ func (db *datastoreDB) close() error {
 	return nil
 }
 
+// compact isn't supported: each record is stored in its own file, so a
+// deleted record leaves no space to reclaim.
+func (db *datastoreDB) compact() (bool, error) {
+	return false, nil
+}
+
 func (db *datastoreDB) view(fn func(tx *datastoreTx) error) error {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
@@ -0,0 +1,2293 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestExportServerEntries(t *testing.T) {
+
+	exportDirectory, err := ioutil.TempDir("", "psiphon-export-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(exportDirectory)
+
+	importDirectory, err := ioutil.TempDir("", "psiphon-import-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(importDirectory)
+
+	err = OpenDataStore(&Config{DataStoreDirectory: exportDirectory})
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	storeServerEntry := func(ipAddress, source string, futureField bool) {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:         ipAddress,
+				WebServerPort:     "8000",
+				WebServerSecret:   "secret",
+				SshObfuscatedPort: 4001,
+				Capabilities:      []string{"OSSH"},
+				Region:            "US",
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			encodedServerEntry, common.GetCurrentTimestamp(), source)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		if futureField {
+			serverEntryFields["dummyFutureField"] = "dummyFutureField"
+		}
+		err = StoreServerEntry(serverEntryFields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	storeServerEntry("192.0.2.1", protocol.SERVER_ENTRY_SOURCE_REMOTE, false)
+	storeServerEntry("192.0.2.2", protocol.SERVER_ENTRY_SOURCE_REMOTE, true)
+	storeServerEntry("192.0.2.3", protocol.SERVER_ENTRY_SOURCE_OBFUSCATED, false)
+
+	exported := new(bytes.Buffer)
+	err = ExportServerEntries(exported, "")
+	if err != nil {
+		t.Fatalf("ExportServerEntries failed: %s", err)
+	}
+
+	exportedRemote := new(bytes.Buffer)
+	err = ExportServerEntries(exportedRemote, protocol.SERVER_ENTRY_SOURCE_REMOTE)
+	if err != nil {
+		t.Fatalf("ExportServerEntries failed: %s", err)
+	}
+
+	if strings.Count(exported.String(), "\n") != 3 ||
+		strings.Count(exportedRemote.String(), "\n") != 2 {
+
+		t.Fatalf("unexpected export line counts")
+	}
+
+	expectedServerEntries := getTestStoredServerEntryFields(t)
+
+	// Import the export into an empty datastore, as with an embedded server
+	// entry list.
+
+	CloseDataStore()
+	err = OpenDataStore(&Config{DataStoreDirectory: importDirectory})
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	importTimestamp := common.GetCurrentTimestamp()
+
+	serverEntries, err := protocol.DecodeServerEntryList(
+		exported.String(), importTimestamp, protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryList failed: %s", err)
+	}
+	for _, serverEntryFields := range serverEntries {
+		err = StoreServerEntry(serverEntryFields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	importedServerEntries := getTestStoredServerEntryFields(t)
+
+	// Importing sets the local source and timestamp; all other fields,
+	// including the unrecognized field, are expected to round trip.
+
+	for _, serverEntryFields := range importedServerEntries {
+		if serverEntryFields.GetLocalSource() != protocol.SERVER_ENTRY_SOURCE_EMBEDDED ||
+			serverEntryFields["localTimestamp"] != importTimestamp {
+
+			t.Fatalf("unexpected imported local fields: %+v", serverEntryFields)
+		}
+	}
+
+	for _, serverEntries := range []map[string]protocol.ServerEntryFields{
+		expectedServerEntries, importedServerEntries} {
+
+		for _, serverEntryFields := range serverEntries {
+			delete(serverEntryFields, "localSource")
+			delete(serverEntryFields, "localTimestamp")
+		}
+	}
+
+	if !reflect.DeepEqual(importedServerEntries, expectedServerEntries) {
+		t.Fatalf(
+			"unexpected imported server entries: %+v, expected %+v",
+			importedServerEntries, expectedServerEntries)
+	}
+
+	if importedServerEntries["192.0.2.2"]["dummyFutureField"] != "dummyFutureField" {
+		t.Fatalf("missing unrecognized field")
+	}
+}
+
+// getTestStoredServerEntryFields returns all stored server entries keyed by
+// IP address.
+func getTestStoredServerEntryFields(t *testing.T) map[string]protocol.ServerEntryFields {
+
+	serverEntries := make(map[string]protocol.ServerEntryFields)
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		cursor := tx.bucket(datastoreServerEntriesBucket).cursor()
+		defer cursor.close()
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			var serverEntryFields protocol.ServerEntryFields
+			err := json.Unmarshal(value, &serverEntryFields)
+			if err != nil {
+				return err
+			}
+			serverEntries[string(key)] = serverEntryFields
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("datastoreView failed: %s", err)
+	}
+
+	return serverEntries
+}
+
+func TestServerEntryImportRollback(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-import-rollback-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = testDataDirName
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	makeServerEntryFields := func(ipAddress string, configurationVersion int) protocol.ServerEntryFields {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:            ipAddress,
+				WebServerPort:        "8000",
+				WebServerSecret:      "secret",
+				SshObfuscatedPort:    4001,
+				Capabilities:         []string{"OSSH"},
+				Region:               "US",
+				ConfigurationVersion: configurationVersion,
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			encodedServerEntry, common.GetCurrentTimestamp(), protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		return serverEntryFields
+	}
+
+	checkServerEntries := func(expected map[string]int) {
+		storedServerEntries := getTestStoredServerEntryFields(t)
+		if len(storedServerEntries) != len(expected) {
+			t.Fatalf("unexpected stored server entries: %+v", storedServerEntries)
+		}
+		for ipAddress, configurationVersion := range expected {
+			// Stored server entries are JSON decoded, so numeric fields are
+			// float64 values.
+			serverEntryFields, ok := storedServerEntries[ipAddress]
+			if !ok || serverEntryFields["configurationVersion"] != float64(configurationVersion) {
+				t.Fatalf("unexpected stored server entry %s: %+v", ipAddress, serverEntryFields)
+			}
+		}
+		journalCount := 0
+		err := datastoreView(func(tx *datastoreTx) error {
+			cursor := tx.bucket(datastoreServerEntryImportJournalBucket).cursor()
+			defer cursor.close()
+			for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+				journalCount += 1
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("datastoreView failed: %s", err)
+		}
+		if journalCount != 0 {
+			t.Fatalf("unexpected import journal records: %d", journalCount)
+		}
+	}
+
+	err = StoreServerEntry(makeServerEntryFields("192.0.2.1", 1), false)
+	if err != nil {
+		t.Fatalf("StoreServerEntry failed: %s", err)
+	}
+
+	// A failed import is rolled back: the updated entry is restored to its
+	// prior version and the added entry is removed.
+
+	invalidServerEntryFields := makeServerEntryFields("192.0.2.3", 1)
+	invalidServerEntryFields["ipAddress"] = "invalid"
+
+	err = StoreServerEntries(
+		config,
+		[]protocol.ServerEntryFields{
+			makeServerEntryFields("192.0.2.1", 2),
+			makeServerEntryFields("192.0.2.2", 1),
+			invalidServerEntryFields,
+		},
+		true)
+	if err == nil {
+		t.Fatalf("unexpected import success")
+	}
+
+	checkServerEntries(map[string]int{"192.0.2.1": 1})
+
+	// An import interrupted before completing, as by a crash, is rolled back
+	// when the datastore is next opened.
+
+	journal, err := newServerEntryImportJournal()
+	if err != nil {
+		t.Fatalf("newServerEntryImportJournal failed: %s", err)
+	}
+	for _, serverEntryFields := range []protocol.ServerEntryFields{
+		makeServerEntryFields("192.0.2.1", 3),
+		makeServerEntryFields("192.0.2.2", 1),
+		makeServerEntryFields("192.0.2.2", 2),
+	} {
+		_, err = storeServerEntry(serverEntryFields, true, nil, false, journal)
+		if err != nil {
+			t.Fatalf("storeServerEntry failed: %s", err)
+		}
+	}
+
+	CloseDataStore()
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	checkServerEntries(map[string]int{"192.0.2.1": 1})
+
+	// A completed import retains its entries and leaves no journal records.
+
+	err = StoreServerEntries(
+		config,
+		[]protocol.ServerEntryFields{
+			makeServerEntryFields("192.0.2.1", 2),
+			makeServerEntryFields("192.0.2.2", 1),
+		},
+		true)
+	if err != nil {
+		t.Fatalf("StoreServerEntries failed: %s", err)
+	}
+
+	CloseDataStore()
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	checkServerEntries(map[string]int{"192.0.2.1": 2, "192.0.2.2": 1})
+}
+
+func TestServerEntryImportAtomic(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-import-atomic-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = testDataDirName
+	config.ImportServerEntriesAtomically = true
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	encodeServerEntry := func(ipAddress string, configurationVersion int) string {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:            ipAddress,
+				WebServerPort:        "8000",
+				WebServerSecret:      "secret",
+				SshObfuscatedPort:    4001,
+				Capabilities:         []string{"OSSH"},
+				Region:               "US",
+				ConfigurationVersion: configurationVersion,
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		return encodedServerEntry
+	}
+
+	makeServerEntryFields := func(ipAddress string, configurationVersion int) protocol.ServerEntryFields {
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			encodeServerEntry(ipAddress, configurationVersion),
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		return serverEntryFields
+	}
+
+	streamingStore := func(encodedServerEntries ...string) (int, error) {
+		return streamingStoreServerEntries(
+			context.Background(),
+			config,
+			protocol.NewStreamingServerEntryDecoder(
+				strings.NewReader(strings.Join(encodedServerEntries, "\n")),
+				common.GetCurrentTimestamp(),
+				protocol.SERVER_ENTRY_SOURCE_REMOTE),
+			true,
+			nil,
+			nil)
+	}
+
+	checkServerEntries := func(expected map[string]int) {
+		storedServerEntries := getTestStoredServerEntryFields(t)
+		if len(storedServerEntries) != len(expected) {
+			t.Fatalf("unexpected stored server entries: %+v", storedServerEntries)
+		}
+		for ipAddress, configurationVersion := range expected {
+			serverEntryFields, ok := storedServerEntries[ipAddress]
+			if !ok || serverEntryFields["configurationVersion"] != float64(configurationVersion) {
+				t.Fatalf("unexpected stored server entry %s: %+v", ipAddress, serverEntryFields)
+			}
+		}
+	}
+
+	err = StoreServerEntry(makeServerEntryFields("192.0.2.1", 1), false)
+	if err != nil {
+		t.Fatalf("StoreServerEntry failed: %s", err)
+	}
+
+	// A failure part way through an atomic import discards all of the
+	// entries stored by the import, including those stored before the
+	// failure.
+
+	invalidServerEntryFields := makeServerEntryFields("192.0.2.3", 1)
+	invalidServerEntryFields["ipAddress"] = "invalid"
+
+	err = StoreServerEntries(
+		config,
+		[]protocol.ServerEntryFields{
+			makeServerEntryFields("192.0.2.1", 2),
+			makeServerEntryFields("192.0.2.2", 1),
+			invalidServerEntryFields,
+		},
+		true)
+	if err == nil {
+		t.Fatalf("unexpected import success")
+	}
+
+	checkServerEntries(map[string]int{"192.0.2.1": 1})
+
+	_, err = streamingStore(
+		encodeServerEntry("192.0.2.1", 2),
+		encodeServerEntry("192.0.2.2", 1),
+		"invalid")
+	if err == nil {
+		t.Fatalf("unexpected import success")
+	}
+
+	checkServerEntries(map[string]int{"192.0.2.1": 1})
+
+	// A completed atomic import stores all of its entries.
+
+	newCount, err := streamingStore(
+		encodeServerEntry("192.0.2.1", 2),
+		encodeServerEntry("192.0.2.2", 1))
+	if err != nil {
+		t.Fatalf("streamingStoreServerEntries failed: %s", err)
+	}
+	if newCount != 1 {
+		t.Fatalf("unexpected new server entries count: %d", newCount)
+	}
+
+	checkServerEntries(map[string]int{"192.0.2.1": 2, "192.0.2.2": 1})
+
+	err = StoreServerEntries(
+		config,
+		[]protocol.ServerEntryFields{
+			makeServerEntryFields("192.0.2.2", 2),
+			makeServerEntryFields("192.0.2.3", 1),
+		},
+		true)
+	if err != nil {
+		t.Fatalf("StoreServerEntries failed: %s", err)
+	}
+
+	checkServerEntries(map[string]int{"192.0.2.1": 2, "192.0.2.2": 2, "192.0.2.3": 1})
+}
+
+func TestServerEntryImportCancellation(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-import-cancellation-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = testDataDirName
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ServerEntryImportMaxWriters: 1,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	encodeServerEntry := func(ipAddress string, configurationVersion int) string {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:            ipAddress,
+				WebServerPort:        "8000",
+				WebServerSecret:      "secret",
+				SshObfuscatedPort:    4001,
+				Capabilities:         []string{"OSSH"},
+				Region:               "US",
+				ConfigurationVersion: configurationVersion,
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		return encodedServerEntry
+	}
+
+	var encodedServerEntries []string
+	encodedServerEntries = append(encodedServerEntries, encodeServerEntry("192.0.2.1", 2))
+	for i := 0; i < 100; i++ {
+		encodedServerEntries = append(
+			encodedServerEntries, encodeServerEntry(fmt.Sprintf("192.0.3.%d", i+1), 1))
+	}
+
+	newDecoder := func() *protocol.StreamingServerEntryDecoder {
+		return protocol.NewStreamingServerEntryDecoder(
+			strings.NewReader(strings.Join(encodedServerEntries, "\n")),
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE)
+	}
+
+	checkServerEntries := func() {
+		storedServerEntries := getTestStoredServerEntryFields(t)
+		serverEntryFields, ok := storedServerEntries["192.0.2.1"]
+		if len(storedServerEntries) != 1 || !ok ||
+			serverEntryFields["configurationVersion"] != float64(1) {
+			t.Fatalf("unexpected stored server entries: %+v", storedServerEntries)
+		}
+		journalCount := 0
+		err := datastoreView(func(tx *datastoreTx) error {
+			cursor := tx.bucket(datastoreServerEntryImportJournalBucket).cursor()
+			defer cursor.close()
+			for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+				journalCount += 1
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("datastoreView failed: %s", err)
+		}
+		if journalCount != 0 {
+			t.Fatalf("unexpected import journal records: %d", journalCount)
+		}
+	}
+
+	err = StoreServerEntry(
+		protocol.ServerEntryFields{
+			"ipAddress":            "192.0.2.1",
+			"capabilities":         []string{"OSSH"},
+			"configurationVersion": 1,
+		},
+		false)
+	if err != nil {
+		t.Fatalf("StoreServerEntry failed: %s", err)
+	}
+
+	// Cancelling part way through an import stops the import before the
+	// next server entry is stored, and the import is rolled back: the
+	// updated entry is restored and the added entries are removed.
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+
+	decoder := newDecoder()
+	decodedCount := 0
+	decoder.SetDecodedCallback(func(protocol.ServerEntryFields) {
+		decodedCount += 1
+		if decodedCount == 10 {
+			cancelFunc()
+		}
+	})
+
+	_, err = streamingStoreServerEntries(ctx, config, decoder, true, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Fatalf("unexpected import result: %v", err)
+	}
+	if decodedCount != 10 {
+		t.Fatalf("unexpected decoded server entries after cancel: %d", decodedCount)
+	}
+
+	checkServerEntries()
+
+	// An import cancelled while waiting for a writer slot returns promptly
+	// without storing any server entries.
+
+	release := serverEntryImportWriters.acquire(config)
+
+	ctx, cancelFunc = context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, err := streamingStoreServerEntries(ctx, config, newDecoder(), true, nil, nil)
+		result <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancelFunc()
+
+	select {
+	case err = <-result:
+		if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+			t.Fatalf("unexpected import result: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("cancelled import did not return")
+	}
+
+	release()
+
+	checkServerEntries()
+
+	serverEntryImportWriters.mutex.Lock()
+	active := serverEntryImportWriters.active
+	serverEntryImportWriters.mutex.Unlock()
+	if active != 0 {
+		t.Fatalf("unexpected active imports: %d", active)
+	}
+
+	// An import which isn't cancelled completes.
+
+	newEntries, err := streamingStoreServerEntries(
+		context.Background(), config, newDecoder(), true, nil, nil)
+	if err != nil {
+		t.Fatalf("streamingStoreServerEntries failed: %s", err)
+	}
+	if newEntries != 100 || CountServerEntries() != 101 {
+		t.Fatalf("unexpected import: %d, %d", newEntries, CountServerEntries())
+	}
+}
+
+func TestServerEntryImportNewCount(t *testing.T) {
+
+	t.Run("journaled", func(t *testing.T) {
+		testServerEntryImportNewCount(t, false)
+	})
+
+	t.Run("atomic", func(t *testing.T) {
+		testServerEntryImportNewCount(t, true)
+	})
+}
+
+func testServerEntryImportNewCount(t *testing.T, atomic bool) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-import-new-count-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = testDataDirName
+	config.ImportServerEntriesAtomically = atomic
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	encodeServerEntry := func(ipAddress string) string {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:         ipAddress,
+				WebServerPort:     "8000",
+				WebServerSecret:   "secret",
+				SshObfuscatedPort: 4001,
+				Capabilities:      []string{"OSSH"},
+				Region:            "US",
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		return encodedServerEntry
+	}
+
+	store := func(ipAddresses ...string) int {
+		var serverEntries []protocol.ServerEntryFields
+		for _, ipAddress := range ipAddresses {
+			serverEntryFields, err := protocol.DecodeServerEntryFields(
+				encodeServerEntry(ipAddress),
+				common.GetCurrentTimestamp(),
+				protocol.SERVER_ENTRY_SOURCE_REMOTE)
+			if err != nil {
+				t.Fatalf("DecodeServerEntryFields failed: %s", err)
+			}
+			serverEntries = append(serverEntries, serverEntryFields)
+		}
+		newEntries, err := storeServerEntries(config, serverEntries, true)
+		if err != nil {
+			t.Fatalf("storeServerEntries failed: %s", err)
+		}
+		return newEntries
+	}
+
+	streamingStore := func(ipAddresses ...string) (int, int) {
+		var encodedServerEntries []string
+		for _, ipAddress := range ipAddresses {
+			encodedServerEntries = append(encodedServerEntries, encodeServerEntry(ipAddress))
+		}
+		decoder := protocol.NewStreamingServerEntryDecoder(
+			strings.NewReader(strings.Join(encodedServerEntries, "\n")),
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		newEntries, err := streamingStoreServerEntries(
+			context.Background(), config, decoder, true, nil, nil)
+		if err != nil {
+			t.Fatalf("streamingStoreServerEntries failed: %s", err)
+		}
+		return newEntries, decoder.DecodedCount()
+	}
+
+	// Only server entries which aren't already stored are new, and a server
+	// entry listed more than once in an import is counted once.
+
+	newEntries := store("192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.1")
+	if newEntries != 3 {
+		t.Fatalf("unexpected new entries: %d", newEntries)
+	}
+
+	newEntries = store("192.0.2.2", "192.0.2.3", "192.0.2.4")
+	if newEntries != 1 {
+		t.Fatalf("unexpected new entries: %d", newEntries)
+	}
+
+	newEntries, totalEntries := streamingStore(
+		"192.0.2.3", "192.0.2.4", "192.0.2.5", "192.0.2.5")
+	if newEntries != 1 || totalEntries != 4 {
+		t.Fatalf("unexpected new entries: %d, %d", newEntries, totalEntries)
+	}
+
+	newEntries, totalEntries = streamingStore("192.0.2.1", "192.0.2.5")
+	if newEntries != 0 || totalEntries != 2 {
+		t.Fatalf("unexpected new entries: %d, %d", newEntries, totalEntries)
+	}
+
+	if CountServerEntries() != 5 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestServerEntryIPFilter(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-ip-filter-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	ipAddresses := []string{
+		"192.0.2.1",
+		"192.0.2.130",
+		"198.51.100.1",
+		"203.0.113.1",
+	}
+
+	encodeServerEntry := func(ipAddress string) string {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:         ipAddress,
+				WebServerPort:     "8000",
+				WebServerSecret:   "secret",
+				SshObfuscatedPort: 4001,
+				Capabilities:      []string{"OSSH"},
+				Region:            "US",
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		return encodedServerEntry
+	}
+
+	testCases := []struct {
+		description string
+		allowlist   []string
+		blocklist   []string
+		streaming   bool
+		expected    []string
+	}{
+		{
+			"allowlist only",
+			[]string{"192.0.2.0/25", "203.0.113.0/24"},
+			nil,
+			false,
+			[]string{"192.0.2.1", "203.0.113.1"},
+		},
+		{
+			"blocklist only",
+			nil,
+			[]string{"192.0.2.128/25", "198.51.100.0/24"},
+			true,
+			[]string{"192.0.2.1", "203.0.113.1"},
+		},
+		{
+			"blocklist overrides allowlist",
+			[]string{"192.0.2.0/24"},
+			[]string{"192.0.2.128/25"},
+			true,
+			[]string{"192.0.2.1"},
+		},
+		{
+			"no policy",
+			nil,
+			nil,
+			false,
+			ipAddresses,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			dataStoreDirName, err := ioutil.TempDir(testDataDirName, "")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+
+			config, err := LoadConfig([]byte(`
+            {
+                "ClientPlatform" : "",
+                "ClientVersion" : "0",
+                "SponsorId" : "0",
+                "PropagationChannelId" : "0"
+            }`))
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %s", err)
+			}
+			config.DataStoreDirectory = dataStoreDirName
+			config.ServerEntryIPAllowlist = testCase.allowlist
+			config.ServerEntryIPBlocklist = testCase.blocklist
+			err = config.Commit()
+			if err != nil {
+				t.Fatalf("Commit failed: %s", err)
+			}
+
+			err = OpenDataStore(config)
+			if err != nil {
+				t.Fatalf("OpenDataStore failed: %s", err)
+			}
+			defer CloseDataStore()
+
+			recorder := startTestNoticeRecorder()
+			defer recorder.stop()
+
+			if testCase.streaming {
+				var encodedServerEntries []string
+				for _, ipAddress := range ipAddresses {
+					encodedServerEntries = append(
+						encodedServerEntries, encodeServerEntry(ipAddress))
+				}
+				err = StreamingStoreServerEntries(
+					config,
+					protocol.NewStreamingServerEntryDecoder(
+						strings.NewReader(strings.Join(encodedServerEntries, "\n")),
+						common.GetCurrentTimestamp(),
+						protocol.SERVER_ENTRY_SOURCE_REMOTE),
+					true)
+				if err != nil {
+					t.Fatalf("StreamingStoreServerEntries failed: %s", err)
+				}
+			} else {
+				var serverEntries []protocol.ServerEntryFields
+				for _, ipAddress := range ipAddresses {
+					serverEntryFields, err := protocol.DecodeServerEntryFields(
+						encodeServerEntry(ipAddress),
+						common.GetCurrentTimestamp(),
+						protocol.SERVER_ENTRY_SOURCE_REMOTE)
+					if err != nil {
+						t.Fatalf("DecodeServerEntryFields failed: %s", err)
+					}
+					serverEntries = append(serverEntries, serverEntryFields)
+				}
+				err = StoreServerEntries(config, serverEntries, true)
+				if err != nil {
+					t.Fatalf("StoreServerEntries failed: %s", err)
+				}
+			}
+
+			storedServerEntries := getTestStoredServerEntryFields(t)
+			if len(storedServerEntries) != len(testCase.expected) {
+				t.Fatalf("unexpected stored server entries: %+v", storedServerEntries)
+			}
+			for _, ipAddress := range testCase.expected {
+				if _, ok := storedServerEntries[ipAddress]; !ok {
+					t.Fatalf("missing stored server entry: %s", ipAddress)
+				}
+			}
+
+			droppedCount := len(ipAddresses) - len(testCase.expected)
+			payloads := recorder.payloads("ServerEntriesDroppedByIPPolicy")
+			if droppedCount == 0 {
+				if len(payloads) != 0 {
+					t.Fatalf("unexpected dropped notices: %+v", payloads)
+				}
+			} else if len(payloads) != 1 ||
+				payloads[0]["count"] != float64(droppedCount) {
+				t.Fatalf("unexpected dropped notices: %+v", payloads)
+			}
+		})
+	}
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "ServerEntryIPBlocklist" : ["192.0.2.1"]
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = testDataDirName
+	err = config.Commit()
+	if err == nil {
+		t.Fatalf("unexpected Commit success with invalid CIDR")
+	}
+}
+
+func TestServerEntryTimestampSkew(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-timestamp-skew-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = testDataDirName
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	encodeServerEntry := func(ipAddress string) string {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:         ipAddress,
+				WebServerPort:     "8000",
+				WebServerSecret:   "secret",
+				SshObfuscatedPort: 4001,
+				Capabilities:      []string{"OSSH"},
+				Region:            "US",
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		return encodedServerEntry
+	}
+
+	now := time.Now()
+	formatTimestamp := func(timestamp time.Time) string {
+		return timestamp.UTC().Format(time.RFC3339)
+	}
+
+	timestamps := map[string]string{
+		"192.0.2.1": formatTimestamp(now),
+		"192.0.2.2": formatTimestamp(now.Add(1 * time.Hour)),
+		"192.0.2.3": formatTimestamp(now.Add(48 * time.Hour)),
+		"192.0.2.4": "invalid",
+	}
+
+	storeServerEntries := func() {
+		var serverEntries []protocol.ServerEntryFields
+		for ipAddress, timestamp := range timestamps {
+			serverEntryFields, err := protocol.DecodeServerEntryFields(
+				encodeServerEntry(ipAddress), timestamp, protocol.SERVER_ENTRY_SOURCE_REMOTE)
+			if err != nil {
+				t.Fatalf("DecodeServerEntryFields failed: %s", err)
+			}
+			serverEntries = append(serverEntries, serverEntryFields)
+		}
+		err := StoreServerEntries(config, serverEntries, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntries failed: %s", err)
+		}
+	}
+
+	checkStoredServerEntries := func(expected []string) {
+		storedServerEntries := getTestStoredServerEntryFields(t)
+		if len(storedServerEntries) != len(expected) {
+			t.Fatalf("unexpected stored server entries: %+v", storedServerEntries)
+		}
+		for _, ipAddress := range expected {
+			if _, ok := storedServerEntries[ipAddress]; !ok {
+				t.Fatalf("missing stored server entry: %s", ipAddress)
+			}
+		}
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// By default, there's no skew limit and all server entries are stored.
+
+	storeServerEntries()
+
+	checkStoredServerEntries([]string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"})
+
+	if recorder.count("ServerEntriesDroppedByFutureTimestamp") != 0 {
+		t.Fatalf("unexpected dropped notice")
+	}
+
+	_, err = DeleteServerEntries(
+		[]string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"})
+	if err != nil {
+		t.Fatalf("DeleteServerEntries failed: %s", err)
+	}
+
+	// With a skew limit, the server entry with a timestamp beyond the limit
+	// is dropped, while a timestamp within the limit and a malformed
+	// timestamp are permitted.
+
+	err = config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ServerEntryMaxTimestampSkew: "24h",
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	storeServerEntries()
+
+	checkStoredServerEntries([]string{"192.0.2.1", "192.0.2.2", "192.0.2.4"})
+
+	payloads := recorder.payloads("ServerEntriesDroppedByFutureTimestamp")
+	if len(payloads) != 1 ||
+		payloads[0]["count"] != float64(1) ||
+		payloads[0]["maxSkew"] != "24h0m0s" {
+		t.Fatalf("unexpected dropped notices: %+v", payloads)
+	}
+
+	// Streamed server entries are filtered in the same way.
+
+	err = StreamingStoreServerEntries(
+		config,
+		protocol.NewStreamingServerEntryDecoder(
+			strings.NewReader(strings.Join(
+				[]string{
+					encodeServerEntry("192.0.2.5"),
+					encodeServerEntry("192.0.2.6"),
+				},
+				"\n")),
+			formatTimestamp(now.Add(48*time.Hour)),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE),
+		true)
+	if err != nil {
+		t.Fatalf("StreamingStoreServerEntries failed: %s", err)
+	}
+
+	checkStoredServerEntries([]string{"192.0.2.1", "192.0.2.2", "192.0.2.4"})
+
+	payloads = recorder.payloads("ServerEntriesDroppedByFutureTimestamp")
+	if len(payloads) != 2 || payloads[1]["count"] != float64(2) {
+		t.Fatalf("unexpected dropped notices: %+v", payloads)
+	}
+}
+
+func TestPurgeExpiredServerEntries(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-expiry-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = testDataDirName
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	now := time.Now()
+	formatTimestamp := func(timestamp time.Time) string {
+		return timestamp.UTC().Format(time.RFC3339)
+	}
+
+	expiries := map[string]string{
+		"192.0.2.1": formatTimestamp(now.Add(-1 * time.Hour)),
+		"192.0.2.2": formatTimestamp(now.Add(1 * time.Hour)),
+		"192.0.2.3": "",
+		"192.0.2.4": "invalid",
+	}
+
+	var serverEntries []protocol.ServerEntryFields
+	for ipAddress, expiry := range expiries {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:         ipAddress,
+				WebServerPort:     "8000",
+				WebServerSecret:   "secret",
+				SshObfuscatedPort: 4001,
+				Capabilities:      []string{"OSSH"},
+				Region:            "US",
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			encodedServerEntry, formatTimestamp(now), protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		if expiry != "" {
+			serverEntryFields["expiry"] = expiry
+		}
+		serverEntries = append(serverEntries, serverEntryFields)
+	}
+
+	err = StoreServerEntries(config, serverEntries, true)
+	if err != nil {
+		t.Fatalf("StoreServerEntries failed: %s", err)
+	}
+
+	checkStoredServerEntries := func(expected []string) {
+		storedServerEntries := getTestStoredServerEntryFields(t)
+		if len(storedServerEntries) != len(expected) {
+			t.Fatalf("unexpected stored server entries: %+v", storedServerEntries)
+		}
+		for _, ipAddress := range expected {
+			serverEntryFields, ok := storedServerEntries[ipAddress]
+			if !ok {
+				t.Fatalf("missing stored server entry: %s", ipAddress)
+			}
+			expiry, _ := serverEntryFields["expiry"].(string)
+			if expiry != expiries[ipAddress] {
+				t.Fatalf("unexpected stored expiry: %+v", serverEntryFields)
+			}
+		}
+	}
+
+	// The explicit expiries are stored, and expired server entries are
+	// imported.
+
+	checkStoredServerEntries([]string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"})
+
+	// Only the server entry past its expiry is purged. Server entries with
+	// no expiry or a malformed expiry are retained.
+
+	count, err := PurgeExpiredServerEntries(now)
+	if err != nil {
+		t.Fatalf("PurgeExpiredServerEntries failed: %s", err)
+	}
+	if count != 1 {
+		t.Fatalf("unexpected purge count: %d", count)
+	}
+
+	checkStoredServerEntries([]string{"192.0.2.2", "192.0.2.3", "192.0.2.4"})
+
+	// Once its expiry passes, the remaining server entry with an expiry is
+	// purged.
+
+	count, err = PurgeExpiredServerEntries(now.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatalf("PurgeExpiredServerEntries failed: %s", err)
+	}
+	if count != 1 {
+		t.Fatalf("unexpected purge count: %d", count)
+	}
+
+	checkStoredServerEntries([]string{"192.0.2.3", "192.0.2.4"})
+}
+
+func TestServerEntryProvenanceDeletion(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-provenance-deletion-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = testDataDirName
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	now := time.Now()
+	formatTimestamp := func(timestamp time.Time) string {
+		return timestamp.UTC().Format(time.RFC3339)
+	}
+
+	storeServerEntryWithRecords := func(ipAddress, url, expiry string) {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:         ipAddress,
+				WebServerPort:     "8000",
+				WebServerSecret:   "secret",
+				SshObfuscatedPort: 4001,
+				Capabilities:      []string{"OSSH"},
+				Region:            "US",
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			encodedServerEntry, formatTimestamp(now), protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		if expiry != "" {
+			serverEntryFields["expiry"] = expiry
+		}
+		_, err = storeServerEntry(
+			serverEntryFields,
+			true,
+			&ServerEntryProvenance{
+				Source:         protocol.SERVER_ENTRY_SOURCE_REMOTE,
+				URL:            url,
+				FetchTimestamp: formatTimestamp(now),
+			},
+			true,
+			nil)
+		if err != nil {
+			t.Fatalf("storeServerEntry failed: %s", err)
+		}
+		err = setServerEntryReachability(
+			ipAddress,
+			&ServerEntryReachability{
+				Reachable:      true,
+				ProbeTimestamp: formatTimestamp(now),
+			})
+		if err != nil {
+			t.Fatalf("setServerEntryReachability failed: %s", err)
+		}
+	}
+
+	checkRecords := func(ipAddress string, expectRecords bool) {
+		provenance, err := GetServerEntryProvenance(ipAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntryProvenance failed: %s", err)
+		}
+		reachability, err := GetServerEntryReachability(ipAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntryReachability failed: %s", err)
+		}
+		if (provenance != nil) != expectRecords ||
+			(reachability != nil) != expectRecords {
+
+			t.Fatalf(
+				"unexpected records for %s: %+v %+v", ipAddress, provenance, reachability)
+		}
+	}
+
+	storeServerEntryWithRecords("192.0.2.1", "https://example.org/1", "")
+	storeServerEntryWithRecords("192.0.2.2", "https://example.org/2", "")
+	storeServerEntryWithRecords(
+		"192.0.2.3", "https://example.org/3", formatTimestamp(now.Add(-1*time.Hour)))
+	storeServerEntryWithRecords("192.0.2.4", "https://example.org/4", "")
+
+	for _, ipAddress := range []string{
+		"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"} {
+
+		checkRecords(ipAddress, true)
+	}
+
+	// Each server entry deletion path, including revocation and expiry,
+	// deletes the provenance and reachability records along with the server
+	// entry.
+
+	count, err := DeleteServerEntries([]string{"192.0.2.1"})
+	if err != nil || count != 1 {
+		t.Fatalf("DeleteServerEntries failed: %d %v", count, err)
+	}
+	checkRecords("192.0.2.1", false)
+
+	count, err = DeleteServerEntriesByProvenance(
+		func(provenance *ServerEntryProvenance) bool {
+			return provenance.URL == "https://example.org/2"
+		})
+	if err != nil || count != 1 {
+		t.Fatalf("DeleteServerEntriesByProvenance failed: %d %v", count, err)
+	}
+	checkRecords("192.0.2.2", false)
+
+	count, err = PurgeExpiredServerEntries(now)
+	if err != nil || count != 1 {
+		t.Fatalf("PurgeExpiredServerEntries failed: %d %v", count, err)
+	}
+	checkRecords("192.0.2.3", false)
+
+	checkRecords("192.0.2.4", true)
+
+	// Orphaned records, with no corresponding server entry, are deleted when
+	// the datastore is opened.
+
+	err = datastoreUpdate(func(tx *datastoreTx) error {
+		return tx.bucket(datastoreServerEntriesBucket).delete([]byte("192.0.2.4"))
+	})
+	if err != nil {
+		t.Fatalf("datastoreUpdate failed: %s", err)
+	}
+	checkRecords("192.0.2.4", true)
+
+	CloseDataStore()
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	checkRecords("192.0.2.4", false)
+}
+
+func TestServerEntryIteratorFilter(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-iterator-filter-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "EgressRegion" : "US"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = testDataDirName
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	makeServerEntry := func(ipAddress, region string) *protocol.ServerEntry {
+		return &protocol.ServerEntry{
+			IpAddress:          ipAddress,
+			WebServerPort:      "8000",
+			WebServerSecret:    "secret",
+			SshObfuscatedPort:  4001,
+			Capabilities:       []string{"OSSH"},
+			Region:             region,
+			MeekFrontingDomain: "example.org",
+		}
+	}
+
+	for _, serverEntry := range []*protocol.ServerEntry{
+		makeServerEntry("192.0.2.1", "US"),
+		makeServerEntry("192.0.2.2", "CA")} {
+
+		encodedServerEntry, err := protocol.EncodeServerEntry(serverEntry)
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			encodedServerEntry,
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		err = StoreServerEntry(serverEntryFields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	_, iterator, err := NewServerEntryIterator(config)
+	if err != nil {
+		t.Fatalf("NewServerEntryIterator failed: %s", err)
+	}
+	defer iterator.Close()
+
+	// The stored copy of a server entry meeting the filter requirements is
+	// returned; server entries outside the egress region, or no longer
+	// stored, are filtered out.
+
+	serverEntry, err := iterator.Filter(makeServerEntry("192.0.2.1", "CA"))
+	if err != nil {
+		t.Fatalf("Filter failed: %s", err)
+	}
+	if serverEntry == nil ||
+		serverEntry.Region != "US" ||
+		len(serverEntry.MeekFrontingAddresses) != 1 {
+
+		t.Fatalf("unexpected filtered server entry: %+v", serverEntry)
+	}
+
+	for _, ipAddress := range []string{"192.0.2.2", "192.0.2.3"} {
+		serverEntry, err := iterator.Filter(makeServerEntry(ipAddress, "US"))
+		if err != nil {
+			t.Fatalf("Filter failed: %s", err)
+		}
+		if serverEntry != nil {
+			t.Fatalf("unexpected filtered server entry: %+v", serverEntry)
+		}
+	}
+
+	// The tactics server entry iterator, which has no config, applies its
+	// own filter requirements.
+
+	tacticsIterator, err := NewTacticsServerEntryIterator(config)
+	if err != nil {
+		t.Fatalf("NewTacticsServerEntryIterator failed: %s", err)
+	}
+	defer tacticsIterator.Close()
+
+	serverEntry, err = tacticsIterator.Next()
+	if err != nil {
+		t.Fatalf("Next failed: %s", err)
+	}
+	if serverEntry != nil {
+		t.Fatalf("unexpected tactics server entry: %+v", serverEntry)
+	}
+}
+
+func TestServerEntrySchemaVersionSkip(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-schema-version-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = testDataDirName
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	encodeServerEntry := func(ipAddress string, schemaVersion int) string {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:         ipAddress,
+				WebServerPort:     "8000",
+				WebServerSecret:   "secret",
+				SshObfuscatedPort: 4001,
+				Capabilities:      []string{"OSSH"},
+				Region:            "US",
+				SchemaVersion:     schemaVersion,
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		return encodedServerEntry
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// A payload with entries requiring a newer schema version is imported,
+	// less those entries, rather than failing.
+
+	err = StreamingStoreServerEntries(
+		config,
+		protocol.NewStreamingServerEntryDecoder(
+			strings.NewReader(strings.Join(
+				[]string{
+					encodeServerEntry("192.0.2.1", 0),
+					encodeServerEntry("192.0.2.2", protocol.SERVER_ENTRY_SCHEMA_VERSION+1),
+					encodeServerEntry("192.0.2.3", protocol.SERVER_ENTRY_SCHEMA_VERSION),
+					encodeServerEntry("192.0.2.4", protocol.SERVER_ENTRY_SCHEMA_VERSION+2),
+				}, "\n")),
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE),
+		true)
+	if err != nil {
+		t.Fatalf("StreamingStoreServerEntries failed: %s", err)
+	}
+
+	storedServerEntries := getTestStoredServerEntryFields(t)
+	if len(storedServerEntries) != 2 {
+		t.Fatalf("unexpected stored server entries: %+v", storedServerEntries)
+	}
+	for _, ipAddress := range []string{"192.0.2.1", "192.0.2.3"} {
+		if _, ok := storedServerEntries[ipAddress]; !ok {
+			t.Fatalf("missing stored server entry: %s", ipAddress)
+		}
+	}
+
+	payloads := recorder.payloads("ServerEntriesSkippedBySchemaVersion")
+	if len(payloads) != 1 ||
+		payloads[0]["count"] != float64(2) ||
+		payloads[0]["schemaVersion"] != float64(protocol.SERVER_ENTRY_SCHEMA_VERSION) {
+		t.Fatalf("unexpected skipped notices: %+v", payloads)
+	}
+
+	// No notice is emitted when no entries are skipped.
+
+	err = StreamingStoreServerEntries(
+		config,
+		protocol.NewStreamingServerEntryDecoder(
+			strings.NewReader(encodeServerEntry("192.0.2.5", 0)),
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE),
+		true)
+	if err != nil {
+		t.Fatalf("StreamingStoreServerEntries failed: %s", err)
+	}
+
+	payloads = recorder.payloads("ServerEntriesSkippedBySchemaVersion")
+	if len(payloads) != 1 {
+		t.Fatalf("unexpected skipped notices: %+v", payloads)
+	}
+}
+
+func TestServerEntryMinimumClientVersionSkip(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-client-version-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	loadConfig := func(clientVersion string) *Config {
+		config, err := LoadConfig([]byte(fmt.Sprintf(`
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "%s",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`, clientVersion)))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %s", err)
+		}
+		config.DataStoreDirectory = testDataDirName
+		err = config.Commit()
+		if err != nil {
+			t.Fatalf("Commit failed: %s", err)
+		}
+		return config
+	}
+
+	config := loadConfig("100")
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	encodeServerEntry := func(ipAddress string, minimumClientVersion int) string {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:            ipAddress,
+				WebServerPort:        "8000",
+				WebServerSecret:      "secret",
+				SshObfuscatedPort:    4001,
+				Capabilities:         []string{"OSSH"},
+				Region:               "US",
+				MinimumClientVersion: minimumClientVersion,
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		return encodedServerEntry
+	}
+
+	encodedServerEntries := []string{
+		encodeServerEntry("192.0.2.1", 0),
+		encodeServerEntry("192.0.2.2", 99),
+		encodeServerEntry("192.0.2.3", 100),
+		encodeServerEntry("192.0.2.4", 101),
+		encodeServerEntry("192.0.2.5", 200),
+	}
+
+	streamingStore := func(config *Config) {
+		err := StreamingStoreServerEntries(
+			config,
+			protocol.NewStreamingServerEntryDecoder(
+				strings.NewReader(strings.Join(encodedServerEntries, "\n")),
+				common.GetCurrentTimestamp(),
+				protocol.SERVER_ENTRY_SOURCE_REMOTE),
+			true)
+		if err != nil {
+			t.Fatalf("StreamingStoreServerEntries failed: %s", err)
+		}
+	}
+
+	checkStoredServerEntries := func(expectedIPAddresses []string) {
+		storedServerEntries := getTestStoredServerEntryFields(t)
+		if len(storedServerEntries) != len(expectedIPAddresses) {
+			t.Fatalf("unexpected stored server entries: %+v", storedServerEntries)
+		}
+		for _, ipAddress := range expectedIPAddresses {
+			if _, ok := storedServerEntries[ipAddress]; !ok {
+				t.Fatalf("missing stored server entry: %s", ipAddress)
+			}
+		}
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	checkSkippedNotice := func(index, expectedCount, expectedClientVersion int) {
+		payloads := recorder.payloads("ServerEntriesSkippedByClientVersion")
+		if len(payloads) != index+1 ||
+			payloads[index]["count"] != float64(expectedCount) ||
+			payloads[index]["clientVersion"] != float64(expectedClientVersion) {
+			t.Fatalf("unexpected skipped notices: %+v", payloads)
+		}
+	}
+
+	// A payload with entries requiring a newer client version is imported,
+	// less those entries, rather than failing.
+
+	streamingStore(config)
+
+	checkStoredServerEntries([]string{"192.0.2.1", "192.0.2.2", "192.0.2.3"})
+
+	checkSkippedNotice(0, 2, 100)
+
+	// StoreServerEntries also skips entries requiring a newer client version.
+
+	serverEntryFields, err := protocol.DecodeServerEntryFields(
+		encodeServerEntry("192.0.2.6", 150),
+		common.GetCurrentTimestamp(),
+		protocol.SERVER_ENTRY_SOURCE_REMOTE)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryFields failed: %s", err)
+	}
+	err = StoreServerEntries(
+		config, []protocol.ServerEntryFields{serverEntryFields}, true)
+	if err != nil {
+		t.Fatalf("StoreServerEntries failed: %s", err)
+	}
+
+	checkStoredServerEntries([]string{"192.0.2.1", "192.0.2.2", "192.0.2.3"})
+
+	checkSkippedNotice(1, 1, 100)
+
+	// Once the client is upgraded, the same payload imports the entries
+	// which were previously skipped.
+
+	streamingStore(loadConfig("150"))
+
+	checkStoredServerEntries([]string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"})
+
+	checkSkippedNotice(2, 1, 150)
+
+	streamingStore(loadConfig("200"))
+
+	checkStoredServerEntries(
+		[]string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5"})
+
+	payloads := recorder.payloads("ServerEntriesSkippedByClientVersion")
+	if len(payloads) != 3 {
+		t.Fatalf("unexpected skipped notices: %+v", payloads)
+	}
+}
+
+type testServerEntrySink struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (sink *testServerEntrySink) ServerEntryStored(
+	serverEntry *protocol.ServerEntry, isNew bool) {
+
+	event := "updated"
+	if isNew {
+		event = "new"
+	}
+	sink.mutex.Lock()
+	sink.events = append(
+		sink.events, fmt.Sprintf("%s %s", serverEntry.IpAddress, event))
+	sink.mutex.Unlock()
+}
+
+func (sink *testServerEntrySink) takeEvents() []string {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	events := sink.events
+	sink.events = nil
+	return events
+}
+
+func TestServerEntrySink(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-server-entry-sink-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	sink := &testServerEntrySink{}
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = testDataDirName
+	config.ServerEntrySink = sink
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	encodeServerEntry := func(ipAddress string) string {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:    ipAddress,
+				Capabilities: []string{"OSSH"},
+				Region:       "US",
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		return encodedServerEntry
+	}
+
+	decodeServerEntry := func(ipAddress string) protocol.ServerEntryFields {
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			encodeServerEntry(ipAddress),
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		return serverEntryFields
+	}
+
+	checkEvents := func(expectedEvents ...string) {
+		events := sink.takeEvents()
+		if strings.Join(events, ",") != strings.Join(expectedEvents, ",") {
+			t.Fatalf("unexpected events: %v", events)
+		}
+	}
+
+	// New server entries are delivered as new.
+
+	err = StoreServerEntries(
+		config,
+		[]protocol.ServerEntryFields{
+			decodeServerEntry("192.0.2.1"),
+			decodeServerEntry("192.0.2.2"),
+		},
+		false)
+	if err != nil {
+		t.Fatalf("StoreServerEntries failed: %s", err)
+	}
+	checkEvents("192.0.2.1 new", "192.0.2.2 new")
+
+	// Server entries which aren't stored are not delivered.
+
+	err = StoreServerEntries(
+		config,
+		[]protocol.ServerEntryFields{decodeServerEntry("192.0.2.1")},
+		false)
+	if err != nil {
+		t.Fatalf("StoreServerEntries failed: %s", err)
+	}
+	checkEvents()
+
+	// Updated server entries are delivered as updated.
+
+	err = StreamingStoreServerEntries(
+		config,
+		protocol.NewStreamingServerEntryDecoder(
+			strings.NewReader(strings.Join(
+				[]string{
+					encodeServerEntry("192.0.2.1"),
+					encodeServerEntry("192.0.2.3"),
+				}, "\n")),
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE),
+		true)
+	if err != nil {
+		t.Fatalf("StreamingStoreServerEntries failed: %s", err)
+	}
+	checkEvents("192.0.2.1 updated", "192.0.2.3 new")
+
+	err = StoreServerEntries(
+		config,
+		[]protocol.ServerEntryFields{decodeServerEntry("192.0.2.2")},
+		true)
+	if err != nil {
+		t.Fatalf("StoreServerEntries failed: %s", err)
+	}
+	checkEvents("192.0.2.2 updated")
+
+	// The server entries of a failed import, which are rolled back, are not
+	// delivered.
+
+	invalidServerEntry := decodeServerEntry("192.0.2.5")
+	invalidServerEntry["ipAddress"] = "invalid"
+
+	err = StoreServerEntries(
+		config,
+		[]protocol.ServerEntryFields{
+			decodeServerEntry("192.0.2.4"),
+			invalidServerEntry,
+		},
+		false)
+	if err == nil {
+		t.Fatalf("unexpected StoreServerEntries success")
+	}
+	checkEvents()
+
+	if CountServerEntries() != 3 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestServerEntryImportMaxWriters(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-import-max-writers-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = testDataDirName
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	maxWriters := 2
+
+	err = config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ServerEntryImportMaxWriters: maxWriters,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	importCount := 8
+	importSize := 20
+
+	// Imports which hold the limiter block further imports until released.
+
+	limiter := newServerEntryImportWriterLimiter()
+	hold := make(chan struct{})
+	var waitGroup sync.WaitGroup
+	for i := 0; i < importCount; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			release := limiter.acquire(config)
+			<-hold
+			release()
+			release()
+		}()
+	}
+
+	getActive := func() int {
+		limiter.mutex.Lock()
+		defer limiter.mutex.Unlock()
+		return limiter.active
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for getActive() < maxWriters && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if getActive() != maxWriters {
+		t.Fatalf("unexpected active imports: %d", getActive())
+	}
+	close(hold)
+	waitGroup.Wait()
+	if getActive() != 0 || limiter.peakActive != maxWriters {
+		t.Fatalf("unexpected imports: %d, %d", getActive(), limiter.peakActive)
+	}
+
+	// Concurrent imports stay within the limit and all succeed.
+
+	serverEntryImportWriters.mutex.Lock()
+	serverEntryImportWriters.peakActive = 0
+	serverEntryImportWriters.mutex.Unlock()
+
+	errs := make(chan error, importCount)
+	for i := 0; i < importCount; i++ {
+		var serverEntries []protocol.ServerEntryFields
+		for j := 0; j < importSize; j++ {
+			encodedServerEntry, err := protocol.EncodeServerEntry(
+				&protocol.ServerEntry{
+					IpAddress:    fmt.Sprintf("192.0.%d.%d", i+1, j+1),
+					Capabilities: []string{"OSSH"},
+					Region:       "US",
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+			serverEntryFields, err := protocol.DecodeServerEntryFields(
+				encodedServerEntry,
+				common.GetCurrentTimestamp(),
+				protocol.SERVER_ENTRY_SOURCE_REMOTE)
+			if err != nil {
+				t.Fatalf("DecodeServerEntryFields failed: %s", err)
+			}
+			serverEntries = append(serverEntries, serverEntryFields)
+		}
+		go func() {
+			errs <- StoreServerEntries(config, serverEntries, false)
+		}()
+	}
+	for i := 0; i < importCount; i++ {
+		err := <-errs
+		if err != nil {
+			t.Fatalf("StoreServerEntries failed: %s", err)
+		}
+	}
+
+	serverEntryImportWriters.mutex.Lock()
+	peakActive := serverEntryImportWriters.peakActive
+	serverEntryImportWriters.mutex.Unlock()
+	if peakActive < 1 || peakActive > maxWriters {
+		t.Fatalf("unexpected peak concurrent imports: %d", peakActive)
+	}
+	if CountServerEntries() != importCount*importSize {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestDataStoreLockedRetry(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-locked-retry-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = testDataDirName
+	retryAttempts := 3
+	retryBackoff := 1
+	config.DataStoreLockedRetryAttempts = &retryAttempts
+	config.DataStoreLockedRetryBackoffMilliseconds = &retryBackoff
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	// Simulate a temporarily locked datastore. The next lockedUpdates update
+	// transactions are run and then fail with a datastoreLockedError, as for
+	// a conflict detected on commit, so that their writes are rolled back.
+	// When permanentErr is set, update transactions fail with that error.
+
+	var mutex sync.Mutex
+	lockedUpdates := 0
+	var permanentErr error
+	updates := 0
+
+	originalUpdateDB := datastoreUpdateDB
+	defer func() {
+		datastoreUpdateDB = originalUpdateDB
+	}()
+	datastoreUpdateDB = func(db *datastoreDB, fn func(tx *datastoreTx) error) error {
+		mutex.Lock()
+		updates += 1
+		locked := lockedUpdates > 0
+		if locked {
+			lockedUpdates -= 1
+		}
+		err := permanentErr
+		mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		if !locked {
+			return db.update(fn)
+		}
+		rolledBack := false
+		err = db.update(func(tx *datastoreTx) error {
+			err := fn(tx)
+			if err != nil {
+				return err
+			}
+			rolledBack = true
+			return errors.New("rollback")
+		})
+		if rolledBack {
+			return datastoreLockedError{err: errors.New("simulated lock")}
+		}
+		return err
+	}
+
+	setLocked := func(n int, err error) {
+		mutex.Lock()
+		lockedUpdates = n
+		permanentErr = err
+		updates = 0
+		mutex.Unlock()
+	}
+
+	getUpdates := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return updates
+	}
+
+	makeServerEntryFields := func(ipAddress string, configurationVersion int) protocol.ServerEntryFields {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:            ipAddress,
+				WebServerPort:        "8000",
+				WebServerSecret:      "secret",
+				SshObfuscatedPort:    4001,
+				Capabilities:         []string{"OSSH"},
+				Region:               "US",
+				ConfigurationVersion: configurationVersion,
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			encodedServerEntry, common.GetCurrentTimestamp(), protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		return serverEntryFields
+	}
+
+	checkServerEntries := func(expected map[string]int) {
+		storedServerEntries := getTestStoredServerEntryFields(t)
+		if len(storedServerEntries) != len(expected) {
+			t.Fatalf("unexpected stored server entries: %+v", storedServerEntries)
+		}
+		for ipAddress, configurationVersion := range expected {
+			serverEntryFields, ok := storedServerEntries[ipAddress]
+			if !ok || serverEntryFields["configurationVersion"] != float64(configurationVersion) {
+				t.Fatalf("unexpected stored server entry %s: %+v", ipAddress, serverEntryFields)
+			}
+		}
+		journalCount := 0
+		err := datastoreView(func(tx *datastoreTx) error {
+			cursor := tx.bucket(datastoreServerEntryImportJournalBucket).cursor()
+			for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+				journalCount += 1
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("datastoreView failed: %s", err)
+		}
+		if journalCount != 0 {
+			t.Fatalf("unexpected import journal records: %d", journalCount)
+		}
+	}
+
+	err = StoreServerEntry(makeServerEntryFields("192.0.2.1", 1), false)
+	if err != nil {
+		t.Fatalf("StoreServerEntry failed: %s", err)
+	}
+
+	// A write is retried while the datastore is locked, and then succeeds.
+
+	setLocked(2, nil)
+
+	err = SetKeyValue("key", "value")
+	if err != nil {
+		t.Fatalf("SetKeyValue failed: %s", err)
+	}
+	if getUpdates() != 3 {
+		t.Fatalf("unexpected update count: %d", getUpdates())
+	}
+	value, err := GetKeyValue("key")
+	if err != nil || value != "value" {
+		t.Fatalf("unexpected value: %s, %v", value, err)
+	}
+
+	// An import with retried writes succeeds, and leaves no journal records.
+
+	setLocked(2, nil)
+
+	err = StoreServerEntries(
+		config,
+		[]protocol.ServerEntryFields{
+			makeServerEntryFields("192.0.2.1", 2),
+			makeServerEntryFields("192.0.2.2", 1),
+		},
+		true)
+	if err != nil {
+		t.Fatalf("StoreServerEntries failed: %s", err)
+	}
+
+	checkServerEntries(map[string]int{"192.0.2.1": 2, "192.0.2.2": 1})
+
+	// The journal records rolled back with a locked write are stored again
+	// when the write is retried, so a failed import is still fully rolled
+	// back.
+
+	setLocked(1, nil)
+
+	invalidServerEntryFields := makeServerEntryFields("192.0.2.4", 1)
+	invalidServerEntryFields["ipAddress"] = "invalid"
+
+	err = StoreServerEntries(
+		config,
+		[]protocol.ServerEntryFields{
+			makeServerEntryFields("192.0.2.1", 3),
+			makeServerEntryFields("192.0.2.3", 1),
+			invalidServerEntryFields,
+		},
+		true)
+	if err == nil {
+		t.Fatalf("unexpected import success")
+	}
+
+	checkServerEntries(map[string]int{"192.0.2.1": 2, "192.0.2.2": 1})
+
+	// A write fails once the retries are exhausted.
+
+	setLocked(retryAttempts+10, nil)
+
+	err = SetKeyValue("key", "new value")
+	if err == nil {
+		t.Fatalf("unexpected SetKeyValue success")
+	}
+	if getUpdates() != retryAttempts+1 {
+		t.Fatalf("unexpected update count: %d", getUpdates())
+	}
+
+	// A permanent error isn't retried.
+
+	setLocked(0, errors.New("simulated permanent error"))
+
+	err = SetKeyValue("key", "new value")
+	if err == nil {
+		t.Fatalf("unexpected SetKeyValue success")
+	}
+	if getUpdates() != 1 {
+		t.Fatalf("unexpected update count: %d", getUpdates())
+	}
+
+	setLocked(0, nil)
+
+	value, err = GetKeyValue("key")
+	if err != nil || value != "value" {
+		t.Fatalf("unexpected value: %s, %v", value, err)
+	}
+}
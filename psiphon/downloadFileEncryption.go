@@ -0,0 +1,371 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/hkdf"
+)
+
+// An encrypted download file consists of a header, the magic value, the key
+// ID of the encryption key, and a random IV, followed by the file content
+// encrypted with AES-256-CTR. The CTR keystream may be positioned at any
+// offset, so that an encrypted partial download may be resumed by appending
+// and an encrypted file may be read with Seek.
+//
+// There's no MAC: encrypted files are authenticated data packages and OSL
+// files, whose signatures are checked when they're read. The key ID detects
+// a file encrypted with a different secret.
+const (
+	downloadFileEncryptionMagic = "PSIENC1\x00"
+	downloadFileKeyIDSize       = 8
+	downloadFileHeaderSize      = len(downloadFileEncryptionMagic) + downloadFileKeyIDSize + aes.BlockSize
+)
+
+// downloadFileKey is the key used to encrypt downloaded files at rest. The
+// encryption key and the key ID are derived from the configured secret with
+// HKDF. HKDF doesn't stretch the secret, as a password hash would, so the
+// secret must be high-entropy: with a guessable secret, the key ID, which
+// is stored in each file header, permits an offline guessing attack.
+type downloadFileKey struct {
+	block cipher.Block
+	keyID []byte
+}
+
+func newDownloadFileKey(secret string) (*downloadFileKey, error) {
+
+	key := make([]byte, 32)
+	_, err := io.ReadFull(
+		hkdf.New(sha256.New, []byte(secret), nil, []byte("download-file-encryption-key")), key)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	keyID := make([]byte, downloadFileKeyIDSize)
+	_, err = io.ReadFull(
+		hkdf.New(sha256.New, []byte(secret), nil, []byte("download-file-encryption-key-id")), keyID)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return &downloadFileKey{
+		block: block,
+		keyID: keyID,
+	}, nil
+}
+
+// newStream returns the keystream for the file with the specified IV,
+// positioned at the plaintext offset.
+func (key *downloadFileKey) newStream(iv []byte, offset int64) cipher.Stream {
+
+	// The CTR counter is the IV, as a big-endian 128-bit integer, plus the
+	// number of blocks preceding offset.
+
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, iv)
+	high := binary.BigEndian.Uint64(counter[:8])
+	low := binary.BigEndian.Uint64(counter[8:])
+	sum := low + uint64(offset/aes.BlockSize)
+	if sum < low {
+		high += 1
+	}
+	binary.BigEndian.PutUint64(counter[:8], high)
+	binary.BigEndian.PutUint64(counter[8:], sum)
+
+	stream := cipher.NewCTR(key.block, counter)
+
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+
+	return stream
+}
+
+// readDownloadFileHeader reads the header of file, when it's encrypted, and
+// returns the IV and key ID. A file which isn't encrypted has no header, and
+// the returned IV is nil.
+func readDownloadFileHeader(file *os.File, size int64) ([]byte, []byte, error) {
+
+	if size < int64(len(downloadFileEncryptionMagic)) {
+		return nil, nil, nil
+	}
+
+	magic := make([]byte, len(downloadFileEncryptionMagic))
+	_, err := file.ReadAt(magic, 0)
+	if err != nil {
+		return nil, nil, common.ContextError(err)
+	}
+	if string(magic) != downloadFileEncryptionMagic {
+		return nil, nil, nil
+	}
+
+	if size < int64(downloadFileHeaderSize) {
+		return nil, nil, common.ContextError(errors.New("truncated encryption header"))
+	}
+
+	header := make([]byte, downloadFileHeaderSize)
+	_, err = file.ReadAt(header, 0)
+	if err != nil {
+		return nil, nil, common.ContextError(err)
+	}
+
+	keyID := header[len(downloadFileEncryptionMagic) : len(downloadFileEncryptionMagic)+downloadFileKeyIDSize]
+	iv := header[len(downloadFileEncryptionMagic)+downloadFileKeyIDSize:]
+
+	return iv, keyID, nil
+}
+
+// downloadFile is a downloaded file opened for reading. The content of an
+// encrypted file is transparently decrypted, and Seek and Size apply to the
+// decrypted content. A file which isn't encrypted, such as a file
+// downloaded before encryption was enabled, is read as is.
+type downloadFile struct {
+	file       *os.File
+	key        *downloadFileKey
+	iv         []byte
+	headerSize int64
+	size       int64
+	stream     cipher.Stream
+}
+
+// openDownloadFile opens the downloaded file filename for reading. An
+// encrypted file can only be opened with the key it was encrypted with; key
+// may be nil when encryption isn't enabled. A failure to open the file is
+// returned unwrapped, so that callers may check os.IsNotExist.
+func openDownloadFile(filename string, key *downloadFileKey) (*downloadFile, error) {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, common.ContextError(err)
+	}
+
+	iv, keyID, err := readDownloadFileHeader(file, fileInfo.Size())
+	if err != nil {
+		file.Close()
+		return nil, common.ContextError(err)
+	}
+
+	if iv == nil {
+		return &downloadFile{
+			file: file,
+			size: fileInfo.Size(),
+		}, nil
+	}
+
+	if key == nil {
+		file.Close()
+		return nil, common.ContextError(errors.New("missing file encryption key"))
+	}
+
+	if !bytes.Equal(keyID, key.keyID) {
+		file.Close()
+		return nil, common.ContextError(errors.New("unexpected file encryption key"))
+	}
+
+	_, err = file.Seek(int64(downloadFileHeaderSize), io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, common.ContextError(err)
+	}
+
+	return &downloadFile{
+		file:       file,
+		key:        key,
+		iv:         iv,
+		headerSize: int64(downloadFileHeaderSize),
+		size:       fileInfo.Size() - int64(downloadFileHeaderSize),
+		stream:     key.newStream(iv, 0),
+	}, nil
+}
+
+// Read implements io.Reader.
+func (file *downloadFile) Read(p []byte) (int, error) {
+	n, err := file.file.Read(p)
+	if file.stream != nil {
+		file.stream.XORKeyStream(p[:n], p[:n])
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (file *downloadFile) Seek(offset int64, whence int) (int64, error) {
+
+	switch whence {
+	case io.SeekStart:
+		offset += file.headerSize
+	case io.SeekEnd:
+		whence = io.SeekStart
+		offset += file.headerSize + file.size
+	}
+
+	position, err := file.file.Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+
+	if position < file.headerSize {
+		return 0, common.ContextError(errors.New("invalid offset"))
+	}
+
+	position -= file.headerSize
+
+	if file.key != nil {
+		file.stream = file.key.newStream(file.iv, position)
+	}
+
+	return position, nil
+}
+
+// Size returns the size of the file content.
+func (file *downloadFile) Size() int64 {
+	return file.size
+}
+
+// Stat returns the os.FileInfo of the underlying file.
+func (file *downloadFile) Stat() (os.FileInfo, error) {
+	return file.file.Stat()
+}
+
+// Close implements io.Closer.
+func (file *downloadFile) Close() error {
+	return file.file.Close()
+}
+
+// getPartialDownloadSize returns the size of the content of the partial
+// download file. ok is false when the partial download isn't in the format
+// specified by key, either encrypted with key or, when key is nil, not
+// encrypted, in which case the partial download can't be resumed.
+func getPartialDownloadSize(file *os.File, key *downloadFileKey) (int64, bool, error) {
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, false, common.ContextError(err)
+	}
+
+	if fileInfo.Size() == 0 {
+		return 0, true, nil
+	}
+
+	iv, keyID, err := readDownloadFileHeader(file, fileInfo.Size())
+	if err != nil {
+		return 0, false, nil
+	}
+
+	if iv == nil {
+		return fileInfo.Size(), key == nil, nil
+	}
+
+	if key == nil || !bytes.Equal(keyID, key.keyID) {
+		return 0, false, nil
+	}
+
+	return fileInfo.Size() - int64(downloadFileHeaderSize), true, nil
+}
+
+// newDownloadFileWriter returns a writer which appends content to file,
+// which is opened for writing at its end. The existing content of file is
+// in the format specified by key; see getPartialDownloadSize. When key is
+// not nil, the written content is encrypted, and the header is written when
+// file is empty.
+func newDownloadFileWriter(file *os.File, key *downloadFileKey) (io.Writer, error) {
+
+	if key == nil {
+		return NewSyncFileWriter(file), nil
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var iv []byte
+	var offset int64
+
+	if fileInfo.Size() == 0 {
+
+		iv, err = common.MakeSecureRandomBytes(aes.BlockSize)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		header := append([]byte(downloadFileEncryptionMagic), key.keyID...)
+		header = append(header, iv...)
+		_, err = file.Write(header)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+	} else {
+
+		iv, _, err = readDownloadFileHeader(file, fileInfo.Size())
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		if iv == nil {
+			return nil, common.ContextError(errors.New("missing encryption header"))
+		}
+		offset = fileInfo.Size() - int64(downloadFileHeaderSize)
+	}
+
+	return &encryptingFileWriter{
+		writer: NewSyncFileWriter(file),
+		stream: key.newStream(iv, offset),
+	}, nil
+}
+
+// encryptingFileWriter encrypts content written to a download file.
+type encryptingFileWriter struct {
+	writer io.Writer
+	stream cipher.Stream
+	buffer []byte
+}
+
+// Write implements io.Writer. The keystream position depends only on the
+// content offset, so a partial download left by a failed write is resumed
+// with a new writer positioned at the end of the file.
+func (writer *encryptingFileWriter) Write(p []byte) (int, error) {
+
+	if cap(writer.buffer) < len(p) {
+		writer.buffer = make([]byte, len(p))
+	}
+	buffer := writer.buffer[:len(p)]
+	writer.stream.XORKeyStream(buffer, p)
+
+	return writer.writer.Write(buffer)
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadFileKeyStream(t *testing.T) {
+
+	key, err := newDownloadFileKey("TestDownloadFileKeyStream")
+	if err != nil {
+		t.Fatalf("newDownloadFileKey failed: %s", err)
+	}
+
+	// The keystream positioned at an offset matches the standard CTR
+	// keystream from the start of the file, including when adding the
+	// offset blocks to the IV carries into the high 64 bits of the counter,
+	// or wraps the entire counter.
+
+	testCases := []struct {
+		description string
+		iv          []byte
+	}{
+		{"zero", make([]byte, aes.BlockSize)},
+		{"low carry", []byte{
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+			0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE}},
+		{"counter wrap", bytes.Repeat([]byte{0xFF}, aes.BlockSize)},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			keystream := make([]byte, 5*aes.BlockSize)
+			cipher.NewCTR(key.block, testCase.iv).XORKeyStream(keystream, keystream)
+
+			for _, offset := range []int{0, 1, aes.BlockSize, 2*aes.BlockSize + 5, 3 * aes.BlockSize} {
+
+				suffix := make([]byte, len(keystream)-offset)
+				key.newStream(testCase.iv, int64(offset)).XORKeyStream(suffix, suffix)
+
+				if !bytes.Equal(suffix, keystream[offset:]) {
+					t.Fatalf("unexpected keystream at offset %d", offset)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadFileEncryption(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-download-file-encryption-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	key, err := newDownloadFileKey("TestDownloadFileEncryption")
+	if err != nil {
+		t.Fatalf("newDownloadFileKey failed: %s", err)
+	}
+
+	content := make([]byte, 10*aes.BlockSize+7)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	filename := filepath.Join(testDataDirName, "file")
+
+	// writeFile appends data to the file, as a resumed download does.
+	writeFile := func(key *downloadFileKey, data []byte) {
+		file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatalf("OpenFile failed: %s", err)
+		}
+		defer file.Close()
+		writer, err := newDownloadFileWriter(file, key)
+		if err != nil {
+			t.Fatalf("newDownloadFileWriter failed: %s", err)
+		}
+		_, err = writer.Write(data)
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+	}
+
+	partialDownloadSize := func(key *downloadFileKey) (int64, bool) {
+		file, err := os.Open(filename)
+		if err != nil {
+			t.Fatalf("Open failed: %s", err)
+		}
+		defer file.Close()
+		size, ok, err := getPartialDownloadSize(file, key)
+		if err != nil {
+			t.Fatalf("getPartialDownloadSize failed: %s", err)
+		}
+		return size, ok
+	}
+
+	// A download resumed part way through a block continues the keystream
+	// from the end of the partial download.
+
+	resumeOffset := 2*aes.BlockSize + 5
+
+	writeFile(key, content[:resumeOffset])
+
+	size, ok := partialDownloadSize(key)
+	if !ok || size != int64(resumeOffset) {
+		t.Fatalf("unexpected partial download size: %d, %v", size, ok)
+	}
+
+	writeFile(key, content[resumeOffset:])
+
+	fileContent, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	if len(fileContent) != downloadFileHeaderSize+len(content) ||
+		bytes.Contains(fileContent, content[:aes.BlockSize]) {
+		t.Fatalf("unexpected file content")
+	}
+
+	file, err := openDownloadFile(filename, key)
+	if err != nil {
+		t.Fatalf("openDownloadFile failed: %s", err)
+	}
+	defer file.Close()
+
+	if file.Size() != int64(len(content)) {
+		t.Fatalf("unexpected size: %d", file.Size())
+	}
+
+	readContent, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %s", err)
+	}
+	if !bytes.Equal(readContent, content) {
+		t.Fatalf("unexpected decrypted content")
+	}
+
+	// Seek positions the keystream at any offset, relative to the start or
+	// the end of the content.
+
+	seekTestCases := []struct {
+		offset         int64
+		whence         int
+		expectedOffset int64
+	}{
+		{int64(aes.BlockSize + 3), io.SeekStart, int64(aes.BlockSize + 3)},
+		{0, io.SeekStart, 0},
+		{-int64(aes.BlockSize + 1), io.SeekEnd, int64(len(content) - aes.BlockSize - 1)},
+		{-5, io.SeekEnd, int64(len(content) - 5)},
+		{0, io.SeekEnd, int64(len(content))},
+	}
+
+	for _, testCase := range seekTestCases {
+
+		position, err := file.Seek(testCase.offset, testCase.whence)
+		if err != nil {
+			t.Fatalf("Seek failed: %s", err)
+		}
+		if position != testCase.expectedOffset {
+			t.Fatalf("unexpected position: %d", position)
+		}
+
+		readContent, err := ioutil.ReadAll(file)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %s", err)
+		}
+		if !bytes.Equal(readContent, content[testCase.expectedOffset:]) {
+			t.Fatalf("unexpected decrypted content at offset %d", testCase.expectedOffset)
+		}
+	}
+
+	_, err = file.Seek(-int64(len(content)+1), io.SeekEnd)
+	if err == nil {
+		t.Fatalf("Seek unexpectedly succeeded")
+	}
+
+	file.Close()
+
+	// A file encrypted with a different secret, or when no secret is set,
+	// can't be read or resumed.
+
+	otherKey, err := newDownloadFileKey("TestDownloadFileEncryption other")
+	if err != nil {
+		t.Fatalf("newDownloadFileKey failed: %s", err)
+	}
+
+	for _, key := range []*downloadFileKey{otherKey, nil} {
+
+		_, err = openDownloadFile(filename, key)
+		if err == nil {
+			t.Fatalf("openDownloadFile unexpectedly succeeded")
+		}
+
+		_, ok = partialDownloadSize(key)
+		if ok {
+			t.Fatalf("unexpected resumable partial download")
+		}
+	}
+
+	// A file which isn't encrypted, as when downloaded before the secret was
+	// set, is read as is, but isn't resumed with encryption.
+
+	err = ioutil.WriteFile(filename, content, 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	file, err = openDownloadFile(filename, key)
+	if err != nil {
+		t.Fatalf("openDownloadFile failed: %s", err)
+	}
+	readContent, err = ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %s", err)
+	}
+	if !bytes.Equal(readContent, content) {
+		t.Fatalf("unexpected content")
+	}
+
+	_, ok = partialDownloadSize(key)
+	if ok {
+		t.Fatalf("unexpected resumable partial download")
+	}
+
+	size, ok = partialDownloadSize(nil)
+	if !ok || size != int64(len(content)) {
+		t.Fatalf("unexpected partial download size: %d, %v", size, ok)
+	}
+
+	// A file which isn't encrypted but begins with the magic value is
+	// indistinguishable from an encrypted file, and isn't read or resumed,
+	// including when it's shorter than the header.
+
+	for _, length := range []int{downloadFileHeaderSize - 1, len(content)} {
+
+		err = ioutil.WriteFile(
+			filename,
+			append([]byte(downloadFileEncryptionMagic), content[:length-len(downloadFileEncryptionMagic)]...),
+			0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+
+		for _, key := range []*downloadFileKey{key, nil} {
+
+			_, err = openDownloadFile(filename, key)
+			if err == nil {
+				t.Fatalf("openDownloadFile unexpectedly succeeded")
+			}
+
+			_, ok = partialDownloadSize(key)
+			if ok {
+				t.Fatalf("unexpected resumable partial download")
+			}
+		}
+	}
+}
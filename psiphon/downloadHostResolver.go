@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Psiphon-Labs/dns"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// downloadHostMaxResponseSize is the maximum size of a DNS-over-HTTPS
+// response body.
+const downloadHostMaxResponseSize = 65535
+
+// downloadHostResolver is the HostResolver specified by the config
+// DownloadHostAddresses and DownloadHostResolverURL, which is used to
+// resolve download host domain names in the untunneled download path.
+// Domain names in the static mapping are resolved without a DNS request;
+// other domain names are resolved with the DNS-over-HTTPS endpoint, when
+// specified, or else with the system resolver.
+type downloadHostResolver struct {
+	addresses   map[string][]net.IP
+	resolverURL string
+}
+
+// newDownloadHostResolver validates the static mapping and the resolver
+// URL. nil is returned when neither is specified.
+func newDownloadHostResolver(
+	addresses map[string][]string, resolverURL string) (*downloadHostResolver, error) {
+
+	if len(addresses) == 0 && resolverURL == "" {
+		return nil, nil
+	}
+
+	resolver := &downloadHostResolver{
+		addresses:   make(map[string][]net.IP),
+		resolverURL: resolverURL,
+	}
+
+	for host, IPAddresses := range addresses {
+		if len(IPAddresses) == 0 {
+			return nil, common.ContextError(
+				fmt.Errorf("invalid DownloadHostAddresses: no addresses for %s", host))
+		}
+		IPs := make([]net.IP, len(IPAddresses))
+		for i, IPAddress := range IPAddresses {
+			IPs[i] = net.ParseIP(IPAddress)
+			if IPs[i] == nil {
+				return nil, common.ContextError(
+					fmt.Errorf("invalid DownloadHostAddresses: invalid address %s", IPAddress))
+			}
+		}
+		resolver.addresses[strings.ToLower(dns.Fqdn(host))] = IPs
+	}
+
+	if resolverURL != "" {
+		parsedURL, err := url.Parse(resolverURL)
+		if err == nil && (parsedURL.Scheme != "https" || parsedURL.Host == "") {
+			err = errors.New("unsupported URL")
+		}
+		if err != nil {
+			return nil, common.ContextError(
+				fmt.Errorf("invalid DownloadHostResolverURL: %s", err))
+		}
+	}
+
+	return resolver, nil
+}
+
+// LookupIP implements the HostResolver interface. The DNS-over-HTTPS
+// request is dialed with dialConfig.
+func (resolver *downloadHostResolver) LookupIP(
+	ctx context.Context, host string, dialConfig *DialConfig) ([]net.IP, error) {
+
+	IPs, ok := resolver.addresses[strings.ToLower(dns.Fqdn(host))]
+	if ok {
+		return IPs, nil
+	}
+
+	if resolver.resolverURL == "" {
+		return LookupIP(ctx, host, dialConfig)
+	}
+
+	IPs, err := resolveDNSOverHTTPS(ctx, resolver.resolverURL, host, dialConfig)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return IPs, nil
+}
+
+// resolveDNSOverHTTPS makes a DNS-over-HTTPS (RFC 8484) request for the A
+// records of host. The resolver host is resolved and dialed using
+// dialConfig, and its certificate is verified with the system root CAs,
+// or with dialConfig.TrustedCACertificatesFilename when set.
+func resolveDNSOverHTTPS(
+	ctx context.Context,
+	resolverURL string,
+	host string,
+	dialConfig *DialConfig) ([]net.IP, error) {
+
+	tlsConfig := &tls.Config{}
+	if dialConfig.TrustedCACertificatesFilename != "" {
+		certData, err := ioutil.ReadFile(dialConfig.TrustedCACertificatesFilename)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(certData)
+	}
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       NewTCPDialer(dialConfig),
+			TLSClientConfig:   tlsConfig,
+			DisableKeepAlives: true,
+		},
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	query.RecursionDesired = true
+	// RFC 8484 recommends a DNS ID of 0, for HTTP cache friendliness.
+	query.Id = 0
+
+	packedQuery, err := query.Pack()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	request, err := http.NewRequest("POST", resolverURL, bytes.NewReader(packedQuery))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, common.ContextError(
+			fmt.Errorf("unexpected response status code: %d", response.StatusCode))
+	}
+
+	packedResponse, err := ioutil.ReadAll(
+		io.LimitReader(response.Body, downloadHostMaxResponseSize))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	dnsResponse := new(dns.Msg)
+	err = dnsResponse.Unpack(packedResponse)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if dnsResponse.Rcode != dns.RcodeSuccess {
+		return nil, common.ContextError(
+			fmt.Errorf("unexpected DNS response code: %s", dns.RcodeToString[dnsResponse.Rcode]))
+	}
+
+	var IPs []net.IP
+	for _, answer := range dnsResponse.Answer {
+		if a, ok := answer.(*dns.A); ok {
+			IPs = append(IPs, a.A)
+		}
+	}
+
+	return IPs, nil
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// nextUploadBatch returns up to size of the oldest runs queued for upload.
+// The runs remain queued until the batch is acknowledged.
+func (telemetry *fetchTelemetry) nextUploadBatch(size int) []*FetchTelemetryRun {
+
+	telemetry.mutex.Lock()
+	defer telemetry.mutex.Unlock()
+
+	if size > len(telemetry.uploadQueue) {
+		size = len(telemetry.uploadQueue)
+	}
+
+	return append([]*FetchTelemetryRun(nil), telemetry.uploadQueue[:size]...)
+}
+
+// acknowledgeUploadBatch removes the runs in an uploaded batch from the
+// upload queue. Runs are appended to the queue while a batch is uploading,
+// and the oldest runs may be discarded, so only the runs of the batch which
+// remain at the head of the queue are removed.
+func (telemetry *fetchTelemetry) acknowledgeUploadBatch(batch []*FetchTelemetryRun) {
+
+	telemetry.mutex.Lock()
+	defer telemetry.mutex.Unlock()
+
+	uploaded := make(map[*FetchTelemetryRun]bool)
+	for _, run := range batch {
+		uploaded[run] = true
+	}
+
+	i := 0
+	for i < len(telemetry.uploadQueue) && uploaded[telemetry.uploadQueue[i]] {
+		i += 1
+	}
+
+	telemetry.uploadQueue = append([]*FetchTelemetryRun(nil), telemetry.uploadQueue[i:]...)
+}
+
+// uploadFetchTelemetry uploads the queued fetch telemetry to
+// Config.FetchTelemetryUploadURL, in batches of up to
+// RemoteServerListTelemetryUploadBatchSize runs, until the queue is empty.
+// Each batch is removed from the queue once it's uploaded, so when an
+// upload fails, the error is returned and the next call resumes with the
+// failed batch. The HTTP client for each batch is made with makeHTTPClient.
+func uploadFetchTelemetry(
+	ctx context.Context,
+	config *Config,
+	makeHTTPClient func(ctx context.Context) (*http.Client, error)) error {
+
+	for {
+
+		p := config.clientParameters.Get()
+		batchSize := p.Int(parameters.RemoteServerListTelemetryUploadBatchSize)
+		timeout := p.Duration(parameters.RemoteServerListTelemetryUploadTimeout)
+		p = nil
+
+		batch := remoteServerListFetchTelemetry.nextUploadBatch(batchSize)
+		if len(batch) == 0 {
+			return nil
+		}
+
+		err := uploadFetchTelemetryBatch(ctx, config, timeout, makeHTTPClient, batch)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		remoteServerListFetchTelemetry.acknowledgeUploadBatch(batch)
+
+		NoticeFetchTelemetryUploaded(len(batch))
+	}
+}
+
+func uploadFetchTelemetryBatch(
+	ctx context.Context,
+	config *Config,
+	timeout time.Duration,
+	makeHTTPClient func(ctx context.Context) (*http.Client, error),
+	batch []*FetchTelemetryRun) error {
+
+	// The runs are recorded when their fetches finish and aren't modified
+	// after, so the batch may be marshaled without holding the
+	// remoteServerListFetchTelemetry mutex.
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	ctx, cancelFunc := context.WithTimeout(ctx, timeout)
+	defer cancelFunc()
+
+	httpClient, err := makeHTTPClient(ctx)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	request, err := http.NewRequest("POST", config.FetchTelemetryUploadURL, bytes.NewReader(body))
+	if err != nil {
+		return common.ContextError(err)
+	}
+	request = request.WithContext(ctx)
+
+	request.Header.Set("User-Agent", MakePsiphonUserAgent(config))
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return common.ContextError(errors.New("received HTTP status: " + response.Status))
+	}
+
+	return nil
+}
+
+// runFetchTelemetryUploader uploads the queued fetch telemetry each time
+// it's signalled, until ctx is done. A failed upload is retried, resuming
+// with the failed batch, after a backoff which starts at
+// RemoteServerListTelemetryUploadBackoff and doubles with each consecutive
+// failure, up to RemoteServerListTelemetryUploadMaxBackoff.
+func runFetchTelemetryUploader(
+	ctx context.Context,
+	config *Config,
+	makeHTTPClient func(ctx context.Context) (*http.Client, error),
+	signal <-chan struct{}) {
+
+uploaderLoop:
+	for {
+		select {
+		case <-signal:
+		case <-ctx.Done():
+			break uploaderLoop
+		}
+
+		p := config.clientParameters.Get()
+		backoff := p.Duration(parameters.RemoteServerListTelemetryUploadBackoff)
+		maxBackoff := p.Duration(parameters.RemoteServerListTelemetryUploadMaxBackoff)
+		p = nil
+
+		for {
+			err := uploadFetchTelemetry(ctx, config, makeHTTPClient)
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+
+			NoticeAlert("failed to upload fetch telemetry, retrying in %s: %s", backoff, err)
+
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				break uploaderLoop
+			}
+
+			backoff *= 2
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// +build darwin linux
+
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"syscall"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// getAvailableInodes returns the number of free inodes on the filesystem
+// containing directory. The returned bool is false when the filesystem
+// doesn't report an inode limit.
+func getAvailableInodes(directory string) (uint64, bool, error) {
+
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(directory, &stat)
+	if err != nil {
+		return 0, false, common.ContextError(err)
+	}
+
+	// Some filesystems, such as btrfs, allocate inodes dynamically and
+	// report 0 total inodes.
+	if stat.Files == 0 {
+		return 0, false, nil
+	}
+
+	return uint64(stat.Ffree), true, nil
+}
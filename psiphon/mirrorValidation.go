@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// MirrorHealthReport is the outcome of validating a remote server list
+// mirror; see ValidateMirror.
+type MirrorHealthReport struct {
+
+	// URL is the validated mirror URL.
+	URL string
+
+	// Healthy indicates that the mirror is reachable and serves a package
+	// which validates and contains only valid server entries.
+	Healthy bool
+
+	// Reachable indicates that the package was downloaded from the mirror.
+	Reachable bool
+
+	// SignatureValid indicates that the package signature validated with
+	// one of the configured signing public keys.
+	SignatureValid bool
+
+	// TrustTier is the trust tier of the key which validated the package
+	// signature, when SignatureValid is set.
+	TrustTier string
+
+	// ServerEntryCount is the number of valid server entries in the package.
+	ServerEntryCount int
+
+	// DownloadedBytes is the size of the downloaded package.
+	DownloadedBytes int64
+
+	// DownloadDuration is the time taken to download the package.
+	DownloadDuration time.Duration
+
+	// ETag is the ETag of the downloaded package, if any.
+	ETag string
+
+	// Error describes why the mirror isn't healthy, and is empty when the
+	// mirror is healthy.
+	Error string
+}
+
+// ValidateMirror health-checks the remote server list mirror at url: the
+// server list package is downloaded, untunneled, then decompressed and
+// signature-validated as a downloaded common remote server list is, with
+// config.RemoteServerListSignaturePublicKey or the low trust signing public
+// key, and its server entries are decoded.
+//
+// No server entries are stored, no ETags or other download state are
+// persisted, and any config overrides in the package are ignored, so
+// ValidateMirror doesn't modify the datastore. The package is downloaded in
+// full on each call, to a temporary directory in config.DataStoreDirectory
+// which is deleted once the validation completes.
+//
+// A mirror which fails the health check is reported in the returned
+// MirrorHealthReport; an error is returned only when the validation can't
+// be performed.
+func ValidateMirror(config *Config, url string) (*MirrorHealthReport, error) {
+
+	err := checkSignaturePublicKey(config)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	directory, err := ioutil.TempDir(config.DataStoreDirectory, "validate-mirror-")
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	defer os.RemoveAll(directory)
+
+	report := &MirrorHealthReport{URL: url}
+
+	err = validateMirror(config, url, filepath.Join(directory, "package"), report)
+	if err != nil {
+		report.Error = err.Error()
+		return report, nil
+	}
+
+	report.Healthy = true
+
+	return report, nil
+}
+
+// validateMirror performs ValidateMirror, downloading to filename and
+// recording the validation outcome in report.
+func validateMirror(
+	config *Config, url, filename string, report *MirrorHealthReport) error {
+
+	p := config.clientParameters.Get()
+	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
+	connectTimeout := p.Duration(parameters.RemoteServerListConnectTimeout)
+	p = nil
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), downloadTimeout)
+	defer cancelFunc()
+
+	untunneledDialConfig := &DialConfig{
+		UpstreamProxyURL:              config.UpstreamProxyURL,
+		CustomHeaders:                 config.CustomHeaders,
+		TrustedCACertificatesFilename: config.TrustedCACertificatesFilename,
+	}
+
+	httpClient, err := makeDownloadHTTPClient(
+		ctx, config, nil, untunneledDialConfig, false, nil)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	if connectTimeout > 0 {
+		setDownloadConnectTimeout(httpClient, connectTimeout)
+	}
+
+	startTime := time.Now()
+
+	var savedBytes int64
+
+	n, etag, err := resumeDownload(
+		ctx,
+		httpClient,
+		url,
+		MakePsiphonUserAgent(config),
+		filename,
+		"",
+		&savedBytes,
+		nil,
+		false,
+		nil,
+		0)
+
+	report.DownloadedBytes = n
+	report.DownloadDuration = time.Since(startTime)
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	report.Reachable = true
+	report.ETag = etag
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer file.Close()
+
+	publicKey, lowTrustPublicKey := getSignaturePublicKeys(config)
+
+	var serverListPayloadReader io.Reader
+	trustTier, err := validateWithTrustTiers(
+		publicKey,
+		lowTrustPublicKey,
+		func(signingPublicKey string) error {
+			var err error
+			serverListPayloadReader, _, err =
+				common.NewAuthenticatedDataPackageReaderWithDictionary(
+					file, signingPublicKey, config.serverEntryCompressionDictionary)
+			return err
+		})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	report.SignatureValid = true
+	report.TrustTier = trustTier
+
+	serverEntryDecoder := newRemoteServerEntryDecoder(
+		config,
+		serverListPayloadReader,
+		config.getCurrentTimestamp(),
+		protocol.SERVER_ENTRY_SOURCE_REMOTE)
+
+	for {
+		serverEntryFields, err := serverEntryDecoder.Next()
+		if err != nil {
+			return common.ContextError(err)
+		}
+		if serverEntryFields == nil {
+			break
+		}
+		report.ServerEntryCount += 1
+	}
+
+	return nil
+}
@@ -20,22 +20,30 @@
 package psiphon
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Psiphon-Labs/dns"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/fragmentor"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/andybalholm/brotli"
 )
 
 const DNS_PORT = 53
@@ -88,6 +96,11 @@ type DialConfig struct {
 	// FragmentorConfig specifies whether to layer a fragmentor.Conn on top
 	// of dialed TCP conns, and the fragmentation configuration to use.
 	FragmentorConfig *fragmentor.Config
+
+	// HostResolver, when set, resolves dial address domain names in place
+	// of LookupIP. HostResolver is not used with an UpstreamProxyURL, as the
+	// proxy resolves the domain name.
+	HostResolver HostResolver
 }
 
 // NetworkConnectivityChecker defines the interface to the external
@@ -106,6 +119,19 @@ type DeviceBinder interface {
 	BindToDevice(fileDescriptor int) (string, error)
 }
 
+// Clock defines the interface to a provider of the current time. A Clock
+// may be set in Config to make time-dependent logic deterministic in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+// HostResolver defines the interface to a custom resolver for dial address
+// domain names. LookupIP should make any network requests using dialConfig,
+// which is the DialConfig of the dial with no HostResolver.
+type HostResolver interface {
+	LookupIP(ctx context.Context, host string, dialConfig *DialConfig) ([]net.IP, error)
+}
+
 // DnsServerGetter defines the interface to the external GetDnsServer provider
 // which calls into the host application to discover the native network DNS
 // server settings.
@@ -270,6 +296,22 @@ func MakeUntunneledHTTPClient(
 	verifyLegacyCertificate *x509.Certificate,
 	skipVerify bool) (*http.Client, error) {
 
+	return makeUntunneledHTTPClient(
+		ctx, config, untunneledDialConfig, verifyLegacyCertificate, skipVerify, 0, nil)
+}
+
+// makeUntunneledHTTPClient is MakeUntunneledHTTPClient with an optional
+// minimum TLS version, see CustomTLSConfig.MinVersion, and an optional
+// per-URL TLS config.
+func makeUntunneledHTTPClient(
+	ctx context.Context,
+	config *Config,
+	untunneledDialConfig *DialConfig,
+	verifyLegacyCertificate *x509.Certificate,
+	skipVerify bool,
+	minTLSVersion uint16,
+	downloadTLSConfig *parameters.DownloadTLSConfig) (*http.Client, error) {
+
 	dialer := NewTCPDialer(untunneledDialConfig)
 
 	// Note: when verifyLegacyCertificate is not nil, some
@@ -282,7 +324,18 @@ func MakeUntunneledHTTPClient(
 		SNIServerName:                 "",
 		SkipVerify:                    skipVerify,
 		TrustedCACertificatesFilename: untunneledDialConfig.TrustedCACertificatesFilename,
+		MinVersion:                    minTLSVersion,
 	}
+
+	var pinnedPublicKeyHashes []string
+	if downloadTLSConfig != nil {
+		if downloadTLSConfig.SNIServerName != "" {
+			tlsConfig.UseDialAddrSNI = false
+			tlsConfig.SNIServerName = downloadTLSConfig.SNIServerName
+		}
+		pinnedPublicKeyHashes = downloadTLSConfig.PinnedPublicKeyHashes
+	}
+
 	tlsConfig.EnableClientSessionCache(config.clientParameters)
 
 	tlsDialer := NewCustomTLSDialer(tlsConfig)
@@ -292,7 +345,20 @@ func MakeUntunneledHTTPClient(
 			return dialer(ctx, network, addr)
 		},
 		DialTLS: func(network, addr string) (net.Conn, error) {
-			return tlsDialer(ctx, network, addr)
+			conn, err := tlsDialer(ctx, network, addr)
+			if err != nil || len(pinnedPublicKeyHashes) == 0 {
+				return conn, err
+			}
+			var certificates []*x509.Certificate
+			if c, ok := conn.(tlsConn); ok {
+				certificates = c.GetPeerCertificates()
+			}
+			err = verifyPinnedPublicKey(certificates, pinnedPublicKeyHashes)
+			if err != nil {
+				conn.Close()
+				return nil, common.ContextError(err)
+			}
+			return conn, nil
 		},
 	}
 
@@ -312,6 +378,17 @@ func MakeTunneledHTTPClient(
 	tunnel *Tunnel,
 	skipVerify bool) (*http.Client, error) {
 
+	return makeTunneledHTTPClient(config, tunnel, skipVerify, nil)
+}
+
+// makeTunneledHTTPClient is MakeTunneledHTTPClient with an optional per-URL
+// TLS config.
+func makeTunneledHTTPClient(
+	config *Config,
+	tunnel *Tunnel,
+	skipVerify bool,
+	downloadTLSConfig *parameters.DownloadTLSConfig) (*http.Client, error) {
+
 	// Note: there is no dial context since SSH port forward dials cannot
 	// be interrupted directly. Closing the tunnel will interrupt the dials.
 
@@ -338,13 +415,67 @@ func MakeTunneledHTTPClient(
 		transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
 	}
 
+	if downloadTLSConfig != nil {
+
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+
+		transport.TLSClientConfig.ServerName = downloadTLSConfig.SNIServerName
+
+		// VerifyPeerCertificate is called after any normal certificate
+		// verification, and also when InsecureSkipVerify is set.
+		pinnedPublicKeyHashes := downloadTLSConfig.PinnedPublicKeyHashes
+		if len(pinnedPublicKeyHashes) > 0 {
+			transport.TLSClientConfig.VerifyPeerCertificate = func(
+				rawCerts [][]byte, _ [][]*x509.Certificate) error {
+
+				var certificates []*x509.Certificate
+				if len(rawCerts) > 0 {
+					certificate, err := x509.ParseCertificate(rawCerts[0])
+					if err != nil {
+						return common.ContextError(err)
+					}
+					certificates = append(certificates, certificate)
+				}
+				return verifyPinnedPublicKey(certificates, pinnedPublicKeyHashes)
+			}
+		}
+	}
+
 	return &http.Client{
 		Transport: transport,
 	}, nil
 }
 
+// verifyPinnedPublicKey checks that the public key of the server
+// certificate, the first of certificates, has one of the pinned SHA-256
+// hashes; see parameters.DownloadTLSConfig.PinnedPublicKeyHashes. Only the
+// server certificate is checked, as the TLS handshake proves that the server
+// holds its private key.
+func verifyPinnedPublicKey(
+	certificates []*x509.Certificate, pinnedPublicKeyHashes []string) error {
+
+	if len(certificates) < 1 {
+		return common.ContextError(errors.New("no certificate to verify"))
+	}
+
+	digest := sha256.Sum256(certificates[0].RawSubjectPublicKeyInfo)
+	publicKeyHash := base64.StdEncoding.EncodeToString(digest[:])
+
+	if !common.Contains(pinnedPublicKeyHashes, publicKeyHash) {
+		return common.ContextError(errors.New("unpinned public key"))
+	}
+
+	return nil
+}
+
 // MakeDownloadHTTPClient is a helper that sets up a http.Client
-// for use either untunneled or through a tunnel.
+// for use either untunneled or through a tunnel. When
+// parameters.DownloadDisableKeepAlives is set, the client doesn't reuse
+// connections and each request is sent with "Connection: close".
+// Untunneled downloads reject TLS versions lower than
+// config.MinDownloadTLSVersion.
 func MakeDownloadHTTPClient(
 	ctx context.Context,
 	config *Config,
@@ -352,26 +483,58 @@ func MakeDownloadHTTPClient(
 	untunneledDialConfig *DialConfig,
 	skipVerify bool) (*http.Client, error) {
 
+	return makeDownloadHTTPClient(
+		ctx, config, tunnel, untunneledDialConfig, skipVerify, nil)
+}
+
+// makeDownloadHTTPClient is MakeDownloadHTTPClient with an optional per-URL
+// TLS config; see parameters.DownloadURL.TLSConfig.
+func makeDownloadHTTPClient(
+	ctx context.Context,
+	config *Config,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	skipVerify bool,
+	downloadTLSConfig *parameters.DownloadTLSConfig) (*http.Client, error) {
+
 	var httpClient *http.Client
 	var err error
 
 	if tunnel != nil {
 
-		httpClient, err = MakeTunneledHTTPClient(
-			config, tunnel, skipVerify)
+		httpClient, err = makeTunneledHTTPClient(
+			config, tunnel, skipVerify, downloadTLSConfig)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
 
 	} else {
 
-		httpClient, err = MakeUntunneledHTTPClient(
-			ctx, config, untunneledDialConfig, nil, skipVerify)
+		// When configured, download host domain names are resolved with
+		// the DownloadHostAddresses/DownloadHostResolverURL resolver, to
+		// avoid relying on the system resolver.
+		if config.downloadHostResolver != nil {
+			dialConfig := *untunneledDialConfig
+			dialConfig.HostResolver = config.downloadHostResolver
+			untunneledDialConfig = &dialConfig
+		}
+
+		httpClient, err = makeUntunneledHTTPClient(
+			ctx, config, untunneledDialConfig, nil, skipVerify,
+			config.minDownloadTLSVersion, downloadTLSConfig)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
 	}
 
+	if config.clientParameters.Get().Bool(parameters.DownloadDisableKeepAlives) {
+		transport, ok := httpClient.Transport.(*http.Transport)
+		if !ok {
+			return nil, common.ContextError(errors.New("unexpected transport type"))
+		}
+		transport.DisableKeepAlives = true
+	}
+
 	return httpClient, nil
 }
 
@@ -389,6 +552,14 @@ func MakeDownloadHTTPClient(
 // object has the same ETag. ifNoneMatchETag has an effect only when no
 // partial download is in progress.
 //
+// The raw, unencoded object is always stored in downloadFilename. When the
+// host applies a gzip or Brotli content coding anyway, the partial download
+// holds the encoded bytes, consistent with Range offsets, and is decoded
+// once the download is complete.
+//
+// A partial download of an object with a weak ETag is not resumed; the
+// download restarts from the beginning.
+//
 func ResumeDownload(
 	ctx context.Context,
 	httpClient *http.Client,
@@ -397,26 +568,105 @@ func ResumeDownload(
 	downloadFilename string,
 	ifNoneMatchETag string) (int64, string, error) {
 
+	return resumeDownload(
+		ctx,
+		httpClient,
+		downloadURL,
+		userAgent,
+		downloadFilename,
+		ifNoneMatchETag,
+		nil,
+		nil,
+		false,
+		nil,
+		0)
+}
+
+// resumeDownload performs ResumeDownload. When savedBytes is not nil and
+// the server resumes a partial download, the partial download size is
+// stored in savedBytes: these are the bytes not downloaded again, versus
+// restarting the download.
+//
+// When encryptionKey is not nil, the partial download and downloadFilename
+// are encrypted at rest with encryptionKey; see openDownloadFile. A partial
+// download which isn't encrypted with encryptionKey is not resumed.
+//
+// When verifyRangeDigest is set, a partial download is resumed only when the
+// server confirms the digest of the partial download byte range; see
+// verifyPartialDownloadDigest.
+//
+// When nonResumableOrigins is not nil, origins which don't support Range
+// requests are recorded in nonResumableOrigins, and downloads from flagged
+// origins are made in full, without a Range request. An origin is flagged
+// after nonResumableThreshold consecutive Range requests for a partial
+// download are ignored; see downloadNonResumableOrigins.
+func resumeDownload(
+	ctx context.Context,
+	httpClient *http.Client,
+	downloadURL string,
+	userAgent string,
+	downloadFilename string,
+	ifNoneMatchETag string,
+	savedBytes *int64,
+	encryptionKey *downloadFileKey,
+	verifyRangeDigest bool,
+	nonResumableOrigins *downloadNonResumableOrigins,
+	nonResumableThreshold int) (int64, string, error) {
+
 	partialFilename := fmt.Sprintf("%s.part", downloadFilename)
 
 	partialETagFilename := fmt.Sprintf("%s.part.etag", downloadFilename)
 
-	file, err := os.OpenFile(partialFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	// The file is opened for reading as well as appending, so that the
+	// encryption header of a partial download may be read.
+	file, err := os.OpenFile(partialFilename, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
 	if err != nil {
 		return 0, "", common.ContextError(err)
 	}
 	defer file.Close()
 
-	fileInfo, err := file.Stat()
+	// partialSize is the size of the partial download content, excluding
+	// any encryption header. A partial download written with a different
+	// encryption setting can't be appended to, so the download restarts
+	// from the beginning.
+	partialSize, ok, err := getPartialDownloadSize(file, encryptionKey)
 	if err != nil {
 		return 0, "", common.ContextError(err)
 	}
+	if !ok {
+
+		NoticeInfo("restarting download with changed encryption: %s", downloadURL)
+
+		err = file.Truncate(0)
+		if err != nil {
+			return 0, "", common.ContextError(err)
+		}
+
+		partialSize = 0
+	}
+
+	// A partial download from an origin which doesn't support Range
+	// requests can't be resumed, so the download restarts from the
+	// beginning, without a Range request.
+	nonResumable := nonResumableOrigins != nil &&
+		nonResumableOrigins.isNonResumable(downloadURL)
+	if nonResumable && partialSize > 0 {
+
+		NoticeInfo("restarting download from non-resumable origin: %s", downloadURL)
+
+		err = file.Truncate(0)
+		if err != nil {
+			return 0, "", common.ContextError(err)
+		}
+
+		partialSize = 0
+	}
 
 	// A partial download should have an ETag which is to be sent with the
 	// Range request to ensure that the source object is the same as the
 	// one that is partially downloaded.
 	var partialETag []byte
-	if fileInfo.Size() > 0 {
+	if partialSize > 0 {
 
 		partialETag, err = ioutil.ReadFile(partialETagFilename)
 
@@ -442,6 +692,62 @@ func ResumeDownload(
 			return 0, "", common.ContextError(
 				fmt.Errorf("failed to load partial download ETag: %s", err))
 		}
+
+		// A weak ETag doesn't guarantee that two versions of the object are
+		// byte-for-byte identical, so Range requests can't safely be used to
+		// combine partial downloads. If-Match also uses strong comparison, so
+		// the resume request would always fail. Instead, discard the partial
+		// download and restart from the beginning. The weak ETag remains
+		// usable for change detection via If-None-Match.
+		if isWeakETag(string(partialETag)) {
+
+			NoticeInfo("restarting download with weak ETag: %s", downloadURL)
+
+			err = file.Truncate(0)
+			if err != nil {
+				return 0, "", common.ContextError(err)
+			}
+
+			partialSize = 0
+
+			partialETag = nil
+		}
+
+		// The If-Match ETag confirms that the resource is unchanged, but not
+		// that the partial download content is intact. When verifyRangeDigest
+		// is set, the partial download is first checked against the digest
+		// of the same byte range of the resource. On any doubt, including a
+		// server which doesn't report the digest, the partial download is
+		// discarded and the download restarts from the beginning.
+		if partialETag != nil && verifyRangeDigest {
+
+			err = verifyPartialDownloadDigest(
+				ctx,
+				httpClient,
+				downloadURL,
+				userAgent,
+				partialFilename,
+				partialSize,
+				string(partialETag),
+				encryptionKey)
+			if err != nil {
+
+				if ctx.Err() != nil {
+					return 0, "", common.ContextError(err)
+				}
+
+				NoticeInfo("restarting download with unverified partial download: %s: %s", downloadURL, err)
+
+				err = file.Truncate(0)
+				if err != nil {
+					return 0, "", common.ContextError(err)
+				}
+
+				partialSize = 0
+
+				partialETag = nil
+			}
+		}
 	}
 
 	request, err := http.NewRequest("GET", downloadURL, nil)
@@ -453,10 +759,20 @@ func ResumeDownload(
 
 	request.Header.Set("User-Agent", userAgent)
 
-	request.Header.Add("Range", fmt.Sprintf("bytes=%d-", fileInfo.Size()))
+	// Explicitly request no content coding. Range offsets apply to the
+	// encoded object, so a transparently decoded response body can't be
+	// resumed. Setting Accept-Encoding also ensures that the http.Transport
+	// doesn't request and transparently decode gzip.
+	request.Header.Set("Accept-Encoding", "identity")
+
+	if !nonResumable {
+		request.Header.Add("Range", fmt.Sprintf("bytes=%d-", partialSize))
+	}
 
 	if partialETag != nil {
 
+		NoticeResumeDownload(downloadURL, partialSize, request.Header.Get("Range"))
+
 		// Note: not using If-Range, since not all host servers support it.
 		// Using If-Match means we need to check for status code 412 and reset
 		// when the ETag has changed since the last partial download.
@@ -475,7 +791,7 @@ func ResumeDownload(
 		// download will be discarded, and then the next retry will use
 		// If-None-Match.
 
-		// Note: in this case, fileInfo.Size() == 0
+		// Note: in this case, partialSize == 0
 
 		request.Header.Add("If-None-Match", ifNoneMatchETag)
 	}
@@ -483,7 +799,8 @@ func ResumeDownload(
 	response, err := httpClient.Do(request)
 
 	// The resumeable download may ask for bytes past the resource range
-	// since it doesn't store the "completed download" state. In this case,
+	// since it doesn't store the "completed download" state, or when the
+	// partial download is larger than the current resource. In this case,
 	// the HTTP server returns 416. Otherwise, we expect 206. We may also
 	// receive 412 on ETag mismatch.
 	if err == nil &&
@@ -505,7 +822,45 @@ func ResumeDownload(
 
 	responseETag := response.Header.Get("ETag")
 
-	if response.StatusCode == http.StatusPreconditionFailed {
+	if response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+
+		// The 416 response body isn't part of the resource, and the partial
+		// download can't be resumed. Discard the partial download and
+		// immediately restart the download from the beginning. The restart
+		// requests the range starting at 0, so any further 416 is an error
+		// and there's no repeated restart.
+		if partialSize == 0 {
+			return 0, "", common.ContextError(
+				errors.New("unexpected range not satisfiable"))
+		}
+
+		NoticeInfo("restarting download with unsatisfiable range: %s", downloadURL)
+
+		response.Body.Close()
+
+		// On Windows, file must be closed before it can be deleted
+		file.Close()
+
+		err = os.Remove(partialFilename)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, "", common.ContextError(err)
+		}
+		os.Remove(partialETagFilename)
+
+		return resumeDownload(
+			ctx,
+			httpClient,
+			downloadURL,
+			userAgent,
+			downloadFilename,
+			ifNoneMatchETag,
+			savedBytes,
+			encryptionKey,
+			verifyRangeDigest,
+			nonResumableOrigins,
+			nonResumableThreshold)
+
+	} else if response.StatusCode == http.StatusPreconditionFailed {
 		// When the ETag no longer matches, delete the partial download. As above,
 		// simply failing and relying on the caller's retry schedule.
 		os.Remove(partialFilename)
@@ -521,13 +876,54 @@ func ResumeDownload(
 		return 0, responseETag, nil
 	}
 
+	// A 200 response to a Range request for a partial download is the
+	// entire resource, which replaces the partial download.
+	if response.StatusCode == http.StatusOK && partialSize > 0 {
+
+		NoticeInfo("restarting download with ignored range: %s", downloadURL)
+
+		err = file.Truncate(0)
+		if err != nil {
+			return 0, "", common.ContextError(err)
+		}
+
+		if nonResumableOrigins != nil {
+			nonResumableOrigins.recordRangeIgnored(downloadURL, nonResumableThreshold)
+		}
+
+	} else if response.StatusCode == http.StatusPartialContent && partialSize > 0 {
+
+		if nonResumableOrigins != nil {
+			nonResumableOrigins.recordRangeHonored(downloadURL)
+		}
+	}
+
+	if nonResumableOrigins != nil &&
+		response.StatusCode != http.StatusPartialContent &&
+		strings.EqualFold(strings.TrimSpace(response.Header.Get("Accept-Ranges")), "none") {
+
+		nonResumableOrigins.flag(downloadURL)
+	}
+
+	if savedBytes != nil &&
+		partialETag != nil &&
+		response.StatusCode == http.StatusPartialContent {
+
+		*savedBytes = partialSize
+	}
+
 	// Not making failure to write ETag file fatal, in case the entire download
 	// succeeds in this one request.
 	ioutil.WriteFile(partialETagFilename, []byte(responseETag), 0600)
 
+	writer, err := makeDownloadFileWriter(file, encryptionKey)
+	if err != nil {
+		return 0, "", common.ContextError(err)
+	}
+
 	// A partial download occurs when this copy is interrupted. The io.Copy
 	// will fail, leaving a partial download in place (.part and .part.etag).
-	n, err := io.Copy(NewSyncFileWriter(file), response.Body)
+	n, err := io.Copy(writer, response.Body)
 
 	// From this point, n bytes are indicated as downloaded, even if there is
 	// an error; the caller may use this to report partial download progress.
@@ -546,12 +942,242 @@ func ResumeDownload(
 	// Remove if exists, to enable rename
 	os.Remove(downloadFilename)
 
-	err = os.Rename(partialFilename, downloadFilename)
-	if err != nil {
-		return n, "", common.ContextError(err)
+	// Despite the identity Accept-Encoding, some hosts apply a content
+	// coding. gzip and Brotli codings are decoded here.
+	var newContentDecoder func(io.Reader) (io.Reader, error)
+	switch strings.ToLower(response.Header.Get("Content-Encoding")) {
+	case "gzip", "x-gzip":
+		newContentDecoder = func(reader io.Reader) (io.Reader, error) {
+			return gzip.NewReader(reader)
+		}
+	case "br":
+		newContentDecoder = func(reader io.Reader) (io.Reader, error) {
+			return brotli.NewReader(reader), nil
+		}
+	}
+
+	if newContentDecoder != nil {
+
+		err = decodeContentEncodedFile(
+			partialFilename, downloadFilename, encryptionKey, newContentDecoder)
+		if err != nil {
+			// The encoded download is complete but can't be decoded; discard
+			// it so that the next attempt downloads it again.
+			os.Remove(downloadFilename)
+			os.Remove(partialFilename)
+			os.Remove(partialETagFilename)
+			return n, "", common.ContextError(err)
+		}
+
+		os.Remove(partialFilename)
+
+	} else {
+
+		err = os.Rename(partialFilename, downloadFilename)
+		if err != nil {
+			return n, "", common.ContextError(err)
+		}
 	}
 
 	os.Remove(partialETagFilename)
 
 	return n, responseETag, nil
 }
+
+// makeDownloadFileWriter is newDownloadFileWriter, and is a variable so that
+// tests may simulate download write errors.
+var makeDownloadFileWriter = newDownloadFileWriter
+
+// downloadNonResumableOrigins tracks download origins which don't support
+// Range requests, so that downloads from those origins are made in full
+// rather than repeatedly attempting to resume partial downloads. An origin
+// is flagged as non-resumable when it responds with Accept-Ranges: none, or
+// when it ignores consecutive Range requests for partial downloads,
+// responding with the entire resource. An origin is the scheme and host of
+// a download URL.
+type downloadNonResumableOrigins struct {
+	mutex        sync.Mutex
+	rangeIgnored map[string]int
+	nonResumable map[string]bool
+}
+
+func newDownloadNonResumableOrigins() *downloadNonResumableOrigins {
+	return &downloadNonResumableOrigins{
+		rangeIgnored: make(map[string]int),
+		nonResumable: make(map[string]bool),
+	}
+}
+
+// isNonResumable indicates whether the origin of downloadURL is flagged as
+// non-resumable.
+func (origins *downloadNonResumableOrigins) isNonResumable(downloadURL string) bool {
+	origins.mutex.Lock()
+	defer origins.mutex.Unlock()
+	return origins.nonResumable[getDownloadOrigin(downloadURL)]
+}
+
+// flag flags the origin of downloadURL as non-resumable.
+func (origins *downloadNonResumableOrigins) flag(downloadURL string) {
+
+	origin := getDownloadOrigin(downloadURL)
+
+	origins.mutex.Lock()
+	defer origins.mutex.Unlock()
+
+	if !origins.nonResumable[origin] {
+		NoticeInfo("flagged non-resumable download origin: %s", origin)
+	}
+	origins.nonResumable[origin] = true
+	delete(origins.rangeIgnored, origin)
+}
+
+// recordRangeIgnored records a Range request for a partial download from
+// downloadURL that was ignored, and flags the origin as non-resumable after
+// threshold consecutive ignored Range requests. A threshold of 0 disables
+// flagging.
+func (origins *downloadNonResumableOrigins) recordRangeIgnored(
+	downloadURL string, threshold int) {
+
+	origin := getDownloadOrigin(downloadURL)
+
+	origins.mutex.Lock()
+	origins.rangeIgnored[origin] += 1
+	flag := threshold > 0 && origins.rangeIgnored[origin] >= threshold
+	origins.mutex.Unlock()
+
+	if flag {
+		origins.flag(downloadURL)
+	}
+}
+
+// recordRangeHonored records a Range request for a partial download from
+// downloadURL that was honored, which resets the count of consecutive
+// ignored Range requests for the origin.
+func (origins *downloadNonResumableOrigins) recordRangeHonored(downloadURL string) {
+	origins.mutex.Lock()
+	defer origins.mutex.Unlock()
+	delete(origins.rangeIgnored, getDownloadOrigin(downloadURL))
+}
+
+// getDownloadOrigin returns the origin, the scheme and host, of downloadURL.
+// When downloadURL can't be parsed, the entire URL is the origin.
+func getDownloadOrigin(downloadURL string) string {
+	parsedURL, err := url.Parse(downloadURL)
+	if err != nil || parsedURL.Host == "" {
+		return downloadURL
+	}
+	return parsedURL.Scheme + "://" + parsedURL.Host
+}
+
+// verifyPartialDownloadDigest checks that the partialSize bytes of content
+// in the partial download file partialFilename match the resource at
+// downloadURL. A HEAD request for the partial download byte range, with
+// If-Match partialETag, must receive a 206 response with a Content-MD5
+// header, the digest of the byte range, as defined in RFC 1864, which
+// matches the digest of the partial download content. An error is returned
+// when the partial download isn't verified.
+func verifyPartialDownloadDigest(
+	ctx context.Context,
+	httpClient *http.Client,
+	downloadURL string,
+	userAgent string,
+	partialFilename string,
+	partialSize int64,
+	partialETag string,
+	encryptionKey *downloadFileKey) error {
+
+	file, err := openDownloadFile(partialFilename, encryptionKey)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	hash := md5.New()
+	_, err = io.CopyN(hash, file, partialSize)
+	file.Close()
+	if err != nil {
+		return common.ContextError(err)
+	}
+	partialDigest := base64.StdEncoding.EncodeToString(hash.Sum(nil))
+
+	request, err := http.NewRequest("HEAD", downloadURL, nil)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	request = request.WithContext(ctx)
+
+	request.Header.Set("User-Agent", userAgent)
+	request.Header.Set("Accept-Encoding", "identity")
+	request.Header.Add("Range", fmt.Sprintf("bytes=0-%d", partialSize-1))
+	request.Header.Add("If-Match", partialETag)
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusPartialContent {
+		return common.ContextError(
+			fmt.Errorf("unexpected response status code: %d", response.StatusCode))
+	}
+
+	digest := response.Header.Get("Content-MD5")
+	if digest == "" {
+		return common.ContextError(errors.New("missing range digest"))
+	}
+
+	if digest != partialDigest {
+		return common.ContextError(errors.New("range digest mismatch"))
+	}
+
+	return nil
+}
+
+// isWeakETag indicates whether etag is a weak entity tag, as defined in
+// RFC 7232 section 2.3.
+func isWeakETag(etag string) bool {
+	return strings.HasPrefix(etag, "W/")
+}
+
+// decodeContentEncodedFile decodes the content encoded encodedFilename, using
+// the decoder returned by newContentDecoder, into decodedFilename. When
+// encryptionKey is not nil, both files are encrypted with encryptionKey.
+func decodeContentEncodedFile(
+	encodedFilename, decodedFilename string,
+	encryptionKey *downloadFileKey,
+	newContentDecoder func(io.Reader) (io.Reader, error)) error {
+
+	encodedFile, err := openDownloadFile(encodedFilename, encryptionKey)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer encodedFile.Close()
+
+	reader, err := newContentDecoder(encodedFile)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	decodedFile, err := os.OpenFile(decodedFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer decodedFile.Close()
+
+	writer, err := newDownloadFileWriter(decodedFile, encryptionKey)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	_, err = io.Copy(writer, reader)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = decodedFile.Close()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
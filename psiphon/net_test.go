@@ -0,0 +1,888 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/dns"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestResumeDownloadRangeNotice(t *testing.T) {
+
+	dataDirectory, err := ioutil.TempDir("", "psiphon-resume-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	contents := make([]byte, 1000)
+	rand.Read(contents)
+	etag := "\"resume-download-test\""
+
+	var mutex sync.Mutex
+	var rangeHeaders []string
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mutex.Lock()
+			rangeHeaders = append(rangeHeaders, req.Header.Get("Range"))
+			mutex.Unlock()
+			w.Header().Add("ETag", etag)
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(contents))
+		}))
+	defer server.Close()
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	download := func(downloadFilename string) {
+
+		_, responseETag, err := ResumeDownload(
+			context.Background(),
+			&http.Client{},
+			server.URL,
+			"",
+			downloadFilename,
+			"")
+		if err != nil {
+			t.Fatalf("ResumeDownload failed: %s", err)
+		}
+		if responseETag != etag {
+			t.Fatalf("unexpected ETag: %s", responseETag)
+		}
+
+		downloadedContents, err := ioutil.ReadFile(downloadFilename)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %s", err)
+		}
+		if !bytes.Equal(downloadedContents, contents) {
+			t.Fatalf("unexpected downloaded contents")
+		}
+	}
+
+	// A download without a partial download in progress is not resumed.
+
+	download(filepath.Join(dataDirectory, "fresh"))
+
+	if recorder.count("ResumeDownload") != 0 {
+		t.Fatalf("unexpected resume notice")
+	}
+
+	// Resume a partial download.
+
+	offset := 300
+	downloadFilename := filepath.Join(dataDirectory, "resumed")
+
+	err = ioutil.WriteFile(downloadFilename+".part", contents[:offset], 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	err = ioutil.WriteFile(downloadFilename+".part.etag", []byte(etag), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	download(downloadFilename)
+
+	payloads := recorder.payloads("ResumeDownload")
+	if len(payloads) != 1 {
+		t.Fatalf("unexpected resume notice count: %d", len(payloads))
+	}
+
+	mutex.Lock()
+	rangeHeader := rangeHeaders[len(rangeHeaders)-1]
+	mutex.Unlock()
+
+	if payloads[0]["url"] != server.URL ||
+		payloads[0]["offset"] != float64(offset) ||
+		payloads[0]["range"] != rangeHeader ||
+		rangeHeader != "bytes=300-" {
+
+		t.Fatalf("unexpected resume notice: %+v, Range header %s", payloads[0], rangeHeader)
+	}
+}
+
+func TestResumeDownloadRangeNotSatisfiable(t *testing.T) {
+
+	dataDirectory, err := ioutil.TempDir("", "psiphon-resume-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	contents := make([]byte, 1000)
+	rand.Read(contents)
+	etag := "\"resume-download-test\""
+
+	var mutex sync.Mutex
+	var rangeHeaders []string
+
+	// http.ServeContent responds with 416 when the requested range starts
+	// past the end of the content.
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mutex.Lock()
+			rangeHeaders = append(rangeHeaders, req.Header.Get("Range"))
+			mutex.Unlock()
+			w.Header().Add("ETag", etag)
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(contents))
+		}))
+	defer server.Close()
+
+	// Simulate a partial download that's larger than the current resource,
+	// as when the resource has shrunk.
+
+	downloadFilename := filepath.Join(dataDirectory, "shrunk")
+
+	partialContents := make([]byte, 1500)
+	rand.Read(partialContents)
+
+	err = ioutil.WriteFile(downloadFilename+".part", partialContents, 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	err = ioutil.WriteFile(downloadFilename+".part.etag", []byte(etag), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	n, responseETag, err := ResumeDownload(
+		context.Background(),
+		&http.Client{},
+		server.URL,
+		"",
+		downloadFilename,
+		"")
+	if err != nil {
+		t.Fatalf("ResumeDownload failed: %s", err)
+	}
+	if n != int64(len(contents)) || responseETag != etag {
+		t.Fatalf("unexpected download result: %d, %s", n, responseETag)
+	}
+
+	// The partial download is discarded and the download restarts from the
+	// beginning.
+
+	mutex.Lock()
+	requestedRanges := fmt.Sprintf("%v", rangeHeaders)
+	mutex.Unlock()
+
+	if requestedRanges != "[bytes=1500- bytes=0-]" {
+		t.Fatalf("unexpected Range headers: %s", requestedRanges)
+	}
+
+	downloadedContents, err := ioutil.ReadFile(downloadFilename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	if !bytes.Equal(downloadedContents, contents) {
+		t.Fatalf("unexpected downloaded contents")
+	}
+
+	for _, filename := range []string{
+		downloadFilename + ".part", downloadFilename + ".part.etag"} {
+
+		_, err = os.Stat(filename)
+		if err == nil || !os.IsNotExist(err) {
+			t.Fatalf("unexpected partial download file: %s", filename)
+		}
+	}
+}
+
+func TestResumeDownloadVerifyRangeDigest(t *testing.T) {
+
+	dataDirectory, err := ioutil.TempDir("", "psiphon-resume-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	contents := make([]byte, 1000)
+	rand.Read(contents)
+	etag := "\"resume-download-test\""
+
+	var mutex sync.Mutex
+	var requests []string
+	supportDigest := true
+
+	// The server reports the Content-MD5 digest of the requested byte range
+	// in response to a ranged HEAD request, when supportDigest is set.
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mutex.Lock()
+			requests = append(requests, req.Method+" "+req.Header.Get("Range"))
+			digest := supportDigest
+			mutex.Unlock()
+			if digest && req.Method == "HEAD" {
+				var start, end int
+				_, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+				if err == nil && start <= end && end < len(contents) {
+					sum := md5.Sum(contents[start : end+1])
+					w.Header().Add("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+				}
+			}
+			w.Header().Add("ETag", etag)
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(contents))
+		}))
+	defer server.Close()
+
+	offset := 300
+
+	download := func(
+		name string, partialContents []byte, verifyRangeDigest bool) ([]byte, int64, string) {
+
+		downloadFilename := filepath.Join(dataDirectory, name)
+
+		err := ioutil.WriteFile(downloadFilename+".part", partialContents, 0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+		err = ioutil.WriteFile(downloadFilename+".part.etag", []byte(etag), 0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+
+		mutex.Lock()
+		requests = nil
+		mutex.Unlock()
+
+		var savedBytes int64
+		_, responseETag, err := resumeDownload(
+			context.Background(),
+			&http.Client{},
+			server.URL,
+			"",
+			downloadFilename,
+			"",
+			&savedBytes,
+			nil,
+			verifyRangeDigest,
+			nil,
+			0)
+		if err != nil {
+			t.Fatalf("resumeDownload failed: %s", err)
+		}
+		if responseETag != etag {
+			t.Fatalf("unexpected ETag: %s", responseETag)
+		}
+
+		downloadedContents, err := ioutil.ReadFile(downloadFilename)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %s", err)
+		}
+
+		mutex.Lock()
+		requestedRanges := fmt.Sprintf("%v", requests)
+		mutex.Unlock()
+
+		return downloadedContents, savedBytes, requestedRanges
+	}
+
+	stalePartialContents := make([]byte, offset)
+	rand.Read(stalePartialContents)
+
+	// Without the digest check, a stale partial download with the current
+	// ETag is resumed, and the downloaded file is corrupt.
+
+	downloaded, savedBytes, requestedRanges := download(
+		"unverified", stalePartialContents, false)
+	if bytes.Equal(downloaded, contents) ||
+		savedBytes != int64(offset) ||
+		requestedRanges != "[GET bytes=300-]" {
+
+		t.Fatalf("unexpected unverified download: %d, %s", savedBytes, requestedRanges)
+	}
+
+	// A valid partial download is resumed once its digest is confirmed.
+
+	downloaded, savedBytes, requestedRanges = download(
+		"valid", contents[:offset], true)
+	if !bytes.Equal(downloaded, contents) ||
+		savedBytes != int64(offset) ||
+		requestedRanges != "[HEAD bytes=0-299 GET bytes=300-]" {
+
+		t.Fatalf("unexpected valid download: %d, %s", savedBytes, requestedRanges)
+	}
+
+	// A stale partial download fails the digest check, and the download
+	// restarts from the beginning.
+
+	downloaded, savedBytes, requestedRanges = download(
+		"stale", stalePartialContents, true)
+	if !bytes.Equal(downloaded, contents) ||
+		savedBytes != 0 ||
+		requestedRanges != "[HEAD bytes=0-299 GET bytes=0-]" {
+
+		t.Fatalf("unexpected stale download: %d, %s", savedBytes, requestedRanges)
+	}
+
+	// When the server doesn't report the digest, the partial download
+	// can't be verified, and the download restarts from the beginning.
+
+	mutex.Lock()
+	supportDigest = false
+	mutex.Unlock()
+
+	downloaded, savedBytes, requestedRanges = download(
+		"no-digest", contents[:offset], true)
+	if !bytes.Equal(downloaded, contents) ||
+		savedBytes != 0 ||
+		requestedRanges != "[HEAD bytes=0-299 GET bytes=0-]" {
+
+		t.Fatalf("unexpected no digest download: %d, %s", savedBytes, requestedRanges)
+	}
+}
+
+func TestResumeDownloadNonResumableOrigin(t *testing.T) {
+
+	dataDirectory, err := ioutil.TempDir("", "psiphon-resume-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	contents := make([]byte, 1000)
+	rand.Read(contents)
+	etag := "\"resume-download-test\""
+
+	var mutex sync.Mutex
+	var requests []string
+
+	// Both servers ignore Range requests and always respond with the entire
+	// resource. One server also responds with Accept-Ranges: none.
+
+	makeServer := func(acceptRangesNone bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, req *http.Request) {
+				rangeHeader := req.Header.Get("Range")
+				if rangeHeader == "" {
+					rangeHeader = "none"
+				}
+				mutex.Lock()
+				requests = append(requests, rangeHeader)
+				mutex.Unlock()
+				w.Header().Add("ETag", etag)
+				if acceptRangesNone {
+					w.Header().Add("Accept-Ranges", "none")
+				}
+				w.Write(contents)
+			}))
+	}
+
+	ignoringServer := makeServer(false)
+	defer ignoringServer.Close()
+
+	acceptRangesNoneServer := makeServer(true)
+	defer acceptRangesNoneServer.Close()
+
+	nonResumableOrigins := newDownloadNonResumableOrigins()
+	threshold := 2
+	offset := 300
+
+	download := func(
+		serverURL string, name string, partialContents []byte) string {
+
+		downloadFilename := filepath.Join(dataDirectory, name)
+
+		if partialContents != nil {
+			err := ioutil.WriteFile(downloadFilename+".part", partialContents, 0600)
+			if err != nil {
+				t.Fatalf("WriteFile failed: %s", err)
+			}
+			err = ioutil.WriteFile(downloadFilename+".part.etag", []byte(etag), 0600)
+			if err != nil {
+				t.Fatalf("WriteFile failed: %s", err)
+			}
+		}
+
+		mutex.Lock()
+		requests = nil
+		mutex.Unlock()
+
+		var savedBytes int64
+		_, responseETag, err := resumeDownload(
+			context.Background(),
+			&http.Client{},
+			serverURL,
+			"",
+			downloadFilename,
+			"",
+			&savedBytes,
+			nil,
+			false,
+			nonResumableOrigins,
+			threshold)
+		if err != nil {
+			t.Fatalf("resumeDownload failed: %s", err)
+		}
+		if responseETag != etag {
+			t.Fatalf("unexpected ETag: %s", responseETag)
+		}
+		if savedBytes != 0 {
+			t.Fatalf("unexpected saved bytes: %d", savedBytes)
+		}
+
+		// The ignored Range request doesn't corrupt the download: the entire
+		// resource replaces the partial download.
+
+		downloadedContents, err := ioutil.ReadFile(downloadFilename)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %s", err)
+		}
+		if !bytes.Equal(downloadedContents, contents) {
+			t.Fatalf("unexpected downloaded contents")
+		}
+
+		mutex.Lock()
+		requestedRanges := fmt.Sprintf("%v", requests)
+		mutex.Unlock()
+
+		return requestedRanges
+	}
+
+	// The origin is flagged only after threshold consecutive ignored Range
+	// requests for a partial download.
+
+	for i := 0; i < threshold; i++ {
+		if nonResumableOrigins.isNonResumable(ignoringServer.URL) {
+			t.Fatalf("unexpected non-resumable origin after %d downloads", i)
+		}
+		requestedRanges := download(ignoringServer.URL, "ignoring", contents[:offset])
+		if requestedRanges != "[bytes=300-]" {
+			t.Fatalf("unexpected Range headers: %s", requestedRanges)
+		}
+	}
+
+	if !nonResumableOrigins.isNonResumable(ignoringServer.URL) {
+		t.Fatalf("non-resumable origin not flagged")
+	}
+
+	// Once flagged, a partial download is discarded and the download is made
+	// without a Range request, including for other URLs with the same
+	// origin.
+
+	requestedRanges := download(ignoringServer.URL+"/other", "ignoring", contents[:offset])
+	if requestedRanges != "[none]" {
+		t.Fatalf("unexpected Range headers: %s", requestedRanges)
+	}
+
+	// An origin which responds with Accept-Ranges: none is flagged
+	// immediately.
+
+	requestedRanges = download(acceptRangesNoneServer.URL, "accept-ranges-none", nil)
+	if requestedRanges != "[bytes=0-]" {
+		t.Fatalf("unexpected Range headers: %s", requestedRanges)
+	}
+
+	if !nonResumableOrigins.isNonResumable(acceptRangesNoneServer.URL) {
+		t.Fatalf("non-resumable origin not flagged")
+	}
+
+	requestedRanges = download(acceptRangesNoneServer.URL, "accept-ranges-none", contents[:offset])
+	if requestedRanges != "[none]" {
+		t.Fatalf("unexpected Range headers: %s", requestedRanges)
+	}
+}
+
+func TestMakeDownloadHTTPClientDisableKeepAlives(t *testing.T) {
+
+	t.Run("keep-alive", func(t *testing.T) {
+		testMakeDownloadHTTPClientDisableKeepAlives(t, false)
+	})
+
+	t.Run("no keep-alive", func(t *testing.T) {
+		testMakeDownloadHTTPClientDisableKeepAlives(t, true)
+	})
+}
+
+func testMakeDownloadHTTPClientDisableKeepAlives(t *testing.T, disableKeepAlives bool) {
+
+	dataDirectory, err := ioutil.TempDir("", "psiphon-download-keep-alive-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	var mutex sync.Mutex
+	var connectionHeaders []string
+	var remoteAddrs []string
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mutex.Lock()
+			if req.Close {
+				connectionHeaders = append(connectionHeaders, "close")
+			} else {
+				connectionHeaders = append(connectionHeaders, req.Header.Get("Connection"))
+			}
+			remoteAddrs = append(remoteAddrs, req.RemoteAddr)
+			mutex.Unlock()
+			w.Write([]byte("contents"))
+		}))
+	defer server.Close()
+
+	config, err := LoadConfig([]byte(fmt.Sprintf(`
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DataStoreDirectory" : "%s",
+        "DownloadDisableKeepAlives" : %v
+    }`, dataDirectory, disableKeepAlives)))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	httpClient, err := MakeDownloadHTTPClient(
+		context.Background(), config, nil, &DialConfig{}, false)
+	if err != nil {
+		t.Fatalf("MakeDownloadHTTPClient failed: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		response, err := httpClient.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Get failed: %s", err)
+		}
+		_, err = ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatalf("ReadAll failed: %s", err)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, connectionHeader := range connectionHeaders {
+		if (connectionHeader == "close") != disableKeepAlives {
+			t.Fatalf("unexpected Connection header: %s", connectionHeader)
+		}
+	}
+
+	// Without keep-alive, each request uses a new connection.
+
+	if (remoteAddrs[0] != remoteAddrs[1]) != disableKeepAlives {
+		t.Fatalf("unexpected connection reuse: %v", remoteAddrs)
+	}
+}
+
+func TestMakeDownloadHTTPClientMinTLSVersion(t *testing.T) {
+
+	dataDirectory, err := ioutil.TempDir("", "psiphon-min-tls-version-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	handler := http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("contents"))
+		})
+
+	// The legacy server offers only TLS 1.0.
+
+	legacyServer := httptest.NewUnstartedServer(handler)
+	legacyServer.TLS = &tls.Config{
+		MinVersion: tls.VersionTLS10,
+		MaxVersion: tls.VersionTLS10,
+	}
+	legacyServer.StartTLS()
+	defer legacyServer.Close()
+
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	// Pin a TLS profile which completes handshakes with both servers, so
+	// that the version check, and not a handshake failure, rejects the
+	// legacy server.
+
+	makeConfig := func(configJSON string) (*Config, error) {
+		config, err := LoadConfig([]byte(fmt.Sprintf(`
+        {
+            "ClientPlatform" : "",
+            "ClientVersion" : "0",
+            "SponsorId" : "0",
+            "PropagationChannelId" : "0",
+            "DataStoreDirectory" : "%s",
+            "LimitTLSProfiles" : ["%s"]
+            %s
+        }`, dataDirectory, protocol.TLS_PROFILE_ANDROID_60, configJSON)))
+		if err != nil {
+			t.Fatalf("error processing configuration file: %s", err)
+		}
+		return config, config.Commit()
+	}
+
+	download := func(config *Config, url string) error {
+		httpClient, err := MakeDownloadHTTPClient(
+			context.Background(), config, nil, &DialConfig{}, true)
+		if err != nil {
+			t.Fatalf("MakeDownloadHTTPClient failed: %s", err)
+		}
+		response, err := httpClient.Get(url)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		_, err = ioutil.ReadAll(response.Body)
+		return err
+	}
+
+	// By default, the minimum is TLS 1.2.
+
+	t.Run("default minimum", func(t *testing.T) {
+		config, err := makeConfig("")
+		if err != nil {
+			t.Fatalf("error committing configuration file: %s", err)
+		}
+		err = download(config, legacyServer.URL)
+		if err == nil || !strings.Contains(err.Error(), "unsupported TLS version: TLS 1.0") {
+			t.Fatalf("unexpected download result: %v", err)
+		}
+		err = download(config, server.URL)
+		if err != nil {
+			t.Fatalf("download failed: %s", err)
+		}
+	})
+
+	t.Run("TLS 1.2 minimum", func(t *testing.T) {
+		config, err := makeConfig(`, "MinDownloadTLSVersion" : "TLS 1.2"`)
+		if err != nil {
+			t.Fatalf("error committing configuration file: %s", err)
+		}
+		err = download(config, legacyServer.URL)
+		if err == nil || !strings.Contains(err.Error(), "unsupported TLS version: TLS 1.0") {
+			t.Fatalf("unexpected download result: %v", err)
+		}
+		err = download(config, server.URL)
+		if err != nil {
+			t.Fatalf("download failed: %s", err)
+		}
+	})
+
+	t.Run("TLS 1.0 minimum", func(t *testing.T) {
+		config, err := makeConfig(`, "MinDownloadTLSVersion" : "TLS 1.0"`)
+		if err != nil {
+			t.Fatalf("error committing configuration file: %s", err)
+		}
+		err = download(config, legacyServer.URL)
+		if err != nil {
+			t.Fatalf("download failed: %s", err)
+		}
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		_, err := makeConfig(`, "MinDownloadTLSVersion" : "SSL 3.0"`)
+		if err == nil {
+			t.Fatalf("unexpected commit success")
+		}
+	})
+}
+
+func TestDownloadHostResolver(t *testing.T) {
+
+	dataDirectory, err := ioutil.TempDir("", "psiphon-download-host-resolver-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataDirectory)
+
+	// The download host domain name isn't resolvable by the system resolver.
+
+	downloadHost := "download.invalid"
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("contents"))
+		}))
+	defer server.Close()
+
+	serverHost, serverPort, _ := net.SplitHostPort(server.Listener.Addr().String())
+	downloadURL := fmt.Sprintf("http://%s/", net.JoinHostPort(downloadHost, serverPort))
+
+	var mutex sync.Mutex
+	var resolverQueries []string
+
+	resolverServer := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			query := new(dns.Msg)
+			err := query.Unpack(body)
+			if err != nil || req.Method != "POST" ||
+				req.Header.Get("Content-Type") != "application/dns-message" {
+
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mutex.Lock()
+			resolverQueries = append(resolverQueries, query.Question[0].Name)
+			mutex.Unlock()
+			response := new(dns.Msg)
+			response.SetReply(query)
+			if query.Question[0].Name == dns.Fqdn(downloadHost) {
+				response.Answer = append(response.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   query.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    60,
+					},
+					A: net.ParseIP(serverHost),
+				})
+			} else {
+				response.SetRcode(query, dns.RcodeNameError)
+			}
+			packedResponse, _ := response.Pack()
+			w.Header().Set("Content-Type", "application/dns-message")
+			w.Write(packedResponse)
+		}))
+	defer resolverServer.Close()
+
+	trustedCACertificatesFilename := filepath.Join(dataDirectory, "ca.pem")
+	err = ioutil.WriteFile(
+		trustedCACertificatesFilename,
+		pem.EncodeToMemory(&pem.Block{
+			Type: "CERTIFICATE", Bytes: resolverServer.Certificate().Raw}),
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	makeConfig := func(configJSON string) (*Config, error) {
+		config, err := LoadConfig([]byte(fmt.Sprintf(`
+        {
+            "ClientPlatform" : "",
+            "ClientVersion" : "0",
+            "SponsorId" : "0",
+            "PropagationChannelId" : "0",
+            "DataStoreDirectory" : "%s"
+            %s
+        }`, dataDirectory, configJSON)))
+		if err != nil {
+			t.Fatalf("error processing configuration file: %s", err)
+		}
+		return config, config.Commit()
+	}
+
+	download := func(config *Config) error {
+		httpClient, err := MakeDownloadHTTPClient(
+			context.Background(),
+			config,
+			nil,
+			&DialConfig{TrustedCACertificatesFilename: trustedCACertificatesFilename},
+			false)
+		if err != nil {
+			t.Fatalf("MakeDownloadHTTPClient failed: %s", err)
+		}
+		response, err := httpClient.Get(downloadURL)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		contents, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return err
+		}
+		if string(contents) != "contents" {
+			t.Fatalf("unexpected contents: %s", contents)
+		}
+		return nil
+	}
+
+	t.Run("system resolver", func(t *testing.T) {
+		config, err := makeConfig("")
+		if err != nil {
+			t.Fatalf("error committing configuration file: %s", err)
+		}
+		err = download(config)
+		if err == nil {
+			t.Fatalf("unexpected download success")
+		}
+	})
+
+	t.Run("static addresses", func(t *testing.T) {
+		config, err := makeConfig(fmt.Sprintf(
+			`, "DownloadHostAddresses" : {"%s" : ["%s"]}`, downloadHost, serverHost))
+		if err != nil {
+			t.Fatalf("error committing configuration file: %s", err)
+		}
+		err = download(config)
+		if err != nil {
+			t.Fatalf("download failed: %s", err)
+		}
+	})
+
+	t.Run("DNS-over-HTTPS", func(t *testing.T) {
+		config, err := makeConfig(fmt.Sprintf(
+			`, "DownloadHostResolverURL" : "%s/dns-query"`, resolverServer.URL))
+		if err != nil {
+			t.Fatalf("error committing configuration file: %s", err)
+		}
+		err = download(config)
+		if err != nil {
+			t.Fatalf("download failed: %s", err)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if len(resolverQueries) != 1 || resolverQueries[0] != dns.Fqdn(downloadHost) {
+			t.Fatalf("unexpected resolver queries: %v", resolverQueries)
+		}
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		for _, configJSON := range []string{
+			`, "DownloadHostAddresses" : {"download.invalid" : ["invalid"]}`,
+			`, "DownloadHostAddresses" : {"download.invalid" : []}`,
+			`, "DownloadHostResolverURL" : "http://127.0.0.1/dns-query"`,
+		} {
+			_, err := makeConfig(configJSON)
+			if err == nil {
+				t.Fatalf("unexpected commit success: %s", configJSON)
+			}
+		}
+	})
+}
@@ -185,6 +185,32 @@ const (
 	noticeSyncHomepages  = 16
 )
 
+// noticeSeverity orders the Info, Alert, and Error notice types, and is used
+// by subsystems, such as remote server list fetches, that support
+// suppressing lower severity notices.
+type noticeSeverity int
+
+const (
+	noticeSeverityInfo noticeSeverity = iota
+	noticeSeverityAlert
+	noticeSeverityError
+)
+
+// parseNoticeSeverity maps a notice type name, "Info", "Alert", or "Error",
+// to its severity. The blank name maps to noticeSeverityInfo.
+func parseNoticeSeverity(name string) (noticeSeverity, error) {
+	switch name {
+	case "", "Info":
+		return noticeSeverityInfo, nil
+	case "Alert":
+		return noticeSeverityAlert, nil
+	case "Error":
+		return noticeSeverityError, nil
+	}
+	return noticeSeverityInfo, common.ContextError(
+		fmt.Errorf("invalid notice severity: %s", name))
+}
+
 // outputNotice encodes a notice in JSON and writes it to the output writer.
 func (nl *noticeLogger) outputNotice(noticeType string, noticeFlags uint32, args ...interface{}) {
 
@@ -708,6 +734,67 @@ func NoticeRemoteServerListResourceDownloadedBytes(url string, bytes int64) {
 		"bytes", bytes)
 }
 
+// NoticeRemoteServerListResourceDownloadProgress reports the progress of a
+// remote server list download in flight. bytesRead includes the offset of a
+// resumed partial download, and bytesTotal is the size of the resource, or 0
+// when the server doesn't indicate the size.
+func NoticeRemoteServerListResourceDownloadProgress(url string, bytesRead, bytesTotal int64) {
+	singletonNoticeLogger.outputNotice(
+		"RemoteServerListResourceDownloadProgress", noticeIsDiagnostic,
+		"url", url,
+		"bytesRead", bytesRead,
+		"bytesTotal", bytesTotal)
+}
+
+// NoticeRemoteServerListNewServerEntries indicates that a remote server list
+// fetch added the specified number of new server entries. The notice is only
+// emitted when the count meets RemoteServerListMinNewEntriesToReport.
+func NoticeRemoteServerListNewServerEntries(count int) {
+	singletonNoticeLogger.outputNotice(
+		"RemoteServerListNewServerEntries", 0,
+		"count", count)
+}
+
+// NoticeNewServerEntriesReportsCoalesced indicates that the specified
+// number of new server entries reports, made within one
+// RemoteServerListNewEntriesReportWindow, were coalesced into a single
+// OnNewServerEntries report of count new server entries.
+func NoticeNewServerEntriesReportsCoalesced(reports, count int) {
+	singletonNoticeLogger.outputNotice(
+		"NewServerEntriesReportsCoalesced", noticeIsDiagnostic,
+		"reports", reports,
+		"count", count)
+}
+
+// NoticeFetchTelemetryUploaded indicates that the specified number of
+// queued remote server list fetch telemetry runs were uploaded to
+// FetchTelemetryUploadURL.
+func NoticeFetchTelemetryUploaded(runs int) {
+	singletonNoticeLogger.outputNotice(
+		"FetchTelemetryUploaded", noticeIsDiagnostic,
+		"runs", runs)
+}
+
+// NoticeResumeDownload indicates that a download is resuming a partial
+// download from the specified offset, and reports the exact Range header
+// sent in the request.
+func NoticeResumeDownload(url string, offset int64, rangeHeader string) {
+	singletonNoticeLogger.outputNotice(
+		"ResumeDownload", noticeIsDiagnostic,
+		"url", url,
+		"offset", offset,
+		"range", rangeHeader)
+}
+
+// NoticeRemoteServerListResumeSavedBytes reports, at the completion of a
+// remote server list fetch, the total number of bytes in this process that
+// weren't downloaded again because partial downloads were resumed.
+func NoticeRemoteServerListResumeSavedBytes(savedBytes int64) {
+	singletonNoticeLogger.outputNotice(
+		"RemoteServerListResumeSavedBytes", noticeIsDiagnostic,
+		"savedBytes", savedBytes)
+}
+
 // NoticeRemoteServerListResourceDownloaded indicates that a remote server list download
 // completed successfully.
 func NoticeRemoteServerListResourceDownloaded(url string) {
@@ -716,6 +803,354 @@ func NoticeRemoteServerListResourceDownloaded(url string) {
 		"url", url)
 }
 
+// NoticeUntunneledDownloadEgressRegionViolation indicates that an untunneled
+// remote server list download egressed in a region that is not allowed by
+// the config. The "enforced" flag indicates whether the download was
+// rejected.
+func NoticeUntunneledDownloadEgressRegionViolation(url, region string, enforced bool) {
+	singletonNoticeLogger.outputNotice(
+		"UntunneledDownloadEgressRegionViolation", noticeIsDiagnostic,
+		"url", url,
+		"region", region,
+		"enforced", enforced)
+}
+
+// NoticeUntunneledDownloadTLSParameters reports the negotiated TLS version
+// and cipher suite of the connection used for an untunneled remote server
+// list download, to help identify networks which force TLS downgrades.
+func NoticeUntunneledDownloadTLSParameters(url, tlsVersion, cipherSuite string) {
+	singletonNoticeLogger.outputNotice(
+		"UntunneledDownloadTLSParameters", noticeIsDiagnostic,
+		"url", url,
+		"TLSVersion", tlsVersion,
+		"cipherSuite", cipherSuite)
+}
+
+// NoticeRemoteServerListDownloadHTTPProtocol reports the HTTP version
+// negotiated for a remote server list download. "fallback" indicates that
+// HTTP/2 was offered during the TLS handshake but not negotiated, which may
+// indicate middlebox interference.
+func NoticeRemoteServerListDownloadHTTPProtocol(url, protocol string, fallback bool) {
+	singletonNoticeLogger.outputNotice(
+		"RemoteServerListDownloadHTTPProtocol", noticeIsDiagnostic,
+		"url", url,
+		"protocol", protocol,
+		"fallback", fallback)
+}
+
+// NoticeServerEntriesRevoked reports that count stored server entries were
+// deleted, as revoked by the server entry revocation list with the specified
+// version.
+func NoticeServerEntriesRevoked(version int64, count int) {
+	singletonNoticeLogger.outputNotice(
+		"ServerEntriesRevoked", noticeIsDiagnostic,
+		"version", version,
+		"count", count)
+}
+
+// NoticeServerEntriesExpired reports that count stored server entries were
+// deleted, as their explicit expiry had passed.
+func NoticeServerEntriesExpired(count int) {
+	singletonNoticeLogger.outputNotice(
+		"ServerEntriesExpired", noticeIsDiagnostic,
+		"count", count)
+}
+
+// NoticeDataStoreCompacted reports that the datastore was compacted after
+// churn server entry writes and deletes, and the time, in milliseconds, the
+// compaction took.
+func NoticeDataStoreCompacted(churn int, milliseconds int64) {
+	singletonNoticeLogger.outputNotice(
+		"DataStoreCompacted", noticeIsDiagnostic,
+		"churn", churn,
+		"milliseconds", milliseconds)
+}
+
+// NoticeRemoteServerListTimeToFirstNewServerEntry reports the time, in
+// milliseconds, elapsed from the start of a remote server list fetch of
+// type fetchType until the first import which stored a new server entry
+// completed.
+func NoticeRemoteServerListTimeToFirstNewServerEntry(fetchType string, milliseconds int64) {
+	singletonNoticeLogger.outputNotice(
+		"RemoteServerListTimeToFirstNewServerEntry", noticeIsDiagnostic,
+		"fetchType", fetchType,
+		"milliseconds", milliseconds)
+}
+
+// NoticeRemoteServerListDownloadRetry indicates that a failed remote server
+// list download is retried, after the specified backoff, with the specified
+// download attempt, starting at 1, of at most maxAttempts.
+func NoticeRemoteServerListDownloadRetry(
+	url string, attempt, maxAttempts int, backoff time.Duration, err error) {
+
+	singletonNoticeLogger.outputNotice(
+		"RemoteServerListDownloadRetry", noticeIsDiagnostic,
+		"url", url,
+		"attempt", attempt,
+		"maxAttempts", maxAttempts,
+		"backoff", backoff.String(),
+		"error", err.Error())
+}
+
+// NoticeRemoteServerListDownloadFallbackEndpoint reports that a remote
+// server list download failed to connect to the download URL and was made
+// with the specified fallback endpoint.
+func NoticeRemoteServerListDownloadFallbackEndpoint(url, endpoint string) {
+	singletonNoticeLogger.outputNotice(
+		"RemoteServerListDownloadFallbackEndpoint", noticeIsDiagnostic,
+		"url", url,
+		"endpoint", endpoint)
+}
+
+// NoticeRemoteServerListResourceUnchanged indicates that a remote server list
+// download was skipped because the ETag indicated the resource was unchanged.
+// skipCount is the total number of such skips in this process.
+func NoticeRemoteServerListResourceUnchanged(url string, skipCount int64) {
+	singletonNoticeLogger.outputNotice(
+		"RemoteServerListResourceUnchanged", noticeIsDiagnostic,
+		"url", url,
+		"skipCount", skipCount)
+}
+
+// NoticeServerEntriesDroppedByIPPolicy indicates that an import dropped the
+// specified number of server entries whose IP address is not permitted by
+// the config ServerEntryIPAllowlist and ServerEntryIPBlocklist.
+func NoticeServerEntriesDroppedByIPPolicy(count int) {
+	singletonNoticeLogger.outputNotice(
+		"ServerEntriesDroppedByIPPolicy", noticeIsDiagnostic,
+		"count", count)
+}
+
+// NoticeServerEntriesDroppedByFutureTimestamp indicates that an import
+// dropped the specified number of server entries with a timestamp further in
+// the future than the ServerEntryMaxTimestampSkew, maxSkew.
+func NoticeServerEntriesDroppedByFutureTimestamp(count int, maxSkew time.Duration) {
+	singletonNoticeLogger.outputNotice(
+		"ServerEntriesDroppedByFutureTimestamp", noticeIsDiagnostic,
+		"count", count,
+		"maxSkew", maxSkew.String())
+}
+
+// NoticeServerEntriesSkippedBySchemaVersion indicates that an import skipped
+// the specified number of server entries which require a newer server entry
+// schema version than this client supports.
+func NoticeServerEntriesSkippedBySchemaVersion(count, schemaVersion int) {
+	singletonNoticeLogger.outputNotice(
+		"ServerEntriesSkippedBySchemaVersion", noticeIsDiagnostic,
+		"count", count,
+		"schemaVersion", schemaVersion)
+}
+
+// NoticeServerEntriesSkippedByClientVersion indicates that an import skipped
+// the specified number of server entries which require a newer client
+// version than this client, clientVersion.
+func NoticeServerEntriesSkippedByClientVersion(count, clientVersion int) {
+	singletonNoticeLogger.outputNotice(
+		"ServerEntriesSkippedByClientVersion", noticeIsDiagnostic,
+		"count", count,
+		"clientVersion", clientVersion)
+}
+
+// NoticeServerEntriesWithUndecryptedCapabilities indicates that an import
+// stored the specified number of server entries with encrypted capabilities
+// which couldn't be decrypted. These server entries have only their
+// unencrypted capabilities.
+func NoticeServerEntriesWithUndecryptedCapabilities(count int) {
+	singletonNoticeLogger.outputNotice(
+		"ServerEntriesWithUndecryptedCapabilities", noticeIsDiagnostic,
+		"count", count)
+}
+
+// NoticeRemoteServerListResourceImported reports the server entries imported
+// from a downloaded remote server list resource: newEntries is the number of
+// server entries which were not already stored, and totalEntries is the
+// number of valid server entries in the resource. A server entry already
+// imported from another resource in the same fetch isn't new.
+func NoticeRemoteServerListResourceImported(url string, newEntries, totalEntries int) {
+	singletonNoticeLogger.outputNotice(
+		"RemoteServerListResourceImported", noticeIsDiagnostic,
+		"url", url,
+		"newEntries", newEntries,
+		"totalEntries", totalEntries)
+}
+
+// NoticeRemoteServerListResourceNoNewServerEntries indicates that a changed
+// remote server list resource was downloaded and imported, but contained no
+// server entries which were not already stored. Unlike
+// RemoteServerListResourceUnchanged, the resource was downloaded.
+func NoticeRemoteServerListResourceNoNewServerEntries(url string) {
+	singletonNoticeLogger.outputNotice(
+		"RemoteServerListResourceNoNewServerEntries", noticeIsDiagnostic,
+		"url", url)
+}
+
+// NoticeRemoteServerListResourceCorrupt indicates that a downloaded remote
+// server list resource failed validation and, along with its stored ETag,
+// was discarded, so that the next fetch downloads the resource in full.
+func NoticeRemoteServerListResourceCorrupt(url string, err error) {
+	singletonNoticeLogger.outputNotice(
+		"RemoteServerListResourceCorrupt", noticeIsDiagnostic,
+		"url", url,
+		"error", err.Error())
+}
+
+// NoticeRemoteServerListDownloadModeChanged indicates that, within a single
+// fetch, the download mode changed between consecutive downloads. When the
+// fetch tunnel closed before the download of the specified URL, the mode is
+// "stopped": the download isn't made untunneled, and the fetch stops.
+func NoticeRemoteServerListDownloadModeChanged(url, previousMode, mode string) {
+	singletonNoticeLogger.outputNotice(
+		"RemoteServerListDownloadModeChanged", noticeIsDiagnostic,
+		"url", url,
+		"previousMode", previousMode,
+		"mode", mode)
+}
+
+// NoticeObfuscatedServerListConditionalRequest reports the result of the
+// conditional download request for the OSL with the specified ID: a cache
+// hit, when the response is 304 Not Modified for the If-None-Match ETag, or
+// a cache miss, when the OSL file was downloaded with the response ETag.
+func NoticeObfuscatedServerListConditionalRequest(
+	oslID string, cacheHit bool, statusCode int, etag string) {
+
+	singletonNoticeLogger.outputNotice(
+		"ObfuscatedServerListConditionalRequest", noticeIsDiagnostic,
+		"oslID", oslID,
+		"cacheHit", cacheHit,
+		"statusCode", statusCode,
+		"etag", etag)
+}
+
+// NoticeObfuscatedServerListQuarantined indicates that the OSL with the
+// specified ID has repeatedly failed validation and has been quarantined. The
+// OSL will not be downloaded again until the "until" time.
+func NoticeObfuscatedServerListQuarantined(oslID string, failures int, until time.Time) {
+	singletonNoticeLogger.outputNotice(
+		"ObfuscatedServerListQuarantined", noticeIsDiagnostic,
+		"oslID", oslID,
+		"failures", failures,
+		"until", until.UTC().Format(time.RFC3339))
+}
+
+// NoticeObfuscatedServerListRegistryCacheCorrupt indicates that the cached
+// OSL registry failed to load and is being discarded and downloaded again.
+func NoticeObfuscatedServerListRegistryCacheCorrupt(err error) {
+	singletonNoticeLogger.outputNotice(
+		"ObfuscatedServerListRegistryCacheCorrupt", noticeIsDiagnostic,
+		"error", err.Error())
+}
+
+// NoticeSLOKLookupFailed indicates that looking up the SLOK with the
+// specified hex ID in the local datastore failed. Unlike a SLOK that's not
+// found, the SLOK may be stored, so an OSL which appears locked may in fact
+// be unlockable.
+func NoticeSLOKLookupFailed(slokID string, err error) {
+	singletonNoticeLogger.outputNotice(
+		"SLOKLookupFailed", noticeIsDiagnostic,
+		"slokID", slokID,
+		"error", err.Error())
+}
+
+// NoticeObfuscatedServerListRegistryRollback indicates that a downloaded OSL
+// registry was rejected, as its generation is lower than the highest
+// generation previously accepted, which may indicate a rollback attack by
+// a mirror.
+func NoticeObfuscatedServerListRegistryRollback(
+	url string, generation, highestGeneration int64) {
+
+	singletonNoticeLogger.outputNotice(
+		"ObfuscatedServerListRegistryRollback", noticeIsDiagnostic,
+		"url", url,
+		"generation", generation,
+		"highestGeneration", highestGeneration)
+}
+
+// NoticeObfuscatedServerListSLOKSchemeUnsupported indicates that an OSL
+// registry was rejected, as it requires SLOK scheme version
+// slokSchemeVersion, which is newer than supportedVersion, the newest
+// version supported by this client. The client should be upgraded.
+func NoticeObfuscatedServerListSLOKSchemeUnsupported(
+	url string, slokSchemeVersion, supportedVersion int) {
+
+	singletonNoticeLogger.outputNotice(
+		"ObfuscatedServerListSLOKSchemeUnsupported", 0,
+		"url", url,
+		"slokSchemeVersion", slokSchemeVersion,
+		"supportedVersion", supportedVersion)
+}
+
+// NoticeRemoteServerListDiskFull indicates that a remote server list fetch of
+// the specified type failed because local storage is full. The fetch is
+// retried after FetchRemoteServerListDiskFullRetryPeriod.
+func NoticeRemoteServerListDiskFull(fetchType string, err error) {
+	singletonNoticeLogger.outputNotice(
+		"RemoteServerListDiskFull", noticeIsDiagnostic,
+		"fetchType", fetchType,
+		"error", err.Error())
+}
+
+// NoticeObfuscatedServerListInodesExhausted indicates that an obfuscated
+// server list fetch was skipped as the download directory filesystem has
+// fewer than the required number of available inodes.
+func NoticeObfuscatedServerListInodesExhausted(directory string, availableInodes uint64) {
+	singletonNoticeLogger.outputNotice(
+		"ObfuscatedServerListInodesExhausted", noticeIsDiagnostic,
+		"directory", directory,
+		"availableInodes", availableInodes)
+}
+
+// NoticeRemoteServerListDecompressionRatioExceeded indicates that the ratio of
+// decompressed to compressed size of a downloaded remote server list resource
+// exceeds RemoteServerListMaxDecompressionRatio, which may indicate a
+// compression bomb or a misconfigured payload. The reported ratio is a lower
+// bound, as measurement stops once the maximum is exceeded.
+func NoticeRemoteServerListDecompressionRatioExceeded(url string, ratio, maxRatio float64) {
+	singletonNoticeLogger.outputNotice(
+		"RemoteServerListDecompressionRatioExceeded", noticeIsDiagnostic,
+		"url", url,
+		"ratio", ratio,
+		"maxRatio", maxRatio)
+}
+
+// NoticeObfuscatedServerListNoEligibleOSLs indicates that none of the
+// registryOSLCount OSLs in an obfuscated server list registry are eligible,
+// as the client doesn't have sufficient SLOKs to decrypt any of them, so no
+// obfuscated server lists are imported from the registry.
+func NoticeObfuscatedServerListNoEligibleOSLs(url string, registryOSLCount int) {
+	singletonNoticeLogger.outputNotice(
+		"ObfuscatedServerListNoEligibleOSLs", 0,
+		"url", url,
+		"registryOSLCount", registryOSLCount)
+}
+
+// NoticeOSLCoverage reports the SLOK coverage of an obfuscated server list
+// registry, once the registry is streamed: seededCount of the totalCount
+// OSLs are seeded, and missingSLOKCount SLOKs, which the client doesn't
+// have, are required to unlock the remaining OSLs. slokLookupErrorCount is
+// the number of SLOK lookups in the fetch that failed with a datastore
+// error, in which case OSLs may only appear to be unseeded.
+func NoticeOSLCoverage(
+	url string, seededCount, totalCount, missingSLOKCount, slokLookupErrorCount int) {
+
+	singletonNoticeLogger.outputNotice(
+		"OSLCoverage", noticeIsDiagnostic,
+		"url", url,
+		"seededCount", seededCount,
+		"totalCount", totalCount,
+		"missingSLOKCount", missingSLOKCount,
+		"slokLookupErrorCount", slokLookupErrorCount)
+}
+
+// NoticeObfuscatedServerListMaxOSLCountExceeded indicates that an obfuscated
+// server list registry lists more seeded OSLs than the maximum OSL count,
+// and that the remaining OSLs in the registry are ignored.
+func NoticeObfuscatedServerListMaxOSLCountExceeded(url string, maxOSLCount int) {
+	singletonNoticeLogger.outputNotice(
+		"ObfuscatedServerListMaxOSLCountExceeded", noticeIsDiagnostic,
+		"url", url,
+		"maxOSLCount", maxOSLCount)
+}
+
 // NoticeSLOKSeeded indicates that the SLOK with the specified ID was received from
 // the Psiphon server. The "duplicate" flags indicates whether the SLOK was previously known.
 func NoticeSLOKSeeded(slokID string, duplicate bool) {
@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
+)
+
+// oslSharedCacheIndexDirectory is the subdirectory of the shared OSL cache
+// containing the content hash index.
+const oslSharedCacheIndexDirectory = "index"
+
+// oslSharedCache is the content-addressed OSL file cache in
+// Config.ObfuscatedServerListSharedCacheDirectory. Each cached OSL file is
+// named by the hex-encoded SHA-256 digest of its content, and the index
+// subdirectory holds a file for each cached OSL, named by the hex OSL ID,
+// which contains the digest of the OSL file content. So identical OSL files
+// advertised under different OSL IDs are cached once.
+//
+// As the cache may be shared by multiple clients, cached files and index
+// files are written to a temporary file and then renamed, and a cached file
+// is only used when its content matches the registry MD5Sum of the OSL.
+// Cache failures aren't fatal: the OSL file is downloaded as usual.
+//
+// A nil oslSharedCache caches nothing.
+type oslSharedCache struct {
+	config    *Config
+	directory string
+}
+
+// newOSLSharedCache returns the shared OSL cache, or nil when
+// ObfuscatedServerListSharedCacheDirectory isn't set.
+func newOSLSharedCache(config *Config) *oslSharedCache {
+
+	if config.ObfuscatedServerListSharedCacheDirectory == "" {
+		return nil
+	}
+
+	return &oslSharedCache{
+		config:    config,
+		directory: config.ObfuscatedServerListSharedCacheDirectory,
+	}
+}
+
+// reuse copies the cached file for the specified OSL to downloadFilename,
+// when the cached file content matches sourceETag, the ETag form of the
+// registry MD5Sum of the OSL. When the stored ETag for canonicalURL is
+// already sourceETag, the local OSL file is unchanged and the cached file
+// isn't used. reuse returns true when the cached file was copied.
+func (cache *oslSharedCache) reuse(
+	fileSpec *osl.OSLFileSpec,
+	canonicalURL string,
+	sourceETag string,
+	downloadFilename string) bool {
+
+	// Without a registry MD5Sum, it's not known whether a cached file is
+	// the current version of the OSL.
+	if cache == nil || len(fileSpec.MD5Sum) == 0 {
+		return false
+	}
+
+	hexID := hex.EncodeToString(fileSpec.ID)
+
+	lastETag, err := cache.config.getServerListStore().GetUrlETag(canonicalURL)
+	if err != nil || lastETag == sourceETag {
+		return false
+	}
+
+	contentFilename, err := cache.lookup(hexID)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			noticeRemoteServerListAlert(cache.config, "failed to look up shared obfuscated server list file (%s): %s", hexID, common.ContextError(err))
+		}
+		return false
+	}
+
+	contentETag, err := makeContentETag(contentFilename, cache.config.oslFileEncryptionKey)
+	if err != nil || contentETag != sourceETag {
+		return false
+	}
+
+	err = copyRemoteServerListFile(contentFilename, downloadFilename)
+	if err != nil {
+		noticeRemoteServerListAlert(cache.config, "failed to copy shared obfuscated server list file (%s): %s", hexID, common.ContextError(err))
+		return false
+	}
+
+	noticeRemoteServerListInfo(cache.config, "reusing shared obfuscated server list file (%s)", hexID)
+
+	return true
+}
+
+// lookup returns the name of the cached file for the specified OSL.
+func (cache *oslSharedCache) lookup(hexID string) (string, error) {
+
+	digest, err := ioutil.ReadFile(cache.indexFilename(hexID))
+	if err != nil {
+		return "", err
+	}
+
+	// Check that the index file content is a digest, so that the cached
+	// file name can't leave the cache directory.
+	decodedDigest, err := hex.DecodeString(string(digest))
+	if err != nil || len(decodedDigest) != sha256.Size {
+		return "", common.ContextError(errors.New("invalid index file"))
+	}
+
+	return filepath.Join(cache.directory, string(digest)), nil
+}
+
+// store adds the validated OSL file, filename, to the cache, and indexes it
+// for the specified OSL.
+func (cache *oslSharedCache) store(hexID string, filename string) {
+
+	if cache == nil {
+		return
+	}
+
+	err := cache.storeFile(hexID, filename)
+	if err != nil {
+		noticeRemoteServerListAlert(cache.config, "failed to store shared obfuscated server list file (%s): %s", hexID, common.ContextError(err))
+	}
+}
+
+func (cache *oslSharedCache) storeFile(hexID string, filename string) error {
+
+	digest, err := makeContentDigest(filename, cache.config.oslFileEncryptionKey)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	indexFilename := cache.indexFilename(hexID)
+	err = os.MkdirAll(filepath.Dir(indexFilename), 0700)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	// The cached file is named by its content digest, so an existing cached
+	// file with the same name has the same content.
+	contentFilename := filepath.Join(cache.directory, digest)
+	_, err = os.Stat(contentFilename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return common.ContextError(err)
+		}
+		err = cache.writeFile(contentFilename, func(tempFilename string) error {
+			return copyRemoteServerListFile(filename, tempFilename)
+		})
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	// The index file may refer to an older version of the OSL, so it's
+	// always written. The older version's cached file is retained, as it
+	// may be indexed for another OSL.
+	err = cache.writeFile(indexFilename, func(tempFilename string) error {
+		return ioutil.WriteFile(tempFilename, []byte(digest), 0600)
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// writeFile writes filename by calling write with the name of a temporary
+// file, in the same directory, which is then renamed to filename. Other
+// clients sharing the cache never observe a partially written file.
+func (cache *oslSharedCache) writeFile(
+	filename string, write func(tempFilename string) error) error {
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(filename), ".tmp-")
+	if err != nil {
+		return common.ContextError(err)
+	}
+	tempFilename := tempFile.Name()
+	tempFile.Close()
+
+	err = write(tempFilename)
+	if err == nil {
+		err = os.Rename(tempFilename, filename)
+	}
+	if err != nil {
+		os.Remove(tempFilename)
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+func (cache *oslSharedCache) indexFilename(hexID string) string {
+	return filepath.Join(cache.directory, oslSharedCacheIndexDirectory, hexID)
+}
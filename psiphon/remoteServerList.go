@@ -20,11 +20,31 @@
 package psiphon
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
@@ -33,6 +53,456 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 )
 
+const (
+	OBFUSCATED_SERVER_LIST_QUARANTINE_DIRECTORY = "quarantine"
+	OBFUSCATED_SERVER_LIST_DRY_RUN_DIRECTORY    = "dry-run"
+
+	REMOTE_SERVER_LIST_DOWNLOAD_MODE_TUNNELED   = "tunneled"
+	REMOTE_SERVER_LIST_DOWNLOAD_MODE_UNTUNNELED = "untunneled"
+	REMOTE_SERVER_LIST_DOWNLOAD_MODE_STOPPED    = "stopped"
+
+	REMOTE_SERVER_LIST_FETCH_TYPE_COMMON     = "common"
+	REMOTE_SERVER_LIST_FETCH_TYPE_OBFUSCATED = "obfuscated"
+
+	OSL_DOWNLOAD_ATTEMPT_RESULT_DOWNLOADED = "downloaded"
+	OSL_DOWNLOAD_ATTEMPT_RESULT_UNCHANGED  = "unchanged"
+	OSL_DOWNLOAD_ATTEMPT_RESULT_FAILED     = "failed"
+)
+
+// remoteServerListETagSkipCount is the number of remote server list resource
+// downloads, in this process, that were skipped because the ETag indicated
+// the resource was unchanged. Access with sync/atomic.
+var remoteServerListETagSkipCount int64
+
+// GetRemoteServerListETagSkipCount returns the number of remote server list
+// resource downloads skipped because the resource was unchanged.
+func GetRemoteServerListETagSkipCount() int64 {
+	return atomic.LoadInt64(&remoteServerListETagSkipCount)
+}
+
+// remoteServerListResumeSavedBytes is the number of bytes, in this process,
+// that remote server list resource downloads didn't download again because
+// a partial download was resumed instead of restarted. Access with
+// sync/atomic.
+var remoteServerListResumeSavedBytes int64
+
+// GetRemoteServerListResumeSavedBytes returns the number of bytes saved by
+// resuming partial remote server list resource downloads.
+func GetRemoteServerListResumeSavedBytes() int64 {
+	return atomic.LoadInt64(&remoteServerListResumeSavedBytes)
+}
+
+// noticeRemoteServerListResumeSavedBytes emits a notice reporting the bytes
+// saved by resumed downloads, at the completion of a fetch. No notice is
+// emitted when no download has been resumed.
+func noticeRemoteServerListResumeSavedBytes(config *Config) {
+	savedBytes := GetRemoteServerListResumeSavedBytes()
+	if savedBytes > 0 && config.emitRemoteServerListNotice(noticeSeverityInfo) {
+		NoticeRemoteServerListResumeSavedBytes(savedBytes)
+	}
+}
+
+// recordRemoteServerListETagSkip increments the ETag skip count and emits
+// a notice for the unchanged resource.
+func recordRemoteServerListETagSkip(config *Config, url string) {
+	skipCount := atomic.AddInt64(&remoteServerListETagSkipCount, 1)
+	if config.emitRemoteServerListNotice(noticeSeverityInfo) {
+		NoticeRemoteServerListResourceUnchanged(url, skipCount)
+	}
+}
+
+// flushRemoteServerListETags stores any ETags queued by setValidatedUrlETag,
+// at the end of a fetch. ETags which again fail to be stored remain queued
+// for the end of the next fetch.
+func flushRemoteServerListETags(config *Config) {
+	flushed, err := flushPendingUrlETags()
+	if flushed > 0 {
+		noticeRemoteServerListInfo(config, "stored %d queued ETags", flushed)
+	}
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to store queued ETags: %s", err)
+	}
+}
+
+// noticeRemoteServerListInfo emits an Info notice for a remote server list
+// fetch, subject to Config.RemoteServerListNoticeMinimumSeverity.
+func noticeRemoteServerListInfo(config *Config, format string, args ...interface{}) {
+	if config.emitRemoteServerListNotice(noticeSeverityInfo) {
+		NoticeInfo(format, args...)
+	}
+}
+
+// noticeRemoteServerListAlert emits an Alert notice for a remote server list
+// fetch, subject to Config.RemoteServerListNoticeMinimumSeverity.
+func noticeRemoteServerListAlert(config *Config, format string, args ...interface{}) {
+	if config.emitRemoteServerListNotice(noticeSeverityAlert) {
+		NoticeAlert(format, args...)
+	}
+}
+
+// FetchFileError is returned when a remote server list fetch fails to open
+// or read a downloaded file. Filename is the offending local file and OSLID
+// is the hex encoded ID of the corresponding OSL, or blank when the file is
+// not an OSL file.
+type FetchFileError struct {
+	Filename string
+	OSLID    string
+	Err      error
+}
+
+// NewFetchFileError creates a new FetchFileError.
+func NewFetchFileError(filename, oslID string, err error) error {
+	return FetchFileError{
+		Filename: filename,
+		OSLID:    oslID,
+		Err:      err,
+	}
+}
+
+// Error implements the error interface.
+func (err FetchFileError) Error() string {
+	if err.OSLID != "" {
+		return fmt.Sprintf("fetch file error: %s (OSL %s): %s", err.Filename, err.OSLID, err.Err)
+	}
+	return fmt.Sprintf("fetch file error: %s: %s", err.Filename, err.Err)
+}
+
+// FetchGatedError is returned when an obfuscated server list fetch is paused
+// by Config.FetchGate. The fetch is incomplete, but the OSLs processed before
+// the fetch was paused are kept. DownloadedBytes is the number of bytes
+// downloaded by the fetch before it was paused.
+type FetchGatedError struct {
+	DownloadedBytes int64
+}
+
+// Error implements the error interface.
+func (err FetchGatedError) Error() string {
+	return fmt.Sprintf("fetch paused by fetch gate after %d bytes", err.DownloadedBytes)
+}
+
+// UntunneledDownloadVetoedError is returned when an untunneled download
+// from URL isn't attempted as Config.OnUntunneledDownload returned false.
+type UntunneledDownloadVetoedError struct {
+	URL string
+}
+
+// Error implements the error interface.
+func (err UntunneledDownloadVetoedError) Error() string {
+	return fmt.Sprintf("untunneled download vetoed: %s", err.URL)
+}
+
+// checkUntunneledDownload calls Config.OnUntunneledDownload, when set, for
+// an untunneled download from url, returning an
+// UntunneledDownloadVetoedError when the download is vetoed.
+func checkUntunneledDownload(config *Config, url string) error {
+	if config.OnUntunneledDownload == nil || config.OnUntunneledDownload(url) {
+		return nil
+	}
+	return UntunneledDownloadVetoedError{URL: url}
+}
+
+// shouldRetryDownload indicates whether a failed download, the specified
+// attempt, is retried. retry is the default classification, which is
+// overridden by Config.ShouldRetryDownload, when set.
+func shouldRetryDownload(config *Config, err error, attempt int, retry bool) bool {
+	if config.ShouldRetryDownload != nil {
+		return config.ShouldRetryDownload(err, attempt)
+	}
+	return retry
+}
+
+// downloadRetryPolicy is the retry policy for a failed remote server list
+// download within a fetch: up to maxAttempts total attempts, with
+// exponential backoff starting at RemoteServerListRetryBackoff, jittered by
+// RemoteServerListRetryBackoffJitter. The backoff never exceeds
+// FetchRemoteServerListRetryPeriod, the delay before the caller's next
+// fetch.
+type downloadRetryPolicy struct {
+	maxAttempts int
+	backoff     time.Duration
+	jitter      float64
+	maxBackoff  time.Duration
+	attempt     int
+}
+
+func newDownloadRetryPolicy(config *Config, maxAttempts int) *downloadRetryPolicy {
+
+	p := config.clientParameters.Get()
+	policy := &downloadRetryPolicy{
+		maxAttempts: maxAttempts,
+		backoff:     p.Duration(parameters.RemoteServerListRetryBackoff),
+		jitter:      p.Float(parameters.RemoteServerListRetryBackoffJitter),
+		maxBackoff:  p.Duration(parameters.FetchRemoteServerListRetryPeriod),
+	}
+	p = nil
+
+	return policy
+}
+
+// retry indicates whether the download from url, which failed with err, is
+// retried and, when it is, emits a notice and waits for the backoff. A
+// TunnelRequiredError and full local storage aren't retried, as a retry
+// would fail in the same way, and other failures are retried unless
+// Config.ShouldRetryDownload classifies them as not retryable. When ctx is
+// done, the wait ends early and the download isn't retried.
+func (policy *downloadRetryPolicy) retry(
+	ctx context.Context, config *Config, url string, err error) bool {
+
+	if err == nil || policy.attempt+1 >= policy.maxAttempts || ctx.Err() != nil {
+		return false
+	}
+
+	// The tunnel closed during the fetch; a retry won't be attempted
+	// until a tunnel is established.
+	if _, ok := err.(TunnelRequiredError); ok {
+		return false
+	}
+
+	// Local storage is full; a retry would fail in the same way.
+	if isDiskFullError(err) {
+		return false
+	}
+
+	if !shouldRetryDownload(config, err, policy.attempt, true) {
+		return false
+	}
+
+	if policy.backoff > policy.maxBackoff {
+		policy.backoff = policy.maxBackoff
+	}
+
+	backoff := jitterDuration(config.entropy, policy.backoff, policy.jitter)
+	if backoff > policy.maxBackoff {
+		backoff = policy.maxBackoff
+	}
+
+	policy.backoff *= 2
+	policy.attempt += 1
+
+	if config.emitRemoteServerListNotice(noticeSeverityAlert) {
+		NoticeRemoteServerListDownloadRetry(
+			url, policy.attempt+1, policy.maxAttempts, backoff, err)
+	}
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return false
+	}
+
+	return true
+}
+
+// isMirrorFailoverError returns true when err is a download failure after
+// which, with RemoteServerListMirrorFailover, the download fails over to
+// another mirror: a network or HTTP error. A TunnelRequiredError and full
+// local storage aren't specific to the mirror, and a LegalBlockError fails
+// over only with RemoteServerListLegalBlockFailover.
+func isMirrorFailoverError(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch err.(type) {
+	case TunnelRequiredError, LegalBlockError:
+		return false
+	}
+	return !isDiskFullError(err)
+}
+
+// TunnelRequiredError is returned when a download from URL isn't attempted
+// as RemoteServerListRequireTunnel is set and there's no connected tunnel.
+// The fetch may succeed once a tunnel is established, so a
+// TunnelRequiredError is not a download failure and is returned unwrapped,
+// so that callers may check the error type.
+type TunnelRequiredError struct {
+	URL string
+}
+
+// Error implements the error interface.
+func (err TunnelRequiredError) Error() string {
+	return fmt.Sprintf("tunnel required for download: %s", err.URL)
+}
+
+// FetchTunnelClosedError is returned when a tunneled fetch stops as the
+// fetch tunnel closed before the download from URL. The remaining downloads
+// aren't made untunneled; they're made by a later fetch. A
+// FetchTunnelClosedError is returned unwrapped, so that callers may check
+// the error type.
+type FetchTunnelClosedError struct {
+	URL string
+}
+
+// Error implements the error interface.
+func (err FetchTunnelClosedError) Error() string {
+	return fmt.Sprintf("fetch tunnel closed before download: %s", err.URL)
+}
+
+// checkTunnelRequired returns a TunnelRequiredError when
+// RemoteServerListRequireTunnel is set and tunnel is nil or closed, in which
+// case a download from url must not be attempted.
+func checkTunnelRequired(config *Config, tunnel *Tunnel, url string) error {
+	if tunnel != nil && !tunnel.IsClosed() {
+		return nil
+	}
+	if !config.clientParameters.Get().Bool(parameters.RemoteServerListRequireTunnel) {
+		return nil
+	}
+	return TunnelRequiredError{URL: url}
+}
+
+// LegalBlockError is returned when a download from URL fails with an HTTP
+// 451 Unavailable For Legal Reasons response. The URL is blocked, and the
+// same request is not expected to succeed on a retry, so a LegalBlockError
+// is returned unwrapped, so that callers may check the error type and fail
+// over to another mirror rather than retrying the blocked URL.
+type LegalBlockError struct {
+	URL string
+}
+
+// Error implements the error interface.
+func (err LegalBlockError) Error() string {
+	return fmt.Sprintf("download unavailable for legal reasons: %s", err.URL)
+}
+
+// DiskFullError is returned when a remote server list fetch fails because
+// local storage is full. Unlike a network failure, a retry will fail in the
+// same way until storage is freed, so a DiskFullError is returned unwrapped,
+// so that callers may check the error type and back off; see
+// FetchRemoteServerListDiskFullRetryPeriod. Err is the first storage error.
+type DiskFullError struct {
+	Err error
+}
+
+// Error implements the error interface.
+func (err DiskFullError) Error() string {
+	return fmt.Sprintf("local storage full: %s", err.Err)
+}
+
+// isDiskFullError returns true when err is a local storage error indicating
+// that storage is full, ENOSPC, or that a disk quota is exceeded, EDQUOT.
+// Errors are commonly wrapped with common.ContextError, which retains only
+// the error message, so the message of a wrapped error is also checked.
+func isDiskFullError(err error) bool {
+
+	switch e := err.(type) {
+	case nil:
+		return false
+	case DiskFullError:
+		return true
+	case FetchFileError:
+		return isDiskFullError(e.Err)
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+
+	if errno, ok := err.(syscall.Errno); ok {
+		return errno == syscall.ENOSPC || errno == syscall.EDQUOT
+	}
+
+	message := err.Error()
+	return strings.Contains(message, syscall.ENOSPC.Error()) ||
+		strings.Contains(message, syscall.EDQUOT.Error())
+}
+
+// makeDiskFullError returns err as a DiskFullError, emitting a
+// RemoteServerListDiskFull notice, when err indicates that local storage is
+// full. Otherwise, err is returned unmodified.
+func makeDiskFullError(config *Config, fetchType string, err error) error {
+
+	if !isDiskFullError(err) {
+		return err
+	}
+
+	diskFullErr, ok := err.(DiskFullError)
+	if !ok {
+		diskFullErr = DiskFullError{Err: err}
+	}
+
+	if config.emitRemoteServerListNotice(noticeSeverityAlert) {
+		NoticeRemoteServerListDiskFull(fetchType, diskFullErr.Err)
+	}
+
+	return diskFullErr
+}
+
+// SLOKLookupError is returned when an obfuscated server list fetch fails
+// because looking up SLOKs in the local datastore failed, and
+// ObfuscatedServerListFailOnSLOKLookupError is set. A failed lookup is
+// distinct from a missing SLOK: an OSL which appears locked due to a failed
+// lookup may in fact be unlockable. Count is the number of failed lookups
+// and Err is the first lookup error.
+type SLOKLookupError struct {
+	Count int
+	Err   error
+}
+
+// Error implements the error interface.
+func (err SLOKLookupError) Error() string {
+	return fmt.Sprintf("%d SLOK lookups failed: %s", err.Count, err.Err)
+}
+
+// getSLOK looks up a SLOK in the local datastore. It's a variable so that
+// tests can simulate datastore errors.
+var getSLOK = GetSLOK
+
+// oslSLOKLookup looks up SLOKs in the ServerListStore for OSL key
+// reassembly. A lookup which fails with a datastore error returns no key,
+// as for a SLOK that's not stored, but the failure is reported in a
+// SLOKLookupFailed notice and recorded, so that callers can distinguish an
+// OSL that's locked from one that only appears locked.
+type oslSLOKLookup struct {
+	config     *Config
+	mutex      sync.Mutex
+	errorCount int
+	firstErr   error
+}
+
+func newOSLSLOKLookup(config *Config) *oslSLOKLookup {
+	return &oslSLOKLookup{config: config}
+}
+
+// lookup implements osl.SLOKLookup.
+func (lookup *oslSLOKLookup) lookup(slokID []byte) []byte {
+
+	key, err := lookup.config.getServerListStore().GetSLOK(slokID)
+	if err != nil {
+
+		lookup.mutex.Lock()
+		lookup.errorCount += 1
+		if lookup.firstErr == nil {
+			lookup.firstErr = err
+		}
+		lookup.mutex.Unlock()
+
+		if lookup.config.emitRemoteServerListNotice(noticeSeverityAlert) {
+			NoticeSLOKLookupFailed(hex.EncodeToString(slokID), err)
+		}
+		return nil
+	}
+
+	return key
+}
+
+// err returns a SLOKLookupError when any lookup has failed, and otherwise
+// nil.
+func (lookup *oslSLOKLookup) err() error {
+
+	lookup.mutex.Lock()
+	defer lookup.mutex.Unlock()
+
+	if lookup.errorCount == 0 {
+		return nil
+	}
+
+	return SLOKLookupError{Count: lookup.errorCount, Err: lookup.firstErr}
+}
+
 type RemoteServerListFetcher func(
 	ctx context.Context, config *Config, attempt int, tunnel *Tunnel, untunneledDialConfig *DialConfig) error
 
@@ -50,375 +520,6870 @@ func FetchCommonRemoteServerList(
 	tunnel *Tunnel,
 	untunneledDialConfig *DialConfig) error {
 
-	NoticeInfo("fetching common remote server list")
+	return fetchCommonRemoteServerList(
+		ctx, config, attempt, tunnel, untunneledDialConfig, nil, false)
+}
+
+// BootstrapFetchCommonRemoteServerList performs an untunneled fetch of the
+// common remote server list, for the cold start case where the client has no
+// server entries and so cannot establish a tunnel. Unlike
+// FetchCommonRemoteServerList, the caller doesn't pass a tunnel: the fetch is
+// always made using dialConfig, which must be specified.
+//
+// Untunneled downloads on a first run may be slow and unreliable, and no
+// tunnel can be established until the fetch succeeds. So the download uses
+// the longer FetchRemoteServerListBootstrapTimeout, and is attempted up to
+// RemoteServerListBootstrapMaxAttempts times, in place of
+// FetchRemoteServerListTimeout and RemoteServerListRetryMaxAttempts.
+//
+// The fetch can't be canceled; use
+// BootstrapFetchCommonRemoteServerListWithContext to stop the fetch, for
+// example when the client is stopped.
+func BootstrapFetchCommonRemoteServerList(config *Config, dialConfig *DialConfig) error {
+	return BootstrapFetchCommonRemoteServerListWithContext(
+		context.Background(), config, dialConfig)
+}
+
+// BootstrapFetchCommonRemoteServerListWithContext performs
+// BootstrapFetchCommonRemoteServerList, stopping any download and retry
+// when ctx is canceled.
+func BootstrapFetchCommonRemoteServerListWithContext(
+	ctx context.Context, config *Config, dialConfig *DialConfig) error {
+
+	if dialConfig == nil {
+		return common.ContextError(errors.New("missing dial config"))
+	}
+
+	p := config.clientParameters.Get()
+	urls := p.DownloadURLs(parameters.RemoteServerListURLs)
+	p = nil
+
+	if len(urls) == 0 {
+		return common.ContextError(errors.New("missing remote server list URLs"))
+	}
+
+	noticeRemoteServerListInfo(config, "bootstrapping common remote server list")
+
+	return fetchCommonRemoteServerList(
+		ctx, config, 0, nil, dialConfig, nil, true)
+}
+
+// fetchCommonRemoteServerList performs FetchCommonRemoteServerList, using
+// the optional downloadCache to reuse resources already downloaded in a
+// coordinated fetch run. When bootstrap is set, the bootstrap timeout and
+// attempt limit are used; see BootstrapFetchCommonRemoteServerList.
+func fetchCommonRemoteServerList(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	downloadCache *remoteServerListDownloadCache,
+	bootstrap bool) (retErr error) {
+
+	err := checkSignaturePublicKey(config)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	// When a tunnel is required and there's none, the fetch isn't started,
+	// so no requests are sent and no fetch telemetry is recorded.
+	_, requiredURL, _ := config.clientParameters.Get().DownloadURLs(
+		parameters.RemoteServerListURLs).Select(attempt)
+	err = checkTunnelRequired(config, tunnel, requiredURL)
+	if err != nil {
+		return err
+	}
+
+	noticeRemoteServerListInfo(config, "fetching common remote server list")
+
+	// Deferred first, so that the datastore is compacted after all other
+	// deferred writes and deletes.
+	defer compactDataStore(config)
+
+	// Server entries past their explicit expiry are purged after each
+	// fetch, including entries imported by the fetch.
+	defer purgeExpiredServerEntries(config)
+
+	defer noticeRemoteServerListResumeSavedBytes(config)
+
+	defer flushRemoteServerListETags(config)
+
+	telemetry := newFetchTelemetryRecorder(config, REMOTE_SERVER_LIST_FETCH_TYPE_COMMON)
+	defer func() {
+		telemetry.finish(retErr)
+	}()
+
+	// A fetch which failed because local storage is full, whether
+	// downloading or storing, returns a DiskFullError. Deferred before the
+	// revocation list fetch, so that its failures are also included.
+	defer func() {
+		retErr = makeDiskFullError(config, REMOTE_SERVER_LIST_FETCH_TYPE_COMMON, retErr)
+	}()
+
+	// The revocation list is applied once the server list is imported, or
+	// is unchanged, so that revoked server entries that are still in the
+	// server list are deleted.
+	defer func() {
+		if retErr == nil {
+			retErr = fetchServerEntryRevocationList(
+				ctx, config, attempt, tunnel, untunneledDialConfig, downloadCache, telemetry)
+		}
+	}()
+
+	p := config.clientParameters.Get()
+	urls := p.DownloadURLs(parameters.RemoteServerListURLs)
+	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
+	maxAttempts := p.Int(parameters.RemoteServerListRetryMaxAttempts)
+	if bootstrap {
+		downloadTimeout = p.Duration(parameters.FetchRemoteServerListBootstrapTimeout)
+		maxAttempts = p.Int(parameters.RemoteServerListBootstrapMaxAttempts)
+	}
+	mirrorMinimumWeight := p.Float(parameters.RemoteServerListMirrorMinimumWeight)
+	legalBlockFailover := p.Bool(parameters.RemoteServerListLegalBlockFailover)
+	mirrorFailover := p.Bool(parameters.RemoteServerListMirrorFailover)
+	p = nil
+
+	// When there are multiple mirrors, the download URL is selected with a
+	// preference for mirrors with lower recent latency and failure rates.
+
+	downloadURL, canonicalURL, skipVerify := urls.SelectWeighted(
+		attempt,
+		remoteServerListMirrorHealth.weights(urls, mirrorMinimumWeight),
+		config.entropy)
+
+	// Failed downloads are retried, up to RemoteServerListRetryMaxAttempts
+	// total attempts, with exponential backoff; see downloadRetryPolicy.
+	// Only downloads are retried: a downloaded list that fails validation
+	// won't be any different on a retry. Retried downloads resume any
+	// partial download.
+	//
+	// When a download fails with a LegalBlockError and
+	// RemoteServerListLegalBlockFailover is set, the download immediately
+	// fails over to another mirror that's not blocked, without a backoff.
+	// A failover isn't a retry of the blocked URL and doesn't count as an
+	// attempt; failovers are bounded by the number of mirrors.
+	//
+	// Similarly, when a download fails with a network or HTTP error and
+	// RemoteServerListMirrorFailover is set, the download immediately fails
+	// over to another mirror that hasn't failed in this fetch. Once every
+	// mirror has failed, the download is retried as above.
+	//
+	// A failover doesn't change canonicalURL, under which the ETag is
+	// stored, so the conditional request to the failover mirror uses the
+	// ETag last validated from any mirror. A mirror that serves the same
+	// entity with the same ETag reports it as unchanged. A mirror that
+	// serves the same content with a different ETag responds in full; with
+	// RemoteServerListSkipIdenticalContent, that identical list isn't
+	// imported again, and the mirror's ETag is stored.
+
+	var newETag string
+	blockedURLs := make(map[string]bool)
+	failedURLs := make(map[string]bool)
+
+	// resumed is set when the last download attempt was resumed from a
+	// partial download; see discardCorruptRemoteServerListFile.
+	resumed := false
+
+	retry := newDownloadRetryPolicy(config, maxAttempts)
+
+	for {
+
+		fileInfo, statErr := os.Stat(config.RemoteServerListDownloadFilename + ".part")
+		resumed = statErr == nil && fileInfo.Size() > 0
+
+		newETag, _, err = downloadRemoteServerListFile(
+			ctx,
+			config,
+			tunnel,
+			untunneledDialConfig,
+			downloadTimeout,
+			downloadURL,
+			canonicalURL,
+			skipVerify,
+			urls.FallbackEndpoints(downloadURL),
+			urls.TLSConfig(downloadURL),
+			"",
+			config.RemoteServerListDownloadFilename,
+			nil,
+			remoteServerListDownloadOptions{
+				measureRatio:  true,
+				mirrorHealth:  remoteServerListMirrorHealth,
+				downloadCache: downloadCache,
+				telemetry:     telemetry,
+			})
+
+		if _, ok := err.(LegalBlockError); ok && legalBlockFailover && ctx.Err() == nil {
+			blockedURLs[downloadURL] = true
+			failedURLs[downloadURL] = true
+			failoverURL, _, failoverSkipVerify, ok := urls.SelectWeightedExcluding(
+				attempt,
+				remoteServerListMirrorHealth.weights(urls, mirrorMinimumWeight),
+				blockedURLs,
+				config.entropy)
+			if !ok {
+				break
+			}
+			noticeRemoteServerListAlert(config, "failing over common remote server list download to %s: %s", failoverURL, err)
+			downloadURL, skipVerify = failoverURL, failoverSkipVerify
+			continue
+		}
+
+		if isMirrorFailoverError(err) && mirrorFailover && ctx.Err() == nil {
+			failedURLs[downloadURL] = true
+			failoverURL, _, failoverSkipVerify, ok := urls.SelectWeightedExcluding(
+				attempt,
+				remoteServerListMirrorHealth.weights(urls, mirrorMinimumWeight),
+				failedURLs,
+				config.entropy)
+			if ok {
+				noticeRemoteServerListAlert(config, "failing over common remote server list download to %s: %s", failoverURL, common.ContextError(err))
+				downloadURL, skipVerify = failoverURL, failoverSkipVerify
+				continue
+			}
+		}
+
+		if !retry.retry(ctx, config, downloadURL, err) {
+			break
+		}
+	}
+	if err != nil {
+		switch err.(type) {
+		case TunnelRequiredError, LegalBlockError:
+			return err
+		}
+		return fmt.Errorf("failed to download common remote server list: %s", common.ContextError(err))
+	}
+
+	// When the resource is unchanged, skip.
+	if newETag == "" {
+		return nil
+	}
+
+	// When the resource is identical to the imported resource, store the
+	// new ETag and skip.
+	contentDigest, identical := checkImportedContent(
+		config, canonicalURL, config.RemoteServerListDownloadFilename)
+	if identical {
+		noticeRemoteServerListInfo(config, "common remote server list is identical to imported list: %s", downloadURL)
+		err = setValidatedUrlETag(config, canonicalURL, newETag)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to set ETag for common remote server list: %s", common.ContextError(err))
+		}
+		return nil
+	}
+
+	// When a secondary signature is configured, the downloaded list is
+	// imported only when the secondary signature also validates. The new
+	// ETag isn't stored, so the list is checked again on the next fetch.
+	err = verifyRemoteServerListSecondarySignature(
+		ctx, config, attempt, tunnel, untunneledDialConfig, downloadCache, telemetry,
+		config.RemoteServerListDownloadFilename)
+	if err != nil {
+		return err
+	}
+
+	// File-related errors are returned as a FetchFileError, unwrapped, so that
+	// callers may check the error type.
+
+	file, err := os.Open(config.RemoteServerListDownloadFilename)
+	if err != nil {
+		return NewFetchFileError(
+			config.RemoteServerListDownloadFilename, "", common.ContextError(err))
+	}
+	defer file.Close()
+
+	publicKey, lowTrustPublicKey := getSignaturePublicKeys(config)
+
+	var serverListPayloadReader io.Reader
+	var configOverrides []byte
+	trustTier, err := validateWithTrustTiers(
+		publicKey,
+		lowTrustPublicKey,
+		func(signingPublicKey string) error {
+			var err error
+			serverListPayloadReader, configOverrides, err =
+				common.NewAuthenticatedDataPackageReaderWithDictionary(
+					file, signingPublicKey, config.serverEntryCompressionDictionary)
+			return err
+		})
+	if err != nil {
+		if resumed {
+			file.Close()
+			discardCorruptRemoteServerListFile(
+				config, downloadURL, canonicalURL, config.RemoteServerListDownloadFilename, err)
+		}
+		return NewFetchFileError(
+			config.RemoteServerListDownloadFilename, "", common.ContextError(err))
+	}
+
+	if trustTier != SERVER_ENTRY_TRUST_TIER_HIGH && configOverrides != nil {
+		noticeRemoteServerListAlert(config, "ignoring config overrides in %s trust common remote server list", trustTier)
+		configOverrides = nil
+	}
+
+	serverListPayloadReader, err = readValidatedPayload(
+		config, downloadURL, serverListPayloadReader)
+	if err != nil {
+		return NewFetchFileError(
+			config.RemoteServerListDownloadFilename, "", common.ContextError(err))
+	}
+
+	fetchTimestamp := config.getCurrentTimestamp()
+
+	serverEntryDecoder := newRemoteServerEntryDecoder(
+		config,
+		serverListPayloadReader,
+		fetchTimestamp,
+		protocol.SERVER_ENTRY_SOURCE_REMOTE)
+
+	serverEntryStreamHandler := config.getServerEntryStreamHandler()
+	if serverEntryStreamHandler != nil {
+		serverEntryDecoder.SetDecodedCallback(
+			func(serverEntryFields protocol.ServerEntryFields) {
+				serverEntry, err := makeStreamedServerEntry(serverEntryFields)
+				if err != nil {
+					noticeRemoteServerListAlert(config, "failed to stream server entry: %s", common.ContextError(err))
+					return
+				}
+				serverEntryStreamHandler(serverEntry)
+			})
+	}
+
+	prober := newServerEntryReachabilityProber(config)
+
+	newEntries, err := config.getServerListStore().StoreServerEntries(
+		ctx,
+		serverEntryDecoder,
+		&ServerEntryProvenance{
+			Source:         protocol.SERVER_ENTRY_SOURCE_REMOTE,
+			URL:            downloadURL,
+			FetchTimestamp: fetchTimestamp,
+			TrustTier:      trustTier,
+		},
+		prober.add)
+	if err != nil {
+		return fmt.Errorf("failed to store common remote server list: %s", common.ContextError(err))
+	}
+
+	telemetry.recordNewServerEntries(newEntries)
+
+	if config.emitRemoteServerListNotice(noticeSeverityInfo) {
+		NoticeRemoteServerListResourceImported(
+			downloadURL, newEntries, serverEntryDecoder.DecodedCount())
+		if newEntries == 0 {
+			NoticeRemoteServerListResourceNoNewServerEntries(downloadURL)
+		}
+	}
+
+	prober.probe(ctx, config, untunneledDialConfig)
+
+	// Config overrides are applied only after the server entries are
+	// successfully imported. Rejected config overrides don't fail the
+	// fetch, as the server entries remain valid.
+	if configOverrides != nil {
+		err = config.ApplyConfigOverrides(configOverrides)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to apply common remote server list config overrides: %s", common.ContextError(err))
+		}
+	}
+
+	recordImportedContent(config, canonicalURL, contentDigest)
+
+	// Now that the server entries are successfully imported, store the response
+	// ETag so we won't re-download this same data again.
+	err = setValidatedUrlETag(config, canonicalURL, newETag)
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to set ETag for common remote server list: %s", common.ContextError(err))
+		// This fetch is still reported as a success, even if we can't store the etag
+	}
+
+	return nil
+}
+
+// FetchObfuscatedServerLists downloads the obfuscated remote server lists
+// from config.ObfuscatedServerListRootURLs and any additional roots in
+// config.ObfuscatedServerListShardRootURLs.
+// For each root, it first downloads the OSL registry, and then downloads each
+// seeded OSL advertised in the registry. An OSL advertised by more than one
+// root is downloaded only from the first such root. All downloads are
+// resumable, ETags are used to skip both an unchanged registry or unchanged
+// OSL files, and when an individual download fails, the fetch proceeds if it
+// can.
+// Authenticated package digital signatures are validated using the
+// public key config.RemoteServerListSignaturePublicKey.
+// config.ObfuscatedServerListDownloadDirectory is the location to store the
+// downloaded files. As  downloads are resumed after failure, this directory
+// must be unique and persistent.
+// When ctx is canceled, any in-progress download is aborted, no further OSL
+// downloads are attempted, and the context error is returned.
+func FetchObfuscatedServerLists(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig) error {
+
+	_, err := fetchObfuscatedServerLists(
+		ctx, config, attempt, tunnel, nil, untunneledDialConfig, nil, false)
+	return err
+}
+
+// FetchObfuscatedServerListsWithTunnels is FetchObfuscatedServerLists with
+// OSL file downloads distributed across tunnels, for clients maintaining
+// several tunnels. Consecutive OSL file downloads use the tunnels in turn,
+// diversifying the network paths of a large fetch, and each registry is
+// downloaded through the first tunnel which isn't closed. A closed tunnel is
+// skipped, and when all tunnels are closed, the remaining downloads proceed
+// untunneled.
+func FetchObfuscatedServerListsWithTunnels(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnels []*Tunnel,
+	untunneledDialConfig *DialConfig) error {
+
+	var tunnel *Tunnel
+	for _, t := range tunnels {
+		if t != nil && !t.IsClosed() {
+			tunnel = t
+			break
+		}
+	}
+
+	_, err := fetchObfuscatedServerLists(
+		ctx, config, attempt, tunnel, tunnels, untunneledDialConfig, nil, false)
+	return err
+}
+
+// FetchObfuscatedServerListsWithResults is FetchObfuscatedServerLists and
+// also returns an OSLImportResult for each OSL processed by the fetch, in
+// processing order. The returned error is the same aggregate error returned
+// by FetchObfuscatedServerLists. OSLs which the fetch did not reach, due to
+// a registry failure, the byte budget, the new server threshold, the fetch
+// gate, or cancellation, have no result.
+func FetchObfuscatedServerListsWithResults(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig) ([]OSLImportResult, error) {
+
+	return fetchObfuscatedServerLists(
+		ctx, config, attempt, tunnel, nil, untunneledDialConfig, nil, false)
+}
+
+// OSLImportResult is the outcome of processing one OSL in an obfuscated
+// server list fetch.
+type OSLImportResult struct {
+
+	// OSLID is the hex encoded ID of the OSL.
+	OSLID string
+
+	// Downloaded indicates that new OSL file content was obtained in this
+	// fetch, either downloaded or reused from another download in the same
+	// coordinated fetch run.
+	Downloaded bool
+
+	// Skipped indicates that the OSL was deliberately not imported: it's
+	// unchanged, has only unsupported capabilities, is quarantined, or is
+	// identical to another OSL file already imported in this fetch or, with
+	// RemoteServerListSkipIdenticalContent, to the OSL file last imported,
+	// or, with ObfuscatedServerListSkipImportedGeneration, was already
+	// imported for the registry generation, or, with
+	// ObfuscatedServerListSkipImportedFiles, was already imported with the
+	// advertised MD5 sum, or, with
+	// ObfuscatedServerListResumeRegistryDeltas, was already applied from the
+	// registry delta by an interrupted fetch. A skipped OSL is not a failure.
+	Skipped bool
+
+	// NewEntries is the number of server entries imported from the OSL
+	// which were not already stored.
+	NewEntries int
+
+	// SignatureVerificationTime is the CPU time spent authenticating the OSL
+	// file: decrypting the file, and hashing the payload and verifying its
+	// signature with common.NewAuthenticatedDataPackageReader. It's 0 when
+	// the OSL was skipped before verification.
+	SignatureVerificationTime time.Duration
+
+	// Err is the error which caused the OSL to fail, or nil.
+	Err error
+}
+
+// DownloadObfuscatedServerLists is FetchObfuscatedServerLists in
+// download-only mode. OSL files are downloaded and validated, and staged in
+// config.ObfuscatedServerListDownloadDirectory, but their server entries are
+// not imported. ImportDownloadedObfuscatedServerLists, or the next
+// FetchObfuscatedServerLists, imports the staged OSLs. This allows, for
+// example, downloading OSLs in the background while deferring the CPU
+// intensive import until the app is in use.
+func DownloadObfuscatedServerLists(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig) error {
+
+	_, err := fetchObfuscatedServerLists(
+		ctx, config, attempt, tunnel, nil, untunneledDialConfig, nil, true)
+	return err
+}
+
+// ImportDownloadedObfuscatedServerLists imports the server entries in all
+// OSL files staged by DownloadObfuscatedServerLists. When a staged OSL file
+// can't be read, it's discarded, and its ETag is cleared so that it will be
+// downloaded again. When any import fails, the remaining OSLs are still
+// imported and an error is returned.
+func ImportDownloadedObfuscatedServerLists(config *Config) error {
+
+	err := checkSignaturePublicKey(config)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	migrateOSLDownloadFiles(config)
+
+	records, err := getOSLPendingImportRecords()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	slokLookup := newOSLSLOKLookup(config)
+
+	var failed bool
+	var fileErr error
+
+	for _, record := range records {
+
+		hexID := hex.EncodeToString(record.FileSpec.ID)
+
+		downloadFilename, err := getOSLFilename(config, record.FileSpec.ID)
+		if err != nil {
+			failed = true
+			noticeRemoteServerListAlert(config, "failed to get obfuscated server list filename (%s): %s", hexID, common.ContextError(err))
+			continue
+		}
+
+		publicKey, lowTrustPublicKey := getSignaturePublicKeys(config)
+
+		importDigest, _ := checkImportedContent(
+			config, record.CanonicalURL, downloadFilename)
+
+		err = importObfuscatedServerListFile(
+			config, record, downloadFilename, slokLookup.lookup, publicKey, lowTrustPublicKey)
+
+		if _, ok := err.(FetchFileError); ok {
+
+			// The staged file is missing or invalid; discard it so that the
+			// OSL is downloaded again by the next fetch.
+
+			failed = true
+			if fileErr == nil {
+				fileErr = err
+			}
+			noticeRemoteServerListAlert(config, "failed to import obfuscated server list file: %s", err)
+
+			err = config.getServerListStore().SetUrlETag(record.CanonicalURL, "")
+			if err != nil {
+				noticeRemoteServerListAlert(config, "failed to clear ETag for obfuscated server list file (%s): %s", hexID, common.ContextError(err))
+				continue
+			}
+
+		} else if err != nil {
+
+			// Keep the pending import record, so the import is retried.
+			failed = true
+			noticeRemoteServerListAlert(config, "failed to import obfuscated server list file (%s): %s", hexID, common.ContextError(err))
+			continue
+
+		} else {
+
+			// The imported content is recorded only for a successful import.
+			// A staged file which failed to import, for example due to a
+			// missing SLOK, isn't identical to imported content when it's
+			// downloaded again.
+			recordImportedContent(config, record.CanonicalURL, importDigest)
+
+			// Similarly, the MD5 sum of an OSL file which failed to import
+			// isn't recorded as imported.
+			recordOSLImportedMD5Sum(config, record.CanonicalURL, record.FileSpec)
+
+			// The import time orders OSL files for eviction; see
+			// evictObfuscatedServerListFiles.
+			recordOSLImportTime(config, record.FileSpec.ID)
+		}
+
+		err = deleteOSLPendingImportRecord(record.FileSpec.ID)
+		if err != nil {
+			failed = true
+			noticeRemoteServerListAlert(config, "failed to delete obfuscated server list pending import (%s): %s", hexID, common.ContextError(err))
+		}
+
+		DoGarbageCollection()
+	}
+
+	if failed {
+		if fileErr != nil {
+			return fileErr
+		}
+		return errors.New("one or more operations failed")
+	}
+
+	return nil
+}
+
+// importObfuscatedServerListFile imports the server entries in the staged
+// OSL file downloadFilename. Failures to open or read the file are returned
+// as FetchFileError.
+func importObfuscatedServerListFile(
+	config *Config,
+	record *oslPendingImportRecord,
+	downloadFilename string,
+	lookupSLOKs osl.SLOKLookup,
+	publicKey string,
+	lowTrustPublicKey string) error {
+
+	hexID := hex.EncodeToString(record.FileSpec.ID)
+
+	file, err := openDownloadFile(downloadFilename, config.oslFileEncryptionKey)
+	if err != nil {
+		return NewFetchFileError(downloadFilename, hexID, common.ContextError(err))
+	}
+	defer file.Close()
+
+	var serverListPayloadReader io.Reader
+	trustTier, err := validateWithTrustTiers(
+		publicKey,
+		lowTrustPublicKey,
+		func(signingPublicKey string) error {
+			var err error
+			serverListPayloadReader, err = osl.NewOSLReaderWithDictionary(
+				file,
+				record.FileSpec,
+				lookupSLOKs,
+				signingPublicKey,
+				config.serverEntryCompressionDictionary)
+			return err
+		})
+	if err != nil {
+		return NewFetchFileError(downloadFilename, hexID, common.ContextError(err))
+	}
+
+	serverListPayloadReader, err = readValidatedPayload(
+		config, record.URL, serverListPayloadReader)
+	if err != nil {
+		return NewFetchFileError(downloadFilename, hexID, common.ContextError(err))
+	}
+
+	fetchTimestamp := config.getCurrentTimestamp()
+
+	_, err = config.getServerListStore().StoreServerEntries(
+		context.Background(),
+		newOSLServerEntryDecoder(
+			config,
+			serverListPayloadReader,
+			fetchTimestamp,
+			record.FileSpec,
+			lookupSLOKs),
+		&ServerEntryProvenance{
+			Source:          protocol.SERVER_ENTRY_SOURCE_OBFUSCATED,
+			URL:             record.URL,
+			OSLID:           hexID,
+			FetchTimestamp:  fetchTimestamp,
+			TrustTier:       trustTier,
+			SelectionWeight: record.FileSpec.SelectionWeight,
+		},
+		nil)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// OSLDirectory is a structured representation of the cached OSL registry,
+// for external diagnostic tooling. OSLDirectory omits key material: the
+// boxed key shares and the SLOK IDs required to reassemble keys are not
+// included.
+type OSLDirectory struct {
+
+	// ETag is the stored ETag of the registry, which identifies the
+	// registry generation.
+	ETag string
+
+	// CachedTime is the modification time of the cached registry file.
+	CachedTime time.Time
+
+	// OSLs lists the OSLs in the registry, in registry order, including OSLs
+	// the client has not seeded.
+	OSLs []*OSLDirectoryEntry
+}
+
+// OSLDirectoryEntry describes one OSL in an OSLDirectory. The ID and MD5Sum
+// are hex encoded. Size is the advertised OSL file size, or 0 when the
+// registry doesn't advertise sizes.
+type OSLDirectoryEntry struct {
+	ID           string
+	MD5Sum       string
+	Priority     int
+	Regions      []string
+	Capabilities []string
+	Size         int64
+	KeySplit     *OSLDirectoryKeySplit
+}
+
+// OSLDirectoryKeySplit describes the key split parameters of an OSL file
+// key: Threshold of the Total key shares are required to reassemble the
+// key. SLOKCount is the number of shares that are SLOKs, and KeySplits
+// describes the shares that are further split.
+type OSLDirectoryKeySplit struct {
+	Threshold int
+	Total     int
+	SLOKCount int
+	KeySplits []*OSLDirectoryKeySplit
+}
+
+// GetCachedOSLDirectory returns an OSLDirectory describing the cached
+// registry of the primary obfuscated server list root, with any stored
+// registry delta applied. The cached registry is authenticated with the
+// RemoteServerListSignaturePublicKey. When no
+// registry is cached, GetCachedOSLDirectory returns nil.
+func GetCachedOSLDirectory(config *Config) (*OSLDirectory, error) {
+
+	if config.ObfuscatedServerListDownloadDirectory == "" {
+		return nil, common.ContextError(
+			errors.New("missing ObfuscatedServerListDownloadDirectory"))
+	}
+
+	p := config.clientParameters.Get()
+	publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
+	urls := p.DownloadURLs(parameters.ObfuscatedServerListRootURLs)
+	p = nil
+
+	registry, cachedTime, err := loadCachedOSLRegistry(
+		config,
+		osl.GetOSLRegistryFilename(config.ObfuscatedServerListDownloadDirectory),
+		publicKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if registry == nil {
+		return nil, nil
+	}
+
+	directory := &OSLDirectory{
+		CachedTime: cachedTime,
+	}
+
+	if len(urls) > 0 {
+		_, canonicalRootURL, _ := urls.Select(0)
+		directory.ETag, err = config.getServerListStore().GetUrlETag(getOSLRegistryURL(config, canonicalRootURL))
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	for _, fileSpec := range registry.FileSpecs {
+		directory.OSLs = append(directory.OSLs, &OSLDirectoryEntry{
+			ID:           hex.EncodeToString(fileSpec.ID),
+			MD5Sum:       hex.EncodeToString(fileSpec.MD5Sum),
+			Priority:     fileSpec.Priority,
+			Regions:      fileSpec.Regions,
+			Capabilities: fileSpec.Capabilities,
+			Size:         fileSpec.Size,
+			KeySplit:     makeOSLDirectoryKeySplit(fileSpec.KeyShares),
+		})
+	}
+
+	return directory, nil
+}
+
+// loadCachedOSLRegistry reads and authenticates the cached copy of the
+// specified OSL registry, with any stored registry delta applied, returning
+// the registry and the modification time of the cached file. When no
+// registry is cached, the returned registry is nil.
+func loadCachedOSLRegistry(
+	config *Config,
+	registryFilename string,
+	publicKey string) (*osl.Registry, time.Time, error) {
+
+	file, err := openDownloadFile(registryFilename+".cached", config.oslFileEncryptionKey)
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, common.ContextError(err)
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, time.Time{}, common.ContextError(err)
+	}
+
+	payloadReader, err := common.NewAuthenticatedDataPackageReader(file, publicKey)
+	if err != nil {
+		return nil, time.Time{}, common.ContextError(err)
+	}
+
+	var registry osl.Registry
+	err = json.NewDecoder(
+		base64.NewDecoder(base64.StdEncoding, payloadReader)).Decode(&registry)
+	if err != nil {
+		return nil, time.Time{}, common.ContextError(err)
+	}
+
+	delta, err := loadOSLRegistryDelta(config, registryFilename+".delta", publicKey)
+	if err != nil {
+		return nil, time.Time{}, common.ContextError(err)
+	}
+	if delta != nil {
+		registry.ApplyDelta(delta)
+	}
+
+	return &registry, fileInfo.ModTime(), nil
+}
+
+// IsOSLUnlockable reports whether the OSL with the specified ID can be
+// unlocked with the locally stored SLOKs, by checking the key split of the
+// OSL in the cached registries of the obfuscated server list roots against
+// the stored SLOKs. No registry or OSL file is downloaded. When the OSL
+// isn't unlockable, the returned reason describes why; for example, the
+// number of SLOKs missing out of the minimum number required to reassemble
+// the OSL file key.
+func IsOSLUnlockable(config *Config, oslID []byte) (bool, string) {
+
+	if config.ObfuscatedServerListDownloadDirectory == "" {
+		return false, "missing ObfuscatedServerListDownloadDirectory"
+	}
+
+	p := config.clientParameters.Get()
+	publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
+	shardURLs := p.DownloadURLsList(parameters.ObfuscatedServerListShardRootURLs)
+	p = nil
+
+	registryFilenames := []string{
+		osl.GetOSLRegistryFilename(config.ObfuscatedServerListDownloadDirectory),
+	}
+	for _, urls := range shardURLs {
+		_, canonicalShardURL, _ := urls.Select(0)
+		registryFilenames = append(
+			registryFilenames, getOSLShardRegistryFilename(config, canonicalShardURL))
+	}
+
+	var fileSpec *osl.OSLFileSpec
+	cached := false
+
+	for _, registryFilename := range registryFilenames {
+		registry, _, err := loadCachedOSLRegistry(config, registryFilename, publicKey)
+		if err != nil {
+			return false, fmt.Sprintf(
+				"failed to load cached registry: %s", common.ContextError(err))
+		}
+		if registry == nil {
+			continue
+		}
+		cached = true
+		for _, registryFileSpec := range registry.FileSpecs {
+			if bytes.Equal(registryFileSpec.ID, oslID) {
+				fileSpec = registryFileSpec
+				break
+			}
+		}
+		if fileSpec != nil {
+			break
+		}
+	}
+
+	if !cached {
+		return false, "no cached registry"
+	}
+	if fileSpec == nil {
+		return false, "OSL not in cached registry"
+	}
+
+	slokLookup := newOSLSLOKLookup(config)
+
+	missing, required, err := fileSpec.MissingSLOKs(slokLookup.lookup)
+	if err != nil {
+		return false, fmt.Sprintf(
+			"failed to check key split: %s", common.ContextError(err))
+	}
+	err = slokLookup.err()
+	if err != nil {
+		return false, fmt.Sprintf(
+			"failed to look up SLOKs: %s", common.ContextError(err))
+	}
+	if missing > 0 {
+		return false, fmt.Sprintf("missing %d of %d SLOKs", missing, required)
+	}
+
+	return true, ""
+}
+
+// OSLDownloadPreview estimates the download size of the next obfuscated
+// server list fetch; see PreviewObfuscatedServerLists.
+type OSLDownloadPreview struct {
+
+	// OSLCount is the number of OSLs a full fetch would download.
+	OSLCount int
+
+	// TotalBytes is the sum of the advertised sizes of the OSLs a full fetch
+	// would download. OSLs without an advertised size aren't included.
+	TotalBytes int64
+
+	// UnknownSizeCount is the number of OSLs a full fetch would download
+	// which have no advertised size.
+	UnknownSizeCount int
+}
+
+// PreviewObfuscatedServerLists estimates, using the cached registries of the
+// obfuscated server list roots, the OSL downloads of a full fetch, so that
+// apps may, for example, warn users before a large metered download. No
+// registry or OSL file is downloaded. As with FetchObfuscatedServerLists,
+// the OSLs to be downloaded are those which are unlockable with the locally
+// stored SLOKs, hinted to offer a supported capability, not quarantined,
+// and changed since last downloaded, up to RemoteServerListMaxOSLCount per
+// registry. The estimate doesn't include the registry downloads, or the
+// effect of any fetch budget, and may differ when a fetch downloads new
+// registries. When no registry is cached, PreviewObfuscatedServerLists
+// returns nil.
+func PreviewObfuscatedServerLists(config *Config) (*OSLDownloadPreview, error) {
+
+	preview := &OSLDownloadPreview{}
+
+	cached, err := forEachFetchableOSL(
+		config,
+		func(fileSpec *osl.OSLFileSpec, canonicalRootURL string) error {
+
+			downloaded, err := isOSLFileDownloaded(config, canonicalRootURL, fileSpec)
+			if err != nil {
+				return common.ContextError(err)
+			}
+			if downloaded {
+				return nil
+			}
+
+			preview.OSLCount += 1
+			if fileSpec.Size > 0 {
+				preview.TotalBytes += fileSpec.Size
+			} else {
+				preview.UnknownSizeCount += 1
+			}
+
+			return nil
+		})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if !cached {
+		return nil, nil
+	}
+
+	return preview, nil
+}
+
+// RemainingFetchEstimate estimates the obfuscated server list fetch work
+// remaining; see EstimateRemainingFetch.
+type RemainingFetchEstimate struct {
+
+	// OSLCount is the number of eligible OSLs which aren't yet imported,
+	// including OSLs which are downloaded and pending import.
+	OSLCount int
+
+	// PendingImportCount is the number of eligible OSLs which are
+	// downloaded, as by DownloadObfuscatedServerLists, and pending import.
+	PendingImportCount int
+
+	// RemainingBytes is the sum of the advertised sizes of the eligible OSLs
+	// which aren't yet downloaded. OSLs without an advertised size aren't
+	// included.
+	RemainingBytes int64
+
+	// UnknownSizeCount is the number of eligible OSLs which aren't yet
+	// downloaded and have no advertised size.
+	UnknownSizeCount int
+}
+
+// EstimateRemainingFetch estimates, using the cached registries of the
+// obfuscated server list roots and the local download and import state, the
+// OSLs which remain to be imported by full fetches, and the bytes which
+// remain to be downloaded, so that apps may display fetch progress. The
+// eligible OSLs are those which PreviewObfuscatedServerLists considers. As
+// an OSL is imported, it's no longer counted, so EstimateRemainingFetch may
+// be called during a fetch to track its progress. When no registry is
+// cached, EstimateRemainingFetch returns nil.
+func EstimateRemainingFetch(config *Config) (*RemainingFetchEstimate, error) {
+
+	records, err := getOSLPendingImportRecords()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	pendingImports := make(map[string]bool)
+	for _, record := range records {
+		pendingImports[hex.EncodeToString(record.FileSpec.ID)] = true
+	}
+
+	estimate := &RemainingFetchEstimate{}
+
+	cached, err := forEachFetchableOSL(
+		config,
+		func(fileSpec *osl.OSLFileSpec, canonicalRootURL string) error {
+
+			if pendingImports[hex.EncodeToString(fileSpec.ID)] {
+				estimate.OSLCount += 1
+				estimate.PendingImportCount += 1
+				return nil
+			}
+
+			// The OSL file ETag is stored only once the OSL is imported or,
+			// in download-only mode, staged with a pending import record.
+			downloaded, err := isOSLFileDownloaded(config, canonicalRootURL, fileSpec)
+			if err != nil {
+				return common.ContextError(err)
+			}
+			if downloaded {
+				return nil
+			}
+
+			estimate.OSLCount += 1
+			if fileSpec.Size > 0 {
+				estimate.RemainingBytes += fileSpec.Size
+			} else {
+				estimate.UnknownSizeCount += 1
+			}
+
+			return nil
+		})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if !cached {
+		return nil, nil
+	}
+
+	return estimate, nil
+}
+
+// forEachFetchableOSL calls visit with each OSL, in the cached registries of
+// the obfuscated server list roots, which a full fetch would download when
+// changed: those which are unlockable with the locally stored SLOKs, hinted
+// to offer a supported capability, and not quarantined, up to
+// RemoteServerListMaxOSLCount per registry. canonicalRootURL is the
+// canonical URL of the root of the OSL's registry. The returned cached
+// indicates whether any registry is cached.
+func forEachFetchableOSL(
+	config *Config,
+	visit func(fileSpec *osl.OSLFileSpec, canonicalRootURL string) error) (bool, error) {
+
+	if config.ObfuscatedServerListDownloadDirectory == "" {
+		return false, common.ContextError(
+			errors.New("missing ObfuscatedServerListDownloadDirectory"))
+	}
+
+	p := config.clientParameters.Get()
+	publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
+	urls := p.DownloadURLs(parameters.ObfuscatedServerListRootURLs)
+	shardURLs := p.DownloadURLsList(parameters.ObfuscatedServerListShardRootURLs)
+	maxOSLCount := p.Int(parameters.RemoteServerListMaxOSLCount)
+	p = nil
+
+	if len(urls) == 0 {
+		return false, common.ContextError(
+			errors.New("missing ObfuscatedServerListRootURLs"))
+	}
+
+	// The primary root and each shard root, in fetch order.
+
+	_, canonicalRootURL, _ := urls.Select(0)
+	canonicalRootURLs := []string{canonicalRootURL}
+	registryFilenames := []string{
+		osl.GetOSLRegistryFilename(config.ObfuscatedServerListDownloadDirectory),
+	}
+	for _, urls := range shardURLs {
+		_, canonicalShardURL, _ := urls.Select(0)
+		canonicalRootURLs = append(canonicalRootURLs, canonicalShardURL)
+		registryFilenames = append(
+			registryFilenames, getOSLShardRegistryFilename(config, canonicalShardURL))
+	}
+
+	slokLookup := newOSLSLOKLookup(config)
+
+	cached := false
+	oslIDs := make(map[string]bool)
+
+	for i, registryFilename := range registryFilenames {
+
+		registry, _, err := loadCachedOSLRegistry(config, registryFilename, publicKey)
+		if err != nil {
+			return false, common.ContextError(err)
+		}
+		if registry == nil {
+			continue
+		}
+		cached = true
+
+		seededCount := 0
+
+		for _, fileSpec := range registry.FileSpecs {
+
+			missing, _, err := fileSpec.MissingSLOKs(slokLookup.lookup)
+			if err == nil {
+				err = slokLookup.err()
+			}
+			if err != nil {
+				return false, common.ContextError(err)
+			}
+			if missing > 0 {
+				continue
+			}
+
+			seededCount += 1
+			if maxOSLCount > 0 && seededCount > maxOSLCount {
+				break
+			}
+
+			hexID := hex.EncodeToString(fileSpec.ID)
+			if oslIDs[hexID] {
+				continue
+			}
+			oslIDs[hexID] = true
+
+			if !isOSLCapabilitySupported(config, fileSpec) {
+				continue
+			}
+
+			quarantined, err := isObfuscatedServerListQuarantined(config, fileSpec.ID)
+			if err != nil {
+				return false, common.ContextError(err)
+			}
+			if quarantined {
+				continue
+			}
+
+			err = visit(fileSpec, canonicalRootURLs[i])
+			if err != nil {
+				return false, common.ContextError(err)
+			}
+		}
+	}
+
+	return cached, nil
+}
+
+// isOSLFileDownloaded indicates whether the stored ETag of the OSL file
+// matches the MD5Sum advertised by the registry, in which case a fetch won't
+// download the OSL again.
+func isOSLFileDownloaded(config *Config, canonicalRootURL string, fileSpec *osl.OSLFileSpec) (bool, error) {
+
+	lastETag, err := config.getServerListStore().GetUrlETag(osl.GetOSLFileURL(canonicalRootURL, fileSpec.ID))
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+	sourceETag := fmt.Sprintf("\"%s\"", hex.EncodeToString(fileSpec.MD5Sum))
+
+	return lastETag != "" && lastETag == sourceETag, nil
+}
+
+// OSLMissingSLOKs describes the SLOKs missing to unlock an OSL; see
+// GetOSLMissingSLOKs. The OSL ID and SLOK IDs are hex encoded.
+type OSLMissingSLOKs struct {
+	OSLID string
+
+	// MissingCount is the minimum number of additional SLOKs required to
+	// unlock the OSL, and RequiredCount is the minimum number of SLOKs
+	// required to unlock the OSL with no stored SLOKs.
+	MissingCount  int
+	RequiredCount int
+
+	// MissingSLOKIDs are the IDs of the SLOKs which aren't stored, in the
+	// key shares of the OSL which can't yet be reassembled. Any of these
+	// SLOKs may help to unlock the OSL.
+	MissingSLOKIDs []string
+}
+
+// GetOSLMissingSLOKs reports the SLOKs missing to unlock each OSL, in the
+// cached registries of the obfuscated server list roots, which isn't
+// unlockable with the locally stored SLOKs. The report is ordered by
+// MissingCount, so that the OSLs closest to being unlocked are first, and
+// then by registry order. As with IsOSLUnlockable, no registry or OSL file
+// is downloaded. When no registry is cached, GetOSLMissingSLOKs returns
+// nil.
+func GetOSLMissingSLOKs(config *Config) ([]*OSLMissingSLOKs, error) {
+
+	if config.ObfuscatedServerListDownloadDirectory == "" {
+		return nil, common.ContextError(
+			errors.New("missing ObfuscatedServerListDownloadDirectory"))
+	}
+
+	p := config.clientParameters.Get()
+	publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
+	shardURLs := p.DownloadURLsList(parameters.ObfuscatedServerListShardRootURLs)
+	p = nil
+
+	registryFilenames := []string{
+		osl.GetOSLRegistryFilename(config.ObfuscatedServerListDownloadDirectory),
+	}
+	for _, urls := range shardURLs {
+		_, canonicalShardURL, _ := urls.Select(0)
+		registryFilenames = append(
+			registryFilenames, getOSLShardRegistryFilename(config, canonicalShardURL))
+	}
+
+	slokLookup := newOSLSLOKLookup(config)
+
+	var report []*OSLMissingSLOKs
+	oslIDs := make(map[string]bool)
+
+	for _, registryFilename := range registryFilenames {
+
+		registry, _, err := loadCachedOSLRegistry(config, registryFilename, publicKey)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		if registry == nil {
+			continue
+		}
+		if report == nil {
+			report = make([]*OSLMissingSLOKs, 0)
+		}
+
+		for _, fileSpec := range registry.FileSpecs {
+
+			hexID := hex.EncodeToString(fileSpec.ID)
+			if oslIDs[hexID] {
+				continue
+			}
+			oslIDs[hexID] = true
+
+			missing, required, err := fileSpec.MissingSLOKs(slokLookup.lookup)
+			if err == nil {
+				err = slokLookup.err()
+			}
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+			if missing == 0 {
+				continue
+			}
+
+			slokIDs, err := fileSpec.MissingSLOKIDs(slokLookup.lookup)
+			if err == nil {
+				err = slokLookup.err()
+			}
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+
+			missingSLOKs := &OSLMissingSLOKs{
+				OSLID:         hexID,
+				MissingCount:  missing,
+				RequiredCount: required,
+			}
+			for _, slokID := range slokIDs {
+				missingSLOKs.MissingSLOKIDs = append(
+					missingSLOKs.MissingSLOKIDs, hex.EncodeToString(slokID))
+			}
+
+			report = append(report, missingSLOKs)
+		}
+	}
+
+	sort.SliceStable(report, func(i, j int) bool {
+		return report[i].MissingCount < report[j].MissingCount
+	})
+
+	return report, nil
+}
+
+func makeOSLDirectoryKeySplit(keyShares *osl.KeyShares) *OSLDirectoryKeySplit {
+
+	if keyShares == nil {
+		return nil
+	}
+
+	keySplit := &OSLDirectoryKeySplit{
+		Threshold: keyShares.Threshold,
+		Total:     len(keyShares.BoxedShares),
+		SLOKCount: len(keyShares.SLOKIDs),
+	}
+
+	for _, subKeyShares := range keyShares.KeyShares {
+		keySplit.KeySplits = append(
+			keySplit.KeySplits, makeOSLDirectoryKeySplit(subKeyShares))
+	}
+
+	return keySplit
+}
+
+// fetchObfuscatedServerLists performs FetchObfuscatedServerLists, using the
+// optional downloadCache to reuse resources already downloaded in a
+// coordinated fetch run. When downloadOnly is set, OSL files are staged for
+// import instead of imported. When oslTunnels is set, OSL files are
+// downloaded through oslTunnels in turn, as in
+// FetchObfuscatedServerListsWithTunnels. The per-OSL results are returned
+// along with the aggregate fetch error.
+func fetchObfuscatedServerLists(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	oslTunnels []*Tunnel,
+	untunneledDialConfig *DialConfig,
+	downloadCache *remoteServerListDownloadCache,
+	downloadOnly bool) (_ []OSLImportResult, retErr error) {
+
+	err := checkSignaturePublicKey(config)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// When a tunnel is required and there's none, the fetch isn't started,
+	// so no requests are sent and no fetch telemetry is recorded.
+	_, requiredURL, _ := config.clientParameters.Get().DownloadURLs(
+		parameters.ObfuscatedServerListRootURLs).Select(attempt)
+	err = checkTunnelRequired(config, tunnel, requiredURL)
+	if err != nil {
+		return nil, err
+	}
+
+	noticeRemoteServerListInfo(config, "fetching obfuscated remote server lists")
+
+	// Deferred first, so that the datastore is compacted after all other
+	// deferred writes and deletes.
+	defer compactDataStore(config)
+
+	// Server entries past their explicit expiry are purged after each
+	// fetch, including entries imported by the fetch.
+	defer purgeExpiredServerEntries(config)
+
+	defer noticeRemoteServerListResumeSavedBytes(config)
+
+	defer flushRemoteServerListETags(config)
+
+	telemetry := newFetchTelemetryRecorder(config, REMOTE_SERVER_LIST_FETCH_TYPE_OBFUSCATED)
+	defer func() {
+		telemetry.finish(retErr)
+	}()
+
+	p := config.clientParameters.Get()
+	urls := p.DownloadURLs(parameters.ObfuscatedServerListRootURLs)
+	shardURLs := p.DownloadURLsList(parameters.ObfuscatedServerListShardRootURLs)
+	maxTotalBytes := p.Int(parameters.RemoteServerListFetchMaxTotalBytes)
+	newServerThreshold := p.Int(parameters.ObfuscatedServerListNewServerThreshold)
+	minAvailableInodes := p.Int(parameters.ObfuscatedServerListMinAvailableInodes)
+	failureAlertLimit := p.Int(parameters.ObfuscatedServerListFailureAlertLimit)
+	attemptLogSize := p.Int(parameters.ObfuscatedServerListAttemptLogSize)
+	failOnSLOKLookupError := p.Bool(parameters.ObfuscatedServerListFailOnSLOKLookupError)
+	p = nil
+
+	// Each OSL is stored in its own file, so writes may fail on a filesystem
+	// with exhausted inodes even when there's free space. In this case, skip
+	// the fetch; this is not considered a failure, as retrying won't help
+	// until inodes are freed.
+	if minAvailableInodes > 0 {
+		availableInodes, ok, err := availableInodesStat(
+			config.ObfuscatedServerListDownloadDirectory)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to check available inodes: %s", common.ContextError(err))
+		} else if ok && availableInodes < uint64(minAvailableInodes) {
+			if config.emitRemoteServerListNotice(noticeSeverityAlert) {
+				NoticeObfuscatedServerListInodesExhausted(
+					config.ObfuscatedServerListDownloadDirectory, availableInodes)
+			}
+			return nil, nil
+		}
+	}
+
+	migrateOSLDownloadFiles(config)
+
+	// First import any OSLs staged by an earlier download-only fetch. These
+	// OSLs have stored ETags, so this fetch would otherwise skip them as
+	// unchanged.
+	if !downloadOnly {
+		err := ImportDownloadedObfuscatedServerLists(config)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to import downloaded obfuscated server lists: %s", err)
+		}
+	}
+
+	state := &obfuscatedServerListFetchState{
+		config:             config,
+		downloadOnly:       downloadOnly,
+		maxTotalBytes:      maxTotalBytes,
+		oslIDs:             make(map[string]bool),
+		importedContent:    make(map[string]string),
+		downloadCache:      downloadCache,
+		oslTunnels:         oslTunnels,
+		telemetry:          telemetry,
+		newServerThreshold: newServerThreshold,
+		newServerRegion:    config.EgressRegion,
+		failureAlertLimit:  failureAlertLimit,
+		failureAlerts:      make(map[string]int),
+		attemptLogSize:     attemptLogSize,
+		sharedCache:        newOSLSharedCache(config),
+
+		slokLookup:            newOSLSLOKLookup(config),
+		failOnSLOKLookupError: failOnSLOKLookupError,
+	}
+
+	if newServerThreshold > 0 {
+		count, err := countStoredServerEntriesInRegion(state.newServerRegion)
+		if err != nil {
+			// Without a baseline, new servers can't be counted; proceed
+			// without the threshold.
+			noticeRemoteServerListAlert(config, "failed to count stored server entries: %s", common.ContextError(err))
+			state.newServerThreshold = 0
+		}
+		state.newServerBaseline = count
+	}
+
+	// The primary root retains the legacy registry filename; each shard root
+	// has a registry filename derived from its canonical URL.
+
+	err = fetchObfuscatedServerListRoot(
+		ctx,
+		config,
+		attempt,
+		tunnel,
+		untunneledDialConfig,
+		urls,
+		osl.GetOSLRegistryFilename(config.ObfuscatedServerListDownloadDirectory),
+		state)
+
+	for _, shardURLs := range shardURLs {
+
+		if state.isBudgetExhausted() || state.newServerThresholdReached || state.gated ||
+			state.tunnelClosedErr != nil || ctx.Err() != nil {
+			break
+		}
+
+		_, canonicalShardURL, _ := shardURLs.Select(attempt)
+
+		shardErr := fetchObfuscatedServerListRoot(
+			ctx,
+			config,
+			attempt,
+			tunnel,
+			untunneledDialConfig,
+			shardURLs,
+			getOSLShardRegistryFilename(config, canonicalShardURL),
+			state)
+		if shardErr != nil {
+			if err == nil {
+				err = shardErr
+			} else {
+				noticeRemoteServerListAlert(config,
+					"failed to fetch obfuscated server list shard (%s): %s",
+					canonicalShardURL, shardErr)
+			}
+		}
+	}
+
+	state.alertDownloadFailureSummary()
+
+	evictObfuscatedServerListFiles(config)
+
+	results := make([]OSLImportResult, len(state.results))
+	for i, result := range state.results {
+		results[i] = *result
+	}
+
+	// When the fetch is canceled, the context error is returned in place of
+	// the generic failure error.
+	if err != nil && ctx.Err() != nil {
+		return results, common.ContextError(ctx.Err())
+	}
+
+	// When an OSL or registry failed because local storage is full, a
+	// DiskFullError is returned in place of the generic failure error, so
+	// that callers may back off.
+	for _, result := range state.results {
+		state.recordDiskFull(result.Err)
+	}
+	if err != nil && state.diskFullErr != nil {
+		return results, makeDiskFullError(
+			config, REMOTE_SERVER_LIST_FETCH_TYPE_OBFUSCATED, state.diskFullErr)
+	}
+
+	// With ObfuscatedServerListFailOnSLOKLookupError, a failed SLOK lookup
+	// fails the fetch, and the SLOKLookupError is returned unwrapped, in
+	// place of any generic failure error, so that callers may check the
+	// error type. Otherwise, the fetch proceeds as if the SLOK were missing.
+	if state.failOnSLOKLookupError {
+		lookupErr := state.slokLookup.err()
+		if lookupErr != nil {
+			return results, lookupErr
+		}
+	}
+
+	// When the fetch tunnel closed during the fetch, the remaining downloads
+	// weren't attempted. With RemoteServerListRequireTunnel, a
+	// TunnelRequiredError is returned, as when the fetch is started without a
+	// tunnel; otherwise, the FetchTunnelClosedError is returned. Either error
+	// is returned in place of the generic failure error.
+	if err != nil || state.tunnelClosedErr != nil {
+		tunnelErr := checkTunnelRequired(config, tunnel, requiredURL)
+		if tunnelErr != nil {
+			return results, tunnelErr
+		}
+		if state.tunnelClosedErr != nil {
+			return results, *state.tunnelClosedErr
+		}
+	}
+
+	// When a registry download was blocked for legal reasons, the
+	// LegalBlockError is returned unwrapped, in place of the generic failure
+	// error, so that callers may fail over to another root URL.
+	if err != nil && state.legalBlockErr != nil {
+		return results, *state.legalBlockErr
+	}
+
+	// A FetchGatedError is returned unwrapped, so that callers may check the
+	// error type.
+	if err == nil && state.gated {
+		return results, FetchGatedError{DownloadedBytes: state.totalBytes}
+	}
+
+	return results, err
+}
+
+// measureCPUTime calls f and returns the CPU time consumed by f. The calling
+// goroutine is locked to its OS thread while f runs, so that the thread's
+// CPU time is attributable to f. Where thread CPU time isn't available, the
+// elapsed time is returned, which approximates the CPU time of CPU bound
+// work such as signature verification.
+func measureCPUTime(f func()) time.Duration {
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	startTime := time.Now()
+	startCPUTime, ok := getThreadCPUTime()
+
+	f()
+
+	if ok {
+		endCPUTime, ok := getThreadCPUTime()
+		if ok {
+			return endCPUTime - startCPUTime
+		}
+	}
+
+	return time.Since(startTime)
+}
+
+// recordOSLImportTime records that the retained OSL file for the specified
+// OSL ID was imported now, for evictObfuscatedServerListFiles. Failure to
+// record the time isn't fatal: the file is only excluded from eviction.
+func recordOSLImportTime(config *Config, oslID []byte) {
+
+	err := setOSLImportTime(oslID, time.Now())
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to set obfuscated server list import time (%s): %s", hex.EncodeToString(oslID), common.ContextError(err))
+	}
+}
+
+// isOSLImportedForGeneration returns true when the OSL file for the file
+// spec is marked, by recordOSLImportGeneration, as imported while processing
+// the specified registry generation, with the same advertised checksum. A
+// generation of 0, for a registry without a generation, is never marked.
+func isOSLImportedForGeneration(
+	config *Config,
+	registryURL string,
+	generation int64,
+	oslFileSpec *osl.OSLFileSpec) bool {
+
+	if generation <= 0 {
+		return false
+	}
+
+	importGeneration, err := getOSLImportGeneration(oslFileSpec.ID)
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to get obfuscated server list import generation (%s): %s", hex.EncodeToString(oslFileSpec.ID), common.ContextError(err))
+		return false
+	}
+
+	return importGeneration != nil &&
+		importGeneration.RegistryURL == registryURL &&
+		importGeneration.Generation == generation &&
+		len(oslFileSpec.MD5Sum) > 0 &&
+		bytes.Equal(importGeneration.MD5Sum, oslFileSpec.MD5Sum)
+}
+
+// readOSLRegistryMD5Sums reads the cached registry, with any stored delta
+// applied, and returns the MD5 sums of its seeded OSL file specs, by hex ID.
+// OSL file specs with no MD5 sum are omitted.
+func readOSLRegistryMD5Sums(
+	config *Config,
+	cachedFilename string,
+	deltaFilename string,
+	publicKey string,
+	lookupSLOKs func(slokID []byte) []byte) (map[string][]byte, error) {
+
+	registryFile, registryStreamer, err := openOSLRegistry(
+		config, cachedFilename, publicKey, lookupSLOKs)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	defer registryFile.Close()
+
+	delta, err := loadOSLRegistryDelta(config, deltaFilename, publicKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if delta != nil {
+		registryStreamer.ApplyDelta(delta)
+	}
+
+	md5Sums := make(map[string][]byte)
+	for {
+		oslFileSpec, err := registryStreamer.Next()
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		if oslFileSpec == nil {
+			break
+		}
+		if len(oslFileSpec.MD5Sum) > 0 {
+			md5Sums[hex.EncodeToString(oslFileSpec.ID)] = oslFileSpec.MD5Sum
+		}
+	}
+
+	return md5Sums, nil
+}
+
+// isOSLUnchangedFromCachedRegistry indicates whether the OSL file for the
+// file spec has the same MD5 sum in the cached registry, per cachedMD5Sums,
+// and was already imported with that content, as indicated by the ETag
+// stored for canonicalURL. An OSL which is in both registries, but which
+// wasn't imported, as when it's newly seeded or a previous download failed,
+// isn't unchanged.
+func isOSLUnchangedFromCachedRegistry(
+	config *Config,
+	cachedMD5Sums map[string][]byte,
+	canonicalURL string,
+	oslFileSpec *osl.OSLFileSpec) bool {
+
+	cachedMD5Sum, ok := cachedMD5Sums[hex.EncodeToString(oslFileSpec.ID)]
+	if !ok || !bytes.Equal(cachedMD5Sum, oslFileSpec.MD5Sum) {
+		return false
+	}
+
+	etag, err := config.getServerListStore().GetUrlETag(canonicalURL)
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to get ETag for obfuscated server list file (%s): %s", hex.EncodeToString(oslFileSpec.ID), common.ContextError(err))
+		return false
+	}
+
+	return etag == fmt.Sprintf("\"%s\"", hex.EncodeToString(oslFileSpec.MD5Sum))
+}
+
+// recordOSLImportGeneration marks the OSL file for the file spec as imported
+// while processing the specified registry generation. Failure to record the
+// mark isn't fatal: the OSL is only processed again by a retried fetch.
+func recordOSLImportGeneration(
+	config *Config,
+	registryURL string,
+	generation int64,
+	oslFileSpec *osl.OSLFileSpec) {
+
+	if generation <= 0 {
+		return
+	}
+
+	err := setOSLImportGeneration(
+		oslFileSpec.ID,
+		&oslImportGeneration{
+			RegistryURL: registryURL,
+			Generation:  generation,
+			MD5Sum:      oslFileSpec.MD5Sum,
+		})
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to set obfuscated server list import generation (%s): %s", hex.EncodeToString(oslFileSpec.ID), common.ContextError(err))
+	}
+}
+
+// isOSLImportedWithMD5Sum indicates whether the OSL file for the file spec
+// was last imported from canonicalURL, per recordOSLImportedMD5Sum, with the
+// MD5 sum advertised by the registry, and its ETag is still stored. Unlike
+// the sourceETag check in downloadRemoteServerListFile, this doesn't assume
+// that the remote server list host's ETag is the MD5 sum. An OSL file spec
+// with no MD5 sum is never considered imported.
+func isOSLImportedWithMD5Sum(
+	config *Config, canonicalURL string, oslFileSpec *osl.OSLFileSpec) bool {
+
+	if len(oslFileSpec.MD5Sum) == 0 {
+		return false
+	}
+
+	md5Sum, err := getOSLImportedMD5Sum(canonicalURL)
+	if err == nil && bytes.Equal(md5Sum, oslFileSpec.MD5Sum) {
+		var etag string
+		etag, err = config.getServerListStore().GetUrlETag(canonicalURL)
+		if err == nil {
+			return etag != ""
+		}
+	}
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to get imported MD5 sum for obfuscated server list file (%s): %s", hex.EncodeToString(oslFileSpec.ID), common.ContextError(err))
+	}
+
+	return false
+}
+
+// recordOSLImportedMD5Sum stores the MD5 sum advertised by the registry for
+// the OSL file imported from canonicalURL, for isOSLImportedWithMD5Sum.
+// Failure to store the MD5 sum isn't fatal: the OSL is only requested again
+// by the next fetch.
+func recordOSLImportedMD5Sum(
+	config *Config, canonicalURL string, oslFileSpec *osl.OSLFileSpec) {
+
+	err := setOSLImportedMD5Sum(canonicalURL, oslFileSpec.MD5Sum)
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to set imported MD5 sum for obfuscated server list file (%s): %s", hex.EncodeToString(oslFileSpec.ID), common.ContextError(err))
+	}
+}
+
+// evictObfuscatedServerListFiles bounds the number of OSL files retained in
+// the download directory to ObfuscatedServerListMaxRetainedFiles, when set,
+// by deleting the least recently imported files. The server entries in an
+// imported file are already stored, and its ETag is retained, so an evicted
+// OSL isn't downloaded again until it changes. Files staged for a pending
+// import are still needed; they're counted towards the cap, but aren't
+// evicted.
+func evictObfuscatedServerListFiles(config *Config) {
+
+	p := config.clientParameters.Get()
+	maxRetainedFiles := p.Int(parameters.ObfuscatedServerListMaxRetainedFiles)
+	p = nil
+
+	if maxRetainedFiles <= 0 {
+		return
+	}
+
+	importTimes, err := getOSLImportTimes()
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to get obfuscated server list import times: %s", common.ContextError(err))
+		return
+	}
+
+	pendingImports, err := getOSLPendingImportRecords()
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to get obfuscated server list pending imports: %s", common.ContextError(err))
+		return
+	}
+
+	pendingIDs := make(map[string]bool)
+	for _, record := range pendingImports {
+		pendingIDs[string(record.FileSpec.ID)] = true
+	}
+
+	retainedFiles := len(pendingIDs)
+	for _, importTime := range importTimes {
+		if !pendingIDs[string(importTime.OSLID)] {
+			retainedFiles++
+		}
+	}
+
+	evictedFiles := 0
+
+	for _, importTime := range importTimes {
+
+		if retainedFiles <= maxRetainedFiles {
+			break
+		}
+
+		if pendingIDs[string(importTime.OSLID)] {
+			continue
+		}
+
+		hexID := hex.EncodeToString(importTime.OSLID)
+
+		filename, err := getOSLFilename(config, importTime.OSLID)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to get obfuscated server list filename (%s): %s", hexID, common.ContextError(err))
+			continue
+		}
+
+		err = os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			noticeRemoteServerListAlert(config, "failed to evict obfuscated server list file (%s): %s", hexID, common.ContextError(err))
+			continue
+		}
+
+		err = deleteOSLImportTime(importTime.OSLID)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to delete obfuscated server list import time (%s): %s", hexID, common.ContextError(err))
+		}
+
+		retainedFiles--
+		evictedFiles++
+	}
+
+	if evictedFiles > 0 {
+		noticeRemoteServerListInfo(config, "evicted %d obfuscated server list files", evictedFiles)
+	}
+}
+
+// availableInodesStat is getAvailableInodes, and is a variable so that tests
+// may simulate inode exhaustion.
+var availableInodesStat = getAvailableInodes
+
+// FetchRemoteServerLists performs, as one coordinated fetch run, both
+// FetchCommonRemoteServerList, when config.RemoteServerListURLs is set, and
+// then FetchObfuscatedServerLists, when config.ObfuscatedServerListRootURLs
+// is set. Within the run, a resource referenced by both fetches, identified
+// by canonical URL and ETag, is downloaded only once. When both fetches are
+// performed and both fail, the common remote server list error is returned.
+func FetchRemoteServerLists(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig) error {
+
+	downloadCache := newRemoteServerListDownloadCache()
+
+	var err error
+
+	if config.RemoteServerListURLs != nil {
+		err = fetchCommonRemoteServerList(
+			ctx, config, attempt, tunnel, untunneledDialConfig, downloadCache, false)
+	}
+
+	if config.ObfuscatedServerListRootURLs != nil {
+		_, obfuscatedErr := fetchObfuscatedServerLists(
+			ctx, config, attempt, tunnel, nil, untunneledDialConfig, downloadCache, false)
+		if obfuscatedErr != nil {
+			if err == nil {
+				err = obfuscatedErr
+			} else {
+				noticeRemoteServerListAlert(config, "failed to fetch obfuscated server lists: %s", obfuscatedErr)
+			}
+		}
+	}
+
+	return err
+}
+
+// FetchRemoteServerListsStaggered is FetchRemoteServerLists with the two
+// fetches run concurrently, rather than in sequence, and with the start of
+// the obfuscated server list fetch delayed by
+// FetchRemoteServerListStaggerDelay after the start of the common remote
+// server list fetch. The delay avoids the CPU and network usage spike of
+// starting both fetches at once, on low-end devices, without a large
+// common remote server list blocking the obfuscated server list fetch.
+// When ctx is cancelled during the delay, the obfuscated server list fetch
+// isn't started.
+func FetchRemoteServerListsStaggered(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig) error {
+
+	staggerDelay := config.clientParameters.Get().Duration(
+		parameters.FetchRemoteServerListStaggerDelay)
+
+	downloadCache := newRemoteServerListDownloadCache()
+
+	var waitGroup sync.WaitGroup
+	var commonErr, obfuscatedErr error
+
+	if config.RemoteServerListURLs != nil {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			commonErr = fetchCommonRemoteServerList(
+				ctx, config, attempt, tunnel, untunneledDialConfig, downloadCache, false)
+		}()
+	}
+
+	if config.ObfuscatedServerListRootURLs != nil {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+
+			if config.RemoteServerListURLs != nil && staggerDelay > 0 {
+				timer := time.NewTimer(staggerDelay)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					obfuscatedErr = common.ContextError(ctx.Err())
+					return
+				}
+			}
+
+			_, obfuscatedErr = fetchObfuscatedServerLists(
+				ctx, config, attempt, tunnel, nil, untunneledDialConfig, downloadCache, false)
+		}()
+	}
+
+	waitGroup.Wait()
+
+	if obfuscatedErr != nil {
+		if commonErr == nil {
+			return obfuscatedErr
+		}
+		noticeRemoteServerListAlert(config, "failed to fetch obfuscated server lists: %s", obfuscatedErr)
+	}
+
+	return commonErr
+}
+
+// remoteServerListDownloadCache records the remote server list resources
+// downloaded in a coordinated fetch run. Entries are keyed by canonical URL
+// and record the resource ETag and the local file holding the downloaded
+// resource.
+type remoteServerListDownloadCache struct {
+	mutex   sync.Mutex
+	entries map[string]remoteServerListDownloadCacheEntry
+}
+
+type remoteServerListDownloadCacheEntry struct {
+	etag     string
+	filename string
+}
+
+func newRemoteServerListDownloadCache() *remoteServerListDownloadCache {
+	return &remoteServerListDownloadCache{
+		entries: make(map[string]remoteServerListDownloadCacheEntry),
+	}
+}
+
+// set records a completed download of the resource at canonicalURL.
+func (cache *remoteServerListDownloadCache) set(canonicalURL, etag, filename string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.entries[canonicalURL] = remoteServerListDownloadCacheEntry{
+		etag:     etag,
+		filename: filename,
+	}
+}
+
+// get returns the ETag and local filename of a completed download of the
+// resource at canonicalURL. When etag is not blank, the cached download
+// must have the same ETag. Downloads whose local file has since been moved
+// or removed are ignored.
+func (cache *remoteServerListDownloadCache) get(canonicalURL, etag string) (string, string, bool) {
+
+	cache.mutex.Lock()
+	entry, ok := cache.entries[canonicalURL]
+	cache.mutex.Unlock()
+
+	if !ok || (etag != "" && etag != entry.etag) {
+		return "", "", false
+	}
+
+	_, err := os.Stat(entry.filename)
+	if err != nil {
+		return "", "", false
+	}
+
+	return entry.etag, entry.filename, true
+}
+
+// remoteServerListHTTPClients is a set of HTTP clients, one for each
+// skipVerify value, that are shared by remote server list downloads. Each
+// client is created on first use with makeClient, and its connections to
+// any one host are limited to maxConnections.
+type remoteServerListHTTPClients struct {
+	mutex          sync.Mutex
+	maxConnections int
+	makeClient     func(skipVerify bool) (*http.Client, error)
+	clients        map[bool]*http.Client
+}
+
+func newRemoteServerListHTTPClients(
+	maxConnections int,
+	makeClient func(skipVerify bool) (*http.Client, error)) *remoteServerListHTTPClients {
+
+	return &remoteServerListHTTPClients{
+		maxConnections: maxConnections,
+		makeClient:     makeClient,
+		clients:        make(map[bool]*http.Client),
+	}
+}
+
+// get returns the shared HTTP client for skipVerify, creating it when
+// required.
+func (clients *remoteServerListHTTPClients) get(skipVerify bool) (*http.Client, error) {
+
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+
+	httpClient, ok := clients.clients[skipVerify]
+	if ok {
+		return httpClient, nil
+	}
+
+	httpClient, err := clients.makeClient(skipVerify)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// Requests beyond maxConnections wait for an existing connection to
+	// become available.
+	if transport, ok := httpClient.Transport.(*http.Transport); ok {
+		transport.MaxConnsPerHost = clients.maxConnections
+		transport.MaxIdleConnsPerHost = clients.maxConnections
+	}
+
+	clients.clients[skipVerify] = httpClient
+
+	return httpClient, nil
+}
+
+// closeIdleConnections closes the idle connections of all shared clients.
+func (clients *remoteServerListHTTPClients) closeIdleConnections() {
+
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+
+	for _, httpClient := range clients.clients {
+		if transport, ok := httpClient.Transport.(*http.Transport); ok {
+			transport.CloseIdleConnections()
+		}
+	}
+}
+
+// makeContentETag returns an ETag derived from the content of the specified
+// file: the quoted, hex encoded MD5 digest. The content of a file encrypted
+// with encryptionKey is decrypted.
+func makeContentETag(filename string, encryptionKey *downloadFileKey) (string, error) {
+
+	file, err := openDownloadFile(filename, encryptionKey)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(hash.Sum(nil))), nil
+}
+
+// makeContentDigest returns the hex-encoded SHA-256 digest of the contents
+// of the specified file. The content of a file encrypted with encryptionKey
+// is decrypted.
+func makeContentDigest(filename string, encryptionKey *downloadFileKey) (string, error) {
+
+	file, err := openDownloadFile(filename, encryptionKey)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checkImportedContent returns the digest of the downloaded content in
+// filename, from canonicalURL, and whether the content is identical to the
+// content last imported from canonicalURL. Mirrors share a canonical URL,
+// and so a stored ETag, but may assign different ETags to the same content,
+// in which case switching mirrors downloads unchanged content. When
+// RemoteServerListSkipIdenticalContent is set, such content is not imported
+// again. Otherwise, or when the digest can't be made, a blank digest is
+// returned.
+//
+// Skipping an identical import means that server entries from the content
+// which were deleted since it was imported, for example by a revocation
+// list, are not restored.
+func checkImportedContent(
+	config *Config, canonicalURL, filename string) (string, bool) {
+
+	p := config.clientParameters.Get()
+	skipIdentical := p.Bool(parameters.RemoteServerListSkipIdenticalContent)
+	p = nil
+
+	if !skipIdentical {
+		return "", false
+	}
+
+	digest, err := makeContentDigest(filename, config.oslFileEncryptionKey)
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to make content digest: %s", common.ContextError(err))
+		return "", false
+	}
+
+	importedDigest, err := getImportedContentDigest(canonicalURL)
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to get imported content digest: %s", common.ContextError(err))
+		return digest, false
+	}
+
+	return digest, digest == importedDigest
+}
+
+// recordImportedContent stores the digest, returned by checkImportedContent,
+// of content imported from canonicalURL.
+func recordImportedContent(config *Config, canonicalURL, digest string) {
+
+	if digest == "" {
+		return
+	}
+
+	err := setImportedContentDigest(canonicalURL, digest)
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to set imported content digest: %s", common.ContextError(err))
+	}
+}
+
+// measureDecompressionRatio returns the ratio of the decompressed size to the
+// compressed size of the package in the specified file, and whether the
+// ratio exceeds RemoteServerListMaxDecompressionRatio. To bound the work
+// spent on a compression bomb, decompression stops once the maximum is
+// exceeded, in which case the returned ratio is a lower bound. A maximum of
+// 0 disables the check. The sizes are those of the decrypted content of a
+// file encrypted with encryptionKey.
+func measureDecompressionRatio(
+	config *Config, filename string, encryptionKey *downloadFileKey) (float64, bool, error) {
+
+	p := config.clientParameters.Get()
+	maxRatio := p.Float(parameters.RemoteServerListMaxDecompressionRatio)
+	p = nil
+
+	file, err := openDownloadFile(filename, encryptionKey)
+	if err != nil {
+		return 0.0, false, common.ContextError(err)
+	}
+	defer file.Close()
+	// Skip any package format header, which precedes the compressed data.
+
+	// The format header is only a few bytes; 16 bytes is more than enough.
+	prefix := make([]byte, 16)
+	n, err := io.ReadFull(file, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0.0, false, common.ContextError(err)
+	}
+	formatVersion, headerLength, err := common.ParseAuthenticatedDataPackageFormat(prefix[:n])
+	if err != nil {
+		return 0.0, false, common.ContextError(err)
+	}
+	_, err = file.Seek(int64(headerLength), io.SeekStart)
+	if err != nil {
+		return 0.0, false, common.ContextError(err)
+	}
+
+	compressedSize := file.Size() - int64(headerLength)
+	if compressedSize <= 0 {
+		return 0.0, false, nil
+	}
+
+	decompressor, err := common.NewAuthenticatedDataPackageDecompressor(
+		file, formatVersion, config.serverEntryCompressionDictionary)
+	if err != nil {
+		return 0.0, false, common.ContextError(err)
+	}
+
+	if maxRatio > 0.0 {
+		decompressor = io.LimitReader(
+			decompressor, int64(maxRatio*float64(compressedSize))+1)
+	}
+
+	decompressedSize, err := io.Copy(ioutil.Discard, decompressor)
+	if err != nil {
+		return 0.0, false, common.ContextError(err)
+	}
+
+	ratio := float64(decompressedSize) / float64(compressedSize)
+
+	return ratio, maxRatio > 0.0 && ratio > maxRatio, nil
+}
+
+// copyRemoteServerListFile copies a previously downloaded resource to
+// destinationFilename.
+func copyRemoteServerListFile(sourceFilename, destinationFilename string) error {
+
+	sourceFile, err := os.Open(sourceFilename)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer sourceFile.Close()
+
+	destinationFile, err := os.Create(destinationFilename)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	_, err = io.Copy(destinationFile, sourceFile)
+	if err != nil {
+		destinationFile.Close()
+		return common.ContextError(err)
+	}
+
+	err = destinationFile.Close()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// obfuscatedServerListFetchState is the state shared by the per-root fetches
+// in a single FetchObfuscatedServerLists run.
+type obfuscatedServerListFetchState struct {
+	config *Config
+
+	// downloadOnly indicates that OSL files are staged for a later
+	// ImportDownloadedObfuscatedServerLists instead of imported.
+	downloadOnly bool
+
+	// gated is set once Config.FetchGate has paused this fetch.
+	gated bool
+
+	// maxTotalBytes is the RemoteServerListFetchMaxTotalBytes budget, and
+	// totalBytes is the number of bytes downloaded in this fetch, including
+	// registries, which is checked against the budget before each download.
+	maxTotalBytes       int
+	totalBytes          int64
+	budgetExhaustedOnce bool
+
+	// downloadMode is the mode of the most recent download in this fetch,
+	// used to report tunnel transitions between consecutive downloads.
+	downloadMode string
+
+	// oslTunnels, when set, are the tunnels OSL files are downloaded
+	// through in turn, and nextOSLTunnel is the index of the tunnel for the
+	// next OSL download; see selectOSLTunnel.
+	oslTunnels    []*Tunnel
+	nextOSLTunnel int
+
+	// oslIDs is the set of OSLs, identified by hex ID, already processed in
+	// this fetch, used to skip OSLs advertised by more than one root.
+	oslIDs map[string]bool
+
+	// results is the outcome of each OSL processed in this fetch.
+	results []*OSLImportResult
+
+	// importedContent maps the SHA-256 digest of each OSL file imported in
+	// this fetch to the hex ID of the OSL. Content-identical OSL files,
+	// advertised under different OSL IDs due to misconfiguration, are
+	// imported only once.
+	importedContent map[string]string
+
+	// downloadCache, when not nil, is the download cache of the coordinated
+	// fetch run this fetch is part of.
+	downloadCache *remoteServerListDownloadCache
+
+	// telemetry records the FetchTelemetryRun of this fetch.
+	telemetry *fetchTelemetryRecorder
+
+	// newServerThreshold is the ObfuscatedServerListNewServerThreshold.
+	// newServerBaseline is the number of stored server entries in
+	// newServerRegion, the preferred egress region or any region when
+	// blank, at the start of this fetch. newServerThresholdReached is set
+	// once the fetch has added at least newServerThreshold such entries.
+	newServerThreshold        int
+	newServerRegion           string
+	newServerBaseline         int
+	newServerThresholdReached bool
+
+	// failureAlertLimit is the ObfuscatedServerListFailureAlertLimit.
+	// failureAlerts counts the OSL download failures in this fetch by
+	// normalized error message, in failureAlertOrder order. Failures beyond
+	// the limit aren't alerted individually; see alertDownloadFailure.
+	failureAlertLimit int
+	failureAlerts     map[string]int
+	failureAlertOrder []string
+
+	// attemptLogSize is the ObfuscatedServerListAttemptLogSize. When set,
+	// each OSL download attempt is logged; see logDownloadAttempt.
+	attemptLogSize int
+
+	// sharedCache is the shared OSL cache, or nil when not configured.
+	sharedCache *oslSharedCache
+
+	// slokLookup looks up SLOKs for all roots in this fetch and records
+	// lookup failures. failOnSLOKLookupError is the
+	// ObfuscatedServerListFailOnSLOKLookupError.
+	slokLookup            *oslSLOKLookup
+	failOnSLOKLookupError bool
+
+	// legalBlockErr is the LegalBlockError of the most recent registry
+	// download in this fetch which failed with an HTTP 451 response.
+	legalBlockErr *LegalBlockError
+
+	// tunnelClosedErr is set when the fetch stopped as the fetch tunnel
+	// closed; see selectDownloadTunnel.
+	tunnelClosedErr *FetchTunnelClosedError
+
+	// diskFullErr is the first error in this fetch indicating that local
+	// storage is full.
+	diskFullErr error
+}
+
+// recordLegalBlock records err when it's a LegalBlockError.
+func (state *obfuscatedServerListFetchState) recordLegalBlock(err error) {
+	if legalBlockErr, ok := err.(LegalBlockError); ok {
+		state.legalBlockErr = &legalBlockErr
+	}
+}
+
+// recordDiskFull records err when it indicates that local storage is full
+// and no such error is already recorded.
+func (state *obfuscatedServerListFetchState) recordDiskFull(err error) {
+	if state.diskFullErr == nil && isDiskFullError(err) {
+		state.diskFullErr = err
+	}
+}
+
+// logDownloadAttempt persists an OSLDownloadAttempt record for the download
+// of the specified OSL file, which took duration, retaining only the most
+// recent attemptLogSize records. Failing to log an attempt doesn't fail
+// the fetch.
+func (state *obfuscatedServerListFetchState) logDownloadAttempt(
+	hexID string,
+	downloadURL string,
+	downloadFilename string,
+	duration time.Duration,
+	timestamp string,
+	newETag string,
+	n int64,
+	err error) {
+
+	if state.attemptLogSize <= 0 {
+		return
+	}
+
+	attempt := &OSLDownloadAttempt{
+		Timestamp:            timestamp,
+		OSLID:                hexID,
+		URL:                  redactFetchTelemetryURL(downloadURL),
+		Bytes:                n,
+		DurationMilliseconds: int64(duration / time.Millisecond),
+	}
+
+	if err != nil {
+		attempt.Result = OSL_DOWNLOAD_ATTEMPT_RESULT_FAILED
+		attempt.Error = fetchTelemetryURLRegexp.ReplaceAllStringFunc(
+			err.Error(), redactFetchTelemetryURL)
+		if downloadFilename != "" {
+			attempt.Error = strings.Replace(
+				attempt.Error, downloadFilename, "[redacted]", -1)
+		}
+	} else if newETag == "" {
+		attempt.Result = OSL_DOWNLOAD_ATTEMPT_RESULT_UNCHANGED
+	} else {
+		attempt.Result = OSL_DOWNLOAD_ATTEMPT_RESULT_DOWNLOADED
+	}
+
+	record, err := json.Marshal(attempt)
+	if err == nil {
+		err = appendOSLDownloadAttempt(record, state.attemptLogSize)
+	}
+	if err != nil {
+		noticeRemoteServerListAlert(state.config, "failed to log obfuscated server list download attempt (%s): %s", hexID, common.ContextError(err))
+	}
+}
+
+// OSLDownloadAttempt is one OSL download attempt, as logged when
+// ObfuscatedServerListAttemptLogSize is set, for post-incident analysis.
+// The log is redacted: URLs, including any URLs in Error, are redacted to
+// hostnames, and the local OSL file path is removed from Error.
+type OSLDownloadAttempt struct {
+
+	// Timestamp is the RFC3339 time the attempt started.
+	Timestamp string
+
+	// OSLID is the hex encoded ID of the OSL.
+	OSLID string
+
+	// URL is the download URL, redacted to its hostname.
+	URL string
+
+	// Result is OSL_DOWNLOAD_ATTEMPT_RESULT_DOWNLOADED,
+	// OSL_DOWNLOAD_ATTEMPT_RESULT_UNCHANGED, when the OSL file was unchanged
+	// or was skipped due to its ETag, or OSL_DOWNLOAD_ATTEMPT_RESULT_FAILED.
+	Result string
+
+	// Bytes is the number of bytes downloaded, including for a failed
+	// attempt.
+	Bytes int64
+
+	// DurationMilliseconds is the duration of the attempt.
+	DurationMilliseconds int64
+
+	// Error is the error which caused the attempt to fail, or blank.
+	Error string `json:",omitempty"`
+}
+
+// GetOSLDownloadAttemptsJSON returns a JSON encoded array of
+// OSLDownloadAttempt, the logged OSL download attempts, oldest first. Up to
+// ObfuscatedServerListAttemptLogSize attempts are retained, across runs. The
+// log is empty unless ObfuscatedServerListAttemptLogSize is set.
+func GetOSLDownloadAttemptsJSON() ([]byte, error) {
+
+	records, err := getOSLDownloadAttempts()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	attempts := []*OSLDownloadAttempt{}
+	for _, record := range records {
+		var attempt *OSLDownloadAttempt
+		err := json.Unmarshal(record, &attempt)
+		if err != nil || attempt == nil {
+			// In case of data corruption or a bug causing this condition,
+			// do not stop decoding the log.
+			NoticeAlert("GetOSLDownloadAttemptsJSON: invalid record")
+			continue
+		}
+		attempts = append(attempts, attempt)
+	}
+
+	attemptsJSON, err := json.Marshal(attempts)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return attemptsJSON, nil
+}
+
+// noticeConditionalRequest reports whether the download request for the
+// specified OSL file was a cache hit, answered with 304 Not Modified for the
+// If-None-Match ETag, or a cache miss, answered with the file content. No
+// notice is emitted when no request was sent, as when the registry MD5Sum
+// matches the stored ETag, or when the request failed.
+func (state *obfuscatedServerListFetchState) noticeConditionalRequest(
+	hexID string, conditionalRequest *downloadConditionalRequest) {
+
+	ifNoneMatch, statusCode, responseETag := conditionalRequest.get()
+
+	var cacheHit bool
+	var etag string
+	switch statusCode {
+	case http.StatusNotModified:
+		cacheHit = true
+		etag = ifNoneMatch
+	case http.StatusOK, http.StatusPartialContent:
+		etag = responseETag
+	default:
+		return
+	}
+
+	if state.config.emitRemoteServerListNotice(noticeSeverityInfo) {
+		NoticeObfuscatedServerListConditionalRequest(hexID, cacheHit, statusCode, etag)
+	}
+}
+
+// alertDownloadFailure emits an alert for the failed download of the
+// specified OSL file. During a network outage, every OSL download in a fetch
+// may fail with the same error, so only the first failureAlertLimit failures
+// with an identical error, disregarding the OSL ID, URL, and filename, are
+// alerted individually. The remaining failures are reported in one summary
+// alert by alertDownloadFailureSummary. When failureAlertLimit is 0, all
+// failures are alerted individually.
+func (state *obfuscatedServerListFetchState) alertDownloadFailure(
+	hexID, downloadURL, downloadFilename string, err error) {
+
+	if state.failureAlertLimit <= 0 {
+		noticeRemoteServerListAlert(state.config, "failed to download obfuscated server list file (%s): %s", hexID, err)
+		return
+	}
+
+	message := err.Error()
+	for _, identifier := range []string{downloadURL, downloadFilename, hexID} {
+		if identifier != "" {
+			message = strings.Replace(message, identifier, "<OSL>", -1)
+		}
+	}
+
+	count := state.failureAlerts[message]
+	if count == 0 {
+		state.failureAlertOrder = append(state.failureAlertOrder, message)
+	}
+	state.failureAlerts[message] = count + 1
+
+	if count < state.failureAlertLimit {
+		noticeRemoteServerListAlert(state.config, "failed to download obfuscated server list file (%s): %s", hexID, err)
+	}
+}
+
+// alertDownloadFailureSummary emits one alert for each distinct OSL download
+// failure error with failures that weren't alerted individually.
+func (state *obfuscatedServerListFetchState) alertDownloadFailureSummary() {
+
+	for _, message := range state.failureAlertOrder {
+		count := state.failureAlerts[message]
+		if count <= state.failureAlertLimit {
+			continue
+		}
+		noticeRemoteServerListAlert(state.config,
+			"%d obfuscated server list file downloads failed, %d not alerted individually: %s",
+			count, count-state.failureAlertLimit, message)
+	}
+}
+
+// checkNewServerThreshold checks whether the fetch has added enough new
+// server entries in the preferred region, in which case no further OSLs are
+// to be downloaded in this fetch. Emits a notice when the threshold is
+// first reached.
+func (state *obfuscatedServerListFetchState) checkNewServerThreshold() {
+
+	if state.newServerThreshold <= 0 || state.newServerThresholdReached {
+		return
+	}
+
+	count, err := countStoredServerEntriesInRegion(state.newServerRegion)
+	if err != nil {
+		noticeRemoteServerListAlert(state.config, "failed to count stored server entries: %s", common.ContextError(err))
+		return
+	}
+
+	newServers := count - state.newServerBaseline
+	if newServers < state.newServerThreshold {
+		return
+	}
+
+	state.newServerThresholdReached = true
+	noticeRemoteServerListInfo(state.config,
+		"obfuscated server list fetch stopped after %d new servers: threshold of %d reached",
+		newServers, state.newServerThreshold)
+}
+
+// isBudgetExhausted checks whether the fetch byte budget is exhausted, in
+// which case no new downloads are to be started. Emits a notice the first
+// time the budget is found to be exhausted.
+func (state *obfuscatedServerListFetchState) isBudgetExhausted() bool {
+
+	if state.maxTotalBytes <= 0 || state.totalBytes < int64(state.maxTotalBytes) {
+		return false
+	}
+
+	if !state.budgetExhaustedOnce {
+		state.budgetExhaustedOnce = true
+		noticeRemoteServerListInfo(state.config,
+			"obfuscated server list fetch stopped after %d bytes: byte budget of %d exhausted",
+			state.totalBytes, state.maxTotalBytes)
+	}
+
+	return true
+}
+
+// isGated checks Config.FetchGate, if set, in which case no new OSL
+// downloads are to be started when the gate is closed. Once the gate closes,
+// the fetch remains paused. Emits a notice when the fetch is paused.
+func (state *obfuscatedServerListFetchState) isGated() bool {
+
+	if state.gated {
+		return true
+	}
+
+	if state.config.FetchGate == nil || state.config.FetchGate() {
+		return false
+	}
+
+	state.gated = true
+	noticeRemoteServerListInfo(state.config,
+		"obfuscated server list fetch paused by fetch gate after %d bytes",
+		state.totalBytes)
+
+	return true
+}
+
+// addResult adds and returns a new result for the specified OSL.
+func (state *obfuscatedServerListFetchState) addResult(hexID string) *OSLImportResult {
+	result := &OSLImportResult{OSLID: hexID}
+	state.results = append(state.results, result)
+	return result
+}
+
+// getOSLRegistryURL returns the URL of the OSL registry of the root at
+// rootURL, at Config.ObfuscatedServerListRegistryPath when set.
+func getOSLRegistryURL(config *Config, rootURL string) string {
+	return osl.GetOSLRegistryURLWithPath(rootURL, config.ObfuscatedServerListRegistryPath)
+}
+
+// getOSLShardRegistryFilename returns the local registry filename for an
+// obfuscated server list shard root.
+func getOSLShardRegistryFilename(config *Config, canonicalRootURL string) string {
+	digest := sha256.Sum256([]byte(canonicalRootURL))
+	return fmt.Sprintf(
+		"%s-%s",
+		osl.GetOSLRegistryFilename(config.ObfuscatedServerListDownloadDirectory),
+		hex.EncodeToString(digest[:8]))
+}
+
+// pendingOSLDownload is an OSL file download started by
+// dispatchOSLDownload, and its outcome, which is set once done is closed.
+type pendingOSLDownload struct {
+	oslFileSpec        *osl.OSLFileSpec
+	hexID              string
+	downloadURL        string
+	canonicalURL       string
+	sourceETag         string
+	downloadFilename   string
+	result             *OSLImportResult
+	sharedCacheHit     bool
+	timestamp          string
+	conditionalRequest *downloadConditionalRequest
+	done               chan struct{}
+	newETag            string
+	n                  int64
+	resumed            bool
+	duration           time.Duration
+	err                error
+}
+
+// isDone indicates whether the download has completed.
+func (download *pendingOSLDownload) isDone() bool {
+	select {
+	case <-download.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// fetchObfuscatedServerListRoot performs the FetchObfuscatedServerLists
+// operations for a single root and its registry.
+func fetchObfuscatedServerListRoot(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	urls parameters.DownloadURLs,
+	downloadFilename string,
+	state *obfuscatedServerListFetchState) error {
+
+	// The signing public keys are re-read before the registry and each OSL
+	// file is validated, so that a key rotation applied mid-fetch is honored.
+	// Other parameters are fixed for the duration of the fetch.
+
+	publicKey, _ := getSignaturePublicKeys(config)
+
+	p := config.clientParameters.Get()
+	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
+	prioritizeDownloads := p.Bool(parameters.ObfuscatedServerListPrioritizeDownloads)
+	recentlySeededFirst := p.Bool(parameters.ObfuscatedServerListRecentlySeededFirst)
+	maxOSLCount := p.Int(parameters.RemoteServerListMaxOSLCount)
+	registryDeltas := p.Bool(parameters.ObfuscatedServerListRegistryDeltas)
+	resumeDeltas := p.Bool(parameters.ObfuscatedServerListResumeRegistryDeltas)
+	resumeAttempts := p.Int(parameters.ObfuscatedServerListRegistryResumeAttempts)
+	skipUnchanged := p.Bool(parameters.ObfuscatedServerListSkipUnchangedFetch)
+	persistPlan := p.Bool(parameters.ObfuscatedServerListPersistFetchPlan)
+	skipImported := p.Bool(parameters.ObfuscatedServerListSkipImportedGeneration)
+	registryDiff := p.Bool(parameters.ObfuscatedServerListRegistryDiff)
+	registryMinInterval := p.Duration(parameters.ObfuscatedServerListRegistryMinInterval)
+	downloadConcurrency := p.Int(parameters.ObfuscatedServerListDownloadConcurrency)
+	skipImportedFiles := p.Bool(parameters.ObfuscatedServerListSkipImportedFiles)
+	mirrorFailover := p.Bool(parameters.RemoteServerListMirrorFailover)
+	mirrorMinimumWeight := p.Float(parameters.RemoteServerListMirrorMinimumWeight)
+	maxAttempts := p.Int(parameters.RemoteServerListRetryMaxAttempts)
+	p = nil
+
+	rootURL, canonicalRootURL, skipVerify := urls.Select(attempt)
+	fallbackEndpoints := urls.FallbackEndpoints(rootURL)
+	tlsConfig := urls.TLSConfig(rootURL)
+	downloadURL := getOSLRegistryURL(config, rootURL)
+	canonicalURL := getOSLRegistryURL(config, canonicalRootURL)
+
+	cachedFilename := downloadFilename + ".cached"
+	deltaFilename := downloadFilename + ".delta"
+
+	// If the cached registry is not present, we need to download or resume downloading
+	// the registry, so clear the ETag to ensure that always happens. Any stored delta
+	// applies only to the missing cached registry.
+	_, err := os.Stat(cachedFilename)
+	if os.IsNotExist(err) {
+		config.getServerListStore().SetUrlETag(canonicalURL, "")
+		os.Remove(deltaFilename)
+	}
+
+	// failed is set if any operation fails and should trigger a retry. When the OSL registry
+	// fails to download, any cached registry is used instead; when any single OSL fails
+	// to download, the overall operation proceeds. So this flag records whether to report
+	// failure at the end when downloading has proceeded after a failure. Failures due to
+	// full local storage are reported, by fetchObfuscatedServerLists, with a DiskFullError,
+	// so that the retry backs off.
+	var failed bool
+
+	// fileErr is the first FetchFileError for an OSL file. When set, it's
+	// returned in place of a generic failure error.
+	var fileErr error
+
+	// updateCache is set when modifed registry content is downloaded. Both the cached
+	// file and the persisted ETag will be updated in this case. The update is deferred
+	// until after the registry has been authenticated.
+	updateCache := false
+	registryFilename := cachedFilename
+
+	// When ObfuscatedServerListRegistryDeltas is set, the registry request
+	// advertises registry delta support, and the server may respond with a
+	// delta in place of the full registry. A delta is always relative to a
+	// full registry, identified by its ETag; the delta is applied only when
+	// it's relative to the cached registry, and otherwise the full registry
+	// is downloaded. updateDelta is set when a new delta is downloaded. The
+	// delta is stored alongside the cached registry and applied on each
+	// fetch, until a new full registry is downloaded.
+	updateDelta := false
+	var pendingDelta *osl.RegistryDelta
+
+	// The registry may be large, so an interrupted registry download, which
+	// leaves a partial download in place, is resumed. When the interrupted
+	// download made progress, it's immediately resumed, up to
+	// ObfuscatedServerListRegistryResumeAttempts times, and otherwise it's
+	// resumed by the next fetch. The registry signature is validated only
+	// once the download is complete. resumed is set when the registry
+	// download was resumed from a partial download; such a registry which
+	// fails validation is discarded and downloaded again from the beginning,
+	// as the partial download may be corrupt.
+	resumed := false
+
+	// registryDownloaded is set when the registry was successfully
+	// downloaded, whether or not it changed, and the download was accepted.
+	registryDownloaded := false
+
+	// failedRootURLs are the root mirrors which failed, with
+	// RemoteServerListMirrorFailover, in this fetch.
+	failedRootURLs := make(map[string]bool)
+
+	// downloadRegistry downloads the registry. It is invoked again when the
+	// cached registry is found to be corrupt.
+	var newETag string
+	downloadRegistry := func() {
+
+		updateCache = false
+		updateDelta = false
+		pendingDelta = nil
+		registryFilename = cachedFilename
+		resumed = false
+		registryDownloaded = false
+
+		var registryDelta *registryDeltaDownload
+		downloadCache := state.downloadCache
+		if registryDeltas {
+			registryDelta = &registryDeltaDownload{}
+			// A download copied from the downloadCache doesn't indicate
+			// whether it's a delta.
+			downloadCache = nil
+		}
+
+		downloadTunnel := state.selectDownloadTunnel(
+			config, tunnel, downloadURL)
+		if state.tunnelClosedErr != nil {
+			failed = true
+			return
+		}
+
+		var n int64
+		var err error
+		for resumeAttempt := 0; ; resumeAttempt++ {
+
+			fileInfo, statErr := os.Stat(downloadFilename + ".part")
+			if statErr == nil && fileInfo.Size() > 0 {
+				resumed = true
+			}
+
+			newETag, n, err = downloadRemoteServerListFile(
+				ctx,
+				config,
+				downloadTunnel,
+				untunneledDialConfig,
+				downloadTimeout,
+				downloadURL,
+				canonicalURL,
+				skipVerify,
+				fallbackEndpoints,
+				tlsConfig,
+				"",
+				downloadFilename,
+				config.oslFileEncryptionKey,
+				remoteServerListDownloadOptions{
+					measureRatio:  true,
+					registryDelta: registryDelta,
+					downloadCache: downloadCache,
+					telemetry:     state.telemetry,
+				})
+			state.totalBytes += n
+			if err == nil || ctx.Err() != nil || isDiskFullError(err) {
+				break
+			}
+			if resumeAttempt >= resumeAttempts ||
+				!shouldRetryDownload(config, err, resumeAttempt, n > 0) {
+
+				// With RemoteServerListMirrorFailover, the registry download
+				// fails over to another root mirror, from which the OSLs are
+				// then also downloaded.
+				if !mirrorFailover || !isMirrorFailoverError(err) {
+					break
+				}
+				failedRootURLs[rootURL] = true
+				failoverURL, _, failoverSkipVerify, ok := urls.SelectWeightedExcluding(
+					attempt,
+					remoteServerListMirrorHealth.weights(urls, mirrorMinimumWeight),
+					failedRootURLs,
+					config.entropy)
+				if !ok {
+					break
+				}
+				noticeRemoteServerListAlert(config, "failing over obfuscated server list download to %s: %s", failoverURL, common.ContextError(err))
+				rootURL, skipVerify = failoverURL, failoverSkipVerify
+				fallbackEndpoints = urls.FallbackEndpoints(rootURL)
+				tlsConfig = urls.TLSConfig(rootURL)
+				downloadURL = getOSLRegistryURL(config, rootURL)
+				resumeAttempt = -1
+				continue
+			}
+
+			noticeRemoteServerListInfo(config, "resuming interrupted obfuscated server list registry download: %s", common.ContextError(err))
+		}
+		if err != nil {
+			failed = true
+			state.recordLegalBlock(err)
+			state.recordDiskFull(err)
+			noticeRemoteServerListAlert(config, "failed to download obfuscated server list registry: %s", common.ContextError(err))
+			// Proceed with any existing cached OSL registry.
+			return
+		}
+		registryDownloaded = true
+		if newETag == "" {
+			return
+		}
+
+		if registryDelta == nil || !registryDelta.getIsDelta() {
+			updateCache = true
+			registryFilename = downloadFilename
+			return
+		}
+
+		delta, err := readOSLRegistryDelta(config, downloadFilename, publicKey)
+		if err == nil {
+			var baseETag string
+			baseETag, err = getOSLRegistryBaseETag(config, canonicalURL, deltaFilename, publicKey)
+			if err == nil && (baseETag == "" || delta.BaseETag != baseETag) {
+				err = fmt.Errorf("unexpected base ETag: %s", delta.BaseETag)
+			}
+		}
+		if err == nil {
+			updateDelta = true
+			pendingDelta = delta
+			return
+		}
+
+		// The delta doesn't apply to the cached registry, so download the
+		// full registry. This request doesn't advertise delta support.
+
+		noticeRemoteServerListInfo(config, "obfuscated server list registry delta not applied: %s", common.ContextError(err))
+
+		newETag, n, err = downloadRemoteServerListFile(
+			ctx,
+			config,
+			downloadTunnel,
+			untunneledDialConfig,
+			downloadTimeout,
+			downloadURL,
+			canonicalURL,
+			skipVerify,
+			fallbackEndpoints,
+			tlsConfig,
+			"",
+			downloadFilename,
+			config.oslFileEncryptionKey,
+			remoteServerListDownloadOptions{
+				measureRatio: true,
+				telemetry:    state.telemetry,
+			})
+		state.totalBytes += n
+		if err != nil {
+			failed = true
+			registryDownloaded = false
+			state.recordLegalBlock(err)
+			state.recordDiskFull(err)
+			noticeRemoteServerListAlert(config, "failed to download obfuscated server list registry: %s", common.ContextError(err))
+			// Proceed with any existing cached OSL registry.
+		} else if newETag != "" {
+			updateCache = true
+			registryFilename = downloadFilename
+		}
+	}
+
+	// When ObfuscatedServerListRegistryMinInterval is set, the registry isn't
+	// downloaded again until the interval has elapsed since the last
+	// successful registry download, even when the registry was unchanged.
+	// The cached registry is used instead, and the seeded OSLs are still
+	// checked against the stored SLOKs.
+	skipRegistryDownload := false
+	_, statErr := os.Stat(cachedFilename)
+	if registryMinInterval > 0 && statErr == nil {
+		fetchTime, err := getOSLRegistryFetchTime(canonicalURL)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to get obfuscated server list registry fetch time: %s", common.ContextError(err))
+		} else if !fetchTime.IsZero() {
+			now := config.now()
+			nextFetchTime := fetchTime.Add(registryMinInterval)
+			if !now.Before(fetchTime) && now.Before(nextFetchTime) {
+				noticeRemoteServerListInfo(config, "skipping obfuscated server list registry download until %s: %s",
+					nextFetchTime.Format(time.RFC3339), downloadURL)
+				skipRegistryDownload = true
+			}
+		}
+	}
+
+	if !skipRegistryDownload {
+		downloadRegistry()
+	}
+
+	// When ObfuscatedServerListSkipUnchangedFetch is set, and neither the
+	// registry nor the set of stored SLOKs has changed since the last
+	// complete fetch from this registry, the seeded OSLs and their content
+	// are also unchanged. In this case, the registry is not read, and the
+	// per-OSL eligibility checks and conditional requests are skipped.
+	if skipUnchanged && !failed && newETag == "" {
+		fingerprint, err := makeOSLFetchFingerprint(config, canonicalURL, "")
+		if err == nil {
+			var storedFingerprint string
+			storedFingerprint, err = getOSLFetchFingerprint(canonicalURL)
+			if err == nil && fingerprint != "" && fingerprint == storedFingerprint {
+				noticeRemoteServerListInfo(config, "skipping unchanged obfuscated server list registry: %s", downloadURL)
+				return nil
+			}
+		}
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to check obfuscated server list fetch fingerprint: %s", common.ContextError(err))
+		}
+	}
+
+	// complete is cleared when any seeded OSL is not fully processed by this
+	// fetch, in which case the fetch fingerprint is not stored and the next
+	// fetch from this registry checks all seeded OSLs again. OSLs with no
+	// MD5 sum are not pinned by the registry, so their content may change
+	// while the registry is unchanged.
+	complete := true
+
+	// Lookup SLOKs in local datastore
+	lookupSLOKs := state.slokLookup.lookup
+
+	// openRegistry opens the registry and applies the new or stored delta,
+	// if any, to the cached registry.
+	openRegistry := func() (*downloadFile, *osl.RegistryStreamer, error) {
+
+		publicKey, _ = getSignaturePublicKeys(config)
+
+		registryFile, registryStreamer, err := openOSLRegistry(
+			config,
+			registryFilename, publicKey, lookupSLOKs)
+		if err != nil || registryFilename != cachedFilename {
+			return registryFile, registryStreamer, err
+		}
+
+		delta := pendingDelta
+		if delta == nil {
+			delta, err = loadOSLRegistryDelta(config, deltaFilename, publicKey)
+			if err != nil {
+				registryFile.Close()
+				return nil, nil, common.ContextError(err)
+			}
+		}
+		if delta != nil {
+			registryStreamer.ApplyDelta(delta)
+		}
+
+		return registryFile, registryStreamer, nil
+	}
+
+	registryFile, registryStreamer, err := openRegistry()
+
+	// A registry which requires a newer SLOK scheme than this client
+	// supports can't be interpreted. A downloaded registry is discarded and
+	// its ETag isn't stored. The fetch fails with the
+	// osl.SLOKSchemeVersionError, unwrapped, so that callers may check the
+	// error type, and the notice may be used to prompt a client upgrade.
+	if schemeErr, ok := err.(osl.SLOKSchemeVersionError); ok {
+
+		NoticeObfuscatedServerListSLOKSchemeUnsupported(
+			downloadURL, schemeErr.Version, osl.SLOK_SCHEME_VERSION)
+
+		if registryFilename == downloadFilename {
+			err = os.Remove(downloadFilename)
+			if err != nil && !os.IsNotExist(err) {
+				noticeRemoteServerListAlert(config, "failed to delete obfuscated server list registry: %s", common.ContextError(err))
+			}
+		}
+
+		return schemeErr
+	}
+
+	if err != nil && registryFilename == downloadFilename && resumed {
+
+		// The resumed registry download is complete but fails validation.
+		// Discard it and download the full registry again; the partial
+		// download was renamed on completion, so this download starts from
+		// the beginning. The cached registry and its ETag are retained.
+
+		noticeRemoteServerListAlert(config, "resumed obfuscated server list registry failed validation: %s", common.ContextError(err))
+
+		err = os.Remove(downloadFilename)
+		if err != nil && !os.IsNotExist(err) {
+			noticeRemoteServerListAlert(config, "failed to delete resumed obfuscated server list registry: %s", common.ContextError(err))
+		}
+
+		downloadRegistry()
+
+		registryFile, registryStreamer, err = openRegistry()
+	}
+
+	if err != nil && registryFilename == cachedFilename && state.diskFullErr == nil {
+
+		// The cached registry is corrupt. Rather than failing every fetch until
+		// the remote registry changes, discard the cached registry and its ETag
+		// and download a fresh copy. When local storage is full, the fresh copy
+		// can't be written, so no download is attempted.
+
+		if config.emitRemoteServerListNotice(noticeSeverityAlert) {
+			NoticeObfuscatedServerListRegistryCacheCorrupt(err)
+		}
+
+		for _, filename := range []string{cachedFilename, deltaFilename} {
+			err = os.Remove(filename)
+			if err != nil && !os.IsNotExist(err) {
+				noticeRemoteServerListAlert(config, "failed to delete cached obfuscated server list registry: %s", common.ContextError(err))
+			}
+		}
+
+		err = config.getServerListStore().SetUrlETag(canonicalURL, "")
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to clear ETag for obfuscated server list registry: %s", common.ContextError(err))
+		}
+
+		// With the ETag cleared, there's no base for a delta response, and
+		// the full registry is downloaded.
+		downloadRegistry()
+
+		registryFile, registryStreamer, err = openRegistry()
+	}
+
+	if err != nil {
+		return NewFetchFileError(registryFilename, "", common.ContextError(err))
+	}
+
+	// To prevent rollback attacks, where a mirror serves an older, validly
+	// signed registry, a new registry or delta with a lower generation than
+	// the highest generation accepted from this registry URL is rejected.
+	// The rejected download is discarded, its ETag isn't stored, and the
+	// cached registry is used instead. The fetch is reported as failed, so
+	// that it's retried, possibly with another mirror.
+	var registryGeneration, highestGeneration int64
+	if updateCache || updateDelta {
+
+		highestGeneration, err = getOSLRegistryGeneration(canonicalURL)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to get obfuscated server list registry generation: %s", common.ContextError(err))
+		} else if registryStreamer.Generation() < highestGeneration {
+
+			if config.emitRemoteServerListNotice(noticeSeverityAlert) {
+				NoticeObfuscatedServerListRegistryRollback(
+					downloadURL, registryStreamer.Generation(), highestGeneration)
+			}
+
+			registryFile.Close()
+
+			err = os.Remove(downloadFilename)
+			if err != nil && !os.IsNotExist(err) {
+				noticeRemoteServerListAlert(config, "failed to delete obfuscated server list registry: %s", common.ContextError(err))
+			}
+
+			failed = true
+			updateCache = false
+			updateDelta = false
+			registryDownloaded = false
+			pendingDelta = nil
+			newETag = ""
+			registryFilename = cachedFilename
+
+			registryFile, registryStreamer, err = openRegistry()
+			if err != nil {
+				return NewFetchFileError(registryFilename, "", common.ContextError(err))
+			}
+
+		} else {
+			registryGeneration = registryStreamer.Generation()
+		}
+	}
+
+	defer registryFile.Close()
+
+	// When ObfuscatedServerListResumeRegistryDeltas is set, a new registry
+	// delta is stored as soon as it's accepted, rather than once the fetch
+	// completes, along with the progress of applying it: the delta file specs
+	// which remain to be processed. Each delta file spec is recorded as
+	// applied once it's processed. When a fetch is interrupted, for example
+	// by a restart, the next fetch, for which the stored delta is unchanged,
+	// resumes applying the delta and skips the delta file specs already
+	// applied, without requesting them again. The progress is deleted once
+	// all delta file specs are applied, or when the stored delta is replaced.
+	var deltaProgress *oslRegistryDeltaProgress
+	if resumeDeltas {
+		if updateDelta {
+			deltaProgress, err = storeOSLRegistryDelta(
+				config, canonicalURL, downloadFilename, deltaFilename, newETag, pendingDelta)
+			if err != nil {
+				noticeRemoteServerListAlert(config, "failed to set obfuscated server list registry delta: %s", common.ContextError(err))
+			} else {
+				updateDelta = false
+				if registryGeneration > highestGeneration {
+					err = setOSLRegistryGeneration(canonicalURL, registryGeneration)
+					if err != nil {
+						noticeRemoteServerListAlert(config, "failed to set obfuscated server list registry generation: %s", common.ContextError(err))
+					} else {
+						highestGeneration = registryGeneration
+					}
+				}
+			}
+		} else if updateCache {
+			err = deleteOSLRegistryDeltaProgress(canonicalURL)
+			if err != nil {
+				noticeRemoteServerListAlert(config, "failed to delete obfuscated server list registry delta progress: %s", common.ContextError(err))
+			}
+		} else {
+			deltaProgress, err = getResumableOSLRegistryDeltaProgress(config, canonicalURL, deltaFilename)
+			if err != nil {
+				noticeRemoteServerListAlert(config, "failed to get obfuscated server list registry delta progress: %s", common.ContextError(err))
+			} else if deltaProgress != nil {
+				noticeRemoteServerListInfo(config, "resuming obfuscated server list registry delta with %d remaining files", len(deltaProgress.RemainingIDs))
+			}
+		}
+	}
+
+	// When ObfuscatedServerListSkipImportedGeneration is set, each imported
+	// OSL is marked with the generation of the registry being processed, and
+	// OSLs marked as imported for this generation are skipped. A fetch which
+	// is retried after a partial failure, with the same registry, doesn't
+	// process the OSLs already imported again.
+	var importGeneration int64
+	registryCanonicalURL := canonicalURL
+	if skipImported {
+		importGeneration = registryStreamer.Generation()
+	}
+
+	// When ObfuscatedServerListRegistryDiff is set and a new full registry
+	// was downloaded, the seeded OSLs are diffed against the cached registry,
+	// which remains in place until processing completes. OSLs with the same
+	// MD5 sum in both registries, and already imported with that content,
+	// are unchanged and skipped entirely, without the eligibility checks or
+	// any request, even when a revalidating request would otherwise be sent.
+	// Only new and changed OSLs are downloaded. When there's no cached
+	// registry, or it can't be read, all seeded OSLs are processed.
+	var cachedMD5Sums map[string][]byte
+	unchangedCount := 0
+	_, statErr = os.Stat(cachedFilename)
+	if registryDiff && updateCache && statErr == nil {
+		cachedMD5Sums, err = readOSLRegistryMD5Sums(
+			config, cachedFilename, deltaFilename, publicKey, lookupSLOKs)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to read cached obfuscated server list registry: %s", common.ContextError(err))
+			cachedMD5Sums = nil
+		}
+	}
+
+	// NewRegistryStreamer authenticates the downloaded registry, so now it would be
+	// ok to update the cache. However, we defer that until after processing so we
+	// can close the file first before copying it, avoiding related complications on
+	// platforms such as Windows.
+
+	// Note: we proceed to check individual OSLs even if the directory is unchanged,
+	// as the set of local SLOKs may have changed. The fast path above applies only
+	// when the SLOK set is also unchanged.
+
+	// By default, OSLs are downloaded in registry order, streaming the registry.
+	// When downloads are prioritized, or ordered most recently seeded first, or
+	// when there's a region need, all seeded OSL file specs are first read from
+	// the registry and then sorted.
+	//
+	// A corrupt or misconfigured registry may list an excessive number of
+	// OSLs. At most RemoteServerListMaxOSLCount seeded OSLs are processed,
+	// and read into memory when sorting, and the remaining OSLs are ignored.
+	// This is not considered a failure.
+	// When ObfuscatedServerListPersistFetchPlan is set, the seeded OSLs to
+	// be processed are persisted as a fetch plan, and each OSL is removed
+	// from the plan once it's processed. A fetch which is interrupted, for
+	// example by a restart, or which stops early, leaves the remaining OSLs
+	// in the plan. While the registry and the set of stored SLOKs are
+	// unchanged, the next fetch resumes the plan: the registry is opened and
+	// authenticated, but not read, and only the remaining OSLs are processed,
+	// in the planned order. The plan is deleted once all of its OSLs are
+	// processed, and the following fetch reads the registry again.
+	var planFingerprint string
+	var plannedFileSpecs []*osl.OSLFileSpec
+	resumePlan := false
+	if persistPlan {
+		var storedFingerprint string
+		planFingerprint, err = makeOSLFetchFingerprint(config, canonicalURL, newETag)
+		if err == nil && planFingerprint != "" {
+			storedFingerprint, plannedFileSpecs, err = getOSLFetchPlan(canonicalURL)
+		}
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to get obfuscated server list fetch plan: %s", common.ContextError(err))
+			planFingerprint = ""
+		}
+		resumePlan = planFingerprint != "" && storedFingerprint == planFingerprint
+	}
+
+	var nextOSLFileSpec func() (*osl.OSLFileSpec, error)
+
+	if resumePlan {
+
+		noticeRemoteServerListInfo(config, "resuming obfuscated server list fetch plan with %d remaining files", len(plannedFileSpecs))
+		nextOSLFileSpec = iterateOSLFileSpecs(plannedFileSpecs)
+
+	} else {
+
+		nextOSLFileSpec = limitOSLFileSpecs(
+			config,
+			downloadURL,
+			reportNoEligibleOSLFileSpecs(config, downloadURL, registryStreamer, state.slokLookup),
+			maxOSLCount)
+
+		regionNeed := getOSLRegionNeed(config)
+
+		if prioritizeDownloads || recentlySeededFirst ||
+			regionNeed != "" || planFingerprint != "" {
+
+			oslFileSpecs, err := readOSLFileSpecs(nextOSLFileSpec)
+			if err != nil {
+				failed = true
+				noticeRemoteServerListAlert(config, "failed to stream obfuscated server list registry: %s", common.ContextError(err))
+				// Proceed with the OSL file specs read before the failure,
+				// but don't plan with an incomplete set of OSLs.
+				planFingerprint = ""
+			}
+			if prioritizeDownloads {
+				sortOSLFileSpecs(oslFileSpecs)
+			}
+			if recentlySeededFirst {
+				sortOSLFileSpecsBySeedTime(oslFileSpecs, prioritizeDownloads)
+			}
+			if regionNeed != "" {
+				sortOSLFileSpecsForRegion(oslFileSpecs, regionNeed)
+			}
+			if planFingerprint != "" {
+				err = setOSLFetchPlan(canonicalURL, planFingerprint, oslFileSpecs)
+				if err != nil {
+					noticeRemoteServerListAlert(config, "failed to set obfuscated server list fetch plan: %s", common.ContextError(err))
+					planFingerprint = ""
+				}
+				plannedFileSpecs = oslFileSpecs
+			}
+			nextOSLFileSpec = iterateOSLFileSpecs(oslFileSpecs)
+		}
+	}
+
+	// plannedID is the ID of the last OSL skipped by the loop below, and
+	// plannedResult is its result. The OSL is removed from the fetch plan,
+	// and recorded as applied in any registry delta progress, once the loop
+	// moves on. Downloaded OSLs are completed in the same way once processed,
+	// unless processing failed. OSLs which are skipped due to quarantine, or
+	// not reached due to the checks which end the loop early, remain in the
+	// plan and the delta progress.
+	var plannedID []byte
+	var plannedResult *OSLImportResult
+	plannedRemaining := len(plannedFileSpecs)
+
+	completeOSL := func(id []byte, result *OSLImportResult) {
+		if result.Err == nil && planFingerprint != "" {
+			err := deleteOSLFetchPlanEntry(canonicalURL, id)
+			if err != nil {
+				noticeRemoteServerListAlert(config, "failed to update obfuscated server list fetch plan: %s", common.ContextError(err))
+			} else {
+				plannedRemaining -= 1
+			}
+		}
+		if result.Err == nil && deltaProgress != nil {
+			_, err := completeOSLRegistryDeltaOperation(canonicalURL, id)
+			if err != nil {
+				noticeRemoteServerListAlert(config, "failed to update obfuscated server list registry delta progress: %s", common.ContextError(err))
+			}
+		}
+	}
+
+	completePlannedOSL := func() {
+		if plannedID == nil {
+			return
+		}
+		completeOSL(plannedID, plannedResult)
+		plannedID = nil
+		plannedResult = nil
+	}
+
+	// Up to downloadConcurrency OSL files are downloaded concurrently. Each
+	// download is processed on this goroutine, in fetch order, so server
+	// entries are stored, ETags are set, and the fetch state is updated one
+	// OSL at a time, as with sequential downloads. Before each download is
+	// started, the downloads already completed are processed, so the checks
+	// which end the loop early reflect all completed downloads; only up to
+	// downloadConcurrency-1 downloads still in progress may be started
+	// after, for example, the byte budget is exhausted.
+	root := &obfuscatedServerListRootFetch{
+		ctx:                  ctx,
+		attempt:              attempt,
+		untunneledDialConfig: untunneledDialConfig,
+		urls:                 urls,
+		downloadTimeout:      downloadTimeout,
+		mirrorFailover:       mirrorFailover,
+		mirrorMinimumWeight:  mirrorMinimumWeight,
+		maxAttempts:          maxAttempts,
+		lookupSLOKs:          lookupSLOKs,
+		rootURL:              rootURL,
+		skipVerify:           skipVerify,
+		failedRootURLs:       failedRootURLs,
+		registryCanonicalURL: registryCanonicalURL,
+		importGeneration:     importGeneration,
+		completeOSL:          completeOSL,
+	}
+
+	for {
+
+		completePlannedOSL()
+
+		oslFileSpec, err := nextOSLFileSpec()
+		if err != nil {
+			failed = true
+			noticeRemoteServerListAlert(config, "failed to stream obfuscated server list registry: %s", common.ContextError(err))
+			break
+		}
+
+		if oslFileSpec == nil {
+			break
+		}
+
+		// Stop once the fetch is canceled, for example when the controller
+		// is stopped, rather than attempting the remaining OSL downloads.
+		if ctx.Err() != nil {
+			failed = true
+			complete = false
+			break
+		}
+
+		// Stop once a SLOK lookup has failed when that fails the fetch, as
+		// the seeded OSLs can't be determined.
+		if state.failOnSLOKLookupError && state.slokLookup.err() != nil {
+			failed = true
+			complete = false
+			break
+		}
+
+		downloadURL := osl.GetOSLFileURL(rootURL, oslFileSpec.ID)
+		canonicalURL := osl.GetOSLFileURL(canonicalRootURL, oslFileSpec.ID)
+
+		hexID := hex.EncodeToString(oslFileSpec.ID)
+
+		// Skip OSLs already processed, from another root, in this fetch.
+		if state.oslIDs[hexID] {
+			continue
+		}
+		state.oslIDs[hexID] = true
+
+		// Skip delta file specs already applied by an interrupted fetch which
+		// this fetch resumes. This is not considered a failure.
+		if deltaProgress != nil && deltaProgress.isApplied(oslFileSpec.ID) {
+			noticeRemoteServerListInfo(config, "skipping obfuscated server list file (%s) applied from registry delta", hexID)
+			state.addResult(hexID).Skipped = true
+			continue
+		}
+
+		// Skip OSLs unchanged from the cached registry. This is not
+		// considered a failure.
+		if cachedMD5Sums != nil &&
+			isOSLUnchangedFromCachedRegistry(config, cachedMD5Sums, canonicalURL, oslFileSpec) {
+
+			unchangedCount += 1
+			result := state.addResult(hexID)
+			result.Skipped = true
+			plannedID, plannedResult = oslFileSpec.ID, result
+			continue
+		}
+
+		// Skip OSLs hinted to contain only server entries with capabilities
+		// the client can't use. This is not considered a failure.
+		if !isOSLCapabilitySupported(config, oslFileSpec) {
+			noticeRemoteServerListInfo(config, "skipping obfuscated server list file (%s) with unsupported capabilities", hexID)
+			result := state.addResult(hexID)
+			result.Skipped = true
+			plannedID, plannedResult = oslFileSpec.ID, result
+			continue
+		}
+
+		// Skip OSLs that are quarantined due to repeated validation failures.
+		// This is not considered a failure, as retrying won't help until the
+		// quarantine period has elapsed.
+		quarantined, err := isObfuscatedServerListQuarantined(config, oslFileSpec.ID)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to check obfuscated server list file quarantine (%s): %s", hexID, common.ContextError(err))
+		} else if quarantined {
+			noticeRemoteServerListInfo(config, "skipping quarantined obfuscated server list file (%s)", hexID)
+			state.addResult(hexID).Skipped = true
+			complete = false
+			continue
+		}
+
+		// Skip OSLs already imported for this registry generation. This is
+		// not considered a failure.
+		if isOSLImportedForGeneration(
+			config, registryCanonicalURL, importGeneration, oslFileSpec) {
+
+			noticeRemoteServerListInfo(config, "skipping obfuscated server list file (%s) imported for registry generation %d", hexID, importGeneration)
+			result := state.addResult(hexID)
+			result.Skipped = true
+			plannedID, plannedResult = oslFileSpec.ID, result
+			continue
+		}
+
+		// With ObfuscatedServerListSkipImportedFiles, skip OSLs already
+		// imported with the MD5 sum advertised by this registry, without a
+		// conditional request. As the check is against the registry being
+		// processed, a new registry which advertises a changed MD5 sum
+		// invalidates the skip. This is not considered a failure.
+		if skipImportedFiles &&
+			isOSLImportedWithMD5Sum(config, canonicalURL, oslFileSpec) {
+
+			recordRemoteServerListETagSkip(config, downloadURL)
+			result := state.addResult(hexID)
+			result.Skipped = true
+			plannedID, plannedResult = oslFileSpec.ID, result
+			continue
+		}
+
+		// Note: the MD5 checksum step assumes the remote server list host's ETag uses MD5
+		// with a hex encoding. If this is not the case, the sourceETag should be left blank.
+		sourceETag := fmt.Sprintf("\"%s\"", hex.EncodeToString(oslFileSpec.MD5Sum))
+		if len(oslFileSpec.MD5Sum) == 0 {
+			complete = false
+		}
+
+		if !state.prepareOSLDownloadDispatch(root) {
+			complete = false
+			break
+		}
+
+		result := state.addResult(hexID)
+
+		downloadFilename, err := getOSLFilename(config, oslFileSpec.ID)
+		if err != nil {
+			failed = true
+			result.Err = common.ContextError(err)
+			noticeRemoteServerListAlert(config, "failed to get obfuscated server list filename (%s): %s", hexID, result.Err)
+			continue
+		}
+
+		downloadTunnel := state.selectDownloadTunnel(
+			config, state.selectOSLTunnel(tunnel), downloadURL)
+		if state.tunnelClosedErr != nil {
+			complete = false
+			break
+		}
+
+		state.dispatchOSLDownload(
+			root,
+			&pendingOSLDownload{
+				oslFileSpec:      oslFileSpec,
+				hexID:            hexID,
+				downloadURL:      downloadURL,
+				canonicalURL:     canonicalURL,
+				sourceETag:       sourceETag,
+				downloadFilename: downloadFilename,
+				result:           result,
+			},
+			downloadTunnel)
+
+		if len(root.pendingDownloads) >= downloadConcurrency {
+			state.processOSLDownloads(root, 1)
+		}
+	}
+
+	state.processOSLDownloads(root, len(root.pendingDownloads))
+
+	if root.failed {
+		failed = true
+	}
+	if fileErr == nil {
+		fileErr = root.fileErr
+	}
+
+	completePlannedOSL()
+
+	if unchangedCount > 0 {
+		noticeRemoteServerListInfo(config, "skipped %d obfuscated server list files unchanged from cached registry: %s", unchangedCount, downloadURL)
+	}
+
+	if planFingerprint != "" && plannedRemaining == 0 {
+		err := deleteOSLFetchPlan(canonicalURL)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to delete obfuscated server list fetch plan: %s", common.ContextError(err))
+		}
+	}
+
+	// Now that a new registry is downloaded, validated, and parsed, store
+	// the response ETag so we won't re-download this same data again. First
+	// close the file to avoid complications on platforms such as Windows.
+	if updateCache {
+
+		registryFile.Close()
+
+		err := os.Rename(downloadFilename, cachedFilename)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to set cached obfuscated server list registry: %s", common.ContextError(err))
+			// This fetch is still reported as a success, even if we can't update the cache
+		}
+
+		// Any stored delta applies to the replaced cached registry.
+		err = os.Remove(deltaFilename)
+		if err != nil && !os.IsNotExist(err) {
+			noticeRemoteServerListAlert(config, "failed to delete obfuscated server list registry delta: %s", common.ContextError(err))
+		}
+
+		err = setValidatedUrlETag(config, canonicalURL, newETag)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to set ETag for obfuscated server list registry: %s", common.ContextError(err))
+			// This fetch is still reported as a success, even if we can't store the ETag
+		}
+	}
+
+	// Similarly, store a new registry delta and its ETag. The ETag is
+	// stored only when the delta is stored, as the next delta is applied
+	// relative to the cached registry.
+	if updateDelta {
+
+		registryFile.Close()
+
+		err := os.Rename(downloadFilename, deltaFilename)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to set obfuscated server list registry delta: %s", common.ContextError(err))
+		} else {
+			err = setValidatedUrlETag(config, canonicalURL, newETag)
+			if err != nil {
+				noticeRemoteServerListAlert(config, "failed to set ETag for obfuscated server list registry: %s", common.ContextError(err))
+			}
+		}
+	}
+
+	// Record the generation of the accepted registry, for the rollback check
+	// above.
+	if registryGeneration > highestGeneration {
+		err := setOSLRegistryGeneration(canonicalURL, registryGeneration)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to set obfuscated server list registry generation: %s", common.ContextError(err))
+		}
+	}
+
+	// OSLs which appear unseeded due to a failed SLOK lookup may be seeded,
+	// so the fetch isn't complete.
+	if state.slokLookup.err() != nil {
+		complete = false
+	}
+
+	// Record the time of an accepted registry download, for
+	// ObfuscatedServerListRegistryMinInterval.
+	if registryDownloaded {
+		err := setOSLRegistryFetchTime(canonicalURL, config.now())
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to set obfuscated server list registry fetch time: %s", common.ContextError(err))
+		}
+	}
+
+	// Store the fingerprint of a complete fetch, for the fast path above, or
+	// clear any fingerprint of a previous fetch.
+	if skipUnchanged {
+		var fingerprint string
+		var err error
+		if complete && !failed {
+			fingerprint, err = makeOSLFetchFingerprint(config, canonicalURL, newETag)
+		}
+		if err == nil {
+			err = setOSLFetchFingerprint(canonicalURL, fingerprint)
+		}
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to set obfuscated server list fetch fingerprint: %s", common.ContextError(err))
+		}
+	}
+
+	if failed {
+		if fileErr != nil {
+			return fileErr
+		}
+		return errors.New("one or more operations failed")
+	}
+
+	return nil
+}
+
+// obfuscatedServerListRootFetch is the state of fetchObfuscatedServerListRoot
+// which is shared with the processOSLDownload and dispatchOSLDownload steps
+// for the OSLs of the root.
+type obfuscatedServerListRootFetch struct {
+	ctx                  context.Context
+	attempt              int
+	untunneledDialConfig *DialConfig
+	urls                 parameters.DownloadURLs
+	downloadTimeout      time.Duration
+	mirrorFailover       bool
+	mirrorMinimumWeight  float64
+	maxAttempts          int
+	lookupSLOKs          osl.SLOKLookup
+
+	// rootURL is the root mirror OSL files are downloaded from, and
+	// failedRootURLs are the root mirrors which failed, with
+	// RemoteServerListMirrorFailover, in this fetch.
+	rootURL        string
+	skipVerify     bool
+	failedRootURLs map[string]bool
+
+	// registryCanonicalURL and importGeneration identify the registry for
+	// ObfuscatedServerListSkipImportedGeneration.
+	registryCanonicalURL string
+	importGeneration     int64
+
+	// completeOSL is called with each processed OSL; see
+	// fetchObfuscatedServerListRoot.
+	completeOSL func(id []byte, result *OSLImportResult)
+
+	// pendingDownloads are the OSL file downloads started and not yet
+	// processed, in the order they were started.
+	pendingDownloads []*pendingOSLDownload
+
+	// failed and fileErr are set as the failed flag and first
+	// FetchFileError of fetchObfuscatedServerListRoot are.
+	failed  bool
+	fileErr error
+}
+
+// dispatchOSLDownload starts the specified OSL file download, through
+// downloadTunnel, and adds it to the pending downloads of the root fetch. An
+// OSL file in the shared cache, with the content advertised by the
+// registry, is used in place of a download.
+func (state *obfuscatedServerListFetchState) dispatchOSLDownload(
+	root *obfuscatedServerListRootFetch,
+	download *pendingOSLDownload,
+	downloadTunnel *Tunnel) {
+
+	config := state.config
+
+	download.done = make(chan struct{})
+	root.pendingDownloads = append(root.pendingDownloads, download)
+
+	if state.sharedCache != nil && len(download.oslFileSpec.MD5Sum) > 0 {
+
+		// Any earlier pending download of the same OSL is processed first, as
+		// when downloads are sequential, so that the shared cache includes
+		// the OSL file that download stores.
+		for i := len(root.pendingDownloads) - 2; i >= 0; i-- {
+			if root.pendingDownloads[i].hexID == download.hexID {
+				state.processOSLDownloads(root, i+1)
+				break
+			}
+		}
+
+		download.sharedCacheHit = state.sharedCache.reuse(
+			download.oslFileSpec, download.canonicalURL, download.sourceETag, download.downloadFilename)
+		if download.sharedCacheHit {
+			download.newETag = download.sourceETag
+			close(download.done)
+			return
+		}
+	}
+
+	download.timestamp = config.getCurrentTimestamp()
+	download.conditionalRequest = &downloadConditionalRequest{}
+
+	// With RemoteServerListMirrorFailover, a failed OSL download fails over
+	// to another root mirror which hasn't failed in this fetch, selected
+	// with the same mirror health preference as the common remote server
+	// list download. Once no other root mirror remains, the download is
+	// retried as a common remote server list download is, up to
+	// RemoteServerListRetryMaxAttempts total attempts. As with the common
+	// remote server list, the OSL file ETag remains keyed by the canonical
+	// URL across failovers.
+	oslFailedRootURLs := make(map[string]bool)
+	for failedRootURL := range root.failedRootURLs {
+		oslFailedRootURLs[failedRootURL] = true
+	}
+	retry := newDownloadRetryPolicy(config, root.maxAttempts)
+
+	go func() {
+		defer close(download.done)
+		startTime := time.Now()
+		oslRootURL, oslSkipVerify := root.rootURL, root.skipVerify
+		for {
+			fileInfo, statErr := os.Stat(download.downloadFilename + ".part")
+			download.resumed = statErr == nil && fileInfo.Size() > 0
+			var n int64
+			download.newETag, n, download.err = downloadRemoteServerListFile(
+				root.ctx,
+				config,
+				downloadTunnel,
+				root.untunneledDialConfig,
+				root.downloadTimeout,
+				download.downloadURL,
+				download.canonicalURL,
+				oslSkipVerify,
+				root.urls.FallbackEndpoints(oslRootURL),
+				root.urls.TLSConfig(oslRootURL),
+				download.sourceETag,
+				download.downloadFilename,
+				config.oslFileEncryptionKey,
+				remoteServerListDownloadOptions{
+					conditionalRequest: download.conditionalRequest,
+					downloadCache:      state.downloadCache,
+					telemetry:          state.telemetry,
+				})
+			download.n += n
+			if root.mirrorFailover && isMirrorFailoverError(download.err) && root.ctx.Err() == nil {
+				oslFailedRootURLs[oslRootURL] = true
+				failoverURL, _, failoverSkipVerify, ok := root.urls.SelectWeightedExcluding(
+					root.attempt,
+					remoteServerListMirrorHealth.weights(root.urls, root.mirrorMinimumWeight),
+					oslFailedRootURLs,
+					config.entropy)
+				if ok {
+					noticeRemoteServerListAlert(config, "failing over obfuscated server list file (%s) download to %s: %s", download.hexID, failoverURL, common.ContextError(download.err))
+					oslRootURL, oslSkipVerify = failoverURL, failoverSkipVerify
+					download.downloadURL = osl.GetOSLFileURL(oslRootURL, download.oslFileSpec.ID)
+					continue
+				}
+			}
+			if !retry.retry(root.ctx, config, download.downloadURL, download.err) {
+				break
+			}
+		}
+		download.duration = time.Since(startTime)
+	}()
+}
+
+// processOSLDownloads processes, in order, the first count pending
+// downloads of the root fetch, waiting for each to complete.
+func (state *obfuscatedServerListFetchState) processOSLDownloads(
+	root *obfuscatedServerListRootFetch, count int) {
+
+	downloads := root.pendingDownloads[:count]
+	root.pendingDownloads = root.pendingDownloads[count:]
+
+	for _, download := range downloads {
+		state.processOSLDownload(root, download)
+	}
+}
+
+// processCompletedOSLDownloads processes, in order, the pending downloads
+// of the root fetch which have completed, up to the first download which is
+// still in progress.
+func (state *obfuscatedServerListFetchState) processCompletedOSLDownloads(
+	root *obfuscatedServerListRootFetch) {
+
+	count := 0
+	for count < len(root.pendingDownloads) && root.pendingDownloads[count].isDone() {
+		count += 1
+	}
+
+	state.processOSLDownloads(root, count)
+}
+
+// prepareOSLDownloadDispatch processes the completed pending downloads of
+// the root fetch before another OSL file download is started, so that the
+// checks which end the fetch early reflect all completed downloads. The
+// return value indicates whether the next download may be started; when
+// false, the fetch is incomplete.
+func (state *obfuscatedServerListFetchState) prepareOSLDownloadDispatch(
+	root *obfuscatedServerListRootFetch) bool {
+
+	state.processCompletedOSLDownloads(root)
+
+	// Once the byte budget is exhausted, stop starting new downloads. The
+	// OSLs already processed are kept and this is not considered a failure,
+	// as retrying would exceed the budget again.
+	if state.isBudgetExhausted() {
+		return false
+	}
+
+	// Similarly, stop once enough new servers in the preferred region
+	// have been imported in this fetch.
+	if state.newServerThresholdReached {
+		return false
+	}
+
+	// Pause when the app's fetch gate is closed. Unlike the cases above,
+	// the fetch fails with a FetchGatedError, so that the remaining OSLs
+	// are downloaded by a later fetch.
+	if state.isGated() {
+		return false
+	}
+
+	return true
+}
+
+// processOSLDownload waits for the specified pending OSL file download of
+// the root fetch to complete and then processes the downloaded OSL file:
+// the server entries are imported, or the file is staged in download-only
+// mode, and the OSL's ETag and import records are stored. Downloads are
+// processed in the order they're started; see dispatchOSLDownload.
+func (state *obfuscatedServerListFetchState) processOSLDownload(
+	root *obfuscatedServerListRootFetch, download *pendingOSLDownload) {
+
+	<-download.done
+
+	config := state.config
+
+	oslFileSpec := download.oslFileSpec
+	hexID := download.hexID
+	downloadURL := download.downloadURL
+	canonicalURL := download.canonicalURL
+	downloadFilename := download.downloadFilename
+	result := download.result
+	newETag := download.newETag
+
+	defer root.completeOSL(oslFileSpec.ID, result)
+
+	if !download.sharedCacheHit {
+		state.totalBytes += download.n
+		state.noticeConditionalRequest(hexID, download.conditionalRequest)
+		state.logDownloadAttempt(
+			hexID, downloadURL, downloadFilename,
+			download.duration, download.timestamp, newETag, download.n, download.err)
+		if download.err != nil {
+			root.failed = true
+			result.Err = common.ContextError(download.err)
+			state.alertDownloadFailure(hexID, downloadURL, downloadFilename, result.Err)
+			return
+		}
+	}
+
+	// When the resource is unchanged, skip.
+	if newETag == "" {
+		result.Skipped = true
+		return
+	}
+
+	result.Downloaded = true
+
+	// When the OSL file is identical to the OSL file last imported from
+	// canonicalURL, the server entries are already stored, and the OSL
+	// file is neither imported nor staged.
+	importDigest, identical := checkImportedContent(
+		config, canonicalURL, downloadFilename)
+	if identical {
+
+		noticeRemoteServerListInfo(config, "obfuscated server list file (%s) is identical to imported file", hexID)
+
+		result.Skipped = true
+
+		recordOSLImportTime(config, oslFileSpec.ID)
+
+		recordOSLImportGeneration(
+			config, root.registryCanonicalURL, root.importGeneration, oslFileSpec)
+
+		recordOSLImportedMD5Sum(config, canonicalURL, oslFileSpec)
+
+		err := setValidatedUrlETag(config, canonicalURL, newETag)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to set ETag for obfuscated server list file (%s): %s", hexID, common.ContextError(err))
+		}
+
+		return
+	}
+
+	file, err := openDownloadFile(downloadFilename, config.oslFileEncryptionKey)
+	if err != nil {
+		root.failed = true
+		err = NewFetchFileError(downloadFilename, hexID, common.ContextError(err))
+		if root.fileErr == nil {
+			root.fileErr = err
+		}
+		result.Err = err
+		noticeRemoteServerListAlert(config, "failed to open obfuscated server list file: %s", err)
+		return
+	}
+
+	publicKey, lowTrustPublicKey := getSignaturePublicKeys(config)
+
+	var serverListPayloadReader io.Reader
+	var trustTier string
+	verificationTime := measureCPUTime(func() {
+		trustTier, err = validateWithTrustTiers(
+			publicKey,
+			lowTrustPublicKey,
+			func(signingPublicKey string) error {
+				var err error
+				serverListPayloadReader, err = osl.NewOSLReaderWithDictionary(
+					file,
+					oslFileSpec,
+					root.lookupSLOKs,
+					signingPublicKey,
+					config.serverEntryCompressionDictionary)
+				return err
+			})
+	})
+	result.SignatureVerificationTime = verificationTime
+	state.telemetry.recordSignatureVerification(verificationTime)
+	if err != nil {
+		file.Close()
+		root.failed = true
+		err = NewFetchFileError(downloadFilename, hexID, common.ContextError(err))
+		if root.fileErr == nil {
+			root.fileErr = err
+		}
+		result.Err = err
+		noticeRemoteServerListAlert(config, "failed to read obfuscated server list file: %s", err)
+		validationErr := err
+		err = recordObfuscatedServerListFailure(config, oslFileSpec.ID, downloadFilename)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to record obfuscated server list file failure (%s): %s", hexID, common.ContextError(err))
+		}
+		// When the OSL is now quarantined, the file has already been
+		// moved to the quarantine directory, and only the ETag is cleared.
+		if download.resumed {
+			discardCorruptRemoteServerListFile(
+				config, downloadURL, canonicalURL, downloadFilename, validationErr)
+		}
+		return
+	}
+
+	if !download.sharedCacheHit {
+		state.sharedCache.store(hexID, downloadFilename)
+	}
+
+	// When the OSL file is identical to an OSL file already imported in
+	// this fetch, the server entries are already stored. The ETag is
+	// stored as if this OSL file was imported. The check follows
+	// validation, which rejects an identical OSL file with an embedded
+	// OSL ID that doesn't match this OSL. A failure to hash the file only
+	// disables the check.
+	var contentDigest string
+	if !state.downloadOnly {
+		contentDigest, _ = makeContentDigest(downloadFilename, config.oslFileEncryptionKey)
+	}
+	if importedHexID, ok := state.importedContent[contentDigest]; ok {
+
+		file.Close()
+
+		noticeRemoteServerListInfo(config, "obfuscated server list file (%s) is identical to imported file (%s)", hexID, importedHexID)
+
+		result.Skipped = true
+
+		recordOSLImportTime(config, oslFileSpec.ID)
+
+		recordOSLImportGeneration(
+			config, root.registryCanonicalURL, root.importGeneration, oslFileSpec)
+
+		recordOSLImportedMD5Sum(config, canonicalURL, oslFileSpec)
+
+		err = setValidatedUrlETag(config, canonicalURL, newETag)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to set ETag for obfuscated server list file (%s): %s", hexID, common.ContextError(err))
+		}
+
+		err = deleteOSLQuarantineRecord(oslFileSpec.ID)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to clear obfuscated server list file failures (%s): %s", hexID, common.ContextError(err))
+		}
+
+		return
+	}
+
+	// In download-only mode, the validated OSL file is left staged on
+	// disk for a later import. The ETag is stored now, so that the OSL
+	// isn't downloaded again, and a pending import record ensures the
+	// OSL is still imported.
+	if state.downloadOnly {
+
+		file.Close()
+
+		err = setOSLPendingImportRecord(
+			oslFileSpec.ID,
+			&oslPendingImportRecord{
+				FileSpec:     oslFileSpec,
+				URL:          downloadURL,
+				CanonicalURL: canonicalURL,
+			})
+		if err != nil {
+			root.failed = true
+			result.Err = common.ContextError(err)
+			noticeRemoteServerListAlert(config, "failed to stage obfuscated server list file (%s): %s", hexID, result.Err)
+			return
+		}
+
+		err = setValidatedUrlETag(config, canonicalURL, newETag)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to set ETag for obfuscated server list file (%s): %s", hexID, common.ContextError(err))
+		}
+
+		err = deleteOSLQuarantineRecord(oslFileSpec.ID)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to clear obfuscated server list file failures (%s): %s", hexID, common.ContextError(err))
+		}
+
+		return
+	}
+
+	serverListPayloadReader, err = readValidatedPayload(
+		config, downloadURL, serverListPayloadReader)
+	if err != nil {
+		file.Close()
+		root.failed = true
+		err = NewFetchFileError(downloadFilename, hexID, common.ContextError(err))
+		if root.fileErr == nil {
+			root.fileErr = err
+		}
+		result.Err = err
+		noticeRemoteServerListAlert(config, "failed to read obfuscated server list file: %s", err)
+		return
+	}
+
+	fetchTimestamp := config.getCurrentTimestamp()
+
+	prober := newServerEntryReachabilityProber(config)
+
+	serverEntryDecoder := newOSLServerEntryDecoder(
+		config,
+		serverListPayloadReader,
+		fetchTimestamp,
+		oslFileSpec,
+		root.lookupSLOKs)
+
+	newEntries, err := config.getServerListStore().StoreServerEntries(
+		root.ctx,
+		serverEntryDecoder,
+		&ServerEntryProvenance{
+			Source:          protocol.SERVER_ENTRY_SOURCE_OBFUSCATED,
+			URL:             downloadURL,
+			OSLID:           hexID,
+			FetchTimestamp:  fetchTimestamp,
+			TrustTier:       trustTier,
+			SelectionWeight: oslFileSpec.SelectionWeight,
+		},
+		prober.add)
+	if err != nil {
+		file.Close()
+		root.failed = true
+		result.Err = common.ContextError(err)
+		noticeRemoteServerListAlert(config, "failed to store obfuscated server list file (%s): %s", hexID, result.Err)
+		return
+	}
+
+	prober.probe(root.ctx, config, root.untunneledDialConfig)
+
+	result.NewEntries = newEntries
+	state.telemetry.recordNewServerEntries(newEntries)
+
+	if config.emitRemoteServerListNotice(noticeSeverityInfo) {
+		NoticeRemoteServerListResourceImported(
+			downloadURL, newEntries, serverEntryDecoder.DecodedCount())
+		if newEntries == 0 {
+			NoticeRemoteServerListResourceNoNewServerEntries(downloadURL)
+		}
+	}
+
+	if contentDigest != "" {
+		state.importedContent[contentDigest] = hexID
+	}
+
+	state.checkNewServerThreshold()
+
+	recordOSLImportTime(config, oslFileSpec.ID)
+
+	recordOSLImportGeneration(
+		config, root.registryCanonicalURL, root.importGeneration, oslFileSpec)
+
+	recordOSLImportedMD5Sum(config, canonicalURL, oslFileSpec)
+
+	recordImportedContent(config, canonicalURL, importDigest)
+
+	// Now that the server entries are successfully imported, store the response
+	// ETag so we won't re-download this same data again.
+	err = setValidatedUrlETag(config, canonicalURL, newETag)
+	if err != nil {
+		file.Close()
+		noticeRemoteServerListAlert(config, "failed to set ETag for obfuscated server list file (%s): %s", hexID, common.ContextError(err))
+		return
+		// This fetch is still reported as a success, even if we can't store the ETag
+	}
+
+	file.Close()
+
+	err = deleteOSLQuarantineRecord(oslFileSpec.ID)
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to clear obfuscated server list file failures (%s): %s", hexID, common.ContextError(err))
+	}
+
+	// Clear the references to this OSL file streamer and immediately run
+	// a garbage collection to reclaim its memory before processing the
+	// next file.
+	serverListPayloadReader = nil
+	serverEntryDecoder = nil
+	DoGarbageCollection()
+}
+
+// makeOSLFetchFingerprint returns a fingerprint of the registry, identified
+// by its ETag, and the set of stored SLOKs, which together determine the
+// seeded OSLs. When registryETag is blank, the stored ETag for the registry
+// is used. A blank fingerprint is returned when the registry has no ETag.
+func makeOSLFetchFingerprint(config *Config, canonicalURL, registryETag string) (string, error) {
+
+	if registryETag == "" {
+		var err error
+		registryETag, err = config.getServerListStore().GetUrlETag(canonicalURL)
+		if err != nil {
+			return "", common.ContextError(err)
+		}
+		if registryETag == "" {
+			return "", nil
+		}
+	}
+
+	SLOKsDigest, err := getSLOKsDigest()
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(registryETag))
+	hash.Write([]byte{0})
+	hash.Write(SLOKsDigest)
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// newRemoteServerEntryDecoder creates a server entry decoder for a fetched
+// remote server list, applying the Config server entry validation settings.
+func newRemoteServerEntryDecoder(
+	config *Config,
+	serverListPayloadReader io.Reader,
+	fetchTimestamp string,
+	serverEntrySource string) *protocol.StreamingServerEntryDecoder {
+
+	decoder := protocol.NewStreamingServerEntryDecoder(
+		serverListPayloadReader, fetchTimestamp, serverEntrySource)
+
+	if config.OnServerEntryValidationError != nil {
+		decoder.SetValidationErrorCallback(config.OnServerEntryValidationError)
+	}
+
+	decoder.SetLenientValidation(config.LenientServerEntryValidation)
+
+	return decoder
+}
+
+// newOSLServerEntryDecoder creates a server entry decoder for a decrypted
+// OSL, as newRemoteServerEntryDecoder, which also decrypts server entry
+// capabilities encrypted to the OSL key. When the key can't be derived,
+// server entries with encrypted capabilities are imported without them.
+func newOSLServerEntryDecoder(
+	config *Config,
+	serverListPayloadReader io.Reader,
+	fetchTimestamp string,
+	fileSpec *osl.OSLFileSpec,
+	lookupSLOKs osl.SLOKLookup) *protocol.StreamingServerEntryDecoder {
+
+	decoder := newRemoteServerEntryDecoder(
+		config,
+		serverListPayloadReader,
+		fetchTimestamp,
+		protocol.SERVER_ENTRY_SOURCE_OBFUSCATED)
+
+	key, err := fileSpec.ServerEntryCapabilitiesKey(lookupSLOKs)
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to derive server entry capabilities key (%s): %s",
+			hex.EncodeToString(fileSpec.ID), common.ContextError(err))
+		key = nil
+	}
+
+	decoder.SetCapabilitiesDecrypter(
+		func(encryptedCapabilities string) ([]string, error) {
+			if key == nil {
+				return nil, common.ContextError(errors.New("missing key"))
+			}
+			return osl.DecryptServerEntryCapabilities(key, encryptedCapabilities)
+		})
+
+	return decoder
+}
+
+// readValidatedPayload invokes config.OnValidatedPayload, when set, with the
+// entire payload read from serverListPayloadReader, which must be the reader
+// returned by a signature validating package reader. A reader for the
+// buffered payload, to be decoded in place of serverListPayloadReader, is
+// returned. When no callback is set, serverListPayloadReader is returned
+// as-is and the payload continues to be streamed.
+func readValidatedPayload(
+	config *Config,
+	sourceURL string,
+	serverListPayloadReader io.Reader) (io.Reader, error) {
+
+	if config.OnValidatedPayload == nil {
+		return serverListPayloadReader, nil
+	}
+
+	payload, err := ioutil.ReadAll(serverListPayloadReader)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	config.OnValidatedPayload(sourceURL, payload)
+
+	return bytes.NewReader(payload), nil
+}
+
+// makeStreamedServerEntry converts decoded server entry fields into a
+// ServerEntry for a server entry stream handler.
+func makeStreamedServerEntry(
+	serverEntryFields protocol.ServerEntryFields) (*protocol.ServerEntry, error) {
+
+	data, err := json.Marshal(serverEntryFields)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var serverEntry *protocol.ServerEntry
+	err = json.Unmarshal(data, &serverEntry)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return serverEntry, nil
+}
+
+// setValidatedUrlETag stores the ETag of a downloaded resource once its
+// content has been validated, along with the validation time used to
+// schedule revalidation.
+//
+// As a failure to store the ETag means the resource is downloaded again by
+// the next fetch, a failed ETag write is retried, up to
+// RemoteServerListETagWriteMaxAttempts total attempts. When all attempts
+// fail, the ETag is queued to be stored by flushPendingUrlETags at the end
+// of the fetch, and is not reported as an error. The queue is backed by the
+// ETagStore, so ETags for a custom ServerListStore aren't queued; a failed
+// write is reported in a notice, and the resource is downloaded again by the
+// next fetch.
+func setValidatedUrlETag(config *Config, canonicalURL, etag string) error {
+
+	p := config.clientParameters.Get()
+	maxAttempts := p.Int(parameters.RemoteServerListETagWriteMaxAttempts)
+	retryBackoff := p.Duration(parameters.RemoteServerListETagWriteRetryBackoff)
+	p = nil
+
+	store := config.getServerListStore()
+
+	var err error
+	for i := 0; i < maxAttempts; i++ {
+		if i > 0 {
+			time.Sleep(retryBackoff)
+		}
+		err = store.SetUrlETag(canonicalURL, etag)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		if _, ok := store.(*datastoreServerListStore); ok {
+			queueUrlETag(canonicalURL, etag)
+			noticeRemoteServerListAlert(config, "queued ETag for %s after %d failed attempts: %s", canonicalURL, maxAttempts, common.ContextError(err))
+		} else {
+			noticeRemoteServerListAlert(config, "failed to store ETag for %s after %d attempts: %s", canonicalURL, maxAttempts, common.ContextError(err))
+		}
+	}
+
+	err = SetUrlValidatedTime(canonicalURL, config.now())
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// selectDownloadTunnel returns the tunnel, if any, to use for the next
+// download in a fetch, from url, and emits a notice when the download mode
+// changes. The selected tunnel may close during a long fetch; in that case,
+// the remaining downloads aren't made untunneled, which would expose them to
+// the direct network. Instead, the fetch stops, nil is returned, and the
+// FetchTunnelClosedError is recorded in tunnelClosedErr.
+func (state *obfuscatedServerListFetchState) selectDownloadTunnel(
+	config *Config, tunnel *Tunnel, url string) *Tunnel {
+
+	downloadMode := REMOTE_SERVER_LIST_DOWNLOAD_MODE_UNTUNNELED
+	if tunnel != nil {
+		downloadMode = REMOTE_SERVER_LIST_DOWNLOAD_MODE_TUNNELED
+		if tunnel.IsClosed() {
+			downloadMode = REMOTE_SERVER_LIST_DOWNLOAD_MODE_STOPPED
+			state.tunnelClosedErr = &FetchTunnelClosedError{URL: url}
+			tunnel = nil
+		}
+	}
+
+	if state.downloadMode != "" && downloadMode != state.downloadMode &&
+		config.emitRemoteServerListNotice(noticeSeverityInfo) {
+
+		NoticeRemoteServerListDownloadModeChanged(url, state.downloadMode, downloadMode)
+	}
+	state.downloadMode = downloadMode
+
+	return tunnel
+}
+
+// selectOSLTunnel returns the tunnel to use for the next OSL download. With
+// no oslTunnels, this is the fetch tunnel. Otherwise, the next oslTunnels
+// tunnel which isn't closed is returned, and when all are closed, the fetch
+// tunnel is returned. When the fetch tunnel is nil, selectDownloadTunnel then
+// selects an untunneled download, as for any download in an untunneled
+// fetch; when the fetch tunnel is closed, the fetch stops.
+func (state *obfuscatedServerListFetchState) selectOSLTunnel(tunnel *Tunnel) *Tunnel {
+	for range state.oslTunnels {
+		oslTunnel := state.oslTunnels[state.nextOSLTunnel%len(state.oslTunnels)]
+		state.nextOSLTunnel += 1
+		if oslTunnel != nil && !oslTunnel.IsClosed() {
+			return oslTunnel
+		}
+	}
+	return tunnel
+}
+
+// limitOSLFileSpecs wraps next, which returns the seeded OSL file specs of
+// the registry downloaded from registryURL, to return at most maxOSLCount
+// file specs. When the registry has more file specs, a notice is emitted
+// and the remaining file specs are not returned. A maxOSLCount of 0
+// disables the limit.
+func limitOSLFileSpecs(
+	config *Config,
+	registryURL string,
+	next func() (*osl.OSLFileSpec, error),
+	maxOSLCount int) func() (*osl.OSLFileSpec, error) {
+
+	count := 0
+	exceeded := false
+
+	return func() (*osl.OSLFileSpec, error) {
+
+		if exceeded {
+			return nil, nil
+		}
+
+		oslFileSpec, err := next()
+		if err != nil || oslFileSpec == nil {
+			return oslFileSpec, err
+		}
+
+		count += 1
+		if maxOSLCount > 0 && count > maxOSLCount {
+			exceeded = true
+			if config.emitRemoteServerListNotice(noticeSeverityAlert) {
+				NoticeObfuscatedServerListMaxOSLCountExceeded(registryURL, maxOSLCount)
+			}
+			return nil, nil
+		}
+
+		return oslFileSpec, nil
+	}
+}
+
+// reportNoEligibleOSLFileSpecs returns a function which streams the seeded
+// OSL file specs from registryStreamer and, when the registry is streamed to
+// the end without any seeded OSL, reports that no OSLs are eligible, with
+// the total number of OSLs in the registry, with a notice and
+// config.OnNoEligibleOSLs. Clients with few SLOKs commonly have no eligible
+// OSLs, in which case the fetch imports nothing. In either case, the SLOK
+// coverage of the registry is reported with an OSLCoverage notice once the
+// registry is streamed to the end.
+func reportNoEligibleOSLFileSpecs(
+	config *Config,
+	registryURL string,
+	registryStreamer *osl.RegistryStreamer,
+	slokLookup *oslSLOKLookup) func() (*osl.OSLFileSpec, error) {
+
+	seeded := false
+	reported := false
+
+	return func() (*osl.OSLFileSpec, error) {
+
+		oslFileSpec, err := registryStreamer.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		if oslFileSpec != nil {
+			seeded = true
+			return oslFileSpec, nil
+		}
+
+		if !reported && config.emitRemoteServerListNotice(noticeSeverityInfo) {
+			seededCount, totalCount, missingSLOKCount := registryStreamer.Coverage()
+			slokLookupErrorCount := 0
+			if lookupErr, ok := slokLookup.err().(SLOKLookupError); ok {
+				slokLookupErrorCount = lookupErr.Count
+			}
+			NoticeOSLCoverage(
+				registryURL, seededCount, totalCount, missingSLOKCount, slokLookupErrorCount)
+		}
+
+		if !seeded && !reported {
+			registryOSLCount := registryStreamer.FileSpecCount()
+			if config.emitRemoteServerListNotice(noticeSeverityInfo) {
+				NoticeObfuscatedServerListNoEligibleOSLs(registryURL, registryOSLCount)
+			}
+			if config.OnNoEligibleOSLs != nil {
+				config.OnNoEligibleOSLs(registryOSLCount)
+			}
+		}
+
+		reported = true
+
+		return nil, nil
+	}
+}
+
+// iterateOSLFileSpecs returns a function which returns each of the OSL file
+// specs in turn, and then nil.
+func iterateOSLFileSpecs(
+	oslFileSpecs []*osl.OSLFileSpec) func() (*osl.OSLFileSpec, error) {
+
+	return func() (*osl.OSLFileSpec, error) {
+		if len(oslFileSpecs) == 0 {
+			return nil, nil
+		}
+		oslFileSpec := oslFileSpecs[0]
+		oslFileSpecs = oslFileSpecs[1:]
+		return oslFileSpec, nil
+	}
+}
+
+// readOSLFileSpecs reads all remaining seeded OSL file specs from the
+// registry, using next. When an error occurs, the OSL file specs read before
+// the error are returned along with the error.
+func readOSLFileSpecs(
+	next func() (*osl.OSLFileSpec, error)) ([]*osl.OSLFileSpec, error) {
+
+	var oslFileSpecs []*osl.OSLFileSpec
+
+	for {
+		oslFileSpec, err := next()
+		if err != nil {
+			return oslFileSpecs, common.ContextError(err)
+		}
+
+		if oslFileSpec == nil {
+			return oslFileSpecs, nil
+		}
+
+		oslFileSpecs = append(oslFileSpecs, oslFileSpec)
+	}
+}
+
+// sortOSLFileSpecs sorts OSL file specs into download order: descending
+// priority and then ascending OSL ID.
+func sortOSLFileSpecs(oslFileSpecs []*osl.OSLFileSpec) {
+	sort.Slice(oslFileSpecs, func(i, j int) bool {
+		if oslFileSpecs[i].Priority != oslFileSpecs[j].Priority {
+			return oslFileSpecs[i].Priority > oslFileSpecs[j].Priority
+		}
+		return bytes.Compare(oslFileSpecs[i].ID, oslFileSpecs[j].ID) < 0
+	})
+}
+
+// isOSLCapabilitySupported checks whether the OSL Capabilities hint includes
+// any of the config SupportedServerEntryCapabilities. OSLs without a hint,
+// and all OSLs when no supported capabilities are configured, are
+// considered supported.
+func isOSLCapabilitySupported(config *Config, oslFileSpec *osl.OSLFileSpec) bool {
+
+	if len(config.SupportedServerEntryCapabilities) == 0 ||
+		len(oslFileSpec.Capabilities) == 0 {
+		return true
+	}
+
+	for _, capability := range oslFileSpec.Capabilities {
+		if common.Contains(config.SupportedServerEntryCapabilities, capability) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getOSLRegionNeed returns the client's preferred egress region when there
+// are no stored server entries in that region, or "" when there is no
+// region need.
+func getOSLRegionNeed(config *Config) string {
+
+	if config.EgressRegion == "" {
+		return ""
+	}
+
+	count, err := countStoredServerEntriesInRegion(config.EgressRegion)
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to check obfuscated server list region need: %s", common.ContextError(err))
+		return ""
+	}
+
+	if count > 0 {
+		return ""
+	}
+
+	return config.EgressRegion
+}
+
+// reportNewServerEntries runs fetch, a remote server list fetch, and reports
+// the number of new server entries stored by the fetch, when that number
+// meets RemoteServerListMinNewEntriesToReport, with a notice and
+// config.OnNewServerEntries. Server entries are counted even when fetch
+// fails, as a failed fetch may still import some server entries. The
+// fetch error is returned.
+func reportNewServerEntries(config *Config, fetch func() error) error {
+
+	baseline, err := countStoredServerEntriesInRegion("")
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to count stored server entries: %s", common.ContextError(err))
+		return fetch()
+	}
+
+	fetchErr := fetch()
+
+	count, err := countStoredServerEntriesInRegion("")
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to count stored server entries: %s", common.ContextError(err))
+		return fetchErr
+	}
+
+	minNewEntries := config.clientParameters.Get().Int(
+		parameters.RemoteServerListMinNewEntriesToReport)
+
+	newEntries := count - baseline
+	if newEntries >= minNewEntries {
+		NoticeRemoteServerListNewServerEntries(newEntries)
+		config.newServerEntriesReporter.report(config, newEntries)
+	}
+
+	return fetchErr
+}
+
+// newServerEntriesReporter coalesces config.OnNewServerEntries reports over
+// RemoteServerListNewEntriesReportWindow, so that a burst of fetches, each
+// adding new server entries, results in at most one report per window.
+type newServerEntriesReporter struct {
+	mutex   sync.Mutex
+	pending bool
+	reports int
+	count   int
+}
+
+// report reports count new server entries to config.OnNewServerEntries.
+// When a report window is configured, the first report in a window is
+// deferred until the window ends, and further reports within the window
+// are added to it.
+func (reporter *newServerEntriesReporter) report(config *Config, count int) {
+
+	if config.OnNewServerEntries == nil {
+		return
+	}
+
+	window := config.clientParameters.Get().Duration(
+		parameters.RemoteServerListNewEntriesReportWindow)
+
+	if window <= 0 {
+		config.OnNewServerEntries(count)
+		return
+	}
+
+	reporter.mutex.Lock()
+	defer reporter.mutex.Unlock()
+
+	reporter.reports += 1
+	reporter.count += count
+
+	if reporter.pending {
+		return
+	}
+	reporter.pending = true
+
+	time.AfterFunc(window, func() {
+
+		reporter.mutex.Lock()
+		reports := reporter.reports
+		count := reporter.count
+		reporter.pending = false
+		reporter.reports = 0
+		reporter.count = 0
+		reporter.mutex.Unlock()
+
+		if reports > 1 {
+			NoticeNewServerEntriesReportsCoalesced(reports, count)
+		}
+
+		config.OnNewServerEntries(count)
+	})
+}
+
+// countStoredServerEntriesInRegion returns the number of stored server
+// entries in the specified region or, when region is blank, in any region.
+func countStoredServerEntriesInRegion(region string) (int, error) {
+
+	count := 0
+	err := scanServerEntries(func(serverEntry *protocol.ServerEntry) {
+		if region == "" || serverEntry.Region == region {
+			count += 1
+		}
+	})
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	return count, nil
+}
+
+// sortOSLFileSpecsBySeedTime sorts OSL file specs into descending seed
+// timestamp order, most recently seeded first, otherwise preserving the
+// existing download order. OSL file specs without a valid seed timestamp
+// follow those with one. When prioritized is set, the descending priority
+// order is retained and OSL file specs are sorted within each priority.
+func sortOSLFileSpecsBySeedTime(oslFileSpecs []*osl.OSLFileSpec, prioritized bool) {
+
+	seedTimes := make(map[*osl.OSLFileSpec]time.Time)
+	for _, oslFileSpec := range oslFileSpecs {
+		seedTime, err := time.Parse(time.RFC3339, oslFileSpec.SeedTimestamp)
+		if err == nil {
+			seedTimes[oslFileSpec] = seedTime
+		}
+	}
+
+	sort.SliceStable(oslFileSpecs, func(i, j int) bool {
+		a, b := oslFileSpecs[i], oslFileSpecs[j]
+		if prioritized && a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return seedTimes[a].After(seedTimes[b])
+	})
+}
+
+// sortOSLFileSpecsForRegion moves OSL file specs with a region hint matching
+// region to the front, otherwise preserving the existing download order.
+// When no OSL file specs have region hints, the order is unchanged.
+func sortOSLFileSpecsForRegion(oslFileSpecs []*osl.OSLFileSpec, region string) {
+	sort.SliceStable(oslFileSpecs, func(i, j int) bool {
+		return common.Contains(oslFileSpecs[i].Regions, region) &&
+			!common.Contains(oslFileSpecs[j].Regions, region)
+	})
+}
+
+// openOSLRegistry opens and authenticates the specified OSL registry file,
+// returning the open file and a streamer for reading OSL file specs from it.
+// The caller must close the file.
+// getOSLFilename returns the download filename for the specified OSL. When
+// Config.OSLFilenameEncoder is set, the encoded name is validated. Otherwise,
+// when ObfuscatedServerListSubdirectoryLength is set, the OSL file is placed
+// in a subdirectory named by a prefix of the OSL ID hex. Any subdirectory is
+// created.
+func getOSLFilename(config *Config, oslID []byte) (string, error) {
+
+	var filename string
+
+	if config.OSLFilenameEncoder != nil {
+
+		encodedName := config.OSLFilenameEncoder(oslID)
+		name := filepath.Clean(filepath.FromSlash(encodedName))
+
+		topLevelName := strings.SplitN(name, string(filepath.Separator), 2)[0]
+
+		if encodedName == "" ||
+			filepath.IsAbs(name) ||
+			topLevelName == "." ||
+			topLevelName == ".." ||
+			topLevelName == OBFUSCATED_SERVER_LIST_QUARANTINE_DIRECTORY ||
+			topLevelName == OBFUSCATED_SERVER_LIST_DRY_RUN_DIRECTORY ||
+			strings.HasPrefix(topLevelName, osl.REGISTRY_FILENAME) {
+
+			return "", common.ContextError(
+				fmt.Errorf("invalid OSL filename: %s", encodedName))
+		}
+
+		filename = filepath.Join(config.ObfuscatedServerListDownloadDirectory, name)
+
+	} else {
+
+		subdirectoryLength := config.clientParameters.Get().Int(
+			parameters.ObfuscatedServerListSubdirectoryLength)
+		if subdirectoryLength <= 0 {
+			return osl.GetOSLFilename(config.ObfuscatedServerListDownloadDirectory, oslID), nil
+		}
+
+		filename = getOSLSubdirectoryFilename(
+			config.ObfuscatedServerListDownloadDirectory, oslID, subdirectoryLength)
+	}
+
+	err := os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	return filename, nil
+}
+
+// getOSLSubdirectoryFilename returns the download filename for the specified
+// OSL in the subdirectory named by the first subdirectoryLength characters of
+// the OSL ID hex.
+func getOSLSubdirectoryFilename(
+	directory string, oslID []byte, subdirectoryLength int) string {
+
+	hexID := hex.EncodeToString(oslID)
+	if subdirectoryLength > len(hexID) {
+		subdirectoryLength = len(hexID)
+	}
+	return osl.GetOSLFilename(filepath.Join(directory, hexID[:subdirectoryLength]), oslID)
+}
+
+// oslDownloadFilesMigrations records the OSL download directories, and
+// subdirectory lengths, for which migrateOSLDownloadFiles has completed in
+// this process.
+var oslDownloadFilesMigrations = struct {
+	mutex    sync.Mutex
+	migrated map[string]bool
+}{migrated: make(map[string]bool)}
+
+// migrateOSLDownloadFiles moves OSL download files, including partial
+// downloads, from the flat download directory layout into the subdirectories
+// used when ObfuscatedServerListSubdirectoryLength is set, so that existing
+// OSL files and partial downloads aren't downloaded again. Migration is
+// performed on the first fetch in a process, and is retried by subsequent
+// fetches when any file fails to migrate. Files are not migrated back when
+// subdirectories are disabled, or between subdirectory lengths.
+func migrateOSLDownloadFiles(config *Config) {
+
+	subdirectoryLength := config.clientParameters.Get().Int(
+		parameters.ObfuscatedServerListSubdirectoryLength)
+	if config.OSLFilenameEncoder != nil ||
+		subdirectoryLength <= 0 ||
+		config.ObfuscatedServerListDownloadDirectory == "" {
+
+		return
+	}
+
+	directory := config.ObfuscatedServerListDownloadDirectory
+	migrationKey := fmt.Sprintf("%s:%d", directory, subdirectoryLength)
+
+	oslDownloadFilesMigrations.mutex.Lock()
+	defer oslDownloadFilesMigrations.mutex.Unlock()
+
+	if oslDownloadFilesMigrations.migrated[migrationKey] {
+		return
+	}
+
+	fileInfos, err := ioutil.ReadDir(directory)
+	if err != nil && !os.IsNotExist(err) {
+		noticeRemoteServerListAlert(config, "failed to read obfuscated server list directory: %s", common.ContextError(err))
+		return
+	}
+
+	prefix := strings.TrimSuffix(osl.OSL_FILENAME_FORMAT, "%s")
+
+	failed := false
+	migratedCount := 0
+
+	for _, fileInfo := range fileInfos {
+
+		if fileInfo.IsDir() || !strings.HasPrefix(fileInfo.Name(), prefix) {
+			continue
+		}
+
+		// Partial downloads are migrated along with their ETags, so that
+		// the downloads are resumed.
+
+		hexID := strings.TrimPrefix(fileInfo.Name(), prefix)
+		suffix := ""
+		for _, partialSuffix := range []string{".part.etag", ".part"} {
+			if strings.HasSuffix(hexID, partialSuffix) {
+				hexID = strings.TrimSuffix(hexID, partialSuffix)
+				suffix = partialSuffix
+				break
+			}
+		}
+
+		// Skip files, such as the registry, which aren't named by an OSL ID.
+		oslID, err := hex.DecodeString(hexID)
+		if err != nil || len(oslID) == 0 {
+			continue
+		}
+
+		filename := getOSLSubdirectoryFilename(
+			directory, oslID, subdirectoryLength) + suffix
+
+		err = os.MkdirAll(filepath.Dir(filename), 0700)
+		if err == nil {
+			err = os.Rename(filepath.Join(directory, fileInfo.Name()), filename)
+		}
+		if err != nil {
+			failed = true
+			noticeRemoteServerListAlert(config, "failed to migrate obfuscated server list file (%s): %s", fileInfo.Name(), common.ContextError(err))
+			continue
+		}
+
+		migratedCount += 1
+	}
+
+	if migratedCount > 0 {
+		noticeRemoteServerListInfo(config, "migrated %d obfuscated server list files to subdirectories", migratedCount)
+	}
+
+	if !failed {
+		oslDownloadFilesMigrations.migrated[migrationKey] = true
+	}
+}
+
+// readOSLRegistryDelta reads and authenticates the registry delta in the
+// specified file.
+func readOSLRegistryDelta(
+	config *Config, deltaFilename string, publicKey string) (*osl.RegistryDelta, error) {
+
+	file, err := openDownloadFile(deltaFilename, config.oslFileEncryptionKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	defer file.Close()
+
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	delta, err := osl.ReadRegistryDelta(content, publicKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return delta, nil
+}
+
+// loadOSLRegistryDelta reads the stored registry delta, if any, for a
+// cached registry. When no delta is stored, the returned delta is nil.
+func loadOSLRegistryDelta(
+	config *Config, deltaFilename string, publicKey string) (*osl.RegistryDelta, error) {
+
+	_, err := os.Stat(deltaFilename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return readOSLRegistryDelta(config, deltaFilename, publicKey)
+}
+
+// getOSLRegistryBaseETag returns the ETag of the cached registry. When a
+// delta is stored, the persisted ETag is the ETag of the delta response,
+// and the cached registry ETag is the delta BaseETag.
+func getOSLRegistryBaseETag(
+	config *Config,
+	canonicalURL string,
+	deltaFilename string,
+	publicKey string) (string, error) {
+
+	delta, err := loadOSLRegistryDelta(config, deltaFilename, publicKey)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+	if delta != nil {
+		return delta.BaseETag, nil
+	}
+
+	ETag, err := config.getServerListStore().GetUrlETag(canonicalURL)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	return ETag, nil
+}
+
+// storeOSLRegistryDelta stores the accepted registry delta, downloaded to
+// downloadFilename, as the delta for the cached registry, along with the
+// delta response ETag, and stores the progress of applying the delta. The
+// returned progress is nil when the delta has no file specs to apply.
+func storeOSLRegistryDelta(
+	config *Config,
+	canonicalURL string,
+	downloadFilename string,
+	deltaFilename string,
+	ETag string,
+	delta *osl.RegistryDelta) (*oslRegistryDeltaProgress, error) {
+
+	err := os.Rename(downloadFilename, deltaFilename)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// The progress is stored before the ETag. Progress which doesn't match
+	// the stored ETag, as when the ETag fails to be stored, isn't resumed.
+
+	var progress *oslRegistryDeltaProgress
+	if len(delta.FileSpecs) > 0 {
+		remainingIDs := make([][]byte, len(delta.FileSpecs))
+		for i, fileSpec := range delta.FileSpecs {
+			remainingIDs[i] = fileSpec.ID
+		}
+		err = setOSLRegistryDeltaProgress(canonicalURL, ETag, remainingIDs)
+		if err == nil {
+			progress, err = getOSLRegistryDeltaProgress(canonicalURL)
+		}
+	} else {
+		err = deleteOSLRegistryDeltaProgress(canonicalURL)
+	}
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to set obfuscated server list registry delta progress: %s", common.ContextError(err))
+		progress = nil
+	}
+
+	err = setValidatedUrlETag(config, canonicalURL, ETag)
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to set ETag for obfuscated server list registry: %s", common.ContextError(err))
+	}
+
+	return progress, nil
+}
+
+// getResumableOSLRegistryDeltaProgress returns the stored progress of
+// applying the stored registry delta, when that progress remains to be
+// resumed. Progress for a delta which is no longer stored is deleted, and
+// nil is returned.
+func getResumableOSLRegistryDeltaProgress(
+	config *Config, canonicalURL string, deltaFilename string) (*oslRegistryDeltaProgress, error) {
+
+	progress, err := getOSLRegistryDeltaProgress(canonicalURL)
+	if err != nil || progress == nil {
+		return nil, err
+	}
+
+	ETag, err := config.getServerListStore().GetUrlETag(canonicalURL)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	_, err = os.Stat(deltaFilename)
+	if err == nil && ETag == progress.ETag {
+		return progress, nil
+	}
+
+	err = deleteOSLRegistryDeltaProgress(canonicalURL)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return nil, nil
+}
+
+// openOSLRegistry opens and authenticates the registry in the specified
+// file. An osl.SLOKSchemeVersionError is returned unwrapped.
+func openOSLRegistry(
+	config *Config,
+	registryFilename string,
+	publicKey string,
+	lookupSLOKs func(slokID []byte) []byte) (*downloadFile, *osl.RegistryStreamer, error) {
+
+	registryFile, err := openDownloadFile(registryFilename, config.oslFileEncryptionKey)
+	if err != nil {
+		return nil, nil, common.ContextError(err)
+	}
+
+	registryStreamer, err := osl.NewRegistryStreamer(
+		registryFile,
+		publicKey,
+		lookupSLOKs)
+	if _, ok := err.(osl.SLOKSchemeVersionError); ok {
+		registryFile.Close()
+		return nil, nil, err
+	}
+	if err != nil {
+		registryFile.Close()
+		return nil, nil, common.ContextError(err)
+	}
+
+	return registryFile, registryStreamer, nil
+}
+
+// isObfuscatedServerListQuarantined checks if the specified OSL is currently
+// quarantined. When the quarantine period has elapsed, the quarantine record
+// is cleared and the OSL is again eligible for download.
+func isObfuscatedServerListQuarantined(config *Config, oslID []byte) (bool, error) {
+
+	record, err := getOSLQuarantineRecord(oslID)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	if record == nil || record.QuarantinedUntil.IsZero() {
+		return false, nil
+	}
+
+	if config.now().Before(record.QuarantinedUntil) {
+		return true, nil
+	}
+
+	err = deleteOSLQuarantineRecord(oslID)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	return false, nil
+}
+
+// discardCorruptRemoteServerListFile deletes a resumed remote server list
+// download which failed validation, along with the stored ETag for
+// canonicalURL. The resumed download may have appended onto a truncated or
+// corrupt partial download, and the completed file can't be repaired. With
+// no file and no ETag, the next fetch makes an unconditional request and
+// downloads the resource from the beginning.
+func discardCorruptRemoteServerListFile(
+	config *Config, url, canonicalURL, filename string, validationErr error) {
+
+	if config.emitRemoteServerListNotice(noticeSeverityAlert) {
+		NoticeRemoteServerListResourceCorrupt(url, validationErr)
+	}
+
+	err := os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		noticeRemoteServerListAlert(config, "failed to delete corrupt remote server list file: %s", common.ContextError(err))
+	}
+
+	err = config.getServerListStore().SetUrlETag(canonicalURL, "")
+	if err != nil {
+		noticeRemoteServerListAlert(config, "failed to clear ETag for corrupt remote server list file: %s", common.ContextError(err))
+	}
+}
+
+// recordObfuscatedServerListFailure records a validation failure, such as a
+// signature check failure, for the specified OSL. Once the OSL has failed
+// ObfuscatedServerListQuarantineThreshold consecutive times, the downloaded
+// file is moved to the quarantine subdirectory and the OSL is not downloaded
+// again for ObfuscatedServerListQuarantinePeriod. Without quarantine, a bad
+// OSL file is downloaded and rejected on every fetch.
+func recordObfuscatedServerListFailure(
+	config *Config, oslID []byte, downloadFilename string) error {
+
+	p := config.clientParameters.Get()
+	threshold := p.Int(parameters.ObfuscatedServerListQuarantineThreshold)
+	period := p.Duration(parameters.ObfuscatedServerListQuarantinePeriod)
+	p = nil
+
+	record, err := getOSLQuarantineRecord(oslID)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	if record == nil {
+		record = &oslQuarantineRecord{}
+	}
+
+	record.Failures += 1
+
+	if record.Failures >= threshold {
+
+		quarantineDirectory := filepath.Join(
+			config.ObfuscatedServerListDownloadDirectory,
+			OBFUSCATED_SERVER_LIST_QUARANTINE_DIRECTORY)
+
+		err := os.MkdirAll(quarantineDirectory, 0700)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		// The quarantined file is retained for diagnostics. Any previously
+		// quarantined copy is replaced. The quarantined file is always named
+		// by OSL ID, as names from Config.OSLFilenameEncoder may only be
+		// distinct including their subdirectories.
+		err = os.Rename(
+			downloadFilename,
+			filepath.Join(
+				quarantineDirectory,
+				fmt.Sprintf(osl.OSL_FILENAME_FORMAT, hex.EncodeToString(oslID))))
+		if err != nil && !os.IsNotExist(err) {
+			return common.ContextError(err)
+		}
+
+		record.QuarantinedUntil = config.now().Add(period)
+
+		if config.emitRemoteServerListNotice(noticeSeverityAlert) {
+			NoticeObfuscatedServerListQuarantined(
+				hex.EncodeToString(oslID), record.Failures, record.QuarantinedUntil)
+		}
+	}
+
+	err = setOSLQuarantineRecord(oslID, record)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// remoteServerListDownloadOptions are the optional behaviors of
+// downloadRemoteServerListFile. The zero value is a plain download.
+type remoteServerListDownloadOptions struct {
+
+	// When measureRatio is set, the resource is a compressed, unencrypted
+	// authenticated package and the ratio of its decompressed to compressed
+	// size is measured and recorded in the remote server list stat. Ratios
+	// beyond parameters.RemoteServerListMaxDecompressionRatio are flagged.
+	// OSL files are encrypted and are not measured.
+	measureRatio bool
+
+	// When mirrorHealth is not nil, the latency or failure of the download
+	// is recorded for sourceURL, for weighted mirror selection. Downloads
+	// skipped due to ETags or the downloadCache aren't recorded.
+	mirrorHealth *downloadMirrorHealth
+
+	// When registryDelta is not nil, the request advertises support for OSL
+	// registry deltas, and registryDelta records whether the response is a
+	// delta.
+	registryDelta *registryDeltaDownload
+
+	// When conditionalRequest is not nil, it records the If-None-Match ETag
+	// and response status code of the download request. Nothing is recorded
+	// when no request is sent.
+	conditionalRequest *downloadConditionalRequest
+
+	// When downloadCache is not nil and the resource was already downloaded
+	// in the same coordinated fetch run, the earlier download is copied to
+	// the destination file instead of downloading the resource again.
+	downloadCache *remoteServerListDownloadCache
+
+	// When telemetry is not nil, the download request is recorded in the
+	// fetch telemetry run.
+	telemetry *fetchTelemetryRecorder
+
+	// When dryRun is set, as for FetchCommonRemoteServerListDryRun, any
+	// stored ETag is ignored, so the resource is always downloaded in full,
+	// and no next fetch time, remote server list stat, mirror health, or
+	// fetch telemetry is recorded. The response ETag, which may be blank, is
+	// returned.
+	dryRun bool
+}
+
+// downloadRemoteServerListFile downloads the source URL to
+// the destination file, performing a resumable download. When
+// the download completes and the file content has changed, the
+// new resource ETag is returned. Otherwise, blank is returned.
+// The number of bytes downloaded is also returned, including
+// for a failed or unchanged download.
+// The caller is responsible for calling setValidatedUrlETag once the
+// file content has been validated.
+//
+// When parameters.RemoteServerListRevalidateInterval is set and the
+// resource was last validated longer ago than that interval, any stored
+// ETag is ignored and the resource is downloaded in full, so that the
+// caller validates it again.
+//
+// When parameters.RemoteServerListHonorCacheControl is set, the time at
+// which the response max-age elapses is stored along with the response
+// ETag, and the resource isn't requested again until then, as long as the
+// stored ETag is unchanged.
+//
+// When the response has no ETag and
+// parameters.RemoteServerListHashMissingETags is set, an ETag is derived
+// from the downloaded content, in the same MD5 hex format assumed for OSL
+// file ETags, so that changed and unchanged content is distinguished as
+// with host ETags. Otherwise, an ETag-less response is reported as
+// unchanged, matching the blank stored ETag of a resource that has never
+// been validated.
+//
+// The optional behaviors of the download are set in options; see
+// remoteServerListDownloadOptions.
+func downloadRemoteServerListFile(
+	ctx context.Context,
+	config *Config,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	downloadTimeout time.Duration,
+	sourceURL string,
+	canonicalURL string,
+	skipVerify bool,
+	fallbackEndpoints []string,
+	tlsConfig *parameters.DownloadTLSConfig,
+	sourceETag string,
+	destinationFilename string,
+	encryptionKey *downloadFileKey,
+	options remoteServerListDownloadOptions) (string, int64, error) {
+
+	// All download URLs with the same canonicalURL
+	// must have the same entity and ETag.
+	var lastETag string
+	var err error
+	if !options.dryRun {
+		lastETag, err = config.getServerListStore().GetUrlETag(canonicalURL)
+		if err != nil {
+			return "", 0, common.ContextError(err)
+		}
+	}
+
+	p := config.clientParameters.Get()
+	revalidateInterval := p.Duration(parameters.RemoteServerListRevalidateInterval)
+	hashMissingETags := p.Bool(parameters.RemoteServerListHashMissingETags)
+	honorCacheControl := p.Bool(parameters.RemoteServerListHonorCacheControl)
+	maxCacheControlAge := p.Duration(parameters.RemoteServerListMaxCacheControlAge)
+	p = nil
+
+	if lastETag != "" && revalidateInterval > 0 {
+		validatedTime, err := GetUrlValidatedTime(canonicalURL)
+		if err != nil {
+			return "", 0, common.ContextError(err)
+		}
+		if config.now().Sub(validatedTime) > revalidateInterval {
+			noticeRemoteServerListInfo(config, "revalidating remote server list resource: %s", canonicalURL)
+			lastETag = ""
+		}
+	}
+
+	// When Cache-Control is honored, a resource that is still fresh, per the
+	// max-age of the response with the current ETag, isn't requested again.
+	if lastETag != "" && honorCacheControl {
+		etag, nextFetchTime, err := GetUrlNextFetchTime(canonicalURL)
+		if err != nil {
+			return "", 0, common.ContextError(err)
+		}
+		if etag == lastETag && config.now().Before(nextFetchTime) {
+			noticeRemoteServerListInfo(config, "skipping fresh remote server list resource until %s: %s",
+				nextFetchTime.Format(time.RFC3339), canonicalURL)
+			recordRemoteServerListETagSkip(config, sourceURL)
+			return "", 0, nil
+		}
+	}
+
+	// sourceETag, when specified, is prior knowledge of the
+	// remote ETag that can be used to skip the request entirely.
+	// This will be set in the case of OSL files, from the MD5Sum
+	// values stored in the registry.
+	if lastETag != "" && sourceETag == lastETag {
+		recordRemoteServerListETagSkip(config, sourceURL)
+		return "", 0, nil
+	}
+
+	if options.downloadCache != nil {
+		cachedETag, cachedFilename, ok := options.downloadCache.get(canonicalURL, sourceETag)
+		if ok {
+
+			// The earlier download was already validated and its ETag stored.
+			if cachedETag == lastETag {
+				recordRemoteServerListETagSkip(config, sourceURL)
+				return "", 0, nil
+			}
+
+			if cachedFilename != destinationFilename {
+				err := copyRemoteServerListFile(cachedFilename, destinationFilename)
+				if err != nil {
+					return "", 0, common.ContextError(err)
+				}
+			}
+
+			noticeRemoteServerListInfo(config, "reusing remote server list resource downloaded in this fetch: %s", sourceURL)
+
+			return cachedETag, 0, nil
+		}
+	}
+
+	// A download requiring a tunnel isn't attempted untunneled, or through
+	// a closed tunnel; see RemoteServerListRequireTunnel.
+	err = checkTunnelRequired(config, tunnel, sourceURL)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// The app may veto an untunneled download; see
+	// Config.OnUntunneledDownload.
+	if tunnel == nil {
+		err := checkUntunneledDownload(config, sourceURL)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	// A download failure due to the caller canceling fetchCtx isn't counted
+	// against the mirror's health.
+	fetchCtx := ctx
+
+	p = config.clientParameters.Get()
+	minimumRate := p.Int(parameters.FetchRemoteServerListMinimumRate)
+	rateWindow := p.Duration(parameters.FetchRemoteServerListRateWindow)
+	connectTimeout := p.Duration(parameters.RemoteServerListConnectTimeout)
+	verifyResumeDigest := p.Bool(parameters.RemoteServerListResumeVerifyDigest)
+	nonResumableThreshold := p.Int(parameters.RemoteServerListNonResumableThreshold)
+	progressInterval := p.Duration(parameters.RemoteServerListDownloadProgressInterval)
+	p = nil
+
+	var nonResumableOrigins *downloadNonResumableOrigins
+	if nonResumableThreshold > 0 {
+		nonResumableOrigins = remoteServerListNonResumableOrigins
+	}
+
+	// With a minimum rate, the static downloadTimeout only bounds the time
+	// before the download first reaches that rate; see downloadRateMonitor.
+
+	var cancelFunc context.CancelFunc
+	var rateMonitor *downloadRateMonitor
+	if minimumRate > 0 {
+		ctx, cancelFunc = context.WithCancel(ctx)
+		rateMonitor = newDownloadRateMonitor(
+			downloadTimeout, rateWindow, minimumRate)
+		go rateMonitor.run(ctx, cancelFunc)
+	} else {
+		ctx, cancelFunc = context.WithTimeout(ctx, downloadTimeout)
+	}
+	defer cancelFunc()
+
+	// Tunneled downloads use the tunnel's shared HTTP client, so that
+	// concurrent fetches share a connection pool. Untunneled downloads use a
+	// new HTTP client, which dials with the download context. Tunneled
+	// downloads from a URL with its own TLS config also use a new HTTP
+	// client, as the shared client's connections have the default TLS
+	// settings.
+
+	sharedClient := tunnel != nil && tlsConfig == nil
+
+	var httpClient *http.Client
+	if sharedClient {
+		httpClient, err = tunnel.getRemoteServerListHTTPClient(skipVerify)
+	} else {
+		httpClient, err = makeDownloadHTTPClient(
+			ctx,
+			config,
+			tunnel,
+			untunneledDialConfig,
+			skipVerify,
+			tlsConfig)
+		if err == nil && tunnel != nil {
+			if transport, ok := httpClient.Transport.(*http.Transport); ok {
+				defer transport.CloseIdleConnections()
+			}
+		}
+	}
+	if err != nil {
+		return "", 0, common.ContextError(err)
+	}
+
+	// The shared tunneled client has the connect timeout applied when it's
+	// created; see Tunnel.getRemoteServerListHTTPClient.
+	if !sharedClient && connectTimeout > 0 {
+		setDownloadConnectTimeout(httpClient, connectTimeout)
+	}
+
+	var tlsParameters *downloadTLSParameters
+	if tunnel == nil {
+		tlsParameters = &downloadTLSParameters{}
+		tlsParameters.wrapHTTPClient(httpClient)
+	}
+
+	// Fallback endpoints are tried within the single request made by the
+	// wrapped clients below, so only the outcome of the successful endpoint
+	// is observed by those clients.
+	var fallbackEndpoint *downloadFallbackEndpoint
+	if len(fallbackEndpoints) > 0 {
+		fallbackEndpoint = &downloadFallbackEndpoint{endpoints: fallbackEndpoints}
+		httpClient = fallbackEndpoint.wrapHTTPClient(httpClient)
+	}
+
+	httpProtocol := &downloadHTTPProtocol{}
+	httpClient = httpProtocol.wrapHTTPClient(httpClient)
+
+	legalBlock := &downloadLegalBlock{}
+	httpClient = legalBlock.wrapHTTPClient(httpClient)
+
+	if options.registryDelta != nil {
+		httpClient = options.registryDelta.wrapHTTPClient(httpClient)
+	}
+
+	if options.conditionalRequest != nil {
+		httpClient = options.conditionalRequest.wrapHTTPClient(httpClient)
+	}
+
+	var cacheControl *downloadCacheControl
+	if honorCacheControl {
+		cacheControl = &downloadCacheControl{}
+		httpClient = cacheControl.wrapHTTPClient(httpClient)
+	}
+
+	if rateMonitor != nil {
+		httpClient = rateMonitor.wrapHTTPClient(httpClient)
+	}
+
+	if progressInterval > 0 && config.emitRemoteServerListNotice(noticeSeverityInfo) {
+		progress := &downloadProgress{url: sourceURL, interval: progressInterval}
+		httpClient = progress.wrapHTTPClient(httpClient)
+	}
+
+	// The mirror latency is the time to the first response byte, which
+	// includes connection establishment and the request round trip, but not
+	// the transfer time, which depends on the resource size.
+
+	downloadCtx := ctx
+	var firstByteTime time.Time
+	if options.mirrorHealth != nil {
+		downloadCtx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotFirstResponseByte: func() {
+				if firstByteTime.IsZero() {
+					firstByteTime = time.Now()
+				}
+			},
+		})
+	}
+
+	startTime := time.Now()
+
+	var savedBytes int64
+
+	n, responseETag, err := resumeDownload(
+		downloadCtx,
+		httpClient,
+		sourceURL,
+		MakePsiphonUserAgent(config),
+		destinationFilename,
+		lastETag,
+		&savedBytes,
+		encryptionKey,
+		verifyResumeDigest,
+		nonResumableOrigins,
+		nonResumableThreshold)
+
+	// Saved bytes are recorded even when the resumed download fails, as
+	// the resumed request still didn't download those bytes again.
+	if savedBytes > 0 {
+		atomic.AddInt64(&remoteServerListResumeSavedBytes, savedBytes)
+	}
+
+	// A dry run leaves the mirror health and fetch telemetry unchanged.
+
+	if !options.dryRun {
+		options.telemetry.recordDownload(sourceURL, n, err != nil)
+	}
+
+	if options.mirrorHealth != nil && !options.dryRun && fetchCtx.Err() == nil {
+		latency := time.Since(startTime)
+		if !firstByteTime.IsZero() {
+			latency = firstByteTime.Sub(startTime)
+		}
+		options.mirrorHealth.record(sourceURL, latency, err != nil)
+	}
+
+	if config.emitRemoteServerListNotice(noticeSeverityInfo) {
+		NoticeRemoteServerListResourceDownloadedBytes(sourceURL, n)
+	}
+
+	// The TLS parameters and HTTP version are reported even when the
+	// download fails, as a failure following a downgraded handshake or a
+	// protocol fallback is of diagnostic interest.
+
+	tlsVersion, tlsCipherSuite := "", ""
+	if tlsParameters != nil {
+		tlsVersion, tlsCipherSuite = tlsParameters.get()
+		if tlsVersion != "" && config.emitRemoteServerListNotice(noticeSeverityInfo) {
+			NoticeUntunneledDownloadTLSParameters(sourceURL, tlsVersion, tlsCipherSuite)
+		}
+	}
+
+	if fallbackEndpoint != nil {
+		if endpoint := fallbackEndpoint.get(); endpoint != "" &&
+			config.emitRemoteServerListNotice(noticeSeverityInfo) {
+
+			NoticeRemoteServerListDownloadFallbackEndpoint(sourceURL, endpoint)
+		}
+	}
+
+	if protocol := httpProtocol.get(); protocol != "" &&
+		config.emitRemoteServerListNotice(noticeSeverityInfo) {
+
+		fallback := tlsParameters != nil && tlsParameters.isHTTP2Fallback()
+		NoticeRemoteServerListDownloadHTTPProtocol(sourceURL, protocol, fallback)
+	}
+
+	if err != nil {
+		if rateMonitor != nil {
+			if abortErr := rateMonitor.abortError(); abortErr != nil {
+				err = abortErr
+			}
+		}
+		if legalBlock.get() {
+			return "", n, LegalBlockError{URL: sourceURL}
+		}
+		return "", n, common.ContextError(err)
+	}
+
+	if tunnel == nil {
+		err = checkUntunneledDownloadEgressRegion(config, sourceURL)
+		if err != nil {
+			return "", n, common.ContextError(err)
+		}
+	}
+
+	if responseETag == "" && hashMissingETags {
+		responseETag, err = makeContentETag(destinationFilename, encryptionKey)
+		if err != nil {
+			return "", n, common.ContextError(err)
+		}
+	}
+
+	// The next fetch time is stored along with the response ETag, so that
+	// a changed resource which then fails validation is still fetched again.
+	if cacheControl != nil && !options.dryRun {
+		var nextFetchTime time.Time
+		maxAge, ok := cacheControl.maxAge()
+		if ok {
+			if maxAge > maxCacheControlAge {
+				maxAge = maxCacheControlAge
+			}
+			nextFetchTime = config.now().Add(maxAge)
+		}
+		err = SetUrlNextFetchTime(canonicalURL, responseETag, nextFetchTime)
+		if err != nil {
+			// Not fatal: the resource is requested again on the next fetch.
+			noticeRemoteServerListAlert(config, "failed to set next fetch time (%s): %s", canonicalURL, common.ContextError(err))
+		}
+	}
+
+	if options.dryRun {
+		return responseETag, n, nil
+	}
+
+	if responseETag == lastETag {
+		recordRemoteServerListETagSkip(config, sourceURL)
+		return "", n, nil
+	}
+
+	if config.emitRemoteServerListNotice(noticeSeverityInfo) {
+		NoticeRemoteServerListResourceDownloaded(sourceURL)
+	}
+
+	decompressionRatio := 0.0
+	decompressionRatioExceeded := false
+	if options.measureRatio {
+		decompressionRatio, decompressionRatioExceeded, err = measureDecompressionRatio(
+			config, destinationFilename, encryptionKey)
+		if err != nil {
+			// Not fatal: a package which can't be decompressed will fail
+			// validation when imported.
+			noticeRemoteServerListAlert(config, "failed to measure decompression ratio (%s): %s", sourceURL, common.ContextError(err))
+		}
+		if decompressionRatioExceeded && config.emitRemoteServerListNotice(noticeSeverityAlert) {
+			p := config.clientParameters.Get()
+			maxRatio := p.Float(parameters.RemoteServerListMaxDecompressionRatio)
+			p = nil
+			NoticeRemoteServerListDecompressionRatioExceeded(sourceURL, decompressionRatio, maxRatio)
+		}
+	}
+
+	RecordRemoteServerListStat(
+		sourceURL,
+		responseETag,
+		decompressionRatio,
+		decompressionRatioExceeded,
+		tlsVersion,
+		tlsCipherSuite)
+
+	if options.downloadCache != nil {
+		options.downloadCache.set(canonicalURL, responseETag, destinationFilename)
+	}
+
+	return responseETag, n, nil
+}
+
+// checkUntunneledDownloadEgressRegion applies the egress region policy to a
+// completed untunneled download from sourceURL. When the egress region
+// reported by config.UntunneledDownloadEgressRegionChecker is not one of
+// config.UntunneledDownloadAllowedEgressRegions, a notice is emitted and,
+// when config.EnforceUntunneledDownloadEgressRegions is set, an error is
+// returned so that the downloaded resource isn't imported. When enforced,
+// a failed egress region check is also an error.
+func checkUntunneledDownloadEgressRegion(config *Config, sourceURL string) error {
+
+	if config.UntunneledDownloadEgressRegionChecker == nil ||
+		len(config.UntunneledDownloadAllowedEgressRegions) == 0 {
+		return nil
+	}
+
+	enforce := config.EnforceUntunneledDownloadEgressRegions
+
+	region, err := config.UntunneledDownloadEgressRegionChecker()
+	if err != nil {
+		if enforce {
+			return common.ContextError(
+				fmt.Errorf("egress region check failed: %s", err))
+		}
+		noticeRemoteServerListAlert(config, "egress region check failed: %s", common.ContextError(err))
+		return nil
+	}
+
+	if common.Contains(config.UntunneledDownloadAllowedEgressRegions, region) {
+		return nil
+	}
+
+	if config.emitRemoteServerListNotice(noticeSeverityAlert) {
+		NoticeUntunneledDownloadEgressRegionViolation(sourceURL, region, enforce)
+	}
+
+	if enforce {
+		return common.ContextError(
+			fmt.Errorf("egress region not allowed: %s", region))
+	}
+
+	return nil
+}
+
+// setDownloadConnectTimeout applies a time limit, RemoteServerListConnectTimeout,
+// to establishing each connection of the download HTTP client: the dial
+// and, for HTTPS, the TLS handshake. Once a connection is established, the
+// response may take as long as the whole download time limit allows. It must
+// be called before the HTTP client is used.
+//
+// A dial which exceeds the time limit is abandoned, and any connection it
+// later returns is closed. The abandoned dial is interrupted when the
+// download context is canceled or, for tunneled dials, when the port forward
+// dial completes.
+func setDownloadConnectTimeout(httpClient *http.Client, timeout time.Duration) {
+
+	transport, ok := httpClient.Transport.(*http.Transport)
+	if !ok {
+		return
+	}
+
+	if transport.Dial != nil {
+		transport.Dial = makeDownloadConnectTimeoutDial(transport.Dial, timeout)
+	}
+	if transport.DialTLS != nil {
+		transport.DialTLS = makeDownloadConnectTimeoutDial(transport.DialTLS, timeout)
+	} else {
+		// With no DialTLS, the transport performs any TLS handshake itself.
+		transport.TLSHandshakeTimeout = timeout
+	}
+}
+
+func makeDownloadConnectTimeoutDial(
+	dial func(network, addr string) (net.Conn, error),
+	timeout time.Duration) func(network, addr string) (net.Conn, error) {
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	return func(network, addr string) (net.Conn, error) {
+
+		resultChannel := make(chan dialResult, 1)
+		go func() {
+			conn, err := dial(network, addr)
+			resultChannel <- dialResult{conn: conn, err: err}
+		}()
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case result := <-resultChannel:
+			return result.conn, result.err
+		case <-timer.C:
+			go func() {
+				result := <-resultChannel
+				if result.conn != nil {
+					result.conn.Close()
+				}
+			}()
+			return nil, common.ContextError(
+				fmt.Errorf("connect timeout after %s: %s", timeout, addr))
+		}
+	}
+}
+
+// downloadTLSParameters records the negotiated TLS version and cipher suite
+// of the connection dialed by an untunneled download HTTP client, along with
+// whether HTTP/2 was offered and which application protocol was negotiated
+// with ALPN. Each untunneled download uses a new HTTP client, so the most
+// recently dialed connection is the download connection. Plain HTTP
+// downloads record nothing.
+type downloadTLSParameters struct {
+	mutex               sync.Mutex
+	version             string
+	cipherSuite         string
+	offeredHTTP2        bool
+	applicationProtocol string
+}
+
+// wrapHTTPClient wraps the TLS dialer of the HTTP client transport. It must
+// be called before the HTTP client is used.
+func (params *downloadTLSParameters) wrapHTTPClient(httpClient *http.Client) {
+
+	transport, ok := httpClient.Transport.(*http.Transport)
+	if !ok || transport.DialTLS == nil {
+		return
+	}
+
+	dialTLS := transport.DialTLS
+	transport.DialTLS = func(network, addr string) (net.Conn, error) {
+		conn, err := dialTLS(network, addr)
+		if err == nil {
+			version, cipherSuite, ok := GetTLSConnVersionAndCipherSuite(conn)
+			if ok {
+				offered, negotiated, _ := GetTLSConnApplicationProtocols(conn)
+				params.mutex.Lock()
+				params.version = version
+				params.cipherSuite = cipherSuite
+				params.offeredHTTP2 = common.Contains(offered, "h2")
+				params.applicationProtocol = negotiated
+				params.mutex.Unlock()
+			}
+		}
+		return conn, err
+	}
+}
+
+func (params *downloadTLSParameters) get() (string, string) {
+	params.mutex.Lock()
+	defer params.mutex.Unlock()
+	return params.version, params.cipherSuite
+}
+
+// isHTTP2Fallback indicates whether HTTP/2 was offered with ALPN, by the TLS
+// profile, but not negotiated. As the downloads are untunneled, this may
+// indicate a middlebox which strips or rewrites ALPN.
+func (params *downloadTLSParameters) isHTTP2Fallback() bool {
+	params.mutex.Lock()
+	defer params.mutex.Unlock()
+	return params.offeredHTTP2 && params.applicationProtocol != "h2"
+}
+
+// downloadHTTPProtocol records the HTTP version, such as "HTTP/1.1", of the
+// most recent response received by a download HTTP client.
+type downloadHTTPProtocol struct {
+	mutex    sync.Mutex
+	protocol string
+}
+
+// wrapHTTPClient returns a copy of httpClient with response HTTP versions
+// recorded. The copy shares the underlying transport and its connection
+// pool.
+func (protocol *downloadHTTPProtocol) wrapHTTPClient(
+	httpClient *http.Client) *http.Client {
+
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	wrappedClient := *httpClient
+	wrappedClient.Transport = &downloadHTTPProtocolTransport{
+		protocol:  protocol,
+		transport: transport,
+	}
+	return &wrappedClient
+}
+
+func (protocol *downloadHTTPProtocol) get() string {
+	protocol.mutex.Lock()
+	defer protocol.mutex.Unlock()
+	return protocol.protocol
+}
+
+type downloadHTTPProtocolTransport struct {
+	protocol  *downloadHTTPProtocol
+	transport http.RoundTripper
+}
+
+func (transport *downloadHTTPProtocolTransport) RoundTrip(
+	request *http.Request) (*http.Response, error) {
+
+	response, err := transport.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	transport.protocol.mutex.Lock()
+	transport.protocol.protocol = response.Proto
+	transport.protocol.mutex.Unlock()
+	return response, nil
+}
+
+// downloadLegalBlock records whether the most recent response received by a
+// download HTTP client was an HTTP 451 Unavailable For Legal Reasons.
+type downloadLegalBlock struct {
+	mutex   sync.Mutex
+	blocked bool
+}
+
+// wrapHTTPClient returns a copy of httpClient which records legal block
+// responses. The copy shares the underlying transport and its connection
+// pool.
+func (legalBlock *downloadLegalBlock) wrapHTTPClient(
+	httpClient *http.Client) *http.Client {
+
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	wrappedClient := *httpClient
+	wrappedClient.Transport = &downloadLegalBlockTransport{
+		legalBlock: legalBlock,
+		transport:  transport,
+	}
+	return &wrappedClient
+}
+
+func (legalBlock *downloadLegalBlock) get() bool {
+	legalBlock.mutex.Lock()
+	defer legalBlock.mutex.Unlock()
+	return legalBlock.blocked
+}
+
+type downloadLegalBlockTransport struct {
+	legalBlock *downloadLegalBlock
+	transport  http.RoundTripper
+}
+
+func (transport *downloadLegalBlockTransport) RoundTrip(
+	request *http.Request) (*http.Response, error) {
+
+	response, err := transport.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	transport.legalBlock.mutex.Lock()
+	transport.legalBlock.blocked =
+		response.StatusCode == http.StatusUnavailableForLegalReasons
+	transport.legalBlock.mutex.Unlock()
+	return response, nil
+}
+
+// downloadConditionalRequest records the If-None-Match ETag, the response
+// status code, and the response ETag of the most recent request sent by a
+// download HTTP client.
+type downloadConditionalRequest struct {
+	mutex        sync.Mutex
+	ifNoneMatch  string
+	statusCode   int
+	responseETag string
+}
+
+// wrapHTTPClient returns a copy of httpClient which records conditional
+// request results. The copy shares the underlying transport and its
+// connection pool.
+func (conditionalRequest *downloadConditionalRequest) wrapHTTPClient(
+	httpClient *http.Client) *http.Client {
+
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	wrappedClient := *httpClient
+	wrappedClient.Transport = &downloadConditionalRequestTransport{
+		conditionalRequest: conditionalRequest,
+		transport:          transport,
+	}
+	return &wrappedClient
+}
+
+// get returns the recorded If-None-Match ETag, response status code, and
+// response ETag. The status code is 0 when no response was received.
+func (conditionalRequest *downloadConditionalRequest) get() (string, int, string) {
+	conditionalRequest.mutex.Lock()
+	defer conditionalRequest.mutex.Unlock()
+	return conditionalRequest.ifNoneMatch,
+		conditionalRequest.statusCode,
+		conditionalRequest.responseETag
+}
+
+type downloadConditionalRequestTransport struct {
+	conditionalRequest *downloadConditionalRequest
+	transport          http.RoundTripper
+}
+
+func (transport *downloadConditionalRequestTransport) RoundTrip(
+	request *http.Request) (*http.Response, error) {
+
+	response, err := transport.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	transport.conditionalRequest.mutex.Lock()
+	transport.conditionalRequest.ifNoneMatch = request.Header.Get("If-None-Match")
+	transport.conditionalRequest.statusCode = response.StatusCode
+	transport.conditionalRequest.responseETag = response.Header.Get("ETag")
+	transport.conditionalRequest.mutex.Unlock()
+	return response, nil
+}
+
+// downloadFallbackEndpoint retries a request, which fails to connect, with
+// the scheme and host of each of the alternate endpoints in turn, and
+// records the endpoint of the request that succeeded.
+type downloadFallbackEndpoint struct {
+	endpoints []string
+	mutex     sync.Mutex
+	endpoint  string
+}
+
+// wrapHTTPClient returns a copy of httpClient which retries requests with
+// the fallback endpoints. The copy shares the underlying transport and its
+// connection pool.
+func (fallbackEndpoint *downloadFallbackEndpoint) wrapHTTPClient(
+	httpClient *http.Client) *http.Client {
+
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	wrappedClient := *httpClient
+	wrappedClient.Transport = &downloadFallbackEndpointTransport{
+		fallbackEndpoint: fallbackEndpoint,
+		transport:        transport,
+	}
+	return &wrappedClient
+}
+
+// get returns the fallback endpoint used by the most recent successful
+// request, or "" when the request to the original URL succeeded.
+func (fallbackEndpoint *downloadFallbackEndpoint) get() string {
+	fallbackEndpoint.mutex.Lock()
+	defer fallbackEndpoint.mutex.Unlock()
+	return fallbackEndpoint.endpoint
+}
+
+type downloadFallbackEndpointTransport struct {
+	fallbackEndpoint *downloadFallbackEndpoint
+	transport        http.RoundTripper
+}
+
+func (transport *downloadFallbackEndpointTransport) RoundTrip(
+	request *http.Request) (*http.Response, error) {
+
+	// An error returned by RoundTrip indicates that no response was
+	// received, such as a failure to connect; an HTTP error status is a
+	// response from a reachable host, and isn't retried. Download requests
+	// have no body, so the request may be sent again.
+
+	response, err := transport.transport.RoundTrip(request)
+
+	usedEndpoint := ""
+
+	for _, endpoint := range transport.fallbackEndpoint.endpoints {
+
+		if err == nil || request.Context().Err() != nil {
+			break
+		}
+
+		endpointURL, parseErr := url.Parse(endpoint)
+		if parseErr != nil {
+			continue
+		}
+
+		NoticeInfo("retrying download with fallback endpoint %s: %s", endpoint, err)
+
+		fallbackRequest := copyDownloadRequest(request)
+		fallbackRequest.URL.Scheme = endpointURL.Scheme
+		fallbackRequest.URL.Host = endpointURL.Host
+		fallbackRequest.Host = ""
+
+		response, err = transport.transport.RoundTrip(fallbackRequest)
+		usedEndpoint = endpoint
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	transport.fallbackEndpoint.mutex.Lock()
+	transport.fallbackEndpoint.endpoint = usedEndpoint
+	transport.fallbackEndpoint.mutex.Unlock()
+	return response, nil
+}
+
+// remoteServerListMirrorHealth tracks the health of remote server list
+// download URLs, or mirrors, across fetches. Health is kept in memory only,
+// for the lifetime of the process.
+var remoteServerListMirrorHealth = newDownloadMirrorHealth()
+
+// remoteServerListNonResumableOrigins records the remote server list
+// download origins which don't support resuming partial downloads; see
+// RemoteServerListNonResumableThreshold.
+var remoteServerListNonResumableOrigins = newDownloadNonResumableOrigins()
+
+// downloadMirrorHealthSmoothing is the weight of the most recent download
+// in the moving average latency and failure rate of a mirror.
+const downloadMirrorHealthSmoothing = 0.3
+
+// downloadMirrorHealth tracks the recent latency and failure rate of
+// download mirrors, and assigns mirror selection weights accordingly.
+type downloadMirrorHealth struct {
+	mutex   sync.Mutex
+	mirrors map[string]*downloadMirrorStats
+}
+
+// downloadMirrorStats are exponential moving averages of the latency, the
+// time to the first response byte, of successful downloads and of the
+// failure rate of all downloads from a mirror.
+type downloadMirrorStats struct {
+	hasLatency  bool
+	latency     float64
+	failureRate float64
+}
+
+func newDownloadMirrorHealth() *downloadMirrorHealth {
+	return &downloadMirrorHealth{
+		mirrors: make(map[string]*downloadMirrorStats),
+	}
+}
+
+// record updates the stats for the mirror URL with the outcome of one
+// download.
+func (health *downloadMirrorHealth) record(
+	URL string, latency time.Duration, failed bool) {
+
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	stats, ok := health.mirrors[URL]
+	if !ok {
+		stats = &downloadMirrorStats{}
+		health.mirrors[URL] = stats
+	}
+
+	failure := 0.0
+	if failed {
+		failure = 1.0
+	}
+	stats.failureRate += downloadMirrorHealthSmoothing * (failure - stats.failureRate)
+
+	if failed {
+		return
+	}
+
+	if !stats.hasLatency {
+		stats.hasLatency = true
+		stats.latency = latency.Seconds()
+	} else {
+		stats.latency += downloadMirrorHealthSmoothing * (latency.Seconds() - stats.latency)
+	}
+}
+
+// weights returns selection weights for urls, for use with
+// DownloadURLs.SelectWeighted. A mirror's weight is its success rate
+// divided by its latency, so faster and more reliable mirrors are selected
+// more often. Mirrors without a download outcome are given the weight of
+// the healthiest mirror, so that new mirrors are tried. All weights are at
+// least minimumWeight times the weight of the healthiest mirror, so that
+// slow or failing mirrors are still occasionally retried and may recover.
+func (health *downloadMirrorHealth) weights(
+	urls parameters.DownloadURLs, minimumWeight float64) []float64 {
+
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	// Latencies are floored to avoid extreme weights for mirrors with
+	// near-zero latency, such as a local cache.
+	const minimumLatency = 0.001
+
+	weights := make([]float64, len(urls))
+	known := make([]bool, len(urls))
+	maxWeight := 0.0
+
+	for i, url := range urls {
+		stats, ok := health.mirrors[url.URL]
+		if !ok {
+			continue
+		}
+		known[i] = true
+		if stats.hasLatency {
+			latency := stats.latency
+			if latency < minimumLatency {
+				latency = minimumLatency
+			}
+			weights[i] = (1.0 - stats.failureRate) / latency
+		}
+		if weights[i] > maxWeight {
+			maxWeight = weights[i]
+		}
+	}
+
+	if maxWeight <= 0 {
+		maxWeight = 1.0
+	}
+
+	for i := range weights {
+		if !known[i] {
+			weights[i] = maxWeight
+		}
+		if weights[i] < minimumWeight*maxWeight {
+			weights[i] = minimumWeight * maxWeight
+		}
+	}
+
+	return weights
+}
+
+// remoteServerListFetchTelemetry records the most recent remote server list
+// fetches in this process, for GetFetchTelemetryJSON, the cumulative
+// counters of all fetches in this process, by fetch type, for
+// GetFetchTelemetryMetrics, and, when Config.FetchTelemetryUploadURL is
+// set, the fetches which are queued for upload.
+var remoteServerListFetchTelemetry = &fetchTelemetry{}
+
+type fetchTelemetry struct {
+	mutex       sync.Mutex
+	runs        []*FetchTelemetryRun
+	counters    map[string]*fetchTelemetryCounters
+	uploadQueue []*FetchTelemetryRun
+}
+
+// fetchTelemetryCounters are the cumulative totals of the FetchTelemetryRuns
+// of one fetch type.
+type fetchTelemetryCounters struct {
+	fetches          int64
+	fetchFailures    int64
+	downloads        int64
+	downloadFailures int64
+	downloadedBytes  int64
+	newServerEntries int64
+
+	signatureVerificationMicroseconds int64
+}
+
+// add adds the totals of the completed run to the counters.
+func (counters *fetchTelemetryCounters) add(run *FetchTelemetryRun) {
+	counters.fetches += 1
+	if run.Error != "" {
+		counters.fetchFailures += 1
+	}
+	for _, source := range run.Sources {
+		counters.downloads += int64(source.Requests)
+		counters.downloadFailures += int64(source.Failures)
+	}
+	counters.downloadedBytes += run.DownloadedBytes
+	counters.newServerEntries += int64(run.NewServerEntries)
+	counters.signatureVerificationMicroseconds += run.SignatureVerificationMicroseconds
+}
+
+// fetchTelemetryMetricFamilies are the counter metric families exposed by
+// GetFetchTelemetryMetrics.
+var fetchTelemetryMetricFamilies = []struct {
+	name  string
+	help  string
+	value func(*fetchTelemetryCounters) int64
+}{
+	{
+		"psiphon_remote_server_list_fetches",
+		"Remote server list fetches.",
+		func(c *fetchTelemetryCounters) int64 { return c.fetches },
+	},
+	{
+		"psiphon_remote_server_list_fetch_failures",
+		"Remote server list fetches which failed.",
+		func(c *fetchTelemetryCounters) int64 { return c.fetchFailures },
+	},
+	{
+		"psiphon_remote_server_list_downloads",
+		"Remote server list download requests.",
+		func(c *fetchTelemetryCounters) int64 { return c.downloads },
+	},
+	{
+		"psiphon_remote_server_list_download_failures",
+		"Remote server list download requests which failed.",
+		func(c *fetchTelemetryCounters) int64 { return c.downloadFailures },
+	},
+	{
+		"psiphon_remote_server_list_downloaded_bytes",
+		"Bytes downloaded by remote server list fetches.",
+		func(c *fetchTelemetryCounters) int64 { return c.downloadedBytes },
+	},
+	{
+		"psiphon_remote_server_list_new_server_entries",
+		"Server entries imported by remote server list fetches which were not already stored.",
+		func(c *fetchTelemetryCounters) int64 { return c.newServerEntries },
+	},
+	{
+		"psiphon_remote_server_list_signature_verification_microseconds",
+		"CPU time spent authenticating OSL files by obfuscated server list fetches.",
+		func(c *fetchTelemetryCounters) int64 { return c.signatureVerificationMicroseconds },
+	},
+}
+
+// FetchTelemetryRun summarizes one common remote server list fetch or
+// obfuscated server list fetch. When RemoteServerListTelemetryRedactURLs is
+// set, all URLs, including any URLs in Error, are redacted to hostnames.
+type FetchTelemetryRun struct {
+
+	// Type is REMOTE_SERVER_LIST_FETCH_TYPE_COMMON or
+	// REMOTE_SERVER_LIST_FETCH_TYPE_OBFUSCATED.
+	Type string
+
+	// StartTime and EndTime are the RFC3339 timestamps of the start and end
+	// of the fetch.
+	StartTime string
+	EndTime   string
+
+	// DownloadedBytes is the number of bytes downloaded by the fetch,
+	// including OSL registries.
+	DownloadedBytes int64
+
+	// NewServerEntries is the number of server entries imported by the fetch
+	// which were not already stored.
+	NewServerEntries int
+
+	// TimeToFirstNewServerEntryMilliseconds is the time elapsed from the
+	// start of the fetch until the first import which stored a new server
+	// entry completed. It's 0 when NewServerEntries is 0.
+	TimeToFirstNewServerEntryMilliseconds int64
+
+	// SignatureVerificationMicroseconds is the total CPU time spent
+	// authenticating OSL files in an obfuscated server list fetch; see
+	// OSLImportResult.SignatureVerificationTime.
+	SignatureVerificationMicroseconds int64
+
+	// Error is the error which caused the fetch to fail, or blank.
+	Error string `json:",omitempty"`
+
+	// Sources are the download stats of each download URL, keyed by URL or,
+	// when redacted, by hostname.
+	Sources map[string]*FetchTelemetrySource
+}
+
+// FetchTelemetrySource is the download stats of one download source in a
+// fetch. Requests counts the downloads which sent a request; resources
+// skipped as unchanged without a request aren't counted.
+type FetchTelemetrySource struct {
+	Requests        int
+	Failures        int
+	DownloadedBytes int64
+}
+
+// GetFetchTelemetryJSON returns a JSON encoded array of FetchTelemetryRun,
+// summarizing the most recent remote server list fetches in this process,
+// oldest first. Up to RemoteServerListTelemetryMaxRuns fetches are retained.
+// The telemetry is intended to be attached to support requests.
+func GetFetchTelemetryJSON() ([]byte, error) {
+
+	remoteServerListFetchTelemetry.mutex.Lock()
+	defer remoteServerListFetchTelemetry.mutex.Unlock()
+
+	runs := remoteServerListFetchTelemetry.runs
+	if runs == nil {
+		runs = []*FetchTelemetryRun{}
+	}
+
+	telemetryJSON, err := json.Marshal(runs)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return telemetryJSON, nil
+}
+
+// FETCH_TELEMETRY_METRICS_CONTENT_TYPE is the content type of the
+// GetFetchTelemetryMetrics exposition.
+const FETCH_TELEMETRY_METRICS_CONTENT_TYPE = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// GetFetchTelemetryMetrics returns the cumulative counters of all remote
+// server list fetches in this process in the OpenMetrics text exposition
+// format, which is also accepted by Prometheus, so that managed clients may
+// expose fetch metrics to be scraped. Each counter has a sample for each
+// fetch type, labeled with the FetchTelemetryRun Type. Unlike the fetch
+// telemetry returned by GetFetchTelemetryJSON, the counters include all
+// fetches, not only the most recent.
+func GetFetchTelemetryMetrics() []byte {
+
+	remoteServerListFetchTelemetry.mutex.Lock()
+	defer remoteServerListFetchTelemetry.mutex.Unlock()
+
+	fetchTypes := []string{
+		REMOTE_SERVER_LIST_FETCH_TYPE_COMMON,
+		REMOTE_SERVER_LIST_FETCH_TYPE_OBFUSCATED,
+	}
+
+	var buffer bytes.Buffer
+
+	for _, family := range fetchTelemetryMetricFamilies {
+		fmt.Fprintf(&buffer, "# TYPE %s counter\n", family.name)
+		fmt.Fprintf(&buffer, "# HELP %s %s\n", family.name, family.help)
+		for _, fetchType := range fetchTypes {
+			var value int64
+			counters := remoteServerListFetchTelemetry.counters[fetchType]
+			if counters != nil {
+				value = family.value(counters)
+			}
+			fmt.Fprintf(&buffer, "%s_total{type=\"%s\"} %d\n", family.name, fetchType, value)
+		}
+	}
+
+	buffer.WriteString("# EOF\n")
+
+	return buffer.Bytes()
+}
+
+// fetchTelemetryRecorder accumulates the FetchTelemetryRun of one fetch. The
+// recorder is safe for concurrent use, as the OSL downloads in a fetch may be
+// concurrent. A nil recorder records nothing.
+type fetchTelemetryRecorder struct {
+	config     *Config
+	redactURLs bool
+	startTime  time.Time
+	mutex      sync.Mutex
+	run        *FetchTelemetryRun
+}
+
+func newFetchTelemetryRecorder(
+	config *Config, fetchType string) *fetchTelemetryRecorder {
+
+	redactURLs := config.clientParameters.Get().Bool(
+		parameters.RemoteServerListTelemetryRedactURLs)
+
+	return &fetchTelemetryRecorder{
+		config:     config,
+		redactURLs: redactURLs,
+		startTime:  time.Now(),
+		run: &FetchTelemetryRun{
+			Type:      fetchType,
+			StartTime: config.getCurrentTimestamp(),
+			Sources:   make(map[string]*FetchTelemetrySource),
+		},
+	}
+}
+
+// recordDownload records one download request to sourceURL which downloaded
+// n bytes.
+func (recorder *fetchTelemetryRecorder) recordDownload(
+	sourceURL string, n int64, failed bool) {
+
+	if recorder == nil {
+		return
+	}
+
+	if recorder.redactURLs {
+		sourceURL = redactFetchTelemetryURL(sourceURL)
+	}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	source, ok := recorder.run.Sources[sourceURL]
+	if !ok {
+		source = &FetchTelemetrySource{}
+		recorder.run.Sources[sourceURL] = source
+	}
+
+	source.Requests += 1
+	if failed {
+		source.Failures += 1
+	}
+	source.DownloadedBytes += n
+
+	recorder.run.DownloadedBytes += n
+}
 
-	p := config.clientParameters.Get()
-	publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
-	urls := p.DownloadURLs(parameters.RemoteServerListURLs)
-	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
-	p = nil
+// recordNewServerEntries records one import which stored count new server
+// entries. The first import with new server entries sets the run's time to
+// first new server entry.
+func (recorder *fetchTelemetryRecorder) recordNewServerEntries(count int) {
+
+	if recorder == nil {
+		return
+	}
 
-	downloadURL, canonicalURL, skipVerify := urls.Select(attempt)
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
 
-	newETag, err := downloadRemoteServerListFile(
-		ctx,
-		config,
-		tunnel,
-		untunneledDialConfig,
-		downloadTimeout,
-		downloadURL,
-		canonicalURL,
-		skipVerify,
-		"",
-		config.RemoteServerListDownloadFilename)
-	if err != nil {
-		return fmt.Errorf("failed to download common remote server list: %s", common.ContextError(err))
+	if recorder.run.NewServerEntries == 0 && count > 0 {
+
+		// The elapsed time is at least 1ms, so that a recorded time is
+		// distinguishable from no new server entries.
+		milliseconds := int64(time.Since(recorder.startTime) / time.Millisecond)
+		if milliseconds < 1 {
+			milliseconds = 1
+		}
+		recorder.run.TimeToFirstNewServerEntryMilliseconds = milliseconds
+
+		if recorder.config.emitRemoteServerListNotice(noticeSeverityInfo) {
+			NoticeRemoteServerListTimeToFirstNewServerEntry(recorder.run.Type, milliseconds)
+		}
 	}
 
-	// When the resource is unchanged, skip.
-	if newETag == "" {
-		return nil
+	recorder.run.NewServerEntries += count
+}
+
+// recordSignatureVerification records the CPU time spent authenticating one
+// OSL file.
+func (recorder *fetchTelemetryRecorder) recordSignatureVerification(cpuTime time.Duration) {
+
+	if recorder == nil {
+		return
 	}
 
-	file, err := os.Open(config.RemoteServerListDownloadFilename)
-	if err != nil {
-		return fmt.Errorf("failed to open common remote server list: %s", common.ContextError(err))
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
 
+	recorder.run.SignatureVerificationMicroseconds += int64(cpuTime / time.Microsecond)
+}
+
+// finish completes the run, with the fetch outcome err, and adds it to the
+// retained telemetry, discarding the oldest runs in excess of
+// RemoteServerListTelemetryMaxRuns. When Config.FetchTelemetryUploadURL is
+// set, the run is also queued for upload, discarding the oldest queued runs
+// in excess of RemoteServerListTelemetryUploadMaxRuns.
+func (recorder *fetchTelemetryRecorder) finish(err error) {
+
+	if recorder == nil {
+		return
 	}
-	defer file.Close()
 
-	serverListPayloadReader, err := common.NewAuthenticatedDataPackageReader(
-		file, publicKey)
+	recorder.mutex.Lock()
+	recorder.run.EndTime = recorder.config.getCurrentTimestamp()
 	if err != nil {
-		return fmt.Errorf("failed to read remote server list: %s", common.ContextError(err))
+		recorder.run.Error = err.Error()
+		if recorder.redactURLs {
+			recorder.run.Error = fetchTelemetryURLRegexp.ReplaceAllStringFunc(
+				recorder.run.Error, redactFetchTelemetryURL)
+		}
 	}
+	recorder.mutex.Unlock()
 
-	err = StreamingStoreServerEntries(
-		config,
-		protocol.NewStreamingServerEntryDecoder(
-			serverListPayloadReader,
-			common.GetCurrentTimestamp(),
-			protocol.SERVER_ENTRY_SOURCE_REMOTE),
-		true)
-	if err != nil {
-		return fmt.Errorf("failed to store common remote server list: %s", common.ContextError(err))
+	p := recorder.config.clientParameters.Get()
+	maxRuns := p.Int(parameters.RemoteServerListTelemetryMaxRuns)
+	maxUploadRuns := p.Int(parameters.RemoteServerListTelemetryUploadMaxRuns)
+	p = nil
+
+	remoteServerListFetchTelemetry.mutex.Lock()
+	defer remoteServerListFetchTelemetry.mutex.Unlock()
+
+	runs := append(remoteServerListFetchTelemetry.runs, recorder.run)
+	if len(runs) > maxRuns {
+		runs = append([]*FetchTelemetryRun(nil), runs[len(runs)-maxRuns:]...)
 	}
+	remoteServerListFetchTelemetry.runs = runs
 
-	// Now that the server entries are successfully imported, store the response
-	// ETag so we won't re-download this same data again.
-	err = SetUrlETag(canonicalURL, newETag)
-	if err != nil {
-		NoticeAlert("failed to set ETag for common remote server list: %s", common.ContextError(err))
-		// This fetch is still reported as a success, even if we can't store the etag
+	if recorder.config.FetchTelemetryUploadURL != "" {
+		uploadQueue := append(remoteServerListFetchTelemetry.uploadQueue, recorder.run)
+		if len(uploadQueue) > maxUploadRuns {
+			uploadQueue = append([]*FetchTelemetryRun(nil), uploadQueue[len(uploadQueue)-maxUploadRuns:]...)
+		}
+		remoteServerListFetchTelemetry.uploadQueue = uploadQueue
 	}
 
-	return nil
+	if remoteServerListFetchTelemetry.counters == nil {
+		remoteServerListFetchTelemetry.counters = make(map[string]*fetchTelemetryCounters)
+	}
+	counters, ok := remoteServerListFetchTelemetry.counters[recorder.run.Type]
+	if !ok {
+		counters = &fetchTelemetryCounters{}
+		remoteServerListFetchTelemetry.counters[recorder.run.Type] = counters
+	}
+	counters.add(recorder.run)
 }
 
-// FetchObfuscatedServerLists downloads the obfuscated remote server lists
-// from config.ObfuscatedServerListRootURLs.
-// It first downloads the OSL registry, and then downloads each seeded OSL
-// advertised in the registry. All downloads are resumable, ETags are used
-// to skip both an unchanged registry or unchanged OSL files, and when an
-// individual download fails, the fetch proceeds if it can.
-// Authenticated package digital signatures are validated using the
-// public key config.RemoteServerListSignaturePublicKey.
-// config.ObfuscatedServerListDownloadDirectory is the location to store the
-// downloaded files. As  downloads are resumed after failure, this directory
-// must be unique and persistent.
-func FetchObfuscatedServerLists(
-	ctx context.Context,
-	config *Config,
-	attempt int,
-	tunnel *Tunnel,
-	untunneledDialConfig *DialConfig) error {
+// fetchTelemetryURLRegexp matches the URLs, such as the download URLs in
+// net/http errors, to be redacted in an error message.
+var fetchTelemetryURLRegexp = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"']+`)
 
-	NoticeInfo("fetching obfuscated remote server lists")
+// redactFetchTelemetryURL redacts rawURL to its hostname.
+func redactFetchTelemetryURL(rawURL string) string {
 
-	p := config.clientParameters.Get()
-	publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
-	urls := p.DownloadURLs(parameters.ObfuscatedServerListRootURLs)
-	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
-	p = nil
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil || parsedURL.Hostname() == "" {
+		return "[redacted]"
+	}
 
-	rootURL, canonicalRootURL, skipVerify := urls.Select(attempt)
-	downloadURL := osl.GetOSLRegistryURL(rootURL)
-	canonicalURL := osl.GetOSLRegistryURL(canonicalRootURL)
+	return parsedURL.Hostname()
+}
 
-	downloadFilename := osl.GetOSLRegistryFilename(config.ObfuscatedServerListDownloadDirectory)
-	cachedFilename := downloadFilename + ".cached"
+// registryDeltaDownload advertises OSL registry delta support in the
+// Accept header of a registry download request, and records whether the
+// response Content-Type indicates a delta.
+type registryDeltaDownload struct {
+	mutex   sync.Mutex
+	isDelta bool
+}
 
-	// If the cached registry is not present, we need to download or resume downloading
-	// the registry, so clear the ETag to ensure that always happens.
-	_, err := os.Stat(cachedFilename)
-	if os.IsNotExist(err) {
-		SetUrlETag(canonicalURL, "")
+// wrapHTTPClient returns a copy of httpClient which advertises registry
+// delta support. The copy shares the underlying transport and its
+// connection pool.
+func (registryDelta *registryDeltaDownload) wrapHTTPClient(
+	httpClient *http.Client) *http.Client {
+
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
 	}
 
-	// failed is set if any operation fails and should trigger a retry. When the OSL registry
-	// fails to download, any cached registry is used instead; when any single OSL fails
-	// to download, the overall operation proceeds. So this flag records whether to report
-	// failure at the end when downloading has proceeded after a failure.
-	// TODO: should disk-full conditions not trigger retries?
-	var failed bool
+	wrappedClient := *httpClient
+	wrappedClient.Transport = &registryDeltaTransport{
+		registryDelta: registryDelta,
+		transport:     transport,
+	}
+	return &wrappedClient
+}
 
-	// updateCache is set when modifed registry content is downloaded. Both the cached
-	// file and the persisted ETag will be updated in this case. The update is deferred
-	// until after the registry has been authenticated.
-	updateCache := false
-	registryFilename := cachedFilename
+func (registryDelta *registryDeltaDownload) getIsDelta() bool {
+	registryDelta.mutex.Lock()
+	defer registryDelta.mutex.Unlock()
+	return registryDelta.isDelta
+}
 
-	newETag, err := downloadRemoteServerListFile(
-		ctx,
-		config,
-		tunnel,
-		untunneledDialConfig,
-		downloadTimeout,
-		downloadURL,
-		canonicalURL,
-		skipVerify,
-		"",
-		downloadFilename)
-	if err != nil {
-		failed = true
-		NoticeAlert("failed to download obfuscated server list registry: %s", common.ContextError(err))
-		// Proceed with any existing cached OSL registry.
-	} else if newETag != "" {
-		updateCache = true
-		registryFilename = downloadFilename
+type registryDeltaTransport struct {
+	registryDelta *registryDeltaDownload
+	transport     http.RoundTripper
+}
+
+// copyDownloadRequest returns a copy of request, with its own header and URL,
+// which a transport may modify. Download requests have no body.
+func copyDownloadRequest(request *http.Request) *http.Request {
+	requestCopy := new(http.Request)
+	*requestCopy = *request
+	requestCopy.Header = make(http.Header)
+	for key, values := range request.Header {
+		requestCopy.Header[key] = append([]string(nil), values...)
 	}
+	if request.URL != nil {
+		requestURL := *request.URL
+		requestCopy.URL = &requestURL
+	}
+	return requestCopy
+}
 
-	lookupSLOKs := func(slokID []byte) []byte {
-		// Lookup SLOKs in local datastore
-		key, err := GetSLOK(slokID)
-		if err != nil {
-			NoticeAlert("GetSLOK failed: %s", err)
-		}
-		return key
+func (transport *registryDeltaTransport) RoundTrip(
+	request *http.Request) (*http.Response, error) {
+
+	// Per the http.RoundTripper contract, the request is not modified.
+	request = copyDownloadRequest(request)
+	request.Header.Set(
+		"Accept", osl.REGISTRY_DELTA_CONTENT_TYPE+", application/octet-stream")
+
+	response, err := transport.transport.RoundTrip(request)
+	if err == nil {
+		contentType := response.Header.Get("Content-Type")
+		transport.registryDelta.mutex.Lock()
+		transport.registryDelta.isDelta = strings.HasPrefix(
+			contentType, osl.REGISTRY_DELTA_CONTENT_TYPE)
+		transport.registryDelta.mutex.Unlock()
 	}
+	return response, err
+}
 
-	registryFile, err := os.Open(registryFilename)
-	if err != nil {
-		return fmt.Errorf("failed to read obfuscated server list registry: %s", common.ContextError(err))
+// downloadCacheControl records the Cache-Control header of a download
+// response.
+type downloadCacheControl struct {
+	mutex  sync.Mutex
+	header string
+}
+
+// wrapHTTPClient returns a copy of httpClient which records response
+// Cache-Control headers. The copy shares the underlying transport and its
+// connection pool.
+func (cacheControl *downloadCacheControl) wrapHTTPClient(
+	httpClient *http.Client) *http.Client {
+
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
 	}
-	defer registryFile.Close()
 
-	registryStreamer, err := osl.NewRegistryStreamer(
-		registryFile,
-		publicKey,
-		lookupSLOKs)
-	if err != nil {
-		// TODO: delete file? redownload if corrupt?
-		return fmt.Errorf("failed to read obfuscated server list registry: %s", common.ContextError(err))
+	wrappedClient := *httpClient
+	wrappedClient.Transport = &downloadCacheControlTransport{
+		cacheControl: cacheControl,
+		transport:    transport,
 	}
+	return &wrappedClient
+}
 
-	// NewRegistryStreamer authenticates the downloaded registry, so now it would be
-	// ok to update the cache. However, we defer that until after processing so we
-	// can close the file first before copying it, avoiding related complications on
-	// platforms such as Windows.
+// maxAge returns the max-age of the recorded Cache-Control header. The
+// return value is false when there's no max-age, or when the response
+// must not be cached.
+func (cacheControl *downloadCacheControl) maxAge() (time.Duration, bool) {
 
-	// Note: we proceed to check individual OSLs even if the directory is unchanged,
-	// as the set of local SLOKs may have changed.
+	cacheControl.mutex.Lock()
+	header := cacheControl.header
+	cacheControl.mutex.Unlock()
 
-	for {
+	maxAge := time.Duration(0)
+	hasMaxAge := false
 
-		oslFileSpec, err := registryStreamer.Next()
-		if err != nil {
-			failed = true
-			NoticeAlert("failed to stream obfuscated server list registry: %s", common.ContextError(err))
-			break
+	for _, directive := range strings.Split(header, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			return 0, false
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(
+				strings.Trim(strings.TrimPrefix(directive, "max-age="), "\""))
+			if err != nil || seconds < 0 {
+				return 0, false
+			}
+			maxAge = time.Duration(seconds) * time.Second
+			hasMaxAge = true
 		}
+	}
 
-		if oslFileSpec == nil {
-			break
-		}
+	return maxAge, hasMaxAge && maxAge > 0
+}
+
+type downloadCacheControlTransport struct {
+	cacheControl *downloadCacheControl
+	transport    http.RoundTripper
+}
 
-		downloadFilename := osl.GetOSLFilename(
-			config.ObfuscatedServerListDownloadDirectory, oslFileSpec.ID)
+func (transport *downloadCacheControlTransport) RoundTrip(
+	request *http.Request) (*http.Response, error) {
 
-		downloadURL := osl.GetOSLFileURL(rootURL, oslFileSpec.ID)
-		canonicalURL := osl.GetOSLFileURL(canonicalRootURL, oslFileSpec.ID)
+	response, err := transport.transport.RoundTrip(request)
+	if err == nil {
+		transport.cacheControl.mutex.Lock()
+		transport.cacheControl.header = response.Header.Get("Cache-Control")
+		transport.cacheControl.mutex.Unlock()
+	}
+	return response, err
+}
 
-		hexID := hex.EncodeToString(oslFileSpec.ID)
+// downloadRateMonitor implements an adaptive download timeout, in place of
+// a static timeout which either aborts large downloads over slow but
+// working connections or takes too long to detect a stalled download.
+//
+// Received bytes are counted over consecutive windows. The download is
+// allowed to continue for as long as each window receives at least the
+// minimum rate of bytes. Once a window has reached the minimum rate, any
+// following window below the minimum rate is a stall, and the download is
+// aborted. Before the download first reaches the minimum rate, which
+// includes connection establishment and the request round trip, the
+// download is aborted only when the initial timeout elapses.
+type downloadRateMonitor struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	receivedBytes     int64
+	timeout           time.Duration
+	window            time.Duration
+	minBytesPerWindow int64
+	mutex             sync.Mutex
+	err               error
+}
 
-		// Note: the MD5 checksum step assumes the remote server list host's ETag uses MD5
-		// with a hex encoding. If this is not the case, the sourceETag should be left blank.
-		sourceETag := fmt.Sprintf("\"%s\"", hex.EncodeToString(oslFileSpec.MD5Sum))
+func newDownloadRateMonitor(
+	timeout time.Duration,
+	window time.Duration,
+	minimumRate int) *downloadRateMonitor {
 
-		newETag, err := downloadRemoteServerListFile(
-			ctx,
-			config,
-			tunnel,
-			untunneledDialConfig,
-			downloadTimeout,
-			downloadURL,
-			canonicalURL,
-			skipVerify,
-			sourceETag,
-			downloadFilename)
-		if err != nil {
-			failed = true
-			NoticeAlert("failed to download obfuscated server list file (%s): %s", hexID, common.ContextError(err))
-			continue
-		}
+	minBytesPerWindow := int64(minimumRate) * int64(window) / int64(time.Second)
+	if minBytesPerWindow < 1 {
+		minBytesPerWindow = 1
+	}
 
-		// When the resource is unchanged, skip.
-		if newETag == "" {
-			continue
-		}
+	return &downloadRateMonitor{
+		timeout:           timeout,
+		window:            window,
+		minBytesPerWindow: minBytesPerWindow,
+	}
+}
 
-		file, err := os.Open(downloadFilename)
-		if err != nil {
-			failed = true
-			NoticeAlert("failed to open obfuscated server list file (%s): %s", hexID, common.ContextError(err))
-			continue
-		}
-		// Note: don't defer file.Close() since we're in a loop
+// run checks the download rate once per window, calling cancelFunc to
+// abort the download on a stall or timeout. run returns when ctx is done.
+func (monitor *downloadRateMonitor) run(
+	ctx context.Context, cancelFunc context.CancelFunc) {
 
-		serverListPayloadReader, err := osl.NewOSLReader(
-			file,
-			oslFileSpec,
-			lookupSLOKs,
-			publicKey)
-		if err != nil {
-			file.Close()
-			failed = true
-			NoticeAlert("failed to read obfuscated server list file (%s): %s", hexID, common.ContextError(err))
-			continue
+	ticker := time.NewTicker(monitor.window)
+	defer ticker.Stop()
+
+	startTime := time.Now()
+	lastReceivedBytes := int64(0)
+	reachedRate := false
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
 		}
 
-		err = StreamingStoreServerEntries(
-			config,
-			protocol.NewStreamingServerEntryDecoder(
-				serverListPayloadReader,
-				common.GetCurrentTimestamp(),
-				protocol.SERVER_ENTRY_SOURCE_OBFUSCATED),
-			true)
-		if err != nil {
-			file.Close()
-			failed = true
-			NoticeAlert("failed to store obfuscated server list file (%s): %s", hexID, common.ContextError(err))
-			continue
+		receivedBytes := atomic.LoadInt64(&monitor.receivedBytes)
+		windowBytes := receivedBytes - lastReceivedBytes
+		lastReceivedBytes = receivedBytes
+
+		var err error
+		if windowBytes >= monitor.minBytesPerWindow {
+			reachedRate = true
+		} else if reachedRate {
+			err = fmt.Errorf(
+				"download stalled: received %d bytes in %s", windowBytes, monitor.window)
+		} else if time.Since(startTime) >= monitor.timeout {
+			err = fmt.Errorf(
+				"download timed out: minimum rate not reached in %s", monitor.timeout)
 		}
 
-		// Now that the server entries are successfully imported, store the response
-		// ETag so we won't re-download this same data again.
-		err = SetUrlETag(canonicalURL, newETag)
 		if err != nil {
-			file.Close()
-			NoticeAlert("failed to set ETag for obfuscated server list file (%s): %s", hexID, common.ContextError(err))
-			continue
-			// This fetch is still reported as a success, even if we can't store the ETag
+			monitor.mutex.Lock()
+			monitor.err = err
+			monitor.mutex.Unlock()
+			cancelFunc()
+			return
 		}
+	}
+}
 
-		file.Close()
+// abortError returns the reason the download was aborted, or nil when
+// the monitor did not abort the download.
+func (monitor *downloadRateMonitor) abortError() error {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	return monitor.err
+}
 
-		// Clear the reference to this OSL file streamer and immediately run
-		// a garbage collection to reclaim its memory before processing the
-		// next file.
-		serverListPayloadReader = nil
-		DoGarbageCollection()
+// wrapHTTPClient returns a copy of httpClient with response bodies counted
+// by the monitor. The copy shares the underlying transport and its
+// connection pool.
+func (monitor *downloadRateMonitor) wrapHTTPClient(
+	httpClient *http.Client) *http.Client {
+
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
 	}
 
-	// Now that a new registry is downloaded, validated, and parsed, store
-	// the response ETag so we won't re-download this same data again. First
-	// close the file to avoid complications on platforms such as Windows.
-	if updateCache {
+	wrappedClient := *httpClient
+	wrappedClient.Transport = &downloadRateMonitorTransport{
+		monitor:   monitor,
+		transport: transport,
+	}
+	return &wrappedClient
+}
 
-		registryFile.Close()
+type downloadRateMonitorTransport struct {
+	monitor   *downloadRateMonitor
+	transport http.RoundTripper
+}
 
-		err := os.Rename(downloadFilename, cachedFilename)
-		if err != nil {
-			NoticeAlert("failed to set cached obfuscated server list registry: %s", common.ContextError(err))
-			// This fetch is still reported as a success, even if we can't update the cache
-		}
+func (transport *downloadRateMonitorTransport) RoundTrip(
+	request *http.Request) (*http.Response, error) {
 
-		err = SetUrlETag(canonicalURL, newETag)
-		if err != nil {
-			NoticeAlert("failed to set ETag for obfuscated server list registry: %s", common.ContextError(err))
-			// This fetch is still reported as a success, even if we can't store the ETag
-		}
+	response, err := transport.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
 	}
-
-	if failed {
-		return errors.New("one or more operations failed")
+	response.Body = &downloadRateMonitorBody{
+		ReadCloser: response.Body,
+		monitor:    transport.monitor,
 	}
+	return response, nil
+}
 
-	return nil
+type downloadRateMonitorBody struct {
+	io.ReadCloser
+	monitor *downloadRateMonitor
 }
 
-// downloadRemoteServerListFile downloads the source URL to
-// the destination file, performing a resumable download. When
-// the download completes and the file content has changed, the
-// new resource ETag is returned. Otherwise, blank is returned.
-// The caller is responsible for calling SetUrlETag once the file
-// content has been validated.
-func downloadRemoteServerListFile(
-	ctx context.Context,
-	config *Config,
-	tunnel *Tunnel,
-	untunneledDialConfig *DialConfig,
-	downloadTimeout time.Duration,
-	sourceURL string,
-	canonicalURL string,
-	skipVerify bool,
-	sourceETag string,
-	destinationFilename string) (string, error) {
+func (body *downloadRateMonitorBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	atomic.AddInt64(&body.monitor.receivedBytes, int64(n))
+	return n, err
+}
 
-	// All download URLs with the same canonicalURL
-	// must have the same entity and ETag.
-	lastETag, err := GetUrlETag(canonicalURL)
-	if err != nil {
-		return "", common.ContextError(err)
+// downloadProgress emits RemoteServerListResourceDownloadProgress notices as
+// the response bodies of a download are read, at most once per interval,
+// and once more when a response body is read to completion. For a partial
+// content response, which resumes a partial download, the progress starts
+// from the Content-Range offset, so the progress of a resumed download
+// includes the bytes already downloaded.
+type downloadProgress struct {
+	url      string
+	interval time.Duration
+}
+
+// wrapHTTPClient returns a copy of httpClient with response bodies reported
+// by the progress. The copy shares the underlying transport and its
+// connection pool.
+func (progress *downloadProgress) wrapHTTPClient(
+	httpClient *http.Client) *http.Client {
+
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
 	}
 
-	// sourceETag, when specified, is prior knowledge of the
-	// remote ETag that can be used to skip the request entirely.
-	// This will be set in the case of OSL files, from the MD5Sum
-	// values stored in the registry.
-	if lastETag != "" && sourceETag == lastETag {
-		// TODO: notice?
-		return "", nil
+	wrappedClient := *httpClient
+	wrappedClient.Transport = &downloadProgressTransport{
+		progress:  progress,
+		transport: transport,
 	}
+	return &wrappedClient
+}
 
-	var cancelFunc context.CancelFunc
-	ctx, cancelFunc = context.WithTimeout(ctx, downloadTimeout)
-	defer cancelFunc()
+type downloadProgressTransport struct {
+	progress  *downloadProgress
+	transport http.RoundTripper
+}
 
-	// MakeDownloadHttpClient will select either a tunneled
-	// or untunneled configuration.
+func (transport *downloadProgressTransport) RoundTrip(
+	request *http.Request) (*http.Response, error) {
 
-	httpClient, err := MakeDownloadHTTPClient(
-		ctx,
-		config,
-		tunnel,
-		untunneledDialConfig,
-		skipVerify)
+	response, err := transport.transport.RoundTrip(request)
 	if err != nil {
-		return "", common.ContextError(err)
+		return nil, err
 	}
 
-	n, responseETag, err := ResumeDownload(
-		ctx,
-		httpClient,
-		sourceURL,
-		MakePsiphonUserAgent(config),
-		destinationFilename,
-		lastETag)
+	// Only a response with the resource content is reported; a 304, for
+	// example, downloads nothing.
+	var offset, total int64
+	switch response.StatusCode {
+	case http.StatusOK:
+		if response.ContentLength > 0 {
+			total = response.ContentLength
+		}
+	case http.StatusPartialContent:
+		offset, total = parseContentRange(response)
+	default:
+		return response, nil
+	}
+
+	response.Body = &downloadProgressBody{
+		ReadCloser:     response.Body,
+		progress:       transport.progress,
+		bytesRead:      offset,
+		bytesTotal:     total,
+		lastNoticeTime: time.Now(),
+	}
+	return response, nil
+}
 
-	NoticeRemoteServerListResourceDownloadedBytes(sourceURL, n)
+// parseContentRange returns the offset and the complete resource size
+// indicated by the Content-Range header of a partial content response. When
+// the header doesn't indicate the complete size, the size is derived from
+// the response Content-Length; when neither is available, the size is 0.
+func parseContentRange(response *http.Response) (int64, int64) {
 
+	var first, last int64
+	var size string
+	_, err := fmt.Sscanf(
+		response.Header.Get("Content-Range"), "bytes %d-%d/%s", &first, &last, &size)
 	if err != nil {
-		return "", common.ContextError(err)
+		return 0, 0
 	}
 
-	if responseETag == lastETag {
-		return "", nil
+	total, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || total < 0 {
+		total = 0
+		if response.ContentLength > 0 {
+			total = first + response.ContentLength
+		}
 	}
 
-	NoticeRemoteServerListResourceDownloaded(sourceURL)
+	return first, total
+}
+
+type downloadProgressBody struct {
+	io.ReadCloser
+	progress       *downloadProgress
+	bytesRead      int64
+	bytesTotal     int64
+	lastNoticeTime time.Time
+}
 
-	RecordRemoteServerListStat(sourceURL, responseETag)
+func (body *downloadProgressBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.bytesRead += int64(n)
+	if (n > 0 && time.Since(body.lastNoticeTime) >= body.progress.interval) ||
+		err == io.EOF {
 
-	return responseETag, nil
+		body.lastNoticeTime = time.Now()
+		NoticeRemoteServerListResourceDownloadProgress(
+			body.progress.url, body.bytesRead, body.bytesTotal)
+	}
+	return n, err
 }
@@ -0,0 +1,396 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// FetchCommonRemoteServerListDryRun downloads the common remote server list
+// from config.RemoteServerListURLs, validates its digital signature, and
+// decodes and validates its server entries, as FetchCommonRemoteServerList
+// does, but stores nothing: no server entries, ETags, revocation list,
+// config overrides, or fetch stats. This allows tools and QA to check a
+// staging server list without affecting the client state. The number of
+// server entries decoded is returned.
+//
+// As no ETag is used, the list is always downloaded in full. The download
+// is made to a separate file alongside
+// config.RemoteServerListDownloadFilename, and is resumed by the next dry
+// run after an interrupted download. The downloaded file is deleted once
+// validated.
+func FetchCommonRemoteServerListDryRun(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig) (int, error) {
+
+	err := checkSignaturePublicKey(config)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	p := config.clientParameters.Get()
+	urls := p.DownloadURLs(parameters.RemoteServerListURLs)
+	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
+	p = nil
+
+	if len(urls) == 0 {
+		return 0, common.ContextError(errors.New("missing remote server list URLs"))
+	}
+
+	downloadURL, canonicalURL, skipVerify := urls.Select(attempt)
+
+	downloadFilename := config.RemoteServerListDownloadFilename + ".dry-run"
+
+	_, _, err = downloadRemoteServerListFile(
+		ctx,
+		config,
+		tunnel,
+		untunneledDialConfig,
+		downloadTimeout,
+		downloadURL,
+		canonicalURL,
+		skipVerify,
+		urls.FallbackEndpoints(downloadURL),
+		urls.TLSConfig(downloadURL),
+		"",
+		downloadFilename,
+		nil,
+		remoteServerListDownloadOptions{
+			dryRun: true,
+		})
+	if err != nil {
+		switch err.(type) {
+		case TunnelRequiredError, LegalBlockError:
+			return 0, err
+		}
+		return 0, fmt.Errorf("failed to download common remote server list: %s", common.ContextError(err))
+	}
+	defer os.Remove(downloadFilename)
+
+	file, err := os.Open(downloadFilename)
+	if err != nil {
+		return 0, NewFetchFileError(downloadFilename, "", common.ContextError(err))
+	}
+	defer file.Close()
+
+	publicKey, lowTrustPublicKey := getSignaturePublicKeys(config)
+
+	var serverListPayloadReader io.Reader
+	_, err = validateWithTrustTiers(
+		publicKey,
+		lowTrustPublicKey,
+		func(signingPublicKey string) error {
+			var err error
+			serverListPayloadReader, _, err =
+				common.NewAuthenticatedDataPackageReaderWithDictionary(
+					file, signingPublicKey, config.serverEntryCompressionDictionary)
+			return err
+		})
+	if err != nil {
+		return 0, NewFetchFileError(downloadFilename, "", common.ContextError(err))
+	}
+
+	count, err := decodeDryRunServerEntries(
+		ctx,
+		newRemoteServerEntryDecoder(
+			config,
+			serverListPayloadReader,
+			config.getCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE))
+	if err != nil {
+		return 0, NewFetchFileError(downloadFilename, "", common.ContextError(err))
+	}
+
+	noticeRemoteServerListInfo(config, "dry run decoded %d server entries: %s", count, downloadURL)
+
+	return count, nil
+}
+
+// FetchObfuscatedServerListsDryRun performs a dry run, as
+// FetchCommonRemoteServerListDryRun, of FetchObfuscatedServerLists. For
+// each root in config.ObfuscatedServerListRootURLs and
+// config.ObfuscatedServerListShardRootURLs, the registry is downloaded and
+// validated, and each OSL seeded by the locally stored SLOKs is downloaded,
+// decrypted, and validated, and its server entries decoded. The total number
+// of server entries decoded is returned. The dry run stops at the first
+// failure; the count of server entries decoded before the failure is
+// returned along with the error.
+//
+// Downloads are made to the OBFUSCATED_SERVER_LIST_DRY_RUN_DIRECTORY
+// subdirectory of config.ObfuscatedServerListDownloadDirectory. As with
+// FetchCommonRemoteServerListDryRun, interrupted downloads are resumed by
+// the next dry run, and downloaded files are deleted once validated.
+func FetchObfuscatedServerListsDryRun(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig) (int, error) {
+
+	err := checkSignaturePublicKey(config)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	p := config.clientParameters.Get()
+	urls := p.DownloadURLs(parameters.ObfuscatedServerListRootURLs)
+	shardURLs := p.DownloadURLsList(parameters.ObfuscatedServerListShardRootURLs)
+	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
+	p = nil
+
+	if len(urls) == 0 {
+		return 0, common.ContextError(errors.New("missing obfuscated server list root URLs"))
+	}
+
+	downloadDirectory := filepath.Join(
+		config.ObfuscatedServerListDownloadDirectory,
+		OBFUSCATED_SERVER_LIST_DRY_RUN_DIRECTORY)
+
+	err = os.MkdirAll(downloadDirectory, 0700)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	slokLookup := newOSLSLOKLookup(config)
+
+	count := 0
+
+	for _, urls := range append([]parameters.DownloadURLs{urls}, shardURLs...) {
+
+		rootURL, canonicalRootURL, skipVerify := urls.Select(attempt)
+
+		// Each root registry has a distinct filename, as in
+		// getOSLShardRegistryFilename.
+		digest := sha256.Sum256([]byte(canonicalRootURL))
+		registryFilename := fmt.Sprintf(
+			"%s-%s",
+			osl.GetOSLRegistryFilename(downloadDirectory),
+			hex.EncodeToString(digest[:8]))
+
+		download := func(downloadURL, canonicalURL, filename string) error {
+			_, _, err := downloadRemoteServerListFile(
+				ctx,
+				config,
+				tunnel,
+				untunneledDialConfig,
+				downloadTimeout,
+				downloadURL,
+				canonicalURL,
+				skipVerify,
+				urls.FallbackEndpoints(rootURL),
+				urls.TLSConfig(rootURL),
+				"",
+				filename,
+				config.oslFileEncryptionKey,
+				remoteServerListDownloadOptions{
+					dryRun: true,
+				})
+			return err
+		}
+
+		registryURL := getOSLRegistryURL(config, rootURL)
+
+		err := download(
+			registryURL, getOSLRegistryURL(config, canonicalRootURL), registryFilename)
+		if err != nil {
+			switch err.(type) {
+			case TunnelRequiredError, LegalBlockError:
+				return count, err
+			}
+			return count, fmt.Errorf("failed to download obfuscated server list registry: %s", common.ContextError(err))
+		}
+
+		n, err := dryRunObfuscatedServerListRoot(
+			ctx,
+			config,
+			rootURL,
+			canonicalRootURL,
+			registryFilename,
+			downloadDirectory,
+			slokLookup,
+			download)
+		count += n
+		os.Remove(registryFilename)
+		if err != nil {
+			return count, err
+		}
+
+		noticeRemoteServerListInfo(config, "dry run decoded %d server entries: %s", n, registryURL)
+	}
+
+	// A failed SLOK lookup leaves an OSL apparently locked, so that the
+	// count may be incomplete.
+	err = slokLookup.err()
+	if err != nil {
+		return count, err
+	}
+
+	return count, nil
+}
+
+// dryRunObfuscatedServerListRoot validates the downloaded registry of an
+// obfuscated server list root and downloads, using download, and validates
+// each seeded OSL, returning the number of server entries decoded.
+func dryRunObfuscatedServerListRoot(
+	ctx context.Context,
+	config *Config,
+	rootURL string,
+	canonicalRootURL string,
+	registryFilename string,
+	downloadDirectory string,
+	slokLookup *oslSLOKLookup,
+	download func(downloadURL, canonicalURL, filename string) error) (int, error) {
+
+	publicKey, lowTrustPublicKey := getSignaturePublicKeys(config)
+
+	registryFile, registryStreamer, err := openOSLRegistry(
+		config, registryFilename, publicKey, slokLookup.lookup)
+	if err != nil {
+		return 0, NewFetchFileError(registryFilename, "", err)
+	}
+	defer registryFile.Close()
+
+	count := 0
+
+	for {
+
+		oslFileSpec, err := registryStreamer.Next()
+		if err != nil {
+			return count, NewFetchFileError(registryFilename, "", common.ContextError(err))
+		}
+		if oslFileSpec == nil {
+			break
+		}
+
+		hexID := hex.EncodeToString(oslFileSpec.ID)
+		filename := osl.GetOSLFilename(downloadDirectory, oslFileSpec.ID)
+
+		err = download(
+			osl.GetOSLFileURL(rootURL, oslFileSpec.ID),
+			osl.GetOSLFileURL(canonicalRootURL, oslFileSpec.ID),
+			filename)
+		if err != nil {
+			switch err.(type) {
+			case TunnelRequiredError, LegalBlockError:
+				return count, err
+			}
+			return count, fmt.Errorf("failed to download obfuscated server list file (%s): %s", hexID, common.ContextError(err))
+		}
+
+		n, err := dryRunObfuscatedServerListFile(
+			ctx, config, oslFileSpec, filename, slokLookup, publicKey, lowTrustPublicKey)
+		count += n
+		os.Remove(filename)
+		if err != nil {
+			return count, NewFetchFileError(filename, hexID, err)
+		}
+	}
+
+	return count, nil
+}
+
+// dryRunObfuscatedServerListFile decrypts and validates the downloaded OSL
+// file and returns the number of server entries decoded.
+func dryRunObfuscatedServerListFile(
+	ctx context.Context,
+	config *Config,
+	oslFileSpec *osl.OSLFileSpec,
+	filename string,
+	slokLookup *oslSLOKLookup,
+	publicKey string,
+	lowTrustPublicKey string) (int, error) {
+
+	file, err := openDownloadFile(filename, config.oslFileEncryptionKey)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+	defer file.Close()
+
+	var serverListPayloadReader io.Reader
+	_, err = validateWithTrustTiers(
+		publicKey,
+		lowTrustPublicKey,
+		func(signingPublicKey string) error {
+			var err error
+			serverListPayloadReader, err = osl.NewOSLReaderWithDictionary(
+				file,
+				oslFileSpec,
+				slokLookup.lookup,
+				signingPublicKey,
+				config.serverEntryCompressionDictionary)
+			return err
+		})
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	count, err := decodeDryRunServerEntries(
+		ctx,
+		newOSLServerEntryDecoder(
+			config,
+			serverListPayloadReader,
+			config.getCurrentTimestamp(),
+			oslFileSpec,
+			slokLookup.lookup))
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	return count, nil
+}
+
+// decodeDryRunServerEntries decodes and validates all server entries from
+// serverEntries, without storing them, and returns the number of server
+// entries decoded. When ctx is cancelled, the context error is returned.
+func decodeDryRunServerEntries(
+	ctx context.Context,
+	serverEntries *protocol.StreamingServerEntryDecoder) (int, error) {
+
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return 0, common.ContextError(err)
+		}
+
+		serverEntry, err := serverEntries.Next()
+		if err != nil {
+			return 0, common.ContextError(err)
+		}
+
+		if serverEntry == nil {
+			return serverEntries.DecodedCount(), nil
+		}
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// RemoteServerListSecondarySignature is the payload of the authenticated
+// data package fetched from Config.RemoteServerListSecondarySignatureURLs.
+// Digest is the hex-encoded SHA-256 digest of the entire common remote
+// server list file, as downloaded. The package is signed with
+// RemoteServerListSecondaryPublicKey, so that a common remote server list is
+// imported only when it's authenticated by two independent signing keys.
+type RemoteServerListSecondarySignature struct {
+	Digest string
+}
+
+// getRemoteServerListSecondarySignatureFilename returns the download
+// filename for the secondary signature, which is co-located with the common
+// remote server list download.
+func getRemoteServerListSecondarySignatureFilename(config *Config) string {
+	return config.RemoteServerListDownloadFilename + ".signature"
+}
+
+// verifyRemoteServerListSecondarySignature downloads the secondary
+// signature from RemoteServerListSecondarySignatureURLs, when configured,
+// and checks that it authenticates the common remote server list in
+// filename. An error is returned when the signature can't be downloaded or
+// doesn't validate, in which case the common remote server list must not be
+// imported.
+//
+// The signature ETag is stored only once the signature validates. When the
+// signature is unchanged, the previously downloaded signature is checked.
+func verifyRemoteServerListSecondarySignature(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	downloadCache *remoteServerListDownloadCache,
+	telemetry *fetchTelemetryRecorder,
+	filename string) error {
+
+	p := config.clientParameters.Get()
+	urls := p.DownloadURLs(parameters.RemoteServerListSecondarySignatureURLs)
+	publicKey := p.String(parameters.RemoteServerListSecondaryPublicKey)
+	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
+	p = nil
+
+	if len(urls) == 0 {
+		return nil
+	}
+
+	downloadURL, canonicalURL, skipVerify := urls.Select(attempt)
+
+	downloadFilename := getRemoteServerListSecondarySignatureFilename(config)
+
+	newETag, _, err := downloadRemoteServerListFile(
+		ctx,
+		config,
+		tunnel,
+		untunneledDialConfig,
+		downloadTimeout,
+		downloadURL,
+		canonicalURL,
+		skipVerify,
+		urls.FallbackEndpoints(downloadURL),
+		urls.TLSConfig(downloadURL),
+		"",
+		downloadFilename,
+		nil,
+		remoteServerListDownloadOptions{
+			downloadCache: downloadCache,
+			telemetry:     telemetry,
+		})
+	if err != nil {
+		return fmt.Errorf("failed to download remote server list secondary signature: %s", common.ContextError(err))
+	}
+
+	signature, err := readRemoteServerListSecondarySignature(publicKey, downloadFilename)
+	if err != nil {
+		return NewFetchFileError(downloadFilename, "", common.ContextError(err))
+	}
+
+	digest, err := makeContentDigest(filename, nil)
+	if err != nil {
+		return NewFetchFileError(filename, "", common.ContextError(err))
+	}
+
+	if signature.Digest != digest {
+		return NewFetchFileError(
+			filename, "", common.ContextError(errors.New("secondary signature digest mismatch")))
+	}
+
+	if newETag != "" {
+		err = setValidatedUrlETag(config, canonicalURL, newETag)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to set ETag for remote server list secondary signature: %s", common.ContextError(err))
+		}
+	}
+
+	return nil
+}
+
+// readRemoteServerListSecondarySignature reads and authenticates the
+// downloaded secondary signature.
+func readRemoteServerListSecondarySignature(
+	publicKey, filename string) (*RemoteServerListSecondarySignature, error) {
+
+	dataPackage, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	payload, err := common.ReadAuthenticatedDataPackage(dataPackage, true, publicKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var signature *RemoteServerListSecondarySignature
+	err = json.Unmarshal([]byte(payload), &signature)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if signature == nil || signature.Digest == "" {
+		return nil, common.ContextError(errors.New("missing remote server list secondary signature"))
+	}
+
+	return signature, nil
+}
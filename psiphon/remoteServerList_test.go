@@ -21,28 +21,53 @@ package psiphon
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
+	math_rand "math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
 	socks "github.com/Psiphon-Labs/goptlib"
+	"github.com/Psiphon-Labs/net/http2"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/server"
+	"github.com/andybalholm/brotli"
 )
 
 // TODO: TestCommonRemoteServerList (this is currently covered by controller_test.go)
@@ -177,6 +202,7 @@ func testObfuscatedRemoteServerLists(t *testing.T, omitMD5Sums bool) {
 		map[string][]string{},
 		omitMD5SumsSchemes,
 		omitEmptyOSLsSchemes,
+		0,
 		func(logInfo *osl.PaveLogInfo) {
 			oslID = logInfo.OSLID
 		})
@@ -196,6 +222,7 @@ func testObfuscatedRemoteServerLists(t *testing.T, omitMD5Sums bool) {
 		},
 		omitMD5SumsSchemes,
 		omitEmptyOSLsSchemes,
+		0,
 		nil)
 	if err != nil {
 		t.Fatalf("error paving OSL files: %s", err)
@@ -460,3 +487,14447 @@ func testObfuscatedRemoteServerLists(t *testing.T, omitMD5Sums bool) {
 		}
 	}
 }
+
+func TestObfuscatedServerListQuarantine(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	threshold := 2
+
+	err := env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ObfuscatedServerListQuarantineThreshold: threshold,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	notices := startTestNoticeRecorder()
+	defer notices.stop()
+
+	badOSLID := env.oslIDs[0]
+	badOSLName := env.oslFileName(badOSLID)
+	goodContents := env.getFile(badOSLName)
+	badContents := append([]byte(nil), goodContents...)
+	badContents[len(badContents)-1] ^= 0xff
+	env.setFile(badOSLName, badContents)
+
+	for i := 0; i < threshold; i++ {
+		err := env.fetch()
+		if err == nil {
+			t.Fatalf("unexpected fetch success")
+		}
+	}
+
+	if notices.count("ObfuscatedServerListQuarantined") != 1 {
+		t.Fatalf("unexpected quarantine notice count")
+	}
+
+	quarantineFilename := filepath.Join(
+		env.dataDirectory, OBFUSCATED_SERVER_LIST_QUARANTINE_DIRECTORY, badOSLName)
+	if _, err := os.Stat(quarantineFilename); err != nil {
+		t.Fatalf("missing quarantined file: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(env.dataDirectory, badOSLName)); !os.IsNotExist(err) {
+		t.Fatalf("unexpected downloaded file: %v", err)
+	}
+
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// While quarantined, the OSL is not requested and the fetch succeeds.
+
+	requestCount := env.requestCount(badOSLName)
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(badOSLName) != requestCount {
+		t.Fatalf("unexpected request for quarantined OSL")
+	}
+
+	// Once the quarantine period has elapsed, the OSL is downloaded again.
+
+	oslID, _ := hex.DecodeString(badOSLID)
+	err = setOSLQuarantineRecord(oslID, &oslQuarantineRecord{
+		Failures:         threshold,
+		QuarantinedUntil: time.Now().Add(-time.Second),
+	})
+	if err != nil {
+		t.Fatalf("setOSLQuarantineRecord failed: %s", err)
+	}
+
+	env.setFile(badOSLName, goodContents)
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(badOSLName) == requestCount {
+		t.Fatalf("missing request for unquarantined OSL")
+	}
+
+	if CountServerEntries() != 2 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	record, err := getOSLQuarantineRecord(oslID)
+	if err != nil {
+		t.Fatalf("getOSLQuarantineRecord failed: %s", err)
+	}
+	if record != nil {
+		t.Fatalf("unexpected quarantine record")
+	}
+}
+
+func TestObfuscatedServerListInodesExhausted(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	var availableInodes uint64
+	availableInodesStat = func(directory string) (uint64, bool, error) {
+		if directory != env.config.ObfuscatedServerListDownloadDirectory {
+			t.Fatalf("unexpected directory: %s", directory)
+		}
+		return availableInodes, true, nil
+	}
+	defer func() {
+		availableInodesStat = getAvailableInodes
+	}()
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// With no available inodes, the fetch is skipped without any downloads.
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if recorder.count("ObfuscatedServerListInodesExhausted") != 1 ||
+		env.requestCount(osl.REGISTRY_FILENAME) != 0 ||
+		CountServerEntries() != 0 {
+
+		t.Fatalf("unexpected fetch with exhausted inodes")
+	}
+
+	// With available inodes, the fetch proceeds.
+
+	availableInodes = 1000
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if recorder.count("ObfuscatedServerListInodesExhausted") != 1 ||
+		CountServerEntries() != len(env.oslIDs) {
+
+		t.Fatalf("unexpected fetch with available inodes")
+	}
+}
+
+func TestCommonRemoteServerListCompression(t *testing.T) {
+
+	var encodedServerEntries []string
+	for i := 0; i < 3; i++ {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:    fmt.Sprintf("192.0.2.%d", 100+i),
+				Capabilities: []string{"OSSH"},
+				Region:       "JP",
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+	}
+
+	// Each encoding of the common remote server list is imported, with the
+	// same server entries, into a fresh datastore. Each encoding is derived
+	// from the default, zlib compressed, package, except for the Brotli
+	// package format, which is written as such. Brotli is otherwise
+	// selected only by a Brotli content coding.
+
+	encodeBrotli := func(packageJSON []byte) []byte {
+		brotliPackage, err := common.WriteAuthenticatedDataPackageWithFormat(
+			strings.Join(encodedServerEntries, "\n"),
+			nil,
+			common.AUTHENTICATED_DATA_PACKAGE_FORMAT_V1_BROTLI,
+			testOSLSigningPublicKey,
+			testOSLSigningPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackageWithFormat failed: %s", err)
+		}
+		return brotliPackage
+	}
+
+	testCases := []struct {
+		description     string
+		encode          func(packageJSON []byte) []byte
+		contentEncoding string
+	}{
+		{"zlib", func(packageJSON []byte) []byte {
+			return common.Compress(packageJSON)
+		}, ""},
+		{"gzip", func(packageJSON []byte) []byte {
+			var gzipPackage bytes.Buffer
+			gzipWriter := gzip.NewWriter(&gzipPackage)
+			gzipWriter.Write(packageJSON)
+			gzipWriter.Close()
+			return gzipPackage.Bytes()
+		}, ""},
+		{"uncompressed", func(packageJSON []byte) []byte {
+			return packageJSON
+		}, ""},
+		{"brotli format", encodeBrotli, ""},
+		{"brotli content encoding", func(packageJSON []byte) []byte {
+			return packageJSON
+		}, "br"},
+		{"brotli content encoding and format", encodeBrotli, "br"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			env := newTestOSLEnvironment(t, 1, 1)
+			defer env.close()
+
+			commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+				strings.Join(encodedServerEntries, "\n"),
+				testOSLSigningPublicKey,
+				testOSLSigningPrivateKey)
+			if err != nil {
+				t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+			}
+
+			packageJSON, err := common.Decompress(commonRemoteServerList)
+			if err != nil {
+				t.Fatalf("Decompress failed: %s", err)
+			}
+
+			env.setFile(
+				testCommonRemoteServerListName, testCase.encode(packageJSON))
+
+			env.mutex.Lock()
+			env.contentEncoding = testCase.contentEncoding
+			env.mutex.Unlock()
+
+			err = env.fetchCommon()
+			if err != nil {
+				t.Fatalf("fetchCommon failed: %s", err)
+			}
+
+			serverEntries := getTestStoredServerEntryFields(t)
+			if len(serverEntries) != len(encodedServerEntries) {
+				t.Fatalf("unexpected stored server entry count: %d", len(serverEntries))
+			}
+			for i := range encodedServerEntries {
+				if _, ok := serverEntries[fmt.Sprintf("192.0.2.%d", 100+i)]; !ok {
+					t.Fatalf("missing server entry: %d", i)
+				}
+			}
+		})
+	}
+
+	// A common remote server list in an unrecognized encoding is reported
+	// as a FetchFileError, and nothing is imported.
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	garbage := make([]byte, 1024)
+	math_rand.New(math_rand.NewSource(0)).Read(garbage)
+	env.setFile(testCommonRemoteServerListName, garbage)
+
+	err := env.fetchCommon()
+	fileErr, ok := err.(FetchFileError)
+	if !ok {
+		t.Fatalf("unexpected fetch error: %v", err)
+	}
+	if fileErr.Filename != env.config.RemoteServerListDownloadFilename ||
+		fileErr.Err == nil {
+
+		t.Fatalf("unexpected fetch file error: %+v", fileErr)
+	}
+
+	if count := len(getTestStoredServerEntryFields(t)); count != 0 {
+		t.Fatalf("unexpected stored server entry count: %d", count)
+	}
+}
+
+func TestFetchFileError(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	// A corrupt OSL file is reported with its filename and OSL ID.
+
+	badOSLID := env.oslIDs[1]
+	badOSLName := env.oslFileName(badOSLID)
+	badContents := append([]byte(nil), env.getFile(badOSLName)...)
+	badContents[len(badContents)-1] ^= 0xff
+	env.setFile(badOSLName, badContents)
+
+	err := env.fetch()
+	fileErr, ok := err.(FetchFileError)
+	if !ok {
+		t.Fatalf("unexpected fetch error: %v", err)
+	}
+
+	if fileErr.Filename != filepath.Join(env.dataDirectory, badOSLName) ||
+		fileErr.OSLID != badOSLID ||
+		fileErr.Err == nil {
+
+		t.Fatalf("unexpected fetch file error: %+v", fileErr)
+	}
+
+	if !strings.Contains(fileErr.Error(), badOSLName) ||
+		!strings.Contains(fileErr.Error(), badOSLID) {
+
+		t.Fatalf("unexpected fetch file error message: %s", fileErr)
+	}
+
+	// A corrupt common remote server list is reported with its filename and
+	// no OSL ID.
+
+	env.setFile(testCommonRemoteServerListName, []byte("corrupt"))
+
+	err = env.fetchCommon()
+	fileErr, ok = err.(FetchFileError)
+	if !ok {
+		t.Fatalf("unexpected fetch error: %v", err)
+	}
+
+	if fileErr.Filename != env.config.RemoteServerListDownloadFilename ||
+		fileErr.OSLID != "" {
+
+		t.Fatalf("unexpected fetch file error: %+v", fileErr)
+	}
+}
+
+func TestRemoteServerListNoticeMinimumSeverity(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	badOSLName := env.oslFileName(env.oslIDs[1])
+	badContents := append([]byte(nil), env.getFile(badOSLName)...)
+	badContents[len(badContents)-1] ^= 0xff
+	env.setFile(badOSLName, badContents)
+
+	setMinimumSeverity := func(severity string) {
+		env.config.RemoteServerListNoticeMinimumSeverity = severity
+		err := env.config.Commit()
+		if err != nil {
+			t.Fatalf("error committing configuration file: %s", err)
+		}
+	}
+
+	// At the Alert threshold, Info and download progress notices are
+	// suppressed while alerts pass.
+
+	setMinimumSeverity("Alert")
+
+	recorder := startTestNoticeRecorder()
+
+	err := env.fetch()
+	if _, ok := err.(FetchFileError); !ok {
+		t.Fatalf("unexpected fetch error: %v", err)
+	}
+
+	recorder.stop()
+
+	if recorder.count("Info") != 0 ||
+		recorder.count("RemoteServerListResourceDownloadedBytes") != 0 ||
+		recorder.count("RemoteServerListResourceDownloaded") != 0 {
+
+		t.Fatalf("unexpected Info notices at Alert threshold")
+	}
+
+	if recorder.count("Alert") == 0 {
+		t.Fatalf("missing Alert notices at Alert threshold")
+	}
+
+	// At the Error threshold, alerts are also suppressed, but the fetch
+	// error is still returned.
+
+	setMinimumSeverity("Error")
+
+	recorder = startTestNoticeRecorder()
+
+	err = env.fetch()
+	if _, ok := err.(FetchFileError); !ok {
+		t.Fatalf("unexpected fetch error: %v", err)
+	}
+
+	recorder.stop()
+
+	if recorder.count("Info") != 0 || recorder.count("Alert") != 0 {
+		t.Fatalf("unexpected notices at Error threshold")
+	}
+
+	env.config.RemoteServerListNoticeMinimumSeverity = "Debug"
+	err = env.config.Commit()
+	if err == nil {
+		t.Fatalf("unexpected commit success with invalid notice severity")
+	}
+}
+
+func TestGetAvailableServerRegions(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 3, 2)
+	defer env.close()
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	// Add a server entry which supports a different tunnel protocol and is
+	// in a region not otherwise present.
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"SSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	serverEntryFields, err := protocol.DecodeServerEntryFields(
+		encodedServerEntry, common.GetCurrentTimestamp(), protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryFields failed: %s", err)
+	}
+	err = StoreServerEntry(serverEntryFields, true)
+	if err != nil {
+		t.Fatalf("StoreServerEntry failed: %s", err)
+	}
+
+	// Expected regions are derived from the test environment server entry
+	// assignment: OSL i, entry j is in regions[(i+j)%len(regions)].
+
+	regions, err := GetAvailableServerRegions(nil)
+	if err != nil {
+		t.Fatalf("GetAvailableServerRegions failed: %s", err)
+	}
+	expectedRegions := []string{"CA", "DE", "GB", "JP", "US"}
+	if !reflect.DeepEqual(regions, expectedRegions) {
+		t.Fatalf("unexpected regions: %v", regions)
+	}
+
+	regions, err = GetAvailableServerRegions(
+		protocol.TunnelProtocols{protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH})
+	if err != nil {
+		t.Fatalf("GetAvailableServerRegions failed: %s", err)
+	}
+	expectedRegions = []string{"CA", "DE", "GB", "US"}
+	if !reflect.DeepEqual(regions, expectedRegions) {
+		t.Fatalf("unexpected regions: %v", regions)
+	}
+
+	regions, err = GetAvailableServerRegions(
+		protocol.TunnelProtocols{protocol.TUNNEL_PROTOCOL_SSH})
+	if err != nil {
+		t.Fatalf("GetAvailableServerRegions failed: %s", err)
+	}
+	expectedRegions = []string{"JP"}
+	if !reflect.DeepEqual(regions, expectedRegions) {
+		t.Fatalf("unexpected regions: %v", regions)
+	}
+}
+
+func TestServerEntryAvailabilityWindows(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 0)
+	defer env.close()
+
+	clock := &testClock{now: time.Date(2019, 1, 1, 20, 0, 0, 0, time.UTC)}
+	env.config.Clock = clock
+
+	// Reopen the datastore with the test config, so that
+	// GetAvailableServerRegions applies the test clock.
+
+	CloseDataStore()
+	err := OpenDataStore(env.config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	// Store a server entry which is only available during the day, and a
+	// server entry with a window spanning midnight. Both support tactics, so
+	// that the tactics server entry iterator is also checked.
+
+	serverEntries := []*protocol.ServerEntry{
+		{
+			IpAddress:         "192.0.2.100",
+			Capabilities:      []string{"OSSH", "UNFRONTED-MEEK-TACTICS"},
+			SshObfuscatedPort: 4001,
+			Region:            "JP",
+			AvailabilityWindows: []protocol.AvailabilityWindow{
+				{Start: "09:00", End: "17:00"},
+			},
+		},
+		{
+			IpAddress:         "192.0.2.101",
+			Capabilities:      []string{"OSSH", "UNFRONTED-MEEK-TACTICS"},
+			SshObfuscatedPort: 4001,
+			Region:            "US",
+			AvailabilityWindows: []protocol.AvailabilityWindow{
+				{Start: "18:00", End: "06:00"},
+			},
+		},
+	}
+	for _, serverEntry := range serverEntries {
+		encodedServerEntry, err := protocol.EncodeServerEntry(serverEntry)
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			encodedServerEntry, common.GetCurrentTimestamp(), protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		err = StoreServerEntry(serverEntryFields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	checkAvailable := func(expectedRegions []string, expectedIPAddresses []string) {
+
+		regions, err := GetAvailableServerRegions(nil)
+		if err != nil {
+			t.Fatalf("GetAvailableServerRegions failed: %s", err)
+		}
+		if !reflect.DeepEqual(regions, expectedRegions) {
+			t.Fatalf("unexpected regions: %v", regions)
+		}
+
+		_, iterator, err := NewServerEntryIterator(env.config)
+		if err != nil {
+			t.Fatalf("NewServerEntryIterator failed: %s", err)
+		}
+		defer iterator.Close()
+
+		var ipAddresses []string
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("ServerEntryIterator.Next failed: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+		}
+		sort.Strings(ipAddresses)
+		if !reflect.DeepEqual(ipAddresses, expectedIPAddresses) {
+			t.Fatalf("unexpected iterated server entries: %v", ipAddresses)
+		}
+
+		tacticsIterator, err := NewTacticsServerEntryIterator(env.config)
+		if err != nil {
+			t.Fatalf("NewTacticsServerEntryIterator failed: %s", err)
+		}
+		defer tacticsIterator.Close()
+
+		ipAddresses = nil
+		for {
+			serverEntry, err := tacticsIterator.Next()
+			if err != nil {
+				t.Fatalf("ServerEntryIterator.Next failed: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+		}
+		sort.Strings(ipAddresses)
+		if !reflect.DeepEqual(ipAddresses, expectedIPAddresses) {
+			t.Fatalf("unexpected iterated tactics server entries: %v", ipAddresses)
+		}
+	}
+
+	// At 20:00, only the server entry with the overnight window is
+	// available.
+
+	checkAvailable([]string{"US"}, []string{"192.0.2.101"})
+
+	// At 12:00 the following day, only the daytime server entry is
+	// available.
+
+	clock.advance(16 * time.Hour)
+
+	checkAvailable([]string{"JP"}, []string{"192.0.2.100"})
+
+	// At 17:00, the daytime window has ended and the overnight window has
+	// not yet started.
+
+	clock.advance(5 * time.Hour)
+
+	checkAvailable([]string{}, nil)
+}
+
+func TestGetFrontedServerEntries(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	// Import, via the common remote server list, server entries addressed
+	// by domain name through each form of fronting address, a fronted
+	// server entry with no fronting address, and a server entry which isn't
+	// fronted.
+
+	serverEntries := []*protocol.ServerEntry{
+		{
+			IpAddress:             "192.0.2.100",
+			Capabilities:          []string{"FRONTED-MEEK", "OSSH"},
+			Region:                "JP",
+			MeekFrontingAddresses: []string{"a.example.com", "b.example.com"},
+			MeekFrontingHosts:     []string{"host.example.com"},
+		},
+		{
+			IpAddress:          "192.0.2.101",
+			Capabilities:       []string{"FRONTED-MEEK"},
+			Region:             "KR",
+			MeekFrontingDomain: "a.example.com",
+		},
+		{
+			IpAddress:                  "192.0.2.102",
+			Capabilities:               []string{"FRONTED-MEEK"},
+			Region:                     "JP",
+			MeekFrontingAddressesRegex: "[a-z]\\.example\\.com",
+		},
+		{
+			IpAddress:    "192.0.2.103",
+			Capabilities: []string{"FRONTED-MEEK"},
+			Region:       "NZ",
+		},
+		{
+			IpAddress:             "192.0.2.104",
+			Capabilities:          []string{"OSSH"},
+			Region:                "JP",
+			MeekFrontingAddresses: []string{"a.example.com"},
+		},
+	}
+
+	encodedServerEntries := make([]string, len(serverEntries))
+	for i, serverEntry := range serverEntries {
+		encodedServerEntry, err := protocol.EncodeServerEntry(serverEntry)
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		encodedServerEntries[i] = encodedServerEntry
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		strings.Join(encodedServerEntries, "\n"),
+		testOSLSigningPublicKey,
+		testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	// The fronting addresses are stored as imported.
+
+	storedServerEntries := getTestStoredServerEntryFields(t)
+	for _, serverEntry := range serverEntries {
+		storedServerEntry, ok := storedServerEntries[serverEntry.IpAddress]
+		if !ok {
+			t.Fatalf("missing stored server entry: %s", serverEntry.IpAddress)
+		}
+		storedFrontingAddresses, _ := storedServerEntry["meekFrontingAddresses"].([]interface{})
+		if len(storedFrontingAddresses) != len(serverEntry.MeekFrontingAddresses) {
+			t.Fatalf("unexpected stored fronting addresses: %+v", storedServerEntry)
+		}
+		if storedServerEntry["meekFrontingDomain"] != serverEntry.MeekFrontingDomain ||
+			storedServerEntry["meekFrontingAddressesRegex"] != serverEntry.MeekFrontingAddressesRegex {
+			t.Fatalf("unexpected stored fronting domain: %+v", storedServerEntry)
+		}
+	}
+
+	getIPAddresses := func(
+		frontingAddress, region string, limitTunnelProtocols protocol.TunnelProtocols) []string {
+
+		frontedServerEntries, err := GetFrontedServerEntries(
+			frontingAddress, region, limitTunnelProtocols)
+		if err != nil {
+			t.Fatalf("GetFrontedServerEntries failed: %s", err)
+		}
+		ipAddresses := make([]string, 0)
+		for _, serverEntry := range frontedServerEntries {
+			ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+		}
+		sort.Strings(ipAddresses)
+		return ipAddresses
+	}
+
+	testCases := []struct {
+		frontingAddress      string
+		region               string
+		limitTunnelProtocols protocol.TunnelProtocols
+		expectedIPAddresses  []string
+	}{
+		{"a.example.com", "", nil, []string{"192.0.2.100", "192.0.2.101", "192.0.2.102"}},
+		{"B.example.com", "", nil, []string{"192.0.2.100", "192.0.2.102"}},
+		{"ab.example.com", "", nil, []string{}},
+		{"a.example.com", "JP", nil, []string{"192.0.2.100", "192.0.2.102"}},
+		{"a.example.com", "KR", nil, []string{"192.0.2.101"}},
+		{
+			"a.example.com", "",
+			protocol.TunnelProtocols{protocol.TUNNEL_PROTOCOL_FRONTED_MEEK},
+			[]string{"192.0.2.100", "192.0.2.101", "192.0.2.102"},
+		},
+		{
+			"a.example.com", "",
+			protocol.TunnelProtocols{protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH},
+			[]string{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		ipAddresses := getIPAddresses(
+			testCase.frontingAddress, testCase.region, testCase.limitTunnelProtocols)
+		if !reflect.DeepEqual(ipAddresses, testCase.expectedIPAddresses) {
+			t.Fatalf("unexpected fronted server entries for %+v: %v", testCase, ipAddresses)
+		}
+	}
+
+	// The fronted server entry with no fronting address, which can't be
+	// dialed, doesn't make its region available for fronted tunnel
+	// protocols.
+
+	regions, err := GetAvailableServerRegions(
+		protocol.TunnelProtocols{protocol.TUNNEL_PROTOCOL_FRONTED_MEEK})
+	if err != nil {
+		t.Fatalf("GetAvailableServerRegions failed: %s", err)
+	}
+	expectedRegions := []string{"JP", "KR"}
+	if !reflect.DeepEqual(regions, expectedRegions) {
+		t.Fatalf("unexpected regions: %v", regions)
+	}
+}
+
+func TestChunkedCommonRemoteServerList(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	chunkSize := 256
+
+	var encodedServerEntries []string
+	for i := 0; i < 10; i++ {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:    fmt.Sprintf("192.0.2.%d", 100+i),
+				Capabilities: []string{"OSSH"},
+				Region:       "JP",
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+	}
+	serverEntryList := strings.Join(encodedServerEntries, "\n")
+	if len(serverEntryList) < 4*chunkSize {
+		t.Fatalf("unexpected server entry list size: %d", len(serverEntryList))
+	}
+
+	commonRemoteServerList, err := common.WriteChunkedAuthenticatedDataPackage(
+		serverEntryList,
+		nil,
+		chunkSize,
+		testOSLSigningPublicKey,
+		testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteChunkedAuthenticatedDataPackage failed: %s", err)
+	}
+
+	// When a chunk of the common remote server list is tampered with, the
+	// fetch fails, and the server entries read from the preceding, verified
+	// chunks are imported. The server entry spanning the tampered chunk, and
+	// all following server entries, are not.
+
+	_, headerLength, err := common.ParseAuthenticatedDataPackageFormat(commonRemoteServerList)
+	if err != nil {
+		t.Fatalf("ParseAuthenticatedDataPackageFormat failed: %s", err)
+	}
+	packageJSON, err := common.Decompress(commonRemoteServerList[headerLength:])
+	if err != nil {
+		t.Fatalf("Decompress failed: %s", err)
+	}
+	tamperedChunk := len(serverEntryList) / chunkSize / 2
+	tamperedOffset := tamperedChunk*chunkSize + 1
+	encodedPrefix, err := json.Marshal(serverEntryList[:tamperedOffset])
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	dataField := []byte(`"data":"`)
+	index := bytes.Index(packageJSON, dataField) + len(dataField) + len(encodedPrefix) - 2
+	if packageJSON[index] != serverEntryList[tamperedOffset] {
+		t.Fatalf("unexpected package data")
+	}
+	packageJSON[index] ^= 0x01
+	tamperedCommonRemoteServerList := append(
+		append([]byte(nil), commonRemoteServerList[:headerLength]...),
+		common.Compress(packageJSON)...)
+
+	verifiedCount := 0
+	offset := 0
+	for _, encodedServerEntry := range encodedServerEntries {
+		offset += len(encodedServerEntry)
+		if offset >= tamperedChunk*chunkSize {
+			break
+		}
+		verifiedCount += 1
+		offset += 1
+	}
+	if verifiedCount == 0 || verifiedCount == len(encodedServerEntries) {
+		t.Fatalf("unexpected verified server entry count: %d", verifiedCount)
+	}
+
+	env.setFile(testCommonRemoteServerListName, tamperedCommonRemoteServerList)
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("fetchCommon unexpectedly succeeded")
+	}
+
+	storedServerEntries := getTestStoredServerEntryFields(t)
+	if len(storedServerEntries) != verifiedCount {
+		t.Fatalf("unexpected stored server entry count: %d", len(storedServerEntries))
+	}
+	for i := 0; i < verifiedCount; i++ {
+		ipAddress := fmt.Sprintf("192.0.2.%d", 100+i)
+		if storedServerEntries[ipAddress] == nil {
+			t.Fatalf("missing stored server entry: %s", ipAddress)
+		}
+	}
+
+	// A chunked common remote server list is verified and imported.
+
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	if count := len(getTestStoredServerEntryFields(t)); count != len(encodedServerEntries) {
+		t.Fatalf("unexpected stored server entry count: %d", count)
+	}
+}
+
+func TestObfuscatedServerListPrioritizedDownloads(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 5, 1)
+	defer env.close()
+	env.downloadSequentially()
+
+	priorities := []int{1, 3, 0, 3, 1}
+	for i, scheme := range env.oslConfig.Schemes {
+		scheme.OSLPriority = priorities[i]
+	}
+	env.pave()
+
+	err := env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.ObfuscatedServerListPrioritizeDownloads: true,
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	// Expect descending priority, with ties in ascending OSL ID order. OSL
+	// IDs are hex encoded, so string order is ID byte order.
+
+	indexes := []int{0, 1, 2, 3, 4}
+	sort.Slice(indexes, func(i, j int) bool {
+		a, b := indexes[i], indexes[j]
+		if priorities[a] != priorities[b] {
+			return priorities[a] > priorities[b]
+		}
+		return env.oslIDs[a] < env.oslIDs[b]
+	})
+
+	var expectedOrder []string
+	for _, index := range indexes {
+		expectedOrder = append(expectedOrder, env.oslFileName(env.oslIDs[index]))
+	}
+
+	order := env.oslRequestOrder()
+	if !reflect.DeepEqual(order, expectedOrder) {
+		t.Fatalf("unexpected download order: %v, expected %v", order, expectedOrder)
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestObfuscatedServerListRecentlySeededFirst(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 5, 1)
+	defer env.close()
+	env.downloadSequentially()
+
+	// Paved file specs include seed timestamps when the scheme sets
+	// OSLSeedTimestamps.
+
+	for _, scheme := range env.oslConfig.Schemes {
+		scheme.OSLSeedTimestamps = true
+	}
+	env.pave()
+
+	// Replace the paved seed timestamps with distinct seed timestamps,
+	// omitting one.
+
+	now := time.Now().UTC()
+	seedTimestamps := []string{
+		now.Add(-3 * time.Hour).Format(time.RFC3339),
+		now.Format(time.RFC3339),
+		"",
+		now.Add(-1 * time.Hour).Format(time.RFC3339),
+		now.Add(-2 * time.Hour).Format(time.RFC3339),
+	}
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		for i, fileSpec := range registry.FileSpecs {
+			_, err := time.Parse(time.RFC3339, fileSpec.SeedTimestamp)
+			if err != nil {
+				t.Fatalf("unexpected paved seed timestamp: %s", fileSpec.SeedTimestamp)
+			}
+			fileSpec.SeedTimestamp = seedTimestamps[i]
+		}
+	})
+
+	err := env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.ObfuscatedServerListRecentlySeededFirst: true,
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	// Expect descending seed timestamp, with the OSL without a seed
+	// timestamp last.
+
+	var expectedOrder []string
+	for _, index := range []int{1, 3, 4, 0, 2} {
+		expectedOrder = append(expectedOrder, env.oslFileName(env.oslIDs[index]))
+	}
+
+	order := env.oslRequestOrder()
+	if !reflect.DeepEqual(order, expectedOrder) {
+		t.Fatalf("unexpected download order: %v, expected %v", order, expectedOrder)
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestObfuscatedServerListDownloadOnly(t *testing.T) {
+
+	t.Run("explicit import", func(t *testing.T) {
+		testObfuscatedServerListDownloadOnly(t, true)
+	})
+
+	t.Run("import on fetch", func(t *testing.T) {
+		testObfuscatedServerListDownloadOnly(t, false)
+	})
+}
+
+func testObfuscatedServerListDownloadOnly(t *testing.T, explicitImport bool) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	// Download-only leaves the validated OSL files staged, without importing
+	// any server entries.
+
+	err := DownloadObfuscatedServerLists(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("DownloadObfuscatedServerLists failed: %s", err)
+	}
+
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	for _, oslID := range env.oslIDs {
+		_, err := os.Stat(filepath.Join(env.dataDirectory, env.oslFileName(oslID)))
+		if err != nil {
+			t.Fatalf("missing staged OSL file: %s", err)
+		}
+	}
+
+	records, err := getOSLPendingImportRecords()
+	if err != nil {
+		t.Fatalf("getOSLPendingImportRecords failed: %s", err)
+	}
+	if len(records) != len(env.oslIDs) {
+		t.Fatalf("unexpected pending import count: %d", len(records))
+	}
+
+	// Staged OSLs aren't downloaded again.
+
+	err = DownloadObfuscatedServerLists(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("DownloadObfuscatedServerLists failed: %s", err)
+	}
+
+	for _, oslID := range env.oslIDs {
+		if env.requestCount(env.oslFileName(oslID)) != 1 {
+			t.Fatalf("unexpected OSL download count")
+		}
+	}
+
+	// The later import, or a regular fetch, stores the staged server entries.
+
+	if explicitImport {
+		err = ImportDownloadedObfuscatedServerLists(env.config)
+		if err != nil {
+			t.Fatalf("ImportDownloadedObfuscatedServerLists failed: %s", err)
+		}
+	} else {
+		err = env.fetch()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	for i, oslID := range env.oslIDs {
+		provenance, err := GetServerEntryProvenance(fmt.Sprintf("192.0.%d.1", i+1))
+		if err != nil {
+			t.Fatalf("GetServerEntryProvenance failed: %s", err)
+		}
+		if provenance == nil ||
+			provenance.Source != protocol.SERVER_ENTRY_SOURCE_OBFUSCATED ||
+			provenance.OSLID != oslID {
+
+			t.Fatalf("unexpected provenance: %+v", provenance)
+		}
+	}
+
+	records, err = getOSLPendingImportRecords()
+	if err != nil {
+		t.Fatalf("getOSLPendingImportRecords failed: %s", err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("unexpected pending import count: %d", len(records))
+	}
+}
+
+func TestImportDownloadedObfuscatedServerListsFailure(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	err := env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.RemoteServerListSkipIdenticalContent:  true,
+			parameters.ObfuscatedServerListSkipImportedFiles: true,
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = DownloadObfuscatedServerLists(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("DownloadObfuscatedServerLists failed: %s", err)
+	}
+
+	records, err := getOSLPendingImportRecords()
+	if err != nil {
+		t.Fatalf("getOSLPendingImportRecords failed: %s", err)
+	}
+	if len(records) != len(env.oslIDs) {
+		t.Fatalf("unexpected pending import count: %d", len(records))
+	}
+
+	// Without the SLOKs, the staged OSL files fail to import, and aren't
+	// recorded as imported.
+
+	err = DeleteSLOKs()
+	if err != nil {
+		t.Fatalf("DeleteSLOKs failed: %s", err)
+	}
+
+	err = ImportDownloadedObfuscatedServerLists(env.config)
+	if _, ok := err.(FetchFileError); !ok {
+		t.Fatalf("unexpected ImportDownloadedObfuscatedServerLists result: %v", err)
+	}
+
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	for _, record := range records {
+		md5Sum, err := getOSLImportedMD5Sum(record.CanonicalURL)
+		if err != nil {
+			t.Fatalf("getOSLImportedMD5Sum failed: %s", err)
+		}
+		if md5Sum != nil {
+			t.Fatalf("unexpected imported MD5 sum")
+		}
+	}
+
+	importTimes, err := getOSLImportTimes()
+	if err != nil {
+		t.Fatalf("getOSLImportTimes failed: %s", err)
+	}
+	if len(importTimes) != 0 {
+		t.Fatalf("unexpected import time count: %d", len(importTimes))
+	}
+
+	// Once the SLOKs arrive, the identical OSL files are downloaded again and
+	// imported, and aren't skipped as identical to imported content or as
+	// already imported with the registry MD5 sum.
+
+	env.seedSLOKs()
+
+	results, err := FetchObfuscatedServerListsWithResults(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("FetchObfuscatedServerListsWithResults failed: %s", err)
+	}
+
+	if len(results) != len(env.oslIDs) {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	for _, result := range results {
+		if !result.Downloaded || result.Skipped || result.NewEntries != 1 || result.Err != nil {
+			t.Fatalf("unexpected result: %+v", result)
+		}
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestObfuscatedServerListMaxRetainedFiles(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 4, 1)
+	defer env.close()
+
+	// Without a cap, all imported OSL files are retained.
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	oslIDs := make([][]byte, len(env.oslIDs))
+	for i, hexID := range env.oslIDs {
+		_, err := os.Stat(filepath.Join(env.dataDirectory, env.oslFileName(hexID)))
+		if err != nil {
+			t.Fatalf("missing OSL file: %s", err)
+		}
+		oslIDs[i], _ = hex.DecodeString(hexID)
+	}
+
+	// Order the import times, oldest first. Clearing the ETag of the oldest
+	// OSL causes the download-only fetch to stage it for a pending import,
+	// so that its file is still needed.
+
+	importTime := time.Now().Add(-time.Hour)
+	for _, oslID := range oslIDs {
+		err = setOSLImportTime(oslID, importTime)
+		if err != nil {
+			t.Fatalf("setOSLImportTime failed: %s", err)
+		}
+		importTime = importTime.Add(time.Minute)
+	}
+
+	err = SetUrlETag(osl.GetOSLFileURL(env.server.URL+"/", oslIDs[0]), "")
+	if err != nil {
+		t.Fatalf("SetUrlETag failed: %s", err)
+	}
+
+	maxRetainedFiles := 2
+
+	err = env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.ObfuscatedServerListMaxRetainedFiles: maxRetainedFiles,
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	// The least recently imported files, other than the pending OSL file,
+	// are evicted down to the cap.
+
+	err = DownloadObfuscatedServerLists(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("DownloadObfuscatedServerLists failed: %s", err)
+	}
+
+	records, err := getOSLPendingImportRecords()
+	if err != nil {
+		t.Fatalf("getOSLPendingImportRecords failed: %s", err)
+	}
+	if len(records) != 1 || !bytes.Equal(records[0].FileSpec.ID, oslIDs[0]) {
+		t.Fatalf("unexpected pending import records: %+v", records)
+	}
+
+	expectedRetained := []bool{true, false, false, true}
+
+	checkRetained := func() {
+		for i, hexID := range env.oslIDs {
+			_, err := os.Stat(filepath.Join(env.dataDirectory, env.oslFileName(hexID)))
+			if expectedRetained[i] != (err == nil) {
+				t.Fatalf("unexpected OSL file %d state: %v", i, err)
+			}
+		}
+	}
+
+	checkRetained()
+
+	importTimes, err := getOSLImportTimes()
+	if err != nil {
+		t.Fatalf("getOSLImportTimes failed: %s", err)
+	}
+	if len(importTimes) != maxRetainedFiles ||
+		!bytes.Equal(importTimes[0].OSLID, oslIDs[0]) ||
+		!bytes.Equal(importTimes[1].OSLID, oslIDs[3]) {
+
+		t.Fatalf("unexpected import times: %+v", importTimes)
+	}
+
+	// The server entries in evicted files remain stored, and evicted OSLs,
+	// which are unchanged, aren't downloaded again. The fetch imports the
+	// pending OSL file, which is then the most recently imported.
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	for i, hexID := range env.oslIDs {
+		expectedCount := 1
+		if i == 0 {
+			expectedCount = 2
+		}
+		if env.requestCount(env.oslFileName(hexID)) != expectedCount {
+			t.Fatalf("unexpected OSL download count")
+		}
+	}
+
+	importTimes, err = getOSLImportTimes()
+	if err != nil {
+		t.Fatalf("getOSLImportTimes failed: %s", err)
+	}
+	if len(importTimes) != maxRetainedFiles ||
+		!bytes.Equal(importTimes[1].OSLID, oslIDs[0]) {
+
+		t.Fatalf("unexpected import times: %+v", importTimes)
+	}
+
+	checkRetained()
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestObfuscatedServerListDuplicateContent(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 2)
+	defer env.close()
+
+	// Misconfigure the registry to advertise the same OSL file under a
+	// second OSL ID.
+
+	var duplicateFileSpec osl.OSLFileSpec
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		duplicateFileSpec = *registry.FileSpecs[0]
+		duplicateFileSpec.ID, _ = common.MakeSecureRandomBytes(len(duplicateFileSpec.ID))
+		registry.FileSpecs = append(registry.FileSpecs, &duplicateFileSpec)
+	})
+
+	oslName := env.oslFileName(env.oslIDs[0])
+	duplicateOSLName := env.oslFileName(hex.EncodeToString(duplicateFileSpec.ID))
+	env.setFile(duplicateOSLName, env.getFile(oslName))
+
+	importCount := 0
+	env.config.OnValidatedPayload = func(_ string, _ []byte) {
+		importCount += 1
+	}
+
+	// Both OSL files are downloaded, but the payload is imported once.
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(oslName) != 1 || env.requestCount(duplicateOSLName) != 1 {
+		t.Fatalf("unexpected OSL request order: %+v", env.oslRequestOrder())
+	}
+	if importCount != 1 {
+		t.Fatalf("unexpected import count: %d", importCount)
+	}
+	if CountServerEntries() != 2 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Both OSLs are linked to the import, and neither is downloaded again.
+
+	for _, name := range []string{oslName, duplicateOSLName} {
+		etag, err := GetUrlETag(env.server.URL + "/" + name)
+		if err != nil {
+			t.Fatalf("GetUrlETag failed: %s", err)
+		}
+		if etag == "" {
+			t.Fatalf("missing ETag for %s", name)
+		}
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(oslName) != 1 || env.requestCount(duplicateOSLName) != 1 {
+		t.Fatalf("unexpected OSL request order: %+v", env.oslRequestOrder())
+	}
+	if importCount != 1 {
+		t.Fatalf("unexpected import count: %d", importCount)
+	}
+}
+
+func TestObfuscatedServerListSharedCache(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 2)
+	defer env.close()
+
+	sharedCacheDirectory := filepath.Join(env.dataDirectory, "shared")
+	env.config.ObfuscatedServerListSharedCacheDirectory = sharedCacheDirectory
+
+	// Advertise the same OSL file under a second OSL ID.
+
+	var duplicateFileSpec osl.OSLFileSpec
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		duplicateFileSpec = *registry.FileSpecs[0]
+		duplicateFileSpec.ID, _ = common.MakeSecureRandomBytes(len(duplicateFileSpec.ID))
+		registry.FileSpecs = append(registry.FileSpecs, &duplicateFileSpec)
+	})
+
+	oslIDs := []string{env.oslIDs[0], hex.EncodeToString(duplicateFileSpec.ID)}
+	oslName := env.oslFileName(oslIDs[0])
+	duplicateOSLName := env.oslFileName(oslIDs[1])
+	env.setFile(duplicateOSLName, env.getFile(oslName))
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(oslName) != 1 || env.requestCount(duplicateOSLName) != 1 {
+		t.Fatalf("unexpected OSL request order: %+v", env.oslRequestOrder())
+	}
+
+	// Both OSL IDs are indexed to one cached file, named by its content
+	// digest.
+
+	contentDigest := fmt.Sprintf("%x", sha256.Sum256(env.getFile(oslName)))
+
+	for _, oslID := range oslIDs {
+		digest, err := ioutil.ReadFile(
+			filepath.Join(sharedCacheDirectory, oslSharedCacheIndexDirectory, oslID))
+		if err != nil {
+			t.Fatalf("ReadFile failed: %s", err)
+		}
+		if string(digest) != contentDigest {
+			t.Fatalf("unexpected index digest: %s", digest)
+		}
+	}
+
+	fileInfos, err := ioutil.ReadDir(sharedCacheDirectory)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %s", err)
+	}
+	var cachedFilenames []string
+	for _, fileInfo := range fileInfos {
+		if !fileInfo.IsDir() {
+			cachedFilenames = append(cachedFilenames, fileInfo.Name())
+		}
+	}
+	if len(cachedFilenames) != 1 || cachedFilenames[0] != contentDigest {
+		t.Fatalf("unexpected cached files: %v", cachedFilenames)
+	}
+
+	// Simulate another profile, with its own datastore and download
+	// directory, sharing the cache. Only the registry is downloaded, and the
+	// cached OSL file is imported.
+
+	CloseDataStore()
+
+	profileDirectory := filepath.Join(env.dataDirectory, "profile")
+	err = os.Mkdir(profileDirectory, 0700)
+	if err != nil {
+		t.Fatalf("Mkdir failed: %s", err)
+	}
+	err = OpenDataStore(&Config{DataStoreDirectory: profileDirectory})
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	env.seedSLOKs()
+	env.config.ObfuscatedServerListDownloadDirectory = profileDirectory
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(osl.REGISTRY_FILENAME) != 2 ||
+		env.requestCount(oslName) != 1 || env.requestCount(duplicateOSLName) != 1 {
+
+		t.Fatalf("unexpected OSL request order: %+v", env.oslRequestOrder())
+	}
+	if CountServerEntries() != 2 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// A cached file which doesn't match the registry MD5Sum isn't used, and
+	// the OSL file is requested.
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		registry.FileSpecs[0].MD5Sum = make([]byte, md5.Size)
+	})
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(oslName) != 2 {
+		t.Fatalf("unexpected OSL request order: %+v", env.oslRequestOrder())
+	}
+}
+
+func TestObfuscatedServerListConditionalRequestNotice(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	// Weak ETags never match the registry MD5Sum, so each fetch sends a
+	// conditional request for the OSL.
+
+	env.mutex.Lock()
+	env.weakETags = true
+	env.mutex.Unlock()
+
+	oslID := env.oslIDs[0]
+	oslName := env.oslFileName(oslID)
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	fetchAndCheck := func(expectedCacheHit bool, expectedStatusCodes ...int) {
+
+		requestCount := env.requestCount(oslName)
+		noticeCount := len(recorder.payloads("ObfuscatedServerListConditionalRequest"))
+
+		err := env.fetch()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+
+		if env.requestCount(oslName) != requestCount+1 {
+			t.Fatalf("unexpected OSL request count: %d", env.requestCount(oslName))
+		}
+
+		md5sum := md5.Sum(env.getFile(oslName))
+		expectedETag := fmt.Sprintf("W/\"%s\"", hex.EncodeToString(md5sum[:]))
+		if expectedCacheHit {
+			storedETag, err := GetUrlETag(env.server.URL + "/" + oslName)
+			if err != nil {
+				t.Fatalf("GetUrlETag failed: %s", err)
+			}
+			expectedETag = storedETag
+		}
+
+		payloads := recorder.payloads("ObfuscatedServerListConditionalRequest")
+		if len(payloads) != noticeCount+1 {
+			t.Fatalf("unexpected conditional request notices: %+v", payloads)
+		}
+		payload := payloads[noticeCount]
+
+		expectedStatusCode := false
+		for _, statusCode := range expectedStatusCodes {
+			if payload["statusCode"] == float64(statusCode) {
+				expectedStatusCode = true
+			}
+		}
+
+		if payload["oslID"] != oslID ||
+			payload["cacheHit"] != expectedCacheHit ||
+			!expectedStatusCode ||
+			payload["etag"] != expectedETag {
+
+			t.Fatalf("unexpected conditional request notice: %+v", payload)
+		}
+	}
+
+	// The first download is a cache miss. The request is a range request
+	// from offset 0, which the host may answer with 200 or 206.
+
+	fetchAndCheck(false, http.StatusOK, http.StatusPartialContent)
+
+	// The unchanged OSL is a cache hit, via If-None-Match.
+
+	fetchAndCheck(true, http.StatusNotModified)
+
+	// A changed OSL is a cache miss, reporting the new ETag.
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.101",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	env.serverEntries[oslID] = append(env.serverEntries[oslID], encodedServerEntry)
+	env.pave()
+
+	fetchAndCheck(false, http.StatusOK, http.StatusPartialContent)
+
+	// When the stored ETag matches the registry MD5Sum, no request is sent
+	// and no notice is emitted.
+
+	canonicalURL := env.server.URL + "/" + oslName
+	md5sum := md5.Sum(env.getFile(oslName))
+	err = SetUrlETag(canonicalURL, fmt.Sprintf("\"%s\"", hex.EncodeToString(md5sum[:])))
+	if err != nil {
+		t.Fatalf("SetUrlETag failed: %s", err)
+	}
+
+	requestCount := env.requestCount(oslName)
+	noticeCount := len(recorder.payloads("ObfuscatedServerListConditionalRequest"))
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(oslName) != requestCount ||
+		len(recorder.payloads("ObfuscatedServerListConditionalRequest")) != noticeCount {
+		t.Fatalf("unexpected conditional request")
+	}
+}
+
+func TestObfuscatedServerListEncryptedCapabilities(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 0)
+	defer env.close()
+
+	oslID := env.oslIDs[0]
+
+	var fileSpec osl.OSLFileSpec
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		fileSpec = *registry.FileSpecs[0]
+	})
+
+	key, err := fileSpec.ServerEntryCapabilitiesKey(
+		func(slokID []byte) []byte {
+			key, _ := GetSLOK(slokID)
+			return key
+		})
+	if err != nil {
+		t.Fatalf("ServerEntryCapabilitiesKey failed: %s", err)
+	}
+
+	otherKey, err := common.MakeSecureRandomBytes(osl.KEY_LENGTH_BYTES)
+	if err != nil {
+		t.Fatalf("MakeSecureRandomBytes failed: %s", err)
+	}
+
+	encodeServerEntry := func(
+		ipAddress string, capabilities []interface{}, key []byte) string {
+
+		encryptedCapabilities, err := osl.EncryptServerEntryCapabilities(
+			key, []string{"FRONTED-MEEK-OSSH"})
+		if err != nil {
+			t.Fatalf("EncryptServerEntryCapabilities failed: %s", err)
+		}
+		encodedServerEntry, err := protocol.EncodeServerEntryFields(
+			protocol.ServerEntryFields{
+				"ipAddress":             ipAddress,
+				"webServerPort":         "8000",
+				"webServerSecret":       "secret",
+				"sshObfuscatedPort":     4001,
+				"capabilities":          capabilities,
+				"region":                "US",
+				"encryptedCapabilities": encryptedCapabilities,
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntryFields failed: %s", err)
+		}
+		return encodedServerEntry
+	}
+
+	// One server entry has capabilities encrypted to the OSL key. Another
+	// has capabilities encrypted to a key the client doesn't have, and no
+	// unencrypted capabilities.
+
+	env.serverEntries[oslID] = []string{
+		encodeServerEntry("192.0.2.1", []interface{}{"OSSH"}, key),
+		encodeServerEntry("192.0.2.2", []interface{}{}, otherKey),
+	}
+	env.pave()
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	storedServerEntries := getTestStoredServerEntryFields(t)
+	if len(storedServerEntries) != 2 {
+		t.Fatalf("unexpected stored server entries: %+v", storedServerEntries)
+	}
+
+	// The decrypted capabilities are stored, and the encrypted capabilities
+	// aren't.
+
+	capabilities, _ := storedServerEntries["192.0.2.1"]["capabilities"].([]interface{})
+	if fmt.Sprintf("%v", capabilities) != "[OSSH FRONTED-MEEK-OSSH]" ||
+		storedServerEntries["192.0.2.1"].GetEncryptedCapabilities() != "" {
+
+		t.Fatalf("unexpected decrypted server entry: %+v", storedServerEntries["192.0.2.1"])
+	}
+
+	// The undecryptable server entry is kept, with no capabilities, and its
+	// encrypted capabilities are retained.
+
+	capabilities, _ = storedServerEntries["192.0.2.2"]["capabilities"].([]interface{})
+	if len(capabilities) != 0 ||
+		storedServerEntries["192.0.2.2"].GetEncryptedCapabilities() == "" {
+
+		t.Fatalf("unexpected undecrypted server entry: %+v", storedServerEntries["192.0.2.2"])
+	}
+
+	payloads := recorder.payloads("ServerEntriesWithUndecryptedCapabilities")
+	if len(payloads) != 1 || payloads[0]["count"] != float64(1) {
+		t.Fatalf("unexpected undecrypted capabilities notices: %+v", payloads)
+	}
+}
+
+func TestObfuscatedServerListUnknownServerEntryFields(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 0)
+	defer env.close()
+
+	oslID := env.oslIDs[0]
+
+	// The OSL server entries carry fields this client doesn't recognize, as
+	// server entries issued for newer clients may.
+
+	encodeServerEntry := func(ipAddress string) string {
+		encodedServerEntry, err := protocol.EncodeServerEntryFields(
+			protocol.ServerEntryFields{
+				"ipAddress":         ipAddress,
+				"webServerPort":     "8000",
+				"webServerSecret":   "secret",
+				"sshObfuscatedPort": 4001,
+				"capabilities":      []interface{}{"OSSH"},
+				"region":            "US",
+				"futureString":      "value",
+				"futureObject":      map[string]interface{}{"nested": []interface{}{1, "two"}},
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntryFields failed: %s", err)
+		}
+		return encodedServerEntry
+	}
+
+	env.serverEntries[oslID] = []string{
+		encodeServerEntry("192.0.2.1"),
+		encodeServerEntry("192.0.2.2"),
+	}
+	env.pave()
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	// The unknown fields are stored along with the recognized fields, for
+	// use after a client upgrade.
+
+	storedServerEntries := getTestStoredServerEntryFields(t)
+	if len(storedServerEntries) != 2 {
+		t.Fatalf("unexpected stored server entries: %+v", storedServerEntries)
+	}
+	for ipAddress, serverEntryFields := range storedServerEntries {
+		if serverEntryFields["futureString"] != "value" ||
+			fmt.Sprintf("%v", serverEntryFields["futureObject"]) != "map[nested:[1 two]]" {
+
+			t.Fatalf("unexpected stored server entry %s: %+v", ipAddress, serverEntryFields)
+		}
+	}
+
+	// The stored server entries are usable as ServerEntry.
+
+	_, iterator, err := NewServerEntryIterator(env.config)
+	if err != nil {
+		t.Fatalf("NewServerEntryIterator failed: %s", err)
+	}
+	defer iterator.Close()
+
+	count := 0
+	for {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("ServerEntryIterator.Next failed: %s", err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		if serverEntry.SshObfuscatedPort != 4001 || serverEntry.Region != "US" {
+			t.Fatalf("unexpected server entry: %+v", serverEntry)
+		}
+		count += 1
+	}
+	if count != 2 {
+		t.Fatalf("unexpected iterated server entry count: %d", count)
+	}
+}
+
+func TestObfuscatedServerListEmbeddedOSLID(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	for _, scheme := range env.oslConfig.Schemes {
+		scheme.EmbedOSLIDs = true
+	}
+	env.pave()
+
+	// Simulate a mirror serving the first OSL file at the second OSL's URL.
+	// The registry links the second OSL to the first OSL's key shares, so
+	// that the substituted file decrypts and only the embedded OSL ID
+	// identifies the substitution.
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		registry.FileSpecs[1].KeyShares = registry.FileSpecs[0].KeyShares
+	})
+
+	oslName := env.oslFileName(env.oslIDs[0])
+	substitutedOSLName := env.oslFileName(env.oslIDs[1])
+	env.setFile(substitutedOSLName, env.getFile(oslName))
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// The substituted OSL is rejected and the fetch proceeds to import the
+	// other OSL.
+
+	err := env.fetch()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+
+	if env.requestCount(oslName) != 1 || env.requestCount(substitutedOSLName) != 1 {
+		t.Fatalf("unexpected OSL request order: %+v", env.oslRequestOrder())
+	}
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	found := false
+	for _, payload := range recorder.payloads("Alert") {
+		message, _ := payload["message"].(string)
+		if strings.Contains(message, "OSL ID mismatch") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("missing OSL ID mismatch alert")
+	}
+
+	etag, err := GetUrlETag(env.server.URL + "/" + substitutedOSLName)
+	if err != nil {
+		t.Fatalf("GetUrlETag failed: %s", err)
+	}
+	if etag != "" {
+		t.Fatalf("unexpected ETag for substituted OSL: %s", etag)
+	}
+}
+
+func TestObfuscatedServerListCapabilities(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 3, 1)
+	defer env.close()
+
+	// The first OSL offers only an unsupported capability, the second offers
+	// both unsupported and supported capabilities, and the third has no
+	// capabilities hint.
+
+	capabilities := map[string][]string{
+		env.oslIDs[0]: {"QUIC"},
+		env.oslIDs[1]: {"QUIC", "OSSH"},
+	}
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		for _, fileSpec := range registry.FileSpecs {
+			fileSpec.Capabilities = capabilities[hex.EncodeToString(fileSpec.ID)]
+		}
+	})
+
+	env.config.SupportedServerEntryCapabilities = []string{"OSSH", "SSH"}
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	for i, oslID := range env.oslIDs {
+		expectedCount := 1
+		if i == 0 {
+			expectedCount = 0
+		}
+		if env.requestCount(env.oslFileName(oslID)) != expectedCount {
+			t.Fatalf("unexpected OSL request order: %+v", env.oslRequestOrder())
+		}
+	}
+	if CountServerEntries() != 2 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Without configured supported capabilities, all OSLs are downloaded.
+
+	env.config.SupportedServerEntryCapabilities = nil
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(env.oslFileName(env.oslIDs[0])) != 1 {
+		t.Fatalf("unexpected OSL request order: %+v", env.oslRequestOrder())
+	}
+	if CountServerEntries() != 3 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestObfuscatedServerListMaxOSLCount(t *testing.T) {
+	t.Run("streamed", func(t *testing.T) {
+		testObfuscatedServerListMaxOSLCount(t, false)
+	})
+	t.Run("prioritized", func(t *testing.T) {
+		testObfuscatedServerListMaxOSLCount(t, true)
+	})
+}
+
+func testObfuscatedServerListMaxOSLCount(t *testing.T, prioritizeDownloads bool) {
+
+	env := newTestOSLEnvironment(t, 5, 1)
+	defer env.close()
+
+	maxOSLCount := 3
+
+	err := env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.RemoteServerListMaxOSLCount:             maxOSLCount,
+			parameters.ObfuscatedServerListPrioritizeDownloads: prioritizeDownloads,
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// Truncating the OSLs is not a fetch failure.
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	order := env.oslRequestOrder()
+	if len(order) != maxOSLCount {
+		t.Fatalf("unexpected OSL request order: %+v", order)
+	}
+	if CountServerEntries() != maxOSLCount {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	payloads := recorder.payloads("ObfuscatedServerListMaxOSLCountExceeded")
+	if len(payloads) != 1 ||
+		payloads[0]["maxOSLCount"] != float64(maxOSLCount) {
+		t.Fatalf("unexpected max OSL count notices: %+v", payloads)
+	}
+}
+
+func TestObfuscatedServerListNoEligibleOSLs(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 3, 1)
+	defer env.close()
+
+	var reportedCounts []int
+	env.config.OnNoEligibleOSLs = func(registryOSLCount int) {
+		reportedCounts = append(reportedCounts, registryOSLCount)
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// With no SLOKs, no OSLs are eligible, which is reported along with the
+	// total number of OSLs in the registry.
+
+	err := DeleteSLOKs()
+	if err != nil {
+		t.Fatalf("DeleteSLOKs failed: %s", err)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	payloads := recorder.payloads("ObfuscatedServerListNoEligibleOSLs")
+	if len(payloads) != 1 ||
+		payloads[0]["registryOSLCount"] != float64(len(env.oslIDs)) {
+		t.Fatalf("unexpected no eligible OSLs notices: %+v", payloads)
+	}
+	if !reflect.DeepEqual(reportedCounts, []int{len(env.oslIDs)}) {
+		t.Fatalf("unexpected no eligible OSLs reports: %+v", reportedCounts)
+	}
+
+	// Once OSLs are eligible, nothing is reported.
+
+	env.seedSLOKs()
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	if recorder.count("ObfuscatedServerListNoEligibleOSLs") != 1 ||
+		len(reportedCounts) != 1 {
+		t.Fatalf("unexpected no eligible OSLs report")
+	}
+}
+
+func TestOSLCoverageNotice(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 3, 1)
+	defer env.close()
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	checkCoverage := func(
+		seededCount, totalCount, missingSLOKCount int, slokLookupErrors bool) {
+
+		payloads := recorder.payloads("OSLCoverage")
+		if len(payloads) == 0 {
+			t.Fatalf("missing OSL coverage notice")
+		}
+		payload := payloads[len(payloads)-1]
+		if payload["seededCount"] != float64(seededCount) ||
+			payload["totalCount"] != float64(totalCount) ||
+			payload["missingSLOKCount"] != float64(missingSLOKCount) ||
+			(payload["slokLookupErrorCount"] != float64(0)) != slokLookupErrors {
+			t.Fatalf("unexpected OSL coverage notice: %+v", payload)
+		}
+	}
+
+	// An empty registry has no OSLs.
+
+	registry := env.getFile(osl.REGISTRY_FILENAME)
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		registry.FileSpecs = []*osl.OSLFileSpec{}
+	})
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	checkCoverage(0, 0, 0, false)
+
+	// With no SLOKs, no OSLs are seeded, and the SLOK of each OSL is
+	// missing.
+
+	env.setFile(osl.REGISTRY_FILENAME, registry)
+
+	err = DeleteSLOKs()
+	if err != nil {
+		t.Fatalf("DeleteSLOKs failed: %s", err)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	checkCoverage(0, 3, 3, false)
+
+	// A SLOK which fails to be looked up is reported as missing, along with
+	// the lookup error.
+
+	env.seedSLOKs()
+
+	seedState := env.oslConfig.NewClientSeedState("", env.propagationChannelID, nil)
+	seedState.NewClientSeedPortForward(net.ParseIP("0.0.0.0")).UpdateProgress(1, 1, 1)
+	failingSLOKID := seedState.GetSeedPayload().SLOKs[0].ID
+
+	originalGetSLOK := getSLOK
+	getSLOK = func(id []byte) ([]byte, error) {
+		if bytes.Equal(id, failingSLOKID) {
+			return nil, errors.New("SLOK lookup failure")
+		}
+		return originalGetSLOK(id)
+	}
+	defer func() { getSLOK = originalGetSLOK }()
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	checkCoverage(2, 3, 1, true)
+
+	if CountServerEntries() != 2 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestGetCachedOSLDirectory(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		for _, fileSpec := range registry.FileSpecs {
+			if hex.EncodeToString(fileSpec.ID) == env.oslIDs[0] {
+				fileSpec.Priority = 1
+				fileSpec.Regions = []string{"US"}
+				fileSpec.Capabilities = []string{"OSSH"}
+			}
+		}
+	})
+
+	// No directory is returned before the registry is cached.
+
+	directory, err := GetCachedOSLDirectory(env.config)
+	if err != nil {
+		t.Fatalf("GetCachedOSLDirectory failed: %s", err)
+	}
+	if directory != nil {
+		t.Fatalf("unexpected directory: %+v", directory)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	directory, err = GetCachedOSLDirectory(env.config)
+	if err != nil {
+		t.Fatalf("GetCachedOSLDirectory failed: %s", err)
+	}
+
+	// The test schemes split each OSL file key into a single share, which is
+	// split again into a single SLOK share.
+
+	keySplit := &OSLDirectoryKeySplit{
+		Threshold: 1,
+		Total:     1,
+		KeySplits: []*OSLDirectoryKeySplit{
+			{Threshold: 1, Total: 1, SLOKCount: 1},
+		},
+	}
+
+	var expectedOSLs []*OSLDirectoryEntry
+	for i, oslID := range env.oslIDs {
+		contents := env.getFile(env.oslFileName(oslID))
+		md5sum := md5.Sum(contents)
+		entry := &OSLDirectoryEntry{
+			ID:       oslID,
+			MD5Sum:   hex.EncodeToString(md5sum[:]),
+			Size:     int64(len(contents)),
+			KeySplit: keySplit,
+		}
+		if i == 0 {
+			entry.Priority = 1
+			entry.Regions = []string{"US"}
+			entry.Capabilities = []string{"OSSH"}
+		}
+		expectedOSLs = append(expectedOSLs, entry)
+	}
+
+	sort.Slice(directory.OSLs, func(i, j int) bool {
+		return directory.OSLs[i].ID < directory.OSLs[j].ID
+	})
+	sort.Slice(expectedOSLs, func(i, j int) bool {
+		return expectedOSLs[i].ID < expectedOSLs[j].ID
+	})
+
+	if !reflect.DeepEqual(directory.OSLs, expectedOSLs) {
+		t.Fatalf("unexpected directory OSLs: %+v", directory.OSLs)
+	}
+
+	registryETag, err := GetUrlETag(osl.GetOSLRegistryURL(env.server.URL + "/"))
+	if err != nil {
+		t.Fatalf("GetUrlETag failed: %s", err)
+	}
+	if registryETag == "" || directory.ETag != registryETag {
+		t.Fatalf("unexpected directory ETag: %s", directory.ETag)
+	}
+	if time.Since(directory.CachedTime) > time.Minute {
+		t.Fatalf("unexpected directory cached time: %s", directory.CachedTime)
+	}
+}
+
+func TestIsOSLUnlockable(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	unlockableOSLID, _ := hex.DecodeString(env.oslIDs[0])
+	lockedOSLID, _ := hex.DecodeString(env.oslIDs[1])
+
+	// The second OSL file key additionally requires a share keyed by a SLOK
+	// the client doesn't have.
+
+	missingSLOKID, err := common.MakeSecureRandomBytes(32)
+	if err != nil {
+		t.Fatalf("MakeSecureRandomBytes failed: %s", err)
+	}
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		for _, fileSpec := range registry.FileSpecs {
+			if bytes.Equal(fileSpec.ID, lockedOSLID) {
+				fileSpec.KeyShares = &osl.KeyShares{
+					Threshold:   2,
+					BoxedShares: [][]byte{{0}, {0}},
+					KeyShares: []*osl.KeyShares{
+						fileSpec.KeyShares,
+						{
+							Threshold:   1,
+							BoxedShares: [][]byte{{0}},
+							SLOKIDs:     [][]byte{missingSLOKID},
+						},
+					},
+				}
+			}
+		}
+	})
+
+	ok, reason := IsOSLUnlockable(env.config, unlockableOSLID)
+	if ok || reason != "no cached registry" {
+		t.Fatalf("unexpected result before fetch: %v, %s", ok, reason)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	requestCount := len(env.oslRequestOrder())
+
+	ok, reason = IsOSLUnlockable(env.config, unlockableOSLID)
+	if !ok || reason != "" {
+		t.Fatalf("unexpected unlockable OSL result: %v, %s", ok, reason)
+	}
+
+	ok, reason = IsOSLUnlockable(env.config, lockedOSLID)
+	if ok || reason != "missing 1 of 2 SLOKs" {
+		t.Fatalf("unexpected locked OSL result: %v, %s", ok, reason)
+	}
+
+	unknownOSLID, _ := hex.DecodeString("00")
+	ok, reason = IsOSLUnlockable(env.config, unknownOSLID)
+	if ok || reason != "OSL not in cached registry" {
+		t.Fatalf("unexpected unknown OSL result: %v, %s", ok, reason)
+	}
+
+	// The check doesn't download anything.
+
+	if len(env.oslRequestOrder()) != requestCount {
+		t.Fatalf("unexpected OSL downloads: %v", env.oslRequestOrder())
+	}
+}
+
+func TestGetOSLMissingSLOKs(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 3, 1)
+	defer env.close()
+
+	makeSLOKIDs := func(count int) [][]byte {
+		var slokIDs [][]byte
+		for i := 0; i < count; i++ {
+			slokID, err := common.MakeSecureRandomBytes(32)
+			if err != nil {
+				t.Fatalf("MakeSecureRandomBytes failed: %s", err)
+			}
+			slokIDs = append(slokIDs, slokID)
+		}
+		return slokIDs
+	}
+
+	// The first OSL is unlockable. The second and third OSL file keys
+	// additionally require shares keyed by SLOKs the client doesn't have:
+	// 2 of 3 SLOKs for the second OSL and 1 SLOK for the third OSL.
+
+	secondSLOKIDs := makeSLOKIDs(3)
+	thirdSLOKIDs := makeSLOKIDs(1)
+
+	addKeyShares := func(fileSpec *osl.OSLFileSpec, threshold int, slokIDs [][]byte) {
+		boxedShares := make([][]byte, len(slokIDs))
+		for i := range boxedShares {
+			boxedShares[i] = []byte{0}
+		}
+		fileSpec.KeyShares = &osl.KeyShares{
+			Threshold:   2,
+			BoxedShares: [][]byte{{0}, {0}},
+			KeyShares: []*osl.KeyShares{
+				fileSpec.KeyShares,
+				{
+					Threshold:   threshold,
+					BoxedShares: boxedShares,
+					SLOKIDs:     slokIDs,
+				},
+			},
+		}
+	}
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		addKeyShares(registry.FileSpecs[1], 2, secondSLOKIDs)
+		addKeyShares(registry.FileSpecs[2], 1, thirdSLOKIDs)
+	})
+
+	report, err := GetOSLMissingSLOKs(env.config)
+	if err != nil || report != nil {
+		t.Fatalf("unexpected report before fetch: %+v, %v", report, err)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	requestCount := len(env.oslRequestOrder())
+
+	hexIDs := func(slokIDs [][]byte) string {
+		var ids []string
+		for _, slokID := range slokIDs {
+			ids = append(ids, hex.EncodeToString(slokID))
+		}
+		return strings.Join(ids, " ")
+	}
+
+	checkMissingSLOKs := func(
+		missingSLOKs *OSLMissingSLOKs,
+		oslID string,
+		missingCount, requiredCount int,
+		slokIDs [][]byte) {
+
+		if missingSLOKs.OSLID != oslID ||
+			missingSLOKs.MissingCount != missingCount ||
+			missingSLOKs.RequiredCount != requiredCount ||
+			strings.Join(missingSLOKs.MissingSLOKIDs, " ") != hexIDs(slokIDs) {
+
+			t.Fatalf("unexpected missing SLOKs: %+v", missingSLOKs)
+		}
+	}
+
+	// The OSL closest to being unlocked is first.
+
+	report, err = GetOSLMissingSLOKs(env.config)
+	if err != nil {
+		t.Fatalf("GetOSLMissingSLOKs failed: %s", err)
+	}
+	if len(report) != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	checkMissingSLOKs(report[0], env.oslIDs[2], 1, 2, thirdSLOKIDs)
+	checkMissingSLOKs(report[1], env.oslIDs[1], 2, 3, secondSLOKIDs)
+
+	// Once the third OSL's SLOK and one of the second OSL's SLOKs are
+	// stored, the third OSL is unlockable and the second OSL is missing one
+	// of its remaining SLOKs.
+
+	_, err = SetSLOK(thirdSLOKIDs[0], []byte("key"))
+	if err != nil {
+		t.Fatalf("SetSLOK failed: %s", err)
+	}
+	_, err = SetSLOK(secondSLOKIDs[1], []byte("key"))
+	if err != nil {
+		t.Fatalf("SetSLOK failed: %s", err)
+	}
+
+	report, err = GetOSLMissingSLOKs(env.config)
+	if err != nil {
+		t.Fatalf("GetOSLMissingSLOKs failed: %s", err)
+	}
+	if len(report) != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	checkMissingSLOKs(report[0], env.oslIDs[1], 1, 3,
+		[][]byte{secondSLOKIDs[0], secondSLOKIDs[2]})
+
+	// The report doesn't download anything.
+
+	if len(env.oslRequestOrder()) != requestCount {
+		t.Fatalf("unexpected OSL downloads: %v", env.oslRequestOrder())
+	}
+}
+
+func TestObfuscatedServerListSLOKLookupError(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	unlockableOSLID, _ := hex.DecodeString(env.oslIDs[0])
+	lockedOSLID, _ := hex.DecodeString(env.oslIDs[1])
+
+	// The second OSL file key additionally requires a share keyed by a SLOK
+	// the client doesn't have.
+
+	missingSLOKID, err := common.MakeSecureRandomBytes(32)
+	if err != nil {
+		t.Fatalf("MakeSecureRandomBytes failed: %s", err)
+	}
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		registry.FileSpecs[1].KeyShares = &osl.KeyShares{
+			Threshold:   2,
+			BoxedShares: [][]byte{{0}, {0}},
+			KeyShares: []*osl.KeyShares{
+				registry.FileSpecs[1].KeyShares,
+				{
+					Threshold:   1,
+					BoxedShares: [][]byte{{0}},
+					SLOKIDs:     [][]byte{missingSLOKID},
+				},
+			},
+		}
+	})
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// A genuinely missing SLOK isn't a lookup failure.
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	ok, reason := IsOSLUnlockable(env.config, lockedOSLID)
+	if ok || reason != "missing 1 of 2 SLOKs" {
+		t.Fatalf("unexpected locked OSL result: %v, %s", ok, reason)
+	}
+
+	_, err = GetOSLMissingSLOKs(env.config)
+	if err != nil {
+		t.Fatalf("GetOSLMissingSLOKs failed: %s", err)
+	}
+
+	if recorder.count("SLOKLookupFailed") != 0 {
+		t.Fatalf("unexpected SLOK lookup failure notices: %+v",
+			recorder.payloads("SLOKLookupFailed"))
+	}
+
+	// A datastore error is reported as a lookup failure, and not as a
+	// missing SLOK.
+
+	lookupErr := errors.New("test datastore error")
+	getSLOK = func([]byte) ([]byte, error) {
+		return nil, lookupErr
+	}
+	defer func() {
+		getSLOK = GetSLOK
+	}()
+
+	ok, reason = IsOSLUnlockable(env.config, unlockableOSLID)
+	if ok || !strings.HasPrefix(reason, "failed to look up SLOKs") {
+		t.Fatalf("unexpected unlockable OSL result: %v, %s", ok, reason)
+	}
+
+	_, err = GetOSLMissingSLOKs(env.config)
+	if err == nil || !strings.Contains(err.Error(), lookupErr.Error()) {
+		t.Fatalf("unexpected GetOSLMissingSLOKs result: %v", err)
+	}
+
+	if recorder.count("SLOKLookupFailed") == 0 {
+		t.Fatalf("missing SLOK lookup failure notice")
+	}
+	for _, payload := range recorder.payloads("SLOKLookupFailed") {
+		if payload["slokID"] == "" || payload["error"] != lookupErr.Error() {
+			t.Fatalf("unexpected SLOK lookup failure notice: %+v", payload)
+		}
+	}
+
+	// By default, the fetch proceeds as if the SLOKs were missing.
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	// With ObfuscatedServerListFailOnSLOKLookupError, the fetch fails with a
+	// SLOKLookupError.
+
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ObfuscatedServerListFailOnSLOKLookupError: true,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = env.fetch()
+	lookupError, ok := err.(SLOKLookupError)
+	if !ok || lookupError.Count == 0 || lookupError.Err != lookupErr {
+		t.Fatalf("unexpected fetch result: %v", err)
+	}
+
+	// Once lookups succeed, the fetch succeeds.
+
+	getSLOK = GetSLOK
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+}
+
+func TestObfuscatedServerListRegistryPath(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	// Serve the registry from a non-standard location. OSL files remain at
+	// the root.
+
+	registryPath := "meta/v2/registry.bin"
+
+	registryContents := env.getFile(osl.REGISTRY_FILENAME)
+	env.mutex.Lock()
+	delete(env.files, osl.REGISTRY_FILENAME)
+	env.mutex.Unlock()
+	env.setFile(registryPath, registryContents)
+
+	env.config.ObfuscatedServerListRegistryPath = registryPath
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(registryPath) != 1 ||
+		env.requestCount(osl.REGISTRY_FILENAME) != 0 {
+
+		t.Fatalf("unexpected registry requests: %d, %d",
+			env.requestCount(registryPath), env.requestCount(osl.REGISTRY_FILENAME))
+	}
+
+	for _, oslID := range env.oslIDs {
+		if env.requestCount(env.oslFileName(oslID)) != 1 {
+			t.Fatalf("unexpected OSL requests: %v", env.oslRequestOrder())
+		}
+	}
+
+	if CountServerEntries() != 2 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// The registry ETag is stored for the override URL.
+
+	etag, err := GetUrlETag(osl.GetOSLRegistryURLWithPath(env.server.URL+"/", registryPath))
+	if err != nil {
+		t.Fatalf("GetUrlETag failed: %s", err)
+	}
+	if etag == "" || etag != env.fileETag(registryPath) {
+		t.Fatalf("unexpected registry ETag: %s", etag)
+	}
+
+	// Without the override, the registry is fetched from the conventional
+	// location, which isn't served.
+
+	env.config.ObfuscatedServerListRegistryPath = ""
+
+	err = env.fetch()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+	if env.requestCount(osl.REGISTRY_FILENAME) == 0 {
+		t.Fatalf("missing default registry request")
+	}
+}
+
+func TestObfuscatedServerListRegistryMinInterval(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	clock := &testClock{now: time.Now()}
+	env.config.Clock = clock
+
+	err := env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ObfuscatedServerListRegistryMinInterval: "1h",
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(osl.REGISTRY_FILENAME) != 1 {
+		t.Fatalf("unexpected registry requests: %d", env.requestCount(osl.REGISTRY_FILENAME))
+	}
+
+	// Within the interval, the registry isn't downloaded, but the seeded
+	// OSLs in the cached registry are still processed: an OSL with a
+	// cleared ETag is downloaded again.
+
+	oslID, _ := hex.DecodeString(env.oslIDs[0])
+	err = SetUrlETag(osl.GetOSLFileURL(env.server.URL+"/", oslID), "")
+	if err != nil {
+		t.Fatalf("SetUrlETag failed: %s", err)
+	}
+
+	clock.advance(30 * time.Minute)
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(osl.REGISTRY_FILENAME) != 1 {
+		t.Fatalf("unexpected registry requests: %d", env.requestCount(osl.REGISTRY_FILENAME))
+	}
+
+	if env.requestCount(env.oslFileName(env.oslIDs[0])) != 2 ||
+		env.requestCount(env.oslFileName(env.oslIDs[1])) != 1 {
+
+		t.Fatalf("unexpected OSL requests: %v", env.oslRequestOrder())
+	}
+
+	// After the interval, measured from the last registry download, the
+	// registry is downloaded again.
+
+	clock.advance(31 * time.Minute)
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(osl.REGISTRY_FILENAME) != 2 {
+		t.Fatalf("unexpected registry requests: %d", env.requestCount(osl.REGISTRY_FILENAME))
+	}
+
+	// An unchanged registry download also restarts the interval.
+
+	clock.advance(30 * time.Minute)
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(osl.REGISTRY_FILENAME) != 2 {
+		t.Fatalf("unexpected registry requests: %d", env.requestCount(osl.REGISTRY_FILENAME))
+	}
+}
+
+func TestOnUntunneledDownload(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	var mutex sync.Mutex
+	var downloadURLs []string
+	veto := true
+
+	env.config.OnUntunneledDownload = func(url string) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		downloadURLs = append(downloadURLs, url)
+		return !veto
+	}
+
+	// A vetoed download isn't attempted. Without a cached registry, the
+	// fetch fails.
+
+	err := env.fetch()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+
+	registryURL := osl.GetOSLRegistryURL(env.server.URL + "/")
+
+	// The registry download may be retried, and each attempt is vetoed.
+
+	mutex.Lock()
+	if len(downloadURLs) == 0 {
+		t.Fatalf("missing download URLs")
+	}
+	for _, url := range downloadURLs {
+		if url != registryURL {
+			t.Fatalf("unexpected download URLs: %v", downloadURLs)
+		}
+	}
+	downloadURLs = nil
+	mutex.Unlock()
+
+	_, ok := checkUntunneledDownload(env.config, registryURL).(UntunneledDownloadVetoedError)
+	if !ok {
+		t.Fatalf("unexpected untunneled download check result")
+	}
+
+	mutex.Lock()
+	downloadURLs = nil
+	veto = false
+	mutex.Unlock()
+
+	if env.requestCount(osl.REGISTRY_FILENAME) != 0 || CountServerEntries() != 0 {
+		t.Fatalf("unexpected vetoed download")
+	}
+
+	// The callback is invoked for each permitted download.
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	expectedURLs := []string{registryURL}
+	for _, oslID := range env.oslIDs {
+		id, _ := hex.DecodeString(oslID)
+		expectedURLs = append(expectedURLs, osl.GetOSLFileURL(env.server.URL+"/", id))
+	}
+
+	mutex.Lock()
+	sort.Strings(downloadURLs)
+	sort.Strings(expectedURLs)
+	if strings.Join(downloadURLs, " ") != strings.Join(expectedURLs, " ") {
+		t.Fatalf("unexpected download URLs: %v", downloadURLs)
+	}
+	mutex.Unlock()
+
+	if CountServerEntries() != 2 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestTunnelRequiredDownload(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListRequireTunnel: true,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	// Each tunneled-only fetch without a tunnel fails with a
+	// TunnelRequiredError, and sends no requests.
+
+	registryURL := osl.GetOSLRegistryURL(env.server.URL + "/")
+	_, rootURL, _ := env.config.clientParameters.Get().DownloadURLs(
+		parameters.ObfuscatedServerListRootURLs).Select(0)
+
+	err = env.fetch()
+	tunnelErr, ok := err.(TunnelRequiredError)
+	if !ok || tunnelErr.URL != rootURL {
+		t.Fatalf("unexpected obfuscated fetch error: %v", err)
+	}
+
+	_, err = FetchObfuscatedServerListsWithResults(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if _, ok := err.(TunnelRequiredError); !ok {
+		t.Fatalf("unexpected obfuscated fetch error: %v", err)
+	}
+
+	err = env.fetchCommon()
+	if _, ok := err.(TunnelRequiredError); !ok {
+		t.Fatalf("unexpected common fetch error: %v", err)
+	}
+
+	err = BootstrapFetchCommonRemoteServerList(env.config, &DialConfig{})
+	if _, ok := err.(TunnelRequiredError); !ok {
+		t.Fatalf("unexpected bootstrap fetch error: %v", err)
+	}
+
+	// A closed tunnel doesn't satisfy the requirement.
+
+	closedTunnel := &Tunnel{
+		mutex:    new(sync.Mutex),
+		isClosed: true,
+	}
+
+	err = FetchObfuscatedServerLists(
+		context.Background(), env.config, 0, closedTunnel, &DialConfig{})
+	if _, ok := err.(TunnelRequiredError); !ok {
+		t.Fatalf("unexpected obfuscated fetch error: %v", err)
+	}
+
+	err = FetchCommonRemoteServerList(
+		context.Background(), env.config, 0, closedTunnel, &DialConfig{})
+	if _, ok := err.(TunnelRequiredError); !ok {
+		t.Fatalf("unexpected common fetch error: %v", err)
+	}
+
+	err = checkTunnelRequired(env.config, closedTunnel, registryURL)
+	if err != (TunnelRequiredError{URL: registryURL}) {
+		t.Fatalf("unexpected tunnel required check result: %v", err)
+	}
+
+	if env.requestCount(osl.REGISTRY_FILENAME) != 0 ||
+		env.requestCount(testCommonRemoteServerListName) != 0 ||
+		CountServerEntries() != 0 {
+
+		t.Fatalf("unexpected tunnel required download")
+	}
+
+	// Without the requirement, the fetches proceed untunneled.
+
+	err = env.config.SetClientParameters("", false, map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = checkTunnelRequired(env.config, nil, registryURL)
+	if err != nil {
+		t.Fatalf("unexpected tunnel required check result: %v", err)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("common fetch failed: %s", err)
+	}
+
+	if CountServerEntries() != 3 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestPreviewObfuscatedServerLists(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 4, 1)
+	defer env.close()
+
+	// The first OSL offers only an unsupported capability, and the last OSL
+	// has no advertised size.
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		for _, fileSpec := range registry.FileSpecs {
+			switch hex.EncodeToString(fileSpec.ID) {
+			case env.oslIDs[0]:
+				fileSpec.Capabilities = []string{"QUIC"}
+			case env.oslIDs[3]:
+				fileSpec.Size = 0
+			}
+		}
+	})
+
+	env.config.SupportedServerEntryCapabilities = []string{"OSSH", "SSH"}
+
+	// No preview is returned before the registry is cached.
+
+	preview, err := PreviewObfuscatedServerLists(env.config)
+	if err != nil {
+		t.Fatalf("PreviewObfuscatedServerLists failed: %s", err)
+	}
+	if preview != nil {
+		t.Fatalf("unexpected preview: %+v", preview)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	// All eligible OSLs are already downloaded.
+
+	preview, err = PreviewObfuscatedServerLists(env.config)
+	if err != nil {
+		t.Fatalf("PreviewObfuscatedServerLists failed: %s", err)
+	}
+	if preview == nil || *preview != (OSLDownloadPreview{}) {
+		t.Fatalf("unexpected preview: %+v", preview)
+	}
+
+	// When the OSLs are to be downloaded again, the previewed total is the
+	// sum of the advertised sizes of the eligible OSLs.
+
+	for _, hexID := range env.oslIDs {
+		oslID, _ := hex.DecodeString(hexID)
+		err = SetUrlETag(osl.GetOSLFileURL(env.server.URL+"/", oslID), "")
+		if err != nil {
+			t.Fatalf("SetUrlETag failed: %s", err)
+		}
+	}
+
+	directory, err := GetCachedOSLDirectory(env.config)
+	if err != nil {
+		t.Fatalf("GetCachedOSLDirectory failed: %s", err)
+	}
+
+	expectedTotalBytes := int64(0)
+	for _, entry := range directory.OSLs {
+		if entry.ID == env.oslIDs[1] || entry.ID == env.oslIDs[2] {
+			expectedTotalBytes += entry.Size
+		}
+	}
+	if expectedTotalBytes != int64(
+		len(env.getFile(env.oslFileName(env.oslIDs[1])))+
+			len(env.getFile(env.oslFileName(env.oslIDs[2])))) {
+
+		t.Fatalf("unexpected advertised sizes: %d", expectedTotalBytes)
+	}
+
+	preview, err = PreviewObfuscatedServerLists(env.config)
+	if err != nil {
+		t.Fatalf("PreviewObfuscatedServerLists failed: %s", err)
+	}
+	if preview == nil ||
+		preview.OSLCount != 3 ||
+		preview.TotalBytes != expectedTotalBytes ||
+		preview.UnknownSizeCount != 1 {
+
+		t.Fatalf("unexpected preview: %+v", preview)
+	}
+}
+
+func TestEstimateRemainingFetch(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 4, 1)
+	defer env.close()
+	env.downloadSequentially()
+
+	// No estimate is returned before the registry is cached.
+
+	estimate, err := EstimateRemainingFetch(env.config)
+	if err != nil {
+		t.Fatalf("EstimateRemainingFetch failed: %s", err)
+	}
+	if estimate != nil {
+		t.Fatalf("unexpected estimate: %+v", estimate)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	estimate, err = EstimateRemainingFetch(env.config)
+	if err != nil {
+		t.Fatalf("EstimateRemainingFetch failed: %s", err)
+	}
+	if estimate == nil || *estimate != (RemainingFetchEstimate{}) {
+		t.Fatalf("unexpected estimate: %+v", estimate)
+	}
+
+	clearETags := func() {
+		for _, hexID := range env.oslIDs {
+			oslID, _ := hex.DecodeString(hexID)
+			err := SetUrlETag(osl.GetOSLFileURL(env.server.URL+"/", oslID), "")
+			if err != nil {
+				t.Fatalf("SetUrlETag failed: %s", err)
+			}
+		}
+	}
+
+	expectedBytes := int64(0)
+	for _, hexID := range env.oslIDs {
+		expectedBytes += int64(len(env.getFile(env.oslFileName(hexID))))
+	}
+
+	// When the OSLs are to be fetched again, all of their bytes remain to be
+	// downloaded.
+
+	clearETags()
+
+	estimate, err = EstimateRemainingFetch(env.config)
+	if err != nil {
+		t.Fatalf("EstimateRemainingFetch failed: %s", err)
+	}
+	if estimate == nil ||
+		*estimate != (RemainingFetchEstimate{
+			OSLCount:       4,
+			RemainingBytes: expectedBytes,
+		}) {
+
+		t.Fatalf("unexpected estimate: %+v", estimate)
+	}
+
+	// During a fetch, the estimate decreases as each OSL is imported. The
+	// estimate is sampled as each OSL file is requested.
+
+	oslFileNames := make(map[string]bool)
+	for _, hexID := range env.oslIDs {
+		oslFileNames[env.oslFileName(hexID)] = true
+	}
+
+	var estimatesMutex sync.Mutex
+	var estimates []int
+
+	env.mutex.Lock()
+	env.requestHook = func(name string) {
+		if !oslFileNames[name] {
+			return
+		}
+		estimate, err := EstimateRemainingFetch(env.config)
+		if err != nil || estimate == nil {
+			t.Errorf("EstimateRemainingFetch failed: %v", err)
+			return
+		}
+		estimatesMutex.Lock()
+		estimates = append(estimates, estimate.OSLCount)
+		estimatesMutex.Unlock()
+	}
+	env.mutex.Unlock()
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	env.mutex.Lock()
+	env.requestHook = nil
+	env.mutex.Unlock()
+
+	estimatesMutex.Lock()
+	if !reflect.DeepEqual(estimates, []int{4, 3, 2, 1}) {
+		t.Fatalf("unexpected estimates: %+v", estimates)
+	}
+	estimatesMutex.Unlock()
+
+	estimate, err = EstimateRemainingFetch(env.config)
+	if err != nil {
+		t.Fatalf("EstimateRemainingFetch failed: %s", err)
+	}
+	if estimate == nil || *estimate != (RemainingFetchEstimate{}) {
+		t.Fatalf("unexpected estimate: %+v", estimate)
+	}
+
+	// OSLs downloaded in download-only mode remain to be imported, but have
+	// no bytes remaining to be downloaded.
+
+	clearETags()
+
+	err = DownloadObfuscatedServerLists(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("DownloadObfuscatedServerLists failed: %s", err)
+	}
+
+	estimate, err = EstimateRemainingFetch(env.config)
+	if err != nil {
+		t.Fatalf("EstimateRemainingFetch failed: %s", err)
+	}
+	if estimate == nil ||
+		*estimate != (RemainingFetchEstimate{
+			OSLCount:           4,
+			PendingImportCount: 4,
+		}) {
+
+		t.Fatalf("unexpected estimate: %+v", estimate)
+	}
+
+	err = ImportDownloadedObfuscatedServerLists(env.config)
+	if err != nil {
+		t.Fatalf("ImportDownloadedObfuscatedServerLists failed: %s", err)
+	}
+
+	estimate, err = EstimateRemainingFetch(env.config)
+	if err != nil {
+		t.Fatalf("EstimateRemainingFetch failed: %s", err)
+	}
+	if estimate == nil || *estimate != (RemainingFetchEstimate{}) {
+		t.Fatalf("unexpected estimate: %+v", estimate)
+	}
+}
+
+func TestObfuscatedServerListEncryptionAtRest(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 2)
+	defer env.close()
+
+	setSecret := func(secret string) {
+		env.config.ObfuscatedServerListFileEncryptionSecret = secret
+		err := env.config.Commit()
+		if err != nil {
+			t.Fatalf("error committing configuration file: %s", err)
+		}
+	}
+
+	registryFilename := osl.GetOSLRegistryFilename(
+		env.config.ObfuscatedServerListDownloadDirectory)
+
+	// checkFiles checks that the downloaded registry and OSL files are
+	// encrypted, and don't contain the served content.
+	checkFiles := func() {
+		files := map[string]string{
+			registryFilename + ".cached": osl.REGISTRY_FILENAME,
+		}
+		for _, oslID := range env.oslIDs {
+			files[filepath.Join(env.dataDirectory, env.oslFileName(oslID))] = env.oslFileName(oslID)
+		}
+		for filename, name := range files {
+			content, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatalf("ReadFile failed: %s", err)
+			}
+			served := env.getFile(name)
+			if !bytes.HasPrefix(content, []byte(downloadFileEncryptionMagic)) ||
+				len(content) != downloadFileHeaderSize+len(served) ||
+				bytes.Contains(content, served[:len(served)/4]) {
+
+				t.Fatalf("unexpected file content: %s", filename)
+			}
+		}
+	}
+
+	setSecret("secret")
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// The interrupted registry download is resumed, through the encryption
+	// layer, from the plaintext offset. The OSL files are staged, as
+	// downloaded, without importing any server entries.
+
+	env.mutex.Lock()
+	env.truncateRequests = 1
+	env.mutex.Unlock()
+
+	registrySize := int64(len(env.getFile(osl.REGISTRY_FILENAME)))
+
+	err := DownloadObfuscatedServerLists(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("DownloadObfuscatedServerLists failed: %s", err)
+	}
+	payloads := recorder.payloads("ResumeDownload")
+	if len(payloads) != 1 || payloads[0]["offset"] != float64(registrySize/2) {
+		t.Fatalf("unexpected resume notices: %+v", payloads)
+	}
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	checkFiles()
+
+	// The cached registry and the staged OSL files are decrypted when read.
+
+	directory, err := GetCachedOSLDirectory(env.config)
+	if err != nil {
+		t.Fatalf("GetCachedOSLDirectory failed: %s", err)
+	}
+	if len(directory.OSLs) != 2 {
+		t.Fatalf("unexpected directory OSLs: %+v", directory.OSLs)
+	}
+
+	err = ImportDownloadedObfuscatedServerLists(env.config)
+	if err != nil {
+		t.Fatalf("ImportDownloadedObfuscatedServerLists failed: %s", err)
+	}
+	if CountServerEntries() != 4 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// A cached registry encrypted with a different secret can't be read,
+	// and is downloaded again.
+
+	setSecret("other secret")
+
+	_, err = GetCachedOSLDirectory(env.config)
+	if err == nil {
+		t.Fatalf("unexpected GetCachedOSLDirectory success")
+	}
+
+	// The unchanged registry is requested, and then downloaded again once
+	// the cached registry fails to open.
+
+	registryRequests := env.requestCount(osl.REGISTRY_FILENAME)
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	if env.requestCount(osl.REGISTRY_FILENAME) != registryRequests+2 {
+		t.Fatalf("unexpected registry request count: %d", env.requestCount(osl.REGISTRY_FILENAME))
+	}
+	if recorder.count("ObfuscatedServerListRegistryCacheCorrupt") != 1 {
+		t.Fatalf("missing registry cache corrupt notice")
+	}
+
+	directory, err = GetCachedOSLDirectory(env.config)
+	if err != nil {
+		t.Fatalf("GetCachedOSLDirectory failed: %s", err)
+	}
+	if len(directory.OSLs) != 2 {
+		t.Fatalf("unexpected directory OSLs: %+v", directory.OSLs)
+	}
+
+	// A gzip encoded download is decoded into an encrypted file.
+
+	env.mutex.Lock()
+	env.contentEncoding = "gzip"
+	env.mutex.Unlock()
+
+	oslRequests := make(map[string]int)
+	for _, hexID := range env.oslIDs {
+		oslID, _ := hex.DecodeString(hexID)
+		SetUrlETag(osl.GetOSLFileURL(env.server.URL+"/", oslID), "")
+		oslRequests[hexID] = env.requestCount(env.oslFileName(hexID))
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	for _, hexID := range env.oslIDs {
+		if env.requestCount(env.oslFileName(hexID)) != oslRequests[hexID]+1 {
+			t.Fatalf("unexpected OSL request count")
+		}
+	}
+	if CountServerEntries() != 4 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	checkFiles()
+}
+
+func TestObfuscatedServerListFilenameEncoder(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 4, 2)
+	defer env.close()
+
+	// The encoder uses hashed names, sharded into subdirectories.
+
+	encodeName := func(oslID []byte) string {
+		digest := sha256.Sum256(oslID)
+		hexDigest := hex.EncodeToString(digest[:])
+		return hexDigest[:2] + "/" + hexDigest[2:]
+	}
+	env.config.OSLFilenameEncoder = encodeName
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if CountServerEntries() != 8 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	filenames := make(map[string]bool)
+	for _, hexID := range env.oslIDs {
+		oslID, _ := hex.DecodeString(hexID)
+
+		filename := filepath.Join(
+			env.config.ObfuscatedServerListDownloadDirectory,
+			filepath.FromSlash(encodeName(oslID)))
+		if filenames[filename] {
+			t.Fatalf("duplicate OSL filename: %s", filename)
+		}
+		filenames[filename] = true
+
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %s", err)
+		}
+		if !bytes.Equal(contents, env.getFile(env.oslFileName(hexID))) {
+			t.Fatalf("unexpected OSL file contents: %s", filename)
+		}
+
+		_, err = os.Stat(
+			osl.GetOSLFilename(env.config.ObfuscatedServerListDownloadDirectory, oslID))
+		if !os.IsNotExist(err) {
+			t.Fatalf("unexpected default OSL filename: %v", err)
+		}
+	}
+
+	// Names which leave the download directory, or collide with the
+	// registry files, are rejected.
+
+	for _, invalidName := range []string{
+		"",
+		"../osl",
+		"/tmp/osl",
+		"shard/../../osl",
+		osl.REGISTRY_FILENAME,
+		osl.REGISTRY_FILENAME + ".cached",
+		OBFUSCATED_SERVER_LIST_QUARANTINE_DIRECTORY + "/osl",
+		OBFUSCATED_SERVER_LIST_DRY_RUN_DIRECTORY + "/osl",
+	} {
+		env.config.OSLFilenameEncoder = func([]byte) string { return invalidName }
+		oslID, _ := hex.DecodeString(env.oslIDs[0])
+		_, err := getOSLFilename(env.config, oslID)
+		if err == nil {
+			t.Fatalf("unexpected valid OSL filename: %s", invalidName)
+		}
+	}
+}
+
+func TestObfuscatedServerListSubdirectories(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 3, 1)
+	defer env.close()
+
+	directory := env.config.ObfuscatedServerListDownloadDirectory
+
+	oslIDs := make([][]byte, len(env.oslIDs))
+	for i, hexID := range env.oslIDs {
+		oslIDs[i], _ = hex.DecodeString(hexID)
+	}
+
+	// Download with the flat layout, then replace the last OSL file with a
+	// partial download, as if its download was interrupted.
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	flatFilename := osl.GetOSLFilename(directory, oslIDs[2])
+	err = os.Remove(flatFilename)
+	if err != nil {
+		t.Fatalf("Remove failed: %s", err)
+	}
+	err = SetUrlETag(osl.GetOSLFileURL(env.server.URL+"/", oslIDs[2]), "")
+	if err != nil {
+		t.Fatalf("SetUrlETag failed: %s", err)
+	}
+
+	oslName := env.oslFileName(env.oslIDs[2])
+	partialSize := len(env.getFile(oslName)) / 2
+	err = ioutil.WriteFile(flatFilename+".part", env.getFile(oslName)[:partialSize], 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	err = ioutil.WriteFile(flatFilename+".part.etag", []byte(env.fileETag(oslName)), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	// With subdirectories enabled, the existing files are migrated. The
+	// migrated OSL files aren't downloaded again, and the partial download
+	// is resumed.
+
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ObfuscatedServerListSubdirectoryLength: 2,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	initialSavedBytes := GetRemoteServerListResumeSavedBytes()
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if CountServerEntries() != 3 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	savedBytes := GetRemoteServerListResumeSavedBytes() - initialSavedBytes
+	if savedBytes != int64(partialSize) {
+		t.Fatalf("unexpected saved bytes: %d", savedBytes)
+	}
+
+	for i, hexID := range env.oslIDs {
+
+		expectedRequestCount := 1
+		if i == 2 {
+			expectedRequestCount = 2
+		}
+		requestCount := env.requestCount(env.oslFileName(hexID))
+		if requestCount != expectedRequestCount {
+			t.Fatalf("unexpected OSL %d request count: %d", i, requestCount)
+		}
+
+		filename := filepath.Join(directory, hexID[:2], env.oslFileName(hexID))
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %s", err)
+		}
+		if !bytes.Equal(contents, env.getFile(env.oslFileName(hexID))) {
+			t.Fatalf("unexpected OSL file contents: %s", filename)
+		}
+
+		for _, suffix := range []string{"", ".part", ".part.etag"} {
+			_, err = os.Stat(osl.GetOSLFilename(directory, oslIDs[i]) + suffix)
+			if !os.IsNotExist(err) {
+				t.Fatalf("unexpected flat OSL file: %v", err)
+			}
+		}
+	}
+
+	// The registry remains in the download directory.
+
+	_, err = os.Stat(osl.GetOSLRegistryFilename(directory) + ".cached")
+	if err != nil {
+		t.Fatalf("unexpected cached registry: %s", err)
+	}
+}
+
+func TestServerEntryReachabilityProbe(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 3)
+	defer env.close()
+
+	var mutex sync.Mutex
+	var probedEndpoints []string
+
+	originalProbe := probeServerEntryEndpoint
+	defer func() {
+		probeServerEntryEndpoint = originalProbe
+	}()
+
+	// The mock probe reports the servers in the first OSL as unreachable.
+
+	probeServerEntryEndpoint = func(
+		_ context.Context, _ *DialConfig, endpoint string) error {
+
+		mutex.Lock()
+		probedEndpoints = append(probedEndpoints, endpoint)
+		mutex.Unlock()
+		if strings.HasPrefix(endpoint, "192.0.1.") {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	// Without ProbeImportedServerEntries, no probes are made.
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if CountServerEntries() != 6 || len(probedEndpoints) != 0 {
+		t.Fatalf("unexpected probes: %v", probedEndpoints)
+	}
+
+	for i := range env.oslIDs {
+		for j := 0; j < 3; j++ {
+			reachability, err := GetServerEntryReachability(
+				fmt.Sprintf("192.0.%d.%d", i+1, j+1))
+			if err != nil || reachability != nil {
+				t.Fatalf("unexpected reachability: %+v, %v", reachability, err)
+			}
+		}
+	}
+
+	// With ProbeImportedServerEntries, a sample of the new server entries in
+	// each imported OSL is probed; existing server entries are not probed.
+
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ProbeImportedServerEntries:           true,
+		parameters.ProbeImportedServerEntriesSampleSize: 3,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	for i, oslID := range env.oslIDs {
+		for j := 3; j < 8; j++ {
+			encodedServerEntry, err := protocol.EncodeServerEntry(
+				&protocol.ServerEntry{
+					IpAddress:         fmt.Sprintf("192.0.%d.%d", i+1, j+1),
+					WebServerPort:     "8000",
+					WebServerSecret:   "secret",
+					SshObfuscatedPort: 4001,
+					Capabilities:      []string{"OSSH"},
+					Region:            "US",
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+			env.serverEntries[oslID] = append(env.serverEntries[oslID], encodedServerEntry)
+		}
+	}
+	env.pave()
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if CountServerEntries() != 16 || len(probedEndpoints) != 6 {
+		t.Fatalf("unexpected probes: %v", probedEndpoints)
+	}
+
+	for i := range env.oslIDs {
+		probedCount := 0
+		for j := 0; j < 8; j++ {
+			ipAddress := fmt.Sprintf("192.0.%d.%d", i+1, j+1)
+			reachability, err := GetServerEntryReachability(ipAddress)
+			if err != nil {
+				t.Fatalf("GetServerEntryReachability failed: %s", err)
+			}
+			if reachability == nil {
+				continue
+			}
+			if j < 3 {
+				t.Fatalf("unexpected existing server entry probe: %s", ipAddress)
+			}
+			probedCount += 1
+			reachable := i != 0
+			if reachability.Endpoint != ipAddress+":4001" ||
+				reachability.Reachable != reachable ||
+				(reachability.Error == "") != reachable ||
+				reachability.ProbeTimestamp == "" {
+				t.Fatalf("unexpected reachability: %+v", reachability)
+			}
+		}
+		if probedCount != 3 {
+			t.Fatalf("unexpected probe count: %d", probedCount)
+		}
+	}
+}
+
+func TestEntropySource(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-entropy-source-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	downloadURLs := parameters.DownloadURLs{
+		{URL: base64.StdEncoding.EncodeToString([]byte("a.example.com"))},
+		{URL: base64.StdEncoding.EncodeToString([]byte("b.example.com"))},
+		{URL: base64.StdEncoding.EncodeToString([]byte("c.example.com"))},
+	}
+	err = downloadURLs.DecodeAndValidate()
+	if err != nil {
+		t.Fatalf("DecodeAndValidate failed: %s", err)
+	}
+
+	// getChoices returns the mirror selections, retry backoff jitter, and
+	// verification sample made using the config entropy.
+	getChoices := func(entropySource math_rand.Source) []string {
+
+		config, err := LoadConfig([]byte(`
+        {
+            "ClientPlatform" : "",
+            "ClientVersion" : "0",
+            "SponsorId" : "0",
+            "PropagationChannelId" : "0"
+        }`))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %s", err)
+		}
+		config.DataStoreDirectory = testDataDirName
+		config.EntropySource = entropySource
+		err = config.Commit()
+		if err != nil {
+			t.Fatalf("Commit failed: %s", err)
+		}
+		err = config.SetClientParameters("", false, map[string]interface{}{
+			parameters.VerifyImportedServerEntries:           true,
+			parameters.VerifyImportedServerEntriesSampleSize: 5,
+		})
+		if err != nil {
+			t.Fatalf("SetClientParameters failed: %s", err)
+		}
+
+		var choices []string
+
+		for i := 0; i < 20; i++ {
+			url, _, _ := downloadURLs.SelectWeighted(
+				0, []float64{1.0, 2.0, 3.0}, config.entropy)
+			choices = append(choices, url)
+		}
+
+		for i := 0; i < 20; i++ {
+			choices = append(choices,
+				jitterDuration(config.entropy, time.Second, 0.5).String())
+		}
+
+		verifier := newServerEntryImportVerifier(config)
+		for i := 0; i < 100; i++ {
+			verifier.add(protocol.ServerEntryFields{
+				"ipAddress": fmt.Sprintf("192.0.2.%d", i)})
+		}
+		for _, serverEntryFields := range verifier.sample {
+			choices = append(choices, serverEntryFields.GetIPAddress())
+		}
+
+		return choices
+	}
+
+	// Deterministic sources with the same seed make the same choices.
+
+	choices := getChoices(math_rand.NewSource(1))
+	if !reflect.DeepEqual(choices, getChoices(math_rand.NewSource(1))) {
+		t.Fatalf("unexpected choices with the same seed")
+	}
+
+	if reflect.DeepEqual(choices, getChoices(math_rand.NewSource(2))) {
+		t.Fatalf("unexpected choices with a different seed")
+	}
+
+	// Without an entropy source, a securely seeded source is used.
+
+	if len(getChoices(nil)) != len(choices) {
+		t.Fatalf("unexpected choices without an entropy source")
+	}
+}
+
+func TestGetFetchTelemetryJSON(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 3)
+	defer env.close()
+
+	remoteServerListFetchTelemetry.mutex.Lock()
+	remoteServerListFetchTelemetry.runs = nil
+	remoteServerListFetchTelemetry.mutex.Unlock()
+
+	getRuns := func() []*FetchTelemetryRun {
+		telemetryJSON, err := GetFetchTelemetryJSON()
+		if err != nil {
+			t.Fatalf("GetFetchTelemetryJSON failed: %s", err)
+		}
+		var runs []*FetchTelemetryRun
+		err = json.Unmarshal(telemetryJSON, &runs)
+		if err != nil {
+			t.Fatalf("json.Unmarshal failed: %s", err)
+		}
+		return runs
+	}
+
+	if len(getRuns()) != 0 {
+		t.Fatalf("unexpected fetch telemetry")
+	}
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	runs := getRuns()
+	if len(runs) != 2 {
+		t.Fatalf("unexpected fetch telemetry run count: %d", len(runs))
+	}
+
+	// The common remote server list fetch downloads one resource.
+
+	commonURL := env.server.URL + "/" + testCommonRemoteServerListName
+	commonSize := int64(len(commonRemoteServerList))
+
+	run := runs[0]
+	if run.Type != REMOTE_SERVER_LIST_FETCH_TYPE_COMMON ||
+		run.StartTime == "" ||
+		run.EndTime == "" ||
+		run.DownloadedBytes != commonSize ||
+		run.NewServerEntries != 1 ||
+		run.Error != "" ||
+		len(run.Sources) != 1 ||
+		run.Sources[commonURL] == nil ||
+		*run.Sources[commonURL] != (FetchTelemetrySource{
+			Requests: 1, Failures: 0, DownloadedBytes: commonSize}) {
+
+		t.Fatalf("unexpected common fetch telemetry: %+v", run)
+	}
+
+	// The obfuscated server list fetch downloads the registry and each OSL
+	// from the same source.
+
+	obfuscatedSize := int64(len(env.getFile(osl.REGISTRY_FILENAME)))
+	for _, hexID := range env.oslIDs {
+		obfuscatedSize += int64(len(env.getFile(env.oslFileName(hexID))))
+	}
+
+	run = runs[1]
+	if run.Type != REMOTE_SERVER_LIST_FETCH_TYPE_OBFUSCATED ||
+		run.StartTime == "" ||
+		run.EndTime == "" ||
+		run.DownloadedBytes != obfuscatedSize ||
+		run.NewServerEntries != 6 ||
+		run.Error != "" ||
+		len(run.Sources) != 3 ||
+		run.Sources[env.server.URL+"/"+osl.REGISTRY_FILENAME] == nil {
+
+		t.Fatalf("unexpected obfuscated fetch telemetry: %+v", run)
+	}
+	for _, source := range run.Sources {
+		if source.Requests != 1 || source.Failures != 0 {
+			t.Fatalf("unexpected obfuscated fetch telemetry source: %+v", source)
+		}
+	}
+
+	// With RemoteServerListTelemetryRedactURLs, URLs are redacted to
+	// hostnames, including in errors.
+
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListTelemetryRedactURLs: true,
+		parameters.RemoteServerListTelemetryMaxRuns:    2,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	SetUrlETag(commonURL, "")
+
+	env.mutex.Lock()
+	env.failRequests = 1
+	env.mutex.Unlock()
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+
+	runs = getRuns()
+	if len(runs) != 2 || runs[0].Type != REMOTE_SERVER_LIST_FETCH_TYPE_OBFUSCATED {
+		t.Fatalf("unexpected retained fetch telemetry: %+v", runs)
+	}
+
+	serverURL, _ := url.Parse(env.server.URL)
+	hostname := serverURL.Hostname()
+
+	run = runs[1]
+	if run.Error == "" ||
+		len(run.Sources) != 1 ||
+		run.Sources[hostname] == nil ||
+		*run.Sources[hostname] != (FetchTelemetrySource{
+			Requests: 1, Failures: 1, DownloadedBytes: 0}) {
+
+		t.Fatalf("unexpected redacted fetch telemetry: %+v", run)
+	}
+
+	runJSON, err := json.Marshal(run)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+	if strings.Contains(string(runJSON), "://") {
+		t.Fatalf("unexpected unredacted URL: %s", runJSON)
+	}
+}
+
+func TestFetchTelemetryTimeToFirstNewServerEntry(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 3, 1)
+	defer env.close()
+	env.downloadSequentially()
+
+	remoteServerListFetchTelemetry.mutex.Lock()
+	remoteServerListFetchTelemetry.runs = nil
+	remoteServerListFetchTelemetry.mutex.Unlock()
+
+	getLastRun := func() *FetchTelemetryRun {
+		telemetryJSON, err := GetFetchTelemetryJSON()
+		if err != nil {
+			t.Fatalf("GetFetchTelemetryJSON failed: %s", err)
+		}
+		var runs []*FetchTelemetryRun
+		err = json.Unmarshal(telemetryJSON, &runs)
+		if err != nil {
+			t.Fatalf("json.Unmarshal failed: %s", err)
+		}
+		if len(runs) == 0 {
+			t.Fatalf("missing fetch telemetry")
+		}
+		return runs[len(runs)-1]
+	}
+
+	// Each request is delayed, so the first OSL file is imported only after
+	// the registry and that file are downloaded, and the remaining OSL files
+	// are downloaded after the first import.
+
+	requestDelay := 30 * time.Millisecond
+
+	env.mutex.Lock()
+	env.requestHook = func(name string) {
+		time.Sleep(requestDelay)
+	}
+	env.mutex.Unlock()
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	startTime := time.Now()
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	fetchMilliseconds := int64(time.Since(startTime) / time.Millisecond)
+	delayMilliseconds := int64(requestDelay / time.Millisecond)
+
+	run := getLastRun()
+	if run.NewServerEntries != len(env.oslIDs) ||
+		run.TimeToFirstNewServerEntryMilliseconds < 2*delayMilliseconds ||
+		run.TimeToFirstNewServerEntryMilliseconds >
+			fetchMilliseconds-int64(len(env.oslIDs)-1)*delayMilliseconds {
+
+		t.Fatalf("unexpected time to first new server entry: %d, %d",
+			run.TimeToFirstNewServerEntryMilliseconds, fetchMilliseconds)
+	}
+
+	payloads := recorder.payloads("RemoteServerListTimeToFirstNewServerEntry")
+	if len(payloads) != 1 ||
+		payloads[0]["fetchType"] != REMOTE_SERVER_LIST_FETCH_TYPE_OBFUSCATED ||
+		payloads[0]["milliseconds"] != float64(run.TimeToFirstNewServerEntryMilliseconds) {
+
+		t.Fatalf("unexpected time to first new server entry notices: %+v", payloads)
+	}
+
+	// A fetch which imports no new server entries records no time.
+
+	env.mutex.Lock()
+	env.requestHook = nil
+	env.mutex.Unlock()
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	run = getLastRun()
+	if run.NewServerEntries != 0 || run.TimeToFirstNewServerEntryMilliseconds != 0 {
+		t.Fatalf("unexpected time to first new server entry: %+v", run)
+	}
+
+	if recorder.count("RemoteServerListTimeToFirstNewServerEntry") != 1 {
+		t.Fatalf("unexpected time to first new server entry notice count")
+	}
+}
+
+func TestFetchTelemetrySignatureVerificationTime(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 3, 1)
+	defer env.close()
+
+	remoteServerListFetchTelemetry.mutex.Lock()
+	remoteServerListFetchTelemetry.runs = nil
+	remoteServerListFetchTelemetry.mutex.Unlock()
+
+	getLastRun := func() *FetchTelemetryRun {
+		telemetryJSON, err := GetFetchTelemetryJSON()
+		if err != nil {
+			t.Fatalf("GetFetchTelemetryJSON failed: %s", err)
+		}
+		var runs []*FetchTelemetryRun
+		err = json.Unmarshal(telemetryJSON, &runs)
+		if err != nil {
+			t.Fatalf("json.Unmarshal failed: %s", err)
+		}
+		if len(runs) == 0 {
+			t.Fatalf("missing fetch telemetry")
+		}
+		return runs[len(runs)-1]
+	}
+
+	// Each verified OSL records its verification time, and the run records
+	// the total.
+
+	results, err := FetchObfuscatedServerListsWithResults(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("FetchObfuscatedServerListsWithResults failed: %s", err)
+	}
+	if len(results) != len(env.oslIDs) {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+
+	var totalMicroseconds int64
+	for _, result := range results {
+		if result.Err != nil || result.SignatureVerificationTime <= 0 {
+			t.Fatalf("unexpected result: %+v", result)
+		}
+		totalMicroseconds += int64(result.SignatureVerificationTime / time.Microsecond)
+	}
+
+	run := getLastRun()
+	if run.SignatureVerificationMicroseconds != totalMicroseconds {
+		t.Fatalf("unexpected signature verification time: %d, %d",
+			run.SignatureVerificationMicroseconds, totalMicroseconds)
+	}
+
+	// A real verification consumes CPU time.
+
+	dataPackage, err := common.WriteAuthenticatedDataPackage(
+		strings.Repeat("data", 1<<16), testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+
+	cpuTime := measureCPUTime(func() {
+		_, err = common.ReadAuthenticatedDataPackage(
+			dataPackage, true, testOSLSigningPublicKey)
+	})
+	if err != nil {
+		t.Fatalf("ReadAuthenticatedDataPackage failed: %s", err)
+	}
+	if cpuTime <= 0 {
+		t.Fatalf("unexpected verification time: %s", cpuTime)
+	}
+
+	// Unchanged OSLs are skipped without verification.
+
+	results, err = FetchObfuscatedServerListsWithResults(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("FetchObfuscatedServerListsWithResults failed: %s", err)
+	}
+	for _, result := range results {
+		if result.SignatureVerificationTime != 0 {
+			t.Fatalf("unexpected result: %+v", result)
+		}
+	}
+
+	run = getLastRun()
+	if run.SignatureVerificationMicroseconds != 0 {
+		t.Fatalf("unexpected signature verification time: %d",
+			run.SignatureVerificationMicroseconds)
+	}
+}
+
+func TestGetFetchTelemetryMetrics(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	remoteServerListFetchTelemetry.mutex.Lock()
+	remoteServerListFetchTelemetry.runs = nil
+	remoteServerListFetchTelemetry.counters = nil
+	remoteServerListFetchTelemetry.mutex.Unlock()
+
+	// getSamples parses the exposition, checking that each metric family
+	// has TYPE and HELP metadata, and returns the sample values by metric
+	// name and labels.
+	getSamples := func() map[string]int64 {
+
+		exposition := string(GetFetchTelemetryMetrics())
+		if !strings.HasSuffix(exposition, "\n# EOF\n") {
+			t.Fatalf("missing EOF: %s", exposition)
+		}
+
+		for _, family := range fetchTelemetryMetricFamilies {
+			for _, metadata := range []string{
+				"# TYPE " + family.name + " counter\n",
+				"# HELP " + family.name + " ",
+			} {
+				if !strings.Contains(exposition, metadata) {
+					t.Fatalf("missing metadata %q: %s", metadata, exposition)
+				}
+			}
+		}
+
+		samples := make(map[string]int64)
+		for _, line := range strings.Split(strings.TrimSpace(exposition), "\n") {
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				t.Fatalf("unexpected sample: %s", line)
+			}
+			value, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				t.Fatalf("ParseInt failed: %s", err)
+			}
+			samples[fields[0]] = value
+		}
+		return samples
+	}
+
+	samples := getSamples()
+	if len(samples) != 2*len(fetchTelemetryMetricFamilies) {
+		t.Fatalf("unexpected samples: %v", samples)
+	}
+	for name, value := range samples {
+		if value != 0 {
+			t.Fatalf("unexpected sample: %s %d", name, value)
+		}
+	}
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	// The counters accumulate across fetches, including a failed fetch.
+
+	env.mutex.Lock()
+	env.failRequests = 1
+	env.mutex.Unlock()
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("unexpected fetchCommon success")
+	}
+
+	remoteServerListFetchTelemetry.mutex.Lock()
+	obfuscatedBytes := remoteServerListFetchTelemetry.runs[1].DownloadedBytes
+	obfuscatedVerificationMicroseconds := remoteServerListFetchTelemetry.runs[1].SignatureVerificationMicroseconds
+	remoteServerListFetchTelemetry.mutex.Unlock()
+
+	expectedSamples := map[string]int64{
+		`psiphon_remote_server_list_fetches_total{type="common"}`:                2,
+		`psiphon_remote_server_list_fetch_failures_total{type="common"}`:         1,
+		`psiphon_remote_server_list_downloads_total{type="common"}`:              2,
+		`psiphon_remote_server_list_download_failures_total{type="common"}`:      1,
+		`psiphon_remote_server_list_downloaded_bytes_total{type="common"}`:       int64(len(commonRemoteServerList)),
+		`psiphon_remote_server_list_new_server_entries_total{type="common"}`:     1,
+		`psiphon_remote_server_list_fetches_total{type="obfuscated"}`:            1,
+		`psiphon_remote_server_list_fetch_failures_total{type="obfuscated"}`:     0,
+		`psiphon_remote_server_list_downloads_total{type="obfuscated"}`:          int64(1 + len(env.oslIDs)),
+		`psiphon_remote_server_list_download_failures_total{type="obfuscated"}`:  0,
+		`psiphon_remote_server_list_downloaded_bytes_total{type="obfuscated"}`:   obfuscatedBytes,
+		`psiphon_remote_server_list_new_server_entries_total{type="obfuscated"}`: int64(len(env.oslIDs)),
+
+		`psiphon_remote_server_list_signature_verification_microseconds_total{type="common"}`:     0,
+		`psiphon_remote_server_list_signature_verification_microseconds_total{type="obfuscated"}`: obfuscatedVerificationMicroseconds,
+	}
+
+	samples = getSamples()
+	if len(samples) != len(expectedSamples) {
+		t.Fatalf("unexpected samples: %v", samples)
+	}
+	for name, expectedValue := range expectedSamples {
+		value, ok := samples[name]
+		if !ok || value != expectedValue {
+			t.Fatalf("unexpected sample %s: %d", name, value)
+		}
+	}
+
+	if obfuscatedBytes <= 0 {
+		t.Fatalf("unexpected obfuscated downloaded bytes: %d", obfuscatedBytes)
+	}
+}
+
+func TestFetchTelemetryUpload(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	remoteServerListFetchTelemetry.mutex.Lock()
+	remoteServerListFetchTelemetry.runs = nil
+	remoteServerListFetchTelemetry.counters = nil
+	remoteServerListFetchTelemetry.uploadQueue = nil
+	remoteServerListFetchTelemetry.mutex.Unlock()
+
+	var uploadMutex sync.Mutex
+	var uploadedBatches [][]*FetchTelemetryRun
+	uploadRequests := 0
+	failUploads := 0
+
+	uploadServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			uploadMutex.Lock()
+			defer uploadMutex.Unlock()
+			uploadRequests += 1
+			if r.Method != "POST" {
+				http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+				return
+			}
+			if failUploads > 0 {
+				failUploads -= 1
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			var batch []*FetchTelemetryRun
+			err := json.NewDecoder(r.Body).Decode(&batch)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			uploadedBatches = append(uploadedBatches, batch)
+		}))
+	defer uploadServer.Close()
+
+	makeHTTPClient := func(_ context.Context) (*http.Client, error) {
+		return uploadServer.Client(), nil
+	}
+
+	env.config.FetchTelemetryUploadURL = uploadServer.URL
+	err := env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.RemoteServerListTelemetryUploadBatchSize: 2,
+			parameters.RemoteServerListTelemetryUploadBackoff:   "10ms",
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	// Completed fetches are queued, without uploading.
+
+	for i := 0; i < 5; i++ {
+		err = env.fetchCommon()
+		if err != nil {
+			t.Fatalf("fetchCommon failed: %s", err)
+		}
+	}
+
+	queuedRuns := remoteServerListFetchTelemetry.nextUploadBatch(10)
+	if len(queuedRuns) != 5 || uploadRequests != 0 {
+		t.Fatalf("unexpected queued runs: %d, %d", len(queuedRuns), uploadRequests)
+	}
+
+	// The queue is uploaded in batches. When a batch fails to upload, the
+	// batches already uploaded are removed from the queue, and the next
+	// upload resumes with the failed batch.
+
+	uploadMutex.Lock()
+	uploadedBatches = nil
+	failUploads = 0
+	uploadMutex.Unlock()
+
+	err = uploadFetchTelemetry(context.Background(), env.config,
+		func(ctx context.Context) (*http.Client, error) {
+			uploadMutex.Lock()
+			if len(uploadedBatches) == 1 {
+				failUploads = 1
+			}
+			uploadMutex.Unlock()
+			return makeHTTPClient(ctx)
+		})
+	if err == nil {
+		t.Fatalf("uploadFetchTelemetry unexpectedly succeeded")
+	}
+
+	if len(uploadedBatches) != 1 ||
+		len(remoteServerListFetchTelemetry.nextUploadBatch(10)) != 3 {
+
+		t.Fatalf("unexpected uploaded batches: %d", len(uploadedBatches))
+	}
+
+	err = uploadFetchTelemetry(context.Background(), env.config, makeHTTPClient)
+	if err != nil {
+		t.Fatalf("uploadFetchTelemetry failed: %s", err)
+	}
+
+	if uploadRequests != 4 || len(uploadedBatches) != 3 {
+		t.Fatalf("unexpected uploads: %d, %d", uploadRequests, len(uploadedBatches))
+	}
+
+	var uploadedRuns []*FetchTelemetryRun
+	for i, batch := range uploadedBatches {
+		expectedSize := 2
+		if i == 2 {
+			expectedSize = 1
+		}
+		if len(batch) != expectedSize {
+			t.Fatalf("unexpected batch size: %d", len(batch))
+		}
+		uploadedRuns = append(uploadedRuns, batch...)
+	}
+	if !reflect.DeepEqual(uploadedRuns, queuedRuns) {
+		t.Fatalf("unexpected uploaded runs")
+	}
+
+	if len(remoteServerListFetchTelemetry.nextUploadBatch(10)) != 0 {
+		t.Fatalf("unexpected queued runs after upload")
+	}
+
+	// The uploader retries a failed upload, with backoff, until the queued
+	// fetch telemetry is uploaded.
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	uploadMutex.Lock()
+	uploadRequests = 0
+	uploadedBatches = nil
+	failUploads = 2
+	uploadMutex.Unlock()
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	signal := make(chan struct{}, 1)
+	uploaderDone := make(chan struct{})
+	go func() {
+		runFetchTelemetryUploader(ctx, env.config, makeHTTPClient, signal)
+		close(uploaderDone)
+	}()
+
+	signal <- struct{}{}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(remoteServerListFetchTelemetry.nextUploadBatch(10)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("fetch telemetry not uploaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancelFunc()
+	<-uploaderDone
+
+	uploadMutex.Lock()
+	defer uploadMutex.Unlock()
+
+	if uploadRequests != 3 || len(uploadedBatches) != 1 || len(uploadedBatches[0]) != 1 {
+		t.Fatalf("unexpected uploads: %d, %d", uploadRequests, len(uploadedBatches))
+	}
+}
+
+func TestObfuscatedServerListRegistryDelta(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 3, 1)
+	defer env.close()
+
+	err := env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ObfuscatedServerListRegistryDeltas: true,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	oslIDs := make([][]byte, len(env.oslIDs))
+	for i, hexID := range env.oslIDs {
+		oslIDs[i], _ = hex.DecodeString(hexID)
+	}
+
+	// The base registry omits the third OSL, which is added by the delta.
+
+	var addedFileSpec *osl.OSLFileSpec
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		var fileSpecs []*osl.OSLFileSpec
+		for _, fileSpec := range registry.FileSpecs {
+			if bytes.Equal(fileSpec.ID, oslIDs[2]) {
+				addedFileSpec = fileSpec
+			} else {
+				fileSpecs = append(fileSpecs, fileSpec)
+			}
+		}
+		registry.FileSpecs = fileSpecs
+	})
+
+	checkDirectory := func(expectedOSLIDs ...string) {
+		directory, err := GetCachedOSLDirectory(env.config)
+		if err != nil {
+			t.Fatalf("GetCachedOSLDirectory failed: %s", err)
+		}
+		var directoryOSLIDs []string
+		for _, entry := range directory.OSLs {
+			directoryOSLIDs = append(directoryOSLIDs, entry.ID)
+		}
+		if strings.Join(directoryOSLIDs, ",") != strings.Join(expectedOSLIDs, ",") {
+			t.Fatalf("unexpected directory OSLs: %v", directoryOSLIDs)
+		}
+	}
+
+	fetchAndCheck := func(expectedRegistryRequests int) {
+		err := env.fetch()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+		requestCount := env.requestCount(osl.REGISTRY_FILENAME)
+		if requestCount != expectedRegistryRequests {
+			t.Fatalf("unexpected registry request count: %d", requestCount)
+		}
+	}
+
+	// With no delta served, the full registry is downloaded.
+
+	fetchAndCheck(1)
+	checkDirectory(env.oslIDs[0], env.oslIDs[1])
+
+	baseETag := env.fileETag(osl.REGISTRY_FILENAME)
+
+	// The delta removes the first OSL and adds the third OSL. The OSLs
+	// remaining in the base registry are not downloaded again.
+
+	env.setRegistryDelta(&osl.RegistryDelta{
+		BaseETag:   baseETag,
+		FileSpecs:  []*osl.OSLFileSpec{addedFileSpec},
+		RemovedIDs: [][]byte{oslIDs[0]},
+	})
+
+	fetchAndCheck(2)
+	checkDirectory(env.oslIDs[1], env.oslIDs[2])
+
+	for i, expectedRequestCount := range []int{1, 1, 1} {
+		requestCount := env.requestCount(env.oslFileName(env.oslIDs[i]))
+		if requestCount != expectedRequestCount {
+			t.Fatalf("unexpected OSL %d request count: %d", i, requestCount)
+		}
+	}
+
+	registryFilename := osl.GetOSLRegistryFilename(
+		env.config.ObfuscatedServerListDownloadDirectory)
+
+	cachedRegistry, err := ioutil.ReadFile(registryFilename + ".cached")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	if !bytes.Equal(cachedRegistry, env.getFile(osl.REGISTRY_FILENAME)) {
+		t.Fatalf("unexpected cached registry")
+	}
+
+	// The stored delta remains applied when the registry is unchanged.
+
+	fetchAndCheck(3)
+	checkDirectory(env.oslIDs[1], env.oslIDs[2])
+
+	ok, reason := IsOSLUnlockable(env.config, oslIDs[2])
+	if !ok {
+		t.Fatalf("unexpected added OSL result: %s", reason)
+	}
+
+	// A delta relative to a different base registry isn't applied, and the
+	// full registry is downloaded instead.
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		registry.FileSpecs = append(registry.FileSpecs, addedFileSpec)
+	})
+
+	env.setRegistryDelta(&osl.RegistryDelta{
+		BaseETag:   env.fileETag(osl.REGISTRY_FILENAME),
+		RemovedIDs: [][]byte{oslIDs[1]},
+	})
+
+	fetchAndCheck(5)
+	checkDirectory(env.oslIDs[0], env.oslIDs[1], env.oslIDs[2])
+
+	_, err = os.Stat(registryFilename + ".delta")
+	if !os.IsNotExist(err) {
+		t.Fatalf("unexpected stored delta: %v", err)
+	}
+}
+
+func TestObfuscatedServerListResumeRegistryDelta(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 4, 1)
+	defer env.close()
+	env.downloadSequentially()
+
+	err := env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ObfuscatedServerListRegistryDeltas:       true,
+		parameters.ObfuscatedServerListResumeRegistryDeltas: true,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	registryURL := env.server.URL + "/" + osl.REGISTRY_FILENAME
+
+	// The base registry lists only the first OSL. The remaining OSLs are
+	// added by the delta.
+
+	var addedFileSpecs []*osl.OSLFileSpec
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		addedFileSpecs = registry.FileSpecs[1:]
+		registry.FileSpecs = registry.FileSpecs[:1]
+	})
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	baseETag := env.fileETag(osl.REGISTRY_FILENAME)
+
+	env.setRegistryDelta(&osl.RegistryDelta{
+		BaseETag:  baseETag,
+		FileSpecs: addedFileSpecs,
+	})
+
+	// Interrupt the fetch as the second delta OSL is requested. The first
+	// delta OSL is applied and the remaining delta OSLs are left in the
+	// progress.
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	OSLRequests := 0
+	env.mutex.Lock()
+	env.requestHook = func(name string) {
+		if name == osl.REGISTRY_FILENAME {
+			return
+		}
+		OSLRequests += 1
+		if OSLRequests == 2 {
+			cancelFunc()
+		}
+	}
+	env.mutex.Unlock()
+
+	err = FetchObfuscatedServerLists(ctx, env.config, 0, nil, &DialConfig{})
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+
+	env.mutex.Lock()
+	env.requestHook = nil
+	env.mutex.Unlock()
+
+	if CountServerEntries() != 2 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Simulate a restart. The delta and its progress persist.
+
+	CloseDataStore()
+	err = OpenDataStore(&Config{DataStoreDirectory: env.dataDirectory})
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	progress, err := getOSLRegistryDeltaProgress(registryURL)
+	if err != nil {
+		t.Fatalf("getOSLRegistryDeltaProgress failed: %s", err)
+	}
+	if progress == nil ||
+		len(progress.RemainingIDs) != 2 ||
+		len(progress.AppliedIDs) != 1 ||
+		!bytes.Equal(progress.AppliedIDs[0], addedFileSpecs[0].ID) {
+		t.Fatalf("unexpected delta progress: %+v", progress)
+	}
+
+	ETag, err := GetUrlETag(registryURL)
+	if err != nil {
+		t.Fatalf("GetUrlETag failed: %s", err)
+	}
+	if ETag == "" || ETag == baseETag {
+		t.Fatalf("unexpected registry ETag: %s", ETag)
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// The next fetch resumes applying the stored delta, processing only the
+	// remaining delta OSLs, and the completed progress is deleted.
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// The applied delta OSL isn't requested again. The interrupted request
+	// for the second delta OSL is retried, and the fetch was interrupted
+	// before the third delta OSL was requested.
+
+	for i, expectedRequestCount := range []int{1, 1, 2, 1} {
+		requestCount := env.requestCount(env.oslFileName(env.oslIDs[i]))
+		if requestCount != expectedRequestCount {
+			t.Fatalf("unexpected OSL %d request count: %d", i, requestCount)
+		}
+	}
+
+	resumedCount := 0
+	for _, payload := range recorder.payloads("Info") {
+		message, _ := payload["message"].(string)
+		if strings.Contains(message, "resuming obfuscated server list registry delta with 2 remaining files") {
+			resumedCount += 1
+		}
+	}
+	if resumedCount != 1 {
+		t.Fatalf("unexpected resumed delta count: %d", resumedCount)
+	}
+
+	directory, err := GetCachedOSLDirectory(env.config)
+	if err != nil {
+		t.Fatalf("GetCachedOSLDirectory failed: %s", err)
+	}
+	var directoryOSLIDs []string
+	for _, entry := range directory.OSLs {
+		directoryOSLIDs = append(directoryOSLIDs, entry.ID)
+	}
+	if strings.Join(directoryOSLIDs, ",") != strings.Join(env.oslIDs, ",") {
+		t.Fatalf("unexpected directory OSLs: %v", directoryOSLIDs)
+	}
+
+	progress, err = getOSLRegistryDeltaProgress(registryURL)
+	if err != nil {
+		t.Fatalf("getOSLRegistryDeltaProgress failed: %s", err)
+	}
+	if progress != nil {
+		t.Fatalf("unexpected delta progress: %+v", progress)
+	}
+}
+
+func TestObfuscatedServerListRegistryResume(t *testing.T) {
+
+	// newEnv returns a test environment with a cached registry which lists
+	// only the first OSL. The served registry, which lists both OSLs, has
+	// changed and is to be downloaded by the next fetch.
+	newEnv := func() *testOSLEnvironment {
+
+		env := newTestOSLEnvironment(t, 2, 1)
+
+		oslID, _ := hex.DecodeString(env.oslIDs[1])
+		env.rewriteRegistry(func(registry *osl.Registry) {
+			var fileSpecs []*osl.OSLFileSpec
+			for _, fileSpec := range registry.FileSpecs {
+				if !bytes.Equal(fileSpec.ID, oslID) {
+					fileSpecs = append(fileSpecs, fileSpec)
+				}
+			}
+			registry.FileSpecs = fileSpecs
+		})
+
+		err := env.fetch()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+		if CountServerEntries() != 1 {
+			t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+		}
+
+		env.pave()
+
+		return env
+	}
+
+	checkFetch := func(
+		env *testOSLEnvironment,
+		recorder *testNoticeRecorder,
+		expectedRegistryRequests int,
+		expectedResumeOffset int64) {
+
+		err := env.fetch()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+		requestCount := env.requestCount(osl.REGISTRY_FILENAME)
+		if requestCount != expectedRegistryRequests {
+			t.Fatalf("unexpected registry request count: %d", requestCount)
+		}
+		payloads := recorder.payloads("ResumeDownload")
+		if len(payloads) != 1 ||
+			payloads[0]["offset"] != float64(expectedResumeOffset) {
+			t.Fatalf("unexpected resume notices: %+v", payloads)
+		}
+		if CountServerEntries() != len(env.oslIDs) {
+			t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+		}
+		directory, err := GetCachedOSLDirectory(env.config)
+		if err != nil {
+			t.Fatalf("GetCachedOSLDirectory failed: %s", err)
+		}
+		if len(directory.OSLs) != len(env.oslIDs) {
+			t.Fatalf("unexpected directory OSLs: %+v", directory.OSLs)
+		}
+	}
+
+	t.Run("interrupted download is resumed", func(t *testing.T) {
+
+		env := newEnv()
+		defer env.close()
+
+		recorder := startTestNoticeRecorder()
+		defer recorder.stop()
+
+		env.mutex.Lock()
+		env.truncateRequests = 1
+		env.mutex.Unlock()
+
+		registrySize := int64(len(env.getFile(osl.REGISTRY_FILENAME)))
+
+		// The interrupted registry download is immediately resumed from the
+		// partial download, in the same fetch, and the complete registry is
+		// validated.
+
+		checkFetch(env, recorder, 3, registrySize/2)
+	})
+
+	t.Run("interrupted download is resumed by next fetch", func(t *testing.T) {
+
+		env := newEnv()
+		defer env.close()
+
+		err := env.config.SetClientParameters("", false, map[string]interface{}{
+			parameters.ObfuscatedServerListRegistryResumeAttempts: 0,
+		})
+		if err != nil {
+			t.Fatalf("SetClientParameters failed: %s", err)
+		}
+
+		recorder := startTestNoticeRecorder()
+		defer recorder.stop()
+
+		env.mutex.Lock()
+		env.truncateRequests = 1
+		env.mutex.Unlock()
+
+		registrySize := int64(len(env.getFile(osl.REGISTRY_FILENAME)))
+
+		// The partial registry isn't validated or used, and the fetch
+		// proceeds with the cached registry.
+
+		err = env.fetch()
+		if err == nil {
+			t.Fatalf("unexpected fetch success")
+		}
+		if CountServerEntries() != 1 {
+			t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+		}
+
+		checkFetch(env, recorder, 3, registrySize/2)
+	})
+
+	t.Run("corrupt resumed download is downloaded again", func(t *testing.T) {
+
+		env := newEnv()
+		defer env.close()
+
+		recorder := startTestNoticeRecorder()
+		defer recorder.stop()
+
+		// Simulate a corrupt partial download of the current registry.
+
+		registry := env.getFile(osl.REGISTRY_FILENAME)
+		partialRegistry := make([]byte, len(registry)/2)
+		for i := range partialRegistry {
+			partialRegistry[i] = ^registry[i]
+		}
+
+		registryFilename := osl.GetOSLRegistryFilename(
+			env.config.ObfuscatedServerListDownloadDirectory)
+		err := ioutil.WriteFile(registryFilename+".part", partialRegistry, 0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+		err = ioutil.WriteFile(
+			registryFilename+".part.etag",
+			[]byte(env.fileETag(osl.REGISTRY_FILENAME)),
+			0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+
+		// The resumed registry fails validation and is downloaded again,
+		// from the beginning, in the same fetch.
+
+		checkFetch(env, recorder, 3, int64(len(partialRegistry)))
+
+		found := false
+		for _, payload := range recorder.payloads("Alert") {
+			message, _ := payload["message"].(string)
+			if strings.Contains(message, "resumed obfuscated server list registry failed validation") {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("missing resumed registry validation alert")
+		}
+	})
+}
+
+func TestObfuscatedServerListSkipUnchangedFetch(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	err := env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ObfuscatedServerListSkipUnchangedFetch: true,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	check := func(
+		expectedSkippedCount, expectedOSLRequests, expectedServerEntryCount int) {
+
+		skippedCount := 0
+		for _, payload := range recorder.payloads("Info") {
+			message, _ := payload["message"].(string)
+			if strings.Contains(message, "skipping unchanged obfuscated server list registry") {
+				skippedCount += 1
+			}
+		}
+		if skippedCount != expectedSkippedCount {
+			t.Fatalf("unexpected skipped count: %d", skippedCount)
+		}
+		OSLRequests := 0
+		for _, oslID := range env.oslIDs {
+			OSLRequests += env.requestCount(env.oslFileName(oslID))
+		}
+		if OSLRequests != expectedOSLRequests {
+			t.Fatalf("unexpected OSL request count: %d", OSLRequests)
+		}
+		if CountServerEntries() != expectedServerEntryCount {
+			t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+		}
+	}
+
+	fetchAndCheck := func(
+		expectedSkippedCount, expectedOSLRequests, expectedServerEntryCount int) {
+
+		err := env.fetch()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+		check(expectedSkippedCount, expectedOSLRequests, expectedServerEntryCount)
+	}
+
+	addServerEntries := func(host int) {
+		for i, oslID := range env.oslIDs {
+			encodedServerEntry, err := protocol.EncodeServerEntry(
+				&protocol.ServerEntry{
+					IpAddress:    fmt.Sprintf("192.0.%d.%d", i+1, host),
+					Capabilities: []string{"OSSH"},
+					Region:       "US",
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+			env.serverEntries[oslID] = append(env.serverEntries[oslID], encodedServerEntry)
+		}
+		env.pave()
+	}
+
+	// With no SLOKs, no OSLs are seeded. The first fetch reads the registry
+	// and the next fetch, with nothing changed, skips the registry.
+
+	err = DeleteSLOKs()
+	if err != nil {
+		t.Fatalf("DeleteSLOKs failed: %s", err)
+	}
+
+	fetchAndCheck(0, 0, 0)
+	fetchAndCheck(1, 0, 0)
+
+	// When the SLOK set changes, the registry is read and the newly seeded
+	// OSLs are downloaded.
+
+	env.seedSLOKs()
+
+	fetchAndCheck(1, 2, 2)
+	fetchAndCheck(2, 2, 2)
+
+	// When the registry changes, the registry is read and the seeded OSLs
+	// are requested again.
+
+	addServerEntries(100)
+
+	fetchAndCheck(2, 4, 4)
+	fetchAndCheck(3, 4, 4)
+
+	// A fetch which fails to import an OSL doesn't store a fingerprint, so
+	// the next fetch reads the unchanged registry and retries the failed
+	// OSL. The OSL imported by the failed fetch isn't requested again, as
+	// its stored ETag matches the registry MD5 sum.
+
+	addServerEntries(101)
+
+	oslFileName := env.oslFileName(env.oslIDs[0])
+	oslFile := env.getFile(oslFileName)
+	env.setFile(oslFileName, []byte("invalid"))
+
+	err = env.fetch()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+	check(3, 6, 5)
+
+	env.setFile(oslFileName, oslFile)
+
+	fetchAndCheck(3, 7, 6)
+	fetchAndCheck(4, 7, 6)
+}
+
+func TestObfuscatedServerListKeyRotation(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	rotatedPublicKey, rotatedPrivateKey, err :=
+		common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("error generating package keys: %s", err)
+	}
+
+	// Serve OSL files signed with the rotated key, while the registry remains
+	// signed with the original key. OSL file keys are derived from the
+	// scheme, so the original registry decrypts the repaved OSL files.
+
+	paveFiles, err := env.oslConfig.Pave(
+		time.Now().UTC().Truncate(24*time.Hour),
+		env.propagationChannelID,
+		rotatedPublicKey,
+		rotatedPrivateKey,
+		env.serverEntries,
+		nil,
+		nil,
+		0,
+		nil)
+	if err != nil {
+		t.Fatalf("error paving OSL files: %s", err)
+	}
+	for _, paveFile := range paveFiles {
+		if paveFile.Name != osl.REGISTRY_FILENAME {
+			env.setFile(paveFile.Name, paveFile.Contents)
+		}
+	}
+
+	// Without a key rotation, the OSL files fail validation.
+
+	err = env.fetch()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Apply the key rotation after the registry is downloaded, as the first
+	// OSL file is requested. The registry is validated with the original
+	// key and all OSL files are validated with the rotated key.
+
+	var rotateErr error
+	rotated := false
+	env.mutex.Lock()
+	env.requestHook = func(name string) {
+		if name == osl.REGISTRY_FILENAME || rotated {
+			return
+		}
+		rotated = true
+		rotateErr = env.config.SetClientParameters("", false, map[string]interface{}{
+			parameters.RemoteServerListSignaturePublicKey: rotatedPublicKey,
+		})
+	}
+	env.mutex.Unlock()
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	if !rotated || rotateErr != nil {
+		t.Fatalf("key rotation not applied: %v", rotateErr)
+	}
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestRemoteServerListMissingSignaturePublicKey(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	// Stage the OSL files, to check that a later import without a key
+	// doesn't discard them.
+
+	err := DownloadObfuscatedServerLists(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("DownloadObfuscatedServerLists failed: %s", err)
+	}
+
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListSignaturePublicKey: "",
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	checkErr := func(err error) {
+		if err == nil ||
+			!strings.Contains(err.Error(), "missing RemoteServerListSignaturePublicKey") {
+
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	checkErr(env.fetch())
+	checkErr(env.fetchCommon())
+	checkErr(DownloadObfuscatedServerLists(
+		context.Background(), env.config, 0, nil, &DialConfig{}))
+	checkErr(ImportDownloadedObfuscatedServerLists(env.config))
+
+	// The fetches fail before making any request.
+
+	if env.requestCount(osl.REGISTRY_FILENAME) != 1 ||
+		env.requestCount(testCommonRemoteServerListName) != 0 {
+
+		t.Fatalf("unexpected request count")
+	}
+
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	records, err := getOSLPendingImportRecords()
+	if err != nil {
+		t.Fatalf("getOSLPendingImportRecords failed: %s", err)
+	}
+	if len(records) != len(env.oslIDs) {
+		t.Fatalf("unexpected pending import count: %d", len(records))
+	}
+
+	// With the key restored, the staged OSL files are imported.
+
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListSignaturePublicKey: testOSLSigningPublicKey,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = ImportDownloadedObfuscatedServerLists(env.config)
+	if err != nil {
+		t.Fatalf("ImportDownloadedObfuscatedServerLists failed: %s", err)
+	}
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestObfuscatedServerListFetchPlan(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 4, 1)
+	defer env.close()
+	env.downloadSequentially()
+
+	err := env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ObfuscatedServerListPersistFetchPlan: true,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	registryURL := env.server.URL + "/" + osl.REGISTRY_FILENAME
+
+	checkPlan := func(expectedRemaining int) {
+		fingerprint, fileSpecs, err := getOSLFetchPlan(registryURL)
+		if err != nil {
+			t.Fatalf("getOSLFetchPlan failed: %s", err)
+		}
+		if expectedRemaining == -1 {
+			if fingerprint != "" || len(fileSpecs) != 0 {
+				t.Fatalf("unexpected fetch plan: %d remaining", len(fileSpecs))
+			}
+			return
+		}
+		if fingerprint == "" || len(fileSpecs) != expectedRemaining {
+			t.Fatalf("unexpected fetch plan: %d remaining", len(fileSpecs))
+		}
+	}
+
+	// Interrupt the fetch as the third OSL is requested. The first two OSLs
+	// are processed and the remaining OSLs are left in the plan.
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	OSLRequests := 0
+	env.mutex.Lock()
+	env.requestHook = func(name string) {
+		if name == osl.REGISTRY_FILENAME {
+			return
+		}
+		OSLRequests += 1
+		if OSLRequests == 3 {
+			cancelFunc()
+		}
+	}
+	env.mutex.Unlock()
+
+	err = FetchObfuscatedServerLists(ctx, env.config, 0, nil, &DialConfig{})
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+
+	env.mutex.Lock()
+	env.requestHook = nil
+	env.mutex.Unlock()
+
+	requestOrder := env.oslRequestOrder()
+	if len(requestOrder) != 3 || CountServerEntries() != 2 {
+		t.Fatalf("unexpected interrupted fetch: %+v, %d", requestOrder, CountServerEntries())
+	}
+
+	// Simulate a restart. The plan persists in the datastore.
+
+	CloseDataStore()
+	err = OpenDataStore(&Config{DataStoreDirectory: env.dataDirectory})
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	checkPlan(2)
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// The next fetch resumes the plan, processing only the remaining OSLs,
+	// and the completed plan is deleted.
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+	for i, name := range requestOrder {
+		expectedCount := 1
+		if i == 2 {
+			expectedCount = 2
+		}
+		if env.requestCount(name) != expectedCount {
+			t.Fatalf("unexpected request count for %s: %d", name, env.requestCount(name))
+		}
+	}
+
+	resumedCount := 0
+	for _, payload := range recorder.payloads("Info") {
+		message, _ := payload["message"].(string)
+		if strings.Contains(message, "resuming obfuscated server list fetch plan with 2 remaining files") {
+			resumedCount += 1
+		}
+	}
+	if resumedCount != 1 {
+		t.Fatalf("unexpected resumed plan count: %d", resumedCount)
+	}
+
+	checkPlan(-1)
+
+	// With the plan complete, the following fetch reads the registry and
+	// makes a new plan, which is completed and deleted.
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	checkPlan(-1)
+}
+
+func TestObfuscatedServerListFailureAlerts(t *testing.T) {
+
+	oslCount := 6
+
+	env := newTestOSLEnvironment(t, oslCount, 1)
+	defer env.close()
+
+	failureAlerts := func(recorder *testNoticeRecorder) (int, []string) {
+		individual := 0
+		var summaries []string
+		for _, payload := range recorder.payloads("Alert") {
+			message := payload["message"].(string)
+			if strings.HasPrefix(message, "failed to download obfuscated server list file") {
+				individual += 1
+			} else if strings.Contains(message, "obfuscated server list file downloads failed") {
+				summaries = append(summaries, message)
+			}
+		}
+		return individual, summaries
+	}
+
+	// Simulate an outage once the registry is downloaded: each OSL download
+	// fails with the same network error, which includes the OSL file URL.
+
+	fetchDuringOutage := func() {
+		env.mutex.Lock()
+		env.requestHook = func(name string) {
+			if name == osl.REGISTRY_FILENAME {
+				env.mutex.Lock()
+				env.failRequests = 1000
+				env.mutex.Unlock()
+			}
+		}
+		env.mutex.Unlock()
+
+		err := env.fetch()
+		if err == nil {
+			t.Fatalf("unexpected fetch success")
+		}
+
+		env.mutex.Lock()
+		env.requestHook = nil
+		env.failRequests = 0
+		env.mutex.Unlock()
+	}
+
+	t.Run("identical failures coalesce", func(t *testing.T) {
+
+		recorder := startTestNoticeRecorder()
+		defer recorder.stop()
+
+		fetchDuringOutage()
+
+		individual, summaries := failureAlerts(recorder)
+		if individual != 3 || len(summaries) != 1 ||
+			!strings.HasPrefix(summaries[0],
+				fmt.Sprintf("%d obfuscated server list file downloads failed, %d not alerted individually",
+					oslCount, oslCount-3)) {
+
+			t.Fatalf("unexpected failure alerts: %d, %+v", individual, summaries)
+		}
+		if strings.Contains(summaries[0], env.oslFileName(env.oslIDs[oslCount-1])) {
+			t.Fatalf("unexpected OSL file name in summary: %s", summaries[0])
+		}
+	})
+
+	t.Run("coalescing disabled", func(t *testing.T) {
+
+		err := env.config.SetClientParameters(
+			"", false, map[string]interface{}{
+				parameters.ObfuscatedServerListFailureAlertLimit: 0,
+			})
+		if err != nil {
+			t.Fatalf("SetClientParameters failed: %s", err)
+		}
+
+		recorder := startTestNoticeRecorder()
+		defer recorder.stop()
+
+		fetchDuringOutage()
+
+		individual, summaries := failureAlerts(recorder)
+		if individual != oslCount || len(summaries) != 0 {
+			t.Fatalf("unexpected failure alerts: %d, %+v", individual, summaries)
+		}
+	})
+
+	t.Run("distinct failures", func(t *testing.T) {
+
+		recorder := startTestNoticeRecorder()
+		defer recorder.stop()
+
+		state := &obfuscatedServerListFetchState{
+			config:            env.config,
+			failureAlertLimit: 1,
+			failureAlerts:     make(map[string]int),
+		}
+
+		for i := 0; i < 3; i++ {
+			hexID := fmt.Sprintf("%02x", i)
+			state.alertDownloadFailure(
+				hexID, "http://127.0.0.1/osl-"+hexID, "", fmt.Errorf("error A: osl-%s", hexID))
+			state.alertDownloadFailure(
+				hexID, "http://127.0.0.1/osl-"+hexID, "", errors.New("error B"))
+		}
+		state.alertDownloadFailureSummary()
+
+		individual, summaries := failureAlerts(recorder)
+		if individual != 2 || len(summaries) != 2 ||
+			summaries[0] != "3 obfuscated server list file downloads failed, 2 not alerted individually: error A: osl-<OSL>" ||
+			summaries[1] != "3 obfuscated server list file downloads failed, 2 not alerted individually: error B" {
+
+			t.Fatalf("unexpected failure alerts: %d, %+v", individual, summaries)
+		}
+	})
+}
+
+func TestObfuscatedServerListAttemptLog(t *testing.T) {
+
+	oslCount := 3
+	logSize := 4
+
+	env := newTestOSLEnvironment(t, oslCount, 1)
+	defer env.close()
+
+	getAttempts := func() []*OSLDownloadAttempt {
+		attemptsJSON, err := GetOSLDownloadAttemptsJSON()
+		if err != nil {
+			t.Fatalf("GetOSLDownloadAttemptsJSON failed: %s", err)
+		}
+		var attempts []*OSLDownloadAttempt
+		err = json.Unmarshal(attemptsJSON, &attempts)
+		if err != nil {
+			t.Fatalf("Unmarshal failed: %s", err)
+		}
+		return attempts
+	}
+
+	checkAttempt := func(attempt *OSLDownloadAttempt, oslID, result string) {
+		if attempt.OSLID != oslID || attempt.Result != result ||
+			attempt.URL != "127.0.0.1" ||
+			(result == OSL_DOWNLOAD_ATTEMPT_RESULT_DOWNLOADED) != (attempt.Bytes > 0) ||
+			(result == OSL_DOWNLOAD_ATTEMPT_RESULT_FAILED) != (attempt.Error != "") {
+
+			t.Fatalf("unexpected attempt: %+v", attempt)
+		}
+		_, err := time.Parse(time.RFC3339, attempt.Timestamp)
+		if err != nil {
+			t.Fatalf("unexpected attempt timestamp: %+v", attempt)
+		}
+	}
+
+	// Simulate an outage once the registry is downloaded: each OSL download
+	// fails with a network error which includes the OSL file URL.
+
+	fetchDuringOutage := func() {
+		env.mutex.Lock()
+		env.requestHook = func(name string) {
+			if name == osl.REGISTRY_FILENAME {
+				env.mutex.Lock()
+				env.failRequests = 1000
+				env.mutex.Unlock()
+			}
+		}
+		env.mutex.Unlock()
+
+		err := env.fetch()
+		if err == nil {
+			t.Fatalf("unexpected fetch success")
+		}
+
+		env.mutex.Lock()
+		env.requestHook = nil
+		env.failRequests = 0
+		env.mutex.Unlock()
+	}
+
+	// By default, no attempts are logged.
+
+	fetchDuringOutage()
+
+	if len(getAttempts()) != 0 {
+		t.Fatalf("unexpected attempts")
+	}
+
+	err := env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ObfuscatedServerListAttemptLogSize: logSize,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	// Failed attempts are logged with a redacted error.
+
+	fetchDuringOutage()
+
+	attempts := getAttempts()
+	if len(attempts) != oslCount {
+		t.Fatalf("unexpected attempt count: %d", len(attempts))
+	}
+	for i, oslID := range env.oslIDs {
+		attempt := attempts[i]
+		checkAttempt(attempt, oslID, OSL_DOWNLOAD_ATTEMPT_RESULT_FAILED)
+		if strings.Contains(attempt.Error, env.server.URL) ||
+			strings.Contains(attempt.Error, env.oslFileName(oslID)) ||
+			strings.Contains(attempt.Error, env.dataDirectory) {
+
+			t.Fatalf("unexpected unredacted error: %s", attempt.Error)
+		}
+	}
+
+	// The log is capped at logSize, discarding the oldest attempts.
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	attempts = getAttempts()
+	if len(attempts) != logSize {
+		t.Fatalf("unexpected attempt count: %d", len(attempts))
+	}
+	checkAttempt(attempts[0], env.oslIDs[oslCount-1], OSL_DOWNLOAD_ATTEMPT_RESULT_FAILED)
+	for i, oslID := range env.oslIDs {
+		checkAttempt(attempts[i+1], oslID, OSL_DOWNLOAD_ATTEMPT_RESULT_DOWNLOADED)
+	}
+
+	// Unchanged OSLs are logged. The log persists across a restart.
+
+	CloseDataStore()
+	err = OpenDataStore(&Config{DataStoreDirectory: env.dataDirectory})
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	attempts = getAttempts()
+	if len(attempts) != logSize {
+		t.Fatalf("unexpected attempt count: %d", len(attempts))
+	}
+	checkAttempt(attempts[0], env.oslIDs[oslCount-1], OSL_DOWNLOAD_ATTEMPT_RESULT_DOWNLOADED)
+	for i, oslID := range env.oslIDs {
+		checkAttempt(attempts[i+1], oslID, OSL_DOWNLOAD_ATTEMPT_RESULT_UNCHANGED)
+	}
+}
+
+func TestObfuscatedServerListSelectionWeight(t *testing.T) {
+
+	t.Run("import on fetch", func(t *testing.T) {
+		testObfuscatedServerListSelectionWeight(t, false)
+	})
+
+	t.Run("staged import", func(t *testing.T) {
+		testObfuscatedServerListSelectionWeight(t, true)
+	})
+}
+
+func testObfuscatedServerListSelectionWeight(t *testing.T, stagedImport bool) {
+
+	env := newTestOSLEnvironment(t, 3, 1)
+	defer env.close()
+
+	// OSL i is paved with selection weight i, so the OSL at index 0 has no
+	// selection weight.
+
+	for i, scheme := range env.oslConfig.Schemes {
+		scheme.OSLSelectionWeight = i
+	}
+	env.pave()
+
+	if stagedImport {
+		err := DownloadObfuscatedServerLists(
+			context.Background(), env.config, 0, nil, &DialConfig{})
+		if err != nil {
+			t.Fatalf("DownloadObfuscatedServerLists failed: %s", err)
+		}
+		err = ImportDownloadedObfuscatedServerLists(env.config)
+		if err != nil {
+			t.Fatalf("ImportDownloadedObfuscatedServerLists failed: %s", err)
+		}
+	} else {
+		err := env.fetch()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	for i := range env.oslIDs {
+		ipAddress := fmt.Sprintf("192.0.%d.1", i+1)
+		weight, err := GetServerEntrySelectionWeight(ipAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntrySelectionWeight failed: %s", err)
+		}
+		if weight != i {
+			t.Fatalf("unexpected selection weight for %s: %d", ipAddress, weight)
+		}
+	}
+
+	weight, err := GetServerEntrySelectionWeight("192.0.2.254")
+	if err != nil {
+		t.Fatalf("GetServerEntrySelectionWeight failed: %s", err)
+	}
+	if weight != 0 {
+		t.Fatalf("unexpected selection weight for unknown server entry: %d", weight)
+	}
+}
+
+func TestObfuscatedServerListRegionNeed(t *testing.T) {
+
+	t.Run("region hints", func(t *testing.T) {
+		testObfuscatedServerListRegionNeed(t, true)
+	})
+
+	t.Run("no region hints", func(t *testing.T) {
+		testObfuscatedServerListRegionNeed(t, false)
+	})
+}
+
+func testObfuscatedServerListRegionNeed(t *testing.T, regionHints bool) {
+
+	env := newTestOSLEnvironment(t, 5, 1)
+	defer env.close()
+
+	// With one server entry per OSL, OSL i contains a server entry in region
+	// regions[i%len(regions)], as paved by newTestOSLEnvironment. Only the
+	// OSL at index 2 contains a "GB" server entry.
+
+	regions := []string{"US", "CA", "GB", "DE"}
+	if regionHints {
+		for i, scheme := range env.oslConfig.Schemes {
+			scheme.OSLRegions = []string{regions[i%len(regions)]}
+		}
+		env.pave()
+	}
+
+	env.config.EgressRegion = "GB"
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	// Expect the "GB" OSL first when hinted, followed by the remaining OSLs
+	// in registry order. Without hints, expect registry order.
+
+	indexes := []int{0, 1, 2, 3, 4}
+	if regionHints {
+		indexes = []int{2, 0, 1, 3, 4}
+	}
+
+	var expectedOrder []string
+	for _, index := range indexes {
+		expectedOrder = append(expectedOrder, env.oslFileName(env.oslIDs[index]))
+	}
+
+	order := env.oslRequestOrder()
+	if !reflect.DeepEqual(order, expectedOrder) {
+		t.Fatalf("unexpected download order: %v, expected %v", order, expectedOrder)
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestObfuscatedServerListNewServerThreshold(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 5, 2)
+	defer env.close()
+	env.downloadSequentially()
+
+	// With two server entries per OSL, OSL i contains server entries in
+	// regions[i%4] and regions[(i+1)%4], as paved by newTestOSLEnvironment,
+	// for regions US, CA, GB, DE. So OSLs 0, 3, and 4 each contain one "US"
+	// server entry.
+
+	env.config.EgressRegion = "US"
+
+	err := env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.ObfuscatedServerListNewServerThreshold: 2,
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	// Expect the fetch to stop after OSL 3, which imports the second new "US"
+	// server entry.
+
+	var expectedOrder []string
+	for _, oslID := range env.oslIDs[:4] {
+		expectedOrder = append(expectedOrder, env.oslFileName(oslID))
+	}
+
+	order := env.oslRequestOrder()
+	if !reflect.DeepEqual(order, expectedOrder) {
+		t.Fatalf("unexpected download order: %v, expected %v", order, expectedOrder)
+	}
+
+	if CountServerEntries() != 8 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// The threshold counts only new server entries: the next fetch skips the
+	// unchanged OSLs and then imports OSL 4.
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(env.oslFileName(env.oslIDs[4])) != 1 ||
+		CountServerEntries() != 10 {
+
+		t.Fatalf("unexpected second fetch result: %d", CountServerEntries())
+	}
+}
+
+func TestObfuscatedServerListShardRoots(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 3, 1)
+	defer env.close()
+
+	// The primary root advertises OSLs 0 and 1 and the shard root advertises
+	// OSLs 1 and 2.
+
+	env.mutex.Lock()
+	env.files = make(map[string][]byte)
+	env.mutex.Unlock()
+
+	paveRoot := func(prefix string, oslIndexes []int) {
+
+		paveServerEntries := make(map[string][]string)
+		var omitSchemes []int
+		for i, oslID := range env.oslIDs {
+			if common.ContainsInt(oslIndexes, i) {
+				paveServerEntries[oslID] = env.serverEntries[oslID]
+			} else {
+				omitSchemes = append(omitSchemes, i)
+			}
+		}
+
+		paveFiles, err := env.oslConfig.Pave(
+			time.Now().UTC().Truncate(24*time.Hour),
+			env.propagationChannelID,
+			testOSLSigningPublicKey,
+			testOSLSigningPrivateKey,
+			paveServerEntries,
+			nil,
+			omitSchemes,
+			0,
+			nil)
+		if err != nil {
+			t.Fatalf("error paving OSL files: %s", err)
+		}
+
+		for _, paveFile := range paveFiles {
+			env.setFile(prefix+paveFile.Name, paveFile.Contents)
+		}
+	}
+
+	paveRoot("", []int{0, 1})
+	paveRoot("shard/", []int{1, 2})
+
+	env.config.ObfuscatedServerListShardRootURLs = parameters.DownloadURLsList{
+		parameters.DownloadURLs{
+			{
+				URL:               base64.StdEncoding.EncodeToString([]byte(env.server.URL + "/shard")),
+				OnlyAfterAttempts: 0,
+			},
+		},
+	}
+	err := env.config.SetClientParameters("", false, nil)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(osl.REGISTRY_FILENAME) != 1 ||
+		env.requestCount("shard/"+osl.REGISTRY_FILENAME) != 1 {
+		t.Fatalf("missing registry download")
+	}
+
+	// Each OSL is downloaded once, with the overlapping OSL downloaded from
+	// the primary root.
+
+	expectedRequestCounts := [][]int{{1, 0}, {1, 0}, {0, 1}}
+	for i, oslID := range env.oslIDs {
+		oslName := env.oslFileName(oslID)
+		requestCounts := []int{
+			env.requestCount(oslName), env.requestCount("shard/" + oslName)}
+		if !reflect.DeepEqual(requestCounts, expectedRequestCounts[i]) {
+			t.Fatalf("unexpected OSL %d requests: %v", i, requestCounts)
+		}
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Both registries are cached and the OSLs are not downloaded again.
+
+	requestCount := len(env.oslRequestOrder())
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if len(env.oslRequestOrder()) != requestCount {
+		t.Fatalf("unexpected OSL downloads: %v", env.oslRequestOrder()[requestCount:])
+	}
+}
+
+func TestRemoteServerListDownloadDeduplication(t *testing.T) {
+
+	t.Run("coordinated fetch", func(t *testing.T) {
+		testRemoteServerListDownloadDeduplication(t, true)
+	})
+
+	t.Run("separate fetches", func(t *testing.T) {
+		testRemoteServerListDownloadDeduplication(t, false)
+	})
+}
+
+func testRemoteServerListDownloadDeduplication(t *testing.T, coordinated bool) {
+
+	env := newTestOSLEnvironment(t, 3, 1)
+	defer env.close()
+
+	// The common remote server list URL references the same resource as the
+	// first OSL. The common fetch fails to authenticate the OSL file as a
+	// common remote server list, leaving its ETag unset, while the
+	// obfuscated fetch imports it.
+
+	sharedName := env.oslFileName(env.oslIDs[0])
+
+	env.config.RemoteServerListURLs = parameters.DownloadURLs{
+		{
+			URL:               base64.StdEncoding.EncodeToString([]byte(env.server.URL + "/" + sharedName)),
+			OnlyAfterAttempts: 0,
+		},
+	}
+	err := env.config.SetClientParameters("", false, nil)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	if coordinated {
+		err = FetchRemoteServerLists(
+			context.Background(), env.config, 0, nil, &DialConfig{})
+		if err == nil {
+			t.Fatalf("FetchRemoteServerLists unexpectedly succeeded")
+		}
+	} else {
+		err = env.fetchCommon()
+		if err == nil {
+			t.Fatalf("fetchCommon unexpectedly succeeded")
+		}
+		err = env.fetch()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+	}
+
+	expectedRequestCount := 2
+	if coordinated {
+		expectedRequestCount = 1
+	}
+
+	if env.requestCount(sharedName) != expectedRequestCount {
+		t.Fatalf("unexpected shared resource request count: %d", env.requestCount(sharedName))
+	}
+
+	for _, oslID := range env.oslIDs[1:] {
+		if env.requestCount(env.oslFileName(oslID)) != 1 {
+			t.Fatalf("unexpected OSL request count: %d", env.requestCount(env.oslFileName(oslID)))
+		}
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestFetchRemoteServerListsStaggered(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	// The common remote server list response is delayed, so that a
+	// concurrent obfuscated server list fetch requests the registry before
+	// the common fetch completes.
+
+	commonResponseDelay := 500 * time.Millisecond
+
+	// The registry request time is measured from the start of the fetch, as
+	// the common fetch may do more work than the obfuscated fetch before
+	// sending its request.
+
+	var startTime, commonRequestTime, registryRequestTime time.Time
+	env.requestHook = func(name string) {
+		switch name {
+		case testCommonRemoteServerListName:
+			commonRequestTime = time.Now()
+			time.Sleep(commonResponseDelay)
+		case osl.REGISTRY_FILENAME:
+			registryRequestTime = time.Now()
+		}
+	}
+
+	fetch := func(staggerDelay time.Duration) time.Duration {
+
+		err := env.config.SetClientParameters(
+			"", false, map[string]interface{}{
+				parameters.FetchRemoteServerListStaggerDelay: staggerDelay,
+			})
+		if err != nil {
+			t.Fatalf("SetClientParameters failed: %s", err)
+		}
+
+		startTime = time.Now()
+
+		err = FetchRemoteServerListsStaggered(
+			context.Background(), env.config, 0, nil, &DialConfig{})
+		if err != nil {
+			t.Fatalf("FetchRemoteServerListsStaggered failed: %s", err)
+		}
+
+		env.mutex.Lock()
+		defer env.mutex.Unlock()
+		if commonRequestTime.IsZero() || registryRequestTime.IsZero() {
+			t.Fatalf("missing requests: %v", env.requestOrder)
+		}
+		if registryRequestTime.Sub(commonRequestTime) >= commonResponseDelay {
+			t.Fatalf("unexpected fetch start: %v", env.requestOrder)
+		}
+		return registryRequestTime.Sub(startTime)
+	}
+
+	// The obfuscated server list fetch starts after the stagger delay, and
+	// before the common fetch completes.
+
+	staggerDelay := 200 * time.Millisecond
+
+	elapsed := fetch(staggerDelay)
+	if elapsed < staggerDelay {
+		t.Fatalf("unexpected staggered fetch start: %s", elapsed)
+	}
+
+	if CountServerEntries() != 2 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Without a stagger delay, the fetches start together.
+
+	elapsed = fetch(0)
+	if elapsed >= staggerDelay {
+		t.Fatalf("unexpected fetch start: %s", elapsed)
+	}
+}
+
+func TestObfuscatedServerListCorruptRegistryCache(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	cachedFilename := osl.GetOSLRegistryFilename(env.dataDirectory) + ".cached"
+
+	err = ioutil.WriteFile(cachedFilename, []byte("corrupt"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// The unchanged registry is skipped, the corrupt cached registry fails to
+	// load, and a fresh registry is downloaded in its place.
+
+	registryRequestCount := env.requestCount(osl.REGISTRY_FILENAME)
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if recorder.count("ObfuscatedServerListRegistryCacheCorrupt") != 1 {
+		t.Fatalf("missing corrupt registry cache notice")
+	}
+
+	if env.requestCount(osl.REGISTRY_FILENAME) != registryRequestCount+2 {
+		t.Fatalf("missing fresh registry download")
+	}
+
+	cachedRegistry, err := ioutil.ReadFile(cachedFilename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+
+	if !bytes.Equal(cachedRegistry, env.getFile(osl.REGISTRY_FILENAME)) {
+		t.Fatalf("unexpected cached registry")
+	}
+
+	// The recovered cached registry is used by the next fetch.
+
+	registryRequestCount = env.requestCount(osl.REGISTRY_FILENAME)
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if recorder.count("ObfuscatedServerListRegistryCacheCorrupt") != 1 {
+		t.Fatalf("unexpected corrupt registry cache notice")
+	}
+
+	if env.requestCount(osl.REGISTRY_FILENAME) != registryRequestCount+1 {
+		t.Fatalf("unexpected registry download")
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestObfuscatedServerListRegistryRollback(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	registryURL := osl.GetOSLRegistryURL(env.server.URL + "/")
+	cachedFilename := osl.GetOSLRegistryFilename(env.dataDirectory) + ".cached"
+
+	checkRegistry := func(expectedRegistry []byte, expectedGeneration int64) {
+
+		cachedRegistry, err := ioutil.ReadFile(cachedFilename)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %s", err)
+		}
+		if !bytes.Equal(cachedRegistry, expectedRegistry) {
+			t.Fatalf("unexpected cached registry")
+		}
+
+		generation, err := getOSLRegistryGeneration(registryURL)
+		if err != nil {
+			t.Fatalf("getOSLRegistryGeneration failed: %s", err)
+		}
+		if generation != expectedGeneration {
+			t.Fatalf("unexpected registry generation: %d", generation)
+		}
+	}
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		registry.Generation = 2
+	})
+	acceptedRegistry := env.getFile(osl.REGISTRY_FILENAME)
+	acceptedETag := env.fileETag(osl.REGISTRY_FILENAME)
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	checkRegistry(acceptedRegistry, 2)
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// An older registry is rejected, and the cached registry is used.
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		registry.Generation = 1
+	})
+
+	err = env.fetch()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+
+	payloads := recorder.payloads("ObfuscatedServerListRegistryRollback")
+	if len(payloads) != 1 ||
+		payloads[0]["generation"] != float64(1) ||
+		payloads[0]["highestGeneration"] != float64(2) {
+		t.Fatalf("unexpected registry rollback notices: %+v", payloads)
+	}
+
+	checkRegistry(acceptedRegistry, 2)
+
+	etag, err := GetUrlETag(registryURL)
+	if err != nil {
+		t.Fatalf("GetUrlETag failed: %s", err)
+	}
+	if etag != acceptedETag {
+		t.Fatalf("unexpected registry ETag: %s", etag)
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// A newer registry is accepted.
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		registry.Generation = 3
+	})
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if recorder.count("ObfuscatedServerListRegistryRollback") != 1 {
+		t.Fatalf("unexpected registry rollback notice")
+	}
+
+	checkRegistry(env.getFile(osl.REGISTRY_FILENAME), 3)
+}
+
+func TestObfuscatedServerListSLOKSchemeUnsupported(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	registryURL := osl.GetOSLRegistryURL(env.server.URL + "/")
+	downloadFilename := osl.GetOSLRegistryFilename(env.dataDirectory)
+	cachedFilename := downloadFilename + ".cached"
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	acceptedRegistry := env.getFile(osl.REGISTRY_FILENAME)
+	acceptedETag := env.fileETag(osl.REGISTRY_FILENAME)
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// A registry requiring a newer SLOK scheme is rejected, with a notice,
+	// and isn't cached.
+
+	unsupportedVersion := osl.SLOK_SCHEME_VERSION + 1
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		registry.SLOKSchemeVersion = unsupportedVersion
+	})
+
+	err = env.fetch()
+	schemeErr, ok := err.(osl.SLOKSchemeVersionError)
+	if !ok || schemeErr.Version != unsupportedVersion {
+		t.Fatalf("unexpected fetch error: %v", err)
+	}
+
+	payloads := recorder.payloads("ObfuscatedServerListSLOKSchemeUnsupported")
+	if len(payloads) != 1 ||
+		payloads[0]["slokSchemeVersion"] != float64(unsupportedVersion) ||
+		payloads[0]["supportedVersion"] != float64(osl.SLOK_SCHEME_VERSION) {
+		t.Fatalf("unexpected SLOK scheme unsupported notices: %+v", payloads)
+	}
+
+	cachedRegistry, err := ioutil.ReadFile(cachedFilename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	if !bytes.Equal(cachedRegistry, acceptedRegistry) {
+		t.Fatalf("unexpected cached registry")
+	}
+	if _, err := os.Stat(downloadFilename); !os.IsNotExist(err) {
+		t.Fatalf("unexpected downloaded registry: %v", err)
+	}
+
+	etag, err := GetUrlETag(registryURL)
+	if err != nil {
+		t.Fatalf("GetUrlETag failed: %s", err)
+	}
+	if etag != acceptedETag {
+		t.Fatalf("unexpected registry ETag: %s", etag)
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// A registry with the supported SLOK scheme version is accepted.
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		registry.SLOKSchemeVersion = osl.SLOK_SCHEME_VERSION
+		registry.Generation = 1
+	})
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if recorder.count("ObfuscatedServerListSLOKSchemeUnsupported") != 1 {
+		t.Fatalf("unexpected SLOK scheme unsupported notice")
+	}
+}
+
+func TestObfuscatedServerListSkipImportedGeneration(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 3, 1)
+	defer env.close()
+
+	err := env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ObfuscatedServerListSkipImportedGeneration: true,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	registryURL := osl.GetOSLRegistryURL(env.server.URL + "/")
+
+	checkImportGeneration := func(oslID string, expectedGeneration int64) {
+		id, _ := hex.DecodeString(oslID)
+		importGeneration, err := getOSLImportGeneration(id)
+		if err != nil {
+			t.Fatalf("getOSLImportGeneration failed: %s", err)
+		}
+		if expectedGeneration == 0 {
+			if importGeneration != nil {
+				t.Fatalf("unexpected import generation: %+v", importGeneration)
+			}
+			return
+		}
+		if importGeneration == nil ||
+			importGeneration.RegistryURL != registryURL ||
+			importGeneration.Generation != expectedGeneration {
+			t.Fatalf("unexpected import generation: %+v", importGeneration)
+		}
+	}
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		registry.Generation = 1
+	})
+
+	// The first fetch partially fails: one OSL file is missing. The OSLs
+	// which are imported are marked for the registry generation.
+
+	missingOSLID := env.oslIDs[2]
+	missingName := env.oslFileName(missingOSLID)
+	missingContents := env.getFile(missingName)
+	env.mutex.Lock()
+	delete(env.files, missingName)
+	env.mutex.Unlock()
+
+	err = env.fetch()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+
+	checkImportGeneration(env.oslIDs[0], 1)
+	checkImportGeneration(env.oslIDs[1], 1)
+	checkImportGeneration(missingOSLID, 0)
+
+	// The retried fetch, with the same registry generation, skips the
+	// imported OSLs without requesting them, and imports the remaining OSL.
+	// The stored OSL ETags are cleared, so that only the marks prevent the
+	// imported OSLs from being requested and processed again.
+
+	env.setFile(missingName, missingContents)
+
+	clearOSLETags := func() {
+		for _, oslID := range env.oslIDs {
+			id, _ := hex.DecodeString(oslID)
+			err := SetUrlETag(osl.GetOSLFileURL(env.server.URL+"/", id), "")
+			if err != nil {
+				t.Fatalf("SetUrlETag failed: %s", err)
+			}
+		}
+	}
+	clearOSLETags()
+
+	requestCounts := make([]int, len(env.oslIDs))
+	for i, oslID := range env.oslIDs {
+		requestCounts[i] = env.requestCount(env.oslFileName(oslID))
+	}
+
+	results, err := FetchObfuscatedServerListsWithResults(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("FetchObfuscatedServerListsWithResults failed: %s", err)
+	}
+
+	resultsByID := make(map[string]OSLImportResult)
+	for _, result := range results {
+		resultsByID[result.OSLID] = result
+	}
+
+	for i, oslID := range env.oslIDs[:2] {
+		if env.requestCount(env.oslFileName(oslID)) != requestCounts[i] {
+			t.Fatalf("unexpected request for imported OSL: %s", oslID)
+		}
+		if !resultsByID[oslID].Skipped {
+			t.Fatalf("unexpected result for imported OSL: %+v", resultsByID[oslID])
+		}
+	}
+	if env.requestCount(missingName) == requestCounts[2] {
+		t.Fatalf("missing request for remaining OSL")
+	}
+	if resultsByID[missingOSLID].NewEntries != 1 {
+		t.Fatalf("unexpected result for remaining OSL: %+v", resultsByID[missingOSLID])
+	}
+
+	checkImportGeneration(missingOSLID, 1)
+
+	if count := len(getTestStoredServerEntryFields(t)); count != len(env.oslIDs) {
+		t.Fatalf("unexpected stored server entry count: %d", count)
+	}
+
+	// A new registry generation doesn't match the marks, and the OSLs are
+	// requested and marked again.
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		registry.Generation = 2
+	})
+	clearOSLETags()
+
+	for i, oslID := range env.oslIDs {
+		requestCounts[i] = env.requestCount(env.oslFileName(oslID))
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	for i, oslID := range env.oslIDs {
+		if env.requestCount(env.oslFileName(oslID)) == requestCounts[i] {
+			t.Fatalf("missing request for OSL: %s", oslID)
+		}
+		checkImportGeneration(oslID, 2)
+	}
+}
+
+func TestObfuscatedServerListRegistryDiff(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 4, 1)
+	defer env.close()
+
+	// Unchanged OSLs are revalidated on every fetch, so that the ETag skip
+	// doesn't prevent them from being requested.
+
+	err := env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListRevalidateInterval: "1ns",
+		parameters.ObfuscatedServerListRegistryDiff:   true,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	addedOSLID := env.oslIDs[3]
+	changedOSLID := env.oslIDs[1]
+
+	// The first fetch is with a registry which doesn't yet list the added
+	// OSL. There's no cached registry, so all OSLs are processed.
+
+	registry := env.getFile(osl.REGISTRY_FILENAME)
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		var fileSpecs []*osl.OSLFileSpec
+		for _, fileSpec := range registry.FileSpecs {
+			if hex.EncodeToString(fileSpec.ID) != addedOSLID {
+				fileSpecs = append(fileSpecs, fileSpec)
+			}
+		}
+		registry.FileSpecs = fileSpecs
+	})
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	for _, oslID := range env.oslIDs {
+		expectedCount := 1
+		if oslID == addedOSLID {
+			expectedCount = 0
+		}
+		if env.requestCount(env.oslFileName(oslID)) != expectedCount {
+			t.Fatalf("unexpected request count for OSL: %s", oslID)
+		}
+	}
+
+	// The new registry lists the added OSL and a changed MD5 sum for
+	// another OSL, so only those OSLs are requested.
+
+	env.setFile(osl.REGISTRY_FILENAME, registry)
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		for _, fileSpec := range registry.FileSpecs {
+			if hex.EncodeToString(fileSpec.ID) == changedOSLID {
+				changedMD5Sum := md5.Sum(append(fileSpec.MD5Sum, 0))
+				fileSpec.MD5Sum = changedMD5Sum[:]
+			}
+		}
+	})
+
+	results, err := FetchObfuscatedServerListsWithResults(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("FetchObfuscatedServerListsWithResults failed: %s", err)
+	}
+
+	resultsByID := make(map[string]OSLImportResult)
+	for _, result := range results {
+		resultsByID[result.OSLID] = result
+	}
+
+	for _, oslID := range env.oslIDs {
+		changed := oslID == addedOSLID || oslID == changedOSLID
+		expectedCount := 1
+		if oslID == changedOSLID {
+			expectedCount = 2
+		}
+		if env.requestCount(env.oslFileName(oslID)) != expectedCount {
+			t.Fatalf("unexpected request count for OSL: %s", oslID)
+		}
+		if !changed && !resultsByID[oslID].Skipped {
+			t.Fatalf("unexpected result for unchanged OSL: %+v", resultsByID[oslID])
+		}
+	}
+	if resultsByID[addedOSLID].NewEntries != 1 {
+		t.Fatalf("unexpected result for added OSL: %+v", resultsByID[addedOSLID])
+	}
+
+	if count := len(getTestStoredServerEntryFields(t)); count != len(env.oslIDs) {
+		t.Fatalf("unexpected stored server entry count: %d", count)
+	}
+
+	// Without ObfuscatedServerListRegistryDiff, a new registry with no
+	// changed OSLs still results in all OSLs being revalidated.
+
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListRevalidateInterval: "1ns",
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		registry.Generation += 1
+	})
+
+	requestCounts := make([]int, len(env.oslIDs))
+	for i, oslID := range env.oslIDs {
+		requestCounts[i] = env.requestCount(env.oslFileName(oslID))
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	for i, oslID := range env.oslIDs {
+		if env.requestCount(env.oslFileName(oslID)) != requestCounts[i]+1 {
+			t.Fatalf("unexpected request count for OSL: %s", oslID)
+		}
+	}
+}
+
+func TestObfuscatedServerListFetchMaxTotalBytes(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 4, 1)
+	defer env.close()
+	env.downloadSequentially()
+
+	// The budget is exhausted by the registry and the first OSL download.
+
+	registrySize := len(env.getFile(osl.REGISTRY_FILENAME))
+
+	err := env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.RemoteServerListFetchMaxTotalBytes: registrySize + 1,
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	// Partial success is not a fetch failure.
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	order := env.oslRequestOrder()
+	if len(order) != 1 {
+		t.Fatalf("unexpected OSL downloads: %v", order)
+	}
+
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Without a budget, the remaining OSLs are downloaded.
+
+	err = env.config.SetClientParameters("", false, map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	order = env.oslRequestOrder()
+	if len(order) != len(env.oslIDs) {
+		t.Fatalf("unexpected OSL downloads: %v", order)
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestObfuscatedServerListFetchGate(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 4, 1)
+	defer env.close()
+
+	// The gate allows the first two OSL downloads and then pauses the fetch.
+
+	gateChecks := 0
+	env.config.FetchGate = func() bool {
+		gateChecks += 1
+		return gateChecks <= 2
+	}
+
+	err := env.fetch()
+	if _, ok := err.(FetchGatedError); !ok {
+		t.Fatalf("unexpected fetch error: %v", err)
+	}
+
+	order := env.oslRequestOrder()
+	if len(order) != 2 {
+		t.Fatalf("unexpected OSL downloads: %v", order)
+	}
+
+	if CountServerEntries() != 2 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Once the gate is open, the fetch resumes with the remaining OSLs.
+
+	env.config.FetchGate = func() bool { return true }
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	for _, oslID := range env.oslIDs {
+		count := env.requestCount(env.oslFileName(oslID))
+		if count != 1 {
+			t.Fatalf("unexpected request count for %s: %d", oslID, count)
+		}
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestObfuscatedServerListImportResults(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 4, 1)
+	defer env.close()
+
+	// The first OSL file is corrupt and the second OSL file is missing. The
+	// remaining OSLs are imported.
+
+	corruptOSLID := env.oslIDs[0]
+	corruptName := env.oslFileName(corruptOSLID)
+	corruptContents := env.getFile(corruptName)
+	env.setFile(corruptName, []byte("corrupt"))
+
+	missingOSLID := env.oslIDs[1]
+	missingName := env.oslFileName(missingOSLID)
+	missingContents := env.getFile(missingName)
+	env.mutex.Lock()
+	delete(env.files, missingName)
+	env.mutex.Unlock()
+
+	results, err := FetchObfuscatedServerListsWithResults(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+
+	checkResults := func(
+		results []OSLImportResult,
+		expected map[string]OSLImportResult) {
+
+		if len(results) != len(expected) {
+			t.Fatalf("unexpected results: %+v", results)
+		}
+		for _, result := range results {
+			expectedResult, ok := expected[result.OSLID]
+			if !ok {
+				t.Fatalf("unexpected result: %+v", result)
+			}
+			if result.Downloaded != expectedResult.Downloaded ||
+				result.Skipped != expectedResult.Skipped ||
+				result.NewEntries != expectedResult.NewEntries ||
+				(result.Err != nil) != (expectedResult.Err != nil) {
+				t.Fatalf("unexpected result: %+v", result)
+			}
+		}
+	}
+
+	simulatedErr := errors.New("simulated error")
+
+	expected := map[string]OSLImportResult{
+		corruptOSLID:  {Downloaded: true, Err: simulatedErr},
+		missingOSLID:  {Err: simulatedErr},
+		env.oslIDs[2]: {Downloaded: true, NewEntries: 1},
+		env.oslIDs[3]: {Downloaded: true, NewEntries: 1},
+	}
+	checkResults(results, expected)
+
+	for _, result := range results {
+		if result.OSLID == corruptOSLID {
+			if _, ok := result.Err.(FetchFileError); !ok {
+				t.Fatalf("unexpected corrupt OSL error: %v", result.Err)
+			}
+		}
+	}
+
+	if CountServerEntries() != 2 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Once the OSL files are restored, the failed OSLs are imported and the
+	// unchanged OSLs are skipped.
+
+	env.setFile(corruptName, corruptContents)
+	env.setFile(missingName, missingContents)
+
+	results, err = FetchObfuscatedServerListsWithResults(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	expected = map[string]OSLImportResult{
+		corruptOSLID:  {Downloaded: true, NewEntries: 1},
+		missingOSLID:  {Downloaded: true, NewEntries: 1},
+		env.oslIDs[2]: {Skipped: true},
+		env.oslIDs[3]: {Skipped: true},
+	}
+	checkResults(results, expected)
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestObfuscatedServerListDownloadModeChange(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+	env.downloadSequentially()
+
+	sshServer := newTestSSHServer(t)
+	defer sshServer.close()
+
+	tunnel := sshServer.makeTunnel(env.config)
+
+	// Simulate the tunnel going down after the first OSL download starts.
+	// The tunnel is marked as closed, but the SSH client is left open so that
+	// the in-progress download completes.
+
+	var firstOSLName string
+	env.mutex.Lock()
+	env.requestHook = func(name string) {
+		if name == osl.REGISTRY_FILENAME || firstOSLName != "" {
+			return
+		}
+		firstOSLName = name
+		tunnel.mutex.Lock()
+		tunnel.isClosed = true
+		tunnel.mutex.Unlock()
+	}
+	env.mutex.Unlock()
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// Once the tunnel is closed, the fetch stops rather than downloading the
+	// remaining OSL untunneled.
+
+	err := FetchObfuscatedServerLists(
+		context.Background(), env.config, 0, tunnel, &DialConfig{})
+	tunnelClosedErr, ok := err.(FetchTunnelClosedError)
+	if !ok {
+		t.Fatalf("unexpected fetch error: %v", err)
+	}
+
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// The registry and the first OSL are downloaded through the tunnel. The
+	// downloads share the tunnel's HTTP client, so the connection, and its
+	// port forward, is reused.
+
+	if sshServer.channelCount() != 1 {
+		t.Fatalf("unexpected tunneled download count: %d", sshServer.channelCount())
+	}
+
+	payloads := recorder.payloads("RemoteServerListDownloadModeChanged")
+	if len(payloads) != 1 {
+		t.Fatalf("unexpected download mode change notice count: %d", len(payloads))
+	}
+
+	var secondOSLName string
+	for _, oslID := range env.oslIDs {
+		if env.oslFileName(oslID) != firstOSLName {
+			secondOSLName = env.oslFileName(oslID)
+		}
+	}
+
+	payload := payloads[0]
+	if payload["previousMode"] != REMOTE_SERVER_LIST_DOWNLOAD_MODE_TUNNELED ||
+		payload["mode"] != REMOTE_SERVER_LIST_DOWNLOAD_MODE_STOPPED ||
+		!strings.HasSuffix(payload["url"].(string), "/"+secondOSLName) {
+
+		t.Fatalf("unexpected download mode change notice: %+v", payload)
+	}
+
+	if !strings.HasSuffix(tunnelClosedErr.URL, "/"+secondOSLName) {
+		t.Fatalf("unexpected fetch tunnel closed error: %s", tunnelClosedErr)
+	}
+
+	if env.requestCount(secondOSLName) != 0 {
+		t.Fatalf("unexpected request count: %d", env.requestCount(secondOSLName))
+	}
+
+	// A later fetch downloads the remaining OSL.
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestObfuscatedServerListDownloadConcurrency(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 6, 1)
+	defer env.close()
+
+	concurrency := 3
+
+	err := env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ObfuscatedServerListDownloadConcurrency: concurrency,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	// Each OSL request is held, so that the maximum number of OSL requests
+	// in flight is reached.
+
+	var inFlightMutex sync.Mutex
+	inFlight := 0
+	maxInFlight := 0
+
+	env.mutex.Lock()
+	env.requestHook = func(name string) {
+		if name == osl.REGISTRY_FILENAME {
+			return
+		}
+		inFlightMutex.Lock()
+		inFlight += 1
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		inFlightMutex.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		inFlightMutex.Lock()
+		inFlight -= 1
+		inFlightMutex.Unlock()
+	}
+	env.mutex.Unlock()
+
+	// A failed OSL fails the fetch, but doesn't interrupt the other
+	// downloads and imports.
+
+	failedName := env.oslFileName(env.oslIDs[1])
+	failedContents := env.getFile(failedName)
+	env.setFile(failedName, []byte("invalid"))
+
+	err = env.fetch()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+
+	inFlightMutex.Lock()
+	if maxInFlight != concurrency {
+		t.Fatalf("unexpected maximum requests in flight: %d", maxInFlight)
+	}
+	inFlightMutex.Unlock()
+
+	if CountServerEntries() != len(env.oslIDs)-1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	for _, oslID := range env.oslIDs {
+		name := env.oslFileName(oslID)
+		etag, err := GetUrlETag(env.server.URL + "/" + name)
+		if err != nil {
+			t.Fatalf("GetUrlETag failed: %s", err)
+		}
+		if (name == failedName) != (etag == "") {
+			t.Fatalf("unexpected ETag for %s: %s", name, etag)
+		}
+		if env.requestCount(name) != 1 {
+			t.Fatalf("unexpected request count for %s: %d", name, env.requestCount(name))
+		}
+	}
+
+	// Once restored, only the failed OSL is downloaded again.
+
+	env.setFile(failedName, failedContents)
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	for _, oslID := range env.oslIDs {
+		name := env.oslFileName(oslID)
+		expectedCount := 1
+		if name == failedName {
+			expectedCount = 2
+		}
+		if env.requestCount(name) != expectedCount {
+			t.Fatalf("unexpected request count for %s: %d", name, env.requestCount(name))
+		}
+	}
+}
+
+func TestRemoteServerListFetchCanceled(t *testing.T) {
+
+	testCases := []struct {
+		description string
+		fetch       func(ctx context.Context, env *testOSLEnvironment) ([]OSLImportResult, error)
+	}{
+		{
+			"common",
+			func(ctx context.Context, env *testOSLEnvironment) ([]OSLImportResult, error) {
+				return nil, FetchCommonRemoteServerList(
+					ctx, env.config, 0, nil, &DialConfig{})
+			},
+		},
+		{
+			"obfuscated",
+			func(ctx context.Context, env *testOSLEnvironment) ([]OSLImportResult, error) {
+				return FetchObfuscatedServerListsWithResults(
+					ctx, env.config, 0, nil, &DialConfig{})
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			env := newTestOSLEnvironment(t, 3, 1)
+			defer env.close()
+			env.downloadSequentially()
+
+			// The first server list download stalls until the test ends,
+			// well within FetchRemoteServerListTimeout. The stalled handler
+			// is released before the server is closed.
+
+			stalled := make(chan struct{})
+			release := make(chan struct{})
+			defer close(release)
+
+			var stallOnce sync.Once
+			env.mutex.Lock()
+			env.requestHook = func(name string) {
+				if name == osl.REGISTRY_FILENAME {
+					return
+				}
+				stall := false
+				stallOnce.Do(func() { stall = true })
+				if stall {
+					close(stalled)
+					<-release
+				}
+			}
+			env.mutex.Unlock()
+
+			ctx, cancelFunc := context.WithCancel(context.Background())
+			defer cancelFunc()
+
+			type fetchResult struct {
+				results []OSLImportResult
+				err     error
+			}
+			fetchResults := make(chan fetchResult, 1)
+			go func() {
+				results, err := testCase.fetch(ctx, env)
+				fetchResults <- fetchResult{results, err}
+			}()
+
+			select {
+			case <-stalled:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("download not started")
+			}
+
+			cancelFunc()
+
+			var result fetchResult
+			select {
+			case result = <-fetchResults:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("canceled fetch didn't return")
+			}
+
+			if result.err == nil ||
+				!strings.Contains(result.err.Error(), context.Canceled.Error()) {
+
+				t.Fatalf("unexpected fetch error: %v", result.err)
+			}
+
+			// The remaining OSLs aren't attempted.
+
+			if len(result.results) > 1 || len(env.oslRequestOrder()) > 1 {
+				t.Fatalf("unexpected OSL downloads: %+v", env.oslRequestOrder())
+			}
+
+			if CountServerEntries() != 0 {
+				t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+			}
+		})
+	}
+}
+
+// testDiskFullWriter is an io.Writer which fails as a write to a full disk
+// does.
+type testDiskFullWriter struct {
+	filename string
+}
+
+func (writer *testDiskFullWriter) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: writer.filename, Err: syscall.ENOSPC}
+}
+
+func TestIsDiskFullError(t *testing.T) {
+
+	_, writeErr := io.Copy(
+		&testDiskFullWriter{filename: "remote_server_list"},
+		bytes.NewReader([]byte("data")))
+
+	testCases := []struct {
+		description string
+		err         error
+		expected    bool
+	}{
+		{"nil", nil, false},
+		{"writer", writeErr, true},
+		{"ENOSPC", syscall.ENOSPC, true},
+		{"EDQUOT", &os.PathError{Op: "write", Path: "osl", Err: syscall.EDQUOT}, true},
+		{"link", &os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.ENOSPC}, true},
+		{"wrapped", common.ContextError(common.ContextError(writeErr)), true},
+		{"file", NewFetchFileError("osl", "00", common.ContextError(writeErr)), true},
+		{"disk full", DiskFullError{Err: writeErr}, true},
+		{"permission", &os.PathError{Op: "write", Path: "osl", Err: syscall.EACCES}, false},
+		{"network", common.ContextError(errors.New("connection reset")), false},
+		{"legal block", LegalBlockError{URL: "https://example.com"}, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+			if isDiskFullError(testCase.err) != testCase.expected {
+				t.Fatalf("unexpected classification: %v", testCase.err)
+			}
+		})
+	}
+}
+
+func TestRemoteServerListDiskFull(t *testing.T) {
+
+	testCases := []struct {
+		description string
+		fetchType   string
+		fileName    string
+		fetch       func(env *testOSLEnvironment) error
+	}{
+		{
+			"common",
+			REMOTE_SERVER_LIST_FETCH_TYPE_COMMON,
+			testCommonRemoteServerListName,
+			func(env *testOSLEnvironment) error { return env.fetchCommon() },
+		},
+		{
+			"obfuscated",
+			REMOTE_SERVER_LIST_FETCH_TYPE_OBFUSCATED,
+			osl.REGISTRY_FILENAME,
+			func(env *testOSLEnvironment) error { return env.fetch() },
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			env := newTestOSLEnvironment(t, 2, 1)
+			defer env.close()
+
+			err := env.config.SetClientParameters("", false, map[string]interface{}{
+				parameters.RemoteServerListRetryMaxAttempts:           3,
+				parameters.RemoteServerListRetryBackoff:               "10ms",
+				parameters.ObfuscatedServerListRegistryResumeAttempts: 2,
+			})
+			if err != nil {
+				t.Fatalf("SetClientParameters failed: %s", err)
+			}
+
+			encodedServerEntry, err := protocol.EncodeServerEntry(
+				&protocol.ServerEntry{
+					IpAddress:    "192.0.2.100",
+					Capabilities: []string{"OSSH"},
+					Region:       "JP",
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+			commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+				encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+			if err != nil {
+				t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+			}
+			env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+			// All downloads fail to write as local storage is full.
+
+			defer func() {
+				makeDownloadFileWriter = newDownloadFileWriter
+			}()
+			makeDownloadFileWriter = func(
+				file *os.File, key *downloadFileKey) (io.Writer, error) {
+
+				return &testDiskFullWriter{filename: file.Name()}, nil
+			}
+
+			recorder := startTestNoticeRecorder()
+			defer recorder.stop()
+
+			err = testCase.fetch(env)
+			diskFullErr, ok := err.(DiskFullError)
+			if !ok || !strings.Contains(diskFullErr.Err.Error(), syscall.ENOSPC.Error()) {
+				t.Fatalf("unexpected fetch error: %v", err)
+			}
+
+			// The failed download isn't retried within the fetch.
+
+			if env.requestCount(testCase.fileName) != 1 {
+				t.Fatalf("unexpected request count: %d", env.requestCount(testCase.fileName))
+			}
+
+			payloads := recorder.payloads("RemoteServerListDiskFull")
+			if len(payloads) != 1 || payloads[0]["fetchType"] != testCase.fetchType {
+				t.Fatalf("unexpected disk full notices: %+v", payloads)
+			}
+
+			// Once storage is freed, the fetch succeeds.
+
+			makeDownloadFileWriter = newDownloadFileWriter
+
+			err = testCase.fetch(env)
+			if err != nil {
+				t.Fatalf("fetch failed: %s", err)
+			}
+
+			if CountServerEntries() == 0 {
+				t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+			}
+		})
+	}
+}
+
+func TestFetchObfuscatedServerListsWithTunnels(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 4, 1)
+	defer env.close()
+	env.downloadSequentially()
+
+	var sshServers []*testSSHServer
+	var tunnels []*Tunnel
+	for i := 0; i < 3; i++ {
+		sshServer := newTestSSHServer(t)
+		defer sshServer.close()
+		sshServers = append(sshServers, sshServer)
+		tunnels = append(tunnels, sshServer.makeTunnel(env.config))
+	}
+
+	// A closed tunnel is skipped.
+
+	tunnels[0].mutex.Lock()
+	tunnels[0].isClosed = true
+	tunnels[0].mutex.Unlock()
+
+	err := FetchObfuscatedServerListsWithTunnels(
+		context.Background(), env.config, 0, tunnels, &DialConfig{})
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if CountServerEntries() != len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	getTunnelIndex := func(name string) int {
+		addr := env.requestAddr(name)
+		for i, sshServer := range sshServers {
+			if sshServer.forwarded(addr) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	// The registry is downloaded through the first open tunnel, and the OSL
+	// downloads alternate between the open tunnels.
+
+	if getTunnelIndex(osl.REGISTRY_FILENAME) != 1 {
+		t.Fatalf("unexpected registry tunnel: %d", getTunnelIndex(osl.REGISTRY_FILENAME))
+	}
+
+	oslRequestOrder := env.oslRequestOrder()
+	if len(oslRequestOrder) != len(env.oslIDs) {
+		t.Fatalf("unexpected OSL requests: %v", oslRequestOrder)
+	}
+
+	downloadCounts := make(map[int]int)
+	for i, name := range oslRequestOrder {
+		tunnelIndex := getTunnelIndex(name)
+		if tunnelIndex != 1+i%2 {
+			t.Fatalf("unexpected tunnel for OSL download %d: %d", i, tunnelIndex)
+		}
+		downloadCounts[tunnelIndex] += 1
+	}
+
+	if downloadCounts[1] != 2 || downloadCounts[2] != 2 {
+		t.Fatalf("unexpected tunnel download counts: %v", downloadCounts)
+	}
+
+	if sshServers[0].channelCount() != 0 {
+		t.Fatalf("unexpected closed tunnel download")
+	}
+}
+
+// testSSHServer is a minimal SSH server which accepts "direct-tcpip" port
+// forwards, used to provide a working Tunnel for download tests.
+type testSSHServer struct {
+	t             *testing.T
+	listener      net.Listener
+	mutex         sync.Mutex
+	channels      int
+	upstreamAddrs map[string]bool
+	clients       []*ssh.Client
+}
+
+func newTestSSHServer(t *testing.T) *testSSHServer {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err)
+	}
+
+	hostKey, err := ssh.NewSignerFromKey(rsaKey)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey failed: %s", err)
+	}
+
+	sshServerConfig := &ssh.ServerConfig{
+		NoClientAuth: true,
+	}
+	sshServerConfig.AddHostKey(hostKey)
+
+	server := &testSSHServer{
+		t:             t,
+		listener:      listener,
+		upstreamAddrs: make(map[string]bool),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handleConn(conn, sshServerConfig)
+		}
+	}()
+
+	return server
+}
+
+func (server *testSSHServer) handleConn(conn net.Conn, sshServerConfig *ssh.ServerConfig) {
+
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, sshServerConfig)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+
+		var directTcpipExtraData struct {
+			HostToConnect       string
+			PortToConnect       uint32
+			OriginatorIPAddress string
+			OriginatorPort      uint32
+		}
+		err := ssh.Unmarshal(newChannel.ExtraData(), &directTcpipExtraData)
+		if err != nil {
+			newChannel.Reject(ssh.Prohibited, "invalid extra data")
+			continue
+		}
+
+		upstreamConn, err := net.Dial(
+			"tcp",
+			net.JoinHostPort(
+				directTcpipExtraData.HostToConnect,
+				fmt.Sprintf("%d", directTcpipExtraData.PortToConnect)))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			upstreamConn.Close()
+			continue
+		}
+		go ssh.DiscardRequests(channelRequests)
+
+		server.mutex.Lock()
+		server.channels += 1
+		server.upstreamAddrs[upstreamConn.LocalAddr().String()] = true
+		server.mutex.Unlock()
+
+		go func() {
+			defer channel.Close()
+			defer upstreamConn.Close()
+			go io.Copy(upstreamConn, channel)
+			io.Copy(channel, upstreamConn)
+		}()
+	}
+}
+
+// makeTunnel returns an activated Tunnel with an SSH client connected to the
+// test SSH server. The Tunnel supports port forwards only.
+func (server *testSSHServer) makeTunnel(config *Config) *Tunnel {
+
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		server.t.Fatalf("Dial failed: %s", err)
+	}
+
+	sshClientConn, channels, requests, err := ssh.NewClientConn(
+		conn,
+		conn.RemoteAddr().String(),
+		&ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		server.t.Fatalf("NewClientConn failed: %s", err)
+	}
+
+	sshClient := ssh.NewClient(sshClientConn, channels, requests)
+
+	server.mutex.Lock()
+	server.clients = append(server.clients, sshClient)
+	server.mutex.Unlock()
+
+	return &Tunnel{
+		mutex:       new(sync.Mutex),
+		config:      config,
+		isActivated: true,
+		sshClient:   sshClient,
+	}
+}
+
+func (server *testSSHServer) channelCount() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.channels
+}
+
+// forwarded indicates whether a connection from remoteAddr, as seen by the
+// upstream server, was port forwarded through this server.
+func (server *testSSHServer) forwarded(remoteAddr string) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.upstreamAddrs[remoteAddr]
+}
+
+func (server *testSSHServer) close() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, sshClient := range server.clients {
+		sshClient.Close()
+	}
+	server.listener.Close()
+}
+
+func TestVerifyImportedServerEntries(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	var encodedServerEntries []string
+	for i := 0; i < 5; i++ {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:    fmt.Sprintf("192.0.2.%d", 100+i),
+				Capabilities: []string{"OSSH"},
+				Region:       "JP",
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+	}
+
+	// importServerEntries imports the server entries. When dropWrites is set,
+	// the write of each server entry is undone as the following server entry
+	// is decoded, simulating a datastore that drops writes.
+	importServerEntries := func(dropWrites bool) error {
+
+		_, err := DeleteServerEntriesByProvenance(
+			func(_ *ServerEntryProvenance) bool { return true })
+		if err != nil {
+			t.Fatalf("DeleteServerEntriesByProvenance failed: %s", err)
+		}
+
+		decoder := protocol.NewStreamingServerEntryDecoder(
+			strings.NewReader(strings.Join(encodedServerEntries, "\n")),
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE)
+
+		lastIPAddress := ""
+		decoder.SetDecodedCallback(func(serverEntryFields protocol.ServerEntryFields) {
+			if dropWrites && lastIPAddress != "" {
+				err := datastoreUpdate(func(tx *datastoreTx) error {
+					return tx.bucket(datastoreServerEntriesBucket).delete([]byte(lastIPAddress))
+				})
+				if err != nil {
+					t.Fatalf("datastoreUpdate failed: %s", err)
+				}
+			}
+			lastIPAddress = serverEntryFields.GetIPAddress()
+		})
+
+		return StreamingStoreServerEntriesWithProvenance(
+			env.config,
+			decoder,
+			true,
+			&ServerEntryProvenance{Source: protocol.SERVER_ENTRY_SOURCE_REMOTE})
+	}
+
+	// Without verification, dropped writes aren't detected.
+
+	err := importServerEntries(true)
+	if err != nil {
+		t.Fatalf("StreamingStoreServerEntriesWithProvenance failed: %s", err)
+	}
+
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	env.config.VerifyImportedServerEntries = true
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.VerifyImportedServerEntriesSampleSize: len(encodedServerEntries),
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = importServerEntries(false)
+	if err != nil {
+		t.Fatalf("StreamingStoreServerEntriesWithProvenance failed: %s", err)
+	}
+
+	if CountServerEntries() != len(encodedServerEntries) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	err = importServerEntries(true)
+	if _, ok := err.(DataStoreIntegrityError); !ok {
+		t.Fatalf("unexpected StreamingStoreServerEntriesWithProvenance result: %v", err)
+	}
+}
+
+func TestServerEntryProvenance(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 2)
+	defer env.close()
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	checkProvenance := func(ipAddress, expectedSource, expectedName, expectedOSLID string) {
+		provenance, err := GetServerEntryProvenance(ipAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntryProvenance failed: %s", err)
+		}
+		if provenance == nil {
+			t.Fatalf("missing provenance for %s", ipAddress)
+		}
+		if provenance.Source != expectedSource ||
+			provenance.URL != env.server.URL+"/"+expectedName ||
+			provenance.OSLID != expectedOSLID {
+
+			t.Fatalf("unexpected provenance for %s: %+v", ipAddress, provenance)
+		}
+		_, err = time.Parse(time.RFC3339, provenance.FetchTimestamp)
+		if err != nil {
+			t.Fatalf("unexpected provenance fetch timestamp for %s: %+v", ipAddress, provenance)
+		}
+	}
+
+	for i, oslID := range env.oslIDs {
+		for j := 0; j < 2; j++ {
+			checkProvenance(
+				fmt.Sprintf("192.0.%d.%d", i+1, j+1),
+				protocol.SERVER_ENTRY_SOURCE_OBFUSCATED,
+				env.oslFileName(oslID),
+				oslID)
+		}
+	}
+
+	checkProvenance(
+		"192.0.2.100",
+		protocol.SERVER_ENTRY_SOURCE_REMOTE,
+		testCommonRemoteServerListName,
+		"")
+
+	// Storing a server entry with no provenance clears any existing provenance.
+
+	encodedServerEntry, err = protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.1.1",
+			Capabilities: []string{"OSSH"},
+			Region:       "US",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	serverEntryFields, err := protocol.DecodeServerEntryFields(
+		encodedServerEntry, common.GetCurrentTimestamp(), protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryFields failed: %s", err)
+	}
+	err = StoreServerEntry(serverEntryFields, true)
+	if err != nil {
+		t.Fatalf("StoreServerEntry failed: %s", err)
+	}
+
+	provenance, err := GetServerEntryProvenance("192.0.1.1")
+	if err != nil {
+		t.Fatalf("GetServerEntryProvenance failed: %s", err)
+	}
+	if provenance != nil {
+		t.Fatalf("unexpected provenance: %+v", provenance)
+	}
+
+	// Selectively purge the server entries from the first OSL. The server
+	// entry replaced above no longer has provenance and is retained.
+
+	count, err := DeleteServerEntriesByProvenance(
+		func(provenance *ServerEntryProvenance) bool {
+			return provenance.OSLID == env.oslIDs[0]
+		})
+	if err != nil {
+		t.Fatalf("DeleteServerEntriesByProvenance failed: %s", err)
+	}
+	if count != 1 {
+		t.Fatalf("unexpected deleted server entry count: %d", count)
+	}
+
+	if CountServerEntries() != 4 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	provenance, err = GetServerEntryProvenance("192.0.1.2")
+	if err != nil {
+		t.Fatalf("GetServerEntryProvenance failed: %s", err)
+	}
+	if provenance != nil {
+		t.Fatalf("unexpected provenance: %+v", provenance)
+	}
+
+	checkProvenance(
+		"192.0.2.1",
+		protocol.SERVER_ENTRY_SOURCE_OBFUSCATED,
+		env.oslFileName(env.oslIDs[1]),
+		env.oslIDs[1])
+}
+
+func TestServerEntryTrustTiers(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 2)
+	defer env.close()
+
+	lowTrustPublicKey, lowTrustPrivateKey, err :=
+		common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+	untrustedPublicKey, untrustedPrivateKey, err :=
+		common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	setCommonRemoteServerList := func(
+		ipAddress, signingPublicKey, signingPrivateKey string) {
+
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:    ipAddress,
+				Capabilities: []string{"OSSH"},
+				Region:       "JP",
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		contents, err := common.WriteAuthenticatedDataPackageWithConfigOverrides(
+			encodedServerEntry,
+			[]byte(`{"Version" : 1, "ClientParameters" : {"FetchRemoteServerListRetryPeriod" : "45s"}}`),
+			signingPublicKey,
+			signingPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackageWithConfigOverrides failed: %s", err)
+		}
+		env.setFile(testCommonRemoteServerListName, contents)
+	}
+
+	checkTrustTier := func(ipAddress, expectedTrustTier string) {
+		trustTier, err := GetServerEntryTrustTier(ipAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntryTrustTier failed: %s", err)
+		}
+		if trustTier != expectedTrustTier {
+			t.Fatalf("unexpected trust tier for %s: %s", ipAddress, trustTier)
+		}
+	}
+
+	p := env.config.GetClientParameters()
+	defaultRetryPeriod := p.Duration(parameters.FetchRemoteServerListRetryPeriod)
+	p = nil
+
+	// Without a low trust signing public key, a package signed with the low
+	// trust key is rejected.
+
+	setCommonRemoteServerList("192.0.2.100", lowTrustPublicKey, lowTrustPrivateKey)
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListLowTrustSignaturePublicKey: lowTrustPublicKey,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	// Server entries validated with the low trust key are low trust, and
+	// the package config overrides are not applied.
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	checkTrustTier("192.0.2.100", SERVER_ENTRY_TRUST_TIER_LOW)
+
+	p = env.config.GetClientParameters()
+	retryPeriod := p.Duration(parameters.FetchRemoteServerListRetryPeriod)
+	p = nil
+	if retryPeriod != defaultRetryPeriod {
+		t.Fatalf("unexpected retry period: %s", retryPeriod)
+	}
+
+	// A package signed with neither key is still rejected.
+
+	setCommonRemoteServerList("192.0.2.101", untrustedPublicKey, untrustedPrivateKey)
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Server entries validated with the high trust key, and server entries
+	// with no signature, are high trust.
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	checkTrustTier("192.0.1.1", SERVER_ENTRY_TRUST_TIER_HIGH)
+	checkTrustTier("192.0.1.2", SERVER_ENTRY_TRUST_TIER_HIGH)
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.102",
+			Capabilities: []string{"OSSH"},
+			Region:       "US",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	serverEntryFields, err := protocol.DecodeServerEntryFields(
+		encodedServerEntry, common.GetCurrentTimestamp(), protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryFields failed: %s", err)
+	}
+	err = StoreServerEntry(serverEntryFields, true)
+	if err != nil {
+		t.Fatalf("StoreServerEntry failed: %s", err)
+	}
+
+	checkTrustTier("192.0.2.102", SERVER_ENTRY_TRUST_TIER_HIGH)
+
+	// The server entry iterator yields the low trust server entry last.
+
+	for i := 0; i < 10; i++ {
+
+		_, iterator, err := NewServerEntryIterator(env.config)
+		if err != nil {
+			t.Fatalf("NewServerEntryIterator failed: %s", err)
+		}
+
+		var ipAddresses []string
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("ServerEntryIterator.Next failed: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+		}
+		iterator.Close()
+
+		if len(ipAddresses) != 4 || ipAddresses[3] != "192.0.2.100" {
+			t.Fatalf("unexpected iterator order: %v", ipAddresses)
+		}
+	}
+}
+
+func TestServerEntrySourcePriority(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 2)
+	defer env.close()
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	sources := map[string]string{
+		"192.0.1.1": protocol.SERVER_ENTRY_SOURCE_OBFUSCATED,
+		"192.0.1.2": protocol.SERVER_ENTRY_SOURCE_OBFUSCATED,
+	}
+
+	storeServerEntry := func(ipAddress, source string) {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:    ipAddress,
+				Capabilities: []string{"OSSH"},
+				Region:       "US",
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			encodedServerEntry, common.GetCurrentTimestamp(), source)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		err = StoreServerEntry(serverEntryFields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+		sources[ipAddress] = source
+	}
+
+	storeServerEntry("192.0.2.1", protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
+	storeServerEntry("192.0.2.2", protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
+	storeServerEntry("192.0.2.3", protocol.SERVER_ENTRY_SOURCE_REMOTE)
+	storeServerEntry("192.0.2.4", protocol.SERVER_ENTRY_SOURCE_REMOTE)
+
+	// checkOrder checks that the server entry iterator yields server entries
+	// grouped by source in the expected order.
+	checkOrder := func(expectedSources ...string) {
+		for i := 0; i < 10; i++ {
+
+			_, iterator, err := NewServerEntryIterator(env.config)
+			if err != nil {
+				t.Fatalf("NewServerEntryIterator failed: %s", err)
+			}
+
+			var iteratorSources []string
+			for {
+				serverEntry, err := iterator.Next()
+				if err != nil {
+					t.Fatalf("ServerEntryIterator.Next failed: %s", err)
+				}
+				if serverEntry == nil {
+					break
+				}
+				source := sources[serverEntry.IpAddress]
+				if len(iteratorSources) == 0 ||
+					iteratorSources[len(iteratorSources)-1] != source {
+
+					iteratorSources = append(iteratorSources, source)
+				}
+			}
+			iterator.Close()
+
+			if !reflect.DeepEqual(iteratorSources, expectedSources) {
+				t.Fatalf("unexpected iterator sources: %v", iteratorSources)
+			}
+		}
+	}
+
+	if len(env.config.GetServerEntrySourcePriority()) != 0 {
+		t.Fatalf("unexpected source priority: %v", env.config.GetServerEntrySourcePriority())
+	}
+
+	priority := []string{
+		protocol.SERVER_ENTRY_SOURCE_REMOTE,
+		protocol.SERVER_ENTRY_SOURCE_OBFUSCATED,
+		protocol.SERVER_ENTRY_SOURCE_EMBEDDED,
+	}
+	err = env.config.SetServerEntrySourcePriority(priority)
+	if err != nil {
+		t.Fatalf("SetServerEntrySourcePriority failed: %s", err)
+	}
+	if !reflect.DeepEqual(env.config.GetServerEntrySourcePriority(), priority) {
+		t.Fatalf("unexpected source priority: %v", env.config.GetServerEntrySourcePriority())
+	}
+
+	checkOrder(priority...)
+
+	// Server entries from sources not in the priority follow all prioritized
+	// server entries.
+
+	err = env.config.SetServerEntrySourcePriority([]string{
+		protocol.SERVER_ENTRY_SOURCE_EMBEDDED,
+	})
+	if err != nil {
+		t.Fatalf("SetServerEntrySourcePriority failed: %s", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, iterator, err := NewServerEntryIterator(env.config)
+		if err != nil {
+			t.Fatalf("NewServerEntryIterator failed: %s", err)
+		}
+		for j := 0; j < 2; j++ {
+			serverEntry, err := iterator.Next()
+			if err != nil || serverEntry == nil {
+				t.Fatalf("ServerEntryIterator.Next failed: %v", err)
+			}
+			if sources[serverEntry.IpAddress] != protocol.SERVER_ENTRY_SOURCE_EMBEDDED {
+				t.Fatalf("unexpected server entry source: %s", sources[serverEntry.IpAddress])
+			}
+		}
+		iterator.Close()
+	}
+
+	// Invalid source priorities are rejected, and the existing priority is
+	// retained.
+
+	for _, invalidPriority := range [][]string{
+		{"UNKNOWN"},
+		{protocol.SERVER_ENTRY_SOURCE_REMOTE, protocol.SERVER_ENTRY_SOURCE_REMOTE},
+	} {
+		err = env.config.SetServerEntrySourcePriority(invalidPriority)
+		if err == nil {
+			t.Fatalf("unexpected SetServerEntrySourcePriority success")
+		}
+	}
+	if !reflect.DeepEqual(
+		env.config.GetServerEntrySourcePriority(), []string{protocol.SERVER_ENTRY_SOURCE_EMBEDDED}) {
+
+		t.Fatalf("unexpected source priority: %v", env.config.GetServerEntrySourcePriority())
+	}
+
+	// Tactics which specify a source priority take precedence, and the
+	// source priority is retained when tactics are applied.
+
+	err = env.config.SetClientParameters("tag", true, map[string]interface{}{
+		parameters.ServerEntrySourcePriority: []string{
+			protocol.SERVER_ENTRY_SOURCE_OBFUSCATED,
+			protocol.SERVER_ENTRY_SOURCE_EMBEDDED,
+			protocol.SERVER_ENTRY_SOURCE_REMOTE,
+		},
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	checkOrder(
+		protocol.SERVER_ENTRY_SOURCE_OBFUSCATED,
+		protocol.SERVER_ENTRY_SOURCE_EMBEDDED,
+		protocol.SERVER_ENTRY_SOURCE_REMOTE)
+
+	err = env.config.SetClientParameters("tag", true, nil)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+	if !reflect.DeepEqual(
+		env.config.GetServerEntrySourcePriority(), []string{protocol.SERVER_ENTRY_SOURCE_EMBEDDED}) {
+
+		t.Fatalf("unexpected source priority: %v", env.config.GetServerEntrySourcePriority())
+	}
+}
+
+func TestServerEntryRevocationList(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	setCommonRemoteServerList := func(ipAddresses ...string) {
+		var encodedServerEntries []string
+		for _, ipAddress := range ipAddresses {
+			encodedServerEntry, err := protocol.EncodeServerEntry(
+				&protocol.ServerEntry{
+					IpAddress:    ipAddress,
+					Capabilities: []string{"OSSH"},
+					Region:       "JP",
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+			encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+		}
+		contents, err := common.WriteAuthenticatedDataPackage(
+			strings.Join(encodedServerEntries, "\n"),
+			testOSLSigningPublicKey,
+			testOSLSigningPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		env.setFile(testCommonRemoteServerListName, contents)
+	}
+
+	revocationListName := "server_entry_revocations"
+
+	setRevocationList := func(
+		version int64, signingPublicKey, signingPrivateKey string, ipAddresses ...string) {
+
+		payload, err := json.Marshal(&ServerEntryRevocationList{
+			Version:        version,
+			ServerEntryIDs: ipAddresses,
+		})
+		if err != nil {
+			t.Fatalf("json.Marshal failed: %s", err)
+		}
+		contents, err := common.WriteAuthenticatedDataPackage(
+			string(payload), signingPublicKey, signingPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		env.setFile(revocationListName, contents)
+	}
+
+	checkStored := func(expectedIPAddresses ...string) {
+		serverEntries := getTestStoredServerEntryFields(t)
+		if len(serverEntries) != len(expectedIPAddresses) {
+			t.Fatalf("unexpected stored server entries: %d", len(serverEntries))
+		}
+		for _, ipAddress := range expectedIPAddresses {
+			if serverEntries[ipAddress] == nil {
+				t.Fatalf("missing server entry: %s", ipAddress)
+			}
+		}
+	}
+
+	setCommonRemoteServerList("192.0.2.100", "192.0.2.101")
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	checkStored("192.0.1.1", "192.0.2.1", "192.0.2.100", "192.0.2.101")
+
+	env.config.RemoteServerListRevocationURLs = parameters.DownloadURLs{
+		{
+			URL:               base64.StdEncoding.EncodeToString([]byte(env.server.URL + "/" + revocationListName)),
+			OnlyAfterAttempts: 0,
+		},
+	}
+	err = env.config.SetClientParameters("", false, nil)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// The revocation list is fetched along with the unchanged common remote
+	// server list, and removes the revoked OSL and common server entries,
+	// leaving the others.
+
+	setRevocationList(
+		1, testOSLSigningPublicKey, testOSLSigningPrivateKey,
+		"192.0.1.1", "192.0.2.100", "192.0.2.200")
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	checkStored("192.0.2.1", "192.0.2.101")
+
+	payloads := recorder.payloads("ServerEntriesRevoked")
+	if len(payloads) != 1 ||
+		payloads[0]["version"] != float64(1) ||
+		payloads[0]["count"] != float64(2) {
+
+		t.Fatalf("unexpected server entries revoked notices: %+v", payloads)
+	}
+
+	// A revoked server entry imported again, from a changed common remote
+	// server list, is deleted again by the stored revocation list, while
+	// the unchanged revocation list isn't downloaded again.
+
+	setCommonRemoteServerList("192.0.2.100", "192.0.2.101", "192.0.2.102")
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	checkStored("192.0.2.1", "192.0.2.101", "192.0.2.102")
+
+	if env.requestCount(revocationListName) != 2 {
+		t.Fatalf("unexpected revocation list request count: %d", env.requestCount(revocationListName))
+	}
+
+	// A revocation list that's not newer than the stored revocation list is
+	// ignored.
+
+	setRevocationList(
+		1, testOSLSigningPublicKey, testOSLSigningPrivateKey, "192.0.2.101")
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	checkStored("192.0.2.1", "192.0.2.101", "192.0.2.102")
+
+	// A revocation list that fails signature validation, including a list
+	// signed with the low trust signing key, fails the fetch and isn't
+	// applied.
+
+	untrustedPublicKey, untrustedPrivateKey, err :=
+		common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	err = env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.RemoteServerListLowTrustSignaturePublicKey: untrustedPublicKey,
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	setRevocationList(
+		2, untrustedPublicKey, untrustedPrivateKey, "192.0.2.101", "192.0.2.102")
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("fetchCommon unexpectedly succeeded")
+	}
+	if _, ok := err.(FetchFileError); !ok {
+		t.Fatalf("unexpected error type: %T", err)
+	}
+
+	checkStored("192.0.2.1", "192.0.2.101", "192.0.2.102")
+
+	// A newer, validly signed revocation list is applied.
+
+	setRevocationList(
+		2, testOSLSigningPublicKey, testOSLSigningPrivateKey, "192.0.2.102")
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	checkStored("192.0.2.1", "192.0.2.101")
+}
+
+func TestRemoteServerListSecondarySignature(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 0)
+	defer env.close()
+
+	secondaryPublicKey, secondaryPrivateKey, err :=
+		common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	setCommonRemoteServerList := func(ipAddresses ...string) []byte {
+		var encodedServerEntries []string
+		for _, ipAddress := range ipAddresses {
+			encodedServerEntry, err := protocol.EncodeServerEntry(
+				&protocol.ServerEntry{
+					IpAddress:    ipAddress,
+					Capabilities: []string{"OSSH"},
+					Region:       "JP",
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+			encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+		}
+		contents, err := common.WriteAuthenticatedDataPackage(
+			strings.Join(encodedServerEntries, "\n"),
+			testOSLSigningPublicKey,
+			testOSLSigningPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		env.setFile(testCommonRemoteServerListName, contents)
+		return contents
+	}
+
+	signatureName := "remote_server_list_signature"
+
+	setSignature := func(
+		contents []byte, signingPublicKey, signingPrivateKey string) {
+
+		digest := sha256.Sum256(contents)
+		payload, err := json.Marshal(&RemoteServerListSecondarySignature{
+			Digest: hex.EncodeToString(digest[:]),
+		})
+		if err != nil {
+			t.Fatalf("json.Marshal failed: %s", err)
+		}
+		signature, err := common.WriteAuthenticatedDataPackage(
+			string(payload), signingPublicKey, signingPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		env.setFile(signatureName, signature)
+	}
+
+	checkStored := func(expectedIPAddresses ...string) {
+		serverEntries := getTestStoredServerEntryFields(t)
+		if len(serverEntries) != len(expectedIPAddresses) {
+			t.Fatalf("unexpected stored server entries: %d", len(serverEntries))
+		}
+		for _, ipAddress := range expectedIPAddresses {
+			if serverEntries[ipAddress] == nil {
+				t.Fatalf("missing server entry: %s", ipAddress)
+			}
+		}
+	}
+
+	env.config.RemoteServerListSecondarySignatureURLs = parameters.DownloadURLs{
+		{
+			URL:               base64.StdEncoding.EncodeToString([]byte(env.server.URL + "/" + signatureName)),
+			OnlyAfterAttempts: 0,
+		},
+	}
+	env.config.RemoteServerListSecondaryPublicKey = secondaryPublicKey
+	err = env.config.SetClientParameters("", false, nil)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	// A common remote server list is imported when both the primary
+	// signature and the secondary signature validate.
+
+	contents := setCommonRemoteServerList("192.0.2.100", "192.0.2.101")
+	setSignature(contents, secondaryPublicKey, secondaryPrivateKey)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	checkStored("192.0.2.100", "192.0.2.101")
+
+	// A changed list with no matching secondary signature, as when only the
+	// primary signing key is compromised, is rejected and not imported.
+
+	setCommonRemoteServerList("192.0.2.100", "192.0.2.101", "192.0.2.102")
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("fetchCommon unexpectedly succeeded")
+	}
+	if _, ok := err.(FetchFileError); !ok {
+		t.Fatalf("unexpected error type: %T", err)
+	}
+
+	checkStored("192.0.2.100", "192.0.2.101")
+
+	// A secondary signature signed with a key other than the secondary key,
+	// including the primary key, is rejected.
+
+	contents = setCommonRemoteServerList("192.0.2.100", "192.0.2.101", "192.0.2.103")
+	setSignature(contents, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("fetchCommon unexpectedly succeeded")
+	}
+	if _, ok := err.(FetchFileError); !ok {
+		t.Fatalf("unexpected error type: %T", err)
+	}
+
+	checkStored("192.0.2.100", "192.0.2.101")
+
+	// A missing secondary signature fails the fetch.
+
+	env.mutex.Lock()
+	delete(env.files, signatureName)
+	env.mutex.Unlock()
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("fetchCommon unexpectedly succeeded")
+	}
+
+	checkStored("192.0.2.100", "192.0.2.101")
+
+	// Once a valid secondary signature is published, the list that was
+	// rejected is downloaded again and imported.
+
+	setSignature(contents, secondaryPublicKey, secondaryPrivateKey)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	checkStored("192.0.2.100", "192.0.2.101", "192.0.2.103")
+}
+
+func TestImportServerEntriesFromReader(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 0)
+	defer env.close()
+
+	makeServerList := func(
+		signingPublicKey, signingPrivateKey string, ipAddresses ...string) []byte {
+
+		var encodedServerEntries []string
+		for _, ipAddress := range ipAddresses {
+			encodedServerEntry, err := protocol.EncodeServerEntry(
+				&protocol.ServerEntry{
+					IpAddress:    ipAddress,
+					Capabilities: []string{"OSSH"},
+					Region:       "JP",
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+			encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+		}
+		contents, err := common.WriteAuthenticatedDataPackage(
+			strings.Join(encodedServerEntries, "\n"),
+			signingPublicKey,
+			signingPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		return contents
+	}
+
+	checkStored := func(expectedIPAddresses ...string) {
+		serverEntries := getTestStoredServerEntryFields(t)
+		if len(serverEntries) != len(expectedIPAddresses) {
+			t.Fatalf("unexpected stored server entries: %d", len(serverEntries))
+		}
+		for _, ipAddress := range expectedIPAddresses {
+			if serverEntries[ipAddress] == nil {
+				t.Fatalf("missing server entry: %s", ipAddress)
+			}
+			if serverEntries[ipAddress].GetLocalSource() != protocol.SERVER_ENTRY_SOURCE_EMBEDDED {
+				t.Fatalf("unexpected server entry source: %s", serverEntries[ipAddress].GetLocalSource())
+			}
+		}
+	}
+
+	checkTempFiles := func() {
+		files, err := filepath.Glob(
+			filepath.Join(env.dataDirectory, "import-server-entries-*"))
+		if err != nil || len(files) != 0 {
+			t.Fatalf("unexpected temporary files: %v, %v", files, err)
+		}
+	}
+
+	// An in-memory server list is imported.
+
+	err := ImportServerEntriesFromReader(
+		env.config,
+		bytes.NewReader(makeServerList(
+			testOSLSigningPublicKey, testOSLSigningPrivateKey, "192.0.2.1", "192.0.2.2")),
+		protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
+	if err != nil {
+		t.Fatalf("ImportServerEntriesFromReader failed: %s", err)
+	}
+
+	checkStored("192.0.2.1", "192.0.2.2")
+
+	// A server list streamed from a pipe, which isn't seekable, is imported.
+
+	serverList := makeServerList(
+		testOSLSigningPublicKey, testOSLSigningPrivateKey, "192.0.2.3")
+
+	reader, writer := io.Pipe()
+	go func() {
+		_, err := writer.Write(serverList)
+		writer.CloseWithError(err)
+	}()
+
+	err = ImportServerEntriesFromReader(
+		env.config, reader, protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
+	if err != nil {
+		t.Fatalf("ImportServerEntriesFromReader failed: %s", err)
+	}
+
+	checkStored("192.0.2.1", "192.0.2.2", "192.0.2.3")
+	checkTempFiles()
+
+	// A server list with a bad signature is rejected, and none of its
+	// server entries are imported.
+
+	otherPublicKey, otherPrivateKey, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	for _, seekable := range []bool{true, false} {
+
+		var r io.Reader = bytes.NewReader(makeServerList(
+			otherPublicKey, otherPrivateKey, "192.0.2.4"))
+		if !seekable {
+			r = ioutil.NopCloser(r)
+		}
+
+		err = ImportServerEntriesFromReader(
+			env.config, r, protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
+		if err == nil {
+			t.Fatalf("unexpected ImportServerEntriesFromReader success")
+		}
+	}
+
+	checkStored("192.0.2.1", "192.0.2.2", "192.0.2.3")
+	checkTempFiles()
+
+	// An unsupported server entry source is rejected.
+
+	err = ImportServerEntriesFromReader(
+		env.config,
+		bytes.NewReader(makeServerList(
+			testOSLSigningPublicKey, testOSLSigningPrivateKey, "192.0.2.5")),
+		"INVALID")
+	if err == nil {
+		t.Fatalf("unexpected ImportServerEntriesFromReader success")
+	}
+
+	checkStored("192.0.2.1", "192.0.2.2", "192.0.2.3")
+}
+
+func TestServerEntryAgeHistogram(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 0)
+	defer env.close()
+
+	clock := &testClock{now: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}
+	env.config.Clock = clock
+
+	day := 24 * time.Hour
+
+	ages := []time.Duration{
+		-time.Hour,
+		time.Hour,
+		2 * day,
+		10 * day,
+		10 * day,
+		60 * day,
+		400 * day,
+	}
+
+	storeServerEntry := func(ipAddress, timestamp string) {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:    ipAddress,
+				Capabilities: []string{"OSSH"},
+				Region:       "US",
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			encodedServerEntry, timestamp, protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		if err != nil {
+			t.Fatalf("DecodeServerEntryFields failed: %s", err)
+		}
+		err = StoreServerEntry(serverEntryFields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	for i, age := range ages {
+		storeServerEntry(
+			fmt.Sprintf("192.0.2.%d", i+1),
+			clock.Now().Add(-age).Format(time.RFC3339))
+	}
+	storeServerEntry("192.0.2.100", "")
+
+	histogram, err := GetServerEntryAgeHistogram(env.config)
+	if err != nil {
+		t.Fatalf("GetServerEntryAgeHistogram failed: %s", err)
+	}
+
+	expectedHistogram := &ServerEntryAgeHistogram{
+		Buckets: []ServerEntryAgeHistogramBucket{
+			{MaxAge: day, Count: 2},
+			{MaxAge: 7 * day, Count: 1},
+			{MaxAge: 30 * day, Count: 2},
+			{MaxAge: 90 * day, Count: 1},
+			{MaxAge: 365 * day, Count: 0},
+			{MaxAge: 0, Count: 1},
+		},
+		Unknown: 1,
+	}
+
+	if !reflect.DeepEqual(histogram, expectedHistogram) {
+		t.Fatalf("unexpected histogram: %+v, expected %+v", histogram, expectedHistogram)
+	}
+
+	// As the entries age, they move into older buckets.
+
+	clock.advance(30 * day)
+
+	histogram, err = GetServerEntryAgeHistogram(env.config)
+	if err != nil {
+		t.Fatalf("GetServerEntryAgeHistogram failed: %s", err)
+	}
+
+	expectedCounts := []int{0, 0, 1, 4, 1, 1}
+	for i, bucket := range histogram.Buckets {
+		if bucket.Count != expectedCounts[i] {
+			t.Fatalf("unexpected histogram: %+v", histogram)
+		}
+	}
+}
+
+func TestRemoteServerListGzipContentEncoding(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	env.mutex.Lock()
+	env.contentEncoding = "gzip"
+	env.mutex.Unlock()
+
+	// Resume the common remote server list download from a partial download
+	// of the gzip encoded bytes.
+
+	encodedList := gzipEncode(commonRemoteServerList)
+	md5sum := md5.Sum(encodedList)
+	etag := fmt.Sprintf("\"%s\"", hex.EncodeToString(md5sum[:]))
+
+	downloadFilename := env.config.RemoteServerListDownloadFilename
+	err = ioutil.WriteFile(downloadFilename+".part", encodedList[:len(encodedList)/2], 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	err = ioutil.WriteFile(downloadFilename+".part.etag", []byte(etag), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	downloadedList, err := ioutil.ReadFile(downloadFilename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	if !bytes.Equal(downloadedList, commonRemoteServerList) {
+		t.Fatalf("unexpected downloaded common remote server list")
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if CountServerEntries() != len(env.oslIDs)+1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestRemoteServerListCompressionDictionary(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+
+	// Recompress the package with a dictionary.
+
+	packageJSON, err := common.Decompress(commonRemoteServerList)
+	if err != nil {
+		t.Fatalf("Decompress failed: %s", err)
+	}
+
+	dictionary := []byte(encodedServerEntry)
+
+	var dictionaryRemoteServerList bytes.Buffer
+	zlibWriter, err := zlib.NewWriterLevelDict(
+		&dictionaryRemoteServerList, zlib.DefaultCompression, dictionary)
+	if err != nil {
+		t.Fatalf("NewWriterLevelDict failed: %s", err)
+	}
+	zlibWriter.Write(packageJSON)
+	zlibWriter.Close()
+
+	env.setFile(testCommonRemoteServerListName, dictionaryRemoteServerList.Bytes())
+
+	// Without the dictionary, the import fails cleanly.
+
+	err = env.fetchCommon()
+	if _, ok := err.(FetchFileError); !ok {
+		t.Fatalf("unexpected fetch result: %v", err)
+	}
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected imported server entries")
+	}
+
+	// With the wrong dictionary, the import fails cleanly.
+
+	env.config.serverEntryCompressionDictionary = []byte("wrong")
+
+	err = env.fetchCommon()
+	if _, ok := err.(FetchFileError); !ok {
+		t.Fatalf("unexpected fetch result: %v", err)
+	}
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected imported server entries")
+	}
+
+	// With the dictionary, the server entry is imported.
+
+	env.config.serverEntryCompressionDictionary = dictionary
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestRemoteServerListRetry(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	err := env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.RemoteServerListRetryMaxAttempts: 3,
+			parameters.RemoteServerListRetryBackoff:     "10ms",
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+
+	// A transient network failure is retried.
+
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	env.mutex.Lock()
+	env.failRequests = 2
+	env.mutex.Unlock()
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+	if env.requestCount(testCommonRemoteServerListName) != 3 {
+		t.Fatalf("unexpected request count: %d", env.requestCount(testCommonRemoteServerListName))
+	}
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Retries are bounded by RemoteServerListRetryMaxAttempts.
+
+	env.mutex.Lock()
+	env.failRequests = 3
+	env.mutex.Unlock()
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+	if env.requestCount(testCommonRemoteServerListName) != 6 {
+		t.Fatalf("unexpected request count: %d", env.requestCount(testCommonRemoteServerListName))
+	}
+
+	// A signature failure is not retried.
+
+	signingPublicKey, signingPrivateKey, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+	invalidCommonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, signingPublicKey, signingPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, invalidCommonRemoteServerList)
+
+	err = env.fetchCommon()
+	if _, ok := err.(FetchFileError); !ok {
+		t.Fatalf("unexpected fetch result: %v", err)
+	}
+	if env.requestCount(testCommonRemoteServerListName) != 7 {
+		t.Fatalf("unexpected request count: %d", env.requestCount(testCommonRemoteServerListName))
+	}
+}
+
+func TestObfuscatedServerListRetry(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	err := env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.RemoteServerListRetryMaxAttempts: 3,
+			parameters.RemoteServerListRetryBackoff:     "10ms",
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	oslID, _ := hex.DecodeString(env.oslIDs[0])
+	oslName := env.oslFileName(env.oslIDs[0])
+	oslURL := osl.GetOSLFileURL(env.server.URL+"/", oslID)
+
+	// failOSLRequests simulates transient network failures of the next
+	// count OSL requests, following each registry request.
+	failOSLRequests := func(count int) {
+		env.mutex.Lock()
+		env.requestHook = func(name string) {
+			if name == osl.REGISTRY_FILENAME {
+				env.mutex.Lock()
+				env.failRequests = count
+				env.mutex.Unlock()
+			}
+		}
+		env.mutex.Unlock()
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	checkRetries := func(expectedRequests int, expectedAttempts []int) {
+		if env.requestCount(oslName) != expectedRequests {
+			t.Fatalf("unexpected request count: %d", env.requestCount(oslName))
+		}
+		payloads := recorder.payloads("RemoteServerListDownloadRetry")
+		if len(payloads) != len(expectedAttempts) {
+			t.Fatalf("unexpected retry notice count: %d", len(payloads))
+		}
+		for i, payload := range payloads {
+			if payload["url"] != oslURL ||
+				payload["attempt"] != float64(expectedAttempts[i]) ||
+				payload["maxAttempts"] != float64(3) {
+
+				t.Fatalf("unexpected retry notice: %+v", payload)
+			}
+		}
+	}
+
+	// A download which fails on every attempt is retried until
+	// RemoteServerListRetryMaxAttempts is exhausted.
+
+	failOSLRequests(3)
+
+	err = env.fetch()
+	if err == nil {
+		t.Fatalf("fetch unexpectedly succeeded")
+	}
+	checkRetries(3, []int{2, 3})
+
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// A download which fails once succeeds on the second attempt.
+
+	failOSLRequests(1)
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	checkRetries(5, []int{2, 3, 2})
+
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// A download which fails as local storage is full isn't retried.
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "US",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	env.serverEntries[env.oslIDs[0]] = append(
+		env.serverEntries[env.oslIDs[0]], encodedServerEntry)
+	env.pave()
+
+	failOSLRequests(0)
+
+	defer func() {
+		makeDownloadFileWriter = newDownloadFileWriter
+	}()
+	makeDownloadFileWriter = func(
+		file *os.File, key *downloadFileKey) (io.Writer, error) {
+
+		if strings.HasPrefix(filepath.Base(file.Name()), oslName) {
+			return &testDiskFullWriter{filename: file.Name()}, nil
+		}
+		return newDownloadFileWriter(file, key)
+	}
+
+	err = env.fetch()
+	if _, ok := err.(DiskFullError); !ok {
+		t.Fatalf("unexpected fetch error: %v", err)
+	}
+	checkRetries(6, []int{2, 3, 2})
+
+	makeDownloadFileWriter = newDownloadFileWriter
+
+	// A download which ShouldRetryDownload classifies as not retryable
+	// isn't retried.
+
+	var shouldRetryAttempts []int
+	env.config.ShouldRetryDownload = func(err error, attempt int) bool {
+		shouldRetryAttempts = append(shouldRetryAttempts, attempt)
+		return false
+	}
+	defer func() {
+		env.config.ShouldRetryDownload = nil
+	}()
+
+	failOSLRequests(1)
+
+	err = env.fetch()
+	if err == nil {
+		t.Fatalf("fetch unexpectedly succeeded")
+	}
+	checkRetries(7, []int{2, 3, 2})
+
+	if !reflect.DeepEqual(shouldRetryAttempts, []int{0}) {
+		t.Fatalf("unexpected ShouldRetryDownload attempts: %v", shouldRetryAttempts)
+	}
+
+	// With the classification restored, the changed OSL is imported.
+
+	env.config.ShouldRetryDownload = nil
+
+	failOSLRequests(0)
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	checkRetries(8, []int{2, 3, 2})
+
+	if CountServerEntries() != 2 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Canceling the fetch ends the backoff before the next attempt.
+
+	err = env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.RemoteServerListRetryMaxAttempts: 3,
+			parameters.RemoteServerListRetryBackoff:     "1h",
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	env.serverEntries[env.oslIDs[0]] = env.serverEntries[env.oslIDs[0]][:1]
+	env.pave()
+
+	failOSLRequests(3)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- FetchObfuscatedServerLists(ctx, env.config, 0, nil, &DialConfig{})
+	}()
+
+	for start := time.Now(); recorder.count("RemoteServerListDownloadRetry") == 3; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("missing retry notice")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancelFunc()
+
+	select {
+	case err = <-result:
+		if err == nil {
+			t.Fatalf("canceled fetch unexpectedly succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("canceled fetch did not return")
+	}
+	checkRetries(9, []int{2, 3, 2, 2})
+}
+
+func TestRemoteServerListShouldRetryDownload(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	err := env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.RemoteServerListRetryMaxAttempts: 3,
+			parameters.RemoteServerListRetryBackoff:     "10ms",
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	var mutex sync.Mutex
+	var attempts []int
+	retry := func(attempt int) bool { return false }
+	env.config.ShouldRetryDownload = func(err error, attempt int) bool {
+		if err == nil {
+			t.Errorf("missing download error")
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts = append(attempts, attempt)
+		return retry(attempt)
+	}
+
+	getAttempts := func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		result := fmt.Sprintf("%v", attempts)
+		attempts = nil
+		return result
+	}
+
+	// The callback overrides the default classification, which would retry
+	// the network failure.
+
+	env.mutex.Lock()
+	env.failRequests = 1
+	env.mutex.Unlock()
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+	if env.requestCount(testCommonRemoteServerListName) != 1 {
+		t.Fatalf("unexpected request count: %d", env.requestCount(testCommonRemoteServerListName))
+	}
+	if getAttempts() != "[0]" {
+		t.Fatalf("unexpected callback attempts")
+	}
+
+	// The callback is consulted after each failure, and the download is
+	// retried while it returns true.
+
+	retry = func(attempt int) bool { return attempt < 1 }
+
+	env.mutex.Lock()
+	env.failRequests = 3
+	env.mutex.Unlock()
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+	if env.requestCount(testCommonRemoteServerListName) != 3 {
+		t.Fatalf("unexpected request count: %d", env.requestCount(testCommonRemoteServerListName))
+	}
+	if attempts := getAttempts(); attempts != "[0 1]" {
+		t.Fatalf("unexpected callback attempts: %s", attempts)
+	}
+
+	env.mutex.Lock()
+	env.failRequests = 0
+	env.mutex.Unlock()
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// A registry download which fails without progress isn't retried by
+	// default, but is retried when the callback returns true.
+
+	retry = func(attempt int) bool { return true }
+
+	env.mutex.Lock()
+	env.failRequests = 1
+	env.mutex.Unlock()
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	if env.requestCount(osl.REGISTRY_FILENAME) != 2 {
+		t.Fatalf("unexpected registry request count: %d", env.requestCount(osl.REGISTRY_FILENAME))
+	}
+	if attempts := getAttempts(); attempts != "[0]" {
+		t.Fatalf("unexpected callback attempts: %s", attempts)
+	}
+}
+
+func TestValidateMirror(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 0)
+	defer env.close()
+
+	untrustedPublicKey, untrustedPrivateKey, err :=
+		common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	setCommonRemoteServerList := func(signingPublicKey, signingPrivateKey string) {
+
+		var encodedServerEntries []string
+		for _, ipAddress := range []string{"192.0.2.1", "192.0.2.2"} {
+			encodedServerEntry, err := protocol.EncodeServerEntry(
+				&protocol.ServerEntry{
+					IpAddress:    ipAddress,
+					Capabilities: []string{"OSSH"},
+					Region:       "JP",
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+			encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+		}
+		contents, err := common.WriteAuthenticatedDataPackage(
+			strings.Join(encodedServerEntries, "\n"),
+			signingPublicKey,
+			signingPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		env.setFile(testCommonRemoteServerListName, contents)
+	}
+
+	mirrorURL := env.server.URL + "/" + testCommonRemoteServerListName
+
+	checkUnmodified := func() {
+		if CountServerEntries() != 0 {
+			t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+		}
+		etag, err := GetUrlETag(mirrorURL)
+		if err != nil {
+			t.Fatalf("GetUrlETag failed: %s", err)
+		}
+		if etag != "" {
+			t.Fatalf("unexpected ETag: %s", etag)
+		}
+		matches, err := filepath.Glob(
+			filepath.Join(env.config.DataStoreDirectory, "validate-mirror-*"))
+		if err != nil {
+			t.Fatalf("Glob failed: %s", err)
+		}
+		if len(matches) != 0 {
+			t.Fatalf("unexpected validation files: %v", matches)
+		}
+	}
+
+	// A healthy mirror passes.
+
+	setCommonRemoteServerList(testOSLSigningPublicKey, testOSLSigningPrivateKey)
+
+	report, err := ValidateMirror(env.config, mirrorURL)
+	if err != nil {
+		t.Fatalf("ValidateMirror failed: %s", err)
+	}
+	if !report.Healthy ||
+		!report.Reachable ||
+		!report.SignatureValid ||
+		report.TrustTier != SERVER_ENTRY_TRUST_TIER_HIGH ||
+		report.ServerEntryCount != 2 ||
+		report.DownloadedBytes == 0 ||
+		report.ETag != env.fileETag(testCommonRemoteServerListName) ||
+		report.Error != "" {
+
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	checkUnmodified()
+
+	// A mirror serving a package with a bad signature fails.
+
+	setCommonRemoteServerList(untrustedPublicKey, untrustedPrivateKey)
+
+	report, err = ValidateMirror(env.config, mirrorURL)
+	if err != nil {
+		t.Fatalf("ValidateMirror failed: %s", err)
+	}
+	if report.Healthy ||
+		!report.Reachable ||
+		report.SignatureValid ||
+		report.ServerEntryCount != 0 ||
+		report.Error == "" {
+
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	checkUnmodified()
+
+	// An unreachable mirror fails.
+
+	report, err = ValidateMirror(env.config, env.server.URL+"/missing")
+	if err != nil {
+		t.Fatalf("ValidateMirror failed: %s", err)
+	}
+	if report.Healthy || report.Reachable || report.Error == "" {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	checkUnmodified()
+}
+
+func TestRemoteServerListMirrorSelection(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	// The slow mirror serves the same files as the env server, the fast
+	// mirror, after a delay.
+
+	var slowRequests int32
+	slowServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&slowRequests, 1)
+			time.Sleep(50 * time.Millisecond)
+			env.handleRequest(w, req)
+		}))
+	defer slowServer.Close()
+
+	env.config.RemoteServerListURLs = parameters.DownloadURLs{
+		{
+			URL:               base64.StdEncoding.EncodeToString([]byte(env.server.URL + "/" + testCommonRemoteServerListName)),
+			OnlyAfterAttempts: 0,
+		},
+		{
+			URL:               base64.StdEncoding.EncodeToString([]byte(slowServer.URL + "/" + testCommonRemoteServerListName)),
+			OnlyAfterAttempts: 0,
+		},
+	}
+	err = env.config.SetClientParameters("", false, nil)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	// Over many fetches, the consistently faster mirror is selected more
+	// often, while the slow mirror is still occasionally selected.
+
+	runs := 40
+
+	for i := 0; i < runs; i++ {
+		err = env.fetchCommon()
+		if err != nil {
+			t.Fatalf("fetchCommon failed: %s", err)
+		}
+	}
+
+	totalRequests := env.requestCount(testCommonRemoteServerListName)
+	if totalRequests != runs {
+		t.Fatalf("unexpected request count: %d", totalRequests)
+	}
+
+	slowCount := int(atomic.LoadInt32(&slowRequests))
+	fastCount := totalRequests - slowCount
+	if fastCount <= slowCount*2 {
+		t.Fatalf("unexpected mirror selections: fast %d, slow %d", fastCount, slowCount)
+	}
+
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Mirror weights reflect both latency and failures. Mirrors without
+	// download outcomes are tried, and no mirror falls below the minimum
+	// weight.
+
+	health := newDownloadMirrorHealth()
+	urls := parameters.DownloadURLs{
+		{URL: "fast"}, {URL: "slow"}, {URL: "failing"}, {URL: "new"},
+	}
+	for i := 0; i < 10; i++ {
+		health.record("fast", 10*time.Millisecond, false)
+		health.record("slow", 100*time.Millisecond, false)
+		health.record("failing", 10*time.Millisecond, i%2 == 0)
+	}
+
+	weights := health.weights(urls, 0.0)
+	if !(weights[0] > weights[2] && weights[2] > weights[1]) {
+		t.Fatalf("unexpected mirror weights: %v", weights)
+	}
+	if weights[3] != weights[0] {
+		t.Fatalf("unexpected new mirror weight: %v", weights)
+	}
+
+	weights = health.weights(urls, 0.5)
+	if weights[1] != weights[0]*0.5 {
+		t.Fatalf("unexpected minimum mirror weight: %v", weights)
+	}
+}
+
+func TestRemoteServerListLegalBlock(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	var blockedRequests int32
+	blockedServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&blockedRequests, 1)
+			w.WriteHeader(http.StatusUnavailableForLegalReasons)
+		}))
+	defer blockedServer.Close()
+
+	blockedURL := blockedServer.URL + "/" + testCommonRemoteServerListName
+
+	encode := func(url string) string {
+		return base64.StdEncoding.EncodeToString([]byte(url))
+	}
+
+	// With only the blocked URL, the fetch fails with a LegalBlockError,
+	// and the blocked URL isn't retried.
+
+	env.config.RemoteServerListURLs = parameters.DownloadURLs{
+		{URL: encode(blockedURL), OnlyAfterAttempts: 0},
+	}
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListRetryMaxAttempts: 3,
+		parameters.RemoteServerListRetryBackoff:     "1ms",
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = env.fetchCommon()
+	legalBlockErr, ok := err.(LegalBlockError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if legalBlockErr.URL != blockedURL {
+		t.Fatalf("unexpected blocked URL: %s", legalBlockErr.URL)
+	}
+	if atomic.LoadInt32(&blockedRequests) != 1 {
+		t.Fatalf("unexpected blocked request count: %d", blockedRequests)
+	}
+
+	// With mirrors, a fetch which selects the blocked mirror fails over to
+	// the other mirror and succeeds. With equal mirror weights, the blocked
+	// mirror is selected in about half of the fetches.
+
+	env.config.RemoteServerListURLs = parameters.DownloadURLs{
+		{URL: encode(blockedURL), OnlyAfterAttempts: 0},
+		{URL: encode(env.server.URL + "/" + testCommonRemoteServerListName), OnlyAfterAttempts: 0},
+	}
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListMirrorMinimumWeight: 1.0,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	atomic.StoreInt32(&blockedRequests, 0)
+
+	runs := 20
+
+	for i := 0; i < runs; i++ {
+		err = env.fetchCommon()
+		if err != nil {
+			t.Fatalf("fetchCommon failed: %s", err)
+		}
+	}
+
+	if env.requestCount(testCommonRemoteServerListName) != runs {
+		t.Fatalf("unexpected request count: %d", env.requestCount(testCommonRemoteServerListName))
+	}
+	failovers := int(atomic.LoadInt32(&blockedRequests))
+	if failovers == 0 || failovers == runs {
+		t.Fatalf("unexpected blocked request count: %d", failovers)
+	}
+
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Without RemoteServerListLegalBlockFailover, a fetch which selects the
+	// blocked mirror fails with a LegalBlockError.
+
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListMirrorMinimumWeight: 1.0,
+		parameters.RemoteServerListLegalBlockFailover:  false,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	blocked := false
+	for i := 0; i < runs && !blocked; i++ {
+		err = env.fetchCommon()
+		if err != nil {
+			if _, ok := err.(LegalBlockError); !ok {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			blocked = true
+		}
+	}
+	if !blocked {
+		t.Fatalf("unexpected fetch success")
+	}
+
+	// A blocked obfuscated server list registry download fails the fetch
+	// with a LegalBlockError.
+
+	env.config.ObfuscatedServerListRootURLs = parameters.DownloadURLs{
+		{URL: encode(blockedServer.URL + "/"), OnlyAfterAttempts: 0},
+	}
+	err = env.config.SetClientParameters("", false, nil)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = env.fetch()
+	legalBlockErr, ok = err.(LegalBlockError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(legalBlockErr.URL, blockedServer.URL) {
+		t.Fatalf("unexpected blocked URL: %s", legalBlockErr.URL)
+	}
+}
+
+func TestRemoteServerListMirrorFailover(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	// The failing mirror fails every request. The partial mirror serves the
+	// files of the env server, except for the OSL files.
+
+	var failingRequests int32
+	failingServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&failingRequests, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+	defer failingServer.Close()
+
+	var partialOSLRequests int32
+	partialServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if strings.HasPrefix(req.URL.Path, "/osl-") {
+				atomic.AddInt32(&partialOSLRequests, 1)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			env.handleRequest(w, req)
+		}))
+	defer partialServer.Close()
+
+	encode := func(url string) string {
+		return base64.StdEncoding.EncodeToString([]byte(url))
+	}
+
+	// The failing mirror is the canonical URL, under which ETags are stored.
+	// No download is retried, so each fetch succeeds only by failing over
+	// to the healthy mirror. With equal mirror weights, the failing mirror
+	// is selected first in about half of the fetches.
+
+	failingURL := failingServer.URL + "/" + testCommonRemoteServerListName
+	healthyURL := env.server.URL + "/" + testCommonRemoteServerListName
+
+	env.config.RemoteServerListURLs = parameters.DownloadURLs{
+		{URL: encode(failingURL), OnlyAfterAttempts: 0},
+		{URL: encode(healthyURL), OnlyAfterAttempts: 0},
+	}
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListRetryMaxAttempts:    1,
+		parameters.RemoteServerListMirrorMinimumWeight: 1.0,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	skipCount := GetRemoteServerListETagSkipCount()
+
+	runs := 20
+
+	for i := 0; i < runs; i++ {
+		err = env.fetchCommon()
+		if err != nil {
+			t.Fatalf("fetchCommon failed: %s", err)
+		}
+	}
+
+	if env.requestCount(testCommonRemoteServerListName) != runs {
+		t.Fatalf("unexpected request count: %d", env.requestCount(testCommonRemoteServerListName))
+	}
+	failovers := int(atomic.LoadInt32(&failingRequests))
+	if failovers == 0 || failovers == runs {
+		t.Fatalf("unexpected failing request count: %d", failovers)
+	}
+
+	// The ETag of the healthy mirror is stored under the canonical URL, so
+	// switching mirrors doesn't download the unchanged list again.
+
+	etag, err := GetUrlETag(failingURL)
+	if err != nil || etag != env.fileETag(testCommonRemoteServerListName) {
+		t.Fatalf("unexpected canonical ETag: %s, %v", etag, err)
+	}
+	etag, err = GetUrlETag(healthyURL)
+	if err != nil || etag != "" {
+		t.Fatalf("unexpected mirror ETag: %s, %v", etag, err)
+	}
+	if GetRemoteServerListETagSkipCount()-skipCount != int64(runs-1) {
+		t.Fatalf("unexpected ETag skip count: %d", GetRemoteServerListETagSkipCount()-skipCount)
+	}
+
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// The fetch fails once every mirror has failed.
+
+	env.config.RemoteServerListURLs = parameters.DownloadURLs{
+		{URL: encode(failingURL), OnlyAfterAttempts: 0},
+		{URL: encode(failingServer.URL + "/mirror/" + testCommonRemoteServerListName), OnlyAfterAttempts: 0},
+	}
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListRetryMaxAttempts: 1,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	atomic.StoreInt32(&failingRequests, 0)
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+	if atomic.LoadInt32(&failingRequests) != 2 {
+		t.Fatalf("unexpected failing request count: %d", failingRequests)
+	}
+
+	// A failed obfuscated server list registry download fails over to the
+	// healthy root mirror, from which the OSLs are also downloaded. The
+	// ETags are stored under the canonical URLs, so the OSLs are downloaded
+	// only once.
+
+	env.config.ObfuscatedServerListRootURLs = parameters.DownloadURLs{
+		{URL: encode(failingServer.URL + "/"), OnlyAfterAttempts: 0},
+		{URL: encode(env.server.URL + "/"), OnlyAfterAttempts: 0},
+	}
+	err = env.config.SetClientParameters("", false, nil)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	atomic.StoreInt32(&failingRequests, 0)
+
+	for i := 0; i < runs; i++ {
+		err = env.fetch()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+	}
+
+	if env.requestCount(osl.REGISTRY_FILENAME) != runs {
+		t.Fatalf("unexpected registry request count: %d", env.requestCount(osl.REGISTRY_FILENAME))
+	}
+	failovers = int(atomic.LoadInt32(&failingRequests))
+	if failovers == 0 || failovers == runs {
+		t.Fatalf("unexpected failing request count: %d", failovers)
+	}
+	for _, oslID := range env.oslIDs {
+		if env.requestCount(env.oslFileName(oslID)) != 1 {
+			t.Fatalf("unexpected OSL request count: %d", env.requestCount(env.oslFileName(oslID)))
+		}
+	}
+
+	etag, err = GetUrlETag(getOSLRegistryURL(env.config, failingServer.URL+"/"))
+	if err != nil || etag != env.fileETag(osl.REGISTRY_FILENAME) {
+		t.Fatalf("unexpected canonical registry ETag: %s, %v", etag, err)
+	}
+	etag, err = GetUrlETag(getOSLRegistryURL(env.config, env.server.URL+"/"))
+	if err != nil || etag != "" {
+		t.Fatalf("unexpected mirror registry ETag: %s, %v", etag, err)
+	}
+
+	if CountServerEntries() != 3 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// A failed OSL download fails over to another root mirror. Each run
+	// changes the OSLs, so that they're downloaded again.
+
+	env.config.ObfuscatedServerListRootURLs = parameters.DownloadURLs{
+		{URL: encode(partialServer.URL + "/"), OnlyAfterAttempts: 0},
+		{URL: encode(env.server.URL + "/"), OnlyAfterAttempts: 0},
+	}
+	err = env.config.SetClientParameters("", false, nil)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	for i := 0; i < runs; i++ {
+
+		for j, oslID := range env.oslIDs {
+			encodedServerEntry, err := protocol.EncodeServerEntry(
+				&protocol.ServerEntry{
+					IpAddress:    fmt.Sprintf("198.51.%d.%d", 100+j, i+1),
+					Capabilities: []string{"OSSH"},
+					Region:       "US",
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+			env.serverEntries[oslID] = append(env.serverEntries[oslID], encodedServerEntry)
+		}
+		env.pave()
+
+		err = env.fetch()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+
+		if CountServerEntries() != 3+len(env.oslIDs)*(i+1) {
+			t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+		}
+	}
+
+	if atomic.LoadInt32(&partialOSLRequests) == 0 {
+		t.Fatalf("unexpected partial mirror OSL request count: %d", partialOSLRequests)
+	}
+}
+
+func TestRemoteServerListMirrorFailoverETags(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 0)
+	defer env.close()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	// The canonical mirror serves the files of the env server until it's
+	// set to fail. The other mirror serves the same content with different
+	// ETags, and records the conditional requests it receives.
+
+	var canonicalFailing int32
+	var failingRequests int32
+	canonicalServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if atomic.LoadInt32(&canonicalFailing) != 0 {
+				atomic.AddInt32(&failingRequests, 1)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			env.handleRequest(w, req)
+		}))
+	defer canonicalServer.Close()
+
+	var mirrorMutex sync.Mutex
+	var mirrorIfNoneMatch []string
+	var mirrorStatusCodes []int
+	mirrorServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			contents := env.getFile(strings.TrimPrefix(req.URL.Path, "/"))
+			md5sum := md5.Sum(contents)
+			etag := fmt.Sprintf("\"mirror-%s\"", hex.EncodeToString(md5sum[:]))
+			statusCode := http.StatusOK
+			if req.Header.Get("If-None-Match") == etag {
+				statusCode = http.StatusNotModified
+			}
+			mirrorMutex.Lock()
+			mirrorIfNoneMatch = append(mirrorIfNoneMatch, req.Header.Get("If-None-Match"))
+			mirrorStatusCodes = append(mirrorStatusCodes, statusCode)
+			mirrorMutex.Unlock()
+			w.Header().Add("ETag", etag)
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(contents))
+		}))
+	defer mirrorServer.Close()
+
+	encode := func(url string) string {
+		return base64.StdEncoding.EncodeToString([]byte(url))
+	}
+
+	canonicalURL := canonicalServer.URL + "/" + testCommonRemoteServerListName
+	mirrorURL := mirrorServer.URL + "/" + testCommonRemoteServerListName
+
+	getCanonicalETag := func() string {
+		etag, err := GetUrlETag(canonicalURL)
+		if err != nil {
+			t.Fatalf("GetUrlETag failed: %s", err)
+		}
+		return etag
+	}
+
+	// The list is first downloaded from the canonical mirror only.
+
+	env.config.RemoteServerListURLs = parameters.DownloadURLs{
+		{URL: encode(canonicalURL), OnlyAfterAttempts: 0},
+	}
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListRetryMaxAttempts:     1,
+		parameters.RemoteServerListMirrorMinimumWeight:  1.0,
+		parameters.RemoteServerListSkipIdenticalContent: true,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	canonicalETag := env.fileETag(testCommonRemoteServerListName)
+	if getCanonicalETag() != canonicalETag {
+		t.Fatalf("unexpected canonical ETag: %s", getCanonicalETag())
+	}
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Deleted server entries are restored only when the list is imported
+	// again.
+
+	_, err = DeleteServerEntriesByProvenance(
+		func(_ *ServerEntryProvenance) bool { return true })
+	if err != nil {
+		t.Fatalf("DeleteServerEntriesByProvenance failed: %s", err)
+	}
+
+	// Once the canonical mirror fails, each fetch is served by the other
+	// mirror, either directly or by failing over. The first conditional
+	// request to the other mirror carries the ETag validated from the
+	// canonical mirror, which that mirror doesn't match, so the list is
+	// downloaded in full. The identical list isn't imported again, and the
+	// mirror's ETag is stored under the canonical URL. Subsequent requests,
+	// including after a failover, are then unchanged.
+
+	atomic.StoreInt32(&canonicalFailing, 1)
+
+	env.config.RemoteServerListURLs = parameters.DownloadURLs{
+		{URL: encode(canonicalURL), OnlyAfterAttempts: 0},
+		{URL: encode(mirrorURL), OnlyAfterAttempts: 0},
+	}
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListRetryMaxAttempts:     1,
+		parameters.RemoteServerListMirrorMinimumWeight:  1.0,
+		parameters.RemoteServerListSkipIdenticalContent: true,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	// With equal mirror weights, the failing canonical mirror is selected
+	// first in about half of the fetches. Fetches continue until a fetch
+	// after the first fails over.
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	runs := 1
+	failedOver := false
+	for ; runs < 50 && !failedOver; runs++ {
+		failingCount := atomic.LoadInt32(&failingRequests)
+		err = env.fetchCommon()
+		if err != nil {
+			t.Fatalf("fetchCommon failed: %s", err)
+		}
+		failedOver = atomic.LoadInt32(&failingRequests) > failingCount
+	}
+	if !failedOver {
+		t.Fatalf("unexpected failing request count: %d", failingRequests)
+	}
+
+	mirrorMutex.Lock()
+	defer mirrorMutex.Unlock()
+
+	if len(mirrorIfNoneMatch) != runs {
+		t.Fatalf("unexpected mirror request count: %d", len(mirrorIfNoneMatch))
+	}
+	mirrorETag := strings.Replace(canonicalETag, "\"", "\"mirror-", 1)
+	for i := 0; i < runs; i++ {
+		expectedIfNoneMatch := mirrorETag
+		expectedStatusCode := http.StatusNotModified
+		if i == 0 {
+			expectedIfNoneMatch = canonicalETag
+			expectedStatusCode = http.StatusOK
+		}
+		if mirrorIfNoneMatch[i] != expectedIfNoneMatch ||
+			mirrorStatusCodes[i] != expectedStatusCode {
+
+			t.Fatalf("unexpected mirror request %d: %s, %d",
+				i, mirrorIfNoneMatch[i], mirrorStatusCodes[i])
+		}
+	}
+
+	if getCanonicalETag() != mirrorETag {
+		t.Fatalf("unexpected canonical ETag: %s", getCanonicalETag())
+	}
+	etag, err := GetUrlETag(mirrorURL)
+	if err != nil || etag != "" {
+		t.Fatalf("unexpected mirror ETag: %s, %v", etag, err)
+	}
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestRemoteServerListSkipIdenticalContent(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	setSkipIdentical := func(skipIdentical bool) {
+		err := env.config.SetClientParameters(
+			"", false, map[string]interface{}{
+				parameters.RemoteServerListSkipIdenticalContent: skipIdentical,
+			})
+		if err != nil {
+			t.Fatalf("SetClientParameters failed: %s", err)
+		}
+	}
+
+	fetch := func() []OSLImportResult {
+		err := env.fetchCommon()
+		if err != nil {
+			t.Fatalf("fetchCommon failed: %s", err)
+		}
+		results, err := FetchObfuscatedServerListsWithResults(
+			context.Background(), env.config, 0, nil, &DialConfig{})
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+		return results
+	}
+
+	serverEntryCount := len(env.oslIDs) + 1
+
+	// OSL files with a registry MD5 sum are pinned by the registry, and
+	// aren't downloaded again from a mirror.
+	env.rewriteRegistry(func(registry *osl.Registry) {
+		for _, fileSpec := range registry.FileSpecs {
+			fileSpec.MD5Sum = nil
+		}
+	})
+
+	setSkipIdentical(true)
+	fetch()
+
+	if CountServerEntries() != serverEntryCount {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Deleted server entries are restored only when the server lists are
+	// imported again.
+
+	_, err = DeleteServerEntriesByProvenance(
+		func(_ *ServerEntryProvenance) bool { return true })
+	if err != nil {
+		t.Fatalf("DeleteServerEntriesByProvenance failed: %s", err)
+	}
+
+	// Simulate switching to a mirror, sharing the canonical URLs, which
+	// serves the same content with different ETags. The identical server
+	// lists downloaded from the mirror are not imported again, and their
+	// mirror ETags are stored.
+
+	env.mutex.Lock()
+	env.etagPrefix = "mirror-"
+	env.mutex.Unlock()
+
+	results := fetch()
+
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	if len(results) != len(env.oslIDs) {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	for _, result := range results {
+		if !result.Downloaded || !result.Skipped || result.NewEntries != 0 || result.Err != nil {
+			t.Fatalf("unexpected result: %+v", result)
+		}
+	}
+
+	etag, err := GetUrlETag(env.server.URL + "/" + testCommonRemoteServerListName)
+	if err != nil {
+		t.Fatalf("GetUrlETag failed: %s", err)
+	}
+	if !strings.HasPrefix(etag, "\"mirror-") {
+		t.Fatalf("unexpected common remote server list ETag: %s", etag)
+	}
+
+	// Without RemoteServerListSkipIdenticalContent, the identical server
+	// lists downloaded from another mirror are imported again.
+
+	env.mutex.Lock()
+	env.etagPrefix = "other-mirror-"
+	env.mutex.Unlock()
+
+	setSkipIdentical(false)
+	results = fetch()
+
+	if CountServerEntries() != serverEntryCount {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	for _, result := range results {
+		if !result.Downloaded || result.Skipped || result.NewEntries != 1 {
+			t.Fatalf("unexpected result: %+v", result)
+		}
+	}
+}
+
+func TestCompactDataStore(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 0)
+	defer env.close()
+
+	setCommonServerEntries := func(firstHost, count int) {
+		var encodedServerEntries []string
+		for i := 0; i < count; i++ {
+			encodedServerEntry, err := protocol.EncodeServerEntry(
+				&protocol.ServerEntry{
+					IpAddress:    fmt.Sprintf("192.0.2.%d", firstHost+i),
+					Capabilities: []string{"OSSH"},
+					Region:       "JP",
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+			encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+		}
+		commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+			strings.Join(encodedServerEntries, "\n"),
+			testOSLSigningPublicKey,
+			testOSLSigningPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+	}
+
+	setCompaction := func(enabled bool) {
+		err := env.config.SetClientParameters(
+			"", false, map[string]interface{}{
+				parameters.DataStoreCompaction:             enabled,
+				parameters.DataStoreCompactionMinimumChurn: 5,
+			})
+		if err != nil {
+			t.Fatalf("SetClientParameters failed: %s", err)
+		}
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	fetchCommon := func(expectedChurn int, expectCompacted bool) {
+		compactedCount := recorder.count("DataStoreCompacted")
+		err := env.fetchCommon()
+		if err != nil {
+			t.Fatalf("fetchCommon failed: %s", err)
+		}
+		churn, err := getDataStoreChurn()
+		if err != nil {
+			t.Fatalf("getDataStoreChurn failed: %s", err)
+		}
+		if churn != expectedChurn {
+			t.Fatalf("unexpected churn: %d", churn)
+		}
+		if (recorder.count("DataStoreCompacted") > compactedCount) != expectCompacted {
+			t.Fatalf("unexpected compaction: %v", recorder.payloads("DataStoreCompacted"))
+		}
+	}
+
+	// Below the minimum churn, the datastore isn't compacted.
+
+	setCompaction(true)
+	setCommonServerEntries(1, 3)
+	fetchCommon(3, false)
+
+	// When compaction is disabled, churn accrues without compaction.
+
+	setCompaction(false)
+	setCommonServerEntries(4, 3)
+	fetchCommon(6, false)
+
+	count, err := DeleteServerEntries([]string{"192.0.2.1", "192.0.2.2"})
+	if err != nil || count != 2 {
+		t.Fatalf("DeleteServerEntries failed: %d, %v", count, err)
+	}
+
+	churn, err := getDataStoreChurn()
+	if err != nil {
+		t.Fatalf("getDataStoreChurn failed: %s", err)
+	}
+	if churn != 8 {
+		t.Fatalf("unexpected churn: %d", churn)
+	}
+
+	// Once enabled, with the minimum churn met, the next fetch compacts the
+	// datastore and resets the churn, even when the fetch imports nothing.
+
+	setCompaction(true)
+	fetchCommon(0, true)
+
+	payloads := recorder.payloads("DataStoreCompacted")
+	if len(payloads) != 1 || payloads[0]["churn"] != float64(8) {
+		t.Fatalf("unexpected compaction notices: %+v", payloads)
+	}
+
+	// The compacted datastore retains all records and remains usable.
+
+	if CountServerEntries() != 4 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	setCommonServerEntries(10, 2)
+	fetchCommon(2, false)
+
+	if CountServerEntries() != 6 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestRemoteServerListFallbackEndpoints(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	// The primary endpoint is a port with no listener, so connections to it
+	// fail, while the fallback endpoint, the test server, is reachable.
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	primaryEndpoint := "http://" + listener.Addr().String()
+	listener.Close()
+
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	env.config.RemoteServerListURLs = parameters.DownloadURLs{
+		{
+			URL:               encode(primaryEndpoint + "/" + testCommonRemoteServerListName),
+			OnlyAfterAttempts: 0,
+			FallbackEndpoints: []string{
+				encode(primaryEndpoint),
+				encode(env.server.URL),
+			},
+		},
+	}
+	env.config.ObfuscatedServerListRootURLs = parameters.DownloadURLs{
+		{
+			URL:               encode(primaryEndpoint + "/"),
+			OnlyAfterAttempts: 0,
+			FallbackEndpoints: []string{encode(env.server.URL)},
+		},
+	}
+	err = env.config.SetClientParameters("", false, nil)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(testCommonRemoteServerListName) != 1 {
+		t.Fatalf("unexpected common remote server list request count")
+	}
+	for _, oslID := range env.oslIDs {
+		if env.requestCount(env.oslFileName(oslID)) != 1 {
+			t.Fatalf("unexpected OSL request count")
+		}
+	}
+	if CountServerEntries() != 1+len(env.oslIDs) {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// The common remote server list, the OSL registry, and each OSL file are
+	// downloaded with the second fallback endpoint. Stored ETags remain
+	// associated with the configured URLs.
+
+	payloads := recorder.payloads("RemoteServerListDownloadFallbackEndpoint")
+	if len(payloads) != 2+len(env.oslIDs) {
+		t.Fatalf("unexpected fallback endpoint notices: %+v", payloads)
+	}
+	for _, payload := range payloads {
+		if payload["endpoint"] != env.server.URL ||
+			!strings.HasPrefix(payload["url"].(string), primaryEndpoint) {
+
+			t.Fatalf("unexpected fallback endpoint notice: %+v", payload)
+		}
+	}
+
+	etag, err := GetUrlETag(primaryEndpoint + "/" + testCommonRemoteServerListName)
+	if err != nil || etag == "" {
+		t.Fatalf("unexpected common remote server list ETag: %s, %v", etag, err)
+	}
+
+	// Without a reachable fallback endpoint, the connection failure is a
+	// download failure.
+
+	env.config.RemoteServerListURLs = parameters.DownloadURLs{
+		{
+			URL:               encode(primaryEndpoint + "/" + testCommonRemoteServerListName),
+			OnlyAfterAttempts: 0,
+			FallbackEndpoints: []string{encode(primaryEndpoint)},
+		},
+	}
+	err = env.config.SetClientParameters("", false, nil)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = SetUrlETag(primaryEndpoint+"/"+testCommonRemoteServerListName, "")
+	if err != nil {
+		t.Fatalf("SetUrlETag failed: %s", err)
+	}
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("fetchCommon unexpectedly succeeded")
+	}
+}
+
+func TestBootstrapFetchCommonRemoteServerList(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	err := env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.RemoteServerListBootstrapMaxAttempts: 3,
+			parameters.RemoteServerListRetryBackoff:         "10ms",
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	// A dial config is required, as there's no tunnel.
+
+	err = BootstrapFetchCommonRemoteServerList(env.config, nil)
+	if err == nil {
+		t.Fatalf("unexpected bootstrap fetch success")
+	}
+	if env.requestCount(testCommonRemoteServerListName) != 0 {
+		t.Fatalf("unexpected request count: %d", env.requestCount(testCommonRemoteServerListName))
+	}
+
+	// A canceled bootstrap fetch stops without downloading or retrying.
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc()
+
+	err = BootstrapFetchCommonRemoteServerListWithContext(ctx, env.config, &DialConfig{})
+	if err == nil {
+		t.Fatalf("unexpected bootstrap fetch success")
+	}
+	if env.requestCount(testCommonRemoteServerListName) != 0 {
+		t.Fatalf("unexpected request count: %d", env.requestCount(testCommonRemoteServerListName))
+	}
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// The bootstrap fetch imports the server entries, retrying transient
+	// failures up to RemoteServerListBootstrapMaxAttempts, even though
+	// RemoteServerListRetryMaxAttempts allows only a single attempt.
+
+	env.mutex.Lock()
+	env.failRequests = 2
+	env.mutex.Unlock()
+
+	err = BootstrapFetchCommonRemoteServerList(env.config, &DialConfig{})
+	if err != nil {
+		t.Fatalf("BootstrapFetchCommonRemoteServerList failed: %s", err)
+	}
+	if env.requestCount(testCommonRemoteServerListName) != 3 {
+		t.Fatalf("unexpected request count: %d", env.requestCount(testCommonRemoteServerListName))
+	}
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+	provenance, err := GetServerEntryProvenance("192.0.2.100")
+	if err != nil || provenance == nil ||
+		provenance.Source != protocol.SERVER_ENTRY_SOURCE_REMOTE {
+
+		t.Fatalf("unexpected server entry provenance: %+v, %v", provenance, err)
+	}
+
+	// The ordinary fetch doesn't use the bootstrap attempt limit.
+
+	env.mutex.Lock()
+	env.failRequests = 2
+	env.mutex.Unlock()
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+}
+
+func TestUntunneledDownloadEgressRegion(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	setCommonRemoteServerList := func(ipAddress string) {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:    ipAddress,
+				Capabilities: []string{"OSSH"},
+				Region:       "JP",
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+			encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+	}
+
+	egressRegion := "US"
+	var egressErr error
+	checkCount := 0
+
+	env.config.UntunneledDownloadAllowedEgressRegions = []string{"US"}
+	env.config.UntunneledDownloadEgressRegionChecker = func() (string, error) {
+		checkCount += 1
+		return egressRegion, egressErr
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// An allowed egress region passes the check.
+
+	setCommonRemoteServerList("192.0.2.100")
+
+	err := env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+	if checkCount != 1 || CountServerEntries() != 1 {
+		t.Fatalf("unexpected fetch result: %d checks, %d server entries",
+			checkCount, CountServerEntries())
+	}
+	if recorder.count("UntunneledDownloadEgressRegionViolation") != 0 {
+		t.Fatalf("unexpected egress region violation")
+	}
+
+	// When not enforced, a violation emits a notice and the download is
+	// imported.
+
+	egressRegion = "CA"
+	setCommonRemoteServerList("192.0.2.101")
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+	if CountServerEntries() != 2 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+	payloads := recorder.payloads("UntunneledDownloadEgressRegionViolation")
+	if len(payloads) != 1 ||
+		payloads[0]["region"] != "CA" || payloads[0]["enforced"] != false {
+		t.Fatalf("unexpected egress region violation notices: %+v", payloads)
+	}
+
+	// When enforced, a violation fails the download.
+
+	env.config.EnforceUntunneledDownloadEgressRegions = true
+	setCommonRemoteServerList("192.0.2.102")
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+	if CountServerEntries() != 2 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+	payloads = recorder.payloads("UntunneledDownloadEgressRegionViolation")
+	if len(payloads) != 2 || payloads[1]["enforced"] != true {
+		t.Fatalf("unexpected egress region violation notices: %+v", payloads)
+	}
+
+	// When enforced, a failed check also fails the download.
+
+	egressRegion = ""
+	egressErr = errors.New("egress check failed")
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+	if CountServerEntries() != 2 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// Once the egress region is allowed, the download is imported.
+
+	egressRegion = "US"
+	egressErr = nil
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+	if CountServerEntries() != 3 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestReportNewServerEntries(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	minNewEntries := 3
+	env.config.MinNewEntriesToReport = &minNewEntries
+	err := env.config.SetClientParameters("", false, nil)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	var reportedCounts []int
+	env.config.OnNewServerEntries = func(count int) {
+		reportedCounts = append(reportedCounts, count)
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// fetchServerEntries fetches a common remote server list with the
+	// specified number of server entries, all of which are imported.
+	fetchServerEntries := func(count int) {
+
+		var encodedServerEntries []string
+		for i := 0; i < count; i++ {
+			encodedServerEntry, err := protocol.EncodeServerEntry(
+				&protocol.ServerEntry{
+					IpAddress:    fmt.Sprintf("192.0.2.%d", i+1),
+					Capabilities: []string{"OSSH"},
+					Region:       "JP",
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+			encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+		}
+		commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+			strings.Join(encodedServerEntries, "\n"),
+			testOSLSigningPublicKey,
+			testOSLSigningPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+		err = reportNewServerEntries(env.config, env.fetchCommon)
+		if err != nil {
+			t.Fatalf("fetchCommon failed: %s", err)
+		}
+		if CountServerEntries() != count {
+			t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+		}
+	}
+
+	// Fetches adding fewer than the minimum new entries aren't reported.
+
+	fetchServerEntries(2)
+	fetchServerEntries(4)
+
+	if len(reportedCounts) != 0 ||
+		recorder.count("RemoteServerListNewServerEntries") != 0 {
+		t.Fatalf("unexpected new server entries report: %+v", reportedCounts)
+	}
+
+	// A fetch adding the minimum new entries is reported.
+
+	fetchServerEntries(7)
+
+	if !reflect.DeepEqual(reportedCounts, []int{3}) {
+		t.Fatalf("unexpected new server entries report: %+v", reportedCounts)
+	}
+	payloads := recorder.payloads("RemoteServerListNewServerEntries")
+	if len(payloads) != 1 || payloads[0]["count"] != float64(3) {
+		t.Fatalf("unexpected new server entries notices: %+v", payloads)
+	}
+}
+
+func TestReportNewServerEntriesCoalescing(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	reportWindow := 1000
+	env.config.NewEntriesReportWindowMilliseconds = &reportWindow
+	err := env.config.SetClientParameters("", false, nil)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	reportedCounts := make(chan int, 10)
+	env.config.OnNewServerEntries = func(count int) {
+		reportedCounts <- count
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	nextIPAddress := 1
+
+	// fetchServerEntries fetches a common remote server list with the
+	// specified number of additional server entries.
+	var encodedServerEntries []string
+	fetchServerEntries := func(count int) {
+
+		for i := 0; i < count; i++ {
+			encodedServerEntry, err := protocol.EncodeServerEntry(
+				&protocol.ServerEntry{
+					IpAddress:    fmt.Sprintf("192.0.2.%d", nextIPAddress),
+					Capabilities: []string{"OSSH"},
+					Region:       "JP",
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+			encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+			nextIPAddress += 1
+		}
+		commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+			strings.Join(encodedServerEntries, "\n"),
+			testOSLSigningPublicKey,
+			testOSLSigningPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+		err = reportNewServerEntries(env.config, env.fetchCommon)
+		if err != nil {
+			t.Fatalf("fetchCommon failed: %s", err)
+		}
+	}
+
+	checkReports := func(expectedCount int) {
+		select {
+		case count := <-reportedCounts:
+			if count != expectedCount {
+				t.Fatalf("unexpected new server entries report: %d", count)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing new server entries report")
+		}
+		select {
+		case count := <-reportedCounts:
+			t.Fatalf("unexpected new server entries report: %d", count)
+		case <-time.After(time.Duration(2*reportWindow) * time.Millisecond):
+		}
+	}
+
+	// Rapid reports within the window are coalesced into a single report,
+	// made once the window ends, while each fetch still emits a notice.
+
+	fetchServerEntries(1)
+	fetchServerEntries(2)
+	fetchServerEntries(3)
+
+	select {
+	case count := <-reportedCounts:
+		t.Fatalf("unexpected immediate new server entries report: %d", count)
+	default:
+	}
+
+	checkReports(6)
+
+	if recorder.count("RemoteServerListNewServerEntries") != 3 {
+		t.Fatalf("unexpected new server entries notice count: %d",
+			recorder.count("RemoteServerListNewServerEntries"))
+	}
+	payloads := recorder.payloads("NewServerEntriesReportsCoalesced")
+	if len(payloads) != 1 ||
+		payloads[0]["reports"] != float64(3) ||
+		payloads[0]["count"] != float64(6) {
+
+		t.Fatalf("unexpected coalesced reports notices: %+v", payloads)
+	}
+
+	// A report after the window ends starts a new window.
+
+	fetchServerEntries(4)
+
+	checkReports(4)
+}
+
+func TestRemoteServerListDecompressionRatio(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	setCommonRemoteServerList := func(serverEntryCount int) {
+		var encodedServerEntries []string
+		for i := 0; i < serverEntryCount; i++ {
+			encodedServerEntry, err := protocol.EncodeServerEntry(
+				&protocol.ServerEntry{
+					IpAddress:    fmt.Sprintf("192.0.2.%d", 100+i),
+					Capabilities: []string{"OSSH"},
+					Region:       "JP",
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+			encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+		}
+		commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+			strings.Join(encodedServerEntries, "\n"),
+			testOSLSigningPublicKey,
+			testOSLSigningPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+	}
+
+	// getStat returns the most recent remote server list stat recorded for
+	// the common remote server list.
+	getStat := func() map[string]interface{} {
+		stats, err := TakeOutUnreportedPersistentStats(1000)
+		if err != nil {
+			t.Fatalf("TakeOutUnreportedPersistentStats failed: %s", err)
+		}
+		var commonStat map[string]interface{}
+		for _, statJSON := range stats[datastorePersistentStatTypeRemoteServerList] {
+			var stat map[string]interface{}
+			err := json.Unmarshal(statJSON, &stat)
+			if err != nil {
+				t.Fatalf("json.Unmarshal failed: %s", err)
+			}
+			url, _ := stat["url"].(string)
+			if strings.HasSuffix(url, testCommonRemoteServerListName) {
+				commonStat = stat
+			}
+		}
+		if commonStat == nil {
+			t.Fatalf("missing remote server list stat")
+		}
+		return commonStat
+	}
+
+	// The ratio is measured and recorded for a typical list, which doesn't
+	// exceed the default maximum.
+
+	setCommonRemoteServerList(20)
+
+	err := env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	stat := getStat()
+	ratio, _ := stat["decompression_ratio"].(float64)
+	if ratio <= 1.0 {
+		t.Fatalf("unexpected decompression ratio: %+v", stat)
+	}
+	if stat["decompression_ratio_exceeded"] != nil {
+		t.Fatalf("unexpected decompression ratio flag: %+v", stat)
+	}
+	if recorder.count("RemoteServerListDecompressionRatioExceeded") != 0 {
+		t.Fatalf("unexpected decompression ratio notice")
+	}
+
+	// A ratio beyond the maximum is flagged. The flagged list is still
+	// imported.
+
+	maxRatio := ratio / 2
+	err = env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.RemoteServerListMaxDecompressionRatio: maxRatio,
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	setCommonRemoteServerList(21)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	stat = getStat()
+	if stat["decompression_ratio_exceeded"] != true {
+		t.Fatalf("missing decompression ratio flag: %+v", stat)
+	}
+	flaggedRatio, _ := stat["decompression_ratio"].(float64)
+	if flaggedRatio <= maxRatio {
+		t.Fatalf("unexpected decompression ratio: %+v", stat)
+	}
+
+	payloads := recorder.payloads("RemoteServerListDecompressionRatioExceeded")
+	if len(payloads) != 1 ||
+		payloads[0]["maxRatio"] != maxRatio ||
+		payloads[0]["ratio"] != flaggedRatio {
+
+		t.Fatalf("unexpected decompression ratio notices: %+v", payloads)
+	}
+
+	if CountServerEntries() != 21 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+// testETagStore is an in-memory ETagStore.
+type testETagStore struct {
+	mutex sync.Mutex
+	etags map[string]string
+}
+
+func (store *testETagStore) GetUrlETag(url string) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.etags[url], nil
+}
+
+func (store *testETagStore) SetUrlETag(url, etag string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if etag == "" {
+		delete(store.etags, url)
+	} else {
+		store.etags[url] = etag
+	}
+	return nil
+}
+
+func TestRemoteServerListETagStore(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	store := &testETagStore{etags: make(map[string]string)}
+	SetETagStore(store)
+	defer SetETagStore(nil)
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	for i := 0; i < 2; i++ {
+		err = env.fetch()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+		err = env.fetchCommon()
+		if err != nil {
+			t.Fatalf("fetchCommon failed: %s", err)
+		}
+	}
+
+	// The ETags of the registry, each OSL, and the common remote server list
+	// are stored in the custom store, so the second fetches download no
+	// resources.
+
+	expectedURLs := []string{
+		osl.GetOSLRegistryURL(env.server.URL + "/"),
+		env.server.URL + "/" + testCommonRemoteServerListName,
+	}
+	for _, oslID := range env.oslIDs {
+		expectedURLs = append(expectedURLs, env.server.URL+"/"+env.oslFileName(oslID))
+	}
+
+	store.mutex.Lock()
+	storedCount := len(store.etags)
+	for _, url := range expectedURLs {
+		if store.etags[url] == "" {
+			t.Errorf("missing stored ETag: %s", url)
+		}
+	}
+	store.mutex.Unlock()
+	if storedCount != len(expectedURLs) {
+		t.Fatalf("unexpected stored ETag count: %d", storedCount)
+	}
+
+	if CountServerEntries() != 3 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+	for _, oslID := range env.oslIDs {
+		if env.requestCount(env.oslFileName(oslID)) != 1 {
+			t.Fatalf("unexpected OSL request count: %d", env.requestCount(env.oslFileName(oslID)))
+		}
+	}
+
+	// No ETags are stored in the main datastore.
+
+	err = datastoreView(func(tx *datastoreTx) error {
+		cursor := tx.bucket(datastoreUrlETagsBucket).cursor()
+		defer cursor.close()
+		if key := cursor.firstKey(); key != nil {
+			return fmt.Errorf("unexpected datastore ETag: %s", key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("datastoreView failed: %s", err)
+	}
+
+	// Restoring the default store reverts to the datastore ETags, of which
+	// there are none, so the resources are downloaded again.
+
+	SetETagStore(nil)
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	for _, oslID := range env.oslIDs {
+		if env.requestCount(env.oslFileName(oslID)) != 2 {
+			t.Fatalf("unexpected OSL request count: %d", env.requestCount(env.oslFileName(oslID)))
+		}
+	}
+	etag, err := GetUrlETag(osl.GetOSLRegistryURL(env.server.URL + "/"))
+	if err != nil || etag == "" {
+		t.Fatalf("missing datastore ETag: %v", err)
+	}
+}
+
+// testServerListStore is an in-memory ServerListStore.
+type testServerListStore struct {
+	testETagStore
+	keyValues     map[string]string
+	sloks         map[string][]byte
+	serverEntries map[string]protocol.ServerEntryFields
+}
+
+func newTestServerListStore() *testServerListStore {
+	return &testServerListStore{
+		testETagStore: testETagStore{etags: make(map[string]string)},
+		keyValues:     make(map[string]string),
+		sloks:         make(map[string][]byte),
+		serverEntries: make(map[string]protocol.ServerEntryFields),
+	}
+}
+
+func (store *testServerListStore) GetKeyValue(key string) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.keyValues[key], nil
+}
+
+func (store *testServerListStore) SetKeyValue(key, value string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.keyValues[key] = value
+	return nil
+}
+
+func (store *testServerListStore) GetSLOK(id []byte) ([]byte, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.sloks[string(id)], nil
+}
+
+func (store *testServerListStore) StoreServerEntries(
+	ctx context.Context,
+	serverEntries *protocol.StreamingServerEntryDecoder,
+	provenance *ServerEntryProvenance,
+	newServerEntry func(protocol.ServerEntryFields)) (int, error) {
+
+	newEntries := 0
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return 0, err
+		}
+		serverEntry, err := serverEntries.Next()
+		if err != nil {
+			return 0, err
+		}
+		if serverEntry == nil {
+			return newEntries, nil
+		}
+		store.mutex.Lock()
+		_, ok := store.serverEntries[serverEntry.GetIPAddress()]
+		store.serverEntries[serverEntry.GetIPAddress()] = serverEntry
+		store.mutex.Unlock()
+		if !ok {
+			newEntries += 1
+			if newServerEntry != nil {
+				newServerEntry(serverEntry)
+			}
+		}
+	}
+}
+
+func TestRemoteServerListServerListStore(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 1)
+	defer env.close()
+
+	// The SLOKs are held by the custom store, and datastore SLOK lookups
+	// fail, so the OSLs are only unlocked by using the custom store.
+
+	store := newTestServerListStore()
+	seedState := env.oslConfig.NewClientSeedState("", env.propagationChannelID, nil)
+	seedState.NewClientSeedPortForward(net.ParseIP("0.0.0.0")).UpdateProgress(1, 1, 1)
+	for _, slok := range seedState.GetSeedPayload().SLOKs {
+		store.sloks[string(slok.ID)] = slok.Key
+	}
+
+	originalGetSLOK := getSLOK
+	getSLOK = func(id []byte) ([]byte, error) {
+		return nil, errors.New("unexpected datastore SLOK lookup")
+	}
+	defer func() { getSLOK = originalGetSLOK }()
+
+	env.config.ServerListStore = store
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	// OSL files staged by a download-only fetch are imported into the
+	// custom store, not the datastore.
+
+	err = DownloadObfuscatedServerLists(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("DownloadObfuscatedServerLists failed: %s", err)
+	}
+	err = ImportDownloadedObfuscatedServerLists(env.config)
+	if err != nil {
+		t.Fatalf("ImportDownloadedObfuscatedServerLists failed: %s", err)
+	}
+
+	store.mutex.Lock()
+	storedCount := len(store.serverEntries)
+	store.mutex.Unlock()
+	if storedCount != len(env.oslIDs) {
+		t.Fatalf("unexpected stored server entry count: %d", storedCount)
+	}
+
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected datastore server entry count: %d", CountServerEntries())
+	}
+
+	for i := 0; i < 2; i++ {
+		err = env.fetch()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+		err = env.fetchCommon()
+		if err != nil {
+			t.Fatalf("fetchCommon failed: %s", err)
+		}
+	}
+
+	// The server entries are imported into the custom store, not the
+	// datastore.
+
+	expectedIPAddresses := []string{"192.0.1.1", "192.0.2.1", "192.0.2.100"}
+
+	store.mutex.Lock()
+	storedCount = len(store.serverEntries)
+	for _, ipAddress := range expectedIPAddresses {
+		if store.serverEntries[ipAddress] == nil {
+			t.Errorf("missing stored server entry: %s", ipAddress)
+		}
+	}
+	store.mutex.Unlock()
+	if storedCount != len(expectedIPAddresses) {
+		t.Fatalf("unexpected stored server entry count: %d", storedCount)
+	}
+
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected datastore server entry count: %d", CountServerEntries())
+	}
+
+	// The ETags are stored in the custom store, not the datastore, so the
+	// second fetches download no resources.
+
+	expectedURLs := []string{
+		osl.GetOSLRegistryURL(env.server.URL + "/"),
+		env.server.URL + "/" + testCommonRemoteServerListName,
+	}
+	for _, oslID := range env.oslIDs {
+		expectedURLs = append(expectedURLs, env.server.URL+"/"+env.oslFileName(oslID))
+	}
+
+	for _, url := range expectedURLs {
+		etag, _ := store.GetUrlETag(url)
+		if etag == "" {
+			t.Errorf("missing stored ETag: %s", url)
+		}
+		etag, err = GetUrlETag(url)
+		if err != nil || etag != "" {
+			t.Errorf("unexpected datastore ETag: %s: %v", url, err)
+		}
+	}
+
+	for _, oslID := range env.oslIDs {
+		if env.requestCount(env.oslFileName(oslID)) != 1 {
+			t.Fatalf("unexpected OSL request count: %d", env.requestCount(env.oslFileName(oslID)))
+		}
+	}
+	if env.requestCount(testCommonRemoteServerListName) != 2 {
+		t.Fatalf("unexpected common remote server list request count: %d",
+			env.requestCount(testCommonRemoteServerListName))
+	}
+}
+
+// testDatastoreSnapshot returns the content of the datastore, for checking
+// that an operation leaves the datastore unchanged.
+func testDatastoreSnapshot(t *testing.T) map[string]string {
+
+	buckets := [][]byte{
+		datastoreServerEntriesBucket,
+		datastoreUrlETagsBucket,
+		datastoreKeyValueBucket,
+		datastoreRemoteServerListStatsBucket,
+		datastoreSLOKsBucket,
+		datastoreOSLQuarantineBucket,
+		datastoreServerEntryProvenanceBucket,
+		datastoreUrlValidatedTimesBucket,
+		datastoreUrlNextFetchTimesBucket,
+		datastoreOSLPendingImportBucket,
+		datastoreServerEntryImportJournalBucket,
+		datastoreServerEntryReachabilityBucket,
+		datastoreOSLFetchFingerprintsBucket,
+		datastoreOSLFetchPlansBucket,
+		datastoreOSLDownloadAttemptsBucket,
+		datastoreOSLImportTimesBucket,
+		datastoreOSLRegistryGenerationsBucket,
+		datastoreOSLRegistryFetchTimesBucket,
+		datastoreOSLRegistryDeltaProgressBucket,
+		datastoreOSLImportGenerationsBucket,
+		datastoreImportedContentDigestsBucket,
+		datastoreOSLImportedMD5SumsBucket,
+	}
+
+	snapshot := make(map[string]string)
+	err := datastoreView(func(tx *datastoreTx) error {
+		for _, bucket := range buckets {
+			cursor := tx.bucket(bucket).cursor()
+			for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+				snapshot[string(bucket)+"/"+string(key)] = string(value)
+			}
+			cursor.close()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("datastoreView failed: %s", err)
+	}
+	return snapshot
+}
+
+func TestRemoteServerListDryRun(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 2)
+	defer env.close()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	dryRunDirectory := filepath.Join(
+		env.dataDirectory, OBFUSCATED_SERVER_LIST_DRY_RUN_DIRECTORY)
+
+	dryRun := func(expectedCommonCount, expectedOSLCount int) {
+
+		before := testDatastoreSnapshot(t)
+
+		count, err := FetchCommonRemoteServerListDryRun(
+			context.Background(), env.config, 0, nil, &DialConfig{})
+		if err != nil {
+			t.Fatalf("FetchCommonRemoteServerListDryRun failed: %s", err)
+		}
+		if count != expectedCommonCount {
+			t.Fatalf("unexpected common remote server list count: %d", count)
+		}
+
+		count, err = FetchObfuscatedServerListsDryRun(
+			context.Background(), env.config, 0, nil, &DialConfig{})
+		if err != nil {
+			t.Fatalf("FetchObfuscatedServerListsDryRun failed: %s", err)
+		}
+		if count != expectedOSLCount {
+			t.Fatalf("unexpected obfuscated server list count: %d", count)
+		}
+
+		if !reflect.DeepEqual(before, testDatastoreSnapshot(t)) {
+			t.Fatalf("dry run modified the datastore")
+		}
+
+		// The downloaded files are deleted once validated.
+
+		_, err = os.Stat(env.config.RemoteServerListDownloadFilename + ".dry-run")
+		if !os.IsNotExist(err) {
+			t.Fatalf("unexpected dry run download file: %v", err)
+		}
+		files, err := ioutil.ReadDir(dryRunDirectory)
+		if err != nil {
+			t.Fatalf("ReadDir failed: %s", err)
+		}
+		if len(files) != 0 {
+			t.Fatalf("unexpected dry run download files: %d", len(files))
+		}
+	}
+
+	// A dry run decodes the server entries, but stores no server entries
+	// or ETags.
+
+	dryRun(1, 4)
+
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// After a fetch, the stored ETags are ignored by a dry run, so that the
+	// resources are downloaded and validated again, and the stored ETags
+	// are unchanged.
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+	if CountServerEntries() != 5 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	dryRun(1, 4)
+
+	for _, oslID := range env.oslIDs {
+		if env.requestCount(env.oslFileName(oslID)) != 3 {
+			t.Fatalf("unexpected OSL request count: %d", env.requestCount(env.oslFileName(oslID)))
+		}
+	}
+
+	// An interrupted dry run download is resumed by the next dry run.
+
+	resumeSavedBytes := GetRemoteServerListResumeSavedBytes()
+
+	env.mutex.Lock()
+	env.truncateRequests = 1
+	env.mutex.Unlock()
+
+	_, err = FetchCommonRemoteServerListDryRun(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err == nil {
+		t.Fatalf("unexpected dry run success")
+	}
+
+	dryRun(1, 4)
+
+	if GetRemoteServerListResumeSavedBytes() <= resumeSavedBytes {
+		t.Fatalf("dry run download not resumed")
+	}
+
+	// A server list which fails validation is reported, and the datastore
+	// is unchanged.
+
+	before := testDatastoreSnapshot(t)
+
+	env.setFile(testCommonRemoteServerListName, []byte("invalid"))
+
+	count, err := FetchCommonRemoteServerListDryRun(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if _, ok := err.(FetchFileError); !ok {
+		t.Fatalf("unexpected dry run result: %d, %v", count, err)
+	}
+
+	// A cancelled dry run returns the context error.
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc()
+
+	_, err = FetchObfuscatedServerListsDryRun(ctx, env.config, 0, nil, &DialConfig{})
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Fatalf("unexpected dry run result: %v", err)
+	}
+
+	if !reflect.DeepEqual(before, testDatastoreSnapshot(t)) {
+		t.Fatalf("dry run modified the datastore")
+	}
+}
+
+func TestRemoteServerListDryRunMirrorHealthAndTelemetry(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	env.setFile(testCommonRemoteServerListName, []byte("payload"))
+	sourceURL := env.server.URL + "/" + testCommonRemoteServerListName
+
+	mirrorHealth := newDownloadMirrorHealth()
+	telemetry := newFetchTelemetryRecorder(
+		env.config, REMOTE_SERVER_LIST_FETCH_TYPE_COMMON)
+
+	download := func(dryRun bool) {
+		_, _, err := downloadRemoteServerListFile(
+			context.Background(),
+			env.config,
+			nil,
+			&DialConfig{},
+			10*time.Second,
+			sourceURL,
+			sourceURL,
+			false,
+			nil,
+			nil,
+			"",
+			filepath.Join(env.dataDirectory, "dry-run"),
+			nil,
+			remoteServerListDownloadOptions{
+				mirrorHealth: mirrorHealth,
+				telemetry:    telemetry,
+				dryRun:       dryRun,
+			})
+		if err != nil {
+			t.Fatalf("downloadRemoteServerListFile failed: %s", err)
+		}
+	}
+
+	// A dry run records no mirror health or fetch telemetry.
+
+	download(true)
+
+	if len(mirrorHealth.mirrors) != 0 {
+		t.Fatalf("dry run recorded mirror health")
+	}
+	if len(telemetry.run.Sources) != 0 || telemetry.run.DownloadedBytes != 0 {
+		t.Fatalf("dry run recorded fetch telemetry")
+	}
+
+	// The dry run fetches record nothing in the process-wide mirror health
+	// and fetch telemetry.
+
+	mirrorCount := func() int {
+		remoteServerListMirrorHealth.mutex.Lock()
+		defer remoteServerListMirrorHealth.mutex.Unlock()
+		return len(remoteServerListMirrorHealth.mirrors)
+	}
+
+	fetchTelemetry := func() []byte {
+		telemetryJSON, err := GetFetchTelemetryJSON()
+		if err != nil {
+			t.Fatalf("GetFetchTelemetryJSON failed: %s", err)
+		}
+		return telemetryJSON
+	}
+
+	beforeMirrorCount := mirrorCount()
+	beforeTelemetry := fetchTelemetry()
+
+	_, err := FetchCommonRemoteServerListDryRun(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+	if err == nil {
+		t.Fatalf("unexpected dry run success")
+	}
+
+	if mirrorCount() != beforeMirrorCount {
+		t.Fatalf("dry run recorded mirror health")
+	}
+	if !bytes.Equal(beforeTelemetry, fetchTelemetry()) {
+		t.Fatalf("dry run recorded fetch telemetry")
+	}
+
+	// Otherwise, the same download is recorded.
+
+	download(false)
+
+	if len(mirrorHealth.mirrors) != 1 {
+		t.Fatalf("download didn't record mirror health")
+	}
+	if telemetry.run.Sources[sourceURL] == nil ||
+		telemetry.run.Sources[sourceURL].Requests != 1 {
+
+		t.Fatalf("download didn't record fetch telemetry")
+	}
+}
+
+// testFailingETagStore is a testETagStore which fails the specified number
+// of subsequent ETag writes.
+type testFailingETagStore struct {
+	testETagStore
+	failuresMutex sync.Mutex
+	failures      int
+	attempts      int
+}
+
+func (store *testFailingETagStore) SetUrlETag(url, etag string) error {
+	store.failuresMutex.Lock()
+	store.attempts += 1
+	fail := store.failures > 0
+	if fail {
+		store.failures -= 1
+	}
+	store.failuresMutex.Unlock()
+	if fail {
+		return errors.New("transient ETag store failure")
+	}
+	return store.testETagStore.SetUrlETag(url, etag)
+}
+
+func (store *testFailingETagStore) setFailures(failures int) {
+	store.failuresMutex.Lock()
+	defer store.failuresMutex.Unlock()
+	store.failures = failures
+	store.attempts = 0
+}
+
+func (store *testFailingETagStore) getAttempts() int {
+	store.failuresMutex.Lock()
+	defer store.failuresMutex.Unlock()
+	return store.attempts
+}
+
+func TestRemoteServerListETagWriteRetry(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	store := &testFailingETagStore{
+		testETagStore: testETagStore{etags: make(map[string]string)},
+	}
+	SetETagStore(store)
+	defer SetETagStore(nil)
+
+	err := env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListETagWriteMaxAttempts:  3,
+		parameters.RemoteServerListETagWriteRetryBackoff: "1ms",
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	canonicalURL := env.server.URL + "/" + testCommonRemoteServerListName
+
+	setCommonRemoteServerList := func(region string) {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:    "192.0.2.100",
+				Capabilities: []string{"OSSH"},
+				Region:       region,
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+			encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+	}
+
+	checkStoredETag := func() {
+		store.mutex.Lock()
+		storedETag := store.etags[canonicalURL]
+		store.mutex.Unlock()
+		if storedETag != env.fileETag(testCommonRemoteServerListName) {
+			t.Fatalf("unexpected stored ETag: %s", storedETag)
+		}
+		pendingUrlETagsMutex.Lock()
+		pendingCount := len(pendingUrlETags)
+		pendingUrlETagsMutex.Unlock()
+		if pendingCount != 0 {
+			t.Fatalf("unexpected pending ETag count: %d", pendingCount)
+		}
+	}
+
+	// A transient ETag write failure is retried.
+
+	setCommonRemoteServerList("US")
+	store.setFailures(2)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	if store.getAttempts() != 3 {
+		t.Fatalf("unexpected ETag write attempts: %d", store.getAttempts())
+	}
+	checkStoredETag()
+
+	// When all attempts fail, the ETag is stored by the flush at the end of
+	// the fetch.
+
+	setCommonRemoteServerList("CA")
+	store.setFailures(3)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	if store.getAttempts() != 4 {
+		t.Fatalf("unexpected ETag write attempts: %d", store.getAttempts())
+	}
+	checkStoredETag()
+
+	// When the flush also fails, the ETag remains pending, and the resource
+	// isn't downloaded again. The ETag is stored by the next fetch's flush.
+
+	setCommonRemoteServerList("GB")
+	store.setFailures(4)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	etag, err := GetUrlETag(canonicalURL)
+	if err != nil {
+		t.Fatalf("GetUrlETag failed: %s", err)
+	}
+	if etag != env.fileETag(testCommonRemoteServerListName) {
+		t.Fatalf("unexpected pending ETag: %s", etag)
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	if recorder.count("RemoteServerListResourceUnchanged") != 1 ||
+		recorder.count("RemoteServerListResourceDownloaded") != 0 {
+		t.Fatalf("unexpected download of unchanged resource")
+	}
+	checkStoredETag()
+}
+
+func TestRemoteServerListWeakETag(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	env.mutex.Lock()
+	env.weakETags = true
+	env.mutex.Unlock()
+
+	// Leave a partial download with the weak ETag. The partial bytes don't
+	// match the object, so resuming would corrupt the download.
+
+	md5sum := md5.Sum(commonRemoteServerList)
+	etag := fmt.Sprintf("W/\"%s\"", hex.EncodeToString(md5sum[:]))
+
+	downloadFilename := env.config.RemoteServerListDownloadFilename
+	err = ioutil.WriteFile(
+		downloadFilename+".part", make([]byte, len(commonRemoteServerList)/2), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	err = ioutil.WriteFile(downloadFilename+".part.etag", []byte(etag), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// The download restarts from the beginning instead of resuming.
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	if recorder.count("ResumeDownload") != 0 {
+		t.Fatalf("unexpected resumed download")
+	}
+
+	downloadedList, err := ioutil.ReadFile(downloadFilename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	if !bytes.Equal(downloadedList, commonRemoteServerList) {
+		t.Fatalf("unexpected downloaded common remote server list")
+	}
+
+	canonicalURL := env.server.URL + "/" + testCommonRemoteServerListName
+	storedETag, err := GetUrlETag(canonicalURL)
+	if err != nil {
+		t.Fatalf("GetUrlETag failed: %s", err)
+	}
+	if storedETag != etag {
+		t.Fatalf("unexpected stored ETag: %s", storedETag)
+	}
+
+	// The weak ETag is still used to detect that the object is unchanged.
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	if recorder.count("RemoteServerListResourceUnchanged") != 1 {
+		t.Fatalf("unexpected download of unchanged resource")
+	}
+}
+
+func TestRemoteServerListNoNewServerEntriesNotice(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 2)
+	defer env.close()
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	setCommonRemoteServerList := func(region string) {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:    "192.0.2.100",
+				Capabilities: []string{"OSSH"},
+				Region:       region,
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+			encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+	}
+
+	checkNotices := func(expectedUnchanged, expectedNoNewServerEntries int) {
+		unchanged := recorder.count("RemoteServerListResourceUnchanged")
+		noNewServerEntries := recorder.count("RemoteServerListResourceNoNewServerEntries")
+		if unchanged != expectedUnchanged ||
+			noNewServerEntries != expectedNoNewServerEntries {
+
+			t.Fatalf("unexpected notice counts: %d unchanged, %d no new server entries",
+				unchanged, noNewServerEntries)
+		}
+	}
+
+	// A download which imports a new server entry emits neither notice.
+
+	setCommonRemoteServerList("US")
+
+	err := env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	checkNotices(0, 0)
+
+	// An unchanged resource isn't downloaded.
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	checkNotices(1, 0)
+
+	// A changed resource with only already stored server entries is
+	// downloaded and imported, but adds no new server entries.
+
+	setCommonRemoteServerList("CA")
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	checkNotices(1, 1)
+
+	payloads := recorder.payloads("RemoteServerListResourceNoNewServerEntries")
+	if payloads[0]["url"] != env.server.URL+"/"+testCommonRemoteServerListName {
+		t.Fatalf("unexpected notice: %+v", payloads[0])
+	}
+
+	// The same distinction applies to OSLs. Changing the regions of the
+	// server entries changes the OSL files, but not the set of server
+	// entries.
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	checkNotices(1, 1)
+
+	for i, oslID := range env.oslIDs {
+		env.serverEntries[oslID] = nil
+		for j := 0; j < 2; j++ {
+			encodedServerEntry, err := protocol.EncodeServerEntry(
+				&protocol.ServerEntry{
+					IpAddress:         fmt.Sprintf("192.0.%d.%d", i+1, j+1),
+					WebServerPort:     "8000",
+					WebServerSecret:   "secret",
+					SshObfuscatedPort: 4001,
+					Capabilities:      []string{"OSSH"},
+					Region:            "JP",
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+			env.serverEntries[oslID] = append(env.serverEntries[oslID], encodedServerEntry)
+		}
+	}
+	env.pave()
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	checkNotices(1, 3)
+}
+
+func TestRemoteServerListResourceImportedNotice(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 2)
+	defer env.close()
+
+	// The second OSL also lists the server entries of the first OSL. Those
+	// server entries are new only in the first OSL imported.
+
+	env.serverEntries[env.oslIDs[1]] = append(
+		env.serverEntries[env.oslIDs[1]], env.serverEntries[env.oslIDs[0]]...)
+	env.pave()
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	err := env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	payloads := recorder.payloads("RemoteServerListResourceImported")
+	if len(payloads) != len(env.oslIDs) {
+		t.Fatalf("unexpected notice count: %d", len(payloads))
+	}
+
+	newEntries := 0
+	for _, payload := range payloads {
+		var totalEntries int
+		switch payload["url"] {
+		case env.server.URL + "/" + env.oslFileName(env.oslIDs[0]):
+			totalEntries = 2
+		case env.server.URL + "/" + env.oslFileName(env.oslIDs[1]):
+			totalEntries = 4
+		default:
+			t.Fatalf("unexpected notice URL: %v", payload["url"])
+		}
+		if int(payload["totalEntries"].(float64)) != totalEntries {
+			t.Fatalf("unexpected notice: %+v", payload)
+		}
+		newEntries += int(payload["newEntries"].(float64))
+	}
+
+	if newEntries != 4 || CountServerEntries() != 4 {
+		t.Fatalf("unexpected new entries: %d, %d", newEntries, CountServerEntries())
+	}
+
+	// Reimporting the changed first OSL imports no new server entries.
+
+	for i, encodedServerEntry := range env.serverEntries[env.oslIDs[0]] {
+		serverEntry, err := protocol.DecodeServerEntry(encodedServerEntry, "", "")
+		if err != nil {
+			t.Fatalf("DecodeServerEntry failed: %s", err)
+		}
+		serverEntry.Region = "JP"
+		env.serverEntries[env.oslIDs[0]][i], err = protocol.EncodeServerEntry(serverEntry)
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+	}
+	env.pave()
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	payloads = recorder.payloads("RemoteServerListResourceImported")
+	if len(payloads) != len(env.oslIDs)+1 {
+		t.Fatalf("unexpected notice count: %d", len(payloads))
+	}
+	payload := payloads[len(payloads)-1]
+	if payload["url"] != env.server.URL+"/"+env.oslFileName(env.oslIDs[0]) ||
+		payload["newEntries"] != float64(0) ||
+		payload["totalEntries"] != float64(2) {
+
+		t.Fatalf("unexpected notice: %+v", payload)
+	}
+}
+
+func TestServerEntryValidationError(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	makeCommonRemoteServerList := func(serverEntries []*protocol.ServerEntry) []string {
+		var encodedServerEntries []string
+		for _, serverEntry := range serverEntries {
+			encodedServerEntry, err := protocol.EncodeServerEntry(serverEntry)
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+			encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+		}
+		commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+			strings.Join(encodedServerEntries, "\n"),
+			testOSLSigningPublicKey,
+			testOSLSigningPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+		return encodedServerEntries
+	}
+
+	serverEntries := []*protocol.ServerEntry{
+		{IpAddress: "192.0.2.1", Capabilities: []string{"OSSH"}, Region: "JP"},
+		{IpAddress: "192.0.2", Capabilities: []string{"OSSH"}, Region: "JP"},
+		{IpAddress: "192.0.2.2", Region: "JP"},
+	}
+
+	encodedServerEntries := makeCommonRemoteServerList(serverEntries)
+
+	var invalidServerEntries []string
+	env.config.OnServerEntryValidationError = func(encodedServerEntry string, err error) {
+		if err == nil {
+			t.Errorf("missing validation error")
+		}
+		invalidServerEntries = append(invalidServerEntries, encodedServerEntry)
+	}
+
+	// In the default, strict mode, both the entry with an invalid IP address
+	// and the entry without capabilities are reported and skipped.
+
+	err := env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	if len(invalidServerEntries) != 2 ||
+		invalidServerEntries[0] != encodedServerEntries[1] ||
+		invalidServerEntries[1] != encodedServerEntries[2] {
+
+		t.Fatalf("unexpected invalid server entries: %v", invalidServerEntries)
+	}
+
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// In lenient mode, both entries are still reported, but the entry
+	// without capabilities is imported.
+
+	env.config.LenientServerEntryValidation = true
+
+	serverEntries = append(serverEntries,
+		&protocol.ServerEntry{IpAddress: "192.0.2.3", Capabilities: []string{"OSSH"}, Region: "JP"})
+
+	encodedServerEntries = makeCommonRemoteServerList(serverEntries)
+
+	invalidServerEntries = nil
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+
+	if len(invalidServerEntries) != 2 ||
+		invalidServerEntries[0] != encodedServerEntries[1] ||
+		invalidServerEntries[1] != encodedServerEntries[2] {
+
+		t.Fatalf("unexpected invalid server entries: %v", invalidServerEntries)
+	}
+
+	if CountServerEntries() != 3 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestRemoteServerListValidatedPayload(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 2, 2)
+	defer env.close()
+
+	var mutex sync.Mutex
+	payloads := make(map[string][]string)
+
+	env.config.OnValidatedPayload = func(sourceURL string, payload []byte) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		payloads[sourceURL] = append(payloads[sourceURL], string(payload))
+	}
+
+	checkPayloads := func(sourceURL string, expectedPayloads ...string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !reflect.DeepEqual(payloads[sourceURL], expectedPayloads) {
+			t.Fatalf("unexpected validated payloads for %s: %+v", sourceURL, payloads[sourceURL])
+		}
+	}
+
+	// The callback isn't invoked for a payload that fails validation.
+
+	signingPublicKey, signingPrivateKey, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+
+	invalidCommonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, signingPublicKey, signingPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, invalidCommonRemoteServerList)
+
+	commonURL := env.server.URL + "/" + testCommonRemoteServerListName
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+	checkPayloads(commonURL)
+
+	// The callback receives the validated payload once per unpack.
+
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+	checkPayloads(commonURL, encodedServerEntry)
+
+	// An unchanged resource isn't unpacked again.
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+	checkPayloads(commonURL, encodedServerEntry)
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	for _, oslID := range env.oslIDs {
+		checkPayloads(
+			env.server.URL+"/"+env.oslFileName(oslID),
+			strings.Join(env.serverEntries[oslID], "\n"))
+	}
+
+	if CountServerEntries() != 5 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+}
+
+func TestRemoteServerListSharedHTTPClient(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte("response"))
+		}))
+	defer server.Close()
+
+	// Track the number of open connections, and the maximum number of
+	// concurrently open connections, across all shared clients.
+
+	var mutex sync.Mutex
+	openConns := 0
+	maxOpenConns := 0
+	makeClientCount := 0
+
+	maxConnections := 2
+
+	clients := newRemoteServerListHTTPClients(
+		maxConnections,
+		func(_ bool) (*http.Client, error) {
+			mutex.Lock()
+			makeClientCount += 1
+			mutex.Unlock()
+			return &http.Client{
+				Transport: &http.Transport{
+					Dial: func(network, addr string) (net.Conn, error) {
+						conn, err := net.Dial(network, addr)
+						if err != nil {
+							return nil, err
+						}
+						mutex.Lock()
+						openConns += 1
+						if openConns > maxOpenConns {
+							maxOpenConns = openConns
+						}
+						mutex.Unlock()
+						return &testCountedConn{
+							Conn: conn,
+							onClose: func() {
+								mutex.Lock()
+								openConns -= 1
+								mutex.Unlock()
+							},
+						}, nil
+					},
+				},
+			}, nil
+		})
+
+	httpClient, err := clients.get(false)
+	if err != nil {
+		t.Fatalf("get failed: %s", err)
+	}
+
+	// Concurrent fetches receive the same shared client.
+
+	requestCount := 10
+	var waitGroup sync.WaitGroup
+	for i := 0; i < requestCount; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			sharedClient, err := clients.get(false)
+			if err != nil {
+				t.Errorf("get failed: %s", err)
+				return
+			}
+			if sharedClient != httpClient {
+				t.Errorf("unexpected HTTP client")
+				return
+			}
+			response, err := sharedClient.Get(server.URL)
+			if err != nil {
+				t.Errorf("Get failed: %s", err)
+				return
+			}
+			ioutil.ReadAll(response.Body)
+			response.Body.Close()
+		}()
+	}
+	waitGroup.Wait()
+
+	mutex.Lock()
+	if makeClientCount != 1 {
+		t.Fatalf("unexpected make client count: %d", makeClientCount)
+	}
+	if maxOpenConns > maxConnections {
+		t.Fatalf("unexpected max open connections: %d", maxOpenConns)
+	}
+	mutex.Unlock()
+
+	// A distinct client is used for skipVerify.
+
+	skipVerifyClient, err := clients.get(true)
+	if err != nil {
+		t.Fatalf("get failed: %s", err)
+	}
+	if skipVerifyClient == httpClient || makeClientCount != 2 {
+		t.Fatalf("unexpected skipVerify HTTP client")
+	}
+
+	clients.closeIdleConnections()
+}
+
+type testCountedConn struct {
+	net.Conn
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func (conn *testCountedConn) Close() error {
+	conn.closeOnce.Do(conn.onClose)
+	return conn.Conn.Close()
+}
+
+func TestUntunneledDownloadTLSParameters(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// Limit the TLS profile to one which negotiates TLS 1.2 with the test
+	// server.
+
+	err := env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.LimitTLSProfiles: protocol.TLSProfiles{protocol.TLS_PROFILE_CHROME_58},
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("ETag", "\"tls\"")
+			w.Write([]byte("payload"))
+		}))
+	// Use an ECDSA certificate, as the TLS profile doesn't verify the
+	// RSA-PSS signatures the test server would use with an RSA certificate.
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(
+		rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %s", err)
+	}
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{
+			{Certificate: [][]byte{certificate}, PrivateKey: privateKey}},
+		MaxVersion: tls.VersionTLS12,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	sourceURL := server.URL + "/tls"
+	destinationFilename := filepath.Join(env.dataDirectory, "tls")
+
+	etag, _, err := downloadRemoteServerListFile(
+		context.Background(),
+		env.config,
+		nil,
+		&DialConfig{},
+		10*time.Second,
+		sourceURL,
+		sourceURL,
+		true,
+		nil,
+		nil,
+		"",
+		destinationFilename,
+		nil,
+		remoteServerListDownloadOptions{})
+	if err != nil {
+		t.Fatalf("downloadRemoteServerListFile failed: %s", err)
+	}
+	if etag != "\"tls\"" {
+		t.Fatalf("unexpected ETag: %s", etag)
+	}
+
+	payloads := recorder.payloads("UntunneledDownloadTLSParameters")
+	if len(payloads) != 1 ||
+		payloads[0]["url"] != sourceURL ||
+		payloads[0]["TLSVersion"] != "TLS 1.2" ||
+		!strings.HasPrefix(payloads[0]["cipherSuite"].(string), "TLS_ECDHE_") {
+
+		t.Fatalf("unexpected TLS parameters notices: %+v", payloads)
+	}
+
+	stats, err := TakeOutUnreportedPersistentStats(1000)
+	if err != nil {
+		t.Fatalf("TakeOutUnreportedPersistentStats failed: %s", err)
+	}
+	found := false
+	for _, statJSON := range stats[datastorePersistentStatTypeRemoteServerList] {
+		var stat map[string]interface{}
+		err := json.Unmarshal(statJSON, &stat)
+		if err != nil {
+			t.Fatalf("json.Unmarshal failed: %s", err)
+		}
+		if stat["url"] != sourceURL {
+			continue
+		}
+		if stat["tls_version"] != payloads[0]["TLSVersion"] ||
+			stat["tls_cipher_suite"] != payloads[0]["cipherSuite"] {
+
+			t.Fatalf("unexpected remote server list stat: %+v", stat)
+		}
+		found = true
+	}
+	if !found {
+		t.Fatalf("missing remote server list stat")
+	}
+
+	// Plain HTTP downloads report no TLS parameters.
+
+	env.setFile(testCommonRemoteServerListName, []byte("payload"))
+	plainURL := env.server.URL + "/" + testCommonRemoteServerListName
+
+	_, _, err = downloadRemoteServerListFile(
+		context.Background(),
+		env.config,
+		nil,
+		&DialConfig{},
+		10*time.Second,
+		plainURL,
+		plainURL,
+		false,
+		nil,
+		nil,
+		"",
+		destinationFilename,
+		nil,
+		remoteServerListDownloadOptions{})
+	if err != nil {
+		t.Fatalf("downloadRemoteServerListFile failed: %s", err)
+	}
+	if recorder.count("UntunneledDownloadTLSParameters") != 1 {
+		t.Fatalf("unexpected TLS parameters notice count")
+	}
+}
+
+func TestRemoteServerListPerMirrorTLSConfig(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	err := env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.LimitTLSProfiles: protocol.TLSProfiles{protocol.TLS_PROFILE_CHROME_58},
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	// The test server certificate is valid only for the mirror domain,
+	// which isn't the host dialed, so verification succeeds only when the
+	// mirror's SNI server name is applied. The self-signed certificate is
+	// its own trusted CA.
+
+	const mirrorDomain = "mirror.example.com"
+
+	makeCertificate := func() ([]byte, *ecdsa.PrivateKey) {
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %s", err)
+		}
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			DNSNames:              []string{mirrorDomain},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		certificate, err := x509.CreateCertificate(
+			rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+		if err != nil {
+			t.Fatalf("CreateCertificate failed: %s", err)
+		}
+		return certificate, privateKey
+	}
+
+	makePin := func(certificate []byte) string {
+		parsedCertificate, err := x509.ParseCertificate(certificate)
+		if err != nil {
+			t.Fatalf("ParseCertificate failed: %s", err)
+		}
+		digest := sha256.Sum256(parsedCertificate.RawSubjectPublicKeyInfo)
+		return base64.StdEncoding.EncodeToString(digest[:])
+	}
+
+	certificate, privateKey := makeCertificate()
+	otherCertificate, _ := makeCertificate()
+
+	caFilename := filepath.Join(env.dataDirectory, "ca.pem")
+	err = ioutil.WriteFile(
+		caFilename,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}),
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	var serverNamesMutex sync.Mutex
+	serverNames := make(map[string]bool)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("ETag", "\""+req.URL.Path+"\"")
+			w.Write([]byte("payload"))
+		}))
+	server.TLS = &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			serverNamesMutex.Lock()
+			serverNames[hello.ServerName] = true
+			serverNamesMutex.Unlock()
+			return &tls.Certificate{
+				Certificate: [][]byte{certificate},
+				PrivateKey:  privateKey,
+			}, nil
+		},
+		MaxVersion: tls.VersionTLS12,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	urls := parameters.DownloadURLs{
+		{
+			URL: encode(server.URL + "/sni"),
+			TLSConfig: &parameters.DownloadTLSConfig{
+				SNIServerName:         encode(mirrorDomain),
+				PinnedPublicKeyHashes: []string{makePin(certificate)},
+			},
+		},
+		{
+			URL: encode(server.URL + "/default"),
+		},
+		{
+			URL:        encode(server.URL + "/pinned"),
+			SkipVerify: true,
+			TLSConfig: &parameters.DownloadTLSConfig{
+				PinnedPublicKeyHashes: []string{makePin(certificate)},
+			},
+		},
+		{
+			URL:        encode(server.URL + "/unpinned"),
+			SkipVerify: true,
+			TLSConfig: &parameters.DownloadTLSConfig{
+				PinnedPublicKeyHashes: []string{makePin(otherCertificate)},
+			},
+		},
+	}
+	err = urls.DecodeAndValidate()
+	if err != nil {
+		t.Fatalf("DecodeAndValidate failed: %s", err)
+	}
+
+	download := func(downloadURL *parameters.DownloadURL) (map[string]bool, error) {
+
+		serverNamesMutex.Lock()
+		serverNames = make(map[string]bool)
+		serverNamesMutex.Unlock()
+
+		_, _, err := downloadRemoteServerListFile(
+			context.Background(),
+			env.config,
+			nil,
+			&DialConfig{TrustedCACertificatesFilename: caFilename},
+			10*time.Second,
+			downloadURL.URL,
+			downloadURL.URL,
+			downloadURL.SkipVerify,
+			nil,
+			urls.TLSConfig(downloadURL.URL),
+			"",
+			filepath.Join(env.dataDirectory, "mirror"),
+			nil,
+			remoteServerListDownloadOptions{})
+
+		serverNamesMutex.Lock()
+		defer serverNamesMutex.Unlock()
+		return serverNames, err
+	}
+
+	// The mirror with an SNI server name sends that name and verifies the
+	// certificate against it.
+
+	names, err := download(urls[0])
+	if err != nil {
+		t.Fatalf("downloadRemoteServerListFile failed: %s", err)
+	}
+	if len(names) != 1 || !names[mirrorDomain] {
+		t.Fatalf("unexpected SNI server names: %+v", names)
+	}
+
+	// The mirror with no TLS config uses the dialed IP address, which the
+	// certificate doesn't match.
+
+	names, err = download(urls[1])
+	if err == nil {
+		t.Fatalf("unexpected download success")
+	}
+	if len(names) != 1 || names[mirrorDomain] {
+		t.Fatalf("unexpected SNI server names: %+v", names)
+	}
+
+	// Pins apply even when certificate verification is skipped.
+
+	_, err = download(urls[2])
+	if err != nil {
+		t.Fatalf("downloadRemoteServerListFile failed: %s", err)
+	}
+
+	_, err = download(urls[3])
+	if err == nil || !strings.Contains(err.Error(), "unpinned public key") {
+		t.Fatalf("unexpected download result: %v", err)
+	}
+}
+
+func TestRemoteServerListDownloadHTTPProtocol(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// The TLS profile offers "h2" and "http/1.1" with ALPN, and the test
+	// server, which negotiates only "http/1.1", forces a fallback.
+
+	err := env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.LimitTLSProfiles: protocol.TLSProfiles{protocol.TLS_PROFILE_CHROME_58},
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("ETag", "\"protocol\"")
+			w.Write([]byte("payload"))
+		}))
+	// See the ECDSA certificate comment in TestUntunneledDownloadTLSParameters.
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(
+		rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %s", err)
+	}
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{
+			{Certificate: [][]byte{certificate}, PrivateKey: privateKey}},
+		MaxVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	download := func(sourceURL string, skipVerify bool) {
+		_, _, err := downloadRemoteServerListFile(
+			context.Background(),
+			env.config,
+			nil,
+			&DialConfig{},
+			10*time.Second,
+			sourceURL,
+			sourceURL,
+			skipVerify,
+			nil,
+			nil,
+			"",
+			filepath.Join(env.dataDirectory, "protocol"),
+			nil,
+			remoteServerListDownloadOptions{})
+		if err != nil {
+			t.Fatalf("downloadRemoteServerListFile failed: %s", err)
+		}
+	}
+
+	tlsURL := server.URL + "/protocol"
+	download(tlsURL, true)
+
+	payloads := recorder.payloads("RemoteServerListDownloadHTTPProtocol")
+	if len(payloads) != 1 ||
+		payloads[0]["url"] != tlsURL ||
+		payloads[0]["protocol"] != "HTTP/1.1" ||
+		payloads[0]["fallback"] != true {
+
+		t.Fatalf("unexpected HTTP protocol notices: %+v", payloads)
+	}
+
+	// Plain HTTP downloads offer no HTTP/2, so there's no fallback.
+
+	env.setFile(testCommonRemoteServerListName, []byte("payload"))
+	plainURL := env.server.URL + "/" + testCommonRemoteServerListName
+	download(plainURL, false)
+
+	payloads = recorder.payloads("RemoteServerListDownloadHTTPProtocol")
+	if len(payloads) != 2 ||
+		payloads[1]["url"] != plainURL ||
+		payloads[1]["protocol"] != "HTTP/1.1" ||
+		payloads[1]["fallback"] != false {
+
+		t.Fatalf("unexpected HTTP protocol notices: %+v", payloads)
+	}
+
+	// The recorded HTTP version is that of the response, so HTTP/2 is
+	// reported with a transport that negotiates it. The server offers h2
+	// through ALPN, and the client transport is explicitly configured for
+	// HTTP/2, as it has a custom TLS config.
+
+	http2Server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("payload"))
+		}))
+	http2Server.TLS = &tls.Config{NextProtos: []string{"h2"}}
+	http2Server.StartTLS()
+	defer http2Server.Close()
+
+	http2Client := http2Server.Client()
+	err = http2.ConfigureTransport(http2Client.Transport.(*http.Transport))
+	if err != nil {
+		t.Fatalf("ConfigureTransport failed: %s", err)
+	}
+
+	httpProtocol := &downloadHTTPProtocol{}
+	httpClient := httpProtocol.wrapHTTPClient(http2Client)
+
+	_, _, err = resumeDownload(
+		context.Background(),
+		httpClient,
+		http2Server.URL+"/protocol",
+		MakePsiphonUserAgent(env.config),
+		filepath.Join(env.dataDirectory, "http2"),
+		"",
+		nil,
+		nil,
+		false,
+		nil,
+		0)
+	if err != nil {
+		t.Fatalf("resumeDownload failed: %s", err)
+	}
+	if httpProtocol.get() != "HTTP/2.0" {
+		t.Fatalf("unexpected HTTP protocol: %s", httpProtocol.get())
+	}
+}
+
+func TestRemoteServerListAdaptiveTimeout(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	// The server sends chunkBytes every chunkPeriod, a rate well above the
+	// minimum rate, until sendPeriod elapses, and then either completes the
+	// response or stalls.
+
+	chunkBytes := 50
+	chunkPeriod := 20 * time.Millisecond
+	downloadTimeout := 500 * time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			sendPeriod, _ := time.ParseDuration(req.URL.Query().Get("send"))
+			stall := req.URL.Query().Get("stall") != ""
+			flusher := w.(http.Flusher)
+			startTime := time.Now()
+			for time.Since(startTime) < sendPeriod {
+				w.Write(make([]byte, chunkBytes))
+				flusher.Flush()
+				time.Sleep(chunkPeriod)
+			}
+			if stall {
+				<-req.Context().Done()
+			}
+		}))
+	defer server.Close()
+
+	download := func(minimumRate int, query string) (int64, time.Duration, error) {
+
+		err := env.config.SetClientParameters(
+			"", false, map[string]interface{}{
+				parameters.FetchRemoteServerListMinimumRate: minimumRate,
+				parameters.FetchRemoteServerListRateWindow:  "100ms",
+			})
+		if err != nil {
+			t.Fatalf("SetClientParameters failed: %s", err)
+		}
+
+		destinationFilename := filepath.Join(env.dataDirectory, "adaptive")
+		os.Remove(destinationFilename)
+		os.Remove(destinationFilename + ".part")
+		os.Remove(destinationFilename + ".part.etag")
+
+		sourceURL := server.URL + "/?" + query
+
+		startTime := time.Now()
+		_, n, err := downloadRemoteServerListFile(
+			context.Background(),
+			env.config,
+			nil,
+			&DialConfig{},
+			downloadTimeout,
+			sourceURL,
+			sourceURL,
+			false,
+			nil,
+			nil,
+			"",
+			destinationFilename,
+			nil,
+			remoteServerListDownloadOptions{})
+		return n, time.Since(startTime), err
+	}
+
+	t.Run("slow download exceeds static timeout", func(t *testing.T) {
+		_, _, err := download(0, "send=1500ms")
+		if err == nil {
+			t.Fatalf("unexpected download success")
+		}
+	})
+
+	t.Run("slow but progressing download succeeds", func(t *testing.T) {
+		n, elapsed, err := download(1000, "send=1500ms")
+		if err != nil {
+			t.Fatalf("download failed: %s", err)
+		}
+		if elapsed < downloadTimeout || n < int64(chunkBytes) {
+			t.Fatalf("unexpected download: %d bytes in %s", n, elapsed)
+		}
+	})
+
+	t.Run("stalled download aborts", func(t *testing.T) {
+		_, elapsed, err := download(1000, "send=300ms&stall=1")
+		if err == nil || !strings.Contains(err.Error(), "download stalled") {
+			t.Fatalf("unexpected download result: %v", err)
+		}
+		if elapsed > downloadTimeout+200*time.Millisecond {
+			t.Fatalf("stall detected too slowly: %s", elapsed)
+		}
+	})
+
+	t.Run("unresponsive download times out", func(t *testing.T) {
+		_, elapsed, err := download(1000, "stall=1")
+		if err == nil || !strings.Contains(err.Error(), "download timed out") {
+			t.Fatalf("unexpected download result: %v", err)
+		}
+		if elapsed < downloadTimeout {
+			t.Fatalf("timed out too quickly: %s", elapsed)
+		}
+	})
+}
+
+func TestRemoteServerListConnectTimeout(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	// The dead mirror accepts TCP connections but never responds, so the
+	// TLS handshake doesn't complete.
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	var connsMutex sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connsMutex.Lock()
+			conns = append(conns, conn)
+			connsMutex.Unlock()
+		}
+	}()
+	defer func() {
+		listener.Close()
+		connsMutex.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		connsMutex.Unlock()
+	}()
+	deadURL := "https://" + listener.Addr().String() + "/dead"
+
+	// The slow mirror responds immediately, and then sends the body over
+	// sendPeriod and either completes the response or stalls.
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			sendPeriod, _ := time.ParseDuration(req.URL.Query().Get("send"))
+			stall := req.URL.Query().Get("stall") != ""
+			flusher := w.(http.Flusher)
+			startTime := time.Now()
+			for {
+				w.Write(make([]byte, 50))
+				flusher.Flush()
+				if time.Since(startTime) >= sendPeriod {
+					break
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			if stall {
+				<-req.Context().Done()
+			}
+		}))
+	defer server.Close()
+
+	connectTimeout := 200 * time.Millisecond
+
+	download := func(
+		connectTimeout string,
+		downloadTimeout time.Duration,
+		sourceURL string) (time.Duration, error) {
+
+		err := env.config.SetClientParameters(
+			"", false, map[string]interface{}{
+				parameters.RemoteServerListConnectTimeout: connectTimeout,
+			})
+		if err != nil {
+			t.Fatalf("SetClientParameters failed: %s", err)
+		}
+
+		destinationFilename := filepath.Join(env.dataDirectory, "connect")
+		os.Remove(destinationFilename)
+		os.Remove(destinationFilename + ".part")
+		os.Remove(destinationFilename + ".part.etag")
+
+		startTime := time.Now()
+		_, _, err = downloadRemoteServerListFile(
+			context.Background(),
+			env.config,
+			nil,
+			&DialConfig{},
+			downloadTimeout,
+			sourceURL,
+			sourceURL,
+			true,
+			nil,
+			nil,
+			"",
+			destinationFilename,
+			nil,
+			remoteServerListDownloadOptions{})
+		return time.Since(startTime), err
+	}
+
+	t.Run("dead mirror fails fast", func(t *testing.T) {
+		elapsed, err := download(connectTimeout.String(), 5*time.Second, deadURL)
+		if err == nil || !strings.Contains(err.Error(), "connect timeout") {
+			t.Fatalf("unexpected download result: %v", err)
+		}
+		if elapsed < connectTimeout || elapsed > 2*time.Second {
+			t.Fatalf("unexpected connect timeout: %s", elapsed)
+		}
+	})
+
+	t.Run("dead mirror without connect timeout", func(t *testing.T) {
+		downloadTimeout := 500 * time.Millisecond
+		elapsed, err := download("0s", downloadTimeout, deadURL)
+		if err == nil || strings.Contains(err.Error(), "connect timeout") {
+			t.Fatalf("unexpected download result: %v", err)
+		}
+		if elapsed < downloadTimeout {
+			t.Fatalf("timed out too quickly: %s", elapsed)
+		}
+	})
+
+	t.Run("slow body exceeds connect timeout", func(t *testing.T) {
+		elapsed, err := download(
+			connectTimeout.String(), 5*time.Second, server.URL+"/?send=600ms")
+		if err != nil {
+			t.Fatalf("download failed: %s", err)
+		}
+		if elapsed < 3*connectTimeout {
+			t.Fatalf("download too fast: %s", elapsed)
+		}
+	})
+
+	t.Run("stalled body times out", func(t *testing.T) {
+		downloadTimeout := 500 * time.Millisecond
+		elapsed, err := download(
+			connectTimeout.String(), downloadTimeout, server.URL+"/?send=0s&stall=1")
+		if err == nil || strings.Contains(err.Error(), "connect timeout") {
+			t.Fatalf("unexpected download result: %v", err)
+		}
+		if elapsed < downloadTimeout {
+			t.Fatalf("timed out too quickly: %s", elapsed)
+		}
+	})
+}
+
+func TestCommonRemoteServerListStreaming(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	serverEntryCount := 5
+
+	var encodedServerEntries []string
+	for i := 0; i < serverEntryCount; i++ {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:    fmt.Sprintf("192.0.2.%d", i+1),
+				Capabilities: []string{"OSSH"},
+				Region:       "JP",
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+	}
+
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		strings.Join(encodedServerEntries, "\n"),
+		testOSLSigningPublicKey,
+		testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	// Record each streamed server entry along with the number of server
+	// entries stored at the time it was streamed.
+
+	var streamedIPAddresses []string
+	var storedCounts []int
+
+	env.config.SetServerEntryStreamHandler(
+		func(serverEntry *protocol.ServerEntry) {
+			streamedIPAddresses = append(streamedIPAddresses, serverEntry.IpAddress)
+			storedCounts = append(storedCounts, CountServerEntries())
+		})
+	defer env.config.SetServerEntryStreamHandler(nil)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if len(streamedIPAddresses) != serverEntryCount {
+		t.Fatalf("unexpected streamed server entry count: %d", len(streamedIPAddresses))
+	}
+
+	for i := 0; i < serverEntryCount; i++ {
+		if streamedIPAddresses[i] != fmt.Sprintf("192.0.2.%d", i+1) {
+			t.Fatalf("unexpected streamed server entries: %v", streamedIPAddresses)
+		}
+
+		// Each server entry is streamed before it's stored, and after all
+		// preceding server entries are stored.
+		if storedCounts[i] != i {
+			t.Fatalf("unexpected stored server entry counts: %v", storedCounts)
+		}
+	}
+
+	if CountServerEntries() != serverEntryCount {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	for _, ipAddress := range streamedIPAddresses {
+		provenance, err := GetServerEntryProvenance(ipAddress)
+		if err != nil {
+			t.Fatalf("GetServerEntryProvenance failed: %s", err)
+		}
+		if provenance == nil {
+			t.Fatalf("server entry not stored: %s", ipAddress)
+		}
+	}
+}
+
+func TestRemoteServerListRevalidateInterval(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	revalidateIntervalSeconds := 3600
+	env.config.RemoteServerListRevalidateIntervalSeconds = &revalidateIntervalSeconds
+	err := env.config.SetClientParameters("", false, nil)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	canonicalURL := env.server.URL + "/" + testCommonRemoteServerListName
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// fetchAndCheck deletes the server entry, fetches, and checks whether the
+	// resource was downloaded in full and the server entry was imported.
+	fetchAndCheck := func(expectFullFetch bool) {
+
+		_, err := DeleteServerEntriesByProvenance(
+			func(_ *ServerEntryProvenance) bool { return true })
+		if err != nil {
+			t.Fatalf("DeleteServerEntriesByProvenance failed: %s", err)
+		}
+
+		downloadedCount := recorder.count("RemoteServerListResourceDownloaded")
+
+		err = env.fetchCommon()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+
+		fullFetch := recorder.count("RemoteServerListResourceDownloaded") > downloadedCount
+		imported := CountServerEntries() == 1
+
+		if fullFetch != expectFullFetch || imported != expectFullFetch {
+			t.Fatalf(
+				"unexpected fetch result: full fetch %v, imported %v, expected %v",
+				fullFetch, imported, expectFullFetch)
+		}
+	}
+
+	fetchAndCheck(true)
+
+	// Within the revalidate interval, the ETag skip applies.
+
+	fetchAndCheck(false)
+
+	validatedTime, err := GetUrlValidatedTime(canonicalURL)
+	if err != nil {
+		t.Fatalf("GetUrlValidatedTime failed: %s", err)
+	}
+	if time.Since(validatedTime) > time.Minute {
+		t.Fatalf("unexpected validated time: %s", validatedTime)
+	}
+
+	// Past the revalidate interval, a full fetch occurs, even though the
+	// resource is unchanged.
+
+	err = SetUrlValidatedTime(canonicalURL, time.Now().Add(-2*time.Hour))
+	if err != nil {
+		t.Fatalf("SetUrlValidatedTime failed: %s", err)
+	}
+
+	fetchAndCheck(true)
+
+	fetchAndCheck(false)
+
+	// With no revalidate interval, the ETag skip always applies.
+
+	env.config.RemoteServerListRevalidateIntervalSeconds = nil
+	err = env.config.SetClientParameters("", false, nil)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = SetUrlValidatedTime(canonicalURL, time.Now().Add(-2*time.Hour))
+	if err != nil {
+		t.Fatalf("SetUrlValidatedTime failed: %s", err)
+	}
+
+	fetchAndCheck(false)
+}
+
+func TestRemoteServerListFetchClock(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	clock := &testClock{now: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}
+	env.config.Clock = clock
+
+	revalidateIntervalSeconds := 3600
+	env.config.RemoteServerListRevalidateIntervalSeconds = &revalidateIntervalSeconds
+	err := env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ObfuscatedServerListQuarantineThreshold: 1,
+		parameters.ObfuscatedServerListQuarantinePeriod:    "1h",
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	canonicalURL := env.server.URL + "/" + testCommonRemoteServerListName
+
+	// Fetch timestamps and validation times are taken from the clock.
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	provenance, err := GetServerEntryProvenance("192.0.2.100")
+	if err != nil {
+		t.Fatalf("GetServerEntryProvenance failed: %s", err)
+	}
+	if provenance == nil ||
+		provenance.FetchTimestamp != clock.Now().Format(time.RFC3339) {
+		t.Fatalf("unexpected provenance: %+v", provenance)
+	}
+
+	checkValidatedTime := func() {
+		validatedTime, err := GetUrlValidatedTime(canonicalURL)
+		if err != nil {
+			t.Fatalf("GetUrlValidatedTime failed: %s", err)
+		}
+		if !validatedTime.Equal(clock.Now()) {
+			t.Fatalf("unexpected validated time: %s", validatedTime)
+		}
+	}
+
+	checkValidatedTime()
+
+	requestCount := env.requestCount(testCommonRemoteServerListName)
+
+	// Within the revalidate interval, the unchanged resource is skipped.
+
+	clock.advance(59 * time.Minute)
+
+	skipCount := GetRemoteServerListETagSkipCount()
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if GetRemoteServerListETagSkipCount() != skipCount+1 {
+		t.Fatalf("unexpected full fetch within revalidate interval")
+	}
+
+	// Once the revalidate interval has elapsed, the resource is downloaded
+	// and validated again.
+
+	clock.advance(2 * time.Minute)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if GetRemoteServerListETagSkipCount() != skipCount+1 ||
+		env.requestCount(testCommonRemoteServerListName) != requestCount+2 {
+		t.Fatalf("unexpected skip after revalidate interval")
+	}
+
+	checkValidatedTime()
+
+	// The quarantine period expires according to the clock.
+
+	badOSLName := env.oslFileName(env.oslIDs[0])
+	goodContents := env.getFile(badOSLName)
+	badContents := append([]byte(nil), goodContents...)
+	badContents[len(badContents)-1] ^= 0xff
+	env.setFile(badOSLName, badContents)
+
+	err = env.fetch()
+	if err == nil {
+		t.Fatalf("unexpected fetch success")
+	}
+
+	env.setFile(badOSLName, goodContents)
+
+	requestCount = env.requestCount(badOSLName)
+
+	clock.advance(59 * time.Minute)
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(badOSLName) != requestCount {
+		t.Fatalf("unexpected request for quarantined OSL")
+	}
+
+	clock.advance(2 * time.Minute)
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(badOSLName) != requestCount+1 {
+		t.Fatalf("missing request for unquarantined OSL")
+	}
+}
+
+func TestRemoteServerListResumeSavedBytes(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 10)
+	defer env.close()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	// Leave partial downloads in place, as if earlier downloads of the common
+	// remote server list and the OSL were interrupted.
+
+	writePartialDownload := func(downloadFilename, name string, size int) {
+		err := ioutil.WriteFile(
+			downloadFilename+".part", env.getFile(name)[:size], 0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+		err = ioutil.WriteFile(
+			downloadFilename+".part.etag", []byte(env.fileETag(name)), 0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+	}
+
+	commonOffset := len(commonRemoteServerList) / 2
+	writePartialDownload(
+		env.config.RemoteServerListDownloadFilename,
+		testCommonRemoteServerListName,
+		commonOffset)
+
+	oslID, _ := hex.DecodeString(env.oslIDs[0])
+	oslName := env.oslFileName(env.oslIDs[0])
+	oslOffset := len(env.getFile(oslName)) / 2
+	writePartialDownload(
+		osl.GetOSLFilename(env.config.ObfuscatedServerListDownloadDirectory, oslID),
+		oslName,
+		oslOffset)
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	initialSavedBytes := GetRemoteServerListResumeSavedBytes()
+
+	checkSavedBytes := func(expectedSavedBytes int64) {
+		savedBytes := GetRemoteServerListResumeSavedBytes() - initialSavedBytes
+		if savedBytes != expectedSavedBytes {
+			t.Fatalf("unexpected saved bytes: %d", savedBytes)
+		}
+		payloads := recorder.payloads("RemoteServerListResumeSavedBytes")
+		if len(payloads) == 0 {
+			t.Fatalf("missing saved bytes notice")
+		}
+		noticeSavedBytes := payloads[len(payloads)-1]["savedBytes"].(float64)
+		if int64(noticeSavedBytes) != initialSavedBytes+expectedSavedBytes {
+			t.Fatalf("unexpected notice saved bytes: %v", noticeSavedBytes)
+		}
+	}
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+	checkSavedBytes(int64(commonOffset))
+
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	checkSavedBytes(int64(commonOffset + oslOffset))
+
+	if CountServerEntries() != 11 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	// A download without a partial download in place saves nothing.
+
+	commonRemoteServerList, err = common.WriteAuthenticatedDataPackage(
+		encodedServerEntry+"\n"+encodedServerEntry,
+		testOSLSigningPublicKey,
+		testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+	if env.requestCount(testCommonRemoteServerListName) != 2 {
+		t.Fatalf("unexpected request count: %d", env.requestCount(testCommonRemoteServerListName))
+	}
+	checkSavedBytes(int64(commonOffset + oslOffset))
+}
+
+func TestRemoteServerListCorruptResumedDownload(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 10)
+	defer env.close()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	// Leave corrupt partial downloads in place, with the current ETags, so
+	// that the resumed downloads append the remaining bytes onto bad bytes.
+
+	writeCorruptPartialDownload := func(downloadFilename, name string) int {
+		partial := append([]byte(nil), env.getFile(name)[:len(env.getFile(name))/2]...)
+		for i := range partial {
+			partial[i] ^= 0xff
+		}
+		err := ioutil.WriteFile(downloadFilename+".part", partial, 0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+		err = ioutil.WriteFile(
+			downloadFilename+".part.etag", []byte(env.fileETag(name)), 0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+		return len(partial)
+	}
+
+	commonURL := env.server.URL + "/" + testCommonRemoteServerListName
+	commonFilename := env.config.RemoteServerListDownloadFilename
+	commonOffset := writeCorruptPartialDownload(
+		commonFilename, testCommonRemoteServerListName)
+
+	oslID, _ := hex.DecodeString(env.oslIDs[0])
+	oslName := env.oslFileName(env.oslIDs[0])
+	oslURL := osl.GetOSLFileURL(env.server.URL+"/", oslID)
+	oslFilename := osl.GetOSLFilename(env.config.ObfuscatedServerListDownloadDirectory, oslID)
+	oslOffset := writeCorruptPartialDownload(oslFilename, oslName)
+
+	// A stale stored ETag, as for an earlier version of each resource,
+	// should be cleared along with the corrupt download.
+
+	for _, url := range []string{commonURL, oslURL} {
+		err = SetUrlETag(url, "\"stale\"")
+		if err != nil {
+			t.Fatalf("SetUrlETag failed: %s", err)
+		}
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	initialSavedBytes := GetRemoteServerListResumeSavedBytes()
+
+	checkDiscarded := func(url, filename string, expectedNotices int) {
+		payloads := recorder.payloads("RemoteServerListResourceCorrupt")
+		if len(payloads) != expectedNotices {
+			t.Fatalf("unexpected corrupt notice count: %d", len(payloads))
+		}
+		if payloads[len(payloads)-1]["url"] != url {
+			t.Fatalf("unexpected corrupt notice URL: %v", payloads[len(payloads)-1]["url"])
+		}
+		_, err := os.Stat(filename)
+		if !os.IsNotExist(err) {
+			t.Fatalf("corrupt download not deleted: %v", err)
+		}
+		etag, err := GetUrlETag(url)
+		if err != nil {
+			t.Fatalf("GetUrlETag failed: %s", err)
+		}
+		if etag != "" {
+			t.Fatalf("unexpected ETag: %s", etag)
+		}
+	}
+
+	checkSavedBytes := func(expectedSavedBytes int) {
+		savedBytes := GetRemoteServerListResumeSavedBytes() - initialSavedBytes
+		if savedBytes != int64(expectedSavedBytes) {
+			t.Fatalf("unexpected saved bytes: %d", savedBytes)
+		}
+	}
+
+	// The resumed common remote server list download fails validation, and
+	// is discarded. The next fetch downloads the list from the beginning.
+
+	err = env.fetchCommon()
+	if err == nil {
+		t.Fatalf("fetchCommon unexpectedly succeeded")
+	}
+	checkSavedBytes(commonOffset)
+	checkDiscarded(commonURL, commonFilename, 1)
+
+	if CountServerEntries() != 0 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetchCommon failed: %s", err)
+	}
+	checkSavedBytes(commonOffset)
+
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+	etag, err := GetUrlETag(commonURL)
+	if err != nil {
+		t.Fatalf("GetUrlETag failed: %s", err)
+	}
+	if etag != env.fileETag(testCommonRemoteServerListName) {
+		t.Fatalf("unexpected ETag: %s", etag)
+	}
+
+	// The same applies to a resumed OSL download.
+
+	err = env.fetch()
+	if err == nil {
+		t.Fatalf("fetch unexpectedly succeeded")
+	}
+	checkSavedBytes(commonOffset + oslOffset)
+	checkDiscarded(oslURL, oslFilename, 2)
+
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	checkSavedBytes(commonOffset + oslOffset)
+
+	if CountServerEntries() != 11 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+	etag, err = GetUrlETag(oslURL)
+	if err != nil {
+		t.Fatalf("GetUrlETag failed: %s", err)
+	}
+	if etag != env.fileETag(oslName) {
+		t.Fatalf("unexpected ETag: %s", etag)
+	}
+}
+
+func TestRemoteServerListDownloadProgress(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 4, 10)
+	defer env.close()
+
+	err := env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListDownloadProgressInterval: "1ns",
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	// The first registry download is interrupted halfway and resumed in the
+	// same fetch. The progress of the resumed download starts from the
+	// partial download offset.
+
+	env.mutex.Lock()
+	env.truncateRequests = 1
+	env.mutex.Unlock()
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	registryURL := getOSLRegistryURL(env.config, env.server.URL+"/")
+	registrySize := int64(len(env.getFile(osl.REGISTRY_FILENAME)))
+
+	var bytesRead []int64
+	for _, payload := range recorder.payloads("RemoteServerListResourceDownloadProgress") {
+		if payload["url"] != registryURL {
+			continue
+		}
+		if int64(payload["bytesTotal"].(float64)) != registrySize {
+			t.Fatalf("unexpected bytes total: %v", payload["bytesTotal"])
+		}
+		bytesRead = append(bytesRead, int64(payload["bytesRead"].(float64)))
+	}
+
+	if len(bytesRead) < 2 {
+		t.Fatalf("unexpected progress notices: %v", bytesRead)
+	}
+	resumed := false
+	for i := 1; i < len(bytesRead); i++ {
+		if bytesRead[i] < bytesRead[i-1] {
+			t.Fatalf("progress isn't monotonic: %v", bytesRead)
+		}
+		if bytesRead[i-1] <= registrySize/2 && bytesRead[i] > registrySize/2 {
+			resumed = true
+		}
+	}
+	if !resumed || bytesRead[0] > registrySize/2 ||
+		bytesRead[len(bytesRead)-1] != registrySize {
+		t.Fatalf("unexpected progress: %v", bytesRead)
+	}
+
+	// Each OSL download reports its complete size.
+
+	for _, oslID := range env.oslIDs {
+		oslIDBytes, _ := hex.DecodeString(oslID)
+		oslURL := osl.GetOSLFileURL(env.server.URL+"/", oslIDBytes)
+		oslSize := int64(len(env.getFile(env.oslFileName(oslID))))
+		var lastPayload map[string]interface{}
+		for _, payload := range recorder.payloads("RemoteServerListResourceDownloadProgress") {
+			if payload["url"] == oslURL {
+				lastPayload = payload
+			}
+		}
+		if lastPayload == nil ||
+			int64(lastPayload["bytesRead"].(float64)) != oslSize ||
+			int64(lastPayload["bytesTotal"].(float64)) != oslSize {
+			t.Fatalf("unexpected OSL progress: %+v", lastPayload)
+		}
+	}
+
+	// With no interval, no progress notices are emitted.
+
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListDownloadProgressInterval: "0s",
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "US",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	env.serverEntries[env.oslIDs[0]] = append(
+		env.serverEntries[env.oslIDs[0]], encodedServerEntry)
+	env.pave()
+
+	noticeCount := len(recorder.payloads("RemoteServerListResourceDownloadProgress"))
+	requestCount := env.requestCount(osl.REGISTRY_FILENAME)
+
+	err = env.fetch()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if env.requestCount(osl.REGISTRY_FILENAME) != requestCount+1 ||
+		len(recorder.payloads("RemoteServerListResourceDownloadProgress")) != noticeCount {
+		t.Fatalf("unexpected progress notices")
+	}
+}
+
+func TestRemoteServerListCacheControl(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	clock := &testClock{now: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}
+	env.config.Clock = clock
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	env.mutex.Lock()
+	env.cacheControl = "public, max-age=3600"
+	env.mutex.Unlock()
+
+	fetchAndCheck := func(expectedRequestCount int) {
+		err := env.fetchCommon()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+		requestCount := env.requestCount(testCommonRemoteServerListName)
+		if requestCount != expectedRequestCount {
+			t.Fatalf("unexpected request count: %d", requestCount)
+		}
+	}
+
+	// Without RemoteServerListHonorCacheControl, Cache-Control is ignored
+	// and each fetch makes a conditional request.
+
+	fetchAndCheck(1)
+	fetchAndCheck(2)
+
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListHonorCacheControl: true,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	// A max-age response suppresses a premature re-fetch, until the max-age
+	// has elapsed.
+
+	fetchAndCheck(3)
+	fetchAndCheck(3)
+
+	clock.advance(59 * time.Minute)
+	fetchAndCheck(3)
+
+	clock.advance(2 * time.Minute)
+	fetchAndCheck(4)
+
+	// The max-age is limited by RemoteServerListMaxCacheControlAge.
+
+	err = env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.RemoteServerListHonorCacheControl:  true,
+		parameters.RemoteServerListMaxCacheControlAge: "10m",
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	clock.advance(61 * time.Minute)
+	fetchAndCheck(5)
+
+	clock.advance(11 * time.Minute)
+	fetchAndCheck(6)
+
+	// The next fetch time applies only to the ETag of the response which
+	// set it. When the stored ETag differs, as when a changed resource fails
+	// validation, the resource is requested regardless.
+
+	canonicalURL := env.server.URL + "/" + testCommonRemoteServerListName
+	err = SetUrlETag(canonicalURL, "\"changed\"")
+	if err != nil {
+		t.Fatalf("SetUrlETag failed: %s", err)
+	}
+
+	fetchAndCheck(7)
+
+	// A no-cache response is not scheduled.
+
+	env.mutex.Lock()
+	env.cacheControl = "no-cache, max-age=3600"
+	env.mutex.Unlock()
+
+	clock.advance(11 * time.Minute)
+	fetchAndCheck(8)
+	fetchAndCheck(9)
+}
+
+func TestRemoteServerListMissingETags(t *testing.T) {
+
+	t.Run("hash missing ETags", func(t *testing.T) {
+		testRemoteServerListMissingETags(t, true)
+	})
+
+	t.Run("don't hash missing ETags", func(t *testing.T) {
+		testRemoteServerListMissingETags(t, false)
+	})
+}
+
+func testRemoteServerListMissingETags(t *testing.T, hashMissingETags bool) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	env.mutex.Lock()
+	env.omitETags = true
+	env.mutex.Unlock()
+
+	err := env.config.SetClientParameters(
+		"", false, map[string]interface{}{
+			parameters.RemoteServerListHashMissingETags: hashMissingETags,
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	setCommonRemoteServerList := func(ipAddress string) {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:    ipAddress,
+				Capabilities: []string{"OSSH"},
+				Region:       "JP",
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+			encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+		}
+		env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+	}
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	fetchAndCheck := func(expectedUnchanged bool, expectedCount int) {
+
+		noticeCount := recorder.count("RemoteServerListResourceUnchanged")
+
+		err := env.fetchCommon()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+
+		unchanged := recorder.count("RemoteServerListResourceUnchanged") > noticeCount
+		if unchanged != expectedUnchanged {
+			t.Fatalf("unexpected unchanged: %v", unchanged)
+		}
+
+		if CountServerEntries() != expectedCount {
+			t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+		}
+	}
+
+	// Without hashing, every ETag-less response is reported as unchanged and
+	// nothing is imported.
+
+	setCommonRemoteServerList("192.0.2.100")
+
+	if !hashMissingETags {
+		fetchAndCheck(true, 0)
+		return
+	}
+
+	// With hashing, the first download is imported, identical content is
+	// reported as unchanged, and differing content is imported.
+
+	fetchAndCheck(false, 1)
+
+	fetchAndCheck(true, 1)
+
+	setCommonRemoteServerList("192.0.2.101")
+
+	fetchAndCheck(false, 2)
+}
+
+func TestRemoteServerListETagSkipCount(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err := common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	fetchAndCheck := func(fetch func() error, expectedSkips int) {
+
+		skipCount := GetRemoteServerListETagSkipCount()
+		noticeCount := recorder.count("RemoteServerListResourceUnchanged")
+
+		err := fetch()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+
+		skips := int(GetRemoteServerListETagSkipCount() - skipCount)
+		notices := recorder.count("RemoteServerListResourceUnchanged") - noticeCount
+
+		if skips != expectedSkips || notices != expectedSkips {
+			t.Fatalf(
+				"unexpected skips: count %d, notices %d, expected %d",
+				skips, notices, expectedSkips)
+		}
+	}
+
+	// A fresh download is not counted as a skip.
+
+	fetchAndCheck(env.fetchCommon, 0)
+
+	// The unchanged resource is skipped, via If-None-Match.
+
+	fetchAndCheck(env.fetchCommon, 1)
+
+	// For OSLs, the fresh downloads of the registry and OSL aren't skips.
+	// Then the registry is skipped via If-None-Match and the OSL is skipped
+	// via its registry MD5 without a request.
+
+	fetchAndCheck(env.fetch, 0)
+
+	oslRequestCount := env.requestCount(env.oslFileName(env.oslIDs[0]))
+
+	fetchAndCheck(env.fetch, 2)
+
+	if env.requestCount(env.oslFileName(env.oslIDs[0])) != oslRequestCount {
+		t.Fatalf("unexpected OSL request")
+	}
+
+	// A changed resource is downloaded and not counted as a skip.
+
+	encodedServerEntry, err = protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.101",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	commonRemoteServerList, err = common.WriteAuthenticatedDataPackage(
+		encodedServerEntry, testOSLSigningPublicKey, testOSLSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(testCommonRemoteServerListName, commonRemoteServerList)
+
+	fetchAndCheck(env.fetchCommon, 0)
+}
+
+func TestObfuscatedServerListETagsStoredPerURL(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 3, 1)
+	defer env.close()
+
+	// With an ETag prefix, the registry MD5Sums never match the OSL ETags,
+	// so each fetch sends a conditional request for each OSL, and the
+	// server responds with 304 when the stored ETag is current.
+
+	env.mutex.Lock()
+	env.etagPrefix = "etag-"
+	env.mutex.Unlock()
+
+	recorder := startTestNoticeRecorder()
+	defer recorder.stop()
+
+	oslURLs := make(map[string]bool)
+	for _, oslID := range env.oslIDs {
+		oslIDBytes, _ := hex.DecodeString(oslID)
+		oslURLs[osl.GetOSLFileURL(env.server.URL+"/", oslIDBytes)] = true
+	}
+
+	fetchAndCountOSLBytes := func() int64 {
+		noticeCount := len(recorder.payloads("RemoteServerListResourceDownloadedBytes"))
+		err := env.fetch()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+		var bytes int64
+		for _, payload := range recorder.payloads(
+			"RemoteServerListResourceDownloadedBytes")[noticeCount:] {
+
+			if oslURLs[payload["url"].(string)] {
+				bytes += int64(payload["bytes"].(float64))
+			}
+		}
+		return bytes
+	}
+
+	if fetchAndCountOSLBytes() == 0 {
+		t.Fatalf("unexpected OSL downloaded bytes")
+	}
+
+	// Each OSL ETag is stored under its own URL, and the registry ETag under
+	// the registry URL. The common remote server list ETag isn't touched.
+
+	for oslURL := range oslURLs {
+		etag, err := GetUrlETag(oslURL)
+		if err != nil {
+			t.Fatalf("GetUrlETag failed: %s", err)
+		}
+		name := strings.TrimPrefix(oslURL, env.server.URL+"/")
+		if etag != strings.Replace(env.fileETag(name), "\"", "\"etag-", 1) {
+			t.Fatalf("unexpected ETag for %s: %s", oslURL, etag)
+		}
+	}
+
+	etag, err := GetUrlETag(getOSLRegistryURL(env.config, env.server.URL+"/"))
+	if err != nil {
+		t.Fatalf("GetUrlETag failed: %s", err)
+	}
+	if etag != strings.Replace(env.fileETag(osl.REGISTRY_FILENAME), "\"", "\"etag-", 1) {
+		t.Fatalf("unexpected registry ETag: %s", etag)
+	}
+
+	etag, err = GetUrlETag(env.server.URL + "/" + testCommonRemoteServerListName)
+	if err != nil {
+		t.Fatalf("GetUrlETag failed: %s", err)
+	}
+	if etag != "" {
+		t.Fatalf("unexpected common remote server list ETag: %s", etag)
+	}
+
+	// The second fetch requests each unchanged OSL, and no OSL bytes are
+	// downloaded again.
+
+	oslRequestCounts := make(map[string]int)
+	for _, oslID := range env.oslIDs {
+		oslRequestCounts[oslID] = env.requestCount(env.oslFileName(oslID))
+	}
+
+	if fetchAndCountOSLBytes() != 0 {
+		t.Fatalf("unexpected OSL downloaded bytes")
+	}
+
+	for _, oslID := range env.oslIDs {
+		if env.requestCount(env.oslFileName(oslID)) != oslRequestCounts[oslID]+1 {
+			t.Fatalf("unexpected OSL request count: %s", oslID)
+		}
+	}
+}
+
+func TestObfuscatedServerListSkipImportedFiles(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 3, 1)
+	defer env.close()
+
+	// With an ETag prefix, the registry MD5Sums never match the OSL ETags,
+	// so only the stored imported MD5 sums can skip the OSL requests.
+
+	env.mutex.Lock()
+	env.etagPrefix = "etag-"
+	env.mutex.Unlock()
+
+	err := env.config.SetClientParameters("", false, map[string]interface{}{
+		parameters.ObfuscatedServerListSkipImportedFiles: true,
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	fetchAndCheck := func(expectedOSLRequests []int, expectedServerEntryCount int) {
+		err := env.fetch()
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err)
+		}
+		for i, oslID := range env.oslIDs {
+			if env.requestCount(env.oslFileName(oslID)) != expectedOSLRequests[i] {
+				t.Fatalf("unexpected OSL request count: %s: %d",
+					oslID, env.requestCount(env.oslFileName(oslID)))
+			}
+		}
+		if CountServerEntries() != expectedServerEntryCount {
+			t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+		}
+	}
+
+	// The first fetch downloads each OSL. The second fetch, with an
+	// unchanged registry, sends no OSL requests.
+
+	fetchAndCheck([]int{1, 1, 1}, 3)
+
+	registryRequestCount := env.requestCount(osl.REGISTRY_FILENAME)
+
+	fetchAndCheck([]int{1, 1, 1}, 3)
+
+	if env.requestCount(osl.REGISTRY_FILENAME) != registryRequestCount+1 {
+		t.Fatalf("unexpected registry request count: %d", env.requestCount(osl.REGISTRY_FILENAME))
+	}
+
+	// When a new registry advertises a changed MD5 sum for one OSL, only
+	// that OSL is requested.
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "US",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+	env.serverEntries[env.oslIDs[1]] = append(
+		env.serverEntries[env.oslIDs[1]], encodedServerEntry)
+	env.pave()
+
+	fetchAndCheck([]int{1, 2, 1}, 4)
+	fetchAndCheck([]int{1, 2, 1}, 4)
+
+	// Once an OSL ETag is cleared, the OSL is requested again.
+
+	oslIDBytes, _ := hex.DecodeString(env.oslIDs[2])
+	err = SetUrlETag(osl.GetOSLFileURL(env.server.URL+"/", oslIDBytes), "")
+	if err != nil {
+		t.Fatalf("SetUrlETag failed: %s", err)
+	}
+
+	fetchAndCheck([]int{1, 2, 2}, 4)
+}
+
+func TestCommonRemoteServerListConfigOverrides(t *testing.T) {
+
+	env := newTestOSLEnvironment(t, 1, 1)
+	defer env.close()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{
+			IpAddress:    "192.0.2.100",
+			Capabilities: []string{"OSSH"},
+			Region:       "JP",
+		})
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+
+	setCommonRemoteServerList := func(configOverrides string) {
+		contents, err := common.WriteAuthenticatedDataPackageWithConfigOverrides(
+			encodedServerEntry,
+			[]byte(configOverrides),
+			testOSLSigningPublicKey,
+			testOSLSigningPrivateKey)
+		if err != nil {
+			t.Fatalf("WriteAuthenticatedDataPackageWithConfigOverrides failed: %s", err)
+		}
+		env.setFile(testCommonRemoteServerListName, contents)
+	}
+
+	checkParameters := func(
+		expectedRetryPeriod, expectedStalePeriod, expectedUpgradeRetryPeriod time.Duration) {
+
+		p := env.config.GetClientParameters()
+		retryPeriod := p.Duration(parameters.FetchRemoteServerListRetryPeriod)
+		stalePeriod := p.Duration(parameters.FetchRemoteServerListStalePeriod)
+		upgradeRetryPeriod := p.Duration(parameters.FetchUpgradeRetryPeriod)
+		publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
+		p = nil
+
+		if retryPeriod != expectedRetryPeriod {
+			t.Fatalf("unexpected retry period: %s", retryPeriod)
+		}
+		if stalePeriod != expectedStalePeriod {
+			t.Fatalf("unexpected stale period: %s", stalePeriod)
+		}
+		if upgradeRetryPeriod != expectedUpgradeRetryPeriod {
+			t.Fatalf("unexpected upgrade retry period: %s", upgradeRetryPeriod)
+		}
+		if publicKey != testOSLSigningPublicKey {
+			t.Fatalf("unexpected public key: %s", publicKey)
+		}
+	}
+
+	p := env.config.GetClientParameters()
+	defaultRetryPeriod := p.Duration(parameters.FetchRemoteServerListRetryPeriod)
+	defaultStalePeriod := p.Duration(parameters.FetchRemoteServerListStalePeriod)
+	defaultUpgradeRetryPeriod := p.Duration(parameters.FetchUpgradeRetryPeriod)
+	p = nil
+
+	// Valid config overrides are applied.
+
+	setCommonRemoteServerList(`
+    {
+        "Version" : 1,
+        "ClientParameters" : {
+            "FetchRemoteServerListRetryPeriod" : "45s",
+            "FetchRemoteServerListStalePeriod" : "2h"
+        }
+    }`)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	if CountServerEntries() != 1 {
+		t.Fatalf("unexpected server entry count: %d", CountServerEntries())
+	}
+
+	checkParameters(45*time.Second, 2*time.Hour, defaultUpgradeRetryPeriod)
+
+	// Applying tactics retains the config overrides.
+
+	err = env.config.SetClientParameters(
+		"tag", true, map[string]interface{}{"FetchUpgradeRetryPeriod": "1m"})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	checkParameters(45*time.Second, 2*time.Hour, 1*time.Minute)
+
+	// Config overrides with non-safelisted parameters are rejected in their
+	// entirety, but the server list is still imported.
+
+	nonSafelistedConfigOverrides := fmt.Sprintf(`
+    {
+        "Version" : 2,
+        "ClientParameters" : {
+            "FetchRemoteServerListRetryPeriod" : "90s",
+            "RemoteServerListSignaturePublicKey" : "%s"
+        }
+    }`, defaultRetryPeriod)
+
+	err = env.config.ApplyConfigOverrides([]byte(nonSafelistedConfigOverrides))
+	if err == nil {
+		t.Fatalf("ApplyConfigOverrides unexpectedly succeeded")
+	}
+
+	setCommonRemoteServerList(nonSafelistedConfigOverrides)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	checkParameters(45*time.Second, 2*time.Hour, 1*time.Minute)
+
+	// Config overrides with invalid values are rejected.
+
+	err = env.config.ApplyConfigOverrides([]byte(`
+    {
+        "Version" : 2,
+        "ClientParameters" : {
+            "FetchRemoteServerListStalePeriod" : "1s"
+        }
+    }`))
+	if err == nil {
+		t.Fatalf("ApplyConfigOverrides unexpectedly succeeded")
+	}
+
+	checkParameters(45*time.Second, 2*time.Hour, 1*time.Minute)
+
+	// Config overrides with an older version are ignored.
+
+	setCommonRemoteServerList(`
+    {
+        "Version" : 1,
+        "ClientParameters" : {
+            "FetchRemoteServerListRetryPeriod" : "90s"
+        }
+    }`)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	checkParameters(45*time.Second, 2*time.Hour, 1*time.Minute)
+
+	// Newer config overrides replace, rather than merge with, the current
+	// config overrides.
+
+	setCommonRemoteServerList(`
+    {
+        "Version" : 3,
+        "ClientParameters" : {
+            "FetchRemoteServerListRetryPeriod" : "90s"
+        }
+    }`)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	checkParameters(90*time.Second, defaultStalePeriod, 1*time.Minute)
+
+	// Applied config overrides are reapplied after a restart, before any
+	// fetch, and remain applied when a fetch finds the server list, and its
+	// ETag, unchanged. Tactics aren't retained.
+
+	env.restart()
+
+	checkParameters(90*time.Second, defaultStalePeriod, defaultUpgradeRetryPeriod)
+
+	err = env.fetchCommon()
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+
+	checkParameters(90*time.Second, defaultStalePeriod, defaultUpgradeRetryPeriod)
+
+	// The version of the applied config overrides is retained after a
+	// restart, so older config overrides are still ignored.
+
+	err = env.config.ApplyConfigOverrides([]byte(`
+    {
+        "Version" : 2,
+        "ClientParameters" : {
+            "FetchRemoteServerListRetryPeriod" : "45s"
+        }
+    }`))
+	if err != nil {
+		t.Fatalf("ApplyConfigOverrides failed: %s", err)
+	}
+
+	checkParameters(90*time.Second, defaultStalePeriod, defaultUpgradeRetryPeriod)
+
+	// Stored config overrides which are no longer valid aren't applied after
+	// a restart, but their version is retained.
+
+	err = storeConfigOverrides([]byte(nonSafelistedConfigOverrides))
+	if err != nil {
+		t.Fatalf("storeConfigOverrides failed: %s", err)
+	}
+
+	env.restart()
+
+	checkParameters(defaultRetryPeriod, defaultStalePeriod, defaultUpgradeRetryPeriod)
+
+	err = env.config.ApplyConfigOverrides([]byte(`
+    {
+        "Version" : 1,
+        "ClientParameters" : {
+            "FetchRemoteServerListRetryPeriod" : "45s"
+        }
+    }`))
+	if err != nil {
+		t.Fatalf("ApplyConfigOverrides failed: %s", err)
+	}
+
+	checkParameters(defaultRetryPeriod, defaultStalePeriod, defaultUpgradeRetryPeriod)
+}
+
+const testCommonRemoteServerListName = "server_list_compressed"
+
+var testOSLSigningKeysOnce sync.Once
+var testOSLSigningPublicKey, testOSLSigningPrivateKey string
+
+// testOSLEnvironment paves a set of OSLs, one per scheme, each containing
+// distinct server entries, and serves the OSL files from a local HTTP server.
+// The client datastore is opened and seeded with the SLOKs required to
+// decrypt all of the OSLs. Fetches are made directly with
+// FetchObfuscatedServerLists, untunneled, without running a controller.
+type testOSLEnvironment struct {
+	t                    *testing.T
+	dataDirectory        string
+	propagationChannelID string
+	oslConfig            *osl.Config
+	oslIDs               []string
+	serverEntries        map[string][]string
+	server               *httptest.Server
+	configJSON           []byte
+	config               *Config
+	mutex                sync.Mutex
+	files                map[string][]byte
+	requests             map[string]int
+	requestAddrs         map[string]string
+	requestOrder         []string
+	requestHook          func(name string)
+	contentEncoding      string
+	omitETags            bool
+	weakETags            bool
+	etagPrefix           string
+	cacheControl         string
+	registryDelta        []byte
+	failRequests         int
+	truncateRequests     int
+}
+
+func newTestOSLEnvironment(
+	t *testing.T, oslCount, serverEntriesPerOSL int) *testOSLEnvironment {
+
+	testOSLSigningKeysOnce.Do(func() {
+		var err error
+		testOSLSigningPublicKey, testOSLSigningPrivateKey, err =
+			common.GenerateAuthenticatedDataPackageKeys()
+		if err != nil {
+			t.Fatalf("error generating package keys: %s", err)
+		}
+	})
+
+	dataDirectory, err := ioutil.TempDir("", "psiphon-osl-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+
+	env := &testOSLEnvironment{
+		t:             t,
+		dataDirectory: dataDirectory,
+		serverEntries: make(map[string][]string),
+		files:         make(map[string][]byte),
+		requests:      make(map[string]int),
+		requestAddrs:  make(map[string]string),
+	}
+
+	env.propagationChannelID, _ = common.MakeSecureRandomStringHex(8)
+
+	seedPeriod := 24 * time.Hour
+	epoch := time.Now().UTC().Truncate(seedPeriod)
+
+	schemeJSONTemplate := `
+        {
+          "Epoch" : "%s",
+          "Regions" : [],
+          "PropagationChannelIDs" : ["%s"],
+          "MasterKey" : "%s",
+          "SeedSpecs" : [
+            {
+              "ID" : "%s",
+              "UpstreamSubnets" : ["0.0.0.0/0"],
+              "Targets" :
+              {
+                  "BytesRead" : 1,
+                  "BytesWritten" : 1,
+                  "PortForwardDurationNanoseconds" : 1
+              }
+            }
+          ],
+          "SeedSpecThreshold" : 1,
+          "SeedPeriodNanoseconds" : %d,
+          "SeedPeriodKeySplits": [
+            {
+              "Total": 1,
+              "Threshold": 1
+            }
+          ]
+        }`
+
+	schemesJSON := make([]string, oslCount)
+	for i := 0; i < oslCount; i++ {
+		masterKey, _ := common.MakeSecureRandomBytes(32)
+		seedSpecID, _ := common.MakeSecureRandomBytes(32)
+		schemesJSON[i] = fmt.Sprintf(
+			schemeJSONTemplate,
+			epoch.Format(time.RFC3339Nano),
+			env.propagationChannelID,
+			base64.StdEncoding.EncodeToString(masterKey),
+			base64.StdEncoding.EncodeToString(seedSpecID),
+			seedPeriod)
+	}
+
+	env.oslConfig, err = osl.LoadConfig(
+		[]byte(fmt.Sprintf(`{"Schemes" : [%s]}`, strings.Join(schemesJSON, ","))))
+	if err != nil {
+		t.Fatalf("error loading OSL config: %s", err)
+	}
+
+	// First Pave() call is to get the OSL IDs to pave into
+
+	env.oslIDs = make([]string, oslCount)
+
+	_, err = env.oslConfig.Pave(
+		epoch,
+		env.propagationChannelID,
+		testOSLSigningPublicKey,
+		testOSLSigningPrivateKey,
+		map[string][]string{},
+		nil,
+		nil,
+		0,
+		func(logInfo *osl.PaveLogInfo) {
+			env.oslIDs[logInfo.SchemeIndex] = logInfo.OSLID
+		})
+	if err != nil {
+		t.Fatalf("error paving OSL files: %s", err)
+	}
+
+	regions := []string{"US", "CA", "GB", "DE"}
+
+	for i, oslID := range env.oslIDs {
+		for j := 0; j < serverEntriesPerOSL; j++ {
+			encodedServerEntry, err := protocol.EncodeServerEntry(
+				&protocol.ServerEntry{
+					IpAddress:         fmt.Sprintf("192.0.%d.%d", i+1, j+1),
+					WebServerPort:     "8000",
+					WebServerSecret:   "secret",
+					SshObfuscatedPort: 4001,
+					Capabilities:      []string{"OSSH"},
+					Region:            regions[(i+j)%len(regions)],
+				})
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+			env.serverEntries[oslID] = append(env.serverEntries[oslID], encodedServerEntry)
+		}
+	}
+
+	env.pave()
+
+	err = OpenDataStore(&Config{DataStoreDirectory: dataDirectory})
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+
+	env.seedSLOKs()
+
+	env.server = httptest.NewServer(http.HandlerFunc(env.handleRequest))
+
+	// OSL files are downloaded with the default concurrency; tests which
+	// depend on the order of OSL downloads call downloadSequentially.
+
+	clientConfigJSON := fmt.Sprintf(`
+    {
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DataStoreDirectory" : "%s",
+        "RemoteServerListSignaturePublicKey" : "%s",
+        "RemoteServerListURLs" : [{"URL" : "%s"}],
+        "RemoteServerListDownloadFilename" : "%s",
+        "ObfuscatedServerListRootURLs" : [{"URL" : "%s"}],
+        "ObfuscatedServerListDownloadDirectory" : "%s"
+    }`,
+		dataDirectory,
+		testOSLSigningPublicKey,
+		base64.StdEncoding.EncodeToString(
+			[]byte(env.server.URL+"/"+testCommonRemoteServerListName)),
+		filepath.Join(dataDirectory, testCommonRemoteServerListName),
+		base64.StdEncoding.EncodeToString([]byte(env.server.URL+"/")),
+		dataDirectory)
+
+	env.configJSON = []byte(clientConfigJSON)
+
+	env.config, err = LoadConfig(env.configJSON)
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+	err = env.config.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	return env
+}
+
+// pave (re)paves all OSLs with the current env.serverEntries and replaces
+// the files served by the HTTP server.
+func (env *testOSLEnvironment) pave() {
+
+	paveFiles, err := env.oslConfig.Pave(
+		time.Now().UTC().Truncate(24*time.Hour),
+		env.propagationChannelID,
+		testOSLSigningPublicKey,
+		testOSLSigningPrivateKey,
+		env.serverEntries,
+		nil,
+		nil,
+		0,
+		nil)
+	if err != nil {
+		env.t.Fatalf("error paving OSL files: %s", err)
+	}
+
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+
+	env.files = make(map[string][]byte)
+	for _, paveFile := range paveFiles {
+		env.files[paveFile.Name] = paveFile.Contents
+	}
+}
+
+func (env *testOSLEnvironment) seedSLOKs() {
+
+	seedState := env.oslConfig.NewClientSeedState("", env.propagationChannelID, nil)
+	seedPortForward := seedState.NewClientSeedPortForward(net.ParseIP("0.0.0.0"))
+	seedPortForward.UpdateProgress(1, 1, 1)
+	payload := seedState.GetSeedPayload()
+	if len(payload.SLOKs) != len(env.oslIDs) {
+		env.t.Fatalf("expected %d SLOKs, got %d", len(env.oslIDs), len(payload.SLOKs))
+	}
+
+	for _, slok := range payload.SLOKs {
+		_, err := SetSLOK(slok.ID, slok.Key)
+		if err != nil {
+			env.t.Fatalf("SetSLOK failed: %s", err)
+		}
+	}
+}
+
+func (env *testOSLEnvironment) handleRequest(w http.ResponseWriter, req *http.Request) {
+
+	name := strings.TrimPrefix(req.URL.Path, "/")
+
+	env.mutex.Lock()
+	env.requests[name] += 1
+	env.requestAddrs[name] = req.RemoteAddr
+	env.requestOrder = append(env.requestOrder, name)
+	contents, ok := env.files[name]
+	requestHook := env.requestHook
+	contentEncoding := env.contentEncoding
+	omitETags := env.omitETags
+	weakETags := env.weakETags
+	etagPrefix := env.etagPrefix
+	cacheControl := env.cacheControl
+	registryDelta := env.registryDelta
+	failRequest := env.failRequests > 0
+	if failRequest {
+		env.failRequests -= 1
+	}
+	truncateRequest := env.truncateRequests > 0
+	if truncateRequest {
+		env.truncateRequests -= 1
+	}
+	env.mutex.Unlock()
+
+	if requestHook != nil {
+		requestHook(name)
+	}
+
+	// When failRequests is set, simulate a network failure by closing the
+	// connection without sending a response.
+	if failRequest {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	// When registryDelta is set, serve the delta in place of the registry
+	// when the request advertises delta support.
+	contentType := "application/octet-stream"
+	if registryDelta != nil &&
+		name == osl.REGISTRY_FILENAME &&
+		strings.Contains(req.Header.Get("Accept"), osl.REGISTRY_DELTA_CONTENT_TYPE) {
+
+		contents = registryDelta
+		contentType = osl.REGISTRY_DELTA_CONTENT_TYPE
+	}
+
+	// When contentEncoding is set, simulate a host that applies a gzip or
+	// Brotli content coding regardless of the request Accept-Encoding.
+	switch contentEncoding {
+	case "gzip":
+		contents = gzipEncode(contents)
+		w.Header().Add("Content-Encoding", "gzip")
+	case "br":
+		var buffer bytes.Buffer
+		writer := brotli.NewWriter(&buffer)
+		writer.Write(contents)
+		writer.Close()
+		contents = buffer.Bytes()
+		w.Header().Add("Content-Encoding", "br")
+	}
+
+	md5sum := md5.Sum(contents)
+	w.Header().Add("Content-Type", contentType)
+	if !omitETags {
+		etag := fmt.Sprintf("\"%s%s\"", etagPrefix, hex.EncodeToString(md5sum[:]))
+		if weakETags {
+			etag = "W/" + etag
+		}
+		w.Header().Add("ETag", etag)
+	}
+	if cacheControl != "" {
+		w.Header().Add("Cache-Control", cacheControl)
+	}
+
+	// When truncateRequests is set, simulate a network failure mid-stream
+	// by closing the connection after sending half of the response body.
+	if truncateRequest {
+		w = &truncatingResponseWriter{
+			ResponseWriter: w,
+			remaining:      len(contents) / 2,
+		}
+	}
+
+	http.ServeContent(w, req, name, time.Time{}, bytes.NewReader(contents))
+}
+
+// truncatingResponseWriter writes at most remaining body bytes and then
+// aborts the response, closing the connection.
+type truncatingResponseWriter struct {
+	http.ResponseWriter
+	remaining int
+}
+
+func (w *truncatingResponseWriter) Write(b []byte) (int, error) {
+	if len(b) > w.remaining {
+		b = b[:w.remaining]
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.remaining -= n
+	if err == nil && w.remaining == 0 {
+		w.ResponseWriter.(http.Flusher).Flush()
+		conn, _, err := w.ResponseWriter.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return n, errors.New("truncated")
+	}
+	return n, err
+}
+
+func gzipEncode(contents []byte) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write(contents)
+	writer.Close()
+	return buffer.Bytes()
+}
+
+func (env *testOSLEnvironment) oslFileName(oslID string) string {
+	return fmt.Sprintf(osl.OSL_FILENAME_FORMAT, oslID)
+}
+
+func (env *testOSLEnvironment) getFile(name string) []byte {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	return env.files[name]
+}
+
+func (env *testOSLEnvironment) setFile(name string, contents []byte) {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	env.files[name] = contents
+}
+
+// rewriteRegistry applies update to the registry served by the HTTP server,
+// re-signing the modified registry.
+func (env *testOSLEnvironment) rewriteRegistry(update func(registry *osl.Registry)) {
+
+	encodedRegistry, err := common.ReadAuthenticatedDataPackage(
+		env.getFile(osl.REGISTRY_FILENAME), true, testOSLSigningPublicKey)
+	if err != nil {
+		env.t.Fatalf("ReadAuthenticatedDataPackage failed: %s", err)
+	}
+	registryJSON, err := base64.StdEncoding.DecodeString(encodedRegistry)
+	if err != nil {
+		env.t.Fatalf("DecodeString failed: %s", err)
+	}
+	var registry osl.Registry
+	err = json.Unmarshal(registryJSON, &registry)
+	if err != nil {
+		env.t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	update(&registry)
+
+	registryJSON, err = json.Marshal(&registry)
+	if err != nil {
+		env.t.Fatalf("Marshal failed: %s", err)
+	}
+	registryPackage, err := common.WriteAuthenticatedDataPackage(
+		base64.StdEncoding.EncodeToString(registryJSON),
+		testOSLSigningPublicKey,
+		testOSLSigningPrivateKey)
+	if err != nil {
+		env.t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+	env.setFile(osl.REGISTRY_FILENAME, registryPackage)
+}
+
+// setRegistryDelta signs and serves the specified registry delta.
+func (env *testOSLEnvironment) setRegistryDelta(delta *osl.RegistryDelta) {
+
+	deltaJSON, err := json.Marshal(delta)
+	if err != nil {
+		env.t.Fatalf("Marshal failed: %s", err)
+	}
+	deltaPackage, err := common.WriteAuthenticatedDataPackage(
+		base64.StdEncoding.EncodeToString(deltaJSON),
+		testOSLSigningPublicKey,
+		testOSLSigningPrivateKey)
+	if err != nil {
+		env.t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	env.registryDelta = deltaPackage
+}
+
+// fileETag returns the ETag with which the HTTP server serves the named file.
+func (env *testOSLEnvironment) fileETag(name string) string {
+	md5sum := md5.Sum(env.getFile(name))
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(md5sum[:]))
+}
+
+func (env *testOSLEnvironment) requestCount(name string) int {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	return env.requests[name]
+}
+
+// oslRequestOrder returns the names of the OSL files requested, in request
+// order, excluding the registry.
+// requestAddr returns the remote address of the most recent request for the
+// named file.
+func (env *testOSLEnvironment) requestAddr(name string) string {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	return env.requestAddrs[name]
+}
+
+func (env *testOSLEnvironment) oslRequestOrder() []string {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	var names []string
+	for _, name := range env.requestOrder {
+		if !strings.HasSuffix(name, osl.REGISTRY_FILENAME) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (env *testOSLEnvironment) fetch() error {
+	return FetchObfuscatedServerLists(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+}
+
+func (env *testOSLEnvironment) fetchCommon() error {
+	return FetchCommonRemoteServerList(
+		context.Background(), env.config, 0, nil, &DialConfig{})
+}
+
+// restart simulates a client restart, replacing env.config with a new Config
+// loaded from the same config file and reopening the datastore with the new
+// Config.
+func (env *testOSLEnvironment) restart() {
+
+	CloseDataStore()
+
+	config, err := LoadConfig(env.configJSON)
+	if err != nil {
+		env.t.Fatalf("error processing configuration file: %s", err)
+	}
+	config.ObfuscatedServerListDownloadConcurrency =
+		env.config.ObfuscatedServerListDownloadConcurrency
+	err = config.Commit()
+	if err != nil {
+		env.t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		env.t.Fatalf("error initializing client datastore: %s", err)
+	}
+
+	env.config = config
+}
+
+// downloadSequentially sets OSL files to be downloaded one at a time, for
+// tests which depend on the order of OSL downloads. The setting persists
+// through SetClientParameters and restart.
+func (env *testOSLEnvironment) downloadSequentially() {
+	concurrency := 1
+	env.config.ObfuscatedServerListDownloadConcurrency = &concurrency
+	err := env.config.SetClientParameters(
+		env.config.clientParametersTag,
+		env.config.clientParametersSkipOnError,
+		env.config.clientParametersApply)
+	if err != nil {
+		env.t.Fatalf("SetClientParameters failed: %s", err)
+	}
+}
+
+func (env *testOSLEnvironment) close() {
+	env.server.Close()
+	CloseDataStore()
+	os.RemoveAll(env.dataDirectory)
+}
+
+// testClock is a Clock that advances only when advance is called.
+type testClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (clock *testClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *testClock) advance(duration time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(duration)
+}
+
+// testNoticeRecorder records all notices, including diagnostic notices, for
+// inspection by tests.
+type testNoticeRecorder struct {
+	mutex   sync.Mutex
+	notices map[string][]map[string]interface{}
+}
+
+func startTestNoticeRecorder() *testNoticeRecorder {
+
+	recorder := &testNoticeRecorder{
+		notices: make(map[string][]map[string]interface{}),
+	}
+
+	SetEmitDiagnosticNotices(true)
+
+	SetNoticeWriter(NewNoticeReceiver(
+		func(notice []byte) {
+			noticeType, payload, err := GetNotice(notice)
+			if err != nil {
+				return
+			}
+			recorder.mutex.Lock()
+			recorder.notices[noticeType] = append(recorder.notices[noticeType], payload)
+			recorder.mutex.Unlock()
+		}))
+
+	return recorder
+}
+
+func (recorder *testNoticeRecorder) count(noticeType string) int {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	return len(recorder.notices[noticeType])
+}
+
+func (recorder *testNoticeRecorder) payloads(noticeType string) []map[string]interface{} {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	return append([]map[string]interface{}(nil), recorder.notices[noticeType]...)
+}
+
+// stop restores the default notice writer. Diagnostic notices are left
+// enabled, as TestMain enables them for all tests.
+func (recorder *testNoticeRecorder) stop() {
+	SetNoticeWriter(os.Stderr)
+}
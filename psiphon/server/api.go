@@ -469,6 +469,25 @@ func statusAPIRequestHandler(
 			}
 			remoteServerListFields["etag"] = etag
 
+			// Older clients may not submit the decompression ratio, and it's
+			// omitted for resources, such as OSL files, which aren't measured.
+
+			if decompressionRatio, ok := remoteServerListStat["decompression_ratio"].(float64); ok {
+				remoteServerListFields["decompression_ratio"] = decompressionRatio
+			}
+			if exceeded, ok := remoteServerListStat["decompression_ratio_exceeded"].(bool); ok {
+				remoteServerListFields["decompression_ratio_exceeded"] = exceeded
+			}
+
+			// The TLS parameters are submitted only for untunneled HTTPS
+			// downloads.
+
+			for _, name := range []string{"tls_version", "tls_cipher_suite"} {
+				if value, ok := remoteServerListStat[name].(string); ok {
+					remoteServerListFields[name] = value
+				}
+			}
+
 			logQueue = append(logQueue, remoteServerListFields)
 		}
 	}
@@ -561,7 +561,12 @@ func confirmStatusRequestPayload(payloadInfo *statusRequestPayloadInfo) {
 }
 
 // RecordRemoteServerListStat records a completed common or OSL
-// remote server list resource download.
+// remote server list resource download. decompressionRatio is the
+// measured ratio of decompressed to compressed size, or 0 when not
+// measured, and decompressionRatioExceeded flags a ratio beyond
+// RemoteServerListMaxDecompressionRatio. tlsVersion and tlsCipherSuite
+// are the negotiated TLS parameters of an untunneled HTTPS download,
+// and are blank otherwise.
 //
 // The RSL download event could occur when the client is unable
 // to immediately send a status request to a server, so these
@@ -589,16 +594,27 @@ func confirmStatusRequestPayload(payloadInfo *statusRequestPayloadInfo) {
 // processes a status request but the client fails to receive
 // the response.
 func RecordRemoteServerListStat(
-	url, etag string) error {
+	url, etag string,
+	decompressionRatio float64,
+	decompressionRatioExceeded bool,
+	tlsVersion, tlsCipherSuite string) error {
 
 	remoteServerListStat := struct {
-		ClientDownloadTimestamp string `json:"client_download_timestamp"`
-		URL                     string `json:"url"`
-		ETag                    string `json:"etag"`
+		ClientDownloadTimestamp    string  `json:"client_download_timestamp"`
+		URL                        string  `json:"url"`
+		ETag                       string  `json:"etag"`
+		DecompressionRatio         float64 `json:"decompression_ratio,omitempty"`
+		DecompressionRatioExceeded bool    `json:"decompression_ratio_exceeded,omitempty"`
+		TLSVersion                 string  `json:"tls_version,omitempty"`
+		TLSCipherSuite             string  `json:"tls_cipher_suite,omitempty"`
 	}{
 		common.TruncateTimestampToHour(common.GetCurrentTimestamp()),
 		url,
 		etag,
+		decompressionRatio,
+		decompressionRatioExceeded,
+		tlsVersion,
+		tlsCipherSuite,
 	}
 
 	remoteServerListStatJson, err := json.Marshal(remoteServerListStat)
@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// serverEntryIPFilter is the server entry IP address policy specified by
+// the config ServerEntryIPAllowlist and ServerEntryIPBlocklist. A server
+// entry is permitted when its IP address is in any allowlist network, or
+// when there is no allowlist, and is not in any blocklist network.
+type serverEntryIPFilter struct {
+	allowlist []*net.IPNet
+	blocklist []*net.IPNet
+}
+
+// newServerEntryIPFilter parses the allowlist and blocklist CIDRs. nil is
+// returned when both lists are empty.
+func newServerEntryIPFilter(
+	allowlist, blocklist []string) (*serverEntryIPFilter, error) {
+
+	if len(allowlist) == 0 && len(blocklist) == 0 {
+		return nil, nil
+	}
+
+	filter := &serverEntryIPFilter{}
+
+	var err error
+	filter.allowlist, err = parseServerEntryIPFilterCIDRs(allowlist)
+	if err != nil {
+		return nil, common.ContextError(
+			fmt.Errorf("invalid ServerEntryIPAllowlist: %s", err))
+	}
+	filter.blocklist, err = parseServerEntryIPFilterCIDRs(blocklist)
+	if err != nil {
+		return nil, common.ContextError(
+			fmt.Errorf("invalid ServerEntryIPBlocklist: %s", err))
+	}
+
+	return filter, nil
+}
+
+func parseServerEntryIPFilterCIDRs(CIDRs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(CIDRs))
+	for _, CIDR := range CIDRs {
+		_, network, err := net.ParseCIDR(CIDR)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// permits indicates whether the policy permits the server entry IP address.
+// An IP address which cannot be parsed is not permitted. A nil filter
+// permits all IP addresses.
+func (filter *serverEntryIPFilter) permits(ipAddress string) bool {
+
+	if filter == nil {
+		return true
+	}
+
+	IP := net.ParseIP(ipAddress)
+	if IP == nil {
+		return false
+	}
+
+	if len(filter.allowlist) > 0 && !serverEntryIPFilterContains(filter.allowlist, IP) {
+		return false
+	}
+
+	return !serverEntryIPFilterContains(filter.blocklist, IP)
+}
+
+func serverEntryIPFilterContains(networks []*net.IPNet, IP net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// serverEntryReachabilityProber selects a sample of the new server entries
+// created by an import and, when ProbeImportedServerEntries is set, probes
+// the reachability of the sampled server entries after the import and
+// records the results.
+type serverEntryReachabilityProber struct {
+	random       *rand.Rand
+	sampleSize   int
+	timeout      time.Duration
+	sample       []protocol.ServerEntryFields
+	createdCount int
+}
+
+// newServerEntryReachabilityProber returns a new prober, or nil when
+// ProbeImportedServerEntries is not set.
+func newServerEntryReachabilityProber(config *Config) *serverEntryReachabilityProber {
+
+	p := config.clientParameters.Get()
+	enabled := p.Bool(parameters.ProbeImportedServerEntries)
+	sampleSize := p.Int(parameters.ProbeImportedServerEntriesSampleSize)
+	timeout := p.Duration(parameters.ProbeImportedServerEntriesTimeout)
+	p = nil
+
+	if !enabled {
+		return nil
+	}
+
+	return &serverEntryReachabilityProber{
+		random:     config.entropy,
+		sampleSize: sampleSize,
+		timeout:    timeout,
+	}
+}
+
+// add records a new server entry. A uniform random sample of the new server
+// entries is selected using reservoir sampling.
+func (prober *serverEntryReachabilityProber) add(serverEntryFields protocol.ServerEntryFields) {
+
+	if prober == nil {
+		return
+	}
+
+	prober.createdCount += 1
+
+	if len(prober.sample) < prober.sampleSize {
+		prober.sample = append(prober.sample, serverEntryFields)
+	} else if j := prober.random.Intn(prober.createdCount); j < prober.sampleSize {
+		prober.sample[j] = serverEntryFields
+	}
+}
+
+// probe concurrently probes the sampled server entries, using untunneled
+// dials, and records the results. Failures to record results are not
+// reported as errors, as the import has already succeeded.
+func (prober *serverEntryReachabilityProber) probe(
+	ctx context.Context, config *Config, untunneledDialConfig *DialConfig) {
+
+	if prober == nil || len(prober.sample) == 0 {
+		return
+	}
+
+	var waitGroup sync.WaitGroup
+	var mutex sync.Mutex
+	reachableCount := 0
+
+	for _, serverEntryFields := range prober.sample {
+
+		waitGroup.Add(1)
+		go func(serverEntryFields protocol.ServerEntryFields) {
+			defer waitGroup.Done()
+
+			reachability := &ServerEntryReachability{
+				ProbeTimestamp: config.getCurrentTimestamp(),
+			}
+
+			endpoint, err := getServerEntryProbeEndpoint(serverEntryFields)
+			if err == nil {
+				reachability.Endpoint = endpoint
+				probeCtx, cancelFunc := context.WithTimeout(ctx, prober.timeout)
+				err = probeServerEntryEndpoint(probeCtx, untunneledDialConfig, endpoint)
+				cancelFunc()
+			}
+			if err != nil {
+				reachability.Error = common.ContextError(err).Error()
+			} else {
+				reachability.Reachable = true
+				mutex.Lock()
+				reachableCount += 1
+				mutex.Unlock()
+			}
+
+			err = setServerEntryReachability(
+				serverEntryFields.GetIPAddress(), reachability)
+			if err != nil {
+				noticeRemoteServerListAlert(config, "failed to record server entry reachability: %s", common.ContextError(err))
+			}
+		}(serverEntryFields)
+	}
+
+	waitGroup.Wait()
+
+	noticeRemoteServerListInfo(config, "probed %d new server entries: %d reachable", len(prober.sample), reachableCount)
+}
+
+// getServerEntryProbeEndpoint returns the TCP address to probe for the
+// server entry: the first advertised OSSH, SSH, or meek port.
+func getServerEntryProbeEndpoint(
+	serverEntryFields protocol.ServerEntryFields) (string, error) {
+
+	serverEntry, err := makeStreamedServerEntry(serverEntryFields)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	for _, port := range []int{
+		serverEntry.SshObfuscatedPort,
+		serverEntry.SshPort,
+		serverEntry.MeekServerPort} {
+
+		if port > 0 {
+			return net.JoinHostPort(serverEntry.IpAddress, strconv.Itoa(port)), nil
+		}
+	}
+
+	return "", common.ContextError(errors.New("no TCP endpoint"))
+}
+
+// probeServerEntryEndpoint makes a TCP connection to the endpoint, which is
+// immediately closed. It's a variable so that tests may substitute a mock
+// probe.
+var probeServerEntryEndpoint = func(
+	ctx context.Context, dialConfig *DialConfig, endpoint string) error {
+
+	conn, err := NewTCPDialer(dialConfig)(ctx, "tcp", endpoint)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	conn.Close()
+
+	return nil
+}
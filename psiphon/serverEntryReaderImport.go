@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// ImportServerEntriesFromReader imports the server entries in the
+// authenticated data package read from r, which may be any reader, such as
+// stdin, a pipe, or an embedded server list. This decouples the import from
+// remote server list downloads, for automation and testing.
+//
+// The package is validated as a downloaded common remote server list is,
+// with config.RemoteServerListSignaturePublicKey or the low trust signing
+// public key, and no server entries are imported when the signature doesn't
+// validate. The server entries are stored with the specified server entry
+// source, such as protocol.SERVER_ENTRY_SOURCE_REMOTE. Any config overrides
+// in the package are ignored.
+//
+// The package signature is verified before any of the payload is read,
+// which requires a second pass over the package. When r isn't an
+// io.ReadSeeker, the package is first copied to a temporary file in
+// config.DataStoreDirectory, which is deleted once the import completes.
+func ImportServerEntriesFromReader(config *Config, r io.Reader, source string) error {
+
+	err := checkSignaturePublicKey(config)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if !common.Contains([]string(protocol.SupportedServerEntrySources), source) {
+		return common.ContextError(
+			fmt.Errorf("invalid server entry source: %s", source))
+	}
+
+	dataPackage, ok := r.(io.ReadSeeker)
+	if !ok {
+
+		file, err := ioutil.TempFile(config.DataStoreDirectory, "import-server-entries-")
+		if err != nil {
+			return common.ContextError(err)
+		}
+		defer func() {
+			file.Close()
+			os.Remove(file.Name())
+		}()
+
+		_, err = io.Copy(file, r)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		dataPackage = file
+	}
+
+	publicKey, lowTrustPublicKey := getSignaturePublicKeys(config)
+
+	var serverListPayloadReader io.Reader
+	trustTier, err := validateWithTrustTiers(
+		publicKey,
+		lowTrustPublicKey,
+		func(signingPublicKey string) error {
+			var err error
+			serverListPayloadReader, _, err =
+				common.NewAuthenticatedDataPackageReaderWithDictionary(
+					dataPackage, signingPublicKey, config.serverEntryCompressionDictionary)
+			return err
+		})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	fetchTimestamp := config.getCurrentTimestamp()
+
+	serverEntryDecoder := newRemoteServerEntryDecoder(
+		config,
+		serverListPayloadReader,
+		fetchTimestamp,
+		source)
+
+	newEntries, err := streamingStoreServerEntries(
+		context.Background(),
+		config,
+		serverEntryDecoder,
+		true,
+		&ServerEntryProvenance{
+			Source:         source,
+			FetchTimestamp: fetchTimestamp,
+			TrustTier:      trustTier,
+		},
+		nil)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	NoticeInfo("imported %d new server entries from reader", newEntries)
+
+	return nil
+}
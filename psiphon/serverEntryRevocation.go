@@ -0,0 +1,231 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// ServerEntryRevocationList is the payload of the authenticated data package
+// fetched from Config.RemoteServerListRevocationURLs. ServerEntryIDs are the
+// IP addresses, the datastore keys, of the server entries to delete. Version
+// must increase with each new revocation list; a revocation list with a
+// version that is not greater than the version of the stored revocation
+// list is ignored, so an older revocation list can't be replayed.
+//
+// The stored revocation list is applied after each common remote server
+// list fetch, so a revoked server entry that's imported again is deleted
+// again.
+type ServerEntryRevocationList struct {
+	Version        int64
+	ServerEntryIDs []string
+}
+
+// getServerEntryRevocationListFilename returns the download filename for the
+// revocation list, which is co-located with the common remote server list
+// download.
+func getServerEntryRevocationListFilename(config *Config) string {
+	return config.RemoteServerListDownloadFilename + ".revocations"
+}
+
+// fetchServerEntryRevocationList downloads the revocation list from
+// RemoteServerListRevocationURLs, when configured, stores it when it's newer
+// than the stored revocation list, and then deletes the server entries
+// revoked by the stored revocation list.
+//
+// The revocation list must be signed with RemoteServerListSignaturePublicKey;
+// low trust signatures aren't accepted, as a revocation deletes server
+// entries of any trust tier.
+func fetchServerEntryRevocationList(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	downloadCache *remoteServerListDownloadCache,
+	telemetry *fetchTelemetryRecorder) error {
+
+	p := config.clientParameters.Get()
+	urls := p.DownloadURLs(parameters.RemoteServerListRevocationURLs)
+	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
+	p = nil
+
+	if len(urls) == 0 {
+		return nil
+	}
+
+	downloadURL, canonicalURL, skipVerify := urls.Select(attempt)
+
+	downloadFilename := getServerEntryRevocationListFilename(config)
+
+	newETag, _, err := downloadRemoteServerListFile(
+		ctx,
+		config,
+		tunnel,
+		untunneledDialConfig,
+		downloadTimeout,
+		downloadURL,
+		canonicalURL,
+		skipVerify,
+		urls.FallbackEndpoints(downloadURL),
+		urls.TLSConfig(downloadURL),
+		"",
+		downloadFilename,
+		nil,
+		remoteServerListDownloadOptions{
+			downloadCache: downloadCache,
+			telemetry:     telemetry,
+		})
+	if err != nil {
+		return fmt.Errorf("failed to download server entry revocation list: %s", common.ContextError(err))
+	}
+
+	// When the resource is unchanged, the stored revocation list is applied.
+	if newETag != "" {
+
+		revocationList, err := readServerEntryRevocationList(config, downloadFilename)
+		if err != nil {
+			return NewFetchFileError(downloadFilename, "", common.ContextError(err))
+		}
+
+		storedList, err := getServerEntryRevocationList(config)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		if storedList != nil && revocationList.Version <= storedList.Version {
+			noticeRemoteServerListInfo(config,
+				"ignoring server entry revocation list version %d, not newer than version %d",
+				revocationList.Version, storedList.Version)
+		} else {
+			err = setServerEntryRevocationList(config, revocationList)
+			if err != nil {
+				return common.ContextError(err)
+			}
+		}
+
+		err = setValidatedUrlETag(config, canonicalURL, newETag)
+		if err != nil {
+			noticeRemoteServerListAlert(config, "failed to set ETag for server entry revocation list: %s", common.ContextError(err))
+		}
+	}
+
+	return applyServerEntryRevocationList(config)
+}
+
+// readServerEntryRevocationList reads and authenticates the downloaded
+// revocation list.
+func readServerEntryRevocationList(
+	config *Config, filename string) (*ServerEntryRevocationList, error) {
+
+	dataPackage, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	publicKey, _ := getSignaturePublicKeys(config)
+
+	payload, err := common.ReadAuthenticatedDataPackage(dataPackage, true, publicKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var revocationList *ServerEntryRevocationList
+	err = json.Unmarshal([]byte(payload), &revocationList)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if revocationList == nil {
+		return nil, common.ContextError(errors.New("missing server entry revocation list"))
+	}
+
+	return revocationList, nil
+}
+
+// applyServerEntryRevocationList deletes the server entries revoked by the
+// stored revocation list.
+func applyServerEntryRevocationList(config *Config) error {
+
+	revocationList, err := getServerEntryRevocationList(config)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if revocationList == nil {
+		return nil
+	}
+
+	count, err := DeleteServerEntries(revocationList.ServerEntryIDs)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if count > 0 {
+		NoticeServerEntriesRevoked(revocationList.Version, count)
+	}
+
+	return nil
+}
+
+// getServerEntryRevocationList returns the revocation list stored in the
+// ServerListStore, or nil when there is none.
+func getServerEntryRevocationList(config *Config) (*ServerEntryRevocationList, error) {
+
+	value, err := config.getServerListStore().GetKeyValue(datastoreServerEntryRevocationListKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if value == "" {
+		return nil, nil
+	}
+
+	var revocationList *ServerEntryRevocationList
+	err = json.Unmarshal([]byte(value), &revocationList)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return revocationList, nil
+}
+
+func setServerEntryRevocationList(
+	config *Config, revocationList *ServerEntryRevocationList) error {
+
+	value, err := json.Marshal(revocationList)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = config.getServerListStore().SetKeyValue(datastoreServerEntryRevocationListKey, string(value))
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// ServerEntrySink defines the interface to an external provider which
+// mirrors imported server entries, such as an app's own server search
+// index. ServerEntryStored is called with each server entry stored by an
+// import; isNew is true when the server entry didn't previously exist and
+// false when an existing server entry was updated. Server entries which
+// are not stored, such as unchanged or dropped server entries, are not
+// delivered. ServerEntryStored must not block.
+type ServerEntrySink interface {
+	ServerEntryStored(serverEntry *protocol.ServerEntry, isNew bool)
+}
+
+// serverEntrySinkQueue holds the server entries stored by an import until
+// the import is committed, so that a ServerEntrySink doesn't receive server
+// entries which are rolled back when the import fails.
+type serverEntrySinkQueue struct {
+	sink   ServerEntrySink
+	events []serverEntrySinkEvent
+}
+
+type serverEntrySinkEvent struct {
+	serverEntryFields protocol.ServerEntryFields
+	isNew             bool
+}
+
+// newServerEntrySinkQueue returns a new queue, or nil when no
+// ServerEntrySink is configured.
+func newServerEntrySinkQueue(config *Config) *serverEntrySinkQueue {
+
+	if config.ServerEntrySink == nil {
+		return nil
+	}
+
+	return &serverEntrySinkQueue{
+		sink: config.ServerEntrySink,
+	}
+}
+
+// add records a stored server entry.
+func (queue *serverEntrySinkQueue) add(
+	serverEntryFields protocol.ServerEntryFields, isNew bool) {
+
+	if queue == nil {
+		return
+	}
+
+	queue.events = append(
+		queue.events,
+		serverEntrySinkEvent{
+			serverEntryFields: serverEntryFields,
+			isNew:             isNew,
+		})
+}
+
+// deliver delivers the recorded server entries to the ServerEntrySink, in
+// the order in which they were stored. deliver is to be called only once
+// the import is committed.
+func (queue *serverEntrySinkQueue) deliver() {
+
+	if queue == nil {
+		return
+	}
+
+	for _, event := range queue.events {
+		serverEntry, err := makeStreamedServerEntry(event.serverEntryFields)
+		if err != nil {
+			NoticeAlert("failed to deliver server entry to sink: %s", common.ContextError(err))
+			continue
+		}
+		queue.sink.ServerEntryStored(serverEntry, event.isNew)
+	}
+
+	queue.events = nil
+}
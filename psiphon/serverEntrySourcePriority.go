@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// GetServerEntrySourcePriority returns the server entry source priority
+// currently applied to server entry selection: the server entry sources,
+// such as protocol.SERVER_ENTRY_SOURCE_EMBEDDED, in the order in which the
+// server entry iterator yields their server entries. Server entries from
+// sources not in the list follow, and server entries from the same source
+// are in random order. With no source priority, the returned list is empty
+// and server entries from all sources are in random order.
+//
+// The server entry iterator always yields any affinity server first, and,
+// when PrioritizeHighTrustServerEntries is set, low trust server entries
+// last, regardless of the source priority.
+func (config *Config) GetServerEntrySourcePriority() []string {
+	p := config.clientParameters.Get()
+	sources := p.Strings(parameters.ServerEntrySourcePriority)
+	p = nil
+	return sources
+}
+
+// SetServerEntrySourcePriority sets Config.ServerEntrySourcePriority and
+// applies the new source priority to subsequent server entry selection.
+// The current tactics and config overrides remain applied, and tactics
+// which specify a source priority take precedence. If there is an error,
+// the existing source priority is left unmodified.
+func (config *Config) SetServerEntrySourcePriority(sources []string) error {
+
+	err := validateServerEntrySourcePriority(sources)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	config.clientParametersMutex.Lock()
+	defer config.clientParametersMutex.Unlock()
+
+	previousSources := config.ServerEntrySourcePriority
+	config.ServerEntrySourcePriority = append([]string(nil), sources...)
+
+	err = config.setClientParameters(
+		config.clientParametersTag,
+		config.clientParametersSkipOnError,
+		config.clientParametersApply,
+		config.configOverridesParameters)
+	if err != nil {
+		config.ServerEntrySourcePriority = previousSources
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// validateServerEntrySourcePriority checks that each source in a source
+// priority is a supported server entry source, listed once.
+func validateServerEntrySourcePriority(sources []string) error {
+
+	for i, source := range sources {
+		if !common.Contains([]string(protocol.SupportedServerEntrySources), source) {
+			return common.ContextError(
+				fmt.Errorf("invalid server entry source: %s", source))
+		}
+		if common.Contains(sources[:i], source) {
+			return common.ContextError(
+				fmt.Errorf("duplicate server entry source: %s", source))
+		}
+	}
+
+	return nil
+}
+
+// prioritizeServerEntrySources reorders serverEntryIDs by the source
+// priority, retaining the existing order of server entries with the same
+// priority. Server entries from sources not in the priority, including
+// sources which aren't supported, follow all prioritized server entries.
+func prioritizeServerEntrySources(
+	serverEntriesBucket *datastoreBucket, serverEntryIDs [][]byte, sources []string) {
+
+	if len(sources) == 0 {
+		return
+	}
+
+	priorities := make(map[string]int)
+	for i, source := range sources {
+		if _, ok := priorities[source]; !ok {
+			priorities[source] = i
+		}
+	}
+
+	prioritized := make([][][]byte, len(sources)+1)
+	for _, serverEntryID := range serverEntryIDs {
+		priority, ok := priorities[getStoredServerEntrySource(
+			serverEntriesBucket.get(serverEntryID))]
+		if !ok {
+			priority = len(sources)
+		}
+		prioritized[priority] = append(prioritized[priority], serverEntryID)
+	}
+
+	n := 0
+	for _, priorityServerEntryIDs := range prioritized {
+		n += copy(serverEntryIDs[n:], priorityServerEntryIDs)
+	}
+}
+
+// getStoredServerEntrySource returns the local source of the marshaled
+// server entry, as stored in the server entries bucket.
+func getStoredServerEntrySource(serverEntryData []byte) string {
+
+	if serverEntryData == nil {
+		return ""
+	}
+
+	var serverEntry struct {
+		LocalSource string `json:"localSource"`
+	}
+	err := json.Unmarshal(serverEntryData, &serverEntry)
+	if err != nil {
+		return ""
+	}
+
+	return serverEntry.LocalSource
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// Server entry trust tiers distinguish server entries by the signing key
+// that validated them. Server entries validated with
+// RemoteServerListSignaturePublicKey, and server entries with no signature,
+// such as embedded server entries, are high trust. Server entries validated
+// with RemoteServerListLowTrustSignaturePublicKey are low trust.
+const (
+	SERVER_ENTRY_TRUST_TIER_HIGH = "HIGH"
+	SERVER_ENTRY_TRUST_TIER_LOW  = "LOW"
+)
+
+// getSignaturePublicKeys returns the high and low trust signing public keys
+// from the current client parameters snapshot. Fetches call this before
+// validating each downloaded file, rather than once at the start of the
+// fetch, so that a key rotation applied mid-fetch with SetClientParameters
+// is honored for all subsequently validated files.
+func getSignaturePublicKeys(config *Config) (string, string) {
+	p := config.clientParameters.Get()
+	publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
+	lowTrustPublicKey := p.String(parameters.RemoteServerListLowTrustSignaturePublicKey)
+	p = nil
+	return publicKey, lowTrustPublicKey
+}
+
+// checkSignaturePublicKey returns an error when no
+// RemoteServerListSignaturePublicKey is specified. Without the key, every
+// downloaded file fails validation, so fetches and imports call this first
+// to fail early with a clear error instead of failing each download and
+// discarding each staged file.
+func checkSignaturePublicKey(config *Config) error {
+	publicKey, _ := getSignaturePublicKeys(config)
+	if publicKey == "" {
+		return common.ContextError(errors.New(
+			"missing RemoteServerListSignaturePublicKey: remote server list signatures can't be validated"))
+	}
+	return nil
+}
+
+// validateWithTrustTiers calls validate with the high trust signing public
+// key and, when that fails and a low trust signing public key is specified,
+// with the low trust signing public key. The trust tier of the key which
+// validated the payload is returned. When neither key validates the payload,
+// the high trust validation error is returned.
+func validateWithTrustTiers(
+	publicKey string,
+	lowTrustPublicKey string,
+	validate func(signingPublicKey string) error) (string, error) {
+
+	err := validate(publicKey)
+	if err == nil {
+		return SERVER_ENTRY_TRUST_TIER_HIGH, nil
+	}
+
+	if lowTrustPublicKey == "" || validate(lowTrustPublicKey) != nil {
+		return "", common.ContextError(err)
+	}
+
+	return SERVER_ENTRY_TRUST_TIER_LOW, nil
+}
+
+// GetServerEntryTrustTier returns the trust tier of the stored server entry
+// with the specified IP address. SERVER_ENTRY_TRUST_TIER_HIGH is returned
+// when the server entry has no recorded trust tier.
+func GetServerEntryTrustTier(ipAddress string) (string, error) {
+
+	provenance, err := GetServerEntryProvenance(ipAddress)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	return getProvenanceTrustTier(provenance), nil
+}
+
+// getStoredServerEntryTrustTier returns the trust tier recorded in the
+// marshaled provenance, as stored in the provenance bucket.
+func getStoredServerEntryTrustTier(provenanceData []byte) string {
+
+	if provenanceData == nil {
+		return SERVER_ENTRY_TRUST_TIER_HIGH
+	}
+
+	var provenance *ServerEntryProvenance
+	err := json.Unmarshal(provenanceData, &provenance)
+	if err != nil {
+		return SERVER_ENTRY_TRUST_TIER_HIGH
+	}
+
+	return getProvenanceTrustTier(provenance)
+}
+
+func getProvenanceTrustTier(provenance *ServerEntryProvenance) string {
+	if provenance == nil || provenance.TrustTier == "" {
+		return SERVER_ENTRY_TRUST_TIER_HIGH
+	}
+	return provenance.TrustTier
+}
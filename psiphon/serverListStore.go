@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2019, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// ServerListStore is the storage used by remote server list fetches: the
+// ETags of downloaded resources, key/value records such as the server entry
+// revocation list, SLOKs for OSL key reassembly, and the imported server
+// entries. By default, fetches use the local datastore; an integrator may
+// set Config.ServerListStore to fetch into another store, such as an
+// in-memory store in tools and tests.
+//
+// Only these operations are routed through the ServerListStore. Fetch
+// bookkeeping, including validation times, OSL import generations, fetch
+// plans, quarantine records, and fetch stats, remains in the local
+// datastore, which must still be open; revoked server entries are also
+// deleted from the local datastore.
+//
+// The ETagStore methods follow the ETagStore contract. GetKeyValue must
+// return an empty string, and no error, when no value is stored for the
+// key, and GetSLOK must return nil, and no error, when the SLOK isn't
+// stored. Implementations must be safe for concurrent use.
+type ServerListStore interface {
+	ETagStore
+
+	GetKeyValue(key string) (string, error)
+	SetKeyValue(key, value string) error
+
+	GetSLOK(id []byte) ([]byte, error)
+
+	// StoreServerEntries stores the server entries read from serverEntries,
+	// replacing any stored server entries with the same IP addresses, and
+	// returns the number of server entries which weren't already stored.
+	// newServerEntry, when not nil, is called with each such server entry.
+	// When ctx is cancelled, StoreServerEntries should stop and return the
+	// context error.
+	StoreServerEntries(
+		ctx context.Context,
+		serverEntries *protocol.StreamingServerEntryDecoder,
+		provenance *ServerEntryProvenance,
+		newServerEntry func(protocol.ServerEntryFields)) (int, error)
+}
+
+// getServerListStore returns Config.ServerListStore, when set, or else the
+// default datastore-backed store.
+func (config *Config) getServerListStore() ServerListStore {
+	if config.ServerListStore != nil {
+		return config.ServerListStore
+	}
+	return &datastoreServerListStore{config: config}
+}
+
+// datastoreServerListStore is the default ServerListStore, which wraps the
+// local datastore. ETags are stored using the ETagStore set by
+// SetETagStore, and server entries are imported as by
+// StreamingStoreServerEntriesWithProvenance.
+type datastoreServerListStore struct {
+	config *Config
+}
+
+func (store *datastoreServerListStore) GetUrlETag(url string) (string, error) {
+	return GetUrlETag(url)
+}
+
+func (store *datastoreServerListStore) SetUrlETag(url, etag string) error {
+	return SetUrlETag(url, etag)
+}
+
+func (store *datastoreServerListStore) GetKeyValue(key string) (string, error) {
+	return GetKeyValue(key)
+}
+
+func (store *datastoreServerListStore) SetKeyValue(key, value string) error {
+	return SetKeyValue(key, value)
+}
+
+func (store *datastoreServerListStore) GetSLOK(id []byte) ([]byte, error) {
+	return getSLOK(id)
+}
+
+func (store *datastoreServerListStore) StoreServerEntries(
+	ctx context.Context,
+	serverEntries *protocol.StreamingServerEntryDecoder,
+	provenance *ServerEntryProvenance,
+	newServerEntry func(protocol.ServerEntryFields)) (int, error) {
+
+	return streamingStoreServerEntries(
+		ctx, store.config, serverEntries, true, provenance, newServerEntry)
+}
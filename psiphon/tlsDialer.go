@@ -55,9 +55,11 @@ package psiphon
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"time"
@@ -122,6 +124,12 @@ type CustomTLSConfig struct {
 	// using the specified key.
 	ObfuscatedSessionTicketKey string
 
+	// MinVersion specifies the minimum TLS version to accept. When set, the
+	// dial fails when the handshake negotiates a lower version. As TLS
+	// profiles determine the versions offered by the client, this is
+	// checked after the handshake.
+	MinVersion uint16
+
 	utlsClientSessionCache utls.ClientSessionCache
 	trisClientSessionCache tris.ClientSessionCache
 }
@@ -205,6 +213,8 @@ type tlsConn interface {
 	Handshake() error
 	GetPeerCertificates() []*x509.Certificate
 	IsHTTP2() bool
+	GetVersionAndCipherSuite() (uint16, uint16)
+	GetApplicationProtocols() ([]string, string)
 }
 
 type utlsConn struct {
@@ -221,6 +231,19 @@ func (conn *utlsConn) IsHTTP2() bool {
 		state.NegotiatedProtocol == "h2"
 }
 
+func (conn *utlsConn) GetVersionAndCipherSuite() (uint16, uint16) {
+	state := conn.UConn.ConnectionState()
+	return state.Version, state.CipherSuite
+}
+
+func (conn *utlsConn) GetApplicationProtocols() ([]string, string) {
+	var offered []string
+	if conn.UConn.HandshakeState.Hello != nil {
+		offered = conn.UConn.HandshakeState.Hello.AlpnProtocols
+	}
+	return offered, conn.UConn.ConnectionState().NegotiatedProtocol
+}
+
 type trisConn struct {
 	*tris.Conn
 }
@@ -235,6 +258,17 @@ func (conn *trisConn) IsHTTP2() bool {
 		state.NegotiatedProtocol == "h2"
 }
 
+func (conn *trisConn) GetVersionAndCipherSuite() (uint16, uint16) {
+	state := conn.Conn.ConnectionState()
+	return state.Version, state.CipherSuite
+}
+
+func (conn *trisConn) GetApplicationProtocols() ([]string, string) {
+	// CustomTLSDial doesn't configure ALPN for tris, so no application
+	// protocols are offered.
+	return nil, conn.Conn.ConnectionState().NegotiatedProtocol
+}
+
 func IsTLSConnUsingHTTP2(conn net.Conn) bool {
 	if c, ok := conn.(tlsConn); ok {
 		return c.IsHTTP2()
@@ -242,6 +276,90 @@ func IsTLSConnUsingHTTP2(conn net.Conn) bool {
 	return false
 }
 
+// GetTLSConnVersionAndCipherSuite returns the names of the negotiated TLS
+// version and cipher suite of a connection established by CustomTLSDial.
+// The return value ok is false when conn is not such a connection.
+func GetTLSConnVersionAndCipherSuite(conn net.Conn) (string, string, bool) {
+	c, ok := conn.(tlsConn)
+	if !ok {
+		return "", "", false
+	}
+	version, cipherSuite := c.GetVersionAndCipherSuite()
+
+	return getTLSVersionName(version), getTLSCipherSuiteName(cipherSuite), true
+}
+
+// utls and tris use the standard IANA TLS version and cipher suite values.
+// The names follow those of crypto/tls in later Go versions. Unknown values
+// are named by their hex value.
+
+// tlsVersionTLS13 is the TLS 1.3 version value, which crypto/tls defines
+// only in later Go versions.
+const tlsVersionTLS13 = 0x0304
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionSSL30: "SSL 3.0",
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tlsVersionTLS13:  "TLS 1.3",
+}
+
+var tlsCipherSuiteNames = map[uint16]string{
+	tls.TLS_RSA_WITH_RC4_128_SHA:                "TLS_RSA_WITH_RC4_128_SHA",
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:           "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            "TLS_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            "TLS_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:         "TLS_RSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:        "TLS_ECDHE_ECDSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA:          "TLS_ECDHE_RSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:     "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305:    "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:  "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	0x1301: "TLS_AES_128_GCM_SHA256",
+	0x1302: "TLS_AES_256_GCM_SHA384",
+	0x1303: "TLS_CHACHA20_POLY1305_SHA256",
+}
+
+func getTLSVersionName(version uint16) string {
+	if name, ok := tlsVersionNames[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+func getTLSCipherSuiteName(cipherSuite uint16) string {
+	if name, ok := tlsCipherSuiteNames[cipherSuite]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", cipherSuite)
+}
+
+// GetTLSConnApplicationProtocols returns the ALPN application protocols
+// offered by the client and the negotiated application protocol of a
+// connection established by CustomTLSDial. The return value ok is false when
+// conn is not such a connection.
+func GetTLSConnApplicationProtocols(conn net.Conn) ([]string, string, bool) {
+	c, ok := conn.(tlsConn)
+	if !ok {
+		return nil, "", false
+	}
+	offered, negotiated := c.GetApplicationProtocols()
+	return offered, negotiated, true
+}
+
 // NewCustomTLSDialer creates a new dialer based on CustomTLSDial.
 func NewCustomTLSDialer(config *CustomTLSConfig) Dialer {
 	return func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -414,6 +532,14 @@ func CustomTLSDial(
 		<-resultChannel
 	}
 
+	if err == nil && config.MinVersion != 0 {
+		version, _ := conn.GetVersionAndCipherSuite()
+		if version < config.MinVersion {
+			err = fmt.Errorf(
+				"unsupported TLS version: %s", getTLSVersionName(version))
+		}
+	}
+
 	if err == nil && !config.SkipVerify && tlsConfigInsecureSkipVerify {
 
 		if config.VerifyLegacyCertificate != nil {
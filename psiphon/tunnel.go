@@ -30,6 +30,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"net/url"
 	"sync"
 	"sync/atomic"
@@ -106,6 +107,8 @@ type Tunnel struct {
 	establishDuration          time.Duration
 	establishedTime            monotime.Time
 	dialStats                  *DialStats
+
+	remoteServerListHTTPClients *remoteServerListHTTPClients
 }
 
 // DialStats records additional dial config that is sent to the server for
@@ -346,7 +349,51 @@ func (tunnel *Tunnel) Close(isDiscarded bool) {
 		if err != nil {
 			NoticeAlert("close tunnel ssh error: %s", err)
 		}
+
+		tunnel.mutex.Lock()
+		remoteServerListHTTPClients := tunnel.remoteServerListHTTPClients
+		tunnel.mutex.Unlock()
+		if remoteServerListHTTPClients != nil {
+			remoteServerListHTTPClients.closeIdleConnections()
+		}
+	}
+}
+
+// getRemoteServerListHTTPClient returns the tunneled HTTP client shared by
+// all remote server list downloads through this tunnel. Concurrent common
+// and obfuscated server list fetches through the same tunnel share the
+// client's connection pool.
+func (tunnel *Tunnel) getRemoteServerListHTTPClient(skipVerify bool) (*http.Client, error) {
+
+	tunnel.mutex.Lock()
+	if tunnel.remoteServerListHTTPClients == nil {
+		p := tunnel.config.clientParameters.Get()
+		maxConnections := p.Int(parameters.RemoteServerListFetchMaxConnections)
+		connectTimeout := p.Duration(parameters.RemoteServerListConnectTimeout)
+		p = nil
+		tunnel.remoteServerListHTTPClients = newRemoteServerListHTTPClients(
+			maxConnections,
+			func(skipVerify bool) (*http.Client, error) {
+				httpClient, err := MakeDownloadHTTPClient(
+					context.Background(), tunnel.config, tunnel, nil, skipVerify)
+				if err != nil {
+					return nil, common.ContextError(err)
+				}
+				if connectTimeout > 0 {
+					setDownloadConnectTimeout(httpClient, connectTimeout)
+				}
+				return httpClient, nil
+			})
+	}
+	remoteServerListHTTPClients := tunnel.remoteServerListHTTPClients
+	tunnel.mutex.Unlock()
+
+	httpClient, err := remoteServerListHTTPClients.get(skipVerify)
+	if err != nil {
+		return nil, common.ContextError(err)
 	}
+
+	return httpClient, nil
 }
 
 // IsActivated returns the tunnel's activated flag.
@@ -356,6 +403,13 @@ func (tunnel *Tunnel) IsActivated() bool {
 	return tunnel.isActivated
 }
 
+// IsClosed returns the tunnel's closed flag.
+func (tunnel *Tunnel) IsClosed() bool {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.isClosed
+}
+
 // IsDiscarded returns the tunnel's discarded flag.
 func (tunnel *Tunnel) IsDiscarded() bool {
 	tunnel.mutex.Lock()
@@ -87,6 +87,13 @@ func DownloadUpgrade(
 
 	downloadURL, _, skipVerify := urls.Select(attempt)
 
+	if tunnel == nil {
+		err := checkUntunneledDownload(config, downloadURL)
+		if err != nil {
+			return err
+		}
+	}
+
 	httpClient, err := MakeDownloadHTTPClient(
 		ctx,
 		config,
@@ -24,11 +24,14 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
 	"net"
 	"net/url"
 	"os"
 	"runtime"
 	"runtime/debug"
+	"sync"
 	"syscall"
 	"time"
 
@@ -206,3 +209,33 @@ func DoGarbageCollection() {
 	debug.SetGCPercent(5)
 	debug.FreeOSMemory()
 }
+
+// lockedRandSource is a rand.Source which serializes access to the wrapped
+// source, which need not be safe for concurrent use.
+type lockedRandSource struct {
+	mutex  sync.Mutex
+	source rand.Source
+}
+
+func (r *lockedRandSource) Int63() int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.source.Int63()
+}
+
+func (r *lockedRandSource) Seed(seed int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.source.Seed(seed)
+}
+
+// jitterDuration returns d +/- the given factor, using random.
+func jitterDuration(
+	random *rand.Rand, d time.Duration, factor float64) time.Duration {
+
+	a := int64(math.Ceil(float64(d) * factor))
+	if a <= 0 {
+		return d
+	}
+	return d + time.Duration(random.Int63n(2*a+1)-a)
+}